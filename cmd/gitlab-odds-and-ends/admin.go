@@ -0,0 +1,85 @@
+package main
+
+import (
+	"expvar"
+	"net/http"
+	"net/http/pprof"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	ADMIN_USERNAME_ENV_VAR     = "ADMIN_USERNAME"
+	ADMIN_PASSWORD_ENV_VAR     = "ADMIN_PASSWORD"
+	DEFAULT_ADMIN_LISTEN_ADDRS = "127.0.0.1:9090"
+)
+
+// healthRouter serves `GET /healthz`, for load balancers and orchestrators
+func healthRouter(c *gin.Context) {
+	c.String(http.StatusOK, "ok")
+}
+
+// adminServer builds the admin listener's router: reports, prometheus metrics at `/metrics`, recent webhooks at
+// `/debug/events`, runtime metrics at `/debug/vars`, and pprof at `/debug/pprof/`.  everything but the health check needs the admin credentials when
+// they're set, and without them the admin API only reads: nothing that changes the bot's config or acts on MRs is served,
+// and neither is what says who did what: the recent webhooks, on the dashboard too, the audit log and people's preferences
+func (bot bot) adminServer(username, password string) *gin.Engine {
+	admin := gin.Default()
+	admin.GET("/healthz", healthRouter)
+	authed := admin.Group("/")
+	credentialed := username != "" && password != ""
+	if credentialed {
+		authed.Use(gin.BasicAuth(gin.Accounts{username: password}))
+	} else {
+		logrus.Warn("no admin credentials set, admin endpoints are open to anything that can reach the admin listener, " +
+			"so the admin API's PUT, DELETE and POST endpoints aren't served")
+	}
+	authed.GET("/reports/reviewer-load", bot.reviewerLoadRouter)
+	authed.GET("/reports/cycle-time", bot.cycleTimeRouter)
+	authed.GET("/reports/dora", bot.doraRouter)
+	authed.GET("/metrics", bot.metricsRouter)
+	authed.GET("/dashboard", bot.dashboardRouter(credentialed))
+	authed.GET("/gitlab/oauth/authorize", bot.gitlabOAuthAuthorizeRouter)
+	authed.GET("/admin/projects", bot.adminProjectsRouter)
+	authed.GET("/admin/projects/*project", bot.adminProjectRouter)
+	authed.GET("/admin/policies", bot.adminPoliciesRouter)
+	authed.GET("/admin/policies/:topic", bot.adminPolicyRouter)
+	if credentialed {
+		authed.PUT("/admin/projects/*project", bot.adminPutProjectRouter)
+		authed.DELETE("/admin/projects/*project", bot.adminDeleteProjectRouter)
+		authed.POST("/admin/backfill", bot.adminBackfillRouter)
+		authed.PUT("/admin/policies/:topic", bot.adminPutPolicyRouter)
+		authed.DELETE("/admin/policies/:topic", bot.adminDeletePolicyRouter)
+		authed.PUT("/admin/preferences/:user", bot.adminPutPreferencesRouter)
+		authed.DELETE("/admin/preferences/:user", bot.adminDeletePreferencesRouter)
+	}
+	if simulateEnabled() {
+		if !credentialed {
+			logrus.Warnf("%s needs the admin credentials set, not serving /debug/simulate", DEBUG_SIMULATE_ENV_VAR)
+		} else {
+			authed.POST("/debug/simulate", bot.simulateRouter)
+		}
+	}
+	// the webhooks' payloads are in there, e.g. MRs of private projects, and the audit log and preferences say who
+	// did what and how they want to hear about it
+	if credentialed {
+		authed.GET("/debug/events", bot.debugEventsRouter)
+		authed.GET("/audit", bot.auditRouter)
+		authed.GET("/admin/preferences", bot.adminPreferencesRouter)
+		authed.GET("/admin/preferences/:user", bot.adminUserPreferencesRouter)
+	} else {
+		logrus.Warn("/debug/events, /audit and /admin/preferences need the admin credentials set, not serving them, " +
+			"nor the dashboard's recent webhooks")
+	}
+	authed.GET("/debug/vars", gin.WrapH(expvar.Handler()))
+	authed.GET("/debug/pprof/", gin.WrapF(pprof.Index))
+	authed.GET("/debug/pprof/cmdline", gin.WrapF(pprof.Cmdline))
+	authed.GET("/debug/pprof/profile", gin.WrapF(pprof.Profile))
+	authed.GET("/debug/pprof/symbol", gin.WrapF(pprof.Symbol))
+	authed.GET("/debug/pprof/trace", gin.WrapF(pprof.Trace))
+	authed.GET("/debug/pprof/:profile", func(c *gin.Context) {
+		pprof.Handler(c.Param("profile")).ServeHTTP(c.Writer, c.Request)
+	})
+	return admin
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	ADMIN_OVERRIDES_STORE_KEY = "admin_overrides"
+	ADMIN_SOURCE_CONFIG       = "config"
+	ADMIN_SOURCE_API          = "api"
+)
+
+// errNoOverride is deleting a project or policy the admin API didn't set
+var errNoOverride = errors.New("not set through the admin API")
+
+// adminOverrides are the projects and policies set through the admin API.  they're kept in the store and take the
+// place of the config file's entry for the same project or topic, so the file can still be edited and reloaded
+type adminOverrides struct {
+	Projects map[string]projectConfig `json:"projects"`
+	Policies map[string]policyConfig  `json:"policies"`
+}
+
+func (o adminOverrides) copy() adminOverrides {
+	c := adminOverrides{Projects: make(map[string]projectConfig), Policies: make(map[string]policyConfig)}
+	for k, v := range o.Projects {
+		c.Projects[k] = v
+	}
+	for k, v := range o.Policies {
+		c.Policies[k] = v
+	}
+	return c
+}
+
+// merge returns the config file with the overrides on top.  overridden entries keep their place, since the first
+// matching policy wins, and new ones go after the file's
+func (o adminOverrides) merge(file *botConfig) *botConfig {
+	cfg := *file
+	cfg.Projects = nil
+	seen := make(map[string]bool)
+	for _, p := range file.Projects {
+		if override, ok := o.Projects[p.Project]; ok {
+			p = override
+		}
+		seen[p.Project] = true
+		cfg.Projects = append(cfg.Projects, p)
+	}
+	var paths []string
+	for path := range o.Projects {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	for _, path := range paths {
+		if !seen[path] {
+			cfg.Projects = append(cfg.Projects, o.Projects[path])
+		}
+	}
+
+	cfg.Policies = nil
+	seen = make(map[string]bool)
+	for _, p := range file.Policies {
+		if override, ok := o.Policies[p.Topic]; ok {
+			p = override
+		}
+		seen[p.Topic] = true
+		cfg.Policies = append(cfg.Policies, p)
+	}
+	var topics []string
+	for topic := range o.Policies {
+		topics = append(topics, topic)
+	}
+	sort.Strings(topics)
+	for _, topic := range topics {
+		if !seen[topic] {
+			cfg.Policies = append(cfg.Policies, o.Policies[topic])
+		}
+	}
+	return &cfg
+}
+
+// adminProject is a project as the admin API shows it, in the config file's format
+type adminProject struct {
+	projectConfig `yaml:",inline"`
+	// Source is whether the project comes from the config file or the admin API
+	Source string `yaml:"source"`
+}
+
+type adminPolicy struct {
+	policyConfig `yaml:",inline"`
+	Source       string `yaml:"source"`
+}
+
+func adminSource(overridden bool) string {
+	if overridden {
+		return ADMIN_SOURCE_API
+	}
+	return ADMIN_SOURCE_CONFIG
+}
+
+// adminProjectsRouter lists the projects in effect, from the config file and the admin API
+func (bot bot) adminProjectsRouter(c *gin.Context) {
+	cfg, overrides := bot.reloader.current()
+	projects := []adminProject{}
+	for _, p := range cfg.Projects {
+		_, overridden := overrides.Projects[p.Project]
+		projects = append(projects, adminProject{projectConfig: p, Source: adminSource(overridden)})
+	}
+	c.YAML(http.StatusOK, projects)
+}
+
+// adminProjectRouter shows one project.  its path with namespace follows `/admin/projects/`
+func (bot bot) adminProjectRouter(c *gin.Context) {
+	path := strings.Trim(c.Param("project"), "/")
+	cfg, overrides := bot.reloader.current()
+	for _, p := range cfg.Projects {
+		if p.Project == path {
+			_, overridden := overrides.Projects[path]
+			c.YAML(http.StatusOK, adminProject{projectConfig: p, Source: adminSource(overridden)})
+			return
+		}
+	}
+	http.Error(c.Writer, fmt.Sprintf("project %s isn't configured", path), http.StatusNotFound)
+}
+
+// adminPutProjectRouter enrolls a project, or replaces its settings.  the body is the project's entry in the config
+// file's format, as YAML or JSON, e.g. `{"channels": ["C0123456789"], "policy": "tier-1"}`
+func (bot bot) adminPutProjectRouter(c *gin.Context) {
+	path := strings.Trim(c.Param("project"), "/")
+	var project projectConfig
+	if !bindAdminBody(c, &project) {
+		return
+	}
+	if path == "" {
+		http.Error(c.Writer, "missing project path", http.StatusBadRequest)
+		return
+	}
+	project.Project = path
+	err := bot.reloader.change(func(o *adminOverrides) error {
+		o.Projects[path] = project
+		return nil
+	})
+	bot.adminChanged(c, "admin_project_put", path, err)
+}
+
+// adminDeleteProjectRouter removes a project set through the admin API.  if the config file has it too, that applies again
+func (bot bot) adminDeleteProjectRouter(c *gin.Context) {
+	path := strings.Trim(c.Param("project"), "/")
+	err := bot.reloader.change(func(o *adminOverrides) error {
+		if _, ok := o.Projects[path]; !ok {
+			return errNoOverride
+		}
+		delete(o.Projects, path)
+		return nil
+	})
+	bot.adminChanged(c, "admin_project_delete", path, err)
+}
+
+// adminPoliciesRouter lists the policy bundles in effect, in the order they're matched
+func (bot bot) adminPoliciesRouter(c *gin.Context) {
+	cfg, overrides := bot.reloader.current()
+	policies := []adminPolicy{}
+	for _, p := range cfg.Policies {
+		_, overridden := overrides.Policies[p.Topic]
+		policies = append(policies, adminPolicy{policyConfig: p, Source: adminSource(overridden)})
+	}
+	c.YAML(http.StatusOK, policies)
+}
+
+func (bot bot) adminPolicyRouter(c *gin.Context) {
+	topic := c.Param("topic")
+	cfg, overrides := bot.reloader.current()
+	for _, p := range cfg.Policies {
+		if p.Topic == topic {
+			_, overridden := overrides.Policies[topic]
+			c.YAML(http.StatusOK, adminPolicy{policyConfig: p, Source: adminSource(overridden)})
+			return
+		}
+	}
+	http.Error(c.Writer, fmt.Sprintf("policy %s isn't configured", topic), http.StatusNotFound)
+}
+
+// adminPutPolicyRouter creates or replaces a policy bundle, e.g. `{"reviewers": 3, "assign_as": "reviewer"}`
+func (bot bot) adminPutPolicyRouter(c *gin.Context) {
+	topic := c.Param("topic")
+	var policy policyConfig
+	if !bindAdminBody(c, &policy) {
+		return
+	}
+	policy.Topic = topic
+	err := bot.reloader.change(func(o *adminOverrides) error {
+		o.Policies[topic] = policy
+		return nil
+	})
+	bot.adminChanged(c, "admin_policy_put", topic, err)
+}
+
+func (bot bot) adminDeletePolicyRouter(c *gin.Context) {
+	topic := c.Param("topic")
+	err := bot.reloader.change(func(o *adminOverrides) error {
+		if _, ok := o.Policies[topic]; !ok {
+			return errNoOverride
+		}
+		delete(o.Policies, topic)
+		return nil
+	})
+	bot.adminChanged(c, "admin_policy_delete", topic, err)
+}
+
+// bindAdminBody decodes the request body, answering the request itself if it can't
+func bindAdminBody(c *gin.Context, v interface{}) bool {
+	b, err := ioutil.ReadAll(c.Request.Body)
+	if err == nil {
+		// JSON is YAML too, and this way the fields are named as in the config file
+		err = yaml.UnmarshalStrict(b, v)
+	}
+	if err != nil {
+		http.Error(c.Writer, fmt.Sprintf("invalid body: %v", err), http.StatusBadRequest)
+		return false
+	}
+	return true
+}
+
+// adminChanged answers and audits an admin API change
+func (bot bot) adminChanged(c *gin.Context, action, target string, err error) {
+	entry := auditEntry{Action: action, Actor: "admin:" + c.GetString(gin.AuthUserKey), Target: target, Outcome: "applied"}
+	switch {
+	case errors.Is(err, errNoOverride):
+		http.Error(c.Writer, fmt.Sprintf("%s is %v", target, err), http.StatusNotFound)
+		return
+	case err != nil:
+		logrus.WithError(err).Warnf("Rejected admin API change to %s", target)
+		entry.Outcome = "rejected: " + err.Error()
+		bot.audit.record(entry)
+		http.Error(c.Writer, err.Error(), http.StatusBadRequest)
+		return
+	}
+	bot.audit.record(entry)
+	c.Status(http.StatusNoContent)
+}
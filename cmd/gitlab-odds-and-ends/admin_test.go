@@ -0,0 +1,51 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestAdminServerNeedsCredentialsToChangeThings(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	mutating := []string{
+		"PUT /admin/projects/*project",
+		"DELETE /admin/projects/*project",
+		"POST /admin/backfill",
+		"PUT /admin/policies/:topic",
+		"DELETE /admin/policies/:topic",
+		"PUT /admin/preferences/:user",
+		"DELETE /admin/preferences/:user",
+		// not mutating, but they show the webhooks gitlab sent, what people did, and their preferences
+		"GET /debug/events",
+		"GET /audit",
+		"GET /admin/preferences",
+		"GET /admin/preferences/:user",
+	}
+	tests := []struct {
+		name               string
+		username, password string
+		wantMutating       bool
+	}{
+		{"with credentials", "admin", "hunter2", true},
+		{"without credentials", "", "", false},
+		{"with only a username", "admin", "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			routes := make(map[string]bool)
+			for _, r := range (bot{}).adminServer(tt.username, tt.password).Routes() {
+				routes[r.Method+" "+r.Path] = true
+			}
+			for _, route := range mutating {
+				if routes[route] != tt.wantMutating {
+					t.Errorf("serving %s = %v, want %v", route, routes[route], tt.wantMutating)
+				}
+			}
+			if !routes[http.MethodGet+" /admin/projects"] {
+				t.Errorf("not serving GET /admin/projects")
+			}
+		})
+	}
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"strings"
+
+	"github.com/sirupsen/logrus"
+	"github.com/xanzy/go-gitlab"
+)
+
+const (
+	RESET_APPROVALS_ON_PUSH_ENV_VAR = "RESET_APPROVALS_ON_PUSH"
+)
+
+// resetApprovals clears the approvals of an approved MR that just had new commits pushed to it, and tells the thread
+// why.  Resetting someone else's approval needs a bot user's token; if we aren't allowed, the project's own
+// "reset approvals on push" setting is switched on instead so at least the next push is covered.
+func (bot bot) resetApprovals(mr *gitlab.MergeEvent, slackChans []string) {
+	if mr.ObjectAttributes.OldRev == "" { // not a push, just an edit
+		return
+	}
+	projectID, iid := mr.Project.ID, mr.ObjectAttributes.IID
+	approvals, err := bot.gl.GetMergeRequestApprovals(projectID, iid)
+	if err != nil {
+		logrus.WithError(err).Errorf("failed to check approvals of merge request !%d", iid)
+		return
+	}
+	if len(approvals.ApprovedBy) == 0 {
+		return
+	}
+	var approvers []string
+	for _, a := range approvals.ApprovedBy {
+		if a != nil && a.User != nil {
+			approvers = append(approvers, a.User.Name)
+		}
+	}
+
+	if err := bot.gl.ResetMergeRequestApprovals(projectID, iid); err != nil {
+		logrus.WithError(err).Warnf("not permitted to reset approvals of merge request !%d, enabling the project's reset-on-push setting instead", iid)
+		if err := bot.gl.SetResetApprovalsOnPush(projectID); err != nil {
+			logrus.WithError(err).Error("failed to enable reset approvals on push")
+		}
+		bot.notifyThreadLocalized(projectID, iid, tr("New commits were pushed to <%s|!%d> after it was approved by %s.  I couldn't reset those approvals, so please re-review before merging.",
+			mr.ObjectAttributes.URL, iid, strings.Join(approvers, ", ")), slackChans)
+		return
+	}
+	bot.react(projectID, iid, REACTION_APPROVED, true)
+	bot.notifyThreadLocalized(projectID, iid, tr("New commits were pushed to <%s|!%d>, so the approvals from %s were reset.  It needs another review.",
+		mr.ObjectAttributes.URL, iid, strings.Join(approvers, ", ")), slackChans)
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/raidancampbell/gitlab-odds-and-ends/internal/store"
+	"github.com/sirupsen/logrus"
+	"github.com/xanzy/go-gitlab"
+)
+
+const (
+	APPROVAL_EXPIRY_DAYS_ENV_VAR = "APPROVAL_EXPIRY_DAYS"
+	// gitlab doesn't timestamp approvals in the approvals API, but it does leave a system note for each one
+	NOTE_APPROVED   = "approved this merge request"
+	NOTE_UNAPPROVED = "unapproved this merge request"
+	// NAGGED_STORE_KEY keeps the stale approvals already commented on in the store, so a restart or another replica
+	// doesn't comment on them again
+	NAGGED_STORE_KEY = "stale_approvals"
+)
+
+// approvalExpiry treats approvals older than maxAge as stale.
+// nagged remembers which approvals we've already complained about (keyed by mrRef), so each stale approval is only
+// commented on once
+type approvalExpiry struct {
+	store  *store.Store
+	maxAge time.Duration
+	mu     sync.Mutex
+	nagged map[string]map[string]bool
+}
+
+func newApprovalExpiry(days int, s *store.Store) (*approvalExpiry, error) {
+	e := &approvalExpiry{
+		store:  s,
+		maxAge: time.Duration(days) * 24 * time.Hour,
+		nagged: make(map[string]map[string]bool),
+	}
+	if _, err := s.Load(NAGGED_STORE_KEY, &e.nagged); err != nil {
+		return nil, err
+	}
+	s.Follow(NAGGED_STORE_KEY, &e.nagged, &e.mu)
+	return e, nil
+}
+
+// save persists the stale approvals already reported.  callers hold mu
+func (e *approvalExpiry) save() {
+	if err := e.store.Save(NAGGED_STORE_KEY, e.nagged); err != nil {
+		logrus.WithError(err).Error("failed to persist stale approvals")
+	}
+}
+
+// markNagged records that a stale approval was reported.  returns false if it was already reported
+func (e *approvalExpiry) markNagged(projectID, iid, userID int, approvedAt time.Time) bool {
+	ref := mrRef(projectID, iid)
+	key := fmt.Sprintf("%d/%d", userID, approvedAt.Unix())
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.nagged[ref][key] {
+		return false
+	}
+	if e.nagged[ref] == nil {
+		e.nagged[ref] = make(map[string]bool)
+	}
+	e.nagged[ref][key] = true
+	e.save()
+	return true
+}
+
+// forget the MR's stale approvals, e.g. once it's been merged or closed
+func (e *approvalExpiry) forget(ref string) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if _, ok := e.nagged[ref]; ok {
+		delete(e.nagged, ref)
+		e.save()
+	}
+}
+
+// approvalTimes walks the MR's system notes and returns when each currently-approving user last approved it
+func approvalTimes(gl GitLabAPI, projectID, iid int) (map[int]time.Time, error) {
+	approvedAt := make(map[int]time.Time)
+	opts := &gitlab.ListMergeRequestNotesOptions{
+		ListOptions: gitlab.ListOptions{PerPage: 100},
+		OrderBy:     gitlab.String("created_at"),
+		Sort:        gitlab.String("asc"),
+	}
+	for {
+		notes, resp, err := gl.ListMergeRequestNotes(projectID, iid, opts)
+		if err != nil {
+			return nil, err
+		}
+		for _, note := range notes {
+			if !note.System || note.CreatedAt == nil {
+				continue
+			}
+			switch strings.TrimSpace(note.Body) {
+			case NOTE_APPROVED:
+				approvedAt[note.Author.ID] = *note.CreatedAt
+			case NOTE_UNAPPROVED:
+				delete(approvedAt, note.Author.ID)
+			}
+		}
+		if resp.NextPage == 0 {
+			break
+		}
+		opts.Page = resp.NextPage
+	}
+	return approvedAt, nil
+}
+
+// staleApprovals returns the MR's approval state, and which of its approvals are older than maxAge
+func staleApprovals(gl GitLabAPI, projectID, iid int, maxAge time.Duration) (*gitlab.MergeRequestApprovals, map[*gitlab.BasicUser]time.Time, error) {
+	approvals, err := gl.GetMergeRequestApprovals(projectID, iid)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(approvals.ApprovedBy) == 0 {
+		return approvals, nil, nil
+	}
+	approvedAt, err := approvalTimes(gl, projectID, iid)
+	if err != nil {
+		return approvals, nil, err
+	}
+
+	stale := make(map[*gitlab.BasicUser]time.Time)
+	for _, approver := range approvals.ApprovedBy {
+		if approver == nil || approver.User == nil {
+			continue
+		}
+		at, ok := approvedAt[approver.User.ID]
+		if ok && time.Since(at) > maxAge {
+			stale[approver.User] = at
+		}
+	}
+	return approvals, stale, nil
+}
+
+// readyToMerge reports whether the MR has enough approvals once stale approvals are discounted.
+// gitlab CE doesn't have required approvals, so at least one fresh approval is always required
+func readyToMerge(approvals *gitlab.MergeRequestApprovals, stale map[*gitlab.BasicUser]time.Time) bool {
+	required := approvals.ApprovalsRequired
+	if required < 1 {
+		required = 1
+	}
+	return len(approvals.ApprovedBy)-len(stale) >= required
+}
+
+// expireStaleApprovals comments on the MR asking stale approvers to re-approve, and removes those approvals where gitlab lets us.
+// Returns whether the MR is ready to merge, counting only fresh approvals.
+func (bot bot) expireStaleApprovals(mr *gitlab.MergeEvent) (bool, error) {
+	projectID, iid := mr.Project.ID, mr.ObjectAttributes.IID
+	approvals, stale, err := staleApprovals(bot.gl, projectID, iid, bot.expiry.maxAge)
+	if err != nil {
+		return false, err
+	}
+	if len(stale) == 0 {
+		return readyToMerge(approvals, stale), nil
+	}
+
+	var mentions []string
+	for user, at := range stale {
+		if bot.expiry.markNagged(projectID, iid, user.ID, at) {
+			mentions = append(mentions, "@"+user.Username)
+		}
+	}
+	if len(mentions) > 0 {
+		days := int(bot.expiry.maxAge.Hours() / 24)
+		comment := fmt.Sprintf("%s your approval is more than %d days old and is no longer counted.  Please take another look and re-approve.", strings.Join(mentions, " "), days)
+		if err := bot.comments.post(bot.gl, projectID, iid, comment); err != nil {
+			logrus.WithError(err).Error("failed to comment on stale approvals")
+		}
+		bot.removeStaleApprovals(mr, approvals, stale)
+	}
+
+	return readyToMerge(approvals, stale), nil
+}
+
+// removeStaleApprovals tries to actually pull the stale approvals.
+// gitlab only lets a user remove their own approval, so unless the token's user is the stale approver
+// the best we can do is reset all approvals, which bot users are allowed to do.  That's only attempted when
+// every approval is stale, so we never throw away a fresh approval.
+func (bot bot) removeStaleApprovals(mr *gitlab.MergeEvent, approvals *gitlab.MergeRequestApprovals, stale map[*gitlab.BasicUser]time.Time) {
+	projectID, iid := mr.Project.ID, mr.ObjectAttributes.IID
+	if len(stale) == len(approvals.ApprovedBy) {
+		err := bot.gl.ResetMergeRequestApprovals(projectID, iid)
+		if err == nil {
+			return
+		}
+		logrus.WithError(err).Debug("not permitted to reset approvals, falling back to removing our own")
+	}
+
+	self, err := bot.gl.CurrentUser()
+	if err != nil {
+		logrus.WithError(err).Error("unable to look up our own gitlab user, stale approvals left in place")
+		return
+	}
+	for user := range stale {
+		if user.ID != self.ID {
+			continue
+		}
+		if err := bot.gl.UnapproveMergeRequest(projectID, iid); err != nil {
+			logrus.WithError(err).Error("failed to remove our own stale approval")
+		}
+	}
+}
@@ -0,0 +1,342 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/raidancampbell/gitlab-odds-and-ends/internal/webhook"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	WEBHOOK_ARCHIVE_DIR_ENV_VAR           = "WEBHOOK_ARCHIVE_DIR"
+	WEBHOOK_ARCHIVE_S3_URL_ENV_VAR        = "WEBHOOK_ARCHIVE_S3_URL"
+	WEBHOOK_ARCHIVE_S3_REGION_ENV_VAR     = "WEBHOOK_ARCHIVE_S3_REGION"
+	WEBHOOK_ARCHIVE_S3_ACCESS_KEY_ENV_VAR = "WEBHOOK_ARCHIVE_S3_ACCESS_KEY"
+	WEBHOOK_ARCHIVE_S3_SECRET_KEY_ENV_VAR = "WEBHOOK_ARCHIVE_S3_SECRET_KEY"
+	WEBHOOK_ARCHIVE_MAX_AGE_ENV_VAR       = "WEBHOOK_ARCHIVE_MAX_AGE"
+	WEBHOOK_ARCHIVE_MAX_COUNT_ENV_VAR     = "WEBHOOK_ARCHIVE_MAX_COUNT"
+	DEFAULT_WEBHOOK_ARCHIVE_MAX_AGE       = 30 * 24 * time.Hour
+	DEFAULT_WEBHOOK_ARCHIVE_MAX_COUNT     = 100000
+	DEFAULT_WEBHOOK_ARCHIVE_S3_REGION     = "us-east-1"
+	// WEBHOOK_ARCHIVE_PRUNE_INTERVAL is how often archived webhooks past their retention are deleted
+	WEBHOOK_ARCHIVE_PRUNE_INTERVAL = time.Hour
+	// WEBHOOK_ARCHIVE_TIME_FORMAT starts each archived webhook's name, so names sort oldest first
+	WEBHOOK_ARCHIVE_TIME_FORMAT = "20060102T150405.000000000Z"
+)
+
+// archiveNameUnsafe is what's replaced in the parts of an archived webhook's name
+var archiveNameUnsafe = regexp.MustCompile(`[^a-z0-9]+`)
+
+// archivedWebhook is a webhook as gitlab sent it, with what's needed to send it to the bot again
+type archivedWebhook struct {
+	ReceivedAt time.Time `json:"received_at"`
+	Instance   string    `json:"instance,omitempty"`
+	// URL is the path and query the webhook was sent to, e.g. `/gitlab/callback?slack-channel=C0123456789`
+	URL string `json:"url"`
+	// Headers are gitlab's headers, without the secret token
+	Headers map[string]string `json:"headers"`
+	Body    string            `json:"body"`
+}
+
+// archiveBackend is where archived webhooks are kept, by name
+type archiveBackend interface {
+	put(name string, data []byte) error
+	// prune deletes the webhooks archived before the cutoff, and any past the newest keep
+	prune(cutoff time.Time, keep int) error
+}
+
+// webhookArchive keeps every webhook the bot accepts, for debugging after the fact without gitlab sending it again.
+// webhooks are kept for WEBHOOK_ARCHIVE_MAX_AGE, and at most WEBHOOK_ARCHIVE_MAX_COUNT of them
+type webhookArchive struct {
+	backend  archiveBackend
+	maxAge   time.Duration
+	maxCount int
+}
+
+// newWebhookArchive configures the archive from the environment, returning nil if neither WEBHOOK_ARCHIVE_DIR nor
+// WEBHOOK_ARCHIVE_S3_URL is set
+func newWebhookArchive() (*webhookArchive, error) {
+	dir, s3URL := os.Getenv(WEBHOOK_ARCHIVE_DIR_ENV_VAR), os.Getenv(WEBHOOK_ARCHIVE_S3_URL_ENV_VAR)
+	a := &webhookArchive{maxAge: DEFAULT_WEBHOOK_ARCHIVE_MAX_AGE, maxCount: DEFAULT_WEBHOOK_ARCHIVE_MAX_COUNT}
+	switch {
+	case dir != "" && s3URL != "":
+		return nil, fmt.Errorf("set only one of %s and %s", WEBHOOK_ARCHIVE_DIR_ENV_VAR, WEBHOOK_ARCHIVE_S3_URL_ENV_VAR)
+	case dir != "":
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			return nil, err
+		}
+		a.backend = dirArchive{dir: dir}
+	case s3URL != "":
+		s3, err := newS3Archive(s3URL)
+		if err != nil {
+			return nil, err
+		}
+		a.backend = s3
+	default:
+		return nil, nil
+	}
+	if d, err := time.ParseDuration(os.Getenv(WEBHOOK_ARCHIVE_MAX_AGE_ENV_VAR)); err == nil && d > 0 {
+		a.maxAge = d
+	}
+	if n, err := strconv.Atoi(os.Getenv(WEBHOOK_ARCHIVE_MAX_COUNT_ENV_VAR)); err == nil && n > 0 {
+		a.maxCount = n
+	}
+	return a, nil
+}
+
+// save archives the webhook in the background, so a slow backend doesn't hold up gitlab
+func (a *webhookArchive) save(instance string, r *http.Request, body []byte, status *botStatus) {
+	hook := archivedWebhook{
+		ReceivedAt: time.Now().UTC(),
+		Instance:   instance,
+		URL:        r.URL.RequestURI(),
+		Headers:    make(map[string]string),
+		Body:       string(body),
+	}
+	for name := range r.Header {
+		if strings.HasPrefix(name, "X-Gitlab-") && name != webhook.HEADER_GITLAB_TOKEN {
+			hook.Headers[name] = r.Header.Get(name)
+		}
+	}
+	event := r.Header.Get(HEADER_GITLAB_EVENT)
+	if instance == "" {
+		instance = "default"
+	}
+	name := strings.Join([]string{
+		hook.ReceivedAt.Format(WEBHOOK_ARCHIVE_TIME_FORMAT),
+		archiveNameUnsafe.ReplaceAllString(strings.ToLower(instance), "_"),
+		archiveNameUnsafe.ReplaceAllString(strings.ToLower(event), "_"),
+	}, "-") + ".json"
+	data, err := json.Marshal(hook)
+	if err != nil {
+		logrus.WithError(err).Error("failed to archive webhook")
+		return
+	}
+	go func() {
+		if err := a.backend.put(name, data); err != nil {
+			logrus.WithError(err).Errorf("failed to archive webhook %s", name)
+			status.fail("webhook archive")
+		}
+	}()
+}
+
+// prune deletes archived webhooks past their retention
+func (a *webhookArchive) prune() {
+	if err := a.backend.prune(time.Now().Add(-a.maxAge), a.maxCount); err != nil {
+		logrus.WithError(err).Error("failed to prune the webhook archive")
+	}
+}
+
+// archivedBefore reports whether the archived webhook's name says it was received before the cutoff
+func archivedBefore(name string, cutoff time.Time) bool {
+	if len(name) < len(WEBHOOK_ARCHIVE_TIME_FORMAT) {
+		return false
+	}
+	at, err := time.Parse(WEBHOOK_ARCHIVE_TIME_FORMAT, name[:len(WEBHOOK_ARCHIVE_TIME_FORMAT)])
+	return err == nil && at.Before(cutoff)
+}
+
+// expiredArchives picks the archived webhooks prune deletes, given all their names
+func expiredArchives(names []string, cutoff time.Time, keep int) []string {
+	sort.Strings(names)
+	var old []string
+	for i, name := range names {
+		if i < len(names)-keep || archivedBefore(name, cutoff) {
+			old = append(old, name)
+		}
+	}
+	return old
+}
+
+// dirArchive keeps archived webhooks as files in a directory
+type dirArchive struct {
+	dir string
+}
+
+func (d dirArchive) put(name string, data []byte) error {
+	return ioutil.WriteFile(filepath.Join(d.dir, name), data, 0600)
+}
+
+func (d dirArchive) prune(cutoff time.Time, keep int) error {
+	files, err := ioutil.ReadDir(d.dir)
+	if err != nil {
+		return err
+	}
+	var names []string
+	for _, f := range files {
+		if !f.IsDir() && strings.HasSuffix(f.Name(), ".json") {
+			names = append(names, f.Name())
+		}
+	}
+	for _, name := range expiredArchives(names, cutoff, keep) {
+		if err := os.Remove(filepath.Join(d.dir, name)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// s3Archive keeps archived webhooks in an S3 compatible bucket, e.g. AWS S3 or minio.  its URL is path style:
+// `https://<endpoint>/<bucket>/<optional prefix>`.  requests are signed with AWS signature version 4
+type s3Archive struct {
+	endpoint  *url.URL
+	bucket    string
+	prefix    string
+	region    string
+	accessKey string
+	secretKey string
+	client    *http.Client
+}
+
+func newS3Archive(rawURL string) (*s3Archive, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil || u.Host == "" {
+		return nil, fmt.Errorf("invalid %s '%s'", WEBHOOK_ARCHIVE_S3_URL_ENV_VAR, rawURL)
+	}
+	parts := strings.SplitN(strings.Trim(u.Path, "/"), "/", 2)
+	if parts[0] == "" {
+		return nil, fmt.Errorf("%s must name a bucket, e.g. https://s3.amazonaws.com/bucket", WEBHOOK_ARCHIVE_S3_URL_ENV_VAR)
+	}
+	s := &s3Archive{
+		endpoint:  &url.URL{Scheme: u.Scheme, Host: u.Host},
+		bucket:    parts[0],
+		region:    os.Getenv(WEBHOOK_ARCHIVE_S3_REGION_ENV_VAR),
+		accessKey: secretFromEnv(WEBHOOK_ARCHIVE_S3_ACCESS_KEY_ENV_VAR),
+		secretKey: secretFromEnv(WEBHOOK_ARCHIVE_S3_SECRET_KEY_ENV_VAR),
+		client:    http.DefaultClient,
+	}
+	if len(parts) == 2 && parts[1] != "" {
+		s.prefix = strings.TrimSuffix(parts[1], "/") + "/"
+	}
+	if s.region == "" {
+		s.region = DEFAULT_WEBHOOK_ARCHIVE_S3_REGION
+	}
+	if s.accessKey == "" || s.secretKey == "" {
+		return nil, fmt.Errorf("%s and %s must be set to archive to S3", WEBHOOK_ARCHIVE_S3_ACCESS_KEY_ENV_VAR, WEBHOOK_ARCHIVE_S3_SECRET_KEY_ENV_VAR)
+	}
+	return s, nil
+}
+
+func (s *s3Archive) put(name string, data []byte) error {
+	_, err := s.do(http.MethodPut, s.prefix+name, nil, data)
+	return err
+}
+
+// s3ListResult is the part of a ListObjectsV2 response prune needs
+type s3ListResult struct {
+	Keys                  []string `xml:"Contents>Key"`
+	IsTruncated           bool     `xml:"IsTruncated"`
+	NextContinuationToken string   `xml:"NextContinuationToken"`
+}
+
+func (s *s3Archive) prune(cutoff time.Time, keep int) error {
+	var names []string
+	query := url.Values{"list-type": {"2"}, "prefix": {s.prefix}}
+	for {
+		body, err := s.do(http.MethodGet, "", query, nil)
+		if err != nil {
+			return err
+		}
+		var page s3ListResult
+		if err := xml.Unmarshal(body, &page); err != nil {
+			return fmt.Errorf("unparseable bucket listing: %v", err)
+		}
+		for _, key := range page.Keys {
+			names = append(names, strings.TrimPrefix(key, s.prefix))
+		}
+		if !page.IsTruncated {
+			break
+		}
+		query.Set("continuation-token", page.NextContinuationToken)
+	}
+	for _, name := range expiredArchives(names, cutoff, keep) {
+		if _, err := s.do(http.MethodDelete, s.prefix+name, nil, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// do sends a signed request for the object at key, or the bucket itself for an empty key, returning the response body
+func (s *s3Archive) do(method, key string, query url.Values, body []byte) ([]byte, error) {
+	u := *s.endpoint
+	u.Path = "/" + s.bucket + "/" + key
+	// signing wants spaces as %20, not the + url.Values uses
+	u.RawQuery = strings.ReplaceAll(query.Encode(), "+", "%20")
+	req, err := http.NewRequest(method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	s.sign(req, body, time.Now().UTC())
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	respBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 != 2 {
+		return nil, fmt.Errorf("%s %s: %s: %s", method, u.Path, resp.Status, respBody)
+	}
+	return respBody, nil
+}
+
+// sign adds AWS signature version 4 headers to the request
+func (s *s3Archive) sign(req *http.Request, body []byte, now time.Time) {
+	payloadHash := sha256Hex(body)
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	signedHeaders := "host;x-amz-content-sha256;x-amz-date"
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		"host:" + req.URL.Host,
+		"x-amz-content-sha256:" + payloadHash,
+		"x-amz-date:" + amzDate,
+		"",
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	scope := date + "/" + s.region + "/s3/aws4_request"
+	stringToSign := strings.Join([]string{"AWS4-HMAC-SHA256", amzDate, scope, sha256Hex([]byte(canonicalRequest))}, "\n")
+
+	key := []byte("AWS4" + s.secretKey)
+	for _, part := range []string{date, s.region, "s3", "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.accessKey, scope, signedHeaders, hex.EncodeToString(hmacSHA256(key, stringToSign))))
+}
+
+func sha256Hex(b []byte) string {
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
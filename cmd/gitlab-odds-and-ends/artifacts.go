@@ -0,0 +1,72 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+	"github.com/xanzy/go-gitlab"
+)
+
+const (
+	ARTIFACT_REVIEW_LABEL_ENV_VAR = "ARTIFACT_REVIEW_LABEL"
+	DEFAULT_ARTIFACT_REVIEW_LABEL = "needs-artifact-review"
+	PIPELINE_STATUS_SUCCESS       = "success"
+)
+
+// shareArtifacts posts download links for the pipeline's artifacts to the thread of every open MR
+// for the pipeline's branch that carries the artifact review label
+func (bot bot) shareArtifacts(p *gitlab.PipelineEvent, slackChans []string) {
+	if p.ObjectAttributes.Tag {
+		return
+	}
+	mrs, _, err := bot.gl.ListProjectMergeRequests(p.Project.ID, &gitlab.ListProjectMergeRequestsOptions{
+		State:        gitlab.String("opened"),
+		SourceBranch: &p.ObjectAttributes.Ref,
+		Labels:       &gitlab.LabelOptions{bot.artifactLabel},
+	})
+	if err != nil {
+		logrus.WithError(err).Errorf("failed to find merge requests for %s", p.ObjectAttributes.Ref)
+		return
+	}
+	if len(mrs) == 0 {
+		return
+	}
+
+	jobs, err := bot.gl.ListPipelineJobs(p.Project.ID, p.ObjectAttributes.ID)
+	if err != nil {
+		logrus.WithError(err).Errorf("failed to list jobs for pipeline %d", p.ObjectAttributes.ID)
+		return
+	}
+	var links []string
+	for _, job := range jobs {
+		if job.ArtifactsFile.Filename == "" {
+			continue
+		}
+		jobURL := fmt.Sprintf("%s/-/jobs/%d", p.Project.WebURL, job.ID)
+		links = append(links, fmt.Sprintf("• `%s`: <%s/artifacts/download|download> (%s) · <%s/artifacts/browse|browse>",
+			job.Name, jobURL, byteSize(job.ArtifactsFile.Size), jobURL))
+	}
+	if len(links) == 0 {
+		return
+	}
+
+	for _, mr := range mrs {
+		msg := tr("Pipeline artifacts for <%s|!%d %s> (%s):\n%s", mr.WebURL, mr.IID, mr.Title, p.ObjectAttributes.SHA[:8], strings.Join(links, "\n"))
+		bot.notifyThreadLocalized(p.Project.ID, mr.IID, msg, slackChans)
+	}
+}
+
+// byteSize formats a size in bytes for humans, e.g. `1.5 MiB`
+func byteSize(b int) string {
+	const unit = 1024
+	if b < unit {
+		return fmt.Sprintf("%d B", b)
+	}
+	div, exp := int64(unit), 0
+	for n := int64(b) / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(b)/float64(div), "KMGTPE"[exp])
+}
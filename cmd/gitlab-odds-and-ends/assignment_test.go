@@ -0,0 +1,340 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/raidancampbell/gitlab-odds-and-ends/internal/notify"
+	"github.com/raidancampbell/gitlab-odds-and-ends/internal/store"
+	"github.com/xanzy/go-gitlab"
+)
+
+const (
+	testProject = 7
+	testIID     = 42
+	testAuthor  = 1
+)
+
+// testMembers are the project's members: the MR's author, a developer, and maintainers 10, 11 and 12
+func testMembers(gl *fakeGitLab) map[int]*gitlab.ProjectMember {
+	return map[int]*gitlab.ProjectMember{
+		testAuthor: gl.addUser(testAuthor, "author", gitlab.DeveloperPermissions),
+		2:          gl.addUser(2, "dev", gitlab.DeveloperPermissions),
+		10:         gl.addUser(10, "alice", gitlab.MaintainerPermissions),
+		11:         gl.addUser(11, "bob", gitlab.MaintainerPermissions),
+		12:         gl.addUser(12, "carol", gitlab.MaintainerPermissions),
+	}
+}
+
+func members(all map[int]*gitlab.ProjectMember, ids ...int) []*gitlab.ProjectMember {
+	var ms []*gitlab.ProjectMember
+	for _, id := range ids {
+		ms = append(ms, all[id])
+	}
+	return ms
+}
+
+// testMR is an MR by testAuthor, assigned to the assignee unless it's 0
+func testMR(gl *fakeGitLab, assignee int, reviewers ...int) *gitlab.MergeEvent {
+	mr := &gitlab.MergeRequest{
+		ProjectID: testProject,
+		IID:       testIID,
+		Title:     "Fix the thing",
+		WebURL:    "https://gitlab.example/group/project/-/merge_requests/42",
+		Author:    gl.basicUser(testAuthor),
+	}
+	if assignee != 0 {
+		mr.Assignee = gl.basicUser(assignee)
+	}
+	for _, id := range reviewers {
+		mr.Reviewers = append(mr.Reviewers, gl.basicUser(id))
+	}
+	return gl.addMR(mr)
+}
+
+func TestMaybeAssignMaintainer(t *testing.T) {
+	tests := []struct {
+		name         string
+		assignee     int
+		all          []int
+		available    []int
+		experts      []int
+		wantName     string
+		wantErr      error
+		wantAssignee int // 0 if it shouldn't be reassigned
+	}{
+		{
+			name:      "keeps the maintainer it's assigned to",
+			assignee:  10,
+			all:       []int{10, 11},
+			available: []int{11},
+			wantName:  "User alice",
+		},
+		{
+			name:         "assigns unassigned MRs",
+			all:          []int{10, 11},
+			available:    []int{11},
+			wantName:     "User bob",
+			wantAssignee: 11,
+		},
+		{
+			name:         "reassigns MRs the author assigned to themselves",
+			assignee:     testAuthor,
+			all:          []int{10},
+			available:    []int{10},
+			wantName:     "User alice",
+			wantAssignee: 10,
+		},
+		{
+			name:         "prefers experts",
+			all:          []int{10, 11, 12},
+			available:    []int{10, 11, 12},
+			experts:      []int{12},
+			wantName:     "User carol",
+			wantAssignee: 12,
+		},
+		{
+			name:      "waits when nobody's available",
+			all:       []int{10, 11},
+			available: nil,
+			wantErr:   errNobodyAvailable,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gl := newFakeGitLab()
+			ms := testMembers(gl)
+			mr := testMR(gl, tt.assignee)
+			candidates := reviewCandidates{all: members(ms, tt.all...), available: members(ms, tt.available...), experts: members(ms, tt.experts...)}
+
+			name, err := maybeAssignMaintainer(gl, mr, candidates)
+
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("maybeAssignMaintainer() error = %v, want %v", err, tt.wantErr)
+			}
+			if name != tt.wantName {
+				t.Errorf("maybeAssignMaintainer() = %q, want %q", name, tt.wantName)
+			}
+			updates := gl.updates[mrRef(testProject, testIID)]
+			if tt.wantAssignee == 0 {
+				if len(updates) != 0 {
+					t.Errorf("updated the MR with %s, want it left alone", gitlab.Stringify(updates))
+				}
+				return
+			}
+			if len(updates) != 1 || updates[0].AssigneeID == nil || *updates[0].AssigneeID != tt.wantAssignee {
+				t.Errorf("updated the MR with %s, want it assigned to %d", gitlab.Stringify(updates), tt.wantAssignee)
+			}
+			if mr.ObjectAttributes.AssigneeID != tt.wantAssignee {
+				t.Errorf("the webhook's assignee is %d, want %d", mr.ObjectAttributes.AssigneeID, tt.wantAssignee)
+			}
+		})
+	}
+}
+
+func TestMaybeAssignMaintainerWithoutMaintainers(t *testing.T) {
+	gl := newFakeGitLab()
+	testMembers(gl)
+	if _, err := maybeAssignMaintainer(gl, testMR(gl, 0), reviewCandidates{}); err == nil {
+		t.Error("maybeAssignMaintainer() succeeded without any maintainers")
+	}
+}
+
+func TestMaybeRequestReview(t *testing.T) {
+	tests := []struct {
+		name          string
+		reviewers     []int
+		all           []int
+		available     []int
+		wantName      string
+		wantErr       bool
+		wantReviewers []int // nil if the reviewers shouldn't change
+	}{
+		{
+			name:      "keeps a maintainer who's already reviewing",
+			reviewers: []int{2, 11},
+			all:       []int{10, 11},
+			available: []int{10},
+			wantName:  "User bob",
+		},
+		{
+			name:          "adds a maintainer, keeping the other reviewers",
+			reviewers:     []int{2},
+			all:           []int{10},
+			available:     []int{10},
+			wantName:      "User alice",
+			wantReviewers: []int{10, 2},
+		},
+		{
+			name:          "never asks the author",
+			all:           []int{testAuthor, 10},
+			available:     []int{testAuthor, 10},
+			wantName:      "User alice",
+			wantReviewers: []int{10},
+		},
+		{
+			name:      "fails when the author is the only maintainer",
+			all:       []int{testAuthor},
+			available: []int{testAuthor},
+			wantErr:   true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gl := newFakeGitLab()
+			ms := testMembers(gl)
+			ms[testAuthor].AccessLevel = gitlab.MaintainerPermissions
+			mr := testMR(gl, 0, tt.reviewers...)
+			candidates := reviewCandidates{all: members(ms, tt.all...), available: members(ms, tt.available...)}
+
+			name, err := maybeRequestReview(gl, mr, candidates)
+
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("maybeRequestReview() error = %v, want error %v", err, tt.wantErr)
+			}
+			if name != tt.wantName {
+				t.Errorf("maybeRequestReview() = %q, want %q", name, tt.wantName)
+			}
+			updates := gl.updates[mrRef(testProject, testIID)]
+			if tt.wantReviewers == nil {
+				if len(updates) != 0 {
+					t.Errorf("updated the MR with %s, want it left alone", gitlab.Stringify(updates))
+				}
+				return
+			}
+			if len(updates) != 1 || updates[0].ReviewerIDs == nil || !equalInts(*updates[0].ReviewerIDs, tt.wantReviewers) {
+				t.Errorf("updated the MR with %s, want reviewers %v", gitlab.Stringify(updates), tt.wantReviewers)
+			}
+		})
+	}
+}
+
+func TestEnsureTotalMaintainers(t *testing.T) {
+	tests := []struct {
+		name         string
+		assignee     int
+		participants []int
+		want         int
+		all          []int
+		available    []int
+		wantTagged   []string
+		wantShort    int
+	}{
+		{
+			name:       "tags maintainers up to the total",
+			assignee:   10,
+			want:       2,
+			all:        []int{10, 11},
+			available:  []int{10, 11},
+			wantTagged: []string{"@bob"},
+		},
+		{
+			name:         "counts maintainers already participating",
+			assignee:     10,
+			participants: []int{testAuthor, 11},
+			want:         2,
+			all:          []int{10, 11, 12},
+			available:    []int{10, 11, 12},
+		},
+		{
+			name:         "counts participating maintainers who are away",
+			assignee:     10,
+			participants: []int{12},
+			want:         3,
+			all:          []int{10, 11, 12},
+			available:    []int{10, 11},
+			wantTagged:   []string{"@bob"},
+		},
+		{
+			name:       "reports how many are missing",
+			assignee:   10,
+			want:       4,
+			all:        []int{10, 11},
+			available:  []int{10, 11},
+			wantTagged: []string{"@bob"},
+			wantShort:  2,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gl := newFakeGitLab()
+			ms := testMembers(gl)
+			mr := testMR(gl, tt.assignee)
+			for _, id := range tt.participants {
+				gl.participants[mrRef(testProject, testIID)] = append(gl.participants[mrRef(testProject, testIID)], gl.basicUser(id))
+			}
+			comments := testComments(t)
+			candidates := reviewCandidates{all: members(ms, tt.all...), available: members(ms, tt.available...)}
+
+			short, err := ensureTotalMaintainers(gl, comments, mr, tt.want, candidates)
+
+			if err != nil {
+				t.Fatal(err)
+			}
+			if short != tt.wantShort {
+				t.Errorf("ensureTotalMaintainers() = %d short, want %d", short, tt.wantShort)
+			}
+			notes := gl.notes[mrRef(testProject, testIID)]
+			if len(tt.wantTagged) == 0 {
+				if len(notes) != 0 {
+					t.Errorf("commented %q, want no comment", notes)
+				}
+				return
+			}
+			if len(notes) != 1 || !strings.HasPrefix(notes[0], strings.Join(tt.wantTagged, " ")+" please review") {
+				t.Errorf("commented %q, want %v tagged", notes, tt.wantTagged)
+			}
+		})
+	}
+}
+
+func TestNotifyNewMR(t *testing.T) {
+	gl := newFakeGitLab()
+	testMembers(gl)
+	mr := testMR(gl, 10)
+	gl.approvals[mrRef(testProject, testIID)] = &gitlab.MergeRequestApprovals{ApprovalsRequired: 2}
+	rec := &notify.Recorder{}
+	b := notifyingBot(t, rec)
+	b.gl = gl
+
+	b.notifyNewMR(mr, "User alice", []string{"#team", "#other"})
+
+	sent := rec.Of(notify.KIND_NOTIFY)
+	if len(sent) != 2 || sent[0].Channel != "#team" || sent[1].Channel != "#other" {
+		t.Fatalf("sent %+v, want an announcement in #team and #other", sent)
+	}
+	for _, want := range []string{"from User author has been assigned to User alice", mr.ObjectAttributes.URL, "0/2"} {
+		if !strings.Contains(sent[0].Text, want) {
+			t.Errorf("announced %q, want it to mention %q", sent[0].Text, want)
+		}
+	}
+	if threads := b.threads.get(mrRef(testProject, testIID)); len(threads) != 2 {
+		t.Errorf("recorded threads %+v, want both announcements", threads)
+	}
+}
+
+func testComments(t *testing.T) *mrComments {
+	t.Helper()
+	s, err := store.Open("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := newMRComments(commentsConfig{}, s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func equalInts(a, b []int) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
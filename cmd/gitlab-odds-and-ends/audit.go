@@ -0,0 +1,393 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/raidancampbell/gitlab-odds-and-ends/internal/notify"
+	"github.com/raidancampbell/gitlab-odds-and-ends/internal/store"
+	"github.com/sirupsen/logrus"
+	"github.com/slack-go/slack"
+	"github.com/xanzy/go-gitlab"
+)
+
+const (
+	AUDIT_STORE_KEY = "audit"
+	// oldest entries are dropped past this, so the state file doesn't grow forever
+	MAX_AUDIT_ENTRIES = 10000
+	// MAX_AUDIT_DETAIL is how much of a comment or message the log keeps
+	MAX_AUDIT_DETAIL = 500
+	// AUDIT_ACTOR_BOT is the actor of changes the bot makes on its own, see auditEntry.Trigger for why
+	AUDIT_ACTOR_BOT = "bot"
+)
+
+// auditEntry is one thing the bot did, or was told to do
+type auditEntry struct {
+	Time time.Time `json:"time"`
+	// Action is what was done, e.g. `freeze_override`
+	Action string `json:"action"`
+	// Actor is who asked for it: a slack user, or the webhook event that triggered it
+	Actor string `json:"actor"`
+	// Target is what it was done to, e.g. a project or MR
+	Target string `json:"target"`
+	// Trigger is what the bot was handling when it acted: a webhook, a slack action, or a scheduled job
+	Trigger string `json:"trigger,omitempty"`
+	Detail  string `json:"detail,omitempty"`
+	Outcome string `json:"outcome"`
+}
+
+// auditLog keeps a record of the bot's actions in the store
+type auditLog struct {
+	store   *store.Store
+	mu      sync.Mutex
+	entries []auditEntry
+	// projects are project paths by ID, for naming the targets of gitlab changes
+	projects sync.Map
+}
+
+func newAuditLog(s *store.Store) (*auditLog, error) {
+	a := &auditLog{store: s}
+	if _, err := s.Load(AUDIT_STORE_KEY, &a.entries); err != nil {
+		return nil, err
+	}
+	s.Follow(AUDIT_STORE_KEY, &a.entries, &a.mu)
+	return a, nil
+}
+
+// record adds the entry to the log, stamping it with the current time
+func (a *auditLog) record(entry auditEntry) {
+	entry.Time = time.Now()
+	if len(entry.Detail) > MAX_AUDIT_DETAIL {
+		entry.Detail = entry.Detail[:MAX_AUDIT_DETAIL] + "…"
+	}
+	logrus.WithField("audit", entry.Action).Infof("%s %s %s: %s", entry.Actor, entry.Action, entry.Target, entry.Outcome)
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.entries = append(a.entries, entry)
+	if len(a.entries) > MAX_AUDIT_ENTRIES {
+		a.entries = a.entries[len(a.entries)-MAX_AUDIT_ENTRIES:]
+	}
+	if err := a.store.Save(AUDIT_STORE_KEY, a.entries); err != nil {
+		logrus.WithError(err).Error("failed to persist audit log")
+	}
+}
+
+// auditQuery picks entries from the audit log.  empty fields match everything
+type auditQuery struct {
+	Action string
+	Actor  string
+	// Target matches targets starting with it, so a project finds its MRs too
+	Target string
+	Since  time.Time
+}
+
+// query returns the entries matching q, oldest first
+func (a *auditLog) query(q auditQuery) []auditEntry {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	var found []auditEntry
+	for _, entry := range a.entries {
+		if (q.Action == "" || entry.Action == q.Action) && (q.Actor == "" || entry.Actor == q.Actor) &&
+			strings.HasPrefix(entry.Target, q.Target) && !entry.Time.Before(q.Since) {
+			found = append(found, entry)
+		}
+	}
+	return found
+}
+
+// failedSince describes what the trigger failed to do since the time, e.g. `assign group/project!12 failed: ...`
+func (bot bot) failedSince(trigger string, since time.Time) []string {
+	if bot.audit == nil {
+		return nil
+	}
+	var failed []string
+	for _, entry := range bot.audit.query(auditQuery{Actor: AUDIT_ACTOR_BOT, Since: since}) {
+		if entry.Trigger == trigger && strings.HasPrefix(entry.Outcome, "failed") {
+			failed = append(failed, fmt.Sprintf("%s %s %s", entry.Action, entry.Target, entry.Outcome))
+		}
+	}
+	return failed
+}
+
+// auditRouter serves `GET /audit` on the admin listener, e.g. `/audit?target=group/project!12&action=assign` to find
+// out who reassigned an MR and why.  `since` is a time (RFC 3339) or a duration ago like `24h`, and `format=csv`
+// exports the entries as a spreadsheet instead of JSON
+func (bot bot) auditRouter(c *gin.Context) {
+	q := auditQuery{Action: c.Query("action"), Actor: c.Query("actor"), Target: c.Query("target")}
+	if since := c.Query("since"); since != "" {
+		if ago, err := time.ParseDuration(since); err == nil {
+			q.Since = time.Now().Add(-ago)
+		} else if q.Since, err = time.Parse(time.RFC3339, since); err != nil {
+			c.String(http.StatusBadRequest, "since must be an RFC 3339 time or a duration: %v", err)
+			return
+		}
+	}
+	entries := bot.audit.query(q)
+	if c.Query("format") != "csv" {
+		c.JSON(http.StatusOK, entries)
+		return
+	}
+	c.Header("Content-Disposition", `attachment; filename="audit.csv"`)
+	c.Header("Content-Type", "text/csv")
+	w := csv.NewWriter(c.Writer)
+	w.Write([]string{"time", "action", "actor", "target", "trigger", "detail", "outcome"})
+	for _, e := range entries {
+		w.Write([]string{e.Time.Format(time.RFC3339), e.Action, e.Actor, e.Target, e.Trigger, e.Detail, e.Outcome})
+	}
+	w.Flush()
+}
+
+// triggeredBy is the bot as it handles the trigger, recording every change it makes to gitlab and every message it
+// sends in the audit log.  each webhook, slack action, and scheduled job gets its own, see instances
+func (bot bot) triggeredBy(trigger string) bot {
+	if bot.audit == nil {
+		return bot
+	}
+	gl, notifier := bot.gl, bot.notifier
+	if audited, ok := gl.(auditedGitLab); ok {
+		gl = audited.GitLabAPI
+	}
+	if audited, ok := notifier.(auditedNotifier); ok {
+		notifier = audited.Notifier
+	}
+	bot.gl = auditedGitLab{GitLabAPI: gl, audit: bot.audit, trigger: trigger}
+	bot.notifier = auditedNotifier{Notifier: notifier, audit: bot.audit, trigger: trigger}
+	return bot
+}
+
+// webhookTrigger describes a gitlab webhook for the audit log, e.g. `gitlab:Merge Request Hook group/project!12 (update by @someone)`
+func webhookTrigger(kind string, webhook interface{}) string {
+	project, _ := webhookProject(webhook)
+	trigger := strings.TrimSpace("gitlab:" + kind + " " + project)
+	switch wh := webhook.(type) {
+	case *gitlab.MergeEvent:
+		by := ""
+		if wh.User != nil {
+			by = " by @" + wh.User.Username
+		}
+		trigger += fmt.Sprintf("!%d (%s%s)", wh.ObjectAttributes.IID, wh.ObjectAttributes.Action, by)
+	case *gitlab.MergeCommentEvent:
+		by := ""
+		if wh.User != nil {
+			by = " by @" + wh.User.Username
+		}
+		trigger += fmt.Sprintf("!%d (comment%s)", wh.MergeRequest.IID, by)
+	case *gitlab.PipelineEvent:
+		trigger += fmt.Sprintf(" (pipeline %d %s)", wh.ObjectAttributes.ID, wh.ObjectAttributes.Status)
+	}
+	return trigger
+}
+
+// auditOutcome is the outcome of a change that returned err
+func auditOutcome(err error, dryRun bool) string {
+	switch {
+	case err != nil:
+		return "failed: " + err.Error()
+	case dryRun:
+		return "dry run, not done"
+	}
+	return "done"
+}
+
+// auditedGitLab records the changes the bot makes to gitlab in the audit log, as part of its trigger.  reads pass
+// through untouched
+type auditedGitLab struct {
+	GitLabAPI
+	audit   *auditLog
+	trigger string
+}
+
+// project names a project for the log, looking up its path once
+func (gl auditedGitLab) project(pid int) string {
+	if path, ok := gl.audit.projects.Load(pid); ok {
+		return path.(string)
+	}
+	p, err := gl.GitLabAPI.GetProject(pid)
+	if err != nil {
+		return fmt.Sprintf("project %d", pid)
+	}
+	gl.audit.projects.Store(pid, p.PathWithNamespace)
+	return p.PathWithNamespace
+}
+
+// mr names an MR for the log like the bot's own audit entries do, `group/project!12`
+func (gl auditedGitLab) mr(pid, iid int) string {
+	return fmt.Sprintf("%s!%d", gl.project(pid), iid)
+}
+
+func (gl auditedGitLab) record(action, target, detail string, err error) {
+	_, dryRun := gl.GitLabAPI.(dryRunGitLab)
+	gl.audit.record(auditEntry{
+		Action:  action,
+		Actor:   AUDIT_ACTOR_BOT,
+		Target:  target,
+		Trigger: gl.trigger,
+		Detail:  detail,
+		Outcome: auditOutcome(err, dryRun),
+	})
+}
+
+func (gl auditedGitLab) UpdateMergeRequest(pid, iid int, opt *gitlab.UpdateMergeRequestOptions) (*gitlab.MergeRequest, error) {
+	mr, err := gl.GitLabAPI.UpdateMergeRequest(pid, iid, opt)
+	action := "update_merge_request"
+	if opt.AssigneeID != nil || opt.AssigneeIDs != nil || opt.ReviewerIDs != nil {
+		action = "assign"
+	}
+	gl.record(action, gl.mr(pid, iid), gitlab.Stringify(opt), err)
+	return mr, err
+}
+
+func (gl auditedGitLab) CreateMergeRequest(pid int, opt *gitlab.CreateMergeRequestOptions) (*gitlab.MergeRequest, error) {
+	mr, err := gl.GitLabAPI.CreateMergeRequest(pid, opt)
+	gl.record("create_merge_request", gl.project(pid), gitlab.Stringify(opt), err)
+	return mr, err
+}
+
+func (gl auditedGitLab) AcceptMergeRequest(pid, iid int, opt *gitlab.AcceptMergeRequestOptions) (*gitlab.MergeRequest, error) {
+	mr, err := gl.GitLabAPI.AcceptMergeRequest(pid, iid, opt)
+	gl.record("merge", gl.mr(pid, iid), "", err)
+	return mr, err
+}
+
+func (gl auditedGitLab) CreateMergeRequestNote(pid, iid int, body string) (*gitlab.Note, error) {
+	note, err := gl.GitLabAPI.CreateMergeRequestNote(pid, iid, body)
+	gl.record("comment", gl.mr(pid, iid), body, err)
+	return note, err
+}
+
+func (gl auditedGitLab) CreateIssue(pid int, opt *gitlab.CreateIssueOptions) (*gitlab.Issue, error) {
+	issue, err := gl.GitLabAPI.CreateIssue(pid, opt)
+	gl.record("create_issue", gl.project(pid), *opt.Title, err)
+	return issue, err
+}
+
+func (gl auditedGitLab) CreateIssueNote(pid, iid int, body string) (*gitlab.Note, error) {
+	note, err := gl.GitLabAPI.CreateIssueNote(pid, iid, body)
+	gl.record("comment", fmt.Sprintf("%s#%d", gl.project(pid), iid), body, err)
+	return note, err
+}
+
+func (gl auditedGitLab) ApproveMergeRequest(pid, iid int, sudo string) error {
+	err := gl.GitLabAPI.ApproveMergeRequest(pid, iid, sudo)
+	detail := ""
+	if sudo != "" {
+		detail = "as @" + sudo
+	}
+	gl.record("approve", gl.mr(pid, iid), detail, err)
+	return err
+}
+
+func (gl auditedGitLab) UnapproveMergeRequest(pid, iid int) error {
+	err := gl.GitLabAPI.UnapproveMergeRequest(pid, iid)
+	gl.record("unapprove", gl.mr(pid, iid), "", err)
+	return err
+}
+
+func (gl auditedGitLab) RebaseMergeRequest(pid, iid int) error {
+	err := gl.GitLabAPI.RebaseMergeRequest(pid, iid)
+	gl.record("rebase", gl.mr(pid, iid), "", err)
+	return err
+}
+
+func (gl auditedGitLab) ResetMergeRequestApprovals(pid, iid int) error {
+	err := gl.GitLabAPI.ResetMergeRequestApprovals(pid, iid)
+	gl.record("reset_approvals", gl.mr(pid, iid), "", err)
+	return err
+}
+
+func (gl auditedGitLab) SetResetApprovalsOnPush(pid int) error {
+	err := gl.GitLabAPI.SetResetApprovalsOnPush(pid)
+	gl.record("set_reset_approvals_on_push", gl.project(pid), "", err)
+	return err
+}
+
+func (gl auditedGitLab) CreateBranch(pid int, branch, ref string) (*gitlab.Branch, error) {
+	b, err := gl.GitLabAPI.CreateBranch(pid, branch, ref)
+	gl.record("create_branch", gl.project(pid), fmt.Sprintf("%s from %s", branch, ref), err)
+	return b, err
+}
+
+func (gl auditedGitLab) DeleteBranch(pid int, branch string) error {
+	err := gl.GitLabAPI.DeleteBranch(pid, branch)
+	gl.record("delete_branch", gl.project(pid), branch, err)
+	return err
+}
+
+func (gl auditedGitLab) AddProjectHook(pid int, opt *gitlab.AddProjectHookOptions) (*gitlab.ProjectHook, error) {
+	hook, err := gl.GitLabAPI.AddProjectHook(pid, opt)
+	gl.record("add_project_hook", gl.project(pid), *opt.URL, err)
+	return hook, err
+}
+
+func (gl auditedGitLab) CreateRelease(pid int, opt *gitlab.CreateReleaseOptions) (*gitlab.Release, error) {
+	release, err := gl.GitLabAPI.CreateRelease(pid, opt)
+	gl.record("create_release", gl.project(pid), *opt.TagName, err)
+	return release, err
+}
+
+func (gl auditedGitLab) RevertCommit(pid int, sha, branch string) (*gitlab.Commit, error) {
+	commit, err := gl.GitLabAPI.RevertCommit(pid, sha, branch)
+	gl.record("revert_commit", gl.project(pid), fmt.Sprintf("%s onto %s", sha, branch), err)
+	return commit, err
+}
+
+func (gl auditedGitLab) CherryPickCommit(pid int, sha, branch string) (*gitlab.Commit, error) {
+	commit, err := gl.GitLabAPI.CherryPickCommit(pid, sha, branch)
+	gl.record("cherry_pick_commit", gl.project(pid), fmt.Sprintf("%s onto %s", sha, branch), err)
+	return commit, err
+}
+
+func (gl auditedGitLab) SaveFile(pid int, path, branch, content, message string, create bool) error {
+	err := gl.GitLabAPI.SaveFile(pid, path, branch, content, message, create)
+	gl.record("commit_file", gl.project(pid), fmt.Sprintf("%s on %s: %s", path, branch, message), err)
+	return err
+}
+
+// auditedNotifier records the messages the bot sends in the audit log, as part of its trigger.  reactions, unfurls
+// and modals aren't recorded
+type auditedNotifier struct {
+	notify.Notifier
+	audit   *auditLog
+	trigger string
+}
+
+func (n auditedNotifier) record(action, channel, msg string, err error) {
+	dryRun := isDryRun(n.Notifier)
+	n.audit.record(auditEntry{
+		Action:  action,
+		Actor:   AUDIT_ACTOR_BOT,
+		Target:  channel,
+		Trigger: n.trigger,
+		Detail:  msg,
+		Outcome: auditOutcome(err, dryRun),
+	})
+}
+
+func (n auditedNotifier) Notify(channel, msg string) (string, error) {
+	ts, err := n.Notifier.Notify(channel, msg)
+	n.record("message", channel, msg, err)
+	return ts, err
+}
+
+func (n auditedNotifier) NotifyBlocks(channel, msg string, blocks []slack.Block) (string, error) {
+	ts, err := n.Notifier.NotifyBlocks(channel, msg, blocks)
+	n.record("message", channel, msg, err)
+	return ts, err
+}
+
+func (n auditedNotifier) Reply(channel, threadTS, msg string) (string, error) {
+	ts, err := n.Notifier.Reply(channel, threadTS, msg)
+	n.record("reply", channel, msg, err)
+	return ts, err
+}
+
+func (n auditedNotifier) Update(channel, ts, msg string, blocks []slack.Block) error {
+	err := n.Notifier.Update(channel, ts, msg, blocks)
+	n.record("update_message", channel, msg, err)
+	return err
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+	"github.com/xanzy/go-gitlab"
+)
+
+// labelRule labels MRs that change any file matching one of its path globs.  `**` matches across directories, `*` and
+// `?` don't, and a glob without a `/` matches the file's name in any directory, e.g. `*.sql`
+type labelRule struct {
+	Paths []string `yaml:"paths"`
+	Label string   `yaml:"label"`
+}
+
+// compiledLabelRule is a labelRule with its globs turned into regular expressions
+type compiledLabelRule struct {
+	label string
+	paths []*regexp.Regexp
+}
+
+// compileLabelRules checks every project's label rules up front, so a bad glob fails at startup instead of on an MR
+func compileLabelRules(projects []projectConfig) (map[string][]compiledLabelRule, error) {
+	rules := make(map[string][]compiledLabelRule)
+	for _, p := range projects {
+		for _, rule := range p.Labels {
+			if rule.Label == "" {
+				return nil, fmt.Errorf("label rule for %s in %s has no label", strings.Join(rule.Paths, ", "), p.Project)
+			}
+			compiled := compiledLabelRule{label: rule.Label}
+			for _, glob := range rule.Paths {
+				re, err := globRegexp(glob)
+				if err != nil {
+					return nil, fmt.Errorf("invalid path glob '%s' in %s: %v", glob, p.Project, err)
+				}
+				compiled.paths = append(compiled.paths, re)
+			}
+			rules[p.Project] = append(rules[p.Project], compiled)
+		}
+	}
+	return rules, nil
+}
+
+// globRegexp translates a path glob into an anchored regular expression
+func globRegexp(glob string) (*regexp.Regexp, error) {
+	return compileGlob(glob, !strings.Contains(glob, "/"))
+}
+
+// compileGlob translates a glob into an anchored regular expression.  anyDir lets it match in any directory
+func compileGlob(glob string, anyDir bool) (*regexp.Regexp, error) {
+	var re strings.Builder
+	re.WriteString("^")
+	if anyDir {
+		re.WriteString("(.*/)?")
+	}
+	for i := 0; i < len(glob); i++ {
+		switch c := glob[i]; c {
+		case '*':
+			if i+1 < len(glob) && glob[i+1] == '*' {
+				i++
+				if i+1 < len(glob) && glob[i+1] == '/' { // `**/` also matches no directories at all
+					i++
+					re.WriteString("(.*/)?")
+				} else {
+					re.WriteString(".*")
+				}
+			} else {
+				re.WriteString("[^/]*")
+			}
+		case '?':
+			re.WriteString("[^/]")
+		default:
+			re.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	re.WriteString("$")
+	return regexp.Compile(re.String())
+}
+
+// labelsFor returns the labels whose rules match any of the paths
+func labelsFor(rules []compiledLabelRule, paths []string) []string {
+	var labels []string
+	for _, rule := range rules {
+	matching:
+		for _, re := range rule.paths {
+			for _, p := range paths {
+				if re.MatchString(p) {
+					labels = append(labels, rule.label)
+					break matching
+				}
+			}
+		}
+	}
+	return labels
+}
+
+// autoLabel adds the labels the project's rules call for to the MR, based on the files it changes.  labels it already
+// has are left alone, and labels are never removed, so people can take off a label that got it wrong
+func (bot bot) autoLabel(mr *gitlab.MergeEvent) {
+	rules := bot.labelRules[mr.Project.PathWithNamespace]
+	if len(rules) == 0 {
+		return
+	}
+	changes, err := bot.gl.GetMergeRequestChanges(mr.Project.ID, mr.ObjectAttributes.IID)
+	if err != nil {
+		logrus.WithError(err).Errorf("failed to list changes of merge request !%d", mr.ObjectAttributes.IID)
+		return
+	}
+	var paths []string
+	for _, c := range changes.Changes {
+		paths = append(paths, c.OldPath, c.NewPath)
+	}
+
+	has := make(map[string]bool)
+	for _, l := range changes.Labels {
+		has[l] = true
+	}
+	var add gitlab.LabelOptions
+	for _, l := range labelsFor(rules, paths) {
+		if !has[l] {
+			has[l] = true
+			add = append(add, l)
+		}
+	}
+	if len(add) == 0 {
+		return
+	}
+	sort.Strings(add)
+	logrus.Infof("labeling merge request !%d with %s", mr.ObjectAttributes.IID, strings.Join(add, ", "))
+	if _, err := bot.gl.UpdateMergeRequest(mr.Project.ID, mr.ObjectAttributes.IID, &gitlab.UpdateMergeRequestOptions{AddLabels: &add}); err != nil {
+		logrus.WithError(err).Errorf("failed to label merge request !%d", mr.ObjectAttributes.IID)
+	}
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+	"github.com/xanzy/go-gitlab"
+)
+
+const (
+	BACKFILL_ON_STARTUP_ENV_VAR = "BACKFILL_ON_STARTUP"
+	BACKFILL_TRIGGER            = "backfill"
+)
+
+// backfill runs the new MR flow (assignment, reviewers, and the notification) for the open MRs of the routed projects
+// that nobody is assigned to or reviewing, as if they'd just been opened.  it's for projects enrolled after their MRs
+// were, so the bot is useful on its first day.  an empty project backfills every routed project
+func (bot bot) backfill(project string) {
+	projects := []string{project}
+	if project == "" {
+		projects = nil
+		for p := range bot.routes.all() {
+			projects = append(projects, p)
+		}
+		sort.Strings(projects)
+	}
+	total := 0
+	for _, p := range projects {
+		n, err := bot.backfillProject(p)
+		if err != nil {
+			logrus.WithError(err).Errorf("failed to backfill %s", p)
+			bot.status.fail("backfill")
+		}
+		total += n
+	}
+	logrus.Infof("backfilled %d unassigned merge requests in %d projects", total, len(projects))
+}
+
+// backfillProject runs the new MR flow for the project's unassigned open MRs, returning how many it found
+func (bot bot) backfillProject(path string) (int, error) {
+	id, err := bot.routes.projectID(bot.gl, path)
+	if err != nil {
+		return 0, err
+	}
+	project, err := bot.gl.GetProject(id)
+	if err != nil {
+		return 0, err
+	}
+	opt := &gitlab.ListProjectMergeRequestsOptions{
+		ListOptions: gitlab.ListOptions{PerPage: 100},
+		State:       gitlab.String("opened"),
+		OrderBy:     gitlab.String("created_at"),
+		Sort:        gitlab.String("asc"),
+	}
+	n := 0
+	for {
+		mrs, resp, err := bot.gl.ListProjectMergeRequests(id, opt)
+		if err != nil {
+			return n, err
+		}
+		for _, mr := range mrs {
+			if mr.Assignee != nil || len(mr.Reviewers) > 0 || len(bot.threads.get(mrRef(id, mr.IID))) > 0 {
+				continue
+			}
+			n++
+			ev := mergeEventFor(project, mr)
+			logrus.Infof("backfilling merge request !%d in %s", mr.IID, path)
+			bot.mergeRequest(ev, bot.applyRoutingRules(ev, bot.route(path, id, nil, "")))
+		}
+		if resp.NextPage == 0 {
+			return n, nil
+		}
+		opt.Page = resp.NextPage
+	}
+}
+
+// mergeEventFor makes the webhook gitlab would have sent when the MR was opened
+func mergeEventFor(project *gitlab.Project, mr *gitlab.MergeRequest) *gitlab.MergeEvent {
+	ev := &gitlab.MergeEvent{ObjectKind: "merge_request"}
+	ev.Project.ID = project.ID
+	ev.Project.Name = project.Name
+	ev.Project.PathWithNamespace = project.PathWithNamespace
+	ev.Project.WebURL = project.WebURL
+	ev.ObjectAttributes.ID = mr.ID
+	ev.ObjectAttributes.IID = mr.IID
+	ev.ObjectAttributes.Title = mr.Title
+	ev.ObjectAttributes.Description = mr.Description
+	ev.ObjectAttributes.URL = mr.WebURL
+	ev.ObjectAttributes.State = mr.State
+	ev.ObjectAttributes.Action = MR_ACTION_OPENED
+	ev.ObjectAttributes.SourceBranch = mr.SourceBranch
+	ev.ObjectAttributes.TargetBranch = mr.TargetBranch
+	ev.ObjectAttributes.WorkInProgress = mr.WorkInProgress
+	ev.ObjectAttributes.LastCommit.ID = mr.SHA
+	ev.ObjectAttributes.Target = &gitlab.Repository{Name: project.Name, PathWithNamespace: project.PathWithNamespace, WebURL: project.WebURL}
+	if mr.Author != nil {
+		ev.ObjectAttributes.AuthorID = mr.Author.ID
+		ev.User = &gitlab.EventUser{ID: mr.Author.ID, Name: mr.Author.Name, Username: mr.Author.Username}
+	}
+	return ev
+}
+
+// adminBackfillRouter serves `POST /admin/backfill`, backfilling every routed project of the default gitlab instance,
+// or `?instance=<name>`'s, or just `?project=group/project`.  it answers right away and backfills in the background
+func (bot bot) adminBackfillRouter(c *gin.Context) {
+	target, ok := bot.instances.get(c.Query(GITLAB_INSTANCE_QUERY_PARAM))
+	if !ok {
+		http.Error(c.Writer, fmt.Sprintf("no gitlab instance named %q", c.Query(GITLAB_INSTANCE_QUERY_PARAM)), http.StatusNotFound)
+		return
+	}
+	project := c.Query("project")
+	bot.audit.record(auditEntry{Action: BACKFILL_TRIGGER, Actor: "admin:" + c.GetString(gin.AuthUserKey), Target: project, Outcome: "started"})
+	go target.triggeredBy("admin:" + BACKFILL_TRIGGER).backfill(project)
+	c.Status(http.StatusAccepted)
+}
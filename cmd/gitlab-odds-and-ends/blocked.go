@@ -0,0 +1,282 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/raidancampbell/gitlab-odds-and-ends/internal/store"
+	"github.com/sirupsen/logrus"
+	"github.com/xanzy/go-gitlab"
+)
+
+// blocker is one reason an MR can't be merged, along with who's best placed to clear it
+type blocker struct {
+	reason string
+	owner  string // gitlab username
+	// dmOwner also tells the owner directly, for blockers only they can clear
+	dmOwner bool
+}
+
+const (
+	MERGE_STATUS_CANNOT_BE_MERGED = "cannot_be_merged"
+	BLOCKED_SCAN_INTERVAL_ENV_VAR = "BLOCKED_SCAN_INTERVAL"
+	DEFAULT_BLOCKED_SCAN_INTERVAL = 15 * time.Minute
+	// CLOSED_THREAD_RETENTION is how long a merged or closed MR's threads are kept, for late follow-ups like held back
+	// replies, reverts and cherry-picks, before they're pruned
+	CLOSED_THREAD_RETENTION = 24 * time.Hour
+	BLOCKED_STORE_KEY       = "blocked"
+	CLOSED_MRS_STORE_KEY    = "closed_mrs"
+)
+
+// blockedMRs remembers which blockers were already announced for each MR (keyed by mrRef), so the thread only hears
+// about a blocker once, and again if it comes back after being cleared.  both are kept in the store, so neither a
+// restart nor another replica's scan announces them again
+type blockedMRs struct {
+	store     *store.Store
+	mu        sync.Mutex
+	announced map[string]map[string]bool
+	closed    map[string]time.Time // when MRs were merged or closed, they're no longer worth scanning
+}
+
+func newBlockedMRs(s *store.Store) (*blockedMRs, error) {
+	b := &blockedMRs{store: s, announced: make(map[string]map[string]bool), closed: make(map[string]time.Time)}
+	if _, err := s.Load(BLOCKED_STORE_KEY, &b.announced); err != nil {
+		return nil, err
+	}
+	if _, err := s.Load(CLOSED_MRS_STORE_KEY, &b.closed); err != nil {
+		return nil, err
+	}
+	s.Follow(BLOCKED_STORE_KEY, &b.announced, &b.mu)
+	s.Follow(CLOSED_MRS_STORE_KEY, &b.closed, &b.mu)
+	return b, nil
+}
+
+// save persists the announced blockers and closed MRs.  callers hold mu
+func (b *blockedMRs) save() {
+	if err := b.store.Save(BLOCKED_STORE_KEY, b.announced); err != nil {
+		logrus.WithError(err).Error("failed to persist announced blockers")
+	}
+	if err := b.store.Save(CLOSED_MRS_STORE_KEY, b.closed); err != nil {
+		logrus.WithError(err).Error("failed to persist closed merge requests")
+	}
+}
+
+// close stops scanning the merged or closed MR
+func (b *blockedMRs) close(ref string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	_, announced := b.announced[ref]
+	_, closed := b.closed[ref]
+	if announced || !closed {
+		delete(b.announced, ref)
+		if !closed {
+			b.closed[ref] = time.Now()
+		}
+		b.save()
+	}
+}
+
+func (b *blockedMRs) isClosed(ref string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	_, ok := b.closed[ref]
+	return ok
+}
+
+// prune forgets the MRs closed before the given time, returning them so their threads can be pruned too
+func (b *blockedMRs) prune(before time.Time) []string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var pruned []string
+	for ref, at := range b.closed {
+		if at.Before(before) {
+			delete(b.closed, ref)
+			pruned = append(pruned, ref)
+		}
+	}
+	if len(pruned) > 0 {
+		b.save()
+	}
+	return pruned
+}
+
+// update records the MR's current blockers and returns the ones that weren't announced yet
+func (b *blockedMRs) update(ref string, blockers []blocker) []blocker {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	_, wasClosed := b.closed[ref]
+	delete(b.closed, ref) // it's open, e.g. reopened
+	current := make(map[string]bool)
+	var fresh []blocker
+	for _, blk := range blockers {
+		current[blk.reason] = true
+		if !b.announced[ref][blk.reason] {
+			fresh = append(fresh, blk)
+		}
+	}
+	changed := wasClosed || len(current) != len(b.announced[ref])
+	for reason := range current {
+		changed = changed || !b.announced[ref][reason]
+	}
+	if len(current) == 0 {
+		delete(b.announced, ref)
+	} else {
+		b.announced[ref] = current
+	}
+	if changed {
+		b.save()
+	}
+	return fresh
+}
+
+// mergeBlockers works out why the MR can't be merged: a failed pipeline the project requires to pass,
+// unresolved discussions the project requires to be resolved, or conflicts/divergence that need a rebase
+func mergeBlockers(gl GitLabAPI, project *gitlab.Project, mr *gitlab.MergeRequest) ([]blocker, error) {
+	author := ""
+	if mr.Author != nil {
+		author = mr.Author.Username
+	}
+
+	var blockers []blocker
+	if project.OnlyAllowMergeIfPipelineSucceeds && mr.HeadPipeline != nil && mr.HeadPipeline.Status == PIPELINE_STATUS_FAILED {
+		owner := author
+		if mr.HeadPipeline.User != nil {
+			owner = mr.HeadPipeline.User.Username
+		}
+		blockers = append(blockers, blocker{
+			reason: fmt.Sprintf("the <%s|pipeline> failed and must pass before merging", mr.HeadPipeline.WebURL),
+			owner:  owner,
+		})
+	}
+	if project.OnlyAllowMergeIfAllDiscussionsAreResolved && !mr.BlockingDiscussionsResolved {
+		reviewers, err := unresolvedDiscussionAuthors(gl, mr.ProjectID, mr.IID)
+		if err != nil {
+			logrus.WithError(err).Errorf("failed to find unresolved discussions on merge request !%d", mr.IID)
+		}
+		reason := "there are unresolved discussions"
+		if len(reviewers) > 0 {
+			reason = fmt.Sprintf("there are unresolved discussions from %s", strings.Join(reviewers, ", "))
+		}
+		blockers = append(blockers, blocker{reason: reason, owner: author})
+	}
+	if mr.HasConflicts || mr.MergeStatus == MERGE_STATUS_CANNOT_BE_MERGED {
+		blockers = append(blockers, blocker{
+			reason:  fmt.Sprintf("it conflicts with `%s`.  Rebase it onto `%s`, or <%s/conflicts|resolve the conflicts in gitlab>", mr.TargetBranch, mr.TargetBranch, mr.WebURL),
+			owner:   author,
+			dmOwner: true,
+		})
+	} else if project.MergeMethod == gitlab.FastForwardMerge && mr.DivergedCommitsCount > 0 {
+		blockers = append(blockers, blocker{
+			reason: fmt.Sprintf("it's %s behind `%s` and needs a rebase to fast-forward", plural(mr.DivergedCommitsCount, "commit"), mr.TargetBranch),
+			owner:  author,
+		})
+	}
+	return blockers, nil
+}
+
+// unresolvedDiscussionAuthors returns the usernames (as @mentions) of whoever started the MR's unresolved threads
+func unresolvedDiscussionAuthors(gl GitLabAPI, projectID, iid int) ([]string, error) {
+	seen := make(map[string]bool)
+	opts := &gitlab.ListMergeRequestNotesOptions{ListOptions: gitlab.ListOptions{PerPage: 100}}
+	for {
+		notes, resp, err := gl.ListMergeRequestNotes(projectID, iid, opts)
+		if err != nil {
+			return nil, err
+		}
+		for _, note := range notes {
+			if note.Resolvable && !note.Resolved {
+				seen["@"+note.Author.Username] = true
+			}
+		}
+		if resp.NextPage == 0 {
+			break
+		}
+		opts.Page = resp.NextPage
+	}
+	var authors []string
+	for a := range seen {
+		authors = append(authors, a)
+	}
+	sort.Strings(authors)
+	return authors, nil
+}
+
+// checkBlocked annotates the MR's thread with any new reasons it can't be merged
+func (bot bot) checkBlocked(projectID, iid int, slackChans []string) {
+	mr, err := bot.gl.GetMergeRequest(projectID, iid)
+	if err != nil {
+		logrus.WithError(err).Errorf("failed to look up merge request !%d", iid)
+		return
+	}
+	if mr.State != "opened" {
+		bot.blocked.close(mrRef(projectID, iid))
+		return
+	}
+	if mr.WorkInProgress {
+		bot.blocked.update(mrRef(projectID, iid), nil)
+		return
+	}
+	project, err := bot.gl.GetProject(projectID)
+	if err != nil {
+		logrus.WithError(err).Errorf("failed to check whether merge request !%d is blocked", iid)
+		return
+	}
+	bot.maybeRebase(project, mr, slackChans)
+	blockers, err := mergeBlockers(bot.gl, project, mr)
+	if err != nil {
+		logrus.WithError(err).Errorf("failed to check whether merge request !%d is blocked", iid)
+		return
+	}
+	blockers = append(blockers, bot.policyBlockers(project, mr)...)
+	for _, blk := range bot.blocked.update(mrRef(projectID, iid), blockers) {
+		msg := tr("<%s|!%d %s> is blocked: %s.", mr.WebURL, mr.IID, mr.Title, blk.reason)
+		if blk.owner != "" {
+			msg = tr("<%s|!%d %s> is blocked: %s.  @%s is best placed to sort it out.", mr.WebURL, mr.IID, mr.Title, blk.reason, blk.owner)
+		}
+		bot.notifyThreadLocalized(projectID, iid, msg, slackChans)
+		if blk.dmOwner && blk.owner != "" {
+			bot.dmReviewer(project.PathWithNamespace, mr, blk.owner, bot.locales.render("", msg))
+		}
+	}
+}
+
+// scanBlocked periodically checks every announced MR, since gitlab doesn't send an event when an MR starts conflicting
+// because its target branch moved.  MRs merged or closed more than CLOSED_THREAD_RETENTION ago have their threads
+// pruned, so they're not scanned or remembered forever
+func (bot bot) scanBlocked() {
+	if pruned := bot.blocked.prune(time.Now().Add(-CLOSED_THREAD_RETENTION)); len(pruned) > 0 {
+		logrus.Debugf("pruning the threads of %s", plural(len(pruned), "closed merge request"))
+		bot.threads.forget(pruned...)
+	}
+	for _, ref := range bot.threads.refs() {
+		if bot.blocked.isClosed(ref) {
+			continue
+		}
+		projectID, iid, err := parseMRRef(ref)
+		if err != nil {
+			continue
+		}
+		bot.checkBlocked(projectID, iid, nil)
+	}
+}
+
+// checkBlockedBranch checks every open MR for the pipeline's branch, since a failed pipeline may block them
+func (bot bot) checkBlockedBranch(p *gitlab.PipelineEvent, slackChans []string) {
+	if p.ObjectAttributes.Tag {
+		return
+	}
+	mrs, _, err := bot.gl.ListProjectMergeRequests(p.Project.ID, &gitlab.ListProjectMergeRequestsOptions{
+		State:        gitlab.String("opened"),
+		SourceBranch: &p.ObjectAttributes.Ref,
+	})
+	if err != nil {
+		logrus.WithError(err).Errorf("failed to find merge requests for %s", p.ObjectAttributes.Ref)
+		return
+	}
+	for _, mr := range mrs {
+		bot.checkBlocked(p.Project.ID, mr.IID, slackChans)
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/raidancampbell/gitlab-odds-and-ends/internal/notify"
+	"github.com/raidancampbell/gitlab-odds-and-ends/internal/store"
+)
+
+func TestBlockedPrunesClosedMRs(t *testing.T) {
+	s, err := store.Open("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	blocked, err := newBlockedMRs(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	blocked.close(mrRef(1, 1))
+	blocked.close(mrRef(1, 2))
+	blocked.update(mrRef(1, 2), nil) // reopened
+
+	if got := blocked.prune(time.Now().Add(-time.Hour)); len(got) != 0 {
+		t.Errorf("prune() = %v before the retention passed, want nothing", got)
+	}
+	if !blocked.isClosed(mrRef(1, 1)) || blocked.isClosed(mrRef(1, 2)) {
+		t.Errorf("want only the closed MR skipped")
+	}
+	if got := blocked.prune(time.Now().Add(time.Second)); len(got) != 1 || got[0] != mrRef(1, 1) {
+		t.Errorf("prune() = %v, want the closed MR", got)
+	}
+	if blocked.isClosed(mrRef(1, 1)) {
+		t.Errorf("the pruned MR is still remembered")
+	}
+}
+
+func TestBlockersSurviveRestarts(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.json")
+	open := func() *blockedMRs {
+		s, err := store.Open(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		blocked, err := newBlockedMRs(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return blocked
+	}
+	conflicts := blocker{reason: "it has conflicts"}
+	open().update(mrRef(1, 1), []blocker{conflicts})
+	open().close(mrRef(1, 2))
+
+	blocked := open()
+	if fresh := blocked.update(mrRef(1, 1), []blocker{conflicts}); len(fresh) != 0 {
+		t.Errorf("update() = %v after a restart, want the blocker already announced", fresh)
+	}
+	if !blocked.isClosed(mrRef(1, 2)) {
+		t.Error("the closed MR was forgotten")
+	}
+}
+
+func TestThreadsForget(t *testing.T) {
+	rec := &notify.Recorder{}
+	b := notifyingBot(t, rec)
+	b.threads.record(mrRef(1, 1), b.notify("closed", []string{"#team"}))
+	b.threads.record(mrRef(1, 2), b.notify("open", []string{"#team"}))
+
+	b.threads.forget(mrRef(1, 1))
+
+	if got := b.threads.refs(); len(got) != 1 || got[0] != mrRef(1, 2) {
+		t.Errorf("refs() = %v, want only the open MR", got)
+	}
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+	"github.com/xanzy/go-gitlab"
+)
+
+const DEFAULT_CHANGELOG_OTHER_SECTION = "Other changes"
+
+// defaultChangelogSections group entries when the config doesn't
+var defaultChangelogSections = []changelogSection{
+	{Title: "Features", Labels: []string{"feature", "enhancement"}},
+	{Title: "Fixes", Labels: []string{"bug", "fix"}},
+}
+
+// changelogConfig keeps a changelog of the MRs merged into projects' default branches, in a file in each project's
+// repository, in a channel, or both
+type changelogConfig struct {
+	// File is the changelog's path in the repository, e.g. `CHANGELOG.md`.  entries are committed to the default branch
+	File string `yaml:"file"`
+	// Channel gets each entry posted to it
+	Channel string `yaml:"channel"`
+	// Projects are the projects to keep changelogs for, by path with namespace.  empty is every project
+	Projects []string `yaml:"projects"`
+	// Sections group entries by their MR's labels, the first matching section wins.  defaults to Features and Fixes
+	Sections []changelogSection `yaml:"sections"`
+	// Other is the section for MRs without any of the sections' labels, DEFAULT_CHANGELOG_OTHER_SECTION by default
+	Other string `yaml:"other"`
+}
+
+type changelogSection struct {
+	// Title is the section's heading, e.g. `Features`
+	Title  string   `yaml:"title"`
+	Labels []string `yaml:"labels"`
+}
+
+// changelog writes the entries.  commits to the same file are serialized, so entries don't overwrite each other
+type changelog struct {
+	cfg      changelogConfig
+	projects map[string]bool
+
+	mu sync.Mutex
+}
+
+// newChangelog returns nil unless the config asks for a changelog file or channel
+func newChangelog(cfg changelogConfig) *changelog {
+	if cfg.File == "" && cfg.Channel == "" {
+		return nil
+	}
+	if len(cfg.Sections) == 0 {
+		cfg.Sections = defaultChangelogSections
+	}
+	if cfg.Other == "" {
+		cfg.Other = DEFAULT_CHANGELOG_OTHER_SECTION
+	}
+	c := &changelog{cfg: cfg, projects: make(map[string]bool)}
+	for _, p := range cfg.Projects {
+		c.projects[p] = true
+	}
+	return c
+}
+
+// section picks the section for an MR with the labels
+func (c *changelog) section(labels []string) string {
+	for _, s := range c.cfg.Sections {
+		for _, want := range s.Labels {
+			for _, l := range labels {
+				if strings.EqualFold(l, want) {
+					return s.Title
+				}
+			}
+		}
+	}
+	return c.cfg.Other
+}
+
+// changelogEntry is the MR's line in the changelog, in markdown
+func changelogEntry(mr *gitlab.MergeRequest) string {
+	entry := fmt.Sprintf("- %s ([!%d](%s)", mr.Title, mr.IID, mr.WebURL)
+	if mr.Author != nil {
+		entry += ", @" + mr.Author.Username
+	}
+	entry += ")"
+	if len(mr.Labels) > 0 {
+		entry += " `" + strings.Join(mr.Labels, "` `") + "`"
+	}
+	return entry
+}
+
+// insertChangelogEntry puts the entry at the top of its section, newest first.  a missing section is added at the top
+// of the changelog, below its title if it has one
+func insertChangelogEntry(text, section, entry string) string {
+	heading := "### " + section
+	lines := strings.Split(text, "\n")
+	for i, l := range lines {
+		if strings.TrimSpace(l) == heading {
+			return strings.Join(append(lines[:i+1], append([]string{entry}, lines[i+1:]...)...), "\n")
+		}
+	}
+	at := 0
+	if len(lines) > 0 && strings.HasPrefix(lines[0], "# ") {
+		at = 1
+		for at < len(lines) && strings.TrimSpace(lines[at]) == "" {
+			at++
+		}
+	}
+	added := []string{heading, entry, ""}
+	return strings.Join(append(lines[:at], append(added, lines[at:]...)...), "\n")
+}
+
+// recordChangelog adds the MR to the changelog if it was merged into its project's default branch
+func (bot bot) recordChangelog(ev *gitlab.MergeEvent) {
+	c := bot.changelog
+	project := ev.Project.PathWithNamespace
+	if c == nil || (len(c.projects) > 0 && !c.projects[project]) {
+		return
+	}
+	if ev.ObjectAttributes.TargetBranch != ev.Project.DefaultBranch {
+		return
+	}
+	mr, err := bot.gl.GetMergeRequest(ev.Project.ID, ev.ObjectAttributes.IID)
+	if err != nil {
+		logrus.WithError(err).Errorf("failed to look up merge request !%d for the changelog", ev.ObjectAttributes.IID)
+		return
+	}
+	section, entry := c.section(mr.Labels), changelogEntry(mr)
+
+	if c.cfg.File != "" {
+		if err := bot.commitChangelog(ev.Project.ID, ev.Project.DefaultBranch, section, entry, mr.IID); err != nil {
+			logrus.WithError(err).Errorf("failed to add merge request !%d to %s's changelog", mr.IID, project)
+			bot.status.fail("changelog")
+		}
+	}
+	if c.cfg.Channel != "" {
+		author := ""
+		if mr.Author != nil {
+			author = " by " + mr.Author.Name
+		}
+		bot.notify(fmt.Sprintf(":memo: *%s* in `%s`: <%s|!%d %s>%s", section, project, mr.WebURL, mr.IID, mr.Title, author), []string{c.cfg.Channel})
+	}
+}
+
+// commitChangelog adds the entry to the changelog file on the branch
+func (bot bot) commitChangelog(projectID int, branch, section, entry string, iid int) error {
+	c := bot.changelog
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	current, err := bot.gl.GetRawFile(projectID, c.cfg.File, branch)
+	if err != nil {
+		return err
+	}
+	text := string(current)
+	if current == nil {
+		text = "# Changelog\n"
+	}
+	message := fmt.Sprintf("Add !%d to the changelog", iid)
+	return bot.gl.SaveFile(projectID, c.cfg.File, branch, insertChangelogEntry(text, section, entry), message, current == nil)
+}
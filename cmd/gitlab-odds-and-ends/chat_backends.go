@@ -0,0 +1,79 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/smtp"
+	"os"
+
+	"github.com/raidancampbell/gitlab-odds-and-ends/internal/notify"
+	"github.com/raidancampbell/gitlab-odds-and-ends/internal/store"
+)
+
+// the chat backends besides slack, see notify.Channels
+const (
+	DISCORD_TOKEN_ENV_VAR     = "DISCORD_TOKEN"
+	MATTERMOST_URL_ENV_VAR    = "MATTERMOST_URL"
+	MATTERMOST_TOKEN_ENV_VAR  = "MATTERMOST_TOKEN"
+	SMTP_ADDR_ENV_VAR         = "SMTP_ADDR"
+	SMTP_USERNAME_ENV_VAR     = "SMTP_USERNAME"
+	SMTP_PASSWORD_ENV_VAR     = "SMTP_PASSWORD"
+	SMTP_FROM_ENV_VAR         = "SMTP_FROM"
+	EMAIL_DIGEST_TIME_ENV_VAR = "EMAIL_DIGEST_TIME"
+	DEFAULT_EMAIL_DIGEST_TIME = "08:00"
+)
+
+// teamsChannelConfig is a Microsoft Teams channel the bot can post to through an incoming webhook
+type teamsChannelConfig struct {
+	// Name is how projects refer to the channel, as `teams:<name>` in their channels
+	Name string `yaml:"name"`
+	// Webhook is the channel's incoming webhook URL
+	Webhook string `yaml:"webhook"`
+}
+
+func newTeamsNotifier(channels []teamsChannelConfig, client *http.Client) (notify.Teams, error) {
+	webhooks := make(map[string]string)
+	for _, c := range channels {
+		if c.Name == "" || c.Webhook == "" {
+			return notify.Teams{}, fmt.Errorf("teams channel '%s' needs a name and a webhook", c.Name)
+		}
+		webhooks[c.Name] = c.Webhook
+	}
+	return notify.NewTeams(webhooks, client), nil
+}
+
+// newMattermostNotifier maps the configured users' slack mentions to mattermost ones.  users without a mattermost
+// username configured are assumed to have the same one as in gitlab, which is what gitlab's mattermost SSO gives them
+func newMattermostNotifier(baseURL, token string, users []userConfig, client *http.Client) (*notify.Mattermost, error) {
+	usernames := make(map[string]string)
+	for _, u := range users {
+		if u.Mattermost != "" {
+			usernames[u.Slack] = u.Mattermost
+		} else if u.GitLab != "" {
+			usernames[u.Slack] = u.GitLab
+		}
+	}
+	return notify.NewMattermost(baseURL, token, usernames, client)
+}
+
+// newEmailNotifier configures SMTP from the environment, returning nil if SMTP_ADDR isn't set
+func newEmailNotifier(s *store.Store) (*notify.Email, error) {
+	addr := os.Getenv(SMTP_ADDR_ENV_VAR)
+	if addr == "" {
+		return nil, nil
+	}
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s '%s': %v", SMTP_ADDR_ENV_VAR, addr, err)
+	}
+	from := os.Getenv(SMTP_FROM_ENV_VAR)
+	if from == "" {
+		return nil, fmt.Errorf("%s must be set to send email", SMTP_FROM_ENV_VAR)
+	}
+	var auth smtp.Auth
+	if username := os.Getenv(SMTP_USERNAME_ENV_VAR); username != "" {
+		auth = smtp.PlainAuth("", username, os.Getenv(SMTP_PASSWORD_ENV_VAR), host)
+	}
+	return notify.NewEmail(addr, from, auth, s)
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/raidancampbell/gitlab-odds-and-ends/internal/store"
+	"github.com/sirupsen/logrus"
+	"github.com/xanzy/go-gitlab"
+)
+
+const CHERRY_PICKS_STORE_KEY = "cherry_picks"
+
+// cherryPicks remembers the branches people asked for open MRs (keyed by mrRef) to be cherry-picked onto once they're
+// merged.  they're kept in the store, since an MR can take a while to merge
+type cherryPicks struct {
+	store *store.Store
+
+	mu        sync.Mutex
+	requested map[string][]string
+}
+
+func newCherryPicks(s *store.Store) (*cherryPicks, error) {
+	c := &cherryPicks{store: s, requested: make(map[string][]string)}
+	if _, err := s.Load(CHERRY_PICKS_STORE_KEY, &c.requested); err != nil {
+		return nil, err
+	}
+	s.Follow(CHERRY_PICKS_STORE_KEY, &c.requested, &c.mu)
+	return c, nil
+}
+
+// request queues the cherry-pick, reporting whether it's new
+func (c *cherryPicks) request(ref, branch string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, b := range c.requested[ref] {
+		if b == branch {
+			return false
+		}
+	}
+	c.requested[ref] = append(c.requested[ref], branch)
+	c.save()
+	return true
+}
+
+// take returns the MR's requested cherry-picks, and forgets them
+func (c *cherryPicks) take(ref string) []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	branches, ok := c.requested[ref]
+	if ok {
+		delete(c.requested, ref)
+		c.save()
+	}
+	return branches
+}
+
+// save persists the requests.  callers hold mu
+func (c *cherryPicks) save() {
+	if err := c.store.Save(CHERRY_PICKS_STORE_KEY, c.requested); err != nil {
+		logrus.WithError(err).Error("failed to persist requested cherry-picks")
+	}
+}
+
+// cherryPickFromComment handles `/odds cherry-pick <branch>`.  open MRs are cherry-picked once they merge, merged
+// ones right away
+func (bot bot) cherryPickFromComment(ev *gitlab.MergeCommentEvent, args string) error {
+	branch := strings.TrimSpace(args)
+	if branch == "" || strings.ContainsAny(branch, " \t") {
+		return fmt.Errorf("`%s %s` needs one branch to cherry-pick onto", COMMENT_COMMAND_PREFIX, COMMENT_COMMAND_CHERRY_PICK)
+	}
+	mr, _, err := bot.commandTarget(ev, true)
+	if err != nil {
+		return err
+	}
+	if branch == mr.TargetBranch {
+		return fmt.Errorf("it targets `%s` already", branch)
+	}
+	if mr.State == "merged" {
+		bot.cherryPick(mr, branch, bot.route(ev.Project.PathWithNamespace, ev.ProjectID, nil, ""))
+		return nil
+	}
+	if bot.cherryPicks.request(mrRef(ev.ProjectID, mr.IID), branch) {
+		bot.commentOn(ev.ProjectID, mr.IID, fmt.Sprintf("@%s I'll cherry-pick this onto `%s` once it's merged.", ev.User.Username, branch))
+	}
+	return nil
+}
+
+// cherryPickMerged opens the cherry-pick MRs requested for the MR that was just merged
+func (bot bot) cherryPickMerged(ev *gitlab.MergeEvent, slackChans []string) {
+	branches := bot.cherryPicks.take(mrRef(ev.Project.ID, ev.ObjectAttributes.IID))
+	if len(branches) == 0 {
+		return
+	}
+	mr, err := bot.gl.GetMergeRequest(ev.Project.ID, ev.ObjectAttributes.IID)
+	if err != nil {
+		logrus.WithError(err).Errorf("failed to look up merge request !%d to cherry-pick it", ev.ObjectAttributes.IID)
+		return
+	}
+	for _, branch := range branches {
+		bot.cherryPick(mr, branch, slackChans)
+	}
+}
+
+// cherryPick branches off the target branch, cherry-picks the merged MR's merge (or squash) commit onto it, and opens
+// an MR for it assigned to the original author.  how it went is told to the MR's thread
+func (bot bot) cherryPick(mr *gitlab.MergeRequest, target string, slackChans []string) {
+	pick, err := bot.createCherryPickMR(mr, target)
+	if err != nil {
+		logrus.WithError(err).Errorf("failed to cherry-pick merge request !%d onto %s", mr.IID, target)
+		bot.notifyThreadLocalized(mr.ProjectID, mr.IID, tr(":warning: I couldn't cherry-pick <%s|!%d> onto `%s`, it may conflict: %v",
+			mr.WebURL, mr.IID, target, err), slackChans)
+		bot.commentOn(mr.ProjectID, mr.IID, fmt.Sprintf("I couldn't cherry-pick this onto `%s`, it'll need doing by hand: %v", target, err))
+		return
+	}
+	bot.notifyThreadLocalized(mr.ProjectID, mr.IID, tr(":cherries: <%s|!%d> is cherry-picked onto `%s` in <%s|!%d>.",
+		mr.WebURL, mr.IID, target, pick.WebURL, pick.IID), slackChans)
+	bot.commentOn(mr.ProjectID, mr.IID, fmt.Sprintf("Cherry-picked onto `%s` in !%d.", target, pick.IID))
+}
+
+// createCherryPickMR is createRevertMR for cherry-picks
+func (bot bot) createCherryPickMR(mr *gitlab.MergeRequest, target string) (*gitlab.MergeRequest, error) {
+	sha := mr.MergeCommitSHA
+	if sha == "" { // fast-forward merges don't have a merge commit
+		sha = mr.SquashCommitSHA
+	}
+	if sha == "" {
+		return nil, fmt.Errorf("merge request has no merge or squash commit to cherry-pick")
+	}
+
+	branch := fmt.Sprintf("cherry-pick-%s-%s", sha[:8], strings.ReplaceAll(target, "/", "-"))
+	title := fmt.Sprintf("[%s] %s", target, mr.Title)
+	description := fmt.Sprintf("This cherry-picks merge request !%d (commit %s) onto `%s`.", mr.IID, sha, target)
+	if _, err := bot.gl.CreateBranch(mr.ProjectID, branch, target); err != nil {
+		return nil, err
+	}
+	if _, err := bot.gl.CherryPickCommit(mr.ProjectID, sha, branch); err != nil {
+		return nil, err
+	}
+	opt := &gitlab.CreateMergeRequestOptions{
+		Title:              &title,
+		Description:        &description,
+		SourceBranch:       &branch,
+		TargetBranch:       &target,
+		RemoveSourceBranch: gitlab.Bool(true),
+	}
+	if mr.Author != nil {
+		opt.AssigneeIDs = &[]int{mr.Author.ID}
+	}
+	return bot.gl.CreateMergeRequest(mr.ProjectID, opt)
+}
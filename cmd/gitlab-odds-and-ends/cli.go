@@ -0,0 +1,175 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"sort"
+
+	"github.com/slack-go/slack"
+	"github.com/xanzy/go-gitlab"
+)
+
+const (
+	COMMAND_SERVE           = "serve"
+	COMMAND_VALIDATE_CONFIG = "validate-config"
+	COMMAND_ENROLL          = "enroll"
+	COMMAND_TEST_NOTIFY     = "test-notify"
+	// CLI_ACTOR is who the audit log says made changes from the command line
+	CLI_ACTOR = "cli"
+)
+
+// command is one of the bot's subcommands.  each is configured by the same environment as `serve`
+type command struct {
+	// args are the command's arguments after its flags, for the usage message
+	args string
+	help string
+	run  func(args []string)
+}
+
+func commands() map[string]command {
+	return map[string]command{
+		COMMAND_SERVE:           {help: "run the bot.  this is the default without a command", run: runServe},
+		COMMAND_VALIDATE_CONFIG: {help: "check the configuration, and that gitlab and slack accept the bot's tokens", run: runValidateConfig},
+		COMMAND_ENROLL:          {args: "<group/project>", help: "add the bot's webhook to a gitlab project", run: runEnroll},
+		COMMAND_TEST_NOTIFY:     {args: "<channel>", help: "send a channel a sample new merge request notification, to check its formatting", run: runTestNotify},
+	}
+}
+
+// usage lists the commands
+func usage() {
+	fmt.Fprintf(os.Stderr, "usage: %s [command] [flags]\n\ncommands:\n", os.Args[0])
+	cmds := commands()
+	var names []string
+	for name := range cmds {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(os.Stderr, "  %s %s\n    \t%s\n", name, cmds[name].args, cmds[name].help)
+	}
+}
+
+// parseCommand parses a command's flags, and requires it have as many arguments as its usage says
+func parseCommand(name string, flags *flag.FlagSet, args []string) []string {
+	want := commands()[name].args
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "usage: %s %s [flags] %s\n", os.Args[0], name, want)
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if (want == "") != (flags.NArg() == 0) || flags.NArg() > 1 {
+		flags.Usage()
+		os.Exit(2)
+	}
+	return flags.Args()
+}
+
+// runValidateConfig starts the bot as far as `serve` would without serving anything, then checks every gitlab instance
+// and slack take their tokens.  it exits non-zero if anything is wrong, so it can gate a deployment
+func runValidateConfig(args []string) {
+	parseCommand(COMMAND_VALIDATE_CONFIG, flag.NewFlagSet(COMMAND_VALIDATE_CONFIG, flag.ExitOnError), args)
+	if _, _, err := listenAddrsFromEnv(); err != nil {
+		log.Fatalf("Failed to configure listeners: %v", err)
+	}
+	b, slk, _ := setup(false)
+	cfg, _ := b.reloader.current()
+	fmt.Printf("config: %d projects, %d groups, %d policies, %d instances besides %s\n",
+		len(cfg.Projects), len(cfg.Groups), len(cfg.Policies), len(cfg.Instances), GITLAB_BASE_URL)
+
+	failed := false
+	for _, target := range b.instances.all() {
+		name := target.instance
+		if name == "" {
+			name = GITLAB_BASE_URL
+		}
+		user, err := target.gl.CurrentUser()
+		if err != nil {
+			fmt.Printf("gitlab %s: %v\n", name, err)
+			failed = true
+			continue
+		}
+		fmt.Printf("gitlab %s: authenticated as @%s\n", name, user.Username)
+	}
+	if slk == nil {
+		fmt.Println("slack: no token set")
+	} else if auth, err := slk.AuthTest(); err != nil {
+		fmt.Printf("slack: %v\n", err)
+		failed = true
+	} else {
+		fmt.Printf("slack: authenticated as %s in %s\n", auth.User, auth.Team)
+	}
+	if failed {
+		os.Exit(1)
+	}
+}
+
+// runEnroll adds the bot's webhook to a project, with every event the bot handles, like the system hooks' enroll does
+// for new projects.  the hook URL gets the instance's name and the channel, so the project is routed without a config change
+func runEnroll(args []string) {
+	flags := flag.NewFlagSet(COMMAND_ENROLL, flag.ExitOnError)
+	instance := flags.String("instance", "", "name of the gitlab instance the project is on, instead of GITLAB_BASE_URL")
+	hookURL := flags.String("url", "", "the bot's /gitlab/callback as gitlab reaches it (default the config's system_hooks.enroll.url)")
+	channel := flags.String("channel", "", "channel to notify about the project, instead of its route from the config file")
+	path := parseCommand(COMMAND_ENROLL, flags, args)[0]
+
+	b, _, _ := setup(false)
+	target, ok := b.instances.get(*instance)
+	if !ok {
+		log.Fatalf("Failed to enroll %s: no gitlab instance named %q", path, *instance)
+	}
+	if *hookURL == "" && target.systemHooks != nil {
+		*hookURL = target.systemHooks.cfg.Enroll.URL
+	}
+	if *hookURL == "" {
+		log.Fatalf("Failed to enroll %s: set -url to the bot's webhook URL", path)
+	}
+	u, err := url.Parse(*hookURL)
+	if err != nil {
+		log.Fatalf("Failed to enroll %s: invalid webhook URL: %v", path, err)
+	}
+	query := u.Query()
+	if *instance != "" {
+		query.Set(GITLAB_INSTANCE_QUERY_PARAM, *instance)
+	}
+	if *channel != "" {
+		query.Set(GITLAB_SLACK_CHANNEL_QUERY_PARAM, *channel)
+	}
+	u.RawQuery = query.Encode()
+
+	project, err := target.gl.GetProjectByPath(path)
+	if err != nil {
+		log.Fatalf("Failed to find project %s: %v", path, err)
+	}
+	if err := target.enroll(project.ID, project.PathWithNamespace, u.String(), CLI_ACTOR); err != nil {
+		log.Fatalf("Failed to enroll %s: %v", path, err)
+	}
+	fmt.Printf("%s now sends its webhooks to %s\n", project.PathWithNamespace, u)
+}
+
+// runTestNotify sends the channel a new MR notification for a made up MR, as block kit with the buttons the bot would
+// add.  the buttons don't do anything useful
+func runTestNotify(args []string) {
+	channel := parseCommand(COMMAND_TEST_NOTIFY, flag.NewFlagSet(COMMAND_TEST_NOTIFY, flag.ExitOnError), args)[0]
+	b, _, _ := setup(false)
+
+	mr := &gitlab.MergeEvent{}
+	mr.Project.ID = 1
+	mr.Project.PathWithNamespace = "example/project"
+	mr.ObjectAttributes.IID = 1
+	mr.ObjectAttributes.Title = "Test notification from gitlab-odds-and-ends"
+	mr.ObjectAttributes.URL = GITLAB_BASE_URL
+	mr.ObjectAttributes.Target = &gitlab.Repository{Name: "project", PathWithNamespace: "example/project"}
+	layout := b.newMRBlocks(mr.Project.ID, mr.ObjectAttributes.IID)
+	if layout == nil {
+		layout = func(text string) []slack.Block {
+			return []slack.Block{slack.NewSectionBlock(slack.NewTextBlockObject(slack.MarkdownType, text, false, false), nil, nil)}
+		}
+	}
+	if sent := b.notifyBlocksLocalized(b.newMRMessage(mr, "A. Author", "A. Maintainer"), layout, []string{channel}); len(sent) == 0 {
+		log.Fatalf("Failed to send the test notification to %s", channel)
+	}
+	fmt.Printf("sent the test notification to %s\n", channel)
+}
@@ -0,0 +1,311 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/raidancampbell/gitlab-odds-and-ends/internal/assign"
+	"github.com/raidancampbell/gitlab-odds-and-ends/internal/store"
+	"github.com/sirupsen/logrus"
+	"github.com/xanzy/go-gitlab"
+)
+
+const (
+	COMMENT_COMMAND_PREFIX       = "/odds"
+	COMMENT_COMMAND_REASSIGN     = "reassign"
+	COMMENT_COMMAND_ADD_REVIEWER = "add-reviewer"
+	COMMENT_COMMAND_REMIND_ME    = "remind-me"
+	COMMENT_COMMAND_CHERRY_PICK  = "cherry-pick"
+	COMMENT_COMMAND_HELP         = "help"
+	// MAX_REMINDER_DELAY is how far out `/odds remind-me` can be set, and MAX_PENDING_REMINDERS how many reminders
+	// each user can have waiting, so reminders can't pile up in the store
+	MAX_REMINDER_DELAY    = 30 * 24 * time.Hour
+	MAX_PENDING_REMINDERS = 20
+	REMINDERS_STORE_KEY   = "reminders"
+	// REMINDER_CHECK_INTERVAL is how often reminders are checked for being due
+	REMINDER_CHECK_INTERVAL = time.Minute
+)
+
+// oddsComment is `/odds <command> [args]` on a line of its own in an MR comment
+var oddsComment = regexp.MustCompile(`(?m)^\s*` + regexp.QuoteMeta(COMMENT_COMMAND_PREFIX) + `\s+([\w\-]+)[ \t]*(.*?)\s*$`)
+
+// commentCommandHelp lists the commands, for `/odds help` and commands the bot doesn't know
+const commentCommandHelp = "`/odds reassign` gives the review to another maintainer, `/odds add-reviewer [@someone]` adds a " +
+	"reviewer (a random maintainer if nobody's named), `/odds remind-me 2d` reminds you about this merge request later, and " +
+	"`/odds cherry-pick release-1.2` opens a merge request cherry-picking it onto that branch once it's merged"
+
+// commentCommands runs the `/odds` commands in an MR comment
+func (bot bot) commentCommands(ev *gitlab.MergeCommentEvent) {
+	for _, m := range oddsComment.FindAllStringSubmatch(ev.ObjectAttributes.Note, -1) {
+		command, args := strings.ToLower(m[1]), m[2]
+		var err error
+		switch command {
+		case COMMENT_COMMAND_REASSIGN:
+			err = bot.reassignFromComment(ev)
+		case COMMENT_COMMAND_ADD_REVIEWER:
+			err = bot.addReviewerFromComment(ev, args)
+		case COMMENT_COMMAND_REMIND_ME:
+			err = bot.remindFromComment(ev, args)
+		case COMMENT_COMMAND_CHERRY_PICK:
+			err = bot.cherryPickFromComment(ev, args)
+		case COMMENT_COMMAND_HELP:
+			bot.commentOn(ev.ProjectID, ev.MergeRequest.IID, fmt.Sprintf("@%s %s.", ev.User.Username, commentCommandHelp))
+		default:
+			bot.commentOn(ev.ProjectID, ev.MergeRequest.IID, fmt.Sprintf("@%s I don't know `%s %s`.  %s.", ev.User.Username, COMMENT_COMMAND_PREFIX, command, commentCommandHelp))
+		}
+		if err != nil {
+			logrus.WithError(err).Warnf("failed to run `%s %s` on merge request !%d", COMMENT_COMMAND_PREFIX, command, ev.MergeRequest.IID)
+			bot.commentOn(ev.ProjectID, ev.MergeRequest.IID, fmt.Sprintf("@%s I couldn't %s: %v", ev.User.Username, command, err))
+		}
+	}
+}
+
+// commandTarget looks up the MR a command was commented on, and checks the commenter may change its review: they
+// must be its author, assignee, a reviewer, or a maintainer of the project.  the MR must be open, or merged if allowMerged
+func (bot bot) commandTarget(ev *gitlab.MergeCommentEvent, allowMerged bool) (*gitlab.MergeRequest, []*gitlab.ProjectMember, error) {
+	mr, err := bot.gl.GetMergeRequest(ev.ProjectID, ev.MergeRequest.IID)
+	if err != nil {
+		return nil, nil, err
+	}
+	if mr.State != "opened" && !(allowMerged && mr.State == "merged") {
+		return nil, nil, fmt.Errorf("!%d is %s", mr.IID, mr.State)
+	}
+	maintainers, err := getProjectMaintainers(bot.gl, ev.ProjectID)
+	if err != nil {
+		return nil, nil, err
+	}
+	username := ev.User.Username
+	allowed := (mr.Author != nil && mr.Author.Username == username) || (mr.Assignee != nil && mr.Assignee.Username == username)
+	for _, r := range mr.Reviewers {
+		allowed = allowed || r.Username == username
+	}
+	for _, m := range maintainers {
+		allowed = allowed || m.Username == username
+	}
+	if !allowed {
+		return nil, nil, fmt.Errorf("only its author, assignee, reviewers, or a maintainer can change who reviews it")
+	}
+	return mr, maintainers, nil
+}
+
+// reassignFromComment handles `/odds reassign`, handing the review off to a random maintainer other than whoever has it
+func (bot bot) reassignFromComment(ev *gitlab.MergeCommentEvent) error {
+	mr, maintainers, err := bot.commandTarget(ev, false)
+	if err != nil {
+		return err
+	}
+	exclude := []int{}
+	if mr.Author != nil {
+		exclude = append(exclude, mr.Author.ID)
+	}
+	if mr.Assignee != nil {
+		exclude = append(exclude, mr.Assignee.ID)
+	}
+	for _, r := range mr.Reviewers {
+		exclude = append(exclude, r.ID)
+	}
+	id, ok := assign.Pick(memberIDs(maintainers), exclude...)
+	if !ok {
+		return fmt.Errorf("there's no other maintainer to give it to")
+	}
+	to, err := bot.gl.GetUser(id)
+	if err != nil {
+		return err
+	}
+	if _, err := bot.handoff(ev.ProjectID, mr.IID, to, "gitlab:"+ev.User.Username); err != nil {
+		return err
+	}
+	bot.commentOn(ev.ProjectID, mr.IID, fmt.Sprintf("@%s this review is yours now, @%s asked for someone else.", to.Username, ev.User.Username))
+	return nil
+}
+
+// addReviewerFromComment handles `/odds add-reviewer [@someone]`.  without someone, a random maintainer who isn't
+// already reviewing is added
+func (bot bot) addReviewerFromComment(ev *gitlab.MergeCommentEvent, args string) error {
+	mr, maintainers, err := bot.commandTarget(ev, false)
+	if err != nil {
+		return err
+	}
+	reviewing := make(map[int]bool)
+	for _, r := range mr.Reviewers {
+		reviewing[r.ID] = true
+	}
+	if mr.Assignee != nil {
+		reviewing[mr.Assignee.ID] = true
+	}
+	author := 0
+	if mr.Author != nil {
+		author = mr.Author.ID
+	}
+
+	var reviewer *gitlab.ProjectMember
+	if name := strings.TrimPrefix(strings.TrimSpace(args), "@"); name != "" {
+		for _, m := range maintainers {
+			if m.Username == name {
+				reviewer = m
+			}
+		}
+		if reviewer == nil {
+			return fmt.Errorf("%s isn't a maintainer of this project", name)
+		}
+		if reviewer.ID == author {
+			return fmt.Errorf("%s wrote it, they can't review it", name)
+		}
+	} else {
+		add, _ := assign.TopUp(memberIDs(maintainers), reviewing, author, len(reviewing)+1)
+		if len(add) == 0 {
+			return fmt.Errorf("every maintainer is already reviewing it")
+		}
+		reviewer = memberByID(maintainers, add[0])
+	}
+
+	if bot.reviewersSupported {
+		ids := []int{reviewer.ID}
+		for _, r := range mr.Reviewers {
+			if r.ID != reviewer.ID {
+				ids = append(ids, r.ID)
+			}
+		}
+		if _, err := bot.gl.UpdateMergeRequest(ev.ProjectID, mr.IID, &gitlab.UpdateMergeRequestOptions{ReviewerIDs: &ids}); err != nil {
+			return err
+		}
+	}
+	bot.commentOn(ev.ProjectID, mr.IID, fmt.Sprintf("@%s please review this merge request, @%s asked for another reviewer.", reviewer.Username, ev.User.Username))
+	return nil
+}
+
+// parseReminderDelay parses a duration like `2d`, `1w`, or anything time.ParseDuration takes, like `4h`, up to
+// MAX_REMINDER_DELAY
+func parseReminderDelay(s string) (time.Duration, error) {
+	s = strings.TrimSpace(s)
+	tooLong := fmt.Errorf("`%s` is too far out, reminders can be at most %d days away", s, MAX_REMINDER_DELAY/(24*time.Hour))
+	for suffix, unit := range map[string]time.Duration{"d": 24 * time.Hour, "w": 7 * 24 * time.Hour} {
+		if n, err := strconv.Atoi(strings.TrimSuffix(s, suffix)); strings.HasSuffix(s, suffix) && err == nil && n > 0 {
+			// compared before multiplying, which could overflow
+			if n > int(MAX_REMINDER_DELAY/unit) {
+				return 0, tooLong
+			}
+			return time.Duration(n) * unit, nil
+		}
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("`%s` isn't a delay like `2d` or `4h`", s)
+	}
+	if d > MAX_REMINDER_DELAY {
+		return 0, tooLong
+	}
+	return d, nil
+}
+
+// reminder is an `/odds remind-me` waiting to go off
+type reminder struct {
+	ProjectID int       `json:"project_id"`
+	IID       int       `json:"iid"`
+	Username  string    `json:"username"` // gitlab username
+	At        time.Time `json:"at"`
+}
+
+// pendingReminders are the reminders that haven't gone off yet, keyed by reminderKey.  they're kept in the store, so
+// a restart doesn't lose them, and whichever replica runs the jobs sends them
+type pendingReminders struct {
+	store   *store.Store
+	mu      sync.Mutex
+	waiting map[string]reminder
+}
+
+func newPendingReminders(s *store.Store) (*pendingReminders, error) {
+	r := &pendingReminders{store: s, waiting: make(map[string]reminder)}
+	if _, err := s.Load(REMINDERS_STORE_KEY, &r.waiting); err != nil {
+		return nil, err
+	}
+	s.Follow(REMINDERS_STORE_KEY, &r.waiting, &r.mu)
+	return r, nil
+}
+
+// reminderKey tells apart reminders, even the same user's about the same MR
+func reminderKey(rem reminder) string {
+	return fmt.Sprintf("%s %s %d", mrRef(rem.ProjectID, rem.IID), rem.Username, rem.At.UnixNano())
+}
+
+// add saves the reminder, unless its user already has MAX_PENDING_REMINDERS waiting
+func (r *pendingReminders) add(rem reminder) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	waiting := 0
+	for _, w := range r.waiting {
+		if w.Username == rem.Username {
+			waiting++
+		}
+	}
+	if waiting >= MAX_PENDING_REMINDERS {
+		return false
+	}
+	r.waiting[reminderKey(rem)] = rem
+	r.saveLocked()
+	return true
+}
+
+// due forgets the reminders whose time has come, returning them
+func (r *pendingReminders) due() []reminder {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var due []reminder
+	now := time.Now()
+	for key, rem := range r.waiting {
+		if !now.Before(rem.At) {
+			delete(r.waiting, key)
+			due = append(due, rem)
+		}
+	}
+	if len(due) > 0 {
+		r.saveLocked()
+	}
+	sort.Slice(due, func(i, j int) bool { return due[i].At.Before(due[j].At) })
+	return due
+}
+
+func (r *pendingReminders) saveLocked() {
+	if err := r.store.Save(REMINDERS_STORE_KEY, r.waiting); err != nil {
+		logrus.WithError(err).Error("failed to persist reminders")
+	}
+}
+
+// remindFromComment handles `/odds remind-me <delay>`.  anyone can set a reminder for themselves: it's a slack DM if
+// they're known on slack, or a comment mentioning them otherwise, sent by remindDue
+func (bot bot) remindFromComment(ev *gitlab.MergeCommentEvent, args string) error {
+	delay, err := parseReminderDelay(args)
+	if err != nil {
+		return err
+	}
+	rem := reminder{ProjectID: ev.ProjectID, IID: ev.MergeRequest.IID, Username: ev.User.Username, At: time.Now().Add(delay)}
+	if !bot.reminders.add(rem) {
+		return fmt.Errorf("you already have %d reminders waiting", MAX_PENDING_REMINDERS)
+	}
+	bot.commentOn(rem.ProjectID, rem.IID, fmt.Sprintf("@%s I'll remind you about this on %s.", rem.Username, rem.At.Format(time.RFC1123)))
+	return nil
+}
+
+// remindDue sends the reminders whose time has come, for MRs that are still open
+func (bot bot) remindDue() {
+	for _, rem := range bot.reminders.due() {
+		mr, err := bot.gl.GetMergeRequest(rem.ProjectID, rem.IID)
+		if err != nil {
+			logrus.WithError(err).Errorf("failed to look up merge request !%d for a reminder", rem.IID)
+			continue
+		}
+		if mr.State != "opened" {
+			continue
+		}
+		if slackID, err := bot.users.slackUser(rem.Username); err == nil {
+			bot.notifyLocalized(tr(":alarm_clock: you asked to be reminded about <%s|!%d %s>", mr.WebURL, mr.IID, mr.Title), []string{slackID})
+			continue
+		}
+		bot.commentOn(rem.ProjectID, rem.IID, fmt.Sprintf("@%s here's the reminder you asked for.", rem.Username))
+	}
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/raidancampbell/gitlab-odds-and-ends/internal/store"
+)
+
+func TestParseReminderDelay(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    time.Duration
+		wantErr bool
+	}{
+		{in: "2d", want: 48 * time.Hour},
+		{in: " 1w ", want: 7 * 24 * time.Hour},
+		{in: "4h", want: 4 * time.Hour},
+		{in: "30d", want: MAX_REMINDER_DELAY},
+		{in: "31d", wantErr: true},
+		{in: "5w", wantErr: true},
+		{in: "721h", wantErr: true},
+		{in: "9223372036854775807d", wantErr: true}, // would overflow
+		{in: "99999999999w", wantErr: true},
+		{in: "0d", wantErr: true},
+		{in: "-4h", wantErr: true},
+		{in: "soon", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			got, err := parseReminderDelay(tt.in)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseReminderDelay(%q) = %s, %v, want error %v", tt.in, got, err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("parseReminderDelay(%q) = %s, want %s", tt.in, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPendingReminders(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.json")
+	open := func() *pendingReminders {
+		s, err := store.Open(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r, err := newPendingReminders(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return r
+	}
+	later := time.Now().Add(time.Hour)
+	r := open()
+	for i := 0; i < MAX_PENDING_REMINDERS; i++ {
+		if !r.add(reminder{ProjectID: 1, IID: i, Username: "alice", At: later}) {
+			t.Fatalf("add() refused reminder %d", i+1)
+		}
+	}
+	if r.add(reminder{ProjectID: 1, IID: 1, Username: "alice", At: later.Add(time.Minute)}) {
+		t.Error("add() allowed more than MAX_PENDING_REMINDERS")
+	}
+	if !r.add(reminder{ProjectID: 1, IID: 1, Username: "bob", At: time.Now()}) {
+		t.Error("add() refused someone else's reminder")
+	}
+
+	// restarted: the reminders are still waiting, and only bob's is due
+	r = open()
+	due := r.due()
+	if len(due) != 1 || due[0].Username != "bob" || due[0].IID != 1 {
+		t.Errorf("due() = %+v, want bob's reminder", due)
+	}
+	if again := r.due(); len(again) != 0 {
+		t.Errorf("due() reminded again: %+v", again)
+	}
+	if len(open().waiting) != MAX_PENDING_REMINDERS {
+		t.Errorf("%d reminders waiting after bob's went off, want alice's %d", len(open().waiting), MAX_PENDING_REMINDERS)
+	}
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/raidancampbell/gitlab-odds-and-ends/internal/store"
+	"github.com/sirupsen/logrus"
+	"github.com/xanzy/go-gitlab"
+)
+
+const (
+	COMMENT_OPT_OUT_COMMAND    = "/bot-quiet"
+	COMMENT_OPT_OUTS_STORE_KEY = "comment_opt_outs"
+)
+
+// optOutComment is the opt-out command on a line of its own in an MR comment
+var optOutComment = regexp.MustCompile(`(?m)^\s*` + regexp.QuoteMeta(COMMENT_OPT_OUT_COMMAND) + `\s*$`)
+
+// commentsConfig is the footer of the bot's MR comments
+type commentsConfig struct {
+	// DocsURL is linked as `docs`, for people wondering what the bot is
+	DocsURL string `yaml:"docs_url"`
+	// AdminURL is linked as `admin`, e.g. the bot's admin server or whoever runs it
+	AdminURL string `yaml:"admin_url"`
+	// Text leads the footer, `posted by a bot` by default
+	Text string `yaml:"text"`
+	// DisableOptOut ignores COMMENT_OPT_OUT_COMMAND, and leaves it out of the footer
+	DisableOptOut bool `yaml:"disable_opt_out"`
+}
+
+// mrComments is how the bot comments on MRs: every comment gets the same footer, and MRs that opted out with
+// COMMENT_OPT_OUT_COMMAND get none
+type mrComments struct {
+	cfg   commentsConfig
+	store *store.Store
+
+	mu      sync.Mutex
+	optOuts map[string]bool // by mrRef
+}
+
+func newMRComments(cfg commentsConfig, s *store.Store) (*mrComments, error) {
+	c := &mrComments{cfg: cfg, store: s, optOuts: make(map[string]bool)}
+	if _, err := s.Load(COMMENT_OPT_OUTS_STORE_KEY, &c.optOuts); err != nil {
+		return nil, err
+	}
+	s.Follow(COMMENT_OPT_OUTS_STORE_KEY, &c.optOuts, &c.mu)
+	return c, nil
+}
+
+// footer is the markdown appended to each comment
+func (c *mrComments) footer() string {
+	parts := []string{c.cfg.Text}
+	if parts[0] == "" {
+		parts[0] = ":robot: posted by a bot"
+	}
+	if c.cfg.DocsURL != "" {
+		parts = append(parts, fmt.Sprintf("[docs](%s)", c.cfg.DocsURL))
+	}
+	if c.cfg.AdminURL != "" {
+		parts = append(parts, fmt.Sprintf("[admin](%s)", c.cfg.AdminURL))
+	}
+	if !c.cfg.DisableOptOut {
+		parts = append(parts, fmt.Sprintf("comment `%s` to stop its comments on this MR", COMMENT_OPT_OUT_COMMAND))
+	}
+	return "\n\n---\n<sub>" + strings.Join(parts, " · ") + "</sub>"
+}
+
+// build returns the comment body with the footer
+func (c *mrComments) build(body string) string {
+	return body + c.footer()
+}
+
+// post comments on the MR through gl, unless it opted out
+func (c *mrComments) post(gl GitLabAPI, projectID, iid int, body string) error {
+	c.mu.Lock()
+	quiet := c.optOuts[mrRef(projectID, iid)]
+	c.mu.Unlock()
+	if quiet {
+		logrus.Debugf("merge request !%d opted out of comments, not posting: %s", iid, body)
+		return nil
+	}
+	_, err := gl.CreateMergeRequestNote(projectID, iid, c.build(body))
+	return err
+}
+
+// optOut stops further comments on the MR
+func (c *mrComments) optOut(projectID, iid int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.optOuts[mrRef(projectID, iid)] = true
+	if err := c.store.Save(COMMENT_OPT_OUTS_STORE_KEY, c.optOuts); err != nil {
+		logrus.WithError(err).Error("failed to persist comment opt-outs")
+	}
+}
+
+// commentOn leaves a note on the MR, logging failures
+func (bot bot) commentOn(projectID, iid int, body string) {
+	if err := bot.comments.post(bot.gl, projectID, iid, body); err != nil {
+		logrus.WithError(err).Errorf("failed to comment on merge request !%d", iid)
+	}
+}
+
+// mergeComment receives comments on MRs, for the commands people can give the bot there
+func (bot bot) mergeComment(ev *gitlab.MergeCommentEvent) {
+	if ev.User == nil {
+		return
+	}
+	bot.recordFirstReview(ev)
+	if !bot.comments.cfg.DisableOptOut && optOutComment.MatchString(ev.ObjectAttributes.Note) {
+		bot.comments.optOut(ev.ProjectID, ev.MergeRequest.IID)
+		bot.audit.record(auditEntry{
+			Action:  "comment_opt_out",
+			Actor:   "gitlab:" + ev.User.Username,
+			Target:  fmt.Sprintf("%s!%d", ev.Project.PathWithNamespace, ev.MergeRequest.IID),
+			Outcome: "the bot won't comment on the merge request again",
+		})
+	}
+	if m := handoffComment.FindStringSubmatch(ev.ObjectAttributes.Note); m != nil {
+		bot.handoffFromComment(ev, m[1])
+	}
+	bot.commentCommands(ev)
+}
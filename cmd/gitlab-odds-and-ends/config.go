@@ -0,0 +1,130 @@
+package main
+
+import (
+	"github.com/raidancampbell/gitlab-odds-and-ends/internal/config"
+)
+
+const (
+	CONFIG_FILE_ENV_VAR = "CONFIG_FILE"
+)
+
+// botConfig is the optional YAML configuration file.  Everything in it is optional; without it routing relies
+// entirely on the `slack-channel` query parameter of each webhook.
+type botConfig struct {
+	// Projects maps gitlab projects to the slack channels that care about them
+	Projects []projectConfig `yaml:"projects"`
+	// Groups route the projects of whole groups that aren't in Projects, most specific group first
+	Groups []groupConfig `yaml:"groups"`
+	// Users maps slack users to gitlab users, for when their email addresses don't match
+	Users []userConfig `yaml:"users"`
+	// Policies are review rule bundles, applied to projects by tagging them with the bundle's topic in gitlab
+	Policies []policyConfig `yaml:"policies"`
+	// ReleaseSignoff has teams sign off on release candidate tags before the release is created
+	ReleaseSignoff releaseSignoffConfig `yaml:"release_signoff"`
+	// Freezes are deploy freeze windows
+	Freezes freezeConfig `yaml:"freezes"`
+	// DefaultRoutes routes projects that aren't in Projects and whose webhooks don't name a channel
+	DefaultRoutes defaultRoutesConfig `yaml:"default_routes"`
+	// Teams are Microsoft Teams channels, which projects and rules route to as `teams:<name>`
+	Teams []teamsChannelConfig `yaml:"teams"`
+	// Recognition gives reviewers shout-outs for review milestones and streaks
+	Recognition recognitionConfig `yaml:"recognition"`
+	// OutgoingWebhooks get the bot's events as signed JSON, for other systems to consume
+	OutgoingWebhooks []outgoingWebhookConfig `yaml:"outgoing_webhooks"`
+	// RoutingRules send matching events to more channels than their project's
+	RoutingRules []routingRule `yaml:"routing_rules"`
+	// Comments is the footer of the bot's MR comments
+	Comments commentsConfig `yaml:"comments"`
+	// Locales translates notifications and reminders for channels that want another language
+	Locales localesConfig `yaml:"locales"`
+	// SystemHooks handles gitlab's instance-wide system hooks
+	SystemHooks systemHooksConfig `yaml:"system_hooks"`
+	// Changelog keeps a changelog of MRs merged into default branches
+	Changelog changelogConfig `yaml:"changelog"`
+	// QuietHours hold back channels' messages overnight and on weekends
+	QuietHours []quietHoursConfig `yaml:"quiet_hours"`
+	// OPA has MRs follow rego policies
+	OPA opaConfig `yaml:"opa"`
+	// Instances are more gitlabs to serve besides the one at GITLAB_BASE_URL.  the rest of the config applies to all of them
+	Instances []instanceConfig `yaml:"instances"`
+}
+
+type projectConfig struct {
+	// Project is the project's path with namespace, e.g. `group/project`
+	Project string `yaml:"project"`
+	// Channels are slack channel IDs, `teams:<name>` for Microsoft Teams channels, `discord:<channel ID>`, or
+	// `mattermost:<channel ID>`, or `email:<address>` (see notify.EMAIL_CHANNEL_PREFIX)
+	Channels []string `yaml:"channels"`
+	// DeferDrafts holds off assigning and announcing draft MRs until they're marked ready
+	DeferDrafts bool `yaml:"defer_drafts"`
+	// Labels are applied to MRs based on the files they change
+	Labels []labelRule `yaml:"labels"`
+	// Experts are the maintainers who get the project's MRs in their area first, see expertRule
+	Experts []expertRule `yaml:"experts"`
+	// Locale is the language of the project's channels, e.g. `de`, if not english.  see localesConfig
+	Locale string `yaml:"locale"`
+	// Policy is the topic of the policy bundle the project follows, whatever its topics in gitlab are
+	Policy string `yaml:"policy"`
+	// Rebase is what to do about MRs that fall behind their target branch, see REBASE_API and REBASE_COMMENT.  empty
+	// leaves them alone
+	Rebase string `yaml:"rebase"`
+	// Reviewers is how many maintainers should be reviewing each MR, if not what the project's policy says
+	Reviewers int `yaml:"reviewers"`
+	// LabelReviewers are how many maintainers should be reviewing MRs with a label, e.g. `security: 3`, when that's
+	// more than Reviewers
+	LabelReviewers map[string]int `yaml:"label_reviewers"`
+	// Events are the webhook events that notify the project's channels, e.g. `[merge_request, deployment]`, see
+	// eventKinds.  empty is all of them
+	Events []string `yaml:"events"`
+	// SlackGroup is the ID of the slack user group of the project's maintainers, e.g. `S0123456789`, mentioned when
+	// there aren't enough of them to tag and in review SLA escalations.  it takes the place of its policy's
+	SlackGroup string `yaml:"slack_group"`
+	// TargetBranches are branch globs, e.g. `[main, release/*]`.  only MRs into them are assigned and announced, so MRs
+	// between teammates' feature branches don't pull in maintainers.  empty is every branch
+	TargetBranches []string `yaml:"target_branches"`
+	// Actions are the MR actions that notify, e.g. `[open, merge]` to skip the noise of updates and approvals.  empty
+	// is all of them
+	Actions []string `yaml:"actions"`
+	// DND is what DMs to the project's reviewers do when they have slack's do not disturb on: `defer` (the default)
+	// until it's off, or `thread` to post in the MR's thread instead
+	DND string `yaml:"dnd"`
+	// Script is a starlark file, relative to the config file, for routing and assignment the config can't express.
+	// see scriptedRoute and scriptedAssignee for what it can define
+	Script string `yaml:"script"`
+}
+
+// projectSettings indexes the configured projects by path with namespace.  unconfigured projects get the zero value
+type projectSettings map[string]projectConfig
+
+func newProjectSettings(projects []projectConfig) projectSettings {
+	settings := make(projectSettings)
+	for _, p := range projects {
+		settings[p.Project] = p
+	}
+	return settings
+}
+
+type userConfig struct {
+	// Slack is the slack user ID, e.g. `U0123456789`
+	Slack string `yaml:"slack"`
+	// GitLab is the gitlab username
+	GitLab string `yaml:"gitlab"`
+	// Mattermost is the mattermost username, if it isn't the same as the gitlab one
+	Mattermost string `yaml:"mattermost"`
+	// Timezone is the user's IANA timezone, e.g. `Europe/Berlin`.  without it, it's worked out from the local time on
+	// their gitlab profile
+	Timezone string `yaml:"timezone"`
+	// WorkingHours are when the user reviews, e.g. `08:00-16:00` in their timezone, if not WORKING_HOURS
+	WorkingHours string `yaml:"working_hours"`
+	// WorkingDays are the days the user works, e.g. `[sun, mon, tue, wed, thu]`, if not monday to friday
+	WorkingDays []string `yaml:"working_days"`
+}
+
+// loadConfig reads the config file at path.  An empty path is an empty config
+func loadConfig(path string) (*botConfig, error) {
+	cfg := &botConfig{}
+	if err := config.Load(path, cfg); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
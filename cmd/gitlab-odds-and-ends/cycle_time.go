@@ -0,0 +1,264 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/raidancampbell/gitlab-odds-and-ends/internal/store"
+	"github.com/sirupsen/logrus"
+	"github.com/xanzy/go-gitlab"
+)
+
+const (
+	CYCLE_TIME_STORE_KEY           = "cycle_times"
+	CYCLE_TIME_REPORT_DAY_ENV_VAR  = "CYCLE_TIME_REPORT_DAY"
+	CYCLE_TIME_REPORT_TIME_ENV_VAR = "CYCLE_TIME_REPORT_TIME"
+	DEFAULT_CYCLE_TIME_REPORT_TIME = "09:00"
+	CYCLE_TIME_PERIOD              = 7 * 24 * time.Hour
+	// CYCLE_TIME_RETENTION is how long merged MRs are kept for reports
+	CYCLE_TIME_RETENTION = 90 * 24 * time.Hour
+)
+
+// mrCycle is when an MR reached each step on its way to being merged.  steps it hasn't reached are zero
+type mrCycle struct {
+	Project     string    `json:"project"`
+	IID         int       `json:"iid"`
+	Opened      time.Time `json:"opened"`
+	FirstReview time.Time `json:"first_review"`
+	Approved    time.Time `json:"approved"`
+	Merged      time.Time `json:"merged"`
+}
+
+// cycleTimes records the steps of every MR the bot sees opened, keyed by mrRef, and keeps them in the store
+type cycleTimes struct {
+	store *store.Store
+
+	mu  sync.Mutex
+	mrs map[string]*mrCycle
+}
+
+func newCycleTimes(s *store.Store) (*cycleTimes, error) {
+	c := &cycleTimes{store: s, mrs: make(map[string]*mrCycle)}
+	if _, err := s.Load(CYCLE_TIME_STORE_KEY, &c.mrs); err != nil {
+		return nil, err
+	}
+	s.Follow(CYCLE_TIME_STORE_KEY, &c.mrs, &c.mu)
+	return c, nil
+}
+
+// opened starts tracking the MR, unless it already is (e.g. it was reopened)
+func (c *cycleTimes) opened(project string, projectID, iid int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	ref := mrRef(projectID, iid)
+	if _, ok := c.mrs[ref]; ok {
+		return
+	}
+	c.mrs[ref] = &mrCycle{Project: project, IID: iid, Opened: time.Now()}
+	c.saveLocked()
+}
+
+// step records the time a tracked MR reached a step, through set, unless it already had
+func (c *cycleTimes) step(projectID, iid int, set func(m *mrCycle) *time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	m, ok := c.mrs[mrRef(projectID, iid)]
+	if !ok {
+		return
+	}
+	if t := set(m); t.IsZero() {
+		*t = time.Now()
+		c.saveLocked()
+	}
+}
+
+// forget stops tracking an MR that was closed without merging
+func (c *cycleTimes) forget(ref string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.mrs[ref]; ok {
+		delete(c.mrs, ref)
+		c.saveLocked()
+	}
+}
+
+// saveLocked drops MRs merged longer than CYCLE_TIME_RETENTION ago and persists the rest.  c.mu must be held
+func (c *cycleTimes) saveLocked() {
+	cutoff := time.Now().Add(-CYCLE_TIME_RETENTION)
+	for ref, m := range c.mrs {
+		if !m.Merged.IsZero() && m.Merged.Before(cutoff) {
+			delete(c.mrs, ref)
+		}
+	}
+	if err := c.store.Save(CYCLE_TIME_STORE_KEY, c.mrs); err != nil {
+		logrus.WithError(err).Error("failed to persist merge request cycle times")
+	}
+}
+
+// mergedSince returns the MRs merged since the given time, by project
+func (c *cycleTimes) mergedSince(since time.Time) map[string][]mrCycle {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	merged := make(map[string][]mrCycle)
+	for _, m := range c.mrs {
+		if m.Merged.After(since) {
+			merged[m.Project] = append(merged[m.Project], *m)
+		}
+	}
+	return merged
+}
+
+// cycleTimePercentiles summarizes how long MRs took to reach a step from being opened, in hours
+type cycleTimePercentiles struct {
+	Count int     `json:"count"`
+	P50   float64 `json:"p50_hours"`
+	P75   float64 `json:"p75_hours"`
+	P90   float64 `json:"p90_hours"`
+}
+
+// newCycleTimePercentiles takes the percentiles of the durations
+func newCycleTimePercentiles(durations []time.Duration) cycleTimePercentiles {
+	p := cycleTimePercentiles{Count: len(durations)}
+	if len(durations) == 0 {
+		return p
+	}
+	sort.Slice(durations, func(i, j int) bool { return durations[i] < durations[j] })
+	hours := func(pct float64) float64 {
+		return math.Round(percentile(durations, pct).Hours()*10) / 10
+	}
+	p.P50, p.P75, p.P90 = hours(50), hours(75), hours(90)
+	return p
+}
+
+// percentile is the nearest-rank percentile of the sorted durations
+func percentile(sorted []time.Duration, pct float64) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	i := int(math.Ceil(pct/100*float64(len(sorted)))) - 1
+	if i < 0 {
+		i = 0
+	}
+	return sorted[i]
+}
+
+// cycleTimeReport is a project's cycle times over the MRs merged in the report period
+type cycleTimeReport struct {
+	Project     string               `json:"project"`
+	Since       time.Time            `json:"since"`
+	FirstReview cycleTimePercentiles `json:"first_review"`
+	Approval    cycleTimePercentiles `json:"approval"`
+	Merge       cycleTimePercentiles `json:"merge"`
+}
+
+// cycleTimeReports builds the report of every project with MRs merged since the given time
+func (bot bot) cycleTimeReports(since time.Time) map[string]*cycleTimeReport {
+	reports := make(map[string]*cycleTimeReport)
+	for project, mrs := range bot.cycleTimes.mergedSince(since) {
+		var firstReview, approval, merge []time.Duration
+		for _, m := range mrs {
+			if !m.FirstReview.IsZero() {
+				firstReview = append(firstReview, m.FirstReview.Sub(m.Opened))
+			}
+			if !m.Approved.IsZero() {
+				approval = append(approval, m.Approved.Sub(m.Opened))
+			}
+			merge = append(merge, m.Merged.Sub(m.Opened))
+		}
+		reports[project] = &cycleTimeReport{
+			Project:     project,
+			Since:       since,
+			FirstReview: newCycleTimePercentiles(firstReview),
+			Approval:    newCycleTimePercentiles(approval),
+			Merge:       newCycleTimePercentiles(merge),
+		}
+	}
+	return reports
+}
+
+// format renders the report for slack
+func (r *cycleTimeReport) format() string {
+	line := func(step string, p cycleTimePercentiles) string {
+		if p.Count == 0 {
+			return fmt.Sprintf("• %s: no data", step)
+		}
+		return fmt.Sprintf("• %s: p50 %.1fh, p75 %.1fh, p90 %.1fh (%s)", step, p.P50, p.P75, p.P90, plural(p.Count, "MR"))
+	}
+	return strings.Join([]string{
+		fmt.Sprintf(":stopwatch: *Cycle time for `%s` since %s*, %s merged", r.Project, r.Since.Format("Jan 2"), plural(r.Merge.Count, "MR")),
+		line("opened to first review", r.FirstReview),
+		line("opened to approved", r.Approval),
+		line("opened to merged", r.Merge),
+	}, "\n")
+}
+
+// postCycleTimeReports sends the weekly report of every project with merged MRs to its channels
+func (bot bot) postCycleTimeReports() {
+	for project, report := range bot.cycleTimeReports(time.Now().Add(-CYCLE_TIME_PERIOD)) {
+		if channels := bot.routes.channelsFor(project); len(channels) > 0 {
+			bot.notify(report.format(), channels)
+		}
+	}
+}
+
+// cycleTimeRouter serves `GET /reports/cycle-time[?project=group/project][&days=7]` as JSON, every project's report
+// without a project
+func (bot bot) cycleTimeRouter(c *gin.Context) {
+	period := CYCLE_TIME_PERIOD
+	if days := c.Query("days"); days != "" {
+		var n int
+		if _, err := fmt.Sscanf(days, "%d", &n); err != nil || n <= 0 {
+			http.Error(c.Writer, "days must be a positive number", http.StatusBadRequest)
+			return
+		}
+		period = time.Duration(n) * 24 * time.Hour
+	}
+	reports := bot.cycleTimeReports(time.Now().Add(-period))
+	project := c.Query("project")
+	if project == "" {
+		c.JSON(http.StatusOK, reports)
+		return
+	}
+	report, ok := reports[project]
+	if !ok {
+		http.Error(c.Writer, "no merge requests merged in that project and period", http.StatusNotFound)
+		return
+	}
+	c.JSON(http.StatusOK, report)
+}
+
+// recordCycleTime tracks the MR's steps from its webhooks
+func (bot bot) recordCycleTime(mr *gitlab.MergeEvent) {
+	id, iid := mr.Project.ID, mr.ObjectAttributes.IID
+	switch mr.ObjectAttributes.Action {
+	case MR_ACTION_OPENED, MR_ACTION_REOPENED:
+		bot.cycleTimes.opened(mr.Project.PathWithNamespace, id, iid)
+	case MR_ACTION_APPROVED:
+		if mr.User != nil && mr.User.ID == mr.ObjectAttributes.AuthorID {
+			return
+		}
+		bot.cycleTimes.step(id, iid, func(m *mrCycle) *time.Time { return &m.FirstReview })
+		bot.cycleTimes.step(id, iid, func(m *mrCycle) *time.Time { return &m.Approved })
+	case MR_ACTION_MERGED:
+		bot.cycleTimes.step(id, iid, func(m *mrCycle) *time.Time { return &m.Merged })
+	case MR_ACTION_CLOSED:
+		bot.cycleTimes.forget(mrRef(id, iid))
+	}
+}
+
+// recordFirstReview counts comments by anyone but the MR's author and the bot as reviews, like isReviewNote
+func (bot bot) recordFirstReview(ev *gitlab.MergeCommentEvent) {
+	if ev.User == nil || ev.ObjectAttributes.System || ev.User.ID == ev.MergeRequest.AuthorID {
+		return
+	}
+	if strings.HasSuffix(ev.ObjectAttributes.Note, bot.comments.footer()) {
+		return
+	}
+	bot.cycleTimes.step(ev.ProjectID, ev.MergeRequest.IID, func(m *mrCycle) *time.Time { return &m.FirstReview })
+}
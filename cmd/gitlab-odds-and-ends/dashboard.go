@@ -0,0 +1,167 @@
+package main
+
+import (
+	"bytes"
+	"html/template"
+	"net/http"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+)
+
+// DASHBOARD_MAX_THREADS caps how many MR threads the dashboard lists per instance
+const DASHBOARD_MAX_THREADS = 200
+
+// dashboard is what `/dashboard` shows
+type dashboard struct {
+	Started   time.Time
+	Uptime    time.Duration
+	InFlight  int64
+	Failures  map[string]int
+	Instances []dashboardInstance
+	// Recent are the latest webhooks, newest first, unless HideRecent
+	Recent      []webhookDelivery
+	HideRecent  bool
+	Assignments map[string][]assignment
+}
+
+type dashboardInstance struct {
+	Name     string
+	Projects []dashboardProject
+	Threads  []dashboardThread
+	// MoreThreads is how many threads didn't fit
+	MoreThreads int
+}
+
+type dashboardProject struct {
+	Project  string
+	Channels []string
+	// LastEvent is the project's latest webhook, if it sent one since startup
+	LastEvent string
+	LastAt    time.Time
+}
+
+type dashboardThread struct {
+	Ref      string
+	Messages []slackMessage
+}
+
+var dashboardTemplate = template.Must(template.New("dashboard").Funcs(template.FuncMap{
+	"ago": func(t time.Time) string { return time.Since(t).Round(time.Second).String() },
+}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>gitlab-odds-and-ends</title>
+<style>
+body { font-family: sans-serif; margin: 2em; }
+table { border-collapse: collapse; margin-bottom: 2em; }
+th, td { border: 1px solid #ccc; padding: 0.3em 0.6em; text-align: left; vertical-align: top; }
+th { background: #f4f4f4; }
+.bad { color: #b00; }
+</style>
+</head>
+<body>
+<h1>gitlab-odds-and-ends</h1>
+<p>Up {{.Uptime}} since {{.Started.Format "2006-01-02 15:04:05 MST"}}, {{.InFlight}} webhooks in flight.</p>
+
+<h2>Failures since startup</h2>
+{{if .Failures}}<table><tr><th>Kind</th><th>Count</th></tr>
+{{range $kind, $n := .Failures}}<tr><td>{{$kind}}</td><td class="bad">{{$n}}</td></tr>
+{{end}}</table>{{else}}<p>None.</p>{{end}}
+
+<h2>Recent webhooks</h2>
+{{if .Recent}}<table><tr><th>When</th><th>Instance</th><th>Project</th><th>Event</th><th>Channels</th><th>Outcome</th></tr>
+{{range .Recent}}<tr><td>{{ago .At}} ago</td><td>{{.Instance}}</td><td>{{.Project}}</td><td>{{.Kind}}</td><td>{{range .Channels}}{{.}}<br>{{end}}</td>
+<td{{if ne .Result "handled"}} class="bad"{{end}}>{{.Outcome}}</td></tr>
+{{end}}</table>{{else if .HideRecent}}<p>Shown once the admin credentials are set.</p>{{else}}<p>Nothing since startup.</p>{{end}}
+
+<h2>Reviewer rotation</h2>
+{{if .Assignments}}<table><tr><th>Project</th><th>Latest assignments, newest last</th></tr>
+{{range $project, $assignments := .Assignments}}<tr><td>{{$project}}</td><td>{{range $assignments}}!{{.IID}} → {{.Reviewer}} ({{ago .At}} ago)<br>{{end}}</td></tr>
+{{end}}</table>{{else}}<p>No MRs assigned since startup.</p>{{end}}
+
+{{range .Instances}}
+<h2>Projects{{if .Name}} on {{.Name}}{{end}}</h2>
+{{if .Projects}}<table><tr><th>Project</th><th>Channels</th><th>Last event</th></tr>
+{{range .Projects}}<tr><td>{{.Project}}</td><td{{if not .Channels}} class="bad"{{end}}>{{range .Channels}}{{.}}<br>{{else}}none{{end}}</td>
+<td>{{if .LastEvent}}{{.LastEvent}}, {{ago .LastAt}} ago{{else}}none since startup{{end}}</td></tr>
+{{end}}</table>{{else}}<p>No projects enrolled.</p>{{end}}
+
+<h2>MR threads{{if .Name}} on {{.Name}}{{end}}</h2>
+{{if .Threads}}<table><tr><th>Project:MR</th><th>Slack messages</th></tr>
+{{range .Threads}}<tr><td>{{.Ref}}</td><td>{{range .Messages}}{{.Channel}} {{.Timestamp}}<br>{{end}}</td></tr>
+{{end}}</table>{{if .MoreThreads}}<p>and {{.MoreThreads}} more.</p>{{end}}{{else}}<p>No MR notifications remembered.</p>{{end}}
+{{end}}
+</body>
+</html>
+`))
+
+// dashboardRouter serves an overview of the bot's state on the admin listener, for working out why an MR wasn't
+// announced without going through the logs.  the recent webhooks are left out unless withRecent, see adminServer
+func (bot bot) dashboardRouter(withRecent bool) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		bot.dashboard(c, withRecent)
+	}
+}
+
+func (bot bot) dashboard(c *gin.Context, withRecent bool) {
+	s := bot.status
+	d := dashboard{
+		Started:     s.started,
+		Uptime:      time.Since(s.started).Round(time.Second),
+		InFlight:    atomic.LoadInt64(&s.inFlight),
+		Failures:    make(map[string]int),
+		Assignments: make(map[string][]assignment),
+	}
+	events := make(map[string]projectEvent)
+	s.mu.Lock()
+	for k, n := range s.failures {
+		d.Failures[k] = n
+	}
+	for p, a := range s.assignments {
+		d.Assignments[p] = append([]assignment(nil), a...)
+	}
+	for p, ev := range s.events {
+		events[p] = ev
+	}
+	s.mu.Unlock()
+	if withRecent {
+		d.Recent = s.deliveries()
+	} else {
+		d.HideRecent = true
+	}
+
+	for _, b := range bot.instances.all() {
+		inst := dashboardInstance{Name: b.instance}
+		for project, channels := range b.routes.all() {
+			p := dashboardProject{Project: project, Channels: channels}
+			if ev, ok := events[project]; ok {
+				p.LastEvent, p.LastAt = ev.kind, ev.at
+			}
+			inst.Projects = append(inst.Projects, p)
+		}
+		sort.Slice(inst.Projects, func(i, j int) bool { return inst.Projects[i].Project < inst.Projects[j].Project })
+		refs := b.threads.refs()
+		sort.Strings(refs)
+		if len(refs) > DASHBOARD_MAX_THREADS {
+			inst.MoreThreads = len(refs) - DASHBOARD_MAX_THREADS
+			refs = refs[:DASHBOARD_MAX_THREADS]
+		}
+		for _, ref := range refs {
+			inst.Threads = append(inst.Threads, dashboardThread{Ref: ref, Messages: b.threads.get(ref)})
+		}
+		d.Instances = append(d.Instances, inst)
+	}
+
+	var page bytes.Buffer
+	if err := dashboardTemplate.Execute(&page, d); err != nil {
+		logrus.WithError(err).Error("Failed to render the dashboard")
+		http.Error(c.Writer, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	c.Data(http.StatusOK, "text/html; charset=utf-8", page.Bytes())
+}
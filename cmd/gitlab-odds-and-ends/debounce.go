@@ -0,0 +1,85 @@
+package main
+
+import (
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	MR_UPDATE_DEBOUNCE_ENV_VAR = "MR_UPDATE_DEBOUNCE"
+	// MR_UPDATE_DEBOUNCE_MAX_WAITS is how many debounce windows an MR's replies can be held back for while it keeps
+	// changing, so a busy MR's thread still hears about it now and then
+	MR_UPDATE_DEBOUNCE_MAX_WAITS = 5
+)
+
+// debouncer holds back replies to MR threads until the MR has been quiet for the window, then posts them as one
+// summarized reply.  a force-push followed by relabeling is one message, not half a dozen
+type debouncer struct {
+	window time.Duration
+
+	mu      sync.Mutex
+	pending map[string]*pendingReplies // MR ref -> replies waiting to be posted
+}
+
+// pendingReplies are an MR's held back replies, posted with the bot copy of the latest event
+type pendingReplies struct {
+	bot   bot
+	msgs  []localized
+	first time.Time
+	timer *time.Timer
+}
+
+// debouncerFromEnv debounces MR replies by MR_UPDATE_DEBOUNCE, returning nil when it's not set
+func debouncerFromEnv() *debouncer {
+	window, err := time.ParseDuration(os.Getenv(MR_UPDATE_DEBOUNCE_ENV_VAR))
+	if err != nil || window <= 0 {
+		return nil
+	}
+	return &debouncer{window: window, pending: make(map[string]*pendingReplies)}
+}
+
+// add holds back the reply until the MR's been quiet for the window, or it's been held back for the longest it can be
+func (d *debouncer) add(bot bot, ref string, msg localized) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	p, ok := d.pending[ref]
+	if !ok {
+		p = &pendingReplies{first: time.Now()}
+		d.pending[ref] = p
+		p.timer = time.AfterFunc(d.window, func() { d.flush(ref) })
+	} else if time.Since(p.first) < d.window*MR_UPDATE_DEBOUNCE_MAX_WAITS {
+		p.timer.Reset(d.window)
+	}
+	p.bot = bot
+	p.msgs = append(p.msgs, msg)
+}
+
+// flush posts the MR's held back replies, on their own if there's just one
+func (d *debouncer) flush(ref string) {
+	d.mu.Lock()
+	p, ok := d.pending[ref]
+	delete(d.pending, ref)
+	d.mu.Unlock()
+	if !ok {
+		return
+	}
+	if len(p.msgs) == 1 {
+		p.bot.replyThreadsLocalized(ref, p.msgs[0], nil)
+		return
+	}
+	for _, m := range p.bot.threads.get(ref) {
+		lines := []string{p.bot.locales.render(m.Channel, tr(":arrows_counterclockwise: %d updates:", len(p.msgs)))}
+		for _, msg := range p.msgs {
+			lines = append(lines, "• "+p.bot.locales.render(m.Channel, msg))
+		}
+		text := strings.Join(lines, "\n")
+		logrus.Info(text)
+		if _, err := p.bot.notifier.Reply(m.Channel, m.Timestamp, text); err != nil {
+			logrus.WithError(err).Errorf("failed to reply to slack thread %s in channel %s", m.Timestamp, m.Channel)
+		}
+	}
+}
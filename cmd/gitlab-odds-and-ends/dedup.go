@@ -0,0 +1,57 @@
+package main
+
+import (
+	"strings"
+
+	"github.com/sirupsen/logrus"
+	"github.com/xanzy/go-gitlab"
+)
+
+const (
+	NOTIFICATION_DEDUP_ENV_VAR = "NOTIFICATION_DEDUP"
+)
+
+// dedupChannels splits the channels of a new MR announcement when NOTIFICATION_DEDUP is on: the first slack channel,
+// the project's own when it has one, gets the whole announcement and the other slack channels just a link to it, so
+// routing rules don't put the same announcement in front of the same people five times.  other backends can't link
+// to a slack message, so they get the whole thing
+func (bot bot) dedupChannels(slackChans []string) (full, linked []string) {
+	if !bot.dedupNotifications {
+		return slackChans, nil
+	}
+	primary := ""
+	for _, c := range slackChans {
+		switch {
+		case strings.Contains(c, ":"): // slack channel IDs never have one, the other backends' prefixes all do
+			full = append(full, c)
+		case primary == "":
+			primary = c
+			full = append(full, c)
+		default:
+			linked = append(linked, c)
+		}
+	}
+	return full, linked
+}
+
+// linkAnnouncement points the linked channels at the MR's announcement in its primary channel.  if there's no
+// announcement to link to, they get the whole thing after all
+func (bot bot) linkAnnouncement(mr *gitlab.MergeEvent, msg localized, sent []slackMessage, linked []string) {
+	if len(linked) == 0 {
+		return
+	}
+	for _, m := range sent {
+		if strings.Contains(m.Channel, ":") {
+			continue
+		}
+		permalink, err := bot.notifier.Permalink(m.Channel, m.Timestamp)
+		if err != nil || permalink == "" {
+			logrus.WithError(err).Errorf("failed to link to the announcement of merge request !%d, announcing it in full", mr.ObjectAttributes.IID)
+			break
+		}
+		bot.notifyLocalized(tr("<%s|!%d %s> in `%s` was announced in <#%s>, follow it <%s|there>.",
+			mr.ObjectAttributes.URL, mr.ObjectAttributes.IID, mr.ObjectAttributes.Title, mr.ObjectAttributes.Target.Name, m.Channel, permalink), linked)
+		return
+	}
+	bot.notifyLocalized(msg, linked)
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+)
+
+// defaultRoutesConfig picks a channel for projects that have no route, from the project's topics (gitlab's tag list)
+// or, failing that, the closest group in its namespace
+type defaultRoutesConfig struct {
+	// CatchAll is told about every project that had to be routed by inference, or couldn't be routed at all
+	CatchAll string `yaml:"catch_all"`
+	// Topics maps a project topic, e.g. `go`, to a channel
+	Topics map[string]string `yaml:"topics"`
+	// Groups maps a group path, e.g. `platform/infra`, to a channel.  the longest matching group wins
+	Groups map[string]string `yaml:"groups"`
+}
+
+// inferRoute finds a channel for an unrouted project, returns the reason it was picked
+func (d defaultRoutesConfig) inferRoute(project string, topics []string) (channel, reason string) {
+	for _, t := range topics {
+		if c, ok := d.Topics[t]; ok {
+			return c, fmt.Sprintf("topic `%s`", t)
+		}
+	}
+	for group := project; strings.Contains(group, "/"); {
+		group = group[:strings.LastIndex(group, "/")]
+		if c, ok := d.Groups[group]; ok {
+			return c, fmt.Sprintf("group `%s`", group)
+		}
+	}
+	return "", ""
+}
+
+// defaultRouter applies the default routes, remembering which projects couldn't be routed so they're only reported once
+type defaultRouter struct {
+	defaultRoutesConfig
+	mu       sync.Mutex
+	unrouted map[string]bool
+}
+
+func newDefaultRouter(cfg defaultRoutesConfig) *defaultRouter {
+	return &defaultRouter{defaultRoutesConfig: cfg, unrouted: make(map[string]bool)}
+}
+
+// copy is a deep copy of the router, so what one reports as unrouted the other still will
+func (d *defaultRouter) copy() *defaultRouter {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	c := newDefaultRouter(d.defaultRoutesConfig)
+	for p := range d.unrouted {
+		c.unrouted[p] = true
+	}
+	return c
+}
+
+// reportUnrouted returns true the first time it's called for the project
+func (d *defaultRouter) reportUnrouted(project string) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.unrouted[project] {
+		return false
+	}
+	d.unrouted[project] = true
+	return true
+}
+
+// defaultRoute is used when neither the config file nor the webhook routes the project anywhere.  The inferred route is
+// learned so the project isn't inferred again, the catch-all channel hears about it, and a permanent route is suggested in the logs
+func (bot bot) defaultRoute(project string, id int) []string {
+	var topics []string
+	if len(bot.defaultRoutes.Topics) > 0 {
+		if p, err := bot.gl.GetProject(id); err != nil {
+			logrus.WithError(err).Errorf("failed to look up topics of project %s", project)
+		} else {
+			topics = p.TagList
+		}
+	}
+
+	channel, reason := bot.defaultRoutes.inferRoute(project, topics)
+	if channel == "" {
+		if !bot.defaultRoutes.reportUnrouted(project) {
+			return nil
+		}
+		logrus.Warnf("project %s has no route; add it to the `projects` section of the config file", project)
+		if bot.defaultRoutes.CatchAll != "" {
+			bot.notify(fmt.Sprintf("`%s` isn't routed to any channel, so its notifications are going nowhere.", project), []string{bot.defaultRoutes.CatchAll})
+		}
+		return nil
+	}
+
+	logrus.Infof("routing project %s to channel %s by its %s.  to make this permanent add `{project: %s, channels: [%s]}` to the `projects` section of the config file",
+		project, channel, reason, project, channel)
+	if bot.defaultRoutes.CatchAll != "" && bot.defaultRoutes.CatchAll != channel {
+		bot.notify(fmt.Sprintf("`%s` isn't routed to any channel, so I'm sending its notifications to <#%s> based on its %s.", project, channel, reason), []string{bot.defaultRoutes.CatchAll})
+	}
+	return bot.routes.resolve(project, id, []string{channel})
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/raidancampbell/gitlab-odds-and-ends/internal/store"
+	"github.com/sirupsen/logrus"
+	"github.com/xanzy/go-gitlab"
+)
+
+const (
+	DEPLOY_DIGEST_SLACK_CHANNEL_ENV_VAR = "DEPLOY_DIGEST_SLACK_CHANNEL"
+	DEPLOY_DIGEST_TIME_ENV_VAR          = "DEPLOY_DIGEST_TIME"
+	DEFAULT_DEPLOY_DIGEST_TIME          = "18:00"
+	DEPLOYMENT_STATUS_RUNNING           = "running"
+	DEPLOYMENT_STATUS_SUCCESS           = "success"
+	DEPLOYMENT_STATUS_FAILED            = "failed"
+	// how many previously deployed commits are remembered per environment, for spotting rollbacks
+	DEPLOY_HISTORY_LENGTH    = 50
+	DEPLOY_DIGEST_STORE_KEY  = "deploy_digest"
+	DEPLOY_HISTORY_STORE_KEY = "deploy_history"
+)
+
+// environmentDeploys is a day's worth of deployments to one environment
+type environmentDeploys struct {
+	Deploys   int             `json:"deploys"`
+	Rollbacks int             `json:"rollbacks"`
+	Failures  int             `json:"failures"`
+	Projects  map[string]bool `json:"projects"`
+}
+
+// deployDigest aggregates deployment events per environment and posts a summary to the ops channel once a day.
+// A deployment of a commit that was already deployed to the environment (but isn't what's currently deployed) counts as a rollback.
+// the day's counts and the history are kept in the store, so the leader's digest has the deployments whose webhooks
+// reached any replica, and a restart doesn't lose them
+type deployDigest struct {
+	channel string
+	hour    int
+	minute  int
+	store   *store.Store
+
+	mu      sync.Mutex
+	today   map[string]*environmentDeploys
+	history map[string][]string // project/environment -> previously deployed SHAs, newest last
+}
+
+// newDeployDigest posts to the given channel every day at `at`, formatted as HH:MM in local time
+func newDeployDigest(channel, at string, s *store.Store) (*deployDigest, error) {
+	t, err := time.Parse("15:04", at)
+	if err != nil {
+		return nil, fmt.Errorf("invalid digest time '%s', expected HH:MM: %v", at, err)
+	}
+	d := &deployDigest{
+		channel: channel,
+		hour:    t.Hour(),
+		minute:  t.Minute(),
+		store:   s,
+		today:   make(map[string]*environmentDeploys),
+		history: make(map[string][]string),
+	}
+	if _, err := s.Load(DEPLOY_DIGEST_STORE_KEY, &d.today); err != nil {
+		return nil, err
+	}
+	if _, err := s.Load(DEPLOY_HISTORY_STORE_KEY, &d.history); err != nil {
+		return nil, err
+	}
+	s.Follow(DEPLOY_DIGEST_STORE_KEY, &d.today, &d.mu)
+	s.Follow(DEPLOY_HISTORY_STORE_KEY, &d.history, &d.mu)
+	return d, nil
+}
+
+// saveLocked persists the day's counts and the history.  d.mu must be held
+func (d *deployDigest) saveLocked() {
+	if err := d.store.Save(DEPLOY_DIGEST_STORE_KEY, d.today); err != nil {
+		logrus.WithError(err).Error("failed to persist the day's deployments")
+	}
+	if err := d.store.Save(DEPLOY_HISTORY_STORE_KEY, d.history); err != nil {
+		logrus.WithError(err).Error("failed to persist the deployment history")
+	}
+}
+
+// record counts a finished deployment.  deployments that are still running are ignored
+func (d *deployDigest) record(event *gitlab.DeploymentEvent) {
+	if event.Status != DEPLOYMENT_STATUS_SUCCESS && event.Status != DEPLOYMENT_STATUS_FAILED {
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	defer d.saveLocked()
+
+	env := d.today[event.Environment]
+	if env == nil {
+		env = &environmentDeploys{}
+		d.today[event.Environment] = env
+	}
+	if env.Projects == nil {
+		env.Projects = make(map[string]bool)
+	}
+	env.Projects[event.Project.PathWithNamespace] = true
+	if event.Status == DEPLOYMENT_STATUS_FAILED {
+		env.Failures++
+		return
+	}
+
+	env.Deploys++
+	key := event.Project.PathWithNamespace + "/" + event.Environment
+	history := d.history[key]
+	for i, sha := range history {
+		if sha == event.ShortSHA && i != len(history)-1 {
+			env.Rollbacks++
+			break
+		}
+	}
+	history = append(history, event.ShortSHA)
+	if len(history) > DEPLOY_HISTORY_LENGTH {
+		history = history[len(history)-DEPLOY_HISTORY_LENGTH:]
+	}
+	d.history[key] = history
+}
+
+// flush returns the digest message for everything recorded since the last flush, and starts a new day
+func (d *deployDigest) flush() string {
+	d.mu.Lock()
+	today := d.today
+	d.today = make(map[string]*environmentDeploys)
+	if err := d.store.Save(DEPLOY_DIGEST_STORE_KEY, d.today); err != nil {
+		logrus.WithError(err).Error("failed to persist the day's deployments")
+	}
+	d.mu.Unlock()
+
+	if len(today) == 0 {
+		return "No deployments today."
+	}
+	var envs []string
+	for env := range today {
+		envs = append(envs, env)
+	}
+	sort.Strings(envs)
+
+	lines := []string{"Deployments today:"}
+	for _, name := range envs {
+		env := today[name]
+		var projects []string
+		for p := range env.Projects {
+			projects = append(projects, p)
+		}
+		sort.Strings(projects)
+		line := fmt.Sprintf("• `%s`: %s, %s", name, plural(env.Deploys, "deploy"), plural(env.Rollbacks, "rollback"))
+		if env.Failures > 0 {
+			line += ", " + plural(env.Failures, "failure")
+		}
+		lines = append(lines, line+" ("+strings.Join(projects, ", ")+")")
+	}
+	return strings.Join(lines, "\n")
+}
+
+// postDeployDigest sends the day's digest, run daily by the scheduler
+func (bot bot) postDeployDigest() {
+	bot.notify(bot.deployDigest.flush(), []string{bot.deployDigest.channel})
+}
+
+func plural(n int, noun string) string {
+	if n == 1 {
+		return fmt.Sprintf("%d %s", n, noun)
+	}
+	return fmt.Sprintf("%d %ss", n, noun)
+}
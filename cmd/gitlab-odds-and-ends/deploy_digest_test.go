@@ -0,0 +1,49 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/raidancampbell/gitlab-odds-and-ends/internal/store"
+	"github.com/xanzy/go-gitlab"
+)
+
+func deployment(project, environment, sha, status string) *gitlab.DeploymentEvent {
+	ev := &gitlab.DeploymentEvent{Environment: environment, ShortSHA: sha, Status: status}
+	ev.Project.PathWithNamespace = project
+	return ev
+}
+
+func TestDeployDigestSurvivesRestarts(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.json")
+	open := func() *deployDigest {
+		s, err := store.Open(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		d, err := newDeployDigest("C_OPS", "18:00", s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return d
+	}
+
+	d := open()
+	d.record(deployment("team/app", "production", "aaa", DEPLOYMENT_STATUS_SUCCESS))
+	d.record(deployment("team/app", "production", "bbb", DEPLOYMENT_STATUS_RUNNING))
+	d.record(deployment("team/app", "production", "bbb", DEPLOYMENT_STATUS_SUCCESS))
+	// restarted: the day's deployments and the history are still there, so rolling back to aaa is spotted
+	d = open()
+	d.record(deployment("team/app", "production", "aaa", DEPLOYMENT_STATUS_SUCCESS))
+	d.record(deployment("team/api", "staging", "ccc", DEPLOYMENT_STATUS_FAILED))
+
+	want := "Deployments today:\n" +
+		"• `production`: 3 deploys, 1 rollback (team/app)\n" +
+		"• `staging`: 0 deploys, 0 rollbacks, 1 failure (team/api)"
+	if got := open().flush(); got != want {
+		t.Errorf("flush() = %q, want %q", got, want)
+	}
+	if got := open().flush(); got != "No deployments today." {
+		t.Errorf("flush() after a flush = %q, want a new day", got)
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/xanzy/go-gitlab"
+)
+
+// what a project's DMs to reviewers do when the reviewer has do not disturb on
+const (
+	DND_DEFER  = "defer"
+	DND_THREAD = "thread"
+)
+
+// validateDND checks the projects' dnd settings up front, like validatePolicies
+func validateDND(projects []projectConfig) error {
+	for _, p := range projects {
+		switch p.DND {
+		case "", DND_DEFER, DND_THREAD:
+		default:
+			return fmt.Errorf("project %s has invalid dnd '%s', expected %s or %s", p.Project, p.DND, DND_DEFER, DND_THREAD)
+		}
+	}
+	return nil
+}
+
+// dndUntil is when the slack user's do not disturb ends, or the zero time if it's off.  that's either a snooze they
+// started or their do not disturb schedule
+func (m *userMapper) dndUntil(slackID string, now time.Time) (time.Time, error) {
+	if m.slack == nil {
+		return time.Time{}, nil
+	}
+	dnd, err := m.slack.GetDNDInfo(&slackID)
+	if err != nil {
+		return time.Time{}, err
+	}
+	var until time.Time
+	if dnd.SnoozeEnabled && dnd.SnoozeEndTime > 0 {
+		until = time.Unix(int64(dnd.SnoozeEndTime), 0)
+	}
+	if dnd.Enabled && dnd.NextStartTimestamp > 0 {
+		start, end := time.Unix(int64(dnd.NextStartTimestamp), 0), time.Unix(int64(dnd.NextEndTimestamp), 0)
+		if !now.Before(start) && now.Before(end) && end.After(until) {
+			until = end
+		}
+	}
+	if !until.After(now) {
+		return time.Time{}, nil
+	}
+	return until, nil
+}
+
+// dmReviewer DMs someone reviewing (or otherwise looking after) the MR.  if they've got slack's do not disturb on, the
+// DM waits for it to end, or with the project's `dnd: thread` goes to the MR's thread instead.  deferred DMs don't
+// survive a restart
+func (bot bot) dmReviewer(project string, mr *gitlab.MergeRequest, username, msg string) {
+	bot = bot.about(project)
+	slackID, err := bot.users.slackUser(username)
+	if err != nil {
+		logrus.WithError(err).Warnf("can't DM %s", username)
+		return
+	}
+	until, err := bot.users.dndUntil(slackID, time.Now())
+	if err != nil {
+		logrus.WithError(err).Warnf("failed to check whether %s has do not disturb on, DMing them anyway", username)
+	}
+	if until.IsZero() {
+		bot.dm(username, msg)
+		return
+	}
+	if bot.projects[project].DND == DND_THREAD {
+		logrus.Infof("%s has do not disturb on until %s, posting in the thread of !%d instead of DMing them", username, until.Format(time.RFC3339), mr.IID)
+		bot.notifyThreadLocalized(mr.ProjectID, mr.IID, tr("%s  (for <@%s>, who's on do not disturb)", msg, slackID), nil)
+		return
+	}
+	logrus.Infof("%s has do not disturb on, DMing them at %s", username, until.Format(time.RFC3339))
+	time.AfterFunc(time.Until(until), func() { bot.dm(username, msg) })
+}
@@ -0,0 +1,289 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/raidancampbell/gitlab-odds-and-ends/internal/store"
+	"github.com/sirupsen/logrus"
+	"github.com/xanzy/go-gitlab"
+)
+
+const (
+	DORA_STORE_KEY            = "dora"
+	DORA_ENVIRONMENTS_ENV_VAR = "DORA_ENVIRONMENTS"
+	// DORA_PERIOD is the window the metrics cover, unless the JSON API is asked for another
+	DORA_PERIOD = 30 * 24 * time.Hour
+	// DORA_RETENTION is how long deployments are kept
+	DORA_RETENTION = 90 * 24 * time.Hour
+	// DORA_METRIC_PREFIX namespaces the prometheus metrics
+	DORA_METRIC_PREFIX = "gitlab_odds_and_ends_dora_"
+)
+
+// doraDeployment is a finished deployment to a production environment
+type doraDeployment struct {
+	Project     string    `json:"project"`
+	Environment string    `json:"environment"`
+	SHA         string    `json:"sha"`
+	At          time.Time `json:"at"`
+	Failed      bool      `json:"failed"`
+	// RolledBack is set when a later deployment went back to an earlier commit, making this one a failed change too
+	RolledBack bool `json:"rolled_back"`
+	// LeadTimes are how long each MR it shipped took from its last commit to production
+	LeadTimes []time.Duration `json:"lead_times"`
+}
+
+// doraMerge is an MR merged into its project's default branch that hasn't been deployed yet
+type doraMerge struct {
+	IID       int       `json:"iid"`
+	Committed time.Time `json:"committed"`
+}
+
+// doraState is what's kept in the store
+type doraState struct {
+	Deployments []doraDeployment `json:"deployments"`
+	// Pending are the undeployed merges, by project
+	Pending map[string][]doraMerge `json:"pending"`
+}
+
+// dora derives the DORA metrics (deployment frequency, lead time for changes, change failure rate) from the merge and
+// deployment webhooks the bot already gets.  a production deployment ships every MR merged into the project's default
+// branch since the last one.  failed deployments and deployments that were rolled back are failed changes
+type dora struct {
+	environments map[string]bool
+	store        *store.Store
+
+	mu    sync.Mutex
+	state doraState
+}
+
+// newDora counts deployments to DORA_ENVIRONMENTS (comma separated), DEFAULT_INCIDENT_ENVIRONMENTS by default
+func newDora(s *store.Store) (*dora, error) {
+	environments := os.Getenv(DORA_ENVIRONMENTS_ENV_VAR)
+	if environments == "" {
+		environments = DEFAULT_INCIDENT_ENVIRONMENTS
+	}
+	d := &dora{environments: make(map[string]bool), store: s, state: doraState{Pending: make(map[string][]doraMerge)}}
+	for _, env := range strings.Split(environments, ",") {
+		if env = strings.TrimSpace(env); env != "" {
+			d.environments[env] = true
+		}
+	}
+	if _, err := s.Load(DORA_STORE_KEY, &d.state); err != nil {
+		return nil, err
+	}
+	s.Follow(DORA_STORE_KEY, &d.state, &d.mu)
+	if d.state.Pending == nil {
+		d.state.Pending = make(map[string][]doraMerge)
+	}
+	return d, nil
+}
+
+// merged queues the MR for the project's next production deployment
+func (d *dora) merged(project string, m doraMerge) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.state.Pending[project] = append(d.state.Pending[project], m)
+	d.saveLocked()
+}
+
+// deployed records a finished production deployment.  a successful one ships the project's pending merges, and if it
+// went back to a commit deployed before, the deployment it replaced was rolled back
+func (d *dora) deployed(project, environment, sha string, failed bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	now := time.Now()
+	deploy := doraDeployment{Project: project, Environment: environment, SHA: sha, At: now, Failed: failed}
+	if !failed {
+		for _, m := range d.state.Pending[project] {
+			deploy.LeadTimes = append(deploy.LeadTimes, now.Sub(m.Committed))
+		}
+		delete(d.state.Pending, project)
+
+		latest, seen := -1, false
+		for i := len(d.state.Deployments) - 1; i >= 0; i-- {
+			prev := d.state.Deployments[i]
+			if prev.Project != project || prev.Environment != environment || prev.Failed {
+				continue
+			}
+			if latest < 0 {
+				latest = i
+			} else if prev.SHA == sha {
+				seen = true
+				break
+			}
+		}
+		if seen && d.state.Deployments[latest].SHA != sha {
+			d.state.Deployments[latest].RolledBack = true
+		}
+	}
+	d.state.Deployments = append(d.state.Deployments, deploy)
+	d.saveLocked()
+}
+
+// saveLocked drops deployments and undeployed merges older than DORA_RETENTION and persists the rest.  d.mu must be
+// held
+func (d *dora) saveLocked() {
+	cutoff := time.Now().Add(-DORA_RETENTION)
+	i := 0
+	for i < len(d.state.Deployments) && d.state.Deployments[i].At.Before(cutoff) {
+		i++
+	}
+	d.state.Deployments = d.state.Deployments[i:]
+	for project, pending := range d.state.Pending {
+		var kept []doraMerge
+		for _, m := range pending {
+			if m.Committed.After(cutoff) {
+				kept = append(kept, m)
+			}
+		}
+		if len(kept) == 0 {
+			delete(d.state.Pending, project)
+		} else {
+			d.state.Pending[project] = kept
+		}
+	}
+	if err := d.store.Save(DORA_STORE_KEY, d.state); err != nil {
+		logrus.WithError(err).Error("failed to persist DORA metrics")
+	}
+}
+
+// doraMetrics are a project's DORA metrics over a period
+type doraMetrics struct {
+	Project string    `json:"project"`
+	Since   time.Time `json:"since"`
+	// Deployments counts the successful production deployments, and DeploymentsPerDay averages them over the period
+	Deployments       int     `json:"deployments"`
+	DeploymentsPerDay float64 `json:"deployments_per_day"`
+	// LeadTimeP50 and LeadTimeP90 are the percentiles of the time from an MR's last commit to production, in hours
+	Changes     int     `json:"changes"`
+	LeadTimeP50 float64 `json:"lead_time_p50_hours"`
+	LeadTimeP90 float64 `json:"lead_time_p90_hours"`
+	// ChangeFailureRate is the fraction of deployments that failed or were rolled back
+	FailedChanges     int     `json:"failed_changes"`
+	ChangeFailureRate float64 `json:"change_failure_rate"`
+}
+
+// metrics works out every project's metrics since the given time
+func (d *dora) metrics(since time.Time) map[string]*doraMetrics {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	days := time.Since(since).Hours() / 24
+	metrics := make(map[string]*doraMetrics)
+	leadTimes := make(map[string][]time.Duration)
+	attempts := make(map[string]int)
+	for _, deploy := range d.state.Deployments {
+		if deploy.At.Before(since) {
+			continue
+		}
+		m := metrics[deploy.Project]
+		if m == nil {
+			m = &doraMetrics{Project: deploy.Project, Since: since}
+			metrics[deploy.Project] = m
+		}
+		attempts[deploy.Project]++
+		if deploy.Failed || deploy.RolledBack {
+			m.FailedChanges++
+		}
+		if !deploy.Failed {
+			m.Deployments++
+		}
+		leadTimes[deploy.Project] = append(leadTimes[deploy.Project], deploy.LeadTimes...)
+	}
+	for project, m := range metrics {
+		m.DeploymentsPerDay = math.Round(float64(m.Deployments)/days*100) / 100
+		m.ChangeFailureRate = math.Round(float64(m.FailedChanges)/float64(attempts[project])*1000) / 1000
+		lt := leadTimes[project]
+		sort.Slice(lt, func(i, j int) bool { return lt[i] < lt[j] })
+		m.Changes = len(lt)
+		m.LeadTimeP50 = math.Round(percentile(lt, 50).Hours()*10) / 10
+		m.LeadTimeP90 = math.Round(percentile(lt, 90).Hours()*10) / 10
+	}
+	return metrics
+}
+
+// recordDoraMerge queues MRs merged into their project's default branch for its next production deployment
+func (bot bot) recordDoraMerge(mr *gitlab.MergeEvent) {
+	if mr.ObjectAttributes.TargetBranch != mr.Project.DefaultBranch {
+		return
+	}
+	committed := time.Now()
+	if ts := mr.ObjectAttributes.LastCommit.Timestamp; ts != nil {
+		committed = *ts
+	}
+	bot.dora.merged(mr.Project.PathWithNamespace, doraMerge{IID: mr.ObjectAttributes.IID, Committed: committed})
+}
+
+// recordDoraDeployment counts finished deployments to production environments
+func (bot bot) recordDoraDeployment(ev *gitlab.DeploymentEvent) {
+	if !bot.dora.environments[ev.Environment] {
+		return
+	}
+	switch ev.Status {
+	case DEPLOYMENT_STATUS_SUCCESS, DEPLOYMENT_STATUS_FAILED:
+		bot.dora.deployed(ev.Project.PathWithNamespace, ev.Environment, ev.ShortSHA, ev.Status == DEPLOYMENT_STATUS_FAILED)
+	}
+}
+
+// doraRouter serves `GET /reports/dora[?project=group/project][&days=30]` as JSON, every project's metrics without a
+// project
+func (bot bot) doraRouter(c *gin.Context) {
+	period := DORA_PERIOD
+	if days := c.Query("days"); days != "" {
+		var n int
+		if _, err := fmt.Sscanf(days, "%d", &n); err != nil || n <= 0 {
+			http.Error(c.Writer, "days must be a positive number", http.StatusBadRequest)
+			return
+		}
+		period = time.Duration(n) * 24 * time.Hour
+	}
+	metrics := bot.dora.metrics(time.Now().Add(-period))
+	project := c.Query("project")
+	if project == "" {
+		c.JSON(http.StatusOK, metrics)
+		return
+	}
+	m, ok := metrics[project]
+	if !ok {
+		http.Error(c.Writer, "no production deployments of that project in that period", http.StatusNotFound)
+		return
+	}
+	c.JSON(http.StatusOK, m)
+}
+
+// prometheusLabel escapes a label value for the prometheus text format
+var prometheusLabel = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// metricsRouter serves `GET /metrics`, the DORA metrics over DORA_PERIOD in the prometheus text format
+func (bot bot) metricsRouter(c *gin.Context) {
+	metrics := bot.dora.metrics(time.Now().Add(-DORA_PERIOD))
+	var projects []string
+	for project := range metrics {
+		projects = append(projects, project)
+	}
+	sort.Strings(projects)
+
+	var b strings.Builder
+	gauge := func(name, help string, value func(m *doraMetrics) float64) {
+		fmt.Fprintf(&b, "# HELP %s%s %s\n# TYPE %s%s gauge\n", DORA_METRIC_PREFIX, name, help, DORA_METRIC_PREFIX, name)
+		for _, project := range projects {
+			fmt.Fprintf(&b, "%s%s{project=\"%s\"} %g\n", DORA_METRIC_PREFIX, name, prometheusLabel.Replace(project), value(metrics[project]))
+		}
+	}
+	gauge("deployments_per_day", "Successful production deployments per day over the last 30 days.",
+		func(m *doraMetrics) float64 { return m.DeploymentsPerDay })
+	gauge("lead_time_p50_seconds", "Median time from an MR's last commit to production over the last 30 days.",
+		func(m *doraMetrics) float64 { return m.LeadTimeP50 * 3600 })
+	gauge("lead_time_p90_seconds", "90th percentile time from an MR's last commit to production over the last 30 days.",
+		func(m *doraMetrics) float64 { return m.LeadTimeP90 * 3600 })
+	gauge("change_failure_rate", "Fraction of production deployments over the last 30 days that failed or were rolled back.",
+		func(m *doraMetrics) float64 { return m.ChangeFailureRate })
+	c.Data(http.StatusOK, "text/plain; version=0.0.4", []byte(b.String()))
+}
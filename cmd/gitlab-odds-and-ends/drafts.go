@@ -0,0 +1,129 @@
+package main
+
+import (
+	"regexp"
+	"sync"
+
+	"github.com/raidancampbell/gitlab-odds-and-ends/internal/store"
+	"github.com/sirupsen/logrus"
+	"github.com/xanzy/go-gitlab"
+)
+
+// draftTitle matches the title prefixes gitlab uses to mark an MR as a draft, e.g. `Draft:`, `[WIP]`, `(draft)`
+var draftTitle = regexp.MustCompile(`(?i)^\s*[\[(]?(draft|wip)[\])]?:?\s`)
+
+// drafts remembers the last seen work in progress flag of each MR (keyed by mrRef), so we can tell when one is marked ready.
+// drafts from projects with defer_drafts are queued until then, unassigned and unannounced.  both are kept in the store,
+// so a draft is announced whichever replica hears it was marked ready
+type drafts struct {
+	store    *store.Store
+	mu       sync.Mutex
+	wip      map[string]bool
+	deferred map[string]bool
+}
+
+const (
+	DRAFTS_STORE_KEY          = "drafts"
+	DEFERRED_DRAFTS_STORE_KEY = "deferred_drafts"
+)
+
+func newDrafts(s *store.Store) (*drafts, error) {
+	d := &drafts{store: s, wip: make(map[string]bool), deferred: make(map[string]bool)}
+	if _, err := s.Load(DRAFTS_STORE_KEY, &d.wip); err != nil {
+		return nil, err
+	}
+	if _, err := s.Load(DEFERRED_DRAFTS_STORE_KEY, &d.deferred); err != nil {
+		return nil, err
+	}
+	s.Follow(DRAFTS_STORE_KEY, &d.wip, &d.mu)
+	s.Follow(DEFERRED_DRAFTS_STORE_KEY, &d.deferred, &d.mu)
+	return d, nil
+}
+
+// save persists the drafts.  callers hold mu
+func (d *drafts) save() {
+	if err := d.store.Save(DRAFTS_STORE_KEY, d.wip); err != nil {
+		logrus.WithError(err).Error("failed to persist drafts")
+	}
+	if err := d.store.Save(DEFERRED_DRAFTS_STORE_KEY, d.deferred); err != nil {
+		logrus.WithError(err).Error("failed to persist deferred drafts")
+	}
+}
+
+// deferDraft queues the draft MR to be assigned and announced once it's marked ready
+func (d *drafts) deferDraft(ref string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.deferred[ref] = true
+	d.save()
+}
+
+// undefer takes the MR off the queue, reporting whether it was on it
+func (d *drafts) undefer(ref string) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	wasDeferred := d.deferred[ref]
+	if wasDeferred {
+		delete(d.deferred, ref)
+		d.save()
+	}
+	return wasDeferred
+}
+
+// track records the MR's current work in progress flag and returns the previous one
+func (d *drafts) track(ref string, wip bool) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	wasWIP := d.wip[ref]
+	if wip == wasWIP {
+		return wasWIP
+	}
+	if wip {
+		d.wip[ref] = true
+	} else {
+		delete(d.wip, ref)
+	}
+	d.save()
+	return wasWIP
+}
+
+// forget the MR, e.g. once it's been merged or closed
+func (d *drafts) forget(ref string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.wip[ref] || d.deferred[ref] {
+		delete(d.wip, ref)
+		delete(d.deferred, ref)
+		d.save()
+	}
+}
+
+// leftDraft reports whether the update event marked a draft MR as ready.  webhooks don't say what the work in progress flag
+// used to be, so fall back to the title's previous draft prefix for MRs we haven't seen as drafts since starting up
+func (bot bot) leftDraft(mr *gitlab.MergeEvent) bool {
+	wip := mr.ObjectAttributes.WorkInProgress
+	wasWIP := bot.drafts.track(mrRef(mr.Project.ID, mr.ObjectAttributes.IID), wip)
+	if wip {
+		return false
+	}
+	title := mr.Changes.Title
+	return wasWIP || (title.Previous != "" && draftTitle.MatchString(title.Previous) && !draftTitle.MatchString(title.Current))
+}
+
+// markedReady handles a draft being marked ready: deferred drafts (or, since without STATE_FILE the queue doesn't survive
+// a restart, drafts from deferring projects that were never announced) are assigned and announced now, everyone else gets a heads up in the thread
+func (bot bot) markedReady(mr *gitlab.MergeEvent, slackChans []string) {
+	ref := mrRef(mr.Project.ID, mr.ObjectAttributes.IID)
+	deferred := bot.drafts.undefer(ref)
+	if deferred || (bot.projects[mr.Project.PathWithNamespace].DeferDrafts && len(bot.threads.get(ref)) == 0) {
+		bot.announceNewMR(mr, slackChans)
+		return
+	}
+	bot.notifyReady(mr, slackChans)
+}
+
+// notifyReady tells the MR's thread that it's no longer a draft
+func (bot bot) notifyReady(mr *gitlab.MergeEvent, slackChans []string) {
+	bot.notifyThreadLocalized(mr.Project.ID, mr.ObjectAttributes.IID, tr("<%s|!%d %s> is no longer a draft and is ready for review.",
+		mr.ObjectAttributes.URL, mr.ObjectAttributes.IID, mr.ObjectAttributes.Title), slackChans)
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/segmentio/kafka-go"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	EVENT_BUS_URL_ENV_VAR   = "EVENT_BUS_URL"
+	EVENT_BUS_TOPIC_ENV_VAR = "EVENT_BUS_TOPIC"
+	DEFAULT_EVENT_BUS_TOPIC = "gitlab-odds-and-ends"
+	EVENT_BUS_SCHEME_NATS   = "nats"
+	EVENT_BUS_SCHEME_KAFKA  = "kafka"
+)
+
+// eventBusSender puts one encoded event on the bus
+type eventBusSender interface {
+	send(ev outgoingEvent, body []byte) error
+}
+
+// eventBus publishes the bot's events (see outgoingEvent, the same schema the outgoing webhooks get) to NATS or Kafka,
+// so other services can react to gitlab without their own webhooks
+type eventBus struct {
+	sender eventBusSender
+	target string
+	dryRun bool
+}
+
+// natsBus publishes each event on `<topic>.<event type>`, e.g. `gitlab-odds-and-ends.merge_request.merged`, so
+// subscribers can pick events with wildcards
+type natsBus struct {
+	conn  *nats.Conn
+	topic string
+}
+
+func (n natsBus) send(ev outgoingEvent, body []byte) error {
+	return n.conn.Publish(n.topic+"."+ev.Type, body)
+}
+
+// kafkaBus publishes every event on the topic, keyed by project so each project's events stay in order.  the event
+// type is in the HEADER_BOT_EVENT header
+type kafkaBus struct {
+	writer *kafka.Writer
+}
+
+func (k kafkaBus) send(ev outgoingEvent, body []byte) error {
+	// the writer is async, failures are logged by its completion callback
+	return k.writer.WriteMessages(context.Background(), kafka.Message{
+		Key:     []byte(ev.Project.Path),
+		Value:   body,
+		Headers: []kafka.Header{{Key: HEADER_BOT_EVENT, Value: []byte(ev.Type)}},
+	})
+}
+
+// newEventBus connects to EVENT_BUS_URL, `nats://host:4222` or `kafka://broker1:9092,broker2:9092`, returning nil
+// if it isn't set.  events go to EVENT_BUS_TOPIC, DEFAULT_EVENT_BUS_TOPIC by default
+func newEventBus(dryRun bool) (*eventBus, error) {
+	raw := secretFromEnv(EVENT_BUS_URL_ENV_VAR)
+	if raw == "" {
+		return nil, nil
+	}
+	u, err := url.Parse(raw)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s: %w", EVENT_BUS_URL_ENV_VAR, err)
+	}
+	topic := os.Getenv(EVENT_BUS_TOPIC_ENV_VAR)
+	if topic == "" {
+		topic = DEFAULT_EVENT_BUS_TOPIC
+	}
+	b := &eventBus{target: fmt.Sprintf("%s %s", u.Host, topic), dryRun: dryRun}
+	switch u.Scheme {
+	case EVENT_BUS_SCHEME_NATS:
+		conn, err := nats.Connect(raw, nats.Name("gitlab-odds-and-ends"), nats.MaxReconnects(-1))
+		if err != nil {
+			return nil, err
+		}
+		b.sender = natsBus{conn: conn, topic: topic}
+	case EVENT_BUS_SCHEME_KAFKA:
+		b.sender = kafkaBus{writer: &kafka.Writer{
+			Addr:         kafka.TCP(strings.Split(u.Host, ",")...),
+			Topic:        topic,
+			Balancer:     &kafka.Hash{},
+			Async:        true,
+			BatchTimeout: 100 * time.Millisecond,
+			Completion: func(messages []kafka.Message, err error) {
+				if err != nil {
+					logrus.WithError(err).Errorf("failed to publish %s to kafka", plural(len(messages), "event"))
+				}
+			},
+		}}
+	default:
+		return nil, fmt.Errorf("invalid %s scheme '%s', expected %s or %s", EVENT_BUS_URL_ENV_VAR, u.Scheme, EVENT_BUS_SCHEME_NATS, EVENT_BUS_SCHEME_KAFKA)
+	}
+	return b, nil
+}
+
+// publish puts the event on the bus
+func (b *eventBus) publish(ev outgoingEvent) {
+	body, err := json.Marshal(ev)
+	if err != nil {
+		logrus.WithError(err).Errorf("failed to encode %s event", ev.Type)
+		return
+	}
+	if b.dryRun {
+		logrus.Infof("dry run: would publish %s event to %s: %s", ev.Type, b.target, body)
+		return
+	}
+	if err := b.sender.send(ev, body); err != nil {
+		logrus.WithError(err).Errorf("failed to publish %s event to %s", ev.Type, b.target)
+	}
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	_ "github.com/go-sql-driver/mysql"
+	_ "github.com/lib/pq"
+	"github.com/sirupsen/logrus"
+	"github.com/xanzy/go-gitlab"
+)
+
+const (
+	EVENT_DB_DRIVER_ENV_VAR = "EVENT_DB_DRIVER"
+	EVENT_DB_DSN_ENV_VAR    = "EVENT_DB_DSN"
+	EVENT_DB_POSTGRES       = "postgres"
+	EVENT_DB_MYSQL          = "mysql"
+	// EVENT_DB_QUEUE_LENGTH is how many rows can wait to be written before new ones are dropped, so a slow database
+	// can't hold up webhooks
+	EVENT_DB_QUEUE_LENGTH = 1000
+)
+
+// eventDBSchema creates the tables, in SQL both postgres and mysql take
+var eventDBSchema = []string{
+	`CREATE TABLE IF NOT EXISTS mr_events (
+		at TIMESTAMP NOT NULL,
+		instance VARCHAR(255) NOT NULL,
+		project VARCHAR(255) NOT NULL,
+		iid INTEGER NOT NULL,
+		event VARCHAR(64) NOT NULL,
+		actor VARCHAR(255) NOT NULL,
+		title TEXT NOT NULL,
+		source_branch VARCHAR(255) NOT NULL,
+		target_branch VARCHAR(255) NOT NULL,
+		url TEXT NOT NULL
+	)`,
+	`CREATE TABLE IF NOT EXISTS assignments (
+		at TIMESTAMP NOT NULL,
+		instance VARCHAR(255) NOT NULL,
+		project VARCHAR(255) NOT NULL,
+		iid INTEGER NOT NULL,
+		reviewer VARCHAR(255) NOT NULL
+	)`,
+	`CREATE TABLE IF NOT EXISTS pipeline_results (
+		at TIMESTAMP NOT NULL,
+		instance VARCHAR(255) NOT NULL,
+		project VARCHAR(255) NOT NULL,
+		pipeline_id BIGINT NOT NULL,
+		ref VARCHAR(255) NOT NULL,
+		sha VARCHAR(64) NOT NULL,
+		status VARCHAR(32) NOT NULL,
+		duration_seconds INTEGER NOT NULL,
+		triggered_by VARCHAR(255) NOT NULL
+	)`,
+	`CREATE TABLE IF NOT EXISTS deployments (
+		at TIMESTAMP NOT NULL,
+		instance VARCHAR(255) NOT NULL,
+		project VARCHAR(255) NOT NULL,
+		environment VARCHAR(255) NOT NULL,
+		status VARCHAR(32) NOT NULL,
+		sha VARCHAR(64) NOT NULL,
+		triggered_by VARCHAR(255) NOT NULL
+	)`,
+}
+
+// eventRow is an insert waiting to be written
+type eventRow struct {
+	query string
+	args  []interface{}
+}
+
+// eventDB writes normalized rows for MR lifecycle events, assignments, pipeline results and deployments to postgres or
+// mysql, so reports can be built with SQL instead of from webhook payloads.  rows are written in the background, in
+// the order they happened
+type eventDB struct {
+	db     *sql.DB
+	driver string
+	rows   chan eventRow
+}
+
+// newEventDB connects to EVENT_DB_DSN with EVENT_DB_DRIVER (postgres by default) and creates the tables, returning nil
+// if EVENT_DB_DSN isn't set
+func newEventDB() (*eventDB, error) {
+	dsn := secretFromEnv(EVENT_DB_DSN_ENV_VAR)
+	if dsn == "" {
+		return nil, nil
+	}
+	driver := os.Getenv(EVENT_DB_DRIVER_ENV_VAR)
+	if driver == "" {
+		driver = EVENT_DB_POSTGRES
+	}
+	if driver != EVENT_DB_POSTGRES && driver != EVENT_DB_MYSQL {
+		return nil, fmt.Errorf("invalid %s '%s', expected %s or %s", EVENT_DB_DRIVER_ENV_VAR, driver, EVENT_DB_POSTGRES, EVENT_DB_MYSQL)
+	}
+	db, err := sql.Open(driver, dsn)
+	if err != nil {
+		return nil, err
+	}
+	if err := db.Ping(); err != nil {
+		return nil, err
+	}
+	for _, table := range eventDBSchema {
+		if _, err := db.Exec(table); err != nil {
+			return nil, fmt.Errorf("failed to create tables: %w", err)
+		}
+	}
+	e := &eventDB{db: db, driver: driver, rows: make(chan eventRow, EVENT_DB_QUEUE_LENGTH)}
+	go e.write()
+	return e, nil
+}
+
+// insert queues a row.  query has `?` placeholders, which are numbered for postgres
+func (e *eventDB) insert(query string, args ...interface{}) {
+	if e.driver == EVENT_DB_POSTGRES {
+		for i := 1; strings.Contains(query, "?"); i++ {
+			query = strings.Replace(query, "?", fmt.Sprintf("$%d", i), 1)
+		}
+	}
+	select {
+	case e.rows <- eventRow{query: query, args: args}:
+	default:
+		logrus.Errorf("event database is falling behind, dropping row: %s %v", query, args)
+	}
+}
+
+// write writes the queued rows, forever
+func (e *eventDB) write() {
+	for row := range e.rows {
+		if _, err := e.db.Exec(row.query, row.args...); err != nil {
+			logrus.WithError(err).Errorf("failed to write to the event database: %s %v", row.query, row.args)
+		}
+	}
+}
+
+// export writes the rows for one of the bot's events.  pipelines are exported when they finish, by exportPipeline,
+// rather than only when they fail like the event
+func (e *eventDB) export(instance string, ev outgoingEvent) {
+	at := ev.At
+	if at.IsZero() {
+		at = time.Now()
+	}
+	switch {
+	case ev.MergeRequest != nil:
+		mr := ev.MergeRequest
+		e.insert("INSERT INTO mr_events (at, instance, project, iid, event, actor, title, source_branch, target_branch, url) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)",
+			at, instance, ev.Project.Path, mr.IID, ev.Type, mr.Actor, mr.Title, mr.SourceBranch, mr.TargetBranch, mr.URL)
+		if ev.Type == EVENT_MR_ASSIGNED && mr.Assignee != "" {
+			e.insert("INSERT INTO assignments (at, instance, project, iid, reviewer) VALUES (?, ?, ?, ?, ?)",
+				at, instance, ev.Project.Path, mr.IID, mr.Assignee)
+		}
+	case ev.Deployment != nil:
+		d := ev.Deployment
+		e.insert("INSERT INTO deployments (at, instance, project, environment, status, sha, triggered_by) VALUES (?, ?, ?, ?, ?, ?, ?)",
+			at, instance, ev.Project.Path, d.Environment, d.Status, d.SHA, d.User)
+	}
+}
+
+// exportPipeline writes the result of a finished pipeline
+func (bot bot) exportPipeline(p *gitlab.PipelineEvent) {
+	if bot.eventDB == nil {
+		return
+	}
+	switch p.ObjectAttributes.Status {
+	case PIPELINE_STATUS_SUCCESS, PIPELINE_STATUS_FAILED, PIPELINE_STATUS_CANCELED:
+	default:
+		return
+	}
+	user := ""
+	if p.User != nil {
+		user = p.User.Username
+	}
+	bot.eventDB.insert("INSERT INTO pipeline_results (at, instance, project, pipeline_id, ref, sha, status, duration_seconds, triggered_by) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)",
+		time.Now(), bot.instance, p.Project.PathWithNamespace, p.ObjectAttributes.ID, p.ObjectAttributes.Ref, p.ObjectAttributes.SHA,
+		p.ObjectAttributes.Status, p.ObjectAttributes.Duration, user)
+}
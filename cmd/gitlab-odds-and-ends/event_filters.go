@@ -0,0 +1,99 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/raidancampbell/gitlab-odds-and-ends/internal/notify"
+	"github.com/sirupsen/logrus"
+	"github.com/xanzy/go-gitlab"
+)
+
+// webhook event names for projects' event filters, the object_kind gitlab gives them
+const (
+	EVENT_KIND_MERGE_REQUEST = "merge_request"
+	EVENT_KIND_PIPELINE      = "pipeline"
+	EVENT_KIND_DEPLOYMENT    = "deployment"
+	EVENT_KIND_ISSUE         = "issue"
+	EVENT_KIND_TAG_PUSH      = "tag_push"
+	EVENT_KIND_NOTE          = "note"
+)
+
+var (
+	eventKinds = map[string]bool{
+		EVENT_KIND_MERGE_REQUEST: true, EVENT_KIND_PIPELINE: true, EVENT_KIND_DEPLOYMENT: true,
+		EVENT_KIND_ISSUE: true, EVENT_KIND_TAG_PUSH: true, EVENT_KIND_NOTE: true,
+	}
+	mrActions = map[string]bool{
+		MR_ACTION_OPENED: true, MR_ACTION_REOPENED: true, MR_ACTION_UPDATED: true, MR_ACTION_APPROVED: true,
+		MR_ACTION_UNAPPROVED: true, MR_ACTION_MERGED: true, MR_ACTION_CLOSED: true,
+	}
+)
+
+// validateEventFilters checks the projects' event and action filters up front, like validatePolicies
+func validateEventFilters(projects []projectConfig) error {
+	for _, p := range projects {
+		for _, kind := range p.Events {
+			if !eventKinds[kind] {
+				return fmt.Errorf("project %s has unknown event '%s'", p.Project, kind)
+			}
+		}
+		for _, action := range p.Actions {
+			if !mrActions[action] {
+				return fmt.Errorf("project %s has unknown merge request action '%s'", p.Project, action)
+			}
+		}
+	}
+	return nil
+}
+
+// webhookKind names the webhook's event for event filters
+func webhookKind(webhook interface{}) string {
+	switch webhook.(type) {
+	case *gitlab.MergeEvent:
+		return EVENT_KIND_MERGE_REQUEST
+	case *gitlab.PipelineEvent:
+		return EVENT_KIND_PIPELINE
+	case *gitlab.DeploymentEvent:
+		return EVENT_KIND_DEPLOYMENT
+	case *gitlab.IssueEvent:
+		return EVENT_KIND_ISSUE
+	case *gitlab.TagEvent:
+		return EVENT_KIND_TAG_PUSH
+	case *gitlab.MergeCommentEvent:
+		return EVENT_KIND_NOTE
+	}
+	return ""
+}
+
+// notifies reports whether the project's event and action filters let the webhook notify anyone.  projects without
+// filters hear about everything
+func (p projectConfig) notifies(webhook interface{}) bool {
+	if len(p.Events) > 0 && !contains(p.Events, webhookKind(webhook)) {
+		return false
+	}
+	if mr, ok := webhook.(*gitlab.MergeEvent); ok && len(p.Actions) > 0 {
+		return contains(p.Actions, mr.ObjectAttributes.Action)
+	}
+	return true
+}
+
+// filterEvents silences the bot for a webhook its project's filters leave out.  everything else still happens, e.g.
+// the MR is assigned, it's just nobody is told about it, in slack or any other backend
+func (bot bot) filterEvents(project string, webhook interface{}) bot {
+	if bot.projects[project].notifies(webhook) {
+		return bot
+	}
+	logrus.Debugf("%s's event filters leave out its %s webhook, not notifying anyone", project, webhookKind(webhook))
+	bot.notifier = notify.Noop{}
+	return bot
+}
+
+// contains reports whether the list has the value
+func contains(list []string, value string) bool {
+	for _, v := range list {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+
+	"github.com/sirupsen/logrus"
+	"github.com/xanzy/go-gitlab"
+)
+
+// expertRule says which of a project's MRs a maintainer knows best: those with any of the labels, or changing any
+// file matching one of the path globs (see labelRule for the glob syntax)
+type expertRule struct {
+	// GitLab is the maintainer's gitlab username
+	GitLab string   `yaml:"gitlab"`
+	Labels []string `yaml:"labels"`
+	Paths  []string `yaml:"paths"`
+}
+
+// compiledExpertRule is an expertRule with its globs turned into regular expressions
+type compiledExpertRule struct {
+	username string
+	labels   map[string]bool
+	paths    []*regexp.Regexp
+}
+
+// compileExpertRules checks every project's expert rules up front, like compileLabelRules
+func compileExpertRules(projects []projectConfig) (map[string][]compiledExpertRule, error) {
+	rules := make(map[string][]compiledExpertRule)
+	for _, p := range projects {
+		for _, rule := range p.Experts {
+			if rule.GitLab == "" {
+				return nil, fmt.Errorf("expert rule in %s has no gitlab username", p.Project)
+			}
+			compiled := compiledExpertRule{username: rule.GitLab, labels: make(map[string]bool)}
+			for _, l := range rule.Labels {
+				compiled.labels[l] = true
+			}
+			for _, glob := range rule.Paths {
+				re, err := globRegexp(glob)
+				if err != nil {
+					return nil, fmt.Errorf("invalid path glob '%s' for %s in %s: %v", glob, rule.GitLab, p.Project, err)
+				}
+				compiled.paths = append(compiled.paths, re)
+			}
+			rules[p.Project] = append(rules[p.Project], compiled)
+		}
+	}
+	return rules, nil
+}
+
+// matches reports whether the rule's maintainer knows an MR with the labels that changes the paths
+func (r compiledExpertRule) matches(labels, paths []string) bool {
+	for _, l := range labels {
+		if r.labels[l] {
+			return true
+		}
+	}
+	for _, re := range r.paths {
+		for _, p := range paths {
+			if re.MatchString(p) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// expertsFor narrows the members to the MR's domain experts, by its labels and the files it changes.  projects
+// without expert rules, and MRs nobody is an expert in, have none
+func (bot bot) expertsFor(mr *gitlab.MergeEvent, members []*gitlab.ProjectMember) []*gitlab.ProjectMember {
+	rules := bot.experts[mr.Project.PathWithNamespace]
+	if len(rules) == 0 || len(members) == 0 {
+		return nil
+	}
+	changes, err := bot.gl.GetMergeRequestChanges(mr.Project.ID, mr.ObjectAttributes.IID)
+	if err != nil {
+		logrus.WithError(err).Errorf("failed to list changes of merge request !%d, picking reviewers without its experts", mr.ObjectAttributes.IID)
+		return nil
+	}
+	var paths []string
+	for _, c := range changes.Changes {
+		paths = append(paths, c.OldPath, c.NewPath)
+	}
+	knows := make(map[string]bool)
+	for _, rule := range rules {
+		if rule.matches(changes.Labels, paths) {
+			knows[rule.username] = true
+		}
+	}
+	var experts []*gitlab.ProjectMember
+	for _, m := range members {
+		if knows[m.Username] {
+			experts = append(experts, m)
+		}
+	}
+	return experts
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/xanzy/go-gitlab"
+)
+
+// fakeGitLab is an in-memory gitlab for tests.  it knows the users, MRs and approvals it's given, and remembers what
+// the bot changed.  calls it doesn't implement panic on the nil GitLabAPI it embeds, so a test can't quietly depend on
+// one
+type fakeGitLab struct {
+	GitLabAPI
+
+	mu           sync.Mutex
+	users        map[int]*gitlab.User
+	mrs          map[string]*gitlab.MergeRequest // by mrRef
+	changes      map[string][]*gitlab.MergeRequestDiff
+	participants map[string][]*gitlab.BasicUser
+	approvals    map[string]*gitlab.MergeRequestApprovals
+	// notes and updates are what the bot did to each MR
+	notes    map[string][]string
+	updates  map[string][]*gitlab.UpdateMergeRequestOptions
+	accepted []string
+	releases []*gitlab.CreateReleaseOptions
+}
+
+func newFakeGitLab() *fakeGitLab {
+	return &fakeGitLab{
+		users:        make(map[int]*gitlab.User),
+		mrs:          make(map[string]*gitlab.MergeRequest),
+		changes:      make(map[string][]*gitlab.MergeRequestDiff),
+		participants: make(map[string][]*gitlab.BasicUser),
+		approvals:    make(map[string]*gitlab.MergeRequestApprovals),
+		notes:        make(map[string][]string),
+		updates:      make(map[string][]*gitlab.UpdateMergeRequestOptions),
+	}
+}
+
+// addUser adds a user named after their username, returning them as a project member with the access level
+func (gl *fakeGitLab) addUser(id int, username string, access gitlab.AccessLevelValue) *gitlab.ProjectMember {
+	gl.mu.Lock()
+	defer gl.mu.Unlock()
+	gl.users[id] = &gitlab.User{ID: id, Username: username, Name: "User " + username}
+	return &gitlab.ProjectMember{ID: id, Username: username, Name: "User " + username, AccessLevel: access}
+}
+
+// addMR adds the MR, returning its webhook as it would be opened
+func (gl *fakeGitLab) addMR(mr *gitlab.MergeRequest) *gitlab.MergeEvent {
+	gl.mu.Lock()
+	defer gl.mu.Unlock()
+	gl.mrs[mrRef(mr.ProjectID, mr.IID)] = mr
+	ev := &gitlab.MergeEvent{ObjectKind: EVENT_KIND_MERGE_REQUEST}
+	ev.Project.ID = mr.ProjectID
+	ev.Project.PathWithNamespace = "group/project"
+	ev.ObjectAttributes.IID = mr.IID
+	ev.ObjectAttributes.Title = mr.Title
+	ev.ObjectAttributes.URL = mr.WebURL
+	ev.ObjectAttributes.Action = MR_ACTION_OPENED
+	ev.ObjectAttributes.Target = &gitlab.Repository{Name: "project"}
+	if mr.Author != nil {
+		ev.ObjectAttributes.AuthorID = mr.Author.ID
+	}
+	if mr.Assignee != nil {
+		ev.ObjectAttributes.AssigneeID = mr.Assignee.ID
+	}
+	return ev
+}
+
+func (gl *fakeGitLab) basicUser(id int) *gitlab.BasicUser {
+	u, ok := gl.users[id]
+	if !ok {
+		return &gitlab.BasicUser{ID: id}
+	}
+	return &gitlab.BasicUser{ID: id, Username: u.Username, Name: u.Name}
+}
+
+func (gl *fakeGitLab) mr(pid, iid int) (*gitlab.MergeRequest, error) {
+	mr, ok := gl.mrs[mrRef(pid, iid)]
+	if !ok {
+		return nil, fmt.Errorf("404 merge request !%d of project %d not found", iid, pid)
+	}
+	return mr, nil
+}
+
+func (gl *fakeGitLab) GetUser(id int) (*gitlab.User, error) {
+	gl.mu.Lock()
+	defer gl.mu.Unlock()
+	u, ok := gl.users[id]
+	if !ok {
+		return nil, fmt.Errorf("404 user %d not found", id)
+	}
+	return u, nil
+}
+
+func (gl *fakeGitLab) GetMergeRequest(pid, iid int) (*gitlab.MergeRequest, error) {
+	gl.mu.Lock()
+	defer gl.mu.Unlock()
+	mr, err := gl.mr(pid, iid)
+	if err != nil {
+		return nil, err
+	}
+	copied := *mr
+	return &copied, nil
+}
+
+func (gl *fakeGitLab) GetMergeRequestChanges(pid, iid int) (*gitlab.MergeRequest, error) {
+	mr, err := gl.GetMergeRequest(pid, iid)
+	if err != nil {
+		return nil, err
+	}
+	gl.mu.Lock()
+	defer gl.mu.Unlock()
+	for _, d := range gl.changes[mrRef(pid, iid)] {
+		mr.Changes = append(mr.Changes, &gitlab.MergeRequestDiff{OldPath: d.OldPath, NewPath: d.NewPath, Diff: d.Diff})
+	}
+	return mr, nil
+}
+
+func (gl *fakeGitLab) GetMergeRequestParticipants(pid, iid int) ([]*gitlab.BasicUser, error) {
+	gl.mu.Lock()
+	defer gl.mu.Unlock()
+	return gl.participants[mrRef(pid, iid)], nil
+}
+
+func (gl *fakeGitLab) GetMergeRequestApprovals(pid, iid int) (*gitlab.MergeRequestApprovals, error) {
+	gl.mu.Lock()
+	defer gl.mu.Unlock()
+	if a, ok := gl.approvals[mrRef(pid, iid)]; ok {
+		return a, nil
+	}
+	return &gitlab.MergeRequestApprovals{IID: iid, ProjectID: pid}, nil
+}
+
+func (gl *fakeGitLab) UpdateMergeRequest(pid, iid int, opt *gitlab.UpdateMergeRequestOptions) (*gitlab.MergeRequest, error) {
+	gl.mu.Lock()
+	defer gl.mu.Unlock()
+	mr, err := gl.mr(pid, iid)
+	if err != nil {
+		return nil, err
+	}
+	gl.updates[mrRef(pid, iid)] = append(gl.updates[mrRef(pid, iid)], opt)
+	if opt.AssigneeID != nil {
+		mr.Assignee = gl.basicUser(*opt.AssigneeID)
+	}
+	if opt.ReviewerIDs != nil {
+		mr.Reviewers = nil
+		for _, id := range *opt.ReviewerIDs {
+			mr.Reviewers = append(mr.Reviewers, gl.basicUser(id))
+		}
+	}
+	return mr, nil
+}
+
+func (gl *fakeGitLab) CreateMergeRequestNote(pid, iid int, body string) (*gitlab.Note, error) {
+	gl.mu.Lock()
+	defer gl.mu.Unlock()
+	if _, err := gl.mr(pid, iid); err != nil {
+		return nil, err
+	}
+	gl.notes[mrRef(pid, iid)] = append(gl.notes[mrRef(pid, iid)], body)
+	return &gitlab.Note{Body: body}, nil
+}
+
+func (gl *fakeGitLab) AcceptMergeRequest(pid, iid int, opt *gitlab.AcceptMergeRequestOptions) (*gitlab.MergeRequest, error) {
+	gl.mu.Lock()
+	defer gl.mu.Unlock()
+	mr, err := gl.mr(pid, iid)
+	if err != nil {
+		return nil, err
+	}
+	mr.State = "merged"
+	gl.accepted = append(gl.accepted, mrRef(pid, iid))
+	return mr, nil
+}
+
+func (gl *fakeGitLab) ListUsers(opt *gitlab.ListUsersOptions) ([]*gitlab.User, error) {
+	gl.mu.Lock()
+	defer gl.mu.Unlock()
+	var users []*gitlab.User
+	for _, u := range gl.users {
+		if opt.Username == nil || *opt.Username == u.Username {
+			users = append(users, u)
+		}
+	}
+	return users, nil
+}
+
+func (gl *fakeGitLab) CreateRelease(pid int, opt *gitlab.CreateReleaseOptions) (*gitlab.Release, error) {
+	gl.mu.Lock()
+	defer gl.mu.Unlock()
+	gl.releases = append(gl.releases, opt)
+	return &gitlab.Release{Name: *opt.Name, TagName: *opt.TagName, Description: *opt.Description}, nil
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/raidancampbell/gitlab-odds-and-ends/internal/store"
+	"github.com/sirupsen/logrus"
+	"github.com/xanzy/go-gitlab"
+)
+
+const (
+	FLAKY_TEST_REPORT_DAY_ENV_VAR  = "FLAKY_TEST_REPORT_DAY"
+	FLAKY_TEST_REPORT_TIME_ENV_VAR = "FLAKY_TEST_REPORT_TIME"
+	DEFAULT_FLAKY_TEST_REPORT_TIME = "09:00"
+	FLAKY_TEST_REPORT_PERIOD       = 7 * 24 * time.Hour
+	// FLAKY_TEST_REPORT_SIZE is how many jobs each project's report lists
+	FLAKY_TEST_REPORT_SIZE = 10
+	FLAKY_JOBS_STORE_KEY   = "flaky_jobs"
+	JOB_STATUS_FAILED      = "failed"
+	JOB_STATUS_SUCCESS     = "success"
+)
+
+// flakyRetry is a job that failed and passed when retried in the same pipeline
+type flakyRetry struct {
+	ProjectID   int       `json:"project_id"`
+	Project     string    `json:"project"`
+	WebURL      string    `json:"web_url"`
+	PipelineID  int       `json:"pipeline_id"`
+	Job         string    `json:"job"`
+	Stage       string    `json:"stage"`
+	FailedJobID int       `json:"failed_job_id"`
+	PassedJobID int       `json:"passed_job_id"`
+	At          time.Time `json:"at"`
+}
+
+// failedJob is a job failure that hasn't been retried yet
+type failedJob struct {
+	id int
+	at time.Time
+}
+
+// flakyJobs notices jobs that pass on retry from the builds in pipeline events.  the retries are persisted so a
+// restart doesn't lose the week's report
+type flakyJobs struct {
+	store *store.Store
+	mu    sync.Mutex
+	// failed is the last failure of each job (by name) of each pipeline (by project and pipeline ID)
+	failed  map[string]map[string]failedJob
+	retries []flakyRetry
+}
+
+func newFlakyJobs(s *store.Store) (*flakyJobs, error) {
+	f := &flakyJobs{store: s, failed: make(map[string]map[string]failedJob)}
+	if _, err := s.Load(FLAKY_JOBS_STORE_KEY, &f.retries); err != nil {
+		return nil, err
+	}
+	s.Follow(FLAKY_JOBS_STORE_KEY, &f.retries, &f.mu)
+	return f, nil
+}
+
+// observe records the pipeline's failed jobs, and any that passed after an earlier failure.
+// a retried job keeps its name but gets a new ID, and gitlab may list both the old and new job in the same event
+func (f *flakyJobs) observe(p *gitlab.PipelineEvent) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	key := fmt.Sprintf("%d:%d", p.Project.ID, p.ObjectAttributes.ID)
+	failed := f.failed[key]
+	if failed == nil {
+		failed = make(map[string]failedJob)
+	}
+	// sort a copy, the event is shared with the other handlers
+	builds := append(p.Builds[:0:0], p.Builds...)
+	sort.Slice(builds, func(i, j int) bool { return builds[i].ID < builds[j].ID })
+	now := time.Now()
+	changed := false
+	for _, build := range builds {
+		switch build.Status {
+		case JOB_STATUS_FAILED:
+			failed[build.Name] = failedJob{id: build.ID, at: now}
+		case JOB_STATUS_SUCCESS:
+			prev, ok := failed[build.Name]
+			if !ok || prev.id > build.ID {
+				continue
+			}
+			delete(failed, build.Name)
+			f.retries = append(f.retries, flakyRetry{
+				ProjectID:   p.Project.ID,
+				Project:     p.Project.PathWithNamespace,
+				WebURL:      p.Project.WebURL,
+				PipelineID:  p.ObjectAttributes.ID,
+				Job:         build.Name,
+				Stage:       build.Stage,
+				FailedJobID: prev.id,
+				PassedJobID: build.ID,
+				At:          now,
+			})
+			changed = true
+			logrus.Infof("job %s in %s passed on retry in pipeline %d", build.Name, p.Project.PathWithNamespace, p.ObjectAttributes.ID)
+		}
+	}
+	if len(failed) > 0 {
+		f.failed[key] = failed
+	} else {
+		delete(f.failed, key)
+	}
+
+	// failures nobody retried within the report period never will be
+	for k, jobs := range f.failed {
+		for name, job := range jobs {
+			if now.Sub(job.at) > FLAKY_TEST_REPORT_PERIOD {
+				delete(jobs, name)
+			}
+		}
+		if len(jobs) == 0 {
+			delete(f.failed, k)
+		}
+	}
+	if changed {
+		f.pruneLocked(now.Add(-FLAKY_TEST_REPORT_PERIOD))
+		if err := f.store.Save(FLAKY_JOBS_STORE_KEY, f.retries); err != nil {
+			logrus.WithError(err).Error("failed to persist flaky jobs")
+		}
+	}
+}
+
+// pruneLocked forgets retries from before the given time.  f.mu must be held
+func (f *flakyJobs) pruneLocked(before time.Time) {
+	kept := f.retries[:0]
+	for _, r := range f.retries {
+		if r.At.After(before) {
+			kept = append(kept, r)
+		}
+	}
+	f.retries = kept
+}
+
+// flakyJob is one job's retries over the report period
+type flakyJob struct {
+	name    string
+	stage   string
+	retries []flakyRetry
+}
+
+// report lists the project's flakiest jobs since the given time, most retried first
+func (f *flakyJobs) report(project string, since time.Time) []flakyJob {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	byName := make(map[string]*flakyJob)
+	for _, r := range f.retries {
+		if r.Project != project || r.At.Before(since) {
+			continue
+		}
+		job, ok := byName[r.Job]
+		if !ok {
+			job = &flakyJob{name: r.Job, stage: r.Stage}
+			byName[r.Job] = job
+		}
+		job.retries = append(job.retries, r)
+	}
+	var jobs []flakyJob
+	for _, job := range byName {
+		jobs = append(jobs, *job)
+	}
+	sort.Slice(jobs, func(i, j int) bool {
+		if len(jobs[i].retries) != len(jobs[j].retries) {
+			return len(jobs[i].retries) > len(jobs[j].retries)
+		}
+		return jobs[i].name < jobs[j].name
+	})
+	if len(jobs) > FLAKY_TEST_REPORT_SIZE {
+		jobs = jobs[:FLAKY_TEST_REPORT_SIZE]
+	}
+	return jobs
+}
+
+// formatFlakyReport renders a project's flaky jobs for slack, linking each one's latest failure and the pipeline it passed in
+func formatFlakyReport(project string, since time.Time, jobs []flakyJob) string {
+	lines := []string{fmt.Sprintf(":game_die: *Flakiest jobs in `%s` since %s*", project, since.Format("Jan 2"))}
+	for _, job := range jobs {
+		last := job.retries[len(job.retries)-1]
+		lines = append(lines, fmt.Sprintf("• `%s` (%s): passed on retry %s, last <%s/-/jobs/%d|failure> in <%s/-/pipelines/%d|pipeline %d>",
+			job.name, job.stage, plural(len(job.retries), "time"), last.WebURL, last.FailedJobID, last.WebURL, last.PipelineID, last.PipelineID))
+	}
+	return strings.Join(lines, "\n")
+}
+
+// postFlakyTestReports sends every routed project's weekly flaky job report to its channels.  projects without
+// flaky jobs are skipped
+func (bot bot) postFlakyTestReports() {
+	since := time.Now().Add(-FLAKY_TEST_REPORT_PERIOD)
+	for _, channel := range bot.routes.allChannels() {
+		for _, project := range bot.routes.projectsFor(channel) {
+			jobs := bot.flaky.report(project, since)
+			if len(jobs) == 0 {
+				continue
+			}
+			bot.notify(formatFlakyReport(project, since, jobs), []string{channel})
+		}
+	}
+}
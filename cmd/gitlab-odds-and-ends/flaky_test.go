@@ -0,0 +1,37 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/raidancampbell/gitlab-odds-and-ends/internal/store"
+	"github.com/xanzy/go-gitlab"
+)
+
+func TestFlakyObserveLeavesTheEventAlone(t *testing.T) {
+	s, err := store.Open("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := newFlakyJobs(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var p gitlab.PipelineEvent
+	// the retry is listed before the failure it retried
+	if err := json.Unmarshal([]byte(`{"builds": [
+		{"id": 3, "name": "test", "stage": "test", "status": "success"},
+		{"id": 2, "name": "test", "stage": "test", "status": "failed"}
+	]}`), &p); err != nil {
+		t.Fatal(err)
+	}
+
+	f.observe(&p)
+
+	if p.Builds[0].ID != 3 || p.Builds[1].ID != 2 {
+		t.Errorf("observe() reordered the event's builds to %d, %d", p.Builds[0].ID, p.Builds[1].ID)
+	}
+	if len(f.retries) != 1 || f.retries[0].Job != "test" {
+		t.Errorf("retries = %+v, want the retried test job", f.retries)
+	}
+}
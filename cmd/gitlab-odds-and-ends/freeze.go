@@ -0,0 +1,323 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/raidancampbell/gitlab-odds-and-ends/internal/store"
+	"github.com/sirupsen/logrus"
+	"github.com/slack-go/slack"
+	"github.com/xanzy/go-gitlab"
+)
+
+const (
+	SLACK_COMMAND_FREEZE       = "/freeze"
+	FREEZE_ICAL_REFRESH        = time.Hour
+	FREEZE_ICAL_TIMEOUT        = 30 * time.Second
+	FREEZE_OVERRIDES_STORE_KEY = "freeze_overrides"
+	ICAL_DATE_TIME_FORMAT      = "20060102T150405"
+	ICAL_DATE_FORMAT           = "20060102"
+)
+
+// freezeConfig configures deploy freeze windows.  during a freeze the bot warns loudly about merges to protected
+// branches and about deployments
+type freezeConfig struct {
+	Windows []freezeWindow `yaml:"windows"`
+	// ICal is a path or http(s) URL of an iCal calendar whose events are freeze windows.  recurring events aren't supported
+	ICal string `yaml:"ical"`
+	// BlockAutoMerge holds auto-merges during a freeze unless the project is overridden with `/freeze override`
+	BlockAutoMerge bool `yaml:"block_auto_merge"`
+}
+
+type freezeWindow struct {
+	Name  string    `yaml:"name"`
+	Start time.Time `yaml:"start"`
+	End   time.Time `yaml:"end"`
+}
+
+// freezes knows when the freeze windows are, and which projects were let off auto-merge blocking for which window.
+// overrides are kept in the store, so they outlast restarts and replicas sharing it honor each other's
+type freezes struct {
+	cfg    freezeConfig
+	store  *store.Store
+	client *http.Client
+
+	mu        sync.RWMutex
+	calendar  []freezeWindow
+	overrides map[string]string // project path -> name of the window it's overridden for
+}
+
+// newFreezes returns nil when no freeze windows are configured
+func newFreezes(cfg freezeConfig, s *store.Store) (*freezes, error) {
+	if len(cfg.Windows) == 0 && cfg.ICal == "" {
+		return nil, nil
+	}
+	for _, w := range cfg.Windows {
+		if !w.End.After(w.Start) {
+			return nil, fmt.Errorf("freeze window '%s' ends before it starts", w.Name)
+		}
+	}
+	f := &freezes{cfg: cfg, store: s, client: &http.Client{Timeout: FREEZE_ICAL_TIMEOUT}, overrides: make(map[string]string)}
+	if _, err := s.Load(FREEZE_OVERRIDES_STORE_KEY, &f.overrides); err != nil {
+		return nil, err
+	}
+	s.Follow(FREEZE_OVERRIDES_STORE_KEY, &f.overrides, &f.mu)
+	if cfg.ICal != "" {
+		if err := f.refresh(); err != nil {
+			return nil, err
+		}
+	}
+	return f, nil
+}
+
+// refresh reloads the iCal calendar
+func (f *freezes) refresh() error {
+	windows, err := loadICal(f.client, f.cfg.ICal)
+	if err != nil {
+		return err
+	}
+	f.mu.Lock()
+	f.calendar = windows
+	f.mu.Unlock()
+	return nil
+}
+
+// active returns the freeze window in effect at the given time, if any
+func (f *freezes) active(at time.Time) (freezeWindow, bool) {
+	if f == nil {
+		return freezeWindow{}, false
+	}
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	for _, windows := range [][]freezeWindow{f.cfg.Windows, f.calendar} {
+		for _, w := range windows {
+			if !at.Before(w.Start) && at.Before(w.End) {
+				return w, true
+			}
+		}
+	}
+	return freezeWindow{}, false
+}
+
+// holdsAutoMerge reports whether the project's auto-merges are blocked right now
+func (f *freezes) holdsAutoMerge(project string) (freezeWindow, bool) {
+	if f == nil || !f.cfg.BlockAutoMerge {
+		return freezeWindow{}, false
+	}
+	w, ok := f.active(time.Now())
+	if !ok {
+		return freezeWindow{}, false
+	}
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	return w, f.overrides[project] != w.Name
+}
+
+// override lets the project auto-merge for the rest of the current freeze window
+func (f *freezes) override(project string) (freezeWindow, bool) {
+	w, ok := f.active(time.Now())
+	if !ok {
+		return freezeWindow{}, false
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.overrides[project] = w.Name
+	if err := f.store.Save(FREEZE_OVERRIDES_STORE_KEY, f.overrides); err != nil {
+		logrus.WithError(err).Error("failed to persist freeze overrides")
+	}
+	return w, true
+}
+
+// loadICal reads the VEVENTs of an iCal calendar, from a file or an http(s) URL fetched with the client
+func loadICal(client *http.Client, source string) ([]freezeWindow, error) {
+	var r io.ReadCloser
+	if strings.HasPrefix(source, "http://") || strings.HasPrefix(source, "https://") {
+		resp, err := client.Get(source)
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			return nil, fmt.Errorf("fetching freeze calendar: %s", resp.Status)
+		}
+		r = resp.Body
+	} else {
+		f, err := os.Open(source)
+		if err != nil {
+			return nil, err
+		}
+		r = f
+	}
+	defer r.Close()
+	return parseICal(r)
+}
+
+// parseICal is just enough of RFC 5545 to get each event's summary, start and end
+func parseICal(r io.Reader) ([]freezeWindow, error) {
+	// unfold continuation lines first
+	var lines []string
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		if (strings.HasPrefix(line, " ") || strings.HasPrefix(line, "\t")) && len(lines) > 0 {
+			lines[len(lines)-1] += line[1:]
+			continue
+		}
+		lines = append(lines, line)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	var windows []freezeWindow
+	var event *freezeWindow
+	var allDay bool
+	for _, line := range lines {
+		switch {
+		case line == "BEGIN:VEVENT":
+			event, allDay = &freezeWindow{}, false
+		case line == "END:VEVENT" && event != nil:
+			if event.End.IsZero() && allDay {
+				event.End = event.Start.AddDate(0, 0, 1)
+			}
+			if event.End.After(event.Start) {
+				windows = append(windows, *event)
+			}
+			event = nil
+		case event != nil:
+			colon := strings.Index(line, ":")
+			if colon < 0 {
+				continue
+			}
+			params := strings.Split(line[:colon], ";")
+			value := line[colon+1:]
+			switch params[0] {
+			case "SUMMARY":
+				event.Name = value
+			case "DTSTART", "DTEND":
+				t, date, err := parseICalTime(value, params[1:])
+				if err != nil {
+					return nil, fmt.Errorf("freeze calendar event '%s': %v", event.Name, err)
+				}
+				if params[0] == "DTSTART" {
+					event.Start, allDay = t, date
+				} else {
+					event.End = t
+				}
+			}
+		}
+	}
+	return windows, nil
+}
+
+// parseICalTime parses DTSTART/DTEND values, reporting whether the value was a date without a time
+func parseICalTime(value string, params []string) (time.Time, bool, error) {
+	loc := time.Local
+	for _, p := range params {
+		if strings.HasPrefix(p, "TZID=") {
+			var err error
+			if loc, err = time.LoadLocation(strings.TrimPrefix(p, "TZID=")); err != nil {
+				return time.Time{}, false, err
+			}
+		}
+	}
+	if len(value) == len(ICAL_DATE_FORMAT) {
+		t, err := time.ParseInLocation(ICAL_DATE_FORMAT, value, loc)
+		return t, true, err
+	}
+	if strings.HasSuffix(value, "Z") {
+		t, err := time.Parse(ICAL_DATE_TIME_FORMAT+"Z", value)
+		return t, false, err
+	}
+	t, err := time.ParseInLocation(ICAL_DATE_TIME_FORMAT, value, loc)
+	return t, false, err
+}
+
+// isProtectedBranch reports whether the branch matches one of the project's protected branches, which may be wildcards
+func isProtectedBranch(gl GitLabAPI, projectID int, branch string) (bool, error) {
+	protected, err := gl.ListProtectedBranches(projectID)
+	if err != nil {
+		return false, err
+	}
+	for _, p := range protected {
+		if ok, _ := path.Match(p.Name, branch); ok {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// warnFrozenMerge warns about an MR merged into a protected branch during a freeze
+func (bot bot) warnFrozenMerge(mr *gitlab.MergeEvent, slackChans []string) {
+	w, frozen := bot.freezes.active(time.Now())
+	if !frozen {
+		return
+	}
+	branch := mr.ObjectAttributes.TargetBranch
+	protected, err := isProtectedBranch(bot.gl, mr.Project.ID, branch)
+	if err != nil {
+		logrus.WithError(err).Errorf("failed to check whether %s is protected", branch)
+		protected = true // better a false alarm than a quiet merge
+	}
+	if !protected {
+		return
+	}
+	bot.notifyLocalized(tr("<!here> :snowflake: <%s|!%d %s> was merged into `%s` in `%s` during the *%s* freeze (until %s).",
+		mr.ObjectAttributes.URL, mr.ObjectAttributes.IID, mr.ObjectAttributes.Title, branch, mr.Project.PathWithNamespace, w.Name, w.End.Format(time.RFC1123)), slackChans)
+}
+
+// warnFrozenDeployment warns about a deployment during a freeze.  only once it's running, and when it succeeds, so a
+// deployment's other statuses (created, failed, canceled) don't page the channel again
+func (bot bot) warnFrozenDeployment(d *gitlab.DeploymentEvent, slackChans []string) {
+	if d.Status != DEPLOYMENT_STATUS_RUNNING && d.Status != DEPLOYMENT_STATUS_SUCCESS {
+		return
+	}
+	w, frozen := bot.freezes.active(time.Now())
+	if !frozen {
+		return
+	}
+	bot.notifyLocalized(tr("<!here> :snowflake: `%s` is being deployed to `%s` in `%s` during the *%s* freeze (until %s).",
+		d.ShortSHA, d.Environment, d.Project.PathWithNamespace, w.Name, w.End.Format(time.RFC1123)), slackChans)
+}
+
+// freezeCommand handles `/freeze status` and `/freeze override group/project reason...`
+func (bot bot) freezeCommand(cmd slack.SlashCommand) *slack.Msg {
+	if bot.freezes == nil {
+		return ephemeral("no freeze windows are configured")
+	}
+	args := strings.Fields(cmd.Text)
+	if len(args) == 0 || args[0] == "status" {
+		w, frozen := bot.freezes.active(time.Now())
+		if !frozen {
+			return ephemeral("no freeze is in effect")
+		}
+		return ephemeral(fmt.Sprintf(":snowflake: the *%s* freeze is in effect until %s", w.Name, w.End.Format(time.RFC1123)))
+	}
+	if args[0] != "override" || len(args) < 3 {
+		return ephemeral("usage: `/freeze status` or `/freeze override group/project reason`")
+	}
+	if !bot.isSlackAdmin(cmd.UserID) {
+		return ephemeral("only bot admins can override a freeze")
+	}
+
+	project, reason := args[1], strings.Join(args[2:], " ")
+	w, ok := bot.freezes.override(project)
+	if !ok {
+		return ephemeral("no freeze is in effect")
+	}
+	bot.audit.record(auditEntry{
+		Action:  "freeze_override",
+		Actor:   "slack:" + cmd.UserID,
+		Target:  project,
+		Detail:  reason,
+		Outcome: fmt.Sprintf("auto-merge allowed for the rest of the %s freeze", w.Name),
+	})
+	return inChannel(fmt.Sprintf("<@%s> overrode the *%s* freeze for `%s`, auto-merges are allowed again: %s", cmd.UserID, w.Name, project, reason))
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/raidancampbell/gitlab-odds-and-ends/internal/notify"
+	"github.com/raidancampbell/gitlab-odds-and-ends/internal/store"
+	"github.com/xanzy/go-gitlab"
+)
+
+// frozenNow is a freeze window that's in effect
+func frozenNow() freezeConfig {
+	return freezeConfig{
+		Windows:        []freezeWindow{{Name: "holidays", Start: time.Now().Add(-time.Hour), End: time.Now().Add(time.Hour)}},
+		BlockAutoMerge: true,
+	}
+}
+
+func TestWarnFrozenDeployment(t *testing.T) {
+	tests := []struct {
+		status string
+		warn   bool
+	}{
+		{"created", false},
+		{DEPLOYMENT_STATUS_RUNNING, true},
+		{DEPLOYMENT_STATUS_SUCCESS, true},
+		{DEPLOYMENT_STATUS_FAILED, false},
+		{"canceled", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.status, func(t *testing.T) {
+			s, err := store.Open("")
+			if err != nil {
+				t.Fatal(err)
+			}
+			rec := &notify.Recorder{}
+			b := notifyingBot(t, rec)
+			if b.freezes, err = newFreezes(frozenNow(), s); err != nil {
+				t.Fatal(err)
+			}
+			d := &gitlab.DeploymentEvent{Status: tt.status, ShortSHA: "abc123", Environment: "production"}
+
+			b.warnFrozenDeployment(d, []string{"#deploys"})
+
+			if warned := len(rec.Recorded()) > 0; warned != tt.warn {
+				t.Errorf("warned = %v, want %v", warned, tt.warn)
+			}
+		})
+	}
+}
+
+func TestFreezeOverridesOutlastRestarts(t *testing.T) {
+	s, err := store.Open("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := newFreezes(frozenNow(), s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, held := f.holdsAutoMerge("group/project"); !held {
+		t.Fatal("auto-merge isn't held during the freeze")
+	}
+	if _, ok := f.override("group/project"); !ok {
+		t.Fatal("couldn't override the freeze")
+	}
+
+	restarted, err := newFreezes(frozenNow(), s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, held := restarted.holdsAutoMerge("group/project"); held {
+		t.Error("the override was forgotten on restart")
+	}
+	if _, held := restarted.holdsAutoMerge("group/other"); !held {
+		t.Error("other projects were let off too")
+	}
+}
@@ -0,0 +1,460 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/xanzy/go-gitlab"
+)
+
+// GitLabAPI is the slice of the gitlab API the bot uses.  Projects are always referenced by their numeric ID.
+type GitLabAPI interface {
+	GetUser(id int) (*gitlab.User, error)
+	CurrentUser() (*gitlab.User, error)
+	Version() (*gitlab.Version, error)
+	// TokenExpiry is when our token expires, or nil if it doesn't
+	TokenExpiry() (*time.Time, error)
+	ListUsers(opt *gitlab.ListUsersOptions) ([]*gitlab.User, error)
+	// GetUserLocalTime is the time of day on the user's clock from their profile's timezone, e.g. `3:04 PM`
+	GetUserLocalTime(id int) (string, error)
+	// GetUserStatus is the user's status emoji, message, and whether they've said they're busy
+	GetUserStatus(id int) (*gitlab.UserStatus, error)
+	// GetProjectByPath looks up a project by its path with namespace, e.g. `group/project`
+	GetProjectByPath(path string) (*gitlab.Project, error)
+	GetProject(pid int) (*gitlab.Project, error)
+	ListProjectMembers(pid int, opt *gitlab.ListProjectMembersOptions) ([]*gitlab.ProjectMember, *gitlab.Response, error)
+	// GetMergeRequest includes the number of commits the MR's source branch is behind its target
+	GetMergeRequest(pid, iid int) (*gitlab.MergeRequest, error)
+	// GetMergeRequestChanges is GetMergeRequest with the MR's changed files
+	GetMergeRequestChanges(pid, iid int) (*gitlab.MergeRequest, error)
+	// ListMergeRequestCommits lists all the MR's commits, newest first
+	ListMergeRequestCommits(pid, iid int) ([]*gitlab.Commit, error)
+	ListProjectMergeRequests(pid int, opt *gitlab.ListProjectMergeRequestsOptions) ([]*gitlab.MergeRequest, *gitlab.Response, error)
+	GetMergeRequestParticipants(pid, iid int) ([]*gitlab.BasicUser, error)
+	ListMergeRequestNotes(pid, iid int, opt *gitlab.ListMergeRequestNotesOptions) ([]*gitlab.Note, *gitlab.Response, error)
+	GetMergeRequestApprovals(pid, iid int) (*gitlab.MergeRequestApprovals, error)
+	// GetMergeRequestApprovalRules lists the approval rules that apply to the MR, with who is eligible to approve each
+	GetMergeRequestApprovalRules(pid, iid int) ([]*gitlab.MergeRequestApprovalRule, error)
+	ListPipelineJobs(pid, pipelineID int) ([]*gitlab.Job, error)
+	GetIssue(pid, iid int) (*gitlab.Issue, error)
+	ListProtectedBranches(pid int) ([]*gitlab.ProtectedBranch, error)
+	// GetRawFile is the file's contents at ref, or nil if it doesn't exist
+	GetRawFile(pid int, path, ref string) ([]byte, error)
+	// ListAllGroupMembers lists the group's members, including those inherited from its parent groups
+	ListAllGroupMembers(group string) ([]*gitlab.GroupMember, error)
+
+	UpdateMergeRequest(pid, iid int, opt *gitlab.UpdateMergeRequestOptions) (*gitlab.MergeRequest, error)
+	CreateMergeRequest(pid int, opt *gitlab.CreateMergeRequestOptions) (*gitlab.MergeRequest, error)
+	AcceptMergeRequest(pid, iid int, opt *gitlab.AcceptMergeRequestOptions) (*gitlab.MergeRequest, error)
+	CreateMergeRequestNote(pid, iid int, body string) (*gitlab.Note, error)
+	CreateIssue(pid int, opt *gitlab.CreateIssueOptions) (*gitlab.Issue, error)
+	CreateIssueNote(pid, iid int, body string) (*gitlab.Note, error)
+	// ApproveMergeRequest approves the MR as the given username, which requires an admin token.  An empty username approves as ourselves
+	ApproveMergeRequest(pid, iid int, sudo string) error
+	UnapproveMergeRequest(pid, iid int) error
+	// RebaseMergeRequest starts rebasing the MR's source branch onto its target in the background
+	RebaseMergeRequest(pid, iid int) error
+	// ResetMergeRequestApprovals clears every approval on the MR.  gitlab only allows this for bot users
+	ResetMergeRequestApprovals(pid, iid int) error
+	// SetResetApprovalsOnPush turns on the project's setting to clear approvals whenever new commits are pushed
+	SetResetApprovalsOnPush(pid int) error
+	CreateBranch(pid int, branch, ref string) (*gitlab.Branch, error)
+	DeleteBranch(pid int, branch string) error
+	AddProjectHook(pid int, opt *gitlab.AddProjectHookOptions) (*gitlab.ProjectHook, error)
+	// CreateRelease creates the release, and its tag if it doesn't exist yet
+	CreateRelease(pid int, opt *gitlab.CreateReleaseOptions) (*gitlab.Release, error)
+	RevertCommit(pid int, sha, branch string) (*gitlab.Commit, error)
+	CherryPickCommit(pid int, sha, branch string) (*gitlab.Commit, error)
+	// SaveFile commits the file's new contents to the branch, creating the file if create is set
+	SaveFile(pid int, path, branch, content, message string, create bool) error
+}
+
+// gitlabClient implements GitLabAPI against a real gitlab instance
+type gitlabClient struct {
+	*gitlab.Client
+	// oauth is set when the client authenticates as an OAuth application
+	oauth *gitlabOAuth
+}
+
+func (gl gitlabClient) GetUser(id int) (*gitlab.User, error) {
+	user, _, err := gl.Users.GetUser(id, gitlab.GetUsersOptions{})
+	return user, err
+}
+
+func (gl gitlabClient) CurrentUser() (*gitlab.User, error) {
+	user, _, err := gl.Users.CurrentUser()
+	return user, err
+}
+
+func (gl gitlabClient) Version() (*gitlab.Version, error) {
+	v, _, err := gl.Client.Version.GetVersion()
+	return v, err
+}
+
+func (gl gitlabClient) TokenExpiry() (*time.Time, error) {
+	if gl.oauth != nil {
+		// access tokens are renewed before they expire, so it only stops working if the authorization is revoked
+		return nil, gl.oauth.authorized()
+	}
+	// go-gitlab doesn't know about this endpoint yet
+	req, err := gl.NewRequest(http.MethodGet, "personal_access_tokens/self", nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	var token struct {
+		ExpiresAt *gitlab.ISOTime `json:"expires_at"`
+	}
+	if _, err := gl.Do(req, &token); err != nil {
+		return nil, err
+	}
+	if token.ExpiresAt == nil {
+		return nil, nil
+	}
+	expires := time.Time(*token.ExpiresAt)
+	return &expires, nil
+}
+
+func (gl gitlabClient) ListUsers(opt *gitlab.ListUsersOptions) ([]*gitlab.User, error) {
+	users, _, err := gl.Users.ListUsers(opt)
+	return users, err
+}
+
+func (gl gitlabClient) GetUserLocalTime(id int) (string, error) {
+	// go-gitlab's User doesn't have this field yet
+	req, err := gl.NewRequest(http.MethodGet, fmt.Sprintf("users/%d", id), nil, nil)
+	if err != nil {
+		return "", err
+	}
+	var user struct {
+		LocalTime string `json:"local_time"`
+	}
+	if _, err := gl.Do(req, &user); err != nil {
+		return "", err
+	}
+	return user.LocalTime, nil
+}
+
+func (gl gitlabClient) GetUserStatus(id int) (*gitlab.UserStatus, error) {
+	status, _, err := gl.Users.GetUserStatus(id)
+	return status, err
+}
+
+func (gl gitlabClient) GetProjectByPath(path string) (*gitlab.Project, error) {
+	p, _, err := gl.Projects.GetProject(path, nil)
+	return p, err
+}
+
+func (gl gitlabClient) ListProjectMembers(pid int, opt *gitlab.ListProjectMembersOptions) ([]*gitlab.ProjectMember, *gitlab.Response, error) {
+	return gl.ProjectMembers.ListProjectMembers(pid, opt)
+}
+
+func (gl gitlabClient) GetProject(pid int) (*gitlab.Project, error) {
+	p, _, err := gl.Projects.GetProject(pid, nil)
+	return p, err
+}
+
+func (gl gitlabClient) GetMergeRequest(pid, iid int) (*gitlab.MergeRequest, error) {
+	mr, _, err := gl.MergeRequests.GetMergeRequest(pid, iid, &gitlab.GetMergeRequestsOptions{IncludeDivergedCommitsCount: gitlab.Bool(true)})
+	return mr, err
+}
+
+func (gl gitlabClient) GetMergeRequestChanges(pid, iid int) (*gitlab.MergeRequest, error) {
+	mr, _, err := gl.MergeRequests.GetMergeRequestChanges(pid, iid, nil)
+	return mr, err
+}
+
+func (gl gitlabClient) ListProjectMergeRequests(pid int, opt *gitlab.ListProjectMergeRequestsOptions) ([]*gitlab.MergeRequest, *gitlab.Response, error) {
+	return gl.MergeRequests.ListProjectMergeRequests(pid, opt)
+}
+
+func (gl gitlabClient) GetMergeRequestParticipants(pid, iid int) ([]*gitlab.BasicUser, error) {
+	participants, _, err := gl.MergeRequests.GetMergeRequestParticipants(pid, iid)
+	return participants, err
+}
+
+func (gl gitlabClient) ListMergeRequestNotes(pid, iid int, opt *gitlab.ListMergeRequestNotesOptions) ([]*gitlab.Note, *gitlab.Response, error) {
+	return gl.Notes.ListMergeRequestNotes(pid, iid, opt)
+}
+
+func (gl gitlabClient) GetMergeRequestApprovals(pid, iid int) (*gitlab.MergeRequestApprovals, error) {
+	approvals, _, err := gl.MergeRequestApprovals.GetConfiguration(pid, iid)
+	return approvals, err
+}
+
+func (gl gitlabClient) GetMergeRequestApprovalRules(pid, iid int) ([]*gitlab.MergeRequestApprovalRule, error) {
+	rules, _, err := gl.MergeRequestApprovals.GetApprovalRules(pid, iid)
+	return rules, err
+}
+
+func (gl gitlabClient) ListPipelineJobs(pid, pipelineID int) ([]*gitlab.Job, error) {
+	var jobs []*gitlab.Job
+	opt := &gitlab.ListJobsOptions{ListOptions: gitlab.ListOptions{PerPage: 100}}
+	for {
+		page, resp, err := gl.Jobs.ListPipelineJobs(pid, pipelineID, opt)
+		if err != nil {
+			return nil, err
+		}
+		jobs = append(jobs, page...)
+		if resp.NextPage == 0 {
+			return jobs, nil
+		}
+		opt.Page = resp.NextPage
+	}
+}
+
+func (gl gitlabClient) ListMergeRequestCommits(pid, iid int) ([]*gitlab.Commit, error) {
+	var commits []*gitlab.Commit
+	opt := &gitlab.GetMergeRequestCommitsOptions{PerPage: 100}
+	for {
+		page, resp, err := gl.MergeRequests.GetMergeRequestCommits(pid, iid, opt)
+		if err != nil {
+			return nil, err
+		}
+		commits = append(commits, page...)
+		if resp.NextPage == 0 {
+			return commits, nil
+		}
+		opt.Page = resp.NextPage
+	}
+}
+
+func (gl gitlabClient) ListAllGroupMembers(group string) ([]*gitlab.GroupMember, error) {
+	var members []*gitlab.GroupMember
+	opt := &gitlab.ListGroupMembersOptions{ListOptions: gitlab.ListOptions{PerPage: 100}}
+	for {
+		page, resp, err := gl.Groups.ListAllGroupMembers(group, opt)
+		if err != nil {
+			return nil, err
+		}
+		members = append(members, page...)
+		if resp.NextPage == 0 {
+			return members, nil
+		}
+		opt.Page = resp.NextPage
+	}
+}
+
+func (gl gitlabClient) GetIssue(pid, iid int) (*gitlab.Issue, error) {
+	issue, _, err := gl.Issues.GetIssue(pid, iid)
+	return issue, err
+}
+
+func (gl gitlabClient) ListProtectedBranches(pid int) ([]*gitlab.ProtectedBranch, error) {
+	branches, _, err := gl.ProtectedBranches.ListProtectedBranches(pid, &gitlab.ListProtectedBranchesOptions{PerPage: 100})
+	return branches, err
+}
+
+func (gl gitlabClient) GetRawFile(pid int, path, ref string) ([]byte, error) {
+	b, resp, err := gl.RepositoryFiles.GetRawFile(pid, path, &gitlab.GetRawFileOptions{Ref: &ref})
+	if resp != nil && resp.StatusCode == http.StatusNotFound {
+		return nil, nil
+	}
+	return b, err
+}
+
+func (gl gitlabClient) UpdateMergeRequest(pid, iid int, opt *gitlab.UpdateMergeRequestOptions) (*gitlab.MergeRequest, error) {
+	mr, _, err := gl.MergeRequests.UpdateMergeRequest(pid, iid, opt)
+	return mr, err
+}
+
+func (gl gitlabClient) CreateMergeRequest(pid int, opt *gitlab.CreateMergeRequestOptions) (*gitlab.MergeRequest, error) {
+	mr, _, err := gl.MergeRequests.CreateMergeRequest(pid, opt)
+	return mr, err
+}
+
+func (gl gitlabClient) AcceptMergeRequest(pid, iid int, opt *gitlab.AcceptMergeRequestOptions) (*gitlab.MergeRequest, error) {
+	mr, _, err := gl.MergeRequests.AcceptMergeRequest(pid, iid, opt)
+	return mr, err
+}
+
+func (gl gitlabClient) CreateMergeRequestNote(pid, iid int, body string) (*gitlab.Note, error) {
+	note, _, err := gl.Notes.CreateMergeRequestNote(pid, iid, &gitlab.CreateMergeRequestNoteOptions{Body: &body})
+	return note, err
+}
+
+func (gl gitlabClient) CreateIssue(pid int, opt *gitlab.CreateIssueOptions) (*gitlab.Issue, error) {
+	issue, _, err := gl.Issues.CreateIssue(pid, opt)
+	return issue, err
+}
+
+func (gl gitlabClient) CreateIssueNote(pid, iid int, body string) (*gitlab.Note, error) {
+	note, _, err := gl.Notes.CreateIssueNote(pid, iid, &gitlab.CreateIssueNoteOptions{Body: &body})
+	return note, err
+}
+
+func (gl gitlabClient) ApproveMergeRequest(pid, iid int, sudo string) error {
+	var options []gitlab.RequestOptionFunc
+	if sudo != "" {
+		options = append(options, gitlab.WithSudo(sudo))
+	}
+	_, _, err := gl.MergeRequestApprovals.ApproveMergeRequest(pid, iid, nil, options...)
+	return err
+}
+
+func (gl gitlabClient) UnapproveMergeRequest(pid, iid int) error {
+	_, err := gl.MergeRequestApprovals.UnapproveMergeRequest(pid, iid)
+	return err
+}
+
+func (gl gitlabClient) RebaseMergeRequest(pid, iid int) error {
+	// go-gitlab's wrapper for this has changed shape between versions
+	req, err := gl.NewRequest(http.MethodPut, fmt.Sprintf("projects/%d/merge_requests/%d/rebase", pid, iid), nil, nil)
+	if err != nil {
+		return err
+	}
+	_, err = gl.Do(req, nil)
+	return err
+}
+
+func (gl gitlabClient) ResetMergeRequestApprovals(pid, iid int) error {
+	// go-gitlab doesn't wrap this one yet
+	req, err := gl.NewRequest(http.MethodPut, fmt.Sprintf("projects/%d/merge_requests/%d/reset_approvals", pid, iid), nil, nil)
+	if err != nil {
+		return err
+	}
+	_, err = gl.Do(req, nil)
+	return err
+}
+
+func (gl gitlabClient) SetResetApprovalsOnPush(pid int) error {
+	_, _, err := gl.Projects.ChangeApprovalConfiguration(pid, &gitlab.ChangeApprovalConfigurationOptions{ResetApprovalsOnPush: gitlab.Bool(true)})
+	return err
+}
+
+func (gl gitlabClient) CreateRelease(pid int, opt *gitlab.CreateReleaseOptions) (*gitlab.Release, error) {
+	release, _, err := gl.Releases.CreateRelease(pid, opt)
+	return release, err
+}
+
+func (gl gitlabClient) AddProjectHook(pid int, opt *gitlab.AddProjectHookOptions) (*gitlab.ProjectHook, error) {
+	hook, _, err := gl.Projects.AddProjectHook(pid, opt)
+	return hook, err
+}
+
+func (gl gitlabClient) CreateBranch(pid int, branch, ref string) (*gitlab.Branch, error) {
+	b, _, err := gl.Branches.CreateBranch(pid, &gitlab.CreateBranchOptions{Branch: &branch, Ref: &ref})
+	return b, err
+}
+
+func (gl gitlabClient) DeleteBranch(pid int, branch string) error {
+	_, err := gl.Branches.DeleteBranch(pid, branch)
+	return err
+}
+
+func (gl gitlabClient) RevertCommit(pid int, sha, branch string) (*gitlab.Commit, error) {
+	commit, _, err := gl.Commits.RevertCommit(pid, sha, &gitlab.RevertCommitOptions{Branch: &branch})
+	return commit, err
+}
+
+func (gl gitlabClient) CherryPickCommit(pid int, sha, branch string) (*gitlab.Commit, error) {
+	commit, _, err := gl.Commits.CherryPickCommit(pid, sha, &gitlab.CherryPickCommitOptions{Branch: &branch})
+	return commit, err
+}
+
+func (gl gitlabClient) SaveFile(pid int, path, branch, content, message string, create bool) error {
+	var err error
+	if create {
+		_, _, err = gl.RepositoryFiles.CreateFile(pid, path, &gitlab.CreateFileOptions{Branch: &branch, Content: &content, CommitMessage: &message})
+	} else {
+		_, _, err = gl.RepositoryFiles.UpdateFile(pid, path, &gitlab.UpdateFileOptions{Branch: &branch, Content: &content, CommitMessage: &message})
+	}
+	return err
+}
+
+// dryRunGitLab passes reads through to the wrapped API, and logs writes instead of performing them.
+// writes return empty (non-nil) results so callers carry on as if they'd succeeded
+type dryRunGitLab struct {
+	GitLabAPI
+}
+
+func (gl dryRunGitLab) UpdateMergeRequest(pid, iid int, opt *gitlab.UpdateMergeRequestOptions) (*gitlab.MergeRequest, error) {
+	logrus.Infof("dry run: would update merge request !%d in project %d with %s", iid, pid, gitlab.Stringify(opt))
+	return &gitlab.MergeRequest{ProjectID: pid, IID: iid}, nil
+}
+
+func (gl dryRunGitLab) CreateMergeRequest(pid int, opt *gitlab.CreateMergeRequestOptions) (*gitlab.MergeRequest, error) {
+	logrus.Infof("dry run: would create merge request in project %d with %s", pid, gitlab.Stringify(opt))
+	return &gitlab.MergeRequest{ProjectID: pid}, nil
+}
+
+func (gl dryRunGitLab) AcceptMergeRequest(pid, iid int, opt *gitlab.AcceptMergeRequestOptions) (*gitlab.MergeRequest, error) {
+	logrus.Infof("dry run: would merge merge request !%d in project %d", iid, pid)
+	return &gitlab.MergeRequest{ProjectID: pid, IID: iid}, nil
+}
+
+func (gl dryRunGitLab) CreateMergeRequestNote(pid, iid int, body string) (*gitlab.Note, error) {
+	logrus.Infof("dry run: would comment on merge request !%d in project %d: %s", iid, pid, body)
+	return &gitlab.Note{Body: body}, nil
+}
+
+func (gl dryRunGitLab) CreateIssue(pid int, opt *gitlab.CreateIssueOptions) (*gitlab.Issue, error) {
+	logrus.Infof("dry run: would create issue in project %d: %s", pid, *opt.Title)
+	return &gitlab.Issue{ProjectID: pid, Title: *opt.Title}, nil
+}
+
+func (gl dryRunGitLab) CreateIssueNote(pid, iid int, body string) (*gitlab.Note, error) {
+	logrus.Infof("dry run: would comment on issue #%d in project %d: %s", iid, pid, body)
+	return &gitlab.Note{Body: body}, nil
+}
+
+func (gl dryRunGitLab) ApproveMergeRequest(pid, iid int, sudo string) error {
+	logrus.Infof("dry run: would approve merge request !%d in project %d as '%s'", iid, pid, sudo)
+	return nil
+}
+
+func (gl dryRunGitLab) UnapproveMergeRequest(pid, iid int) error {
+	logrus.Infof("dry run: would remove our approval from merge request !%d in project %d", iid, pid)
+	return nil
+}
+
+func (gl dryRunGitLab) RebaseMergeRequest(pid, iid int) error {
+	logrus.Infof("dry run: would rebase merge request !%d in project %d", iid, pid)
+	return nil
+}
+
+func (gl dryRunGitLab) ResetMergeRequestApprovals(pid, iid int) error {
+	logrus.Infof("dry run: would reset all approvals on merge request !%d in project %d", iid, pid)
+	return nil
+}
+
+func (gl dryRunGitLab) SetResetApprovalsOnPush(pid int) error {
+	logrus.Infof("dry run: would enable reset approvals on push for project %d", pid)
+	return nil
+}
+
+func (gl dryRunGitLab) CreateRelease(pid int, opt *gitlab.CreateReleaseOptions) (*gitlab.Release, error) {
+	logrus.Infof("dry run: would create release %s in project %d", *opt.TagName, pid)
+	return &gitlab.Release{TagName: *opt.TagName, Name: *opt.Name}, nil
+}
+
+func (gl dryRunGitLab) AddProjectHook(pid int, opt *gitlab.AddProjectHookOptions) (*gitlab.ProjectHook, error) {
+	logrus.Infof("dry run: would add a webhook to project %d for %s", pid, *opt.URL)
+	return &gitlab.ProjectHook{ProjectID: pid}, nil
+}
+
+func (gl dryRunGitLab) CreateBranch(pid int, branch, ref string) (*gitlab.Branch, error) {
+	logrus.Infof("dry run: would create branch %s from %s in project %d", branch, ref, pid)
+	return &gitlab.Branch{Name: branch}, nil
+}
+
+func (gl dryRunGitLab) DeleteBranch(pid int, branch string) error {
+	logrus.Infof("dry run: would delete branch %s in project %d", branch, pid)
+	return nil
+}
+
+func (gl dryRunGitLab) RevertCommit(pid int, sha, branch string) (*gitlab.Commit, error) {
+	logrus.Infof("dry run: would revert %s onto branch %s in project %d", sha, branch, pid)
+	return &gitlab.Commit{}, nil
+}
+
+func (gl dryRunGitLab) CherryPickCommit(pid int, sha, branch string) (*gitlab.Commit, error) {
+	logrus.Infof("dry run: would cherry-pick %s onto branch %s in project %d", sha, branch, pid)
+	return &gitlab.Commit{}, nil
+}
+
+func (gl dryRunGitLab) SaveFile(pid int, path, branch, content, message string, create bool) error {
+	logrus.Infof("dry run: would commit %s to branch %s in project %d: %s", path, branch, pid, message)
+	return nil
+}
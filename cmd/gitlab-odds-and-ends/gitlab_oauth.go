@@ -0,0 +1,224 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/raidancampbell/gitlab-odds-and-ends/internal/store"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/oauth2"
+)
+
+const (
+	GITLAB_OAUTH_CLIENT_ID_ENV_VAR     = "GITLAB_OAUTH_CLIENT_ID"
+	GITLAB_OAUTH_CLIENT_SECRET_ENV_VAR = "GITLAB_OAUTH_CLIENT_SECRET"
+	GITLAB_OAUTH_REDIRECT_URL_ENV_VAR  = "GITLAB_OAUTH_REDIRECT_URL"
+	GITLAB_OAUTH_STORE_KEY             = "gitlab_oauth_token"
+	GITLAB_OAUTH_SCOPE                 = "api"
+	// GITLAB_OAUTH_RENEW_BEFORE is how long before it expires an access token is renewed
+	GITLAB_OAUTH_RENEW_BEFORE = 15 * time.Minute
+	// GITLAB_OAUTH_RENEW_INTERVAL is how often the token is checked, so it's renewed even while the bot is idle
+	GITLAB_OAUTH_RENEW_INTERVAL = 5 * time.Minute
+	// GITLAB_OAUTH_STATE_TTL is how long an admin has to finish authorizing the application
+	GITLAB_OAUTH_STATE_TTL = 10 * time.Minute
+)
+
+// gitlabOAuth authenticates the bot as a gitlab OAuth application instead of with a personal access token.  an admin
+// authorizes it once at `/gitlab/oauth/authorize` on the admin listener, signed in to gitlab as the user the bot should
+// act as.  gitlab replaces the refresh token every time it's used, so the latest one is kept in the store
+type gitlabOAuth struct {
+	cfg *oauth2.Config
+	// client talks to gitlab's token endpoint
+	client *http.Client
+	store  *store.Store
+
+	mu    sync.Mutex
+	token *oauth2.Token
+	// states are the authorizations in progress, and when they were started
+	states map[string]time.Time
+}
+
+// newGitLabOAuth returns nil when the instance has no OAuth application
+func newGitLabOAuth(inst instanceConfig, client *http.Client, s *store.Store) (*gitlabOAuth, error) {
+	clientID := os.Getenv(inst.OAuthClientIDEnv)
+	if clientID == "" {
+		return nil, nil
+	}
+	redirect := os.Getenv(GITLAB_OAUTH_REDIRECT_URL_ENV_VAR)
+	if redirect == "" {
+		return nil, fmt.Errorf("%s is needed for the OAuth application's redirect URI", GITLAB_OAUTH_REDIRECT_URL_ENV_VAR)
+	}
+	web := strings.TrimSuffix(strings.TrimSuffix(inst.URL, "/"), "/api/v4")
+	o := &gitlabOAuth{
+		cfg: &oauth2.Config{
+			ClientID:     clientID,
+			ClientSecret: os.Getenv(inst.OAuthClientSecretEnv),
+			Endpoint:     oauth2.Endpoint{AuthURL: web + "/oauth/authorize", TokenURL: web + "/oauth/token"},
+			RedirectURL:  redirect,
+			Scopes:       []string{GITLAB_OAUTH_SCOPE},
+		},
+		client: client,
+		store:  s,
+		states: make(map[string]time.Time),
+	}
+	if _, err := s.Load(GITLAB_OAUTH_STORE_KEY, &o.token); err != nil {
+		return nil, err
+	}
+	s.Follow(GITLAB_OAUTH_STORE_KEY, &o.token, &o.mu)
+	if o.token == nil {
+		logrus.Warnf("the gitlab OAuth application for %s isn't authorized yet, visit /gitlab/oauth/authorize on the admin listener", web)
+	}
+	return o, nil
+}
+
+// httpClient is base with the OAuth access token added to its requests
+func (o *gitlabOAuth) httpClient(base *http.Client) *http.Client {
+	return &http.Client{Transport: &oauth2.Transport{Source: o, Base: base.Transport}, Timeout: base.Timeout}
+}
+
+// Token is the current access token, renewed first if it's about to expire
+func (o *gitlabOAuth) Token() (*oauth2.Token, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.token == nil || o.token.RefreshToken == "" {
+		return nil, errors.New("the gitlab OAuth application isn't authorized")
+	}
+	if o.token.Expiry.IsZero() || time.Until(o.token.Expiry) > GITLAB_OAUTH_RENEW_BEFORE {
+		return o.token, nil
+	}
+	if o.store.ReadOnly() {
+		// renewing replaces the refresh token, which would leave the running bot with one that no longer works
+		if time.Now().Before(o.token.Expiry) {
+			return o.token, nil
+		}
+		return nil, errors.New("the gitlab OAuth token has expired, and is only renewed by the running bot")
+	}
+	// handing the token source only the refresh token makes it refresh
+	token, err := o.cfg.TokenSource(o.context(), &oauth2.Token{RefreshToken: o.token.RefreshToken}).Token()
+	if err != nil {
+		return nil, fmt.Errorf("failed to renew the gitlab OAuth token: %w", err)
+	}
+	o.save(token)
+	return token, nil
+}
+
+// renew is the scheduled job keeping the token fresh
+func (o *gitlabOAuth) renew() {
+	if _, err := o.Token(); err != nil {
+		logrus.WithError(err).Error("Failed to renew the gitlab OAuth token")
+	}
+}
+
+// authorized reports why the application can't be used, if it can't
+func (o *gitlabOAuth) authorized() error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.token == nil {
+		return errors.New("the gitlab OAuth application isn't authorized")
+	}
+	return nil
+}
+
+// authorizeURL starts an authorization, returning where to send the admin
+func (o *gitlabOAuth) authorizeURL() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	state := hex.EncodeToString(b)
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	for s, started := range o.states {
+		if time.Since(started) > GITLAB_OAUTH_STATE_TTL {
+			delete(o.states, s)
+		}
+	}
+	o.states[state] = time.Now()
+	return o.cfg.AuthCodeURL(state), nil
+}
+
+// takeState reports whether state is an authorization this application started, which can only be finished once
+func (o *gitlabOAuth) takeState(state string) bool {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	started, ok := o.states[state]
+	delete(o.states, state)
+	return ok && time.Since(started) <= GITLAB_OAUTH_STATE_TTL
+}
+
+// exchange finishes an authorization with the code gitlab redirected back with
+func (o *gitlabOAuth) exchange(code string) error {
+	token, err := o.cfg.Exchange(o.context(), code)
+	if err != nil {
+		return err
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.save(token)
+	return nil
+}
+
+// save keeps the token.  the caller holds the lock
+func (o *gitlabOAuth) save(token *oauth2.Token) {
+	o.token = token
+	if err := o.store.Save(GITLAB_OAUTH_STORE_KEY, token); err != nil {
+		// the old refresh token no longer works, so a restart now needs the application authorized again
+		logrus.WithError(err).Error("Failed to save the gitlab OAuth token")
+	}
+}
+
+// context has the token requests go through the gitlab HTTP client, and its proxy and CA settings
+func (o *gitlabOAuth) context() context.Context {
+	return context.WithValue(context.Background(), oauth2.HTTPClient, o.client)
+}
+
+// gitlabOAuthAuthorizeRouter sends an admin to gitlab to authorize the instance's OAuth application, see gitlabOAuth
+func (bot bot) gitlabOAuthAuthorizeRouter(c *gin.Context) {
+	target, _ := bot.instances.get(c.Query(GITLAB_INSTANCE_QUERY_PARAM))
+	oauth := target.oauth
+	if oauth == nil {
+		http.Error(c.Writer, "no gitlab OAuth application is configured for that instance", http.StatusNotFound)
+		return
+	}
+	to, err := oauth.authorizeURL()
+	if err != nil {
+		logrus.WithError(err).Error("Failed to start gitlab OAuth authorization")
+		http.Error(c.Writer, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	c.Redirect(http.StatusFound, to)
+}
+
+// gitlabOAuthCallbackRouter is the OAuth application's redirect URI, GITLAB_OAUTH_REDIRECT_URL.  it has to be reachable
+// by the admin's browser, so it's served with the webhooks, and only accepts authorizations started by the admin endpoint
+func (bot bot) gitlabOAuthCallbackRouter(c *gin.Context) {
+	state, code := c.Query("state"), c.Query("code")
+	for _, target := range bot.instances.all() {
+		if target.oauth == nil || !target.oauth.takeState(state) {
+			continue
+		}
+		if err := target.oauth.exchange(code); err != nil {
+			logrus.WithError(err).Error("Failed to finish gitlab OAuth authorization")
+			http.Error(c.Writer, "gitlab didn't accept the authorization, try again", http.StatusBadGateway)
+			return
+		}
+		bot.audit.record(auditEntry{
+			Action:  "gitlab_oauth_authorize",
+			Actor:   "admin",
+			Target:  target.oauth.cfg.Endpoint.AuthURL,
+			Outcome: "the bot now authenticates with the OAuth application",
+		})
+		c.String(http.StatusOK, "The bot is authorized with gitlab, you can close this page.")
+		return
+	}
+	http.Error(c.Writer, "unknown or expired authorization, start again from /gitlab/oauth/authorize", http.StatusBadRequest)
+}
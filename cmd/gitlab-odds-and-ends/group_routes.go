@@ -0,0 +1,64 @@
+package main
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+// GITLAB_GROUP_QUERY_PARAM marks a group webhook, e.g. `/gitlab/callback?group=platform&slack-channel=C0123456789`.
+// a group webhook's slack-channel is only where the group's projects go when they have no route of their own
+const GITLAB_GROUP_QUERY_PARAM = "group"
+
+// groupConfig routes every project in a group, including its subgroups, that has no route of its own
+type groupConfig struct {
+	// Group is the group's full path, e.g. `platform` or `platform/infra`
+	Group string `yaml:"group"`
+	// Channels are where the group's projects go, the same as a project's
+	Channels []string `yaml:"channels"`
+}
+
+// groupRoutes are the configured groups, most specific first
+type groupRoutes []groupConfig
+
+func newGroupRoutes(groups []groupConfig) groupRoutes {
+	g := append(groupRoutes(nil), groups...)
+	sort.SliceStable(g, func(i, j int) bool { return len(g[i].Group) > len(g[j].Group) })
+	return g
+}
+
+// channelsFor returns the channels of the closest group the project is in
+func (g groupRoutes) channelsFor(project string) []string {
+	for _, group := range g {
+		if strings.HasPrefix(project, strings.TrimSuffix(group.Group, "/")+"/") {
+			return group.Channels
+		}
+	}
+	return nil
+}
+
+// route picks the channels for a webhook's project: the project's own route from the config file or its webhooks, then
+// its group's, then the group webhook's channels, and finally the default routes.  channels are the webhook's
+// slack-channel parameters, and group its group parameter, empty for project webhooks
+func (bot bot) route(project string, id int, channels []string, group string) []string {
+	if group == "" {
+		if routed := bot.routes.resolve(project, id, channels); len(routed) > 0 {
+			return routed
+		}
+	} else {
+		if !strings.HasPrefix(project, strings.TrimSuffix(group, "/")+"/") {
+			logrus.Warnf("group webhook for %s sent an event for %s, which isn't in it", group, project)
+		}
+		if routed := bot.routes.resolve(project, id, nil); len(routed) > 0 {
+			return routed
+		}
+	}
+	if groupChannels := bot.groupRoutes.channelsFor(project); len(groupChannels) > 0 {
+		return bot.routes.resolve(project, id, groupChannels)
+	}
+	if len(channels) > 0 {
+		return bot.routes.resolve(project, id, channels)
+	}
+	return bot.defaultRoute(project, id)
+}
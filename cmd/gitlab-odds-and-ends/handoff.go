@@ -0,0 +1,219 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/raidancampbell/gitlab-odds-and-ends/internal/store"
+	"github.com/sirupsen/logrus"
+	"github.com/slack-go/slack"
+	"github.com/xanzy/go-gitlab"
+)
+
+const (
+	SLACK_COMMAND_HANDOFF = "/handoff"
+	HANDOFFS_STORE_KEY    = "handoffs"
+	// HANDOFF_RETENTION is how far back reviewer load reports can account for handoffs
+	HANDOFF_RETENTION = 90 * 24 * time.Hour
+)
+
+// handoffComment is `/handoff @someone` on a line of its own in an MR comment
+var handoffComment = regexp.MustCompile(`(?m)^\s*/handoff\s+@([\w.\-]+)\s*$`)
+
+// handoffMention is the slack mention `/handoff <@U0123>` is given, `<@U0123|name>` in older clients
+var handoffMention = regexp.MustCompile(`^<@([^|>]+)(\|[^>]*)?>$`)
+
+// handoffRecord is a review passed from one maintainer to another
+type handoffRecord struct {
+	ProjectID int       `json:"project_id"`
+	Project   string    `json:"project"`
+	IID       int       `json:"iid"`
+	From      string    `json:"from"`
+	To        string    `json:"to"`
+	At        time.Time `json:"at"`
+}
+
+// handoffs remembers who passed which reviews on, so the reviewer load report still counts a handed off review for
+// whoever it was first assigned to.  otherwise they'd look like they got less work and be due more of it
+type handoffs struct {
+	store   *store.Store
+	mu      sync.Mutex
+	records []handoffRecord
+}
+
+func newHandoffs(s *store.Store) (*handoffs, error) {
+	h := &handoffs{store: s}
+	if _, err := s.Load(HANDOFFS_STORE_KEY, &h.records); err != nil {
+		return nil, err
+	}
+	s.Follow(HANDOFFS_STORE_KEY, &h.records, &h.mu)
+	return h, nil
+}
+
+func (h *handoffs) record(r handoffRecord) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.records = append(h.records, r)
+	kept := h.records[:0]
+	for _, r := range h.records {
+		if time.Since(r.At) < HANDOFF_RETENTION {
+			kept = append(kept, r)
+		}
+	}
+	h.records = kept
+	if err := h.store.Save(HANDOFFS_STORE_KEY, h.records); err != nil {
+		logrus.WithError(err).Error("failed to persist handoffs")
+	}
+}
+
+// since returns the project's handoffs since the time
+func (h *handoffs) since(project string, since time.Time) []handoffRecord {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	var records []handoffRecord
+	for _, r := range h.records {
+		if r.Project == project && r.At.After(since) {
+			records = append(records, r)
+		}
+	}
+	return records
+}
+
+// handoff reassigns the MR's review to another maintainer, tells its thread, and records it
+func (bot bot) handoff(projectID, iid int, to *gitlab.User, actor string) (string, error) {
+	mr, err := bot.gl.GetMergeRequest(projectID, iid)
+	if err != nil {
+		return "", err
+	}
+	if mr.State != "opened" {
+		return "", fmt.Errorf("!%d is %s, there's no review to hand off", mr.IID, mr.State)
+	}
+	if mr.Author != nil && mr.Author.ID == to.ID {
+		return "", fmt.Errorf("%s wrote !%d, they can't review it", to.Username, mr.IID)
+	}
+	maintainers, err := getProjectMaintainers(bot.gl, projectID)
+	if err != nil {
+		return "", err
+	}
+	isMaintainer := false
+	for _, m := range maintainers {
+		isMaintainer = isMaintainer || m.ID == to.ID
+	}
+	if !isMaintainer {
+		return "", fmt.Errorf("%s isn't a maintainer of this project", to.Username)
+	}
+
+	// whoever the bot gave the review to: the assignee, or the first reviewer when only reviewers are requested
+	mode := bot.assignModeFor(bot.policies.forProject(bot.gl, projectID))
+	var from *gitlab.BasicUser
+	if mode.assignee {
+		from = mr.Assignee
+	} else if len(mr.Reviewers) > 0 {
+		from = mr.Reviewers[0]
+	}
+	opts := &gitlab.UpdateMergeRequestOptions{}
+	if mode.assignee {
+		opts.AssigneeID = &to.ID
+	}
+	if mode.reviewer {
+		ids := []int{to.ID}
+		for _, r := range mr.Reviewers {
+			if r.ID != to.ID && (from == nil || r.ID != from.ID) {
+				ids = append(ids, r.ID)
+			}
+		}
+		opts.ReviewerIDs = &ids
+	}
+	if _, err := bot.gl.UpdateMergeRequest(projectID, iid, opts); err != nil {
+		return "", err
+	}
+
+	fromName, fromUsername := "nobody", ""
+	if from != nil {
+		fromName, fromUsername = from.Name, from.Username
+	}
+	link, _ := parseGitlabLink(mr.WebURL)
+	bot.handoffs.record(handoffRecord{ProjectID: projectID, Project: link.project, IID: iid, From: fromUsername, To: to.Username, At: time.Now()})
+	bot.audit.record(auditEntry{
+		Action:  "handoff",
+		Actor:   actor,
+		Target:  fmt.Sprintf("%s!%d", link.project, iid),
+		Outcome: fmt.Sprintf("review handed from %s to %s", fromName, to.Username),
+	})
+
+	who := to.Name
+	if slackID, err := bot.users.slackUser(to.Username); err == nil {
+		who = fmt.Sprintf("<@%s>", slackID)
+	}
+	msg := tr(":handshake: the review of <%s|!%d %s> was handed off from %s to %s", mr.WebURL, mr.IID, mr.Title, fromName, who)
+	bot.notifyThreadLocalized(projectID, iid, msg, bot.routes.channelsFor(link.project))
+	return bot.locales.render("", msg), nil
+}
+
+// handoffTarget resolves `<@U0123|name>` (a slack mention) or `@username` (a gitlab username) to a gitlab user
+func (bot bot) handoffTarget(mention string) (*gitlab.User, error) {
+	if m := handoffMention.FindStringSubmatch(mention); m != nil {
+		return bot.users.gitlabUser(m[1])
+	}
+	username := strings.TrimPrefix(mention, "@")
+	users, err := bot.gl.ListUsers(&gitlab.ListUsersOptions{Username: &username})
+	if err != nil {
+		return nil, err
+	}
+	if len(users) != 1 {
+		return nil, fmt.Errorf("there's no gitlab user named %s", username)
+	}
+	return users[0], nil
+}
+
+// handoffCommand handles `/handoff <mr-url> @someone`
+func (bot bot) handoffCommand(cmd slack.SlashCommand) *slack.Msg {
+	args := strings.Fields(cmd.Text)
+	if len(args) != 2 {
+		return ephemeral("usage: `/handoff <merge request URL> @someone`")
+	}
+	link, ok := parseGitlabLink(strings.Trim(args[0], "<>"))
+	if !ok || link.kind != "merge_requests" {
+		return ephemeral(fmt.Sprintf("%s isn't a merge request link", args[0]))
+	}
+	to, err := bot.handoffTarget(args[1])
+	if err != nil {
+		return ephemeral(fmt.Sprintf("I don't know who %s is on gitlab: %v", args[1], err))
+	}
+	projectID, err := bot.routes.projectID(bot.gl, link.project)
+	if err != nil {
+		return ephemeral(fmt.Sprintf("I couldn't find %s on gitlab", link.project))
+	}
+	msg, err := bot.handoff(projectID, link.iid, to, "slack:"+cmd.UserID)
+	if err != nil {
+		return ephemeral("I couldn't hand it off: " + err.Error())
+	}
+	return ephemeral(msg)
+}
+
+// handoffFromComment handles `/handoff @someone` commented on an MR.  only its assignee or reviewers can hand it off
+func (bot bot) handoffFromComment(ev *gitlab.MergeCommentEvent, username string) {
+	mr, err := bot.gl.GetMergeRequest(ev.ProjectID, ev.MergeRequest.IID)
+	if err != nil {
+		logrus.WithError(err).Errorf("failed to look up merge request !%d for handoff", ev.MergeRequest.IID)
+		return
+	}
+	allowed := mr.Assignee != nil && mr.Assignee.Username == ev.User.Username
+	for _, r := range mr.Reviewers {
+		allowed = allowed || r.Username == ev.User.Username
+	}
+	if !allowed {
+		bot.commentOn(ev.ProjectID, mr.IID, fmt.Sprintf("@%s only the assignee or a reviewer can hand off this review.", ev.User.Username))
+		return
+	}
+	to, err := bot.handoffTarget("@" + username)
+	if err == nil {
+		_, err = bot.handoff(ev.ProjectID, mr.IID, to, "gitlab:"+ev.User.Username)
+	}
+	if err != nil {
+		bot.commentOn(ev.ProjectID, mr.IID, fmt.Sprintf("@%s I couldn't hand this review off: %v", ev.User.Username, err))
+	}
+}
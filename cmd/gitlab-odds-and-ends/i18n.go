@@ -0,0 +1,176 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+
+	"github.com/raidancampbell/gitlab-odds-and-ends/internal/config"
+	"github.com/sirupsen/logrus"
+	"github.com/slack-go/slack"
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	DEFAULT_LOCALE     = "en"
+	DEFAULT_LOCALE_DIR = "locales"
+)
+
+// localesConfig picks the language of each channel's messages.  a catalog is a YAML file named `<locale>.yaml` mapping
+// messages as written in english (format verbs and all) to their translation, e.g.
+//
+//	":hourglass: <%s|!%d %s> hasn't been reviewed in %s.": ":hourglass: <%s|!%d %s> wartet seit %s auf ein Review."
+//
+// translations can reorder the arguments with `%[2]s`.  messages without a translation stay in english
+type localesConfig struct {
+	// Default is the locale of channels that don't have one, english by default
+	Default string `yaml:"default"`
+	// Dir is the directory of the catalogs.  relative to the config file, `locales` by default
+	Dir string `yaml:"dir"`
+	// Channels sets the locale of individual channels, over their projects' locale
+	Channels map[string]string `yaml:"channels"`
+}
+
+// localized is a message rendered in the locale of wherever it's sent.  make them with tr
+type localized struct {
+	format string
+	args   []interface{}
+}
+
+// tr marks the message for translation.  args that are themselves localized are rendered in the same locale
+func tr(format string, args ...interface{}) localized {
+	return localized{format: format, args: args}
+}
+
+// locales knows each channel's locale and the catalogs to translate into
+type locales struct {
+	fallback string
+	channels map[string]string            // channel -> locale
+	catalogs map[string]map[string]string // locale -> english -> translation
+}
+
+// newLocales loads the catalog of every locale in use.  configPath is the config file's.  a project's locale
+// applies to its channels; a channel shared by projects with different locales gets the first one
+func newLocales(cfg localesConfig, configPath string, projects []projectConfig) (*locales, error) {
+	l := &locales{fallback: cfg.Default, channels: make(map[string]string), catalogs: make(map[string]map[string]string)}
+	if l.fallback == "" {
+		l.fallback = DEFAULT_LOCALE
+	}
+	for _, p := range projects {
+		for _, channel := range p.Channels {
+			if _, ok := l.channels[channel]; !ok && p.Locale != "" {
+				l.channels[channel] = p.Locale
+			}
+		}
+	}
+	for channel, locale := range cfg.Channels {
+		l.channels[channel] = locale
+	}
+
+	dir := cfg.Dir
+	if dir == "" {
+		dir = DEFAULT_LOCALE_DIR
+	}
+	dir = config.Resolve(configPath, dir)
+	inUse := map[string]bool{l.fallback: true}
+	for _, locale := range l.channels {
+		inUse[locale] = true
+	}
+	for locale := range inUse {
+		if locale == DEFAULT_LOCALE {
+			continue
+		}
+		b, err := ioutil.ReadFile(filepath.Join(dir, locale+".yaml"))
+		if err != nil {
+			return nil, fmt.Errorf("loading the %s message catalog: %v", locale, err)
+		}
+		catalog := make(map[string]string)
+		if err := yaml.Unmarshal(b, &catalog); err != nil {
+			return nil, fmt.Errorf("parsing the %s message catalog: %v", locale, err)
+		}
+		l.catalogs[locale] = catalog
+		logrus.Infof("loaded %d %s translations", len(catalog), locale)
+	}
+	return l, nil
+}
+
+// locale is the channel's locale.  DMs and unknown channels are in the default one
+func (l *locales) locale(channel string) string {
+	if locale, ok := l.channels[channel]; ok {
+		return locale
+	}
+	return l.fallback
+}
+
+// render formats the message in the channel's locale
+func (l *locales) render(channel string, msg localized) string {
+	return l.sprintf(l.locale(channel), msg)
+}
+
+func (l *locales) sprintf(locale string, msg localized) string {
+	format := msg.format
+	if translated, ok := l.catalogs[locale][format]; ok && translated != "" {
+		format = translated
+	}
+	args := make([]interface{}, len(msg.args))
+	for i, arg := range msg.args {
+		if nested, ok := arg.(localized); ok {
+			arg = l.sprintf(locale, nested)
+		}
+		args[i] = arg
+	}
+	return fmt.Sprintf(format, args...)
+}
+
+// notifyLocalized is notify with each channel getting the message in its locale
+func (bot bot) notifyLocalized(msg localized, slackChans []string) []slackMessage {
+	return bot.notifyBlocksLocalized(msg, nil, slackChans)
+}
+
+// notifyBlocksLocalized is notifyBlocks with each channel getting the message in its locale.  blocks lays out the
+// rendered message, e.g. with buttons; without it the message is sent as plain text
+func (bot bot) notifyBlocksLocalized(msg localized, blocks func(text string) []slack.Block, slackChans []string) []slackMessage {
+	var sent []slackMessage
+	byText := make(map[string][]string)
+	var texts []string // in the order first seen, so channels are notified in order
+	for _, slackChan := range slackChans {
+		text := bot.locales.render(slackChan, msg)
+		if _, ok := byText[text]; !ok {
+			texts = append(texts, text)
+		}
+		byText[text] = append(byText[text], slackChan)
+	}
+	for _, text := range texts {
+		if blocks == nil {
+			sent = append(sent, bot.notify(text, byText[text])...)
+		} else {
+			sent = append(sent, bot.notifyBlocks(text, blocks(text), byText[text])...)
+		}
+	}
+	return sent
+}
+
+// notifyThreadLocalized is notifyThread with each thread getting the message in its channel's locale
+func (bot bot) notifyThreadLocalized(projectID, iid int, msg localized, fallbackChans []string) {
+	if bot.debounce != nil && len(bot.threads.get(mrRef(projectID, iid))) > 0 {
+		bot.debounce.add(bot, mrRef(projectID, iid), msg)
+		return
+	}
+	bot.replyThreadsLocalized(mrRef(projectID, iid), msg, fallbackChans)
+}
+
+// replyThreadsLocalized is replyThreads with each thread getting the message in its channel's locale
+func (bot bot) replyThreadsLocalized(ref string, msg localized, fallbackChans []string) {
+	msgs := bot.threads.get(ref)
+	if len(msgs) == 0 {
+		bot.notifyLocalized(msg, fallbackChans)
+		return
+	}
+	for _, m := range msgs {
+		text := bot.locales.render(m.Channel, msg)
+		logrus.Info(text)
+		if _, err := bot.notifier.Reply(m.Channel, m.Timestamp, text); err != nil {
+			logrus.WithError(err).Errorf("failed to reply to slack thread %s in channel %s", m.Timestamp, m.Channel)
+		}
+	}
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/slack-go/slack"
+)
+
+const (
+	INCIDENT_SLACK_CHANNEL_ENV_VAR = "INCIDENT_SLACK_CHANNEL"
+	INCIDENT_ENVIRONMENTS_ENV_VAR  = "INCIDENT_ENVIRONMENTS"
+	SLACK_ADMIN_USERS_ENV_VAR      = "SLACK_ADMIN_USERS"
+	DEFAULT_INCIDENT_ENVIRONMENTS  = "production"
+)
+
+// incidentMode tracks which projects are mid-incident.  While a project is in incident mode its pipeline failures
+// and production deployments are escalated to the incident channel with an @here, on top of the usual routing.
+// projects are keyed by their path with namespace, e.g. `group/project`
+type incidentMode struct {
+	channel      string
+	environments map[string]bool
+	mu           sync.RWMutex
+	active       map[string]bool
+}
+
+// newIncidentMode escalates to the given slack channel.  environments is a comma separated list of environment
+// names whose deployments count as production
+func newIncidentMode(channel, environments string) *incidentMode {
+	envs := make(map[string]bool)
+	for _, env := range strings.Split(environments, ",") {
+		if env = strings.TrimSpace(env); env != "" {
+			envs[env] = true
+		}
+	}
+	return &incidentMode{
+		channel:      channel,
+		environments: envs,
+		active:       make(map[string]bool),
+	}
+}
+
+func (i *incidentMode) set(project string, on bool) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	if on {
+		i.active[project] = true
+	} else {
+		delete(i.active, project)
+	}
+}
+
+func (i *incidentMode) isActive(project string) bool {
+	if i == nil {
+		return false
+	}
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+	return i.active[project]
+}
+
+func (i *incidentMode) list() []string {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+	var projects []string
+	for p := range i.active {
+		projects = append(projects, p)
+	}
+	return projects
+}
+
+// escalate sends the message to the incident channel if the project is in incident mode
+func (bot bot) escalate(project string, msg localized) {
+	if !bot.incidents.isActive(project) {
+		return
+	}
+	bot.critical(CRITICAL_INCIDENT).notifyLocalized(tr("<!here> :rotating_light: %s", msg), []string{bot.incidents.channel})
+}
+
+// incidentCommand handles `/incident on|off|status [group/project]`
+func (bot bot) incidentCommand(cmd slack.SlashCommand) *slack.Msg {
+	if bot.incidents == nil {
+		return ephemeral(fmt.Sprintf("incident mode isn't configured, set %s to enable it", INCIDENT_SLACK_CHANNEL_ENV_VAR))
+	}
+
+	args := strings.Fields(cmd.Text)
+	if len(args) == 0 || args[0] == "status" {
+		active := bot.incidents.list()
+		if len(active) == 0 {
+			return ephemeral("no projects are in incident mode")
+		}
+		return ephemeral("in incident mode: `" + strings.Join(active, "`, `") + "`")
+	}
+	if len(args) != 2 || (args[0] != "on" && args[0] != "off") {
+		return ephemeral("usage: `/incident on|off group/project` or `/incident status`")
+	}
+	if !bot.isSlackAdmin(cmd.UserID) {
+		return ephemeral("only bot admins can change incident mode")
+	}
+
+	project := args[1]
+	on := args[0] == "on"
+	bot.incidents.set(project, on)
+	if on {
+		bot.notify(fmt.Sprintf("<@%s> put `%s` into incident mode.  Pipeline failures and production deployments will be escalated here until it's cleared.", cmd.UserID, project), []string{bot.incidents.channel})
+		return inChannel(fmt.Sprintf("`%s` is in incident mode, escalating to <#%s>", project, bot.incidents.channel))
+	}
+	bot.notify(fmt.Sprintf("<@%s> cleared incident mode for `%s`.", cmd.UserID, project), []string{bot.incidents.channel})
+	return inChannel(fmt.Sprintf("`%s` is back to normal notifications", project))
+}
+
+// isSlackAdmin reports whether the slack user may use admin commands.  if no admins are configured everyone is an admin
+func (bot bot) isSlackAdmin(userID string) bool {
+	if len(bot.slackAdmins) == 0 {
+		return true
+	}
+	return bot.slackAdmins[userID]
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+	"github.com/raidancampbell/gitlab-odds-and-ends/internal/webhook"
+)
+
+const (
+	GITLAB_INSTANCE_QUERY_PARAM = "instance"
+	HEADER_GITLAB_INSTANCE      = "X-Gitlab-Instance"
+	// INSTANCE_VALUE_SEPARATOR separates the instance from the rest of a button value.  git refs can't contain it
+	INSTANCE_VALUE_SEPARATOR = "~"
+)
+
+// instanceConfig is another gitlab the bot serves, as well as the one at GITLAB_BASE_URL.  its webhooks are told apart
+// by `instance=<name>` in their URL, or by the instance URL gitlab sends with them, or by their secret token
+type instanceConfig struct {
+	// Name identifies the instance in webhook URLs and the state file
+	Name string `yaml:"name"`
+	// URL is the instance's URL, e.g. `https://gitlab.example.com`
+	URL string `yaml:"url"`
+	// TokenEnv is the environment variable holding the instance's access token
+	TokenEnv string `yaml:"token_env"`
+	// WebhookSecretEnv is the environment variable holding its webhooks' secret token, if they have one
+	WebhookSecretEnv string `yaml:"webhook_secret_env"`
+	// OAuthClientIDEnv and OAuthClientSecretEnv hold the instance's OAuth application, to use instead of TokenEnv.  see gitlabOAuth
+	OAuthClientIDEnv     string `yaml:"oauth_client_id_env"`
+	OAuthClientSecretEnv string `yaml:"oauth_client_secret_env"`
+}
+
+// validateInstances checks the instances before any clients are made for them
+func validateInstances(cfgs []instanceConfig) error {
+	seen := make(map[string]bool)
+	for _, cfg := range cfgs {
+		switch {
+		case cfg.Name == "" || strings.Contains(cfg.Name, INSTANCE_VALUE_SEPARATOR) || strings.Contains(cfg.Name, "/"):
+			return fmt.Errorf("instance name %q must be non-empty without %q or '/'", cfg.Name, INSTANCE_VALUE_SEPARATOR)
+		case seen[cfg.Name]:
+			return fmt.Errorf("instance %q is configured twice", cfg.Name)
+		case cfg.URL == "":
+			return fmt.Errorf("instance %q has no url", cfg.Name)
+		case secretFromEnv(cfg.TokenEnv) == "" && os.Getenv(cfg.OAuthClientIDEnv) == "":
+			return fmt.Errorf("instance %q has no token in %q or OAuth application", cfg.Name, cfg.TokenEnv)
+		}
+		seen[cfg.Name] = true
+	}
+	return nil
+}
+
+// instances are the bots for each gitlab, the default one named "".  a config reload replaces them, so requests and
+// scheduled jobs look up their bot when they start instead of holding on to one
+type instances struct {
+	mu    sync.RWMutex
+	bots  map[string]bot
+	hosts map[string]string
+	// order is the instances' names, default first, for matching webhook secrets in a stable order
+	order []string
+}
+
+func newInstances() *instances {
+	return &instances{bots: make(map[string]bot), hosts: make(map[string]string)}
+}
+
+// add registers the bot for the instance at baseURL
+func (in *instances) add(name, baseURL string, b bot) {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	in.bots[name] = b
+	in.order = append(in.order, name)
+	if u, err := url.Parse(baseURL); err == nil && u.Host != "" {
+		in.hosts[strings.ToLower(u.Host)] = name
+	}
+}
+
+// get returns the instance's current bot
+func (in *instances) get(name string) (bot, bool) {
+	in.mu.RLock()
+	defer in.mu.RUnlock()
+	b, ok := in.bots[name]
+	return b, ok
+}
+
+// all returns every instance's current bot, default first
+func (in *instances) all() []bot {
+	in.mu.RLock()
+	defer in.mu.RUnlock()
+	var bots []bot
+	for _, name := range in.order {
+		bots = append(bots, in.bots[name])
+	}
+	return bots
+}
+
+// update replaces every instance's bot with what fn makes of it, all at once
+func (in *instances) update(fn func(b bot) bot) {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	for name, b := range in.bots {
+		in.bots[name] = fn(b)
+	}
+}
+
+// forRequest picks the bot for the instance that sent a gitlab webhook or system hook
+func (in *instances) forRequest(r *http.Request) bot {
+	if name := r.URL.Query().Get(GITLAB_INSTANCE_QUERY_PARAM); name != "" {
+		if b, ok := in.get(name); ok {
+			return b
+		}
+	}
+	if u, err := url.Parse(r.Header.Get(HEADER_GITLAB_INSTANCE)); err == nil && u.Host != "" {
+		in.mu.RLock()
+		name, ok := in.hosts[strings.ToLower(u.Host)]
+		in.mu.RUnlock()
+		if ok {
+			b, _ := in.get(name)
+			return b
+		}
+	}
+	if token := r.Header.Get(webhook.HEADER_GITLAB_TOKEN); token != "" {
+		for _, b := range in.all() {
+			if b.webhookAuth != nil && b.webhookAuth.Secret == token {
+				return b
+			}
+		}
+	}
+	b, _ := in.get("")
+	return b
+}
+
+// handle serves a gitlab request with the bot for the instance that sent it
+func (in *instances) handle(h func(bot, *gin.Context)) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		h(in.forRequest(c.Request).triggeredBy("gitlab:"+c.Request.URL.Path), c)
+	}
+}
+
+// serve serves a request with the instance's current bot
+func (in *instances) serve(name string, h func(bot, *gin.Context)) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		b, _ := in.get(name)
+		h(b.triggeredBy("request:"+c.Request.URL.Path), c)
+	}
+}
+
+// run makes the scheduled job that runs with the instance's current bot
+func (in *instances) run(name, jobName string, job func(bot)) func() {
+	return func() {
+		b, _ := in.get(name)
+		job(b.triggeredBy("schedule:" + jobName))
+	}
+}
+
+// forValue picks the bot for a button value made with instanceValue, and returns the rest of the value
+func (in *instances) forValue(value string) (bot, string) {
+	if i := strings.Index(value, INSTANCE_VALUE_SEPARATOR); i >= 0 {
+		if b, ok := in.get(value[:i]); ok {
+			return b, value[i+len(INSTANCE_VALUE_SEPARATOR):]
+		}
+	}
+	b, _ := in.get("")
+	return b, value
+}
+
+// instanceValue qualifies a button value with the instance it's about, see instances.forValue
+func instanceValue(instance, value string) string {
+	if instance == "" {
+		return value
+	}
+	return instance + INSTANCE_VALUE_SEPARATOR + value
+}
+
+// actionValue qualifies a button value with the bot's instance
+func (bot bot) actionValue(value string) string {
+	return instanceValue(bot.instance, value)
+}
+
+// jobName tells apart the scheduled jobs of each instance
+func (bot bot) jobName(name string) string {
+	if bot.instance == "" {
+		return name
+	}
+	return bot.instance + ": " + name
+}
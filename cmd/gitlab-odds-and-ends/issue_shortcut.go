@@ -0,0 +1,118 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+	"github.com/slack-go/slack"
+	"github.com/xanzy/go-gitlab"
+)
+
+const (
+	// CALLBACK_CREATE_ISSUE is both the message shortcut's callback ID and the modal's
+	CALLBACK_CREATE_ISSUE = "create_gitlab_issue"
+	BLOCK_ISSUE_PROJECT   = "issue_project"
+	BLOCK_ISSUE_TITLE     = "issue_title"
+	BLOCK_ISSUE_BODY      = "issue_description"
+	MAX_ISSUE_TITLE       = 80 // characters
+)
+
+// issueOrigin is the modal's private metadata: the message the issue is being created from
+type issueOrigin struct {
+	Channel   string `json:"channel"`
+	Timestamp string `json:"ts"`
+}
+
+// openIssueModal handles the "Create GitLab issue" message shortcut, prefilling a modal from the message.
+// the issue can go to any project routed to the message's channel
+func (bot bot) openIssueModal(callback slack.InteractionCallback) {
+	projects := bot.routes.projectsFor(callback.Channel.ID)
+	if len(projects) == 0 {
+		respond(callback, "no projects are mapped to this channel, so I don't know where to create the issue")
+		return
+	}
+	var options []*slack.OptionBlockObject
+	for _, p := range projects {
+		options = append(options, slack.NewOptionBlockObject(p, slack.NewTextBlockObject(slack.PlainTextType, p, false, false), nil))
+	}
+	projectSelect := slack.NewOptionsSelectBlockElement(slack.OptTypeStatic, slack.NewTextBlockObject(slack.PlainTextType, "Project", false, false), BLOCK_ISSUE_PROJECT, options...)
+	projectSelect.InitialOption = options[0]
+
+	text := callback.Message.Text
+	title := slack.NewPlainTextInputBlockElement(nil, BLOCK_ISSUE_TITLE)
+	title.InitialValue = issueTitle(text)
+	body := slack.NewPlainTextInputBlockElement(nil, BLOCK_ISSUE_BODY)
+	body.Multiline = true
+	body.InitialValue = text
+
+	metadata, _ := json.Marshal(issueOrigin{Channel: callback.Channel.ID, Timestamp: callback.Message.Timestamp})
+	view := slack.ModalViewRequest{
+		Type:            slack.VTModal,
+		CallbackID:      CALLBACK_CREATE_ISSUE,
+		PrivateMetadata: string(metadata),
+		Title:           slack.NewTextBlockObject(slack.PlainTextType, "Create GitLab issue", false, false),
+		Submit:          slack.NewTextBlockObject(slack.PlainTextType, "Create", false, false),
+		Close:           slack.NewTextBlockObject(slack.PlainTextType, "Cancel", false, false),
+		Blocks: slack.Blocks{BlockSet: []slack.Block{
+			slack.NewInputBlock(BLOCK_ISSUE_PROJECT, slack.NewTextBlockObject(slack.PlainTextType, "Project", false, false), nil, projectSelect),
+			slack.NewInputBlock(BLOCK_ISSUE_TITLE, slack.NewTextBlockObject(slack.PlainTextType, "Title", false, false), nil, title),
+			slack.NewInputBlock(BLOCK_ISSUE_BODY, slack.NewTextBlockObject(slack.PlainTextType, "Description", false, false), nil, body),
+		}},
+	}
+	if err := bot.notifier.OpenModal(callback.TriggerID, view); err != nil {
+		logrus.WithError(err).Error("failed to open the create issue modal")
+		respond(callback, "I couldn't open the issue form: "+err.Error())
+	}
+}
+
+// issueTitle is the first line of the message, shortened to fit a title.  it's cut between characters, never within one
+func issueTitle(text string) string {
+	title := strings.TrimSpace(strings.SplitN(text, "\n", 2)[0])
+	if runes := []rune(title); len(runes) > MAX_ISSUE_TITLE {
+		title = strings.TrimSpace(string(runes[:MAX_ISSUE_TITLE])) + "…"
+	}
+	return title
+}
+
+// createIssue handles the create issue modal's submission, replying in the original message's thread with the new issue
+func (bot bot) createIssue(callback slack.InteractionCallback) {
+	var origin issueOrigin
+	if err := json.Unmarshal([]byte(callback.View.PrivateMetadata), &origin); err != nil {
+		logrus.WithError(err).Error("Failed to parse create issue modal metadata")
+		return
+	}
+	if callback.View.State == nil {
+		logrus.Error("create issue modal was submitted without any values")
+		return
+	}
+	values := callback.View.State.Values
+	project := values[BLOCK_ISSUE_PROJECT][BLOCK_ISSUE_PROJECT].SelectedOption.Value
+	title := values[BLOCK_ISSUE_TITLE][BLOCK_ISSUE_TITLE].Value
+	description := values[BLOCK_ISSUE_BODY][BLOCK_ISSUE_BODY].Value
+	description += fmt.Sprintf("\n\n_Created from slack by %s._", callback.User.Name)
+
+	id, err := bot.routes.projectID(bot.gl, project)
+	if err != nil {
+		logrus.WithError(err).Errorf("failed to look up project %s", project)
+		bot.reply(origin, fmt.Sprintf("<@%s> I couldn't find `%s` to create your issue in.", callback.User.ID, project))
+		return
+	}
+	issue, err := bot.gl.CreateIssue(id, &gitlab.CreateIssueOptions{Title: &title, Description: &description})
+	if err != nil {
+		logrus.WithError(err).Errorf("failed to create issue in %s", project)
+		bot.reply(origin, fmt.Sprintf("<@%s> I couldn't create your issue in `%s`: %v", callback.User.ID, project, err))
+		return
+	}
+	bot.reply(origin, fmt.Sprintf("<@%s> created <%s|%s#%d %s>", callback.User.ID, issue.WebURL, project, issue.IID, issue.Title))
+	bot.linkIssue(id, issue.IID, slackMessage{origin.Channel, origin.Timestamp})
+}
+
+// reply posts to the thread of the message the issue was created from
+func (bot bot) reply(origin issueOrigin, msg string) {
+	logrus.Info(msg)
+	if _, err := bot.notifier.Reply(origin.Channel, origin.Timestamp, msg); err != nil {
+		logrus.WithError(err).Errorf("failed to reply to slack thread %s in channel %s", origin.Timestamp, origin.Channel)
+	}
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestIssueTitle(t *testing.T) {
+	tests := []struct {
+		name string
+		text string
+		want string
+	}{
+		{"first line", "  the build is broken \nsee the logs", "the build is broken"},
+		{"short enough", strings.Repeat("a", MAX_ISSUE_TITLE), strings.Repeat("a", MAX_ISSUE_TITLE)},
+		{"too long", strings.Repeat("a", MAX_ISSUE_TITLE+1), strings.Repeat("a", MAX_ISSUE_TITLE) + "…"},
+		{"multi-byte characters", strings.Repeat("é", MAX_ISSUE_TITLE+5), strings.Repeat("é", MAX_ISSUE_TITLE) + "…"},
+		{"emoji at the cut", strings.Repeat("a", MAX_ISSUE_TITLE-1) + "🔥🔥", strings.Repeat("a", MAX_ISSUE_TITLE-1) + "🔥…"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := issueTitle(tt.text)
+			if got != tt.want {
+				t.Errorf("issueTitle() = %q, want %q", got, tt.want)
+			}
+			if !utf8.ValidString(got) {
+				t.Errorf("issueTitle() = %q, which isn't valid UTF-8", got)
+			}
+		})
+	}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/raidancampbell/gitlab-odds-and-ends/internal/store"
+	"github.com/sirupsen/logrus"
+	"github.com/xanzy/go-gitlab"
+)
+
+const (
+	ISSUE_ACTION_UPDATED      = "update"
+	ISSUE_ACTION_CLOSED       = "close"
+	ISSUE_ACTION_REOPENED     = "reopen"
+	ISSUE_ASSIGNEES_STORE_KEY = "issue_assignees"
+)
+
+// issueRef is mrRef for issues, keeping issue threads apart from MR threads
+func issueRef(projectID, iid int) string {
+	return "issue:" + mrRef(projectID, iid)
+}
+
+// issueAssignees remembers each linked issue's assignees (keyed by issueRef), since issue webhooks don't say who
+// the issue used to be assigned to.  they're kept in the store, so reassignments are spotted across restarts and
+// replicas
+type issueAssignees struct {
+	store     *store.Store
+	mu        sync.Mutex
+	usernames map[string]string
+}
+
+func newIssueAssignees(s *store.Store) (*issueAssignees, error) {
+	a := &issueAssignees{store: s, usernames: make(map[string]string)}
+	if _, err := s.Load(ISSUE_ASSIGNEES_STORE_KEY, &a.usernames); err != nil {
+		return nil, err
+	}
+	s.Follow(ISSUE_ASSIGNEES_STORE_KEY, &a.usernames, &a.mu)
+	return a, nil
+}
+
+// update records the issue's assignees, returning whether they changed.  the first sighting isn't a change
+func (a *issueAssignees) update(ref string, usernames []string) bool {
+	sort.Strings(usernames)
+	current := strings.Join(usernames, ",")
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	previous, known := a.usernames[ref]
+	if known && previous == current {
+		return false
+	}
+	a.usernames[ref] = current
+	if err := a.store.Save(ISSUE_ASSIGNEES_STORE_KEY, a.usernames); err != nil {
+		logrus.WithError(err).Error("failed to persist issue assignees")
+	}
+	return known
+}
+
+// linkIssue ties a slack thread to the issue: the thread hears about the issue's state changes, and the issue gets a
+// comment pointing back at the thread.  linking the same message twice does nothing
+func (bot bot) linkIssue(projectID, iid int, msg slackMessage) {
+	ref := issueRef(projectID, iid)
+	for _, m := range bot.threads.get(ref) {
+		if m == msg {
+			return
+		}
+	}
+	bot.threads.record(ref, []slackMessage{msg})
+
+	if issue, err := bot.gl.GetIssue(projectID, iid); err != nil {
+		logrus.WithError(err).Errorf("failed to look up assignees of issue #%d", iid)
+	} else {
+		var usernames []string
+		for _, a := range issue.Assignees {
+			usernames = append(usernames, a.Username)
+		}
+		bot.issueAssignees.update(ref, usernames)
+	}
+
+	permalink, err := bot.notifier.Permalink(msg.Channel, msg.Timestamp)
+	if err != nil || permalink == "" {
+		logrus.WithError(err).Warnf("no permalink for slack message %s, not back-referencing issue #%d", msg.Timestamp, iid)
+		return
+	}
+	if _, err := bot.gl.CreateIssueNote(projectID, iid, fmt.Sprintf("Discussed in slack: %s", permalink)); err != nil {
+		logrus.WithError(err).Errorf("failed to back-reference slack thread on issue #%d", iid)
+	}
+}
+
+// issue receives an issue event, keeping linked slack threads up to date when the issue is assigned, closed, or reopened
+func (bot bot) issue(ev *gitlab.IssueEvent) {
+	logrus.Debugf("processing issue webhook %+v", ev)
+	ref := issueRef(ev.Project.ID, ev.ObjectAttributes.IID)
+	if len(bot.threads.get(ref)) == 0 {
+		return
+	}
+	link := fmt.Sprintf("<%s|%s#%d %s>", ev.ObjectAttributes.URL, ev.Project.PathWithNamespace, ev.ObjectAttributes.IID, ev.ObjectAttributes.Title)
+
+	var usernames, names []string
+	var assignees []gitlab.EventUser
+	if ev.Assignees != nil {
+		assignees = *ev.Assignees
+	}
+	for _, a := range assignees {
+		usernames = append(usernames, a.Username)
+		names = append(names, a.Name)
+	}
+	assigneesChanged := bot.issueAssignees.update(ref, usernames)
+
+	switch ev.ObjectAttributes.Action {
+	case ISSUE_ACTION_CLOSED:
+		bot.replyThreadsLocalized(ref, tr(":white_check_mark: %s was closed by %s.", link, ev.User.Name), nil)
+	case ISSUE_ACTION_REOPENED:
+		bot.replyThreadsLocalized(ref, tr("%s was reopened by %s.", link, ev.User.Name), nil)
+	case ISSUE_ACTION_UPDATED:
+		if !assigneesChanged {
+			return
+		}
+		if len(names) == 0 {
+			bot.replyThreadsLocalized(ref, tr("%s is no longer assigned to anyone.", link), nil)
+			return
+		}
+		bot.replyThreadsLocalized(ref, tr("%s was assigned to %s.", link, strings.Join(names, ", ")), nil)
+	}
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/xanzy/go-gitlab"
+)
+
+const (
+	JIRA_URL_ENV_VAR               = "JIRA_URL"
+	JIRA_USER_ENV_VAR              = "JIRA_USER"
+	JIRA_TOKEN_ENV_VAR             = "JIRA_TOKEN"
+	JIRA_PROJECT_KEYS_ENV_VAR      = "JIRA_PROJECT_KEYS"
+	JIRA_MERGED_TRANSITION_ENV_VAR = "JIRA_MERGED_TRANSITION"
+)
+
+// jiraKey matches jira issue keys like `ABC-123`
+var jiraKey = regexp.MustCompile(`\b([A-Z][A-Z0-9]+)-(\d+)\b`)
+
+// jiraIssue is the little of a jira issue the bot shows
+type jiraIssue struct {
+	Key    string `json:"key"`
+	Fields struct {
+		Summary string `json:"summary"`
+		Status  struct {
+			Name string `json:"name"`
+		} `json:"status"`
+	} `json:"fields"`
+}
+
+// jira looks up the jira issues MRs mention in their title or source branch, for their notifications, and can move
+// them along when the MR merges.  with JIRA_USER set it authenticates with basic auth (jira cloud's email and API
+// token), otherwise JIRA_TOKEN is a bearer token (a jira server personal access token)
+type jira struct {
+	baseURL string
+	user    string
+	token   string
+	client  *http.Client
+	// projects are the jira project keys to look for.  empty is any key
+	projects map[string]bool
+	// mergedTransition is the transition, e.g. `Done`, for issues whose MR merged.  empty leaves them alone
+	mergedTransition string
+	dryRun           bool
+}
+
+// jiraFromEnv configures jira from the environment, returning nil if JIRA_URL isn't set
+func jiraFromEnv(dryRun bool) *jira {
+	baseURL := os.Getenv(JIRA_URL_ENV_VAR)
+	if baseURL == "" {
+		return nil
+	}
+	j := &jira{
+		baseURL:          strings.TrimSuffix(baseURL, "/"),
+		user:             os.Getenv(JIRA_USER_ENV_VAR),
+		token:            secretFromEnv(JIRA_TOKEN_ENV_VAR),
+		client:           &http.Client{Timeout: 10 * time.Second},
+		projects:         make(map[string]bool),
+		mergedTransition: os.Getenv(JIRA_MERGED_TRANSITION_ENV_VAR),
+		dryRun:           dryRun,
+	}
+	for _, key := range strings.Split(os.Getenv(JIRA_PROJECT_KEYS_ENV_VAR), ",") {
+		if key = strings.TrimSpace(key); key != "" {
+			j.projects[key] = true
+		}
+	}
+	return j
+}
+
+// keys finds the issue keys in the texts, each once
+func (j *jira) keys(texts ...string) []string {
+	seen := make(map[string]bool)
+	var keys []string
+	for _, text := range texts {
+		for _, m := range jiraKey.FindAllStringSubmatch(text, -1) {
+			if (len(j.projects) > 0 && !j.projects[m[1]]) || seen[m[0]] {
+				continue
+			}
+			seen[m[0]] = true
+			keys = append(keys, m[0])
+		}
+	}
+	return keys
+}
+
+// do sends a request to jira's REST API, decoding the response into v if it's set
+func (j *jira) do(method, path string, body, v interface{}) error {
+	var b []byte
+	if body != nil {
+		var err error
+		if b, err = json.Marshal(body); err != nil {
+			return err
+		}
+	}
+	req, err := http.NewRequest(method, j.baseURL+"/rest/api/2"+path, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	if j.user != "" {
+		req.SetBasicAuth(j.user, j.token)
+	} else {
+		req.Header.Set("Authorization", "Bearer "+j.token)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := j.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("jira responded %s to %s %s", resp.Status, method, path)
+	}
+	if v != nil {
+		return json.NewDecoder(resp.Body).Decode(v)
+	}
+	return nil
+}
+
+func (j *jira) issue(key string) (*jiraIssue, error) {
+	var issue jiraIssue
+	if err := j.do(http.MethodGet, "/issue/"+url.PathEscape(key)+"?fields=summary,status", nil, &issue); err != nil {
+		return nil, err
+	}
+	return &issue, nil
+}
+
+// link is a slack link to the issue
+func (j *jira) link(key string) string {
+	return fmt.Sprintf("<%s/browse/%s|%s>", j.baseURL, key, key)
+}
+
+// summary is a line per mentioned issue with its summary and status, for notifications.  issues that can't be looked
+// up are still linked
+func (j *jira) summary(texts ...string) string {
+	var lines []string
+	for _, key := range j.keys(texts...) {
+		issue, err := j.issue(key)
+		if err != nil {
+			logrus.WithError(err).Warnf("failed to look up jira issue %s", key)
+			lines = append(lines, fmt.Sprintf(":ticket: %s", j.link(key)))
+			continue
+		}
+		lines = append(lines, fmt.Sprintf(":ticket: %s %s (_%s_)", j.link(key), issue.Fields.Summary, issue.Fields.Status.Name))
+	}
+	return strings.Join(lines, "\n")
+}
+
+// transition moves the issue along its workflow by the transition's name, e.g. `Done`
+func (j *jira) transition(key, name string) error {
+	var available struct {
+		Transitions []struct {
+			ID   string `json:"id"`
+			Name string `json:"name"`
+			To   struct {
+				Name string `json:"name"`
+			} `json:"to"`
+		} `json:"transitions"`
+	}
+	path := "/issue/" + url.PathEscape(key) + "/transitions"
+	if err := j.do(http.MethodGet, path, nil, &available); err != nil {
+		return err
+	}
+	for _, t := range available.Transitions {
+		if strings.EqualFold(t.Name, name) || strings.EqualFold(t.To.Name, name) {
+			if j.dryRun {
+				logrus.Infof("dry run: would transition jira issue %s to %s", key, name)
+				return nil
+			}
+			return j.do(http.MethodPost, path, map[string]interface{}{"transition": map[string]string{"id": t.ID}}, nil)
+		}
+	}
+	return fmt.Errorf("%s has no '%s' transition right now", key, name)
+}
+
+// jiraSummary is the jira issues the MR mentions, for its notification.  empty without jira or mentions
+func (bot bot) jiraSummary(mr *gitlab.MergeEvent) string {
+	if bot.jira == nil {
+		return ""
+	}
+	return bot.jira.summary(mr.ObjectAttributes.Title, mr.ObjectAttributes.SourceBranch)
+}
+
+// transitionJira moves the jira issues the merged MR mentions along by JIRA_MERGED_TRANSITION, telling the MR's
+// thread
+func (bot bot) transitionJira(mr *gitlab.MergeEvent, slackChans []string) {
+	if bot.jira == nil || bot.jira.mergedTransition == "" {
+		return
+	}
+	for _, key := range bot.jira.keys(mr.ObjectAttributes.Title, mr.ObjectAttributes.SourceBranch) {
+		if err := bot.jira.transition(key, bot.jira.mergedTransition); err != nil {
+			logrus.WithError(err).Errorf("failed to transition jira issue %s for merge request !%d", key, mr.ObjectAttributes.IID)
+			bot.status.fail("jira")
+			continue
+		}
+		bot.audit.record(auditEntry{Action: "jira_transition", Actor: AUDIT_ACTOR_BOT, Target: key, Detail: bot.jira.mergedTransition,
+			Outcome: auditOutcome(nil, bot.jira.dryRun)})
+		bot.notifyThreadLocalized(mr.Project.ID, mr.ObjectAttributes.IID, tr("%s moved to *%s*.", bot.jira.link(key), bot.jira.mergedTransition), slackChans)
+	}
+}
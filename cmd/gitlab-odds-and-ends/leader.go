@@ -0,0 +1,77 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/raidancampbell/gitlab-odds-and-ends/internal/leader"
+	"github.com/raidancampbell/gitlab-odds-and-ends/internal/schedule"
+)
+
+const (
+	LEADER_ELECTION_ENV_VAR           = "LEADER_ELECTION"
+	LEADER_ELECTION_LEASE_ENV_VAR     = "LEADER_ELECTION_LEASE"
+	LEADER_ELECTION_NAMESPACE_ENV_VAR = "LEADER_ELECTION_NAMESPACE"
+	LEADER_ELECTION_IDENTITY_ENV_VAR  = "POD_NAME"
+	LEADER_ELECTION_REDIS             = "redis"
+	LEADER_ELECTION_KUBERNETES        = "kubernetes"
+	DEFAULT_LEADER_ELECTION_LEASE     = "gitlab-odds-and-ends"
+	// SERVICE_ACCOUNT_NAMESPACE_FILE is where kubernetes tells a pod its namespace
+	SERVICE_ACCOUNT_NAMESPACE_FILE = "/var/run/secrets/kubernetes.io/serviceaccount/namespace"
+)
+
+// newLeaderElector campaigns to run the scheduled jobs with LEADER_ELECTION, `redis` (a lock in REDIS_URL's redis) or
+// `kubernetes` (a lease in LEADER_ELECTION_NAMESPACE, the pod's namespace by default), returning nil if it isn't set
+// and every replica should run them.  the lock or lease is called LEADER_ELECTION_LEASE
+func newLeaderElector() (schedule.Elector, error) {
+	kind := os.Getenv(LEADER_ELECTION_ENV_VAR)
+	if kind == "" {
+		return nil, nil
+	}
+	name := os.Getenv(LEADER_ELECTION_LEASE_ENV_VAR)
+	if name == "" {
+		name = DEFAULT_LEADER_ELECTION_LEASE
+	}
+	identity := os.Getenv(LEADER_ELECTION_IDENTITY_ENV_VAR)
+	if identity == "" {
+		host, err := os.Hostname()
+		if err != nil {
+			return nil, err
+		}
+		identity = fmt.Sprintf("%s-%d", host, os.Getpid())
+	}
+	switch kind {
+	case LEADER_ELECTION_REDIS:
+		url := secretFromEnv(REDIS_URL_ENV_VAR)
+		if url == "" {
+			return nil, fmt.Errorf("%s=%s needs %s", LEADER_ELECTION_ENV_VAR, kind, REDIS_URL_ENV_VAR)
+		}
+		prefix := os.Getenv(REDIS_KEY_PREFIX_ENV_VAR)
+		if prefix == "" {
+			prefix = DEFAULT_REDIS_KEY_PREFIX
+		}
+		r, err := leader.NewRedis(url, prefix+name, identity)
+		if err != nil {
+			return nil, err
+		}
+		return r, nil
+	case LEADER_ELECTION_KUBERNETES:
+		namespace := os.Getenv(LEADER_ELECTION_NAMESPACE_ENV_VAR)
+		if namespace == "" {
+			b, err := ioutil.ReadFile(SERVICE_ACCOUNT_NAMESPACE_FILE)
+			if err != nil {
+				return nil, fmt.Errorf("%s isn't set and the pod's namespace can't be read: %w", LEADER_ELECTION_NAMESPACE_ENV_VAR, err)
+			}
+			namespace = strings.TrimSpace(string(b))
+		}
+		k, err := leader.NewKubernetes(namespace, name, identity)
+		if err != nil {
+			return nil, err
+		}
+		return k, nil
+	default:
+		return nil, fmt.Errorf("invalid %s '%s', expected %s or %s", LEADER_ELECTION_ENV_VAR, kind, LEADER_ELECTION_REDIS, LEADER_ELECTION_KUBERNETES)
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	LISTEN_ADDRS_ENV_VAR       = "LISTEN_ADDRS"
+	ADMIN_LISTEN_ADDRS_ENV_VAR = "ADMIN_LISTEN_ADDRS"
+	DEFAULT_LISTEN_ADDRS       = ":8080"
+)
+
+// listenAddrsFromEnv are the addresses to serve webhooks and admin endpoints on
+func listenAddrsFromEnv() ([]string, []string, error) {
+	listenAddrs := os.Getenv(LISTEN_ADDRS_ENV_VAR)
+	if listenAddrs == "" {
+		listenAddrs = DEFAULT_LISTEN_ADDRS
+	}
+	addrs, err := parseListenAddrs(listenAddrs)
+	if err != nil {
+		return nil, nil, err
+	}
+	adminListenAddrs := os.Getenv(ADMIN_LISTEN_ADDRS_ENV_VAR)
+	if adminListenAddrs == "" {
+		adminListenAddrs = DEFAULT_ADMIN_LISTEN_ADDRS
+	}
+	adminAddrs, err := parseListenAddrs(adminListenAddrs)
+	if err != nil {
+		return nil, nil, fmt.Errorf("admin: %w", err)
+	}
+	return addrs, adminAddrs, nil
+}
+
+// parseListenAddrs splits a comma separated list of listen addresses.  a bare `:port` listens on every interface,
+// IPv4 and IPv6 alike; IPv6 hosts are bracketed, e.g. `[::1]:9090`
+func parseListenAddrs(addrs string) ([]string, error) {
+	var parsed []string
+	for _, addr := range strings.Split(addrs, ",") {
+		addr = strings.TrimSpace(addr)
+		if addr == "" {
+			continue
+		}
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			return nil, fmt.Errorf("invalid listen address '%s': %v", addr, err)
+		}
+		parsed = append(parsed, addr)
+	}
+	return parsed, nil
+}
+
+// listener is a handler to serve on some addresses
+type listener struct {
+	name    string
+	addrs   []string
+	handler http.Handler
+}
+
+// serve binds every listener's addresses up front, so a taken port fails at startup, then serves them all.
+// it only returns if one of them stops serving
+func serve(listeners ...listener) error {
+	errs := make(chan error)
+	for _, l := range listeners {
+		for _, addr := range l.addrs {
+			ln, err := net.Listen("tcp", addr)
+			if err != nil {
+				return fmt.Errorf("failed to listen on %s for %s: %v", addr, l.name, err)
+			}
+			logrus.Infof("listening on %s for %s", ln.Addr(), l.name)
+			go func(ln net.Listener, handler http.Handler) {
+				errs <- http.Serve(ln, handler)
+			}(ln, l.handler)
+		}
+	}
+	return <-errs
+}
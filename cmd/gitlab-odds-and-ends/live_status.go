@@ -0,0 +1,151 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+	"github.com/slack-go/slack"
+	"github.com/xanzy/go-gitlab"
+)
+
+// pipelineEmoji shows a pipeline's status at a glance in live statuses
+var pipelineEmoji = map[string]string{
+	PIPELINE_STATUS_SUCCESS:  ":large_green_circle:",
+	PIPELINE_STATUS_FAILED:   ":red_circle:",
+	PIPELINE_STATUS_CANCELED: ":white_circle:",
+	"running":                ":large_blue_circle:",
+	"pending":                ":hourglass_flowing_sand:",
+}
+
+// pipelineLabels are the words for pipeline statuses that gitlab's don't read well in a sentence
+var pipelineLabels = map[string]string{
+	PIPELINE_STATUS_SUCCESS: "passed",
+}
+
+// pipelineStatus is the pipeline's status at a glance, linked to the pipeline
+func pipelineStatus(p *gitlab.Pipeline) string {
+	label := p.Status
+	if l, ok := pipelineLabels[p.Status]; ok {
+		label = l
+	}
+	status := fmt.Sprintf("<%s|%s>", p.WebURL, label)
+	if emoji, ok := pipelineEmoji[p.Status]; ok {
+		status = emoji + " " + status
+	}
+	return status
+}
+
+// headPipelineStatus is the status of the MR's latest pipeline for its notification, or nothing if it has none
+func (bot bot) headPipelineStatus(projectID, iid int) string {
+	mr, err := bot.gl.GetMergeRequest(projectID, iid)
+	if err != nil {
+		logrus.WithError(err).Errorf("failed to look up the pipeline of merge request !%d", iid)
+		return ""
+	}
+	if mr.HeadPipeline == nil {
+		return ""
+	}
+	return pipelineStatus(mr.HeadPipeline)
+}
+
+// approvalProgress is how far the MR is from the approvals it needs for its notification, e.g. `▰▱ 1/2 approvals`, or
+// nothing if they can't be looked up
+func (bot bot) approvalProgress(projectID, iid int) string {
+	approvals, err := bot.gl.GetMergeRequestApprovals(projectID, iid)
+	if err != nil {
+		logrus.WithError(err).Errorf("failed to look up the approvals of merge request !%d", iid)
+		return ""
+	}
+	if approvals.ApprovalsRequired == 0 {
+		return approvalStatus(approvals)
+	}
+	received := len(approvals.ApprovedBy)
+	if received > approvals.ApprovalsRequired {
+		received = approvals.ApprovalsRequired
+	}
+	bar := strings.Repeat("▰", received) + strings.Repeat("▱", approvals.ApprovalsRequired-received)
+	return bar + " " + approvalStatus(approvals)
+}
+
+// pipelineMRs are the MRs whose notifications show the pipeline: the MR it ran for, or the open MRs from its branch
+func (bot bot) pipelineMRs(p *gitlab.PipelineEvent) []int {
+	if p.MergeRequest.IID != 0 {
+		return []int{p.MergeRequest.IID}
+	}
+	if p.ObjectAttributes.Tag || isTrunkPipeline(p) {
+		return nil
+	}
+	mrs, _, err := bot.gl.ListProjectMergeRequests(p.Project.ID, &gitlab.ListProjectMergeRequestsOptions{
+		State:        gitlab.String("opened"),
+		SourceBranch: &p.ObjectAttributes.Ref,
+	})
+	if err != nil {
+		logrus.WithError(err).Errorf("failed to look up merge requests from %s in %s", p.ObjectAttributes.Ref, p.Project.PathWithNamespace)
+		return nil
+	}
+	var iids []int
+	for _, mr := range mrs {
+		iids = append(iids, mr.IID)
+	}
+	return iids
+}
+
+// refreshLiveStatus edits the MR's notifications in place to show where it is now: who has it, its pipeline and
+// approvals, and whether it was merged or closed, so the channel isn't left with the snapshot from when it was opened.
+// the buttons go once it's merged or closed
+func (bot bot) refreshLiveStatus(projectID, iid int) {
+	sent := bot.threads.get(mrRef(projectID, iid))
+	if len(sent) == 0 {
+		return
+	}
+	mr, err := bot.gl.GetMergeRequest(projectID, iid)
+	if err != nil {
+		logrus.WithError(err).Errorf("failed to look up merge request !%d to update its notifications", iid)
+		return
+	}
+	project, err := bot.gl.GetProject(projectID)
+	if err != nil {
+		logrus.WithError(err).Errorf("failed to look up project %d to update its notifications", projectID)
+		return
+	}
+	author := UNKNOWN_AUTHOR
+	if mr.Author != nil {
+		author = mr.Author.Name
+	}
+	assignee := "nobody"
+	if mr.Assignee != nil {
+		assignee = mr.Assignee.Name
+	} else if len(mr.Reviewers) > 0 {
+		assignee = mr.Reviewers[0].Name
+	}
+
+	msg := tr("%s\n%s", bot.newMRMessage(mergeEventFor(project, mr), author, assignee), bot.liveStatus(mr))
+	layout := bot.newMRBlocks(mr.ProjectID, mr.IID)
+	for _, m := range sent {
+		text := bot.locales.render(m.Channel, msg)
+		var blocks []slack.Block
+		if layout != nil {
+			// the first block is the message, the rest are the buttons
+			if blocks = layout(text); mr.State != "opened" {
+				blocks = blocks[:1]
+			}
+		}
+		if err := bot.notifier.Update(m.Channel, m.Timestamp, text, blocks); err != nil {
+			logrus.WithError(err).Errorf("failed to update the status of message %s in channel %s", m.Timestamp, m.Channel)
+			bot.status.fail("live status")
+		}
+	}
+}
+
+// liveStatus is the line describing the MR's current state.  its pipeline and approvals are in the message already,
+// see newMRMessage
+func (bot bot) liveStatus(mr *gitlab.MergeRequest) string {
+	switch mr.State {
+	case "merged":
+		return fmt.Sprintf(":%s: *Merged*", REACTION_MERGED)
+	case "closed":
+		return fmt.Sprintf(":%s: *Closed*", REACTION_CLOSED)
+	}
+	return "*Open*"
+}
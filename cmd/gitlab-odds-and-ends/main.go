@@ -0,0 +1,1519 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"github.com/raidancampbell/gitlab-odds-and-ends/internal/assign"
+	"github.com/raidancampbell/gitlab-odds-and-ends/internal/httpsettings"
+	"github.com/raidancampbell/gitlab-odds-and-ends/internal/mrkdwn"
+	"github.com/raidancampbell/gitlab-odds-and-ends/internal/notify"
+	"github.com/raidancampbell/gitlab-odds-and-ends/internal/schedule"
+	"github.com/raidancampbell/gitlab-odds-and-ends/internal/script"
+	"github.com/raidancampbell/gitlab-odds-and-ends/internal/slackauth"
+	"github.com/raidancampbell/gitlab-odds-and-ends/internal/store"
+	"github.com/raidancampbell/gitlab-odds-and-ends/internal/webhook"
+	"github.com/sirupsen/logrus"
+	"github.com/slack-go/slack"
+	"github.com/xanzy/go-gitlab"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httputil"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	SLACK_TOKEN_ENV_VAR              = "SLACK_TOKEN"
+	GITLAB_TOKEN_ENV_VAR             = "GITLAB_TOKEN"
+	GITLAB_SLACK_CHANNEL_QUERY_PARAM = "slack-channel"
+	MR_ACTION_OPENED                 = "open"
+	MR_ACTION_UPDATED                = "update"
+	MR_ACTION_APPROVED               = "approved"
+	MR_ACTION_MERGED                 = "merge"
+	MR_ACTION_UNAPPROVED             = "unapproved"
+	MR_ACTION_CLOSED                 = "close"
+	MR_ACTION_REOPENED               = "reopen"
+	HEADER_GITLAB_EVENT              = "X-Gitlab-Event"
+	DRY_RUN_ENV_VAR                  = "DRY_RUN"
+	STATE_FILE_ENV_VAR               = "STATE_FILE"
+	REDIS_URL_ENV_VAR                = "REDIS_URL"
+	REDIS_KEY_PREFIX_ENV_VAR         = "REDIS_KEY_PREFIX"
+	DEFAULT_REDIS_KEY_PREFIX         = "gitlab-odds-and-ends:"
+	// how to reach gitlab and slack, see httpsettings.FromEnv
+	GITLAB_PROXY_ENV_VAR                = "GITLAB_PROXY"
+	GITLAB_CA_BUNDLE_ENV_VAR            = "GITLAB_CA_BUNDLE"
+	GITLAB_INSECURE_SKIP_VERIFY_ENV_VAR = "GITLAB_INSECURE_SKIP_VERIFY"
+	SLACK_PROXY_ENV_VAR                 = "SLACK_PROXY"
+	SLACK_CA_BUNDLE_ENV_VAR             = "SLACK_CA_BUNDLE"
+	SLACK_INSECURE_SKIP_VERIFY_ENV_VAR  = "SLACK_INSECURE_SKIP_VERIFY"
+	// MR_DESCRIPTION_EXCERPT_LENGTH is how much of an MR's description its notification quotes
+	MR_DESCRIPTION_EXCERPT_LENGTH = 500
+)
+
+type bot struct {
+	notifier notify.Notifier
+	gl       GitLabAPI
+	// expiry is nil unless approvals should go stale after some number of days
+	expiry *approvalExpiry
+	// slackSigningSecret verifies requests from slack.  interactive messages and slash commands are disabled without it
+	slackSigningSecret string
+	// slackAdmins are the slack user IDs allowed to use admin commands.  empty means everyone
+	slackAdmins map[string]bool
+	// incidents is nil unless an incident channel is configured
+	incidents *incidentMode
+	// deployDigest is nil unless a deployment digest channel is configured
+	deployDigest *deployDigest
+	// routes maps projects to the slack channels they notify
+	routes *routes
+	// users maps slack users to gitlab users
+	users *userMapper
+	// snoozes tracks who asked to be reminded about which MRs later
+	snoozes *snoozes
+	// reminders are the `/odds remind-me` reminders waiting to go off
+	reminders *pendingReminders
+	// threads remembers each MR's notification, for threading follow-ups
+	threads *threads
+	// artifactLabel marks MRs whose pipeline artifacts should be linked in their thread
+	artifactLabel string
+	// userRetry is how hard to try to fix up notifications where we couldn't look up the author
+	userRetry retryPolicy
+	// defaultRoutes picks channels for projects without a route
+	defaultRoutes *defaultRouter
+	// labelRules are each project's path-based MR labels
+	labelRules map[string][]compiledLabelRule
+	// targetBranches are the branches each project assigns and announces MRs into, see projectConfig.TargetBranches
+	targetBranches map[string][]*regexp.Regexp
+	// experts are each project's domain experts, who get the MRs in their area first
+	experts map[string][]compiledExpertRule
+	// routingRules fan events out to more channels, see routingRule
+	routingRules []compiledRoutingRule
+	// scripts are each project's routing and assignment script, see projectConfig.Script
+	scripts map[string]*script.Script
+	// opa, if set, holds MRs to the rego policies, see opaConfig
+	opa          *opaPolicies
+	groupMembers *groupMembers
+	// routingLookups caches what routing rules ask gitlab
+	routingLookups *routingLookups
+	// policies picks each project's review rules from its gitlab topics
+	policies *policies
+	// projects holds the per-project settings from the config file
+	projects projectSettings
+	// changelog, if set, records MRs merged into default branches
+	changelog *changelog
+	// cherryPicks are the branches people asked MRs to be cherry-picked onto once they're merged
+	cherryPicks *cherryPicks
+	// drafts remembers which MRs are still works in progress
+	drafts *drafts
+	// blocked remembers why MRs couldn't be merged, the last time we told their threads
+	blocked *blockedMRs
+	// rebases remembers which MRs fell behind their target branch, for projects that rebase them
+	rebases *rebases
+	// scheduler runs the periodic jobs
+	scheduler *schedule.Scheduler
+	// stale reminds threads about MRs waiting on review.  nil when disabled
+	stale *staleReminders
+	// debounce, if set, coalesces an MR's rapid thread replies into one
+	debounce *debouncer
+	// signoffs tracks release candidates waiting on sign-off.  nil when disabled
+	signoffs *releaseSignoffs
+	// freezes are the deploy freeze windows.  nil when none are configured
+	freezes *freezes
+	// audit records what the bot was asked to do
+	audit *auditLog
+	// flaky, if set, tracks jobs that pass on retry for the weekly flaky test report
+	flaky *flakyJobs
+	// trunk tracks which default branches are red
+	trunk *trunkHealth
+	// issueAssignees remembers who linked issues were assigned to
+	issueAssignees *issueAssignees
+	// slas tracks how long MRs wait for their first review
+	slas *reviewSLAs
+	// quietHours, if set, holds back messages to channels in their quiet hours
+	quietHours *quietHours
+	// preferences are how people want to be DMed
+	preferences *preferences
+	// dedupNotifications links secondary channels to an MR's announcement instead of repeating it, see dedupChannels
+	dedupNotifications bool
+	// resetApprovalsOnPush clears the approvals of approved MRs that get new commits
+	resetApprovalsOnPush bool
+	// outgoing, if set, sends events to other systems' webhooks
+	outgoing *outgoingWebhooks
+	// eventDB, if set, writes events to a database for reporting
+	eventDB *eventDB
+	// eventBus, if set, publishes events to NATS or Kafka
+	eventBus *eventBus
+	// recognition, if set, gives reviewers shout-outs for milestones
+	recognition *recognition
+	// status is what `/bot-status` reports
+	status *botStatus
+	// webhookAuth, if set, rejects webhooks without the secret token, and replayed ones
+	webhookAuth *webhook.Auth
+	// reviewerPool is who the maintainer is picked from
+	reviewerPool reviewerPool
+	// assignMode is whether new MRs get their maintainer as assignee, reviewer, or both, unless their policy says otherwise
+	assignMode assignMode
+	// reviewersSupported is whether the gitlab instance has MR reviewers
+	reviewersSupported bool
+	// handoffs are reviews maintainers passed on to each other
+	handoffs *handoffs
+	// comments is how the bot comments on MRs
+	comments *mrComments
+	// locales translates messages for channels not in english
+	locales *locales
+	// watches are the files people want DMs about
+	watches *watches
+	// systemHooks, if set, handles gitlab's system hooks
+	systemHooks *systemHooks
+	// groupRoutes route the projects of whole groups
+	groupRoutes groupRoutes
+	// instance is the name of the gitlab instance the bot serves, "" for the one at GITLAB_BASE_URL.  see instanceConfig
+	instance string
+	// instances are the bots for every gitlab instance, including this one
+	instances *instances
+	// oauth, if set, is the OAuth application the bot authenticates to gitlab with
+	oauth *gitlabOAuth
+	// token is the gitlab access token, when not using oauth.  it's rotated on reload
+	token *privateToken
+	// reloader applies config changes, from the file or the admin API
+	reloader *reloader
+	// archive, if set, keeps the webhooks the bot accepts
+	archive *webhookArchive
+	// poller, if set, polls for MR changes in case webhooks can't reach the bot
+	poller *poller
+	// workingHours, if set, keeps new reviews to maintainers who are working
+	workingHours *workingHours
+	// userStatuses, if set, keeps new reviews from maintainers whose gitlab status says they're busy or away
+	userStatuses *userStatuses
+	// jira, if set, looks up the jira issues MRs mention
+	jira *jira
+	// pagerDuty, if set, pages about failing critical branches and neglected reviews
+	pagerDuty *pagerDuty
+	// cycleTimes records how long MRs take to get reviewed, approved and merged
+	cycleTimes *cycleTimes
+	// dora derives the DORA metrics from merges and production deployments
+	dora *dora
+}
+
+// usage:
+// set SLACK_TOKEN_ENV_VAR to a slack token capable of interacting with the RTM API.  This is nontrivial.
+//the best method I could find was here: https://github.com/erroneousboat/slack-term/wiki#running-slack-term-without-legacy-tokens
+//visit https://my.slack.com/customize and execute "TS.boot_data.api_token" in the console.  The responded xoxs-.... token will post as you.
+//the bot joins public channels it's routed to but isn't in (bot tokens need the channels:join scope).  private channels
+//can't be joined, invite the bot to them; until then their messages fail with an error saying so
+// set GITLAB_TOKEN to a gitlab personal access token.  I gave mine all scopes because I'm still writing this thing and don't know what it wants.
+const GITLAB_BASE_URL = "http://nuc.sinkhole.raidancampbell.com:2080/api/v4"
+// edit that ^^^ to your gitlab URL.  Or maybe an env var.
+// "enroll" a repo with this by configuring its webhook to hit this code.  As it stands this code listens on `/gitlab/callback`
+//Additionally the webhook should send the desired slack channel in the `slack-channel` query parameter, for example `/gitlab/callback?slack-channel=C0123456789`
+//Enable merge request, pipeline, deployment, issue, and tag push events.  Issue events only update slack threads the issue was created from or linked in.
+//a whole group can be enrolled with one group webhook, by adding `group=<group path>` to its URL.  its projects are routed
+//by the config file's projects and groups sections, and fall back to the group webhook's slack-channel
+// set WORKING_HOURS (e.g. `09:00-17:00`) to only give new MRs to maintainers in their working hours, monday to friday in
+//their timezone.  timezones come from the local time on gitlab profiles, or timezone, working_hours and working_days in the
+//config's users section.  MRs opened when nobody's working are assigned and announced once someone is
+// new MRs aren't given to maintainers whose gitlab status is "Busy", or whose status emoji or message matches one of
+//OOO_STATUS_PATTERNS (comma separated, default `:palm_tree:,vacation,holiday,out of office,ooo`), unless everyone is.
+//set RESPECT_USER_STATUS=false to ignore statuses
+// new MRs get 2 reviewers, or as many as their policy says.  a project's reviewers and label_reviewers in the config file
+//or admin API override that, e.g. `label_reviewers: {security: 3}` for security labeled MRs
+// new MR notifications show the start of the MR's description, with its markdown (links, code, lists) rendered for
+//slack, see the mrkdwn package
+// new MR notifications show the MR's size, from XS to XL by the lines and files it changes (see mrSizes).  policies with
+//`xl_extra_reviewer: true` have XL MRs reviewed by one more maintainer
+// a project's (or its policy's) slack_group is the ID of the slack user group of its maintainers, e.g. `S0123456789`.  it's
+//mentioned in the MR's thread when there aren't enough maintainers to tag, and in review SLA escalations
+// a project's events and actions in the config file pick what it's notified about, e.g. `events: [merge_request, deployment]`
+//and `actions: [open, merge]` to skip updates, approvals and pipelines.  everything else still happens (MRs are still
+//assigned), nobody's told.  events are merge_request, pipeline, deployment, issue, tag_push and note; without them, all are
+// a project's target_branches in the config file (globs, e.g. `[main, release/*]`) are the only branches whose MRs are
+//assigned a maintainer and announced, so MRs between teammates' long-lived feature branches are left to them
+// a project's experts in the config file are maintainers who know MRs with certain labels or changing certain paths best.
+//those MRs go to one of them when they're around, and to a random maintainer otherwise, see expertRule
+// policies with auto_merge set approved MRs to merge when their pipeline succeeds, or merge them right away with
+//`auto_merge_method: merge` when it already has.  auto_merge_approvals holds off until that many maintainers approved, see policyConfig
+// set ASSIGN_AS=reviewer to request a review from the picked maintainer instead of assigning them, or ASSIGN_AS=both for both.
+//gitlab older than 13.7 has no reviewers, so the maintainer is assigned there regardless
+// set REVIEWER_POOL=approval_rules to pick reviewers from the eligible approvers of the MR's approval rules instead of
+//from everyone with maintainer access.  projects without approval rules still use their maintainers
+// set GITLAB_WEBHOOK_SECRET to the webhooks' secret token to reject deliveries without it.  deliveries whose event is older
+//than WEBHOOK_REPLAY_WINDOW (default 1h) are rejected too, allowing WEBHOOK_CLOCK_SKEW (default 1m) between our clock and gitlab's.
+//resending an old delivery from gitlab's webhook settings counts as a replay
+// set DRY_RUN=true to have the bot log what it would do (assign, comment, message) without actually doing any of it.
+// set RESET_APPROVALS_ON_PUSH=true to clear an approved MR's approvals when new commits are pushed to it.  The gitlab token
+//must belong to a bot user (project or group access token) to reset other people's approvals.
+// set OPEN_MR_DIGEST_TIME (HH:MM) to post each mapped channel a daily list of its open MRs grouped by assignee.
+//OPEN_MR_DIGEST_TIMEZONE is an IANA timezone like America/New_York, defaulting to the bot's local time
+// set REVIEWER_LOAD_REPORT_DAY (e.g. monday) to post each project's weekly reviewer load to its channels at REVIEWER_LOAD_REPORT_TIME
+//(HH:MM, default 09:00).  the same report is always available at `/reports/reviewer-load?project=group/project`
+// set FLAKY_TEST_REPORT_DAY (e.g. friday) to post each project's weekly list of jobs that failed and then passed on retry,
+//at FLAKY_TEST_REPORT_TIME (HH:MM, default 09:00).  retries are spotted in pipeline events
+// announced MRs are checked for conflicts and other merge blockers every BLOCKED_SCAN_INTERVAL (default 15m)
+//projects with `rebase: api` in the config file have MRs that fall behind their target branch rebased then (projects that
+//only fast-forward merge get a comment asking the author to, instead), and `rebase: comment` always asks the author
+// before the bot DMs someone about an MR (stale reminders, blockers), it checks their slack do not disturb.  the DM waits
+//until it's over, or with the project's `dnd: thread` in the config file, goes to the MR's thread instead.  the slack
+//token needs the dnd:read scope
+// set STALE_MR_REMINDER_AFTER to a duration (e.g. 48h) to remind an MR's thread when it's gone that long without review.  reminders
+//back off and get louder; set STALE_MR_DM_ASSIGNEE=true to DM the assignee too.  MRs are checked every STALE_MR_SCAN_INTERVAL (default 1h)
+// set NOTIFICATION_DEDUP=true to announce new MRs once, in the first slack channel they're routed to (the project's own,
+//then routing rules'), with a link to that announcement in the others.  threads and live status follow the announcement
+// set MR_UPDATE_DEBOUNCE to a duration (e.g. `30s`) to hold back replies to an MR's thread until it's gone that long
+//without another, then post them as one summary, so a force-push and a round of relabeling don't flood the thread.  a
+//busy MR's replies are held back for 5 times that at most
+// the notification of a new MR is kept up to date as it goes: who has it, its pipeline (whether it's running, passed or
+//failed, so reviewers know if it's worth a look yet) and approvals (e.g. `▰▱ 1/2 approvals`, as gitlab requires), and
+//once it's merged or closed.  threaded replies
+//still tell the story
+// set APPROVAL_EXPIRY_DAYS to a number of days after which an approval is considered stale and must be given again.
+// set SLACK_SIGNING_SECRET to the slack app's signing secret to enable message buttons (e.g. "Revert" on merged MRs).
+//the app's interactivity request URL should point at `/slack/interactive`, and its slash commands at `/slack/commands`.
+//every request to `/slack/` must carry slack's signature, and be less than 5 minutes old so captured requests can't be replayed.
+//`/bot-status` tells whoever runs it how the bot is doing: uptime, webhooks in flight, each project's last event, failures,
+//and when the gitlab token expires
+//`/handoff <MR URL> @someone` hands the MR's review to another maintainer, and so does commenting `/handoff @someone` on the MR
+//as its assignee or reviewer.  the comment needs the webhook's comment events enabled
+//MR comments can also run `/odds reassign`, `/odds add-reviewer [@someone]`, `/odds remind-me 2d`, and
+//`/odds cherry-pick release-1.2`, see comment_commands.go.  only the MR's author, assignee, reviewers, or the project's
+//maintainers can change who reviews it or have it cherry-picked.  cherry-picks happen once the MR merges, and go to the
+//MR's author for review
+// the bot's MR comments end with a footer configured under `comments` in the config file.  commenting `/bot-quiet` on an MR
+//stops the bot commenting on it, including tagging reviewers; comment events need to be enabled for that too
+//`/watch add **/auth/**` DMs whoever ran it about MRs changing matching files, whether or not they're reviewing them
+//new MR notifications get "Assign to me", "Approve", and "Snooze" buttons.  Approving on someone's behalf needs an admin gitlab token.
+//SNOOZE_DURATION (e.g. `4h`) is how long a snooze lasts, a day by default.  a snooze only holds off stale reminders for
+//whoever snoozed, and is kept in STATE_FILE
+// MRs labeled `needs-artifact-review` (or ARTIFACT_REVIEW_LABEL) get their pipeline's artifact download links posted in their thread.
+//the project's webhook needs pipeline events enabled for this
+// if the MR author can't be looked up, the notification is edited once they can be.  USER_LOOKUP_RETRIES (default 5) and
+//USER_LOOKUP_RETRY_INTERVAL (default `1m`, doubling each attempt) control how long that's retried
+// people can DM the bot `my reviews`, `my mrs`, `snooze <MR link> [2d]`, or change how the bot DMs them with `dms off`, `dms
+//digest` (one DM a day, at DM_DIGEST_TIME, default 09:00), `dms on`, and `mute group/project` (and `unmute`), when the slack app subscribes to `message.im` events
+//at `/slack/events`.  they're matched to gitlab users by the config's users section, or their email address
+// links to MRs and issues pasted in a routed channel are unfurled when the slack app subscribes to `link_shared` events at `/slack/events`
+// set INCIDENT_SLACK_CHANNEL to enable `/incident on group/project`, which escalates that project's pipeline failures and
+//production deployments to the channel.  INCIDENT_ENVIRONMENTS is a comma separated list of "production" environment names.
+// set DEPLOY_DIGEST_SLACK_CHANNEL to post a daily per-environment summary of deployments there, at DEPLOY_DIGEST_TIME (HH:MM, local time).
+//the day's deployments are counted in STATE_FILE (or redis), so with several replicas the digest has them all
+// set SLACK_ADMIN_USERS to a comma separated list of slack user IDs to restrict admin commands like `/incident` to them.
+// behind a corporate proxy or a private CA, set GITLAB_PROXY and SLACK_PROXY to proxy URLs (otherwise HTTPS_PROXY etc. are used),
+//GITLAB_CA_BUNDLE and SLACK_CA_BUNDLE to extra PEM CA certificates to trust, or GITLAB_INSECURE_SKIP_VERIFY=true and
+//SLACK_INSECURE_SKIP_VERIFY=true to not check certificates at all
+// webhooks over WEBHOOK_MAX_BODY_BYTES (default 10MiB) are turned away, as are webhooks over the rate limits:
+//WEBHOOK_PROJECT_RATE_LIMIT per project (default 300 a minute) and WEBHOOK_IP_RATE_LIMIT per source address (default 3000
+//a minute, gitlab sends every project's webhooks from the same few).  bursts of a fifth of a minute's worth are allowed.
+//set a limit to 0 to turn it off.  gitlab disables webhooks that keep failing, so keep the limits well above normal traffic
+//the source address is the connection's, unless it comes from one of TRUSTED_PROXIES (comma separated addresses or
+//CIDRs, e.g. the ingress's), in which case it's the one the proxy puts in X-Forwarded-For
+// set LISTEN_ADDRS to a comma separated list of addresses to listen on (default `:8080`, all interfaces, IPv4 and IPv6),
+//which serve only the gitlab and slack callbacks and `/healthz`.  admin endpoints (`/reports/...`, `/debug/vars`, and
+//`/debug/pprof/`) are served on ADMIN_LISTEN_ADDRS (default `127.0.0.1:9090`), behind basic auth when ADMIN_USERNAME and
+//ADMIN_PASSWORD are set
+//`/dashboard` on the admin listener shows the enrolled projects, recent webhooks and where they were routed (once
+//ADMIN_USERNAME and ADMIN_PASSWORD are set), MR threads, recent reviewer assignments, and failure counts
+//`/debug/events` on the admin listener lists the last RECENT_WEBHOOKS (default 100) webhooks as JSON, newest first, with
+//whether each was handled, ignored, or hit an error and why.  filter with `?project=group/project&result=error&limit=10`.
+//it needs ADMIN_USERNAME and ADMIN_PASSWORD set, as the webhooks hold what gitlab sent about private projects
+//`/audit` on the admin listener lists what the bot did (assignments, comments, approval resets, messages, ...), what
+//triggered it, and how it went.  filter with `?target=group/project!12&action=assign&since=24h`, or add `format=csv` to export.
+//like `/debug/events` it needs ADMIN_USERNAME and ADMIN_PASSWORD set
+// an instance admin can point a gitlab system hook at `/gitlab/system` to announce new projects and membership changes, and
+//to add the bot's webhook to new projects, see systemHooksConfig.  its secret token goes in GITLAB_SYSTEM_HOOK_SECRET
+// more gitlab instances can be served alongside GITLAB_BASE_URL, each with its own token and webhook secret, see instanceConfig.
+//their webhooks should add `instance=<name>` to the URL (gitlab's X-Gitlab-Instance header or the secret token also tell them apart).
+//each keeps its own state under `instances/<name>` in STATE_FILE.  slash commands, link unfurls, and the issue shortcut use GITLAB_BASE_URL's
+// instead of GITLAB_TOKEN the bot can authenticate as a gitlab OAuth application: set GITLAB_OAUTH_CLIENT_ID and GITLAB_OAUTH_CLIENT_SECRET,
+//and GITLAB_OAUTH_REDIRECT_URL to this bot's `/gitlab/oauth/callback` as the application's redirect URI.  then visit `/gitlab/oauth/authorize`
+//on the admin listener (with `?instance=<name>` for other instances) signed in as the bot's gitlab user.  the tokens are kept in
+//STATE_FILE and renewed before they expire, so without STATE_FILE the application has to be authorized again after every restart
+// set CONFIG_FILE to a YAML file to configure project routing, see config.go.  projects can notify Microsoft Teams channels
+//through incoming webhooks instead of (or as well as) slack channels, see teamsChannelConfig.  set DISCORD_TOKEN to a discord
+//bot token to route projects to `discord:<channel ID>` channels too, and MATTERMOST_URL and MATTERMOST_TOKEN (a bot
+//account's access token) for `mattermost:<channel ID>` channels.  mattermost mentions use the config's users section
+// set SMTP_ADDR (host:port), SMTP_FROM, and optionally SMTP_USERNAME and SMTP_PASSWORD to email `email:<address>` channels.
+//`email:hourly:<address>` and `email:daily:<address>` get digests instead, the daily one at EMAIL_DIGEST_TIME (HH:MM, default 08:00)
+// a channel's quiet_hours in the config file (e.g. `hours: "19:00-08:00"` and `weekends: true`) hold back its messages
+//until they're over, then post them together.  critical events it lists, like `trunk_broken`, are posted anyway, see quietHoursConfig
+// notifications and reminders can be translated per project or channel with message catalogs next to the config file,
+//see localesConfig
+// for routing and assignment the config can't express, a project's `script` in the config file is a starlark file
+//defining `route(event, channels)`, returning the channels to notify instead, and/or `assign(event, candidates)`, returning
+//the username of the candidate to review.  either can return None to leave it be.  each call gets 250ms, a million
+//steps, and can build about 4 million bytes of strings and elements of lists and dicts altogether
+// the config file's `opa: {files: [...]}` holds MRs to rego policies, e.g. "no self-approval", see opaConfig.  their
+//violations are posted to the MR's thread as merge blockers, and they can keep people from being picked to review
+// set DEBUG_SIMULATE=true (and the admin credentials) to try routing rules and policies out with `POST /debug/simulate`
+//on the admin listener, e.g. `?event=merge_request&project=group/project&action=open`.  it makes up the event from the
+//project's real data and answers with what the bot would have done about it, without doing any of it, see simulateRouter
+// the admin listener's `/admin/projects/<group/project>` and `/admin/policies/<topic>` enroll projects and set policies
+//(reviewer counts, ASSIGN_AS and REVIEWER_POOL per policy) at runtime with PUT, GET, and DELETE, see admin_api.go.  they
+//take the place of the config file's entry for the same project or topic, and are kept in STATE_FILE.  with REDIS_URL,
+//the other replicas apply them as soon as they're saved
+//`/admin/preferences/<slack user ID>` sets someone's DM preferences the same way, e.g. `{"dms": "digest", "muted": ["group/project"]}`.
+//changing anything through the admin API (PUT, DELETE, and `POST /admin/backfill`), or reading the preferences, needs
+//ADMIN_USERNAME and ADMIN_PASSWORD set
+// where gitlab can't reach the bot, set POLL_INTERVAL (e.g. `1m`) to poll the routed projects' MRs instead.  new, updated,
+//approved, merged, and closed MRs are handled as if gitlab had sent their webhooks.  other events still need webhooks
+// set BACKFILL_ON_STARTUP=true to assign and announce the routed projects' open MRs that nobody is assigned to or reviewing
+//when the bot starts, as if they'd just been opened.  `POST /admin/backfill` on the admin listener does the same on demand,
+//for one project with `?project=group/project`
+// the config file is reloaded when it changes (checked every CONFIG_RELOAD_INTERVAL, default 30s) or on SIGHUP, see reloader.
+//secrets like GITLAB_TOKEN and GITLAB_WEBHOOK_SECRET can be read from a file named by e.g. GITLAB_TOKEN_FILE instead, which is reloaded too
+// set WEBHOOK_ARCHIVE_DIR to a directory to keep every accepted webhook there as JSON, or WEBHOOK_ARCHIVE_S3_URL to
+//an S3 compatible bucket like `https://s3.amazonaws.com/bucket/prefix` with WEBHOOK_ARCHIVE_S3_ACCESS_KEY,
+//WEBHOOK_ARCHIVE_S3_SECRET_KEY and WEBHOOK_ARCHIVE_S3_REGION (default us-east-1).  they're kept for WEBHOOK_ARCHIVE_MAX_AGE
+//(default 720h), and at most WEBHOOK_ARCHIVE_MAX_COUNT (default 100000) of them.  secret tokens aren't archived
+// the config file's changelog section adds MRs merged into a project's default branch to a changelog file in its
+//repository (committed by the bot), a channel, or both, grouped into sections by label, see changelogConfig
+// set JIRA_URL (e.g. `https://example.atlassian.net`) and JIRA_TOKEN to show the summary and status of jira issues
+//mentioned in new MRs' titles or source branches, like `ABC-123`, in their notifications.  with JIRA_USER set the token is
+//an API token for that user's email, otherwise a personal access token.  JIRA_PROJECT_KEYS (comma separated) limits which
+//keys count, and JIRA_MERGED_TRANSITION (e.g. `Done`) moves the issues along when their MR merges
+// set PAGERDUTY_ROUTING_KEY to an Events API v2 integration key to page when pipelines fail on critical branches, and when
+//an MR's review SLA breach reaches the escalation channel without anyone reviewing it (PAGERDUTY_REVIEW_SLA=false to not).
+//PAGERDUTY_BRANCHES are the critical branch globs (comma separated, e.g. `main,release/*`), each project's default branch by
+//default.  repeats join the open incident, which resolves once the branch is green or the MR is reviewed
+// the bot records when MRs are opened, first reviewed, approved and merged.  `/reports/cycle-time?project=group/project&days=7`
+//on the admin listener has the percentiles of each, and CYCLE_TIME_REPORT_DAY (e.g. `monday`) posts a weekly summary to each
+//project's channels at CYCLE_TIME_REPORT_TIME (HH:MM, default 09:00)
+// DORA metrics (deployment frequency, lead time from an MR's last commit to production, and change failure rate) are worked
+//out from merges into default branches and deployments to DORA_ENVIRONMENTS (comma separated, default production).  failed
+//and rolled back deployments are failed changes.  they're on the admin listener at `/metrics` for prometheus, over the last
+//30 days, and as JSON at `/reports/dora?project=group/project&days=30`
+// set EVENT_DB_DSN to a postgres or mysql DSN (with EVENT_DB_DRIVER=mysql for mysql) to write MR events, assignments, finished
+//pipelines and deployments to the mr_events, assignments, pipeline_results and deployments tables, for reporting with SQL.
+//the tables are created if they don't exist, see eventDBSchema
+// set EVENT_BUS_URL to `nats://host:4222` or `kafka://broker1:9092,broker2:9092` to publish the bot's events there, as the
+//same JSON the outgoing webhooks get.  NATS subjects are EVENT_BUS_TOPIC (default gitlab-odds-and-ends) and the event type,
+//e.g. `gitlab-odds-and-ends.merge_request.merged`.  kafka gets them on the EVENT_BUS_TOPIC topic, keyed by project
+// set STATE_FILE to a writable path to keep the bot's state (e.g. review SLA clocks, announced blockers, deferred drafts,
+//snoozes and `/odds remind-me` reminders) across restarts
+// set REDIS_URL (e.g. `redis://:password@redis:6379/0`) to keep the state in redis instead of STATE_FILE, so several
+//replicas behind a load balancer share it and a replica that restarts picks up where the others are.  keys are prefixed
+//with REDIS_KEY_PREFIX (default gitlab-odds-and-ends:).  a replica's saves are pushed to the others as they happen, and
+//saves only write the entries (MRs, users...) they changed, so the last save of an entry wins.  every replica still runs the scheduled jobs, unless LEADER_ELECTION is set
+// set LEADER_ELECTION to `redis` or `kubernetes` to run the scheduled jobs (digests, reminders, polling...) on one replica
+//at a time.  `redis` takes a lock in REDIS_URL's redis, `kubernetes` a lease in LEADER_ELECTION_NAMESPACE, the pod's
+//namespace by default, which needs a service account that can get, create and update leases.  the lock or lease is
+//called LEADER_ELECTION_LEASE (default gitlab-odds-and-ends) and replicas go by POD_NAME, or their hostname.  if the
+//leader dies another replica takes over within 15 seconds
+// `serve` runs the bot, and is the default.  `validate-config` checks the configuration and that gitlab and slack take the
+//tokens, `enroll group/project` adds the bot's webhook to a project, and `test-notify <channel>` sends a sample notification.
+//they're configured by the same environment as `serve`, see cli.go
+func main() {
+	name, args := COMMAND_SERVE, os.Args[1:]
+	if len(args) > 0 {
+		name, args = args[0], args[1:]
+	}
+	command, ok := commands()[name]
+	if !ok {
+		usage()
+		os.Exit(2)
+	}
+	command.run(args)
+}
+
+// setup makes every gitlab instance's bot from the environment and config file, as `serve` runs them.  the other
+// commands use it too so they check and act with exactly what the bot would.  unless serving, the state file is only
+// read and slack's RTM connection isn't made, so they can run next to the bot
+func setup(serving bool) (bot, *slack.Client, *notify.Email) {
+	gitlabHTTP, err := httpsettings.FromEnv(GITLAB_PROXY_ENV_VAR, GITLAB_CA_BUNDLE_ENV_VAR, GITLAB_INSECURE_SKIP_VERIFY_ENV_VAR)
+	if err != nil {
+		log.Fatalf("Failed to configure gitlab HTTP client: %v", err)
+	}
+	slackHTTP, err := httpsettings.FromEnv(SLACK_PROXY_ENV_VAR, SLACK_CA_BUNDLE_ENV_VAR, SLACK_INSECURE_SKIP_VERIFY_ENV_VAR)
+	if err != nil {
+		log.Fatalf("Failed to configure slack HTTP client: %v", err)
+	}
+	if gitlabHTTP.InsecureSkipVerify || slackHTTP.InsecureSkipVerify {
+		logrus.Warn("TLS certificate verification is disabled, connections can be intercepted")
+	}
+
+	cfg, err := loadConfig(os.Getenv(CONFIG_FILE_ENV_VAR))
+	if err != nil {
+		log.Fatalf("Failed to load config: %v", err)
+	}
+	if err := validateInstances(cfg.Instances); err != nil {
+		log.Fatalf("Failed to configure gitlab instances: %v", err)
+	}
+
+	openState := store.Open
+	if !serving {
+		openState = store.OpenReadOnly
+	}
+	if redisURL := secretFromEnv(REDIS_URL_ENV_VAR); redisURL != "" {
+		prefix := os.Getenv(REDIS_KEY_PREFIX_ENV_VAR)
+		if prefix == "" {
+			prefix = DEFAULT_REDIS_KEY_PREFIX
+		}
+		openRedis := store.OpenRedis
+		if !serving {
+			openRedis = store.OpenRedisReadOnly
+		}
+		openState = func(string) (*store.Store, error) { return openRedis(redisURL, prefix) }
+	}
+	state, err := openState(os.Getenv(STATE_FILE_ENV_VAR))
+	if err != nil {
+		log.Fatalf("Failed to load state: %v", err)
+	}
+
+	registry := newInstances()
+	defaultInstance := instanceConfig{URL: GITLAB_BASE_URL, TokenEnv: GITLAB_TOKEN_ENV_VAR, WebhookSecretEnv: GITLAB_WEBHOOK_SECRET_ENV_VAR,
+		OAuthClientIDEnv: GITLAB_OAUTH_CLIENT_ID_ENV_VAR, OAuthClientSecretEnv: GITLAB_OAUTH_CLIENT_SECRET_ENV_VAR}
+	reloader, err := newReloader(os.Getenv(CONFIG_FILE_ENV_VAR), cfg, state, registry, append([]instanceConfig{defaultInstance}, cfg.Instances...))
+	if err != nil {
+		log.Fatalf("Failed to load admin API changes: %v", err)
+	}
+	// from here on cfg includes the projects and policies set through the admin API
+	cfg, _ = reloader.current()
+
+	locales, err := newLocales(cfg.Locales, os.Getenv(CONFIG_FILE_ENV_VAR), cfg.Projects)
+	if err != nil {
+		log.Fatalf("Failed to load message catalogs: %v", err)
+	}
+	scripts, err := loadScripts(os.Getenv(CONFIG_FILE_ENV_VAR), cfg.Projects)
+	if err != nil {
+		log.Fatalf("Failed to load project scripts: %v", err)
+	}
+	opa, err := newOPAPolicies(cfg.OPA, os.Getenv(CONFIG_FILE_ENV_VAR))
+	if err != nil {
+		log.Fatalf("Failed to load rego policies: %v", err)
+	}
+
+	var notifier notify.Notifier = notify.Noop{}
+	var slk *slack.Client
+	if os.Getenv(SLACK_TOKEN_ENV_VAR) != "" {
+		slk = slack.New(os.Getenv(SLACK_TOKEN_ENV_VAR), slack.OptionDebug(true),
+			slack.OptionLog(log.New(os.Stdout, "slack-bot: ", log.Lshortfile|log.LstdFlags)), slack.OptionHTTPClient(slackHTTP.Client()), )
+
+		rtm := slk.NewRTM(slack.RTMOptionDialer(slackHTTP.Dialer()))
+		if serving {
+			go rtm.ManageConnection()
+		}
+		notifier = notify.Slack{RTM: rtm}
+	} else {
+		logrus.Warn("no slack token set, slack messaging disabled")
+	}
+
+	backends := make(map[string]notify.Notifier)
+	if len(cfg.Teams) > 0 {
+		teams, err := newTeamsNotifier(cfg.Teams, http.DefaultClient)
+		if err != nil {
+			log.Fatalf("Failed to configure teams: %v", err)
+		}
+		backends[notify.TEAMS_CHANNEL_PREFIX] = teams
+	}
+	if token := os.Getenv(DISCORD_TOKEN_ENV_VAR); token != "" {
+		backends[notify.DISCORD_CHANNEL_PREFIX] = notify.Discord{Token: token, Client: http.DefaultClient}
+	}
+	if mattermostURL := os.Getenv(MATTERMOST_URL_ENV_VAR); mattermostURL != "" {
+		mattermost, err := newMattermostNotifier(mattermostURL, os.Getenv(MATTERMOST_TOKEN_ENV_VAR), cfg.Users, http.DefaultClient)
+		if err != nil {
+			log.Fatalf("Failed to configure mattermost: %v", err)
+		}
+		backends[notify.MATTERMOST_CHANNEL_PREFIX] = mattermost
+	}
+	email, err := newEmailNotifier(state)
+	if err != nil {
+		log.Fatalf("Failed to configure email: %v", err)
+	}
+	if email != nil {
+		backends[notify.EMAIL_CHANNEL_PREFIX] = email
+	}
+	if len(backends) > 0 {
+		notifier = notify.Channels{Slack: notifier, Backends: backends}
+	}
+
+	dryRun, _ := strconv.ParseBool(os.Getenv(DRY_RUN_ENV_VAR))
+	if dryRun {
+		logrus.Warn("dry run enabled, no assignments, comments, or slack messages will be sent")
+		notifier = notify.DryRun{}
+	}
+	quiet, err := newQuietHours(cfg.QuietHours, state)
+	if err != nil {
+		log.Fatalf("Failed to configure quiet hours: %v", err)
+	}
+	if quiet != nil {
+		quiet.send = notifier
+		notifier = quietNotifier{Notifier: notifier, hours: quiet}
+	}
+	preferences, err := newPreferences(state)
+	if err != nil {
+		log.Fatalf("Failed to load notification preferences: %v", err)
+	}
+	preferences.send = notifier
+	notifier = preferencesNotifier{Notifier: notifier, prefs: preferences}
+
+	freezes, err := newFreezes(cfg.Freezes, state)
+	if err != nil {
+		log.Fatalf("Failed to configure freeze windows: %v", err)
+	}
+	outgoing, err := newOutgoingWebhooks(cfg.OutgoingWebhooks, dryRun)
+	if err != nil {
+		log.Fatalf("Failed to configure outgoing webhooks: %v", err)
+	}
+	eventDB, err := newEventDB()
+	if err != nil {
+		log.Fatalf("Failed to connect to the event database: %v", err)
+	}
+	eventBus, err := newEventBus(dryRun)
+	if err != nil {
+		log.Fatalf("Failed to connect to the event bus: %v", err)
+	}
+	audit, err := newAuditLog(state)
+	if err != nil {
+		log.Fatalf("Failed to load audit log: %v", err)
+	}
+	archive, err := newWebhookArchive()
+	if err != nil {
+		log.Fatalf("Failed to configure the webhook archive: %v", err)
+	}
+
+	// shared is what every gitlab instance's bot has in common, see newBot
+	shared := bot{
+		notifier:           notifier,
+		slackSigningSecret: os.Getenv(SLACK_SIGNING_SECRET_ENV_VAR),
+		scheduler:          schedule.New(),
+		freezes:            freezes,
+		audit:              audit,
+		status:             newBotStatus(),
+		outgoing:           outgoing,
+		eventDB:            eventDB,
+		eventBus:           eventBus,
+		locales:            locales,
+		scripts:            scripts,
+		opa:                opa,
+		systemHooks:        newSystemHooks(cfg.SystemHooks, os.Getenv(SYSTEM_HOOK_SECRET_ENV_VAR)),
+		instances:          registry,
+		reloader:           reloader,
+		archive:            archive,
+		jira:               jiraFromEnv(dryRun),
+		quietHours:         quiet,
+		preferences:        preferences,
+	}
+	if channel := os.Getenv(INCIDENT_SLACK_CHANNEL_ENV_VAR); channel != "" {
+		environments := os.Getenv(INCIDENT_ENVIRONMENTS_ENV_VAR)
+		if environments == "" {
+			environments = DEFAULT_INCIDENT_ENVIRONMENTS
+		}
+		shared.incidents = newIncidentMode(channel, environments)
+	}
+	if channel := os.Getenv(DEPLOY_DIGEST_SLACK_CHANNEL_ENV_VAR); channel != "" {
+		at := os.Getenv(DEPLOY_DIGEST_TIME_ENV_VAR)
+		if at == "" {
+			at = DEFAULT_DEPLOY_DIGEST_TIME
+		}
+		shared.deployDigest, err = newDeployDigest(channel, at, state)
+		if err != nil {
+			log.Fatalf("Failed to configure deployment digest: %v", err)
+		}
+	}
+	shared.dedupNotifications, _ = strconv.ParseBool(os.Getenv(NOTIFICATION_DEDUP_ENV_VAR))
+	shared.slackAdmins = make(map[string]bool)
+	for _, admin := range strings.Split(os.Getenv(SLACK_ADMIN_USERS_ENV_VAR), ",") {
+		if admin = strings.TrimSpace(admin); admin != "" {
+			shared.slackAdmins[admin] = true
+		}
+	}
+
+	// the default instance keeps the state file's top level, so adding instances doesn't lose its state
+	b := newBot(shared, cfg, defaultInstance, state, gitlabHTTP, slk, dryRun)
+	for _, inst := range cfg.Instances {
+		newBot(shared, cfg, inst, state.Namespace("instances/"+inst.Name), gitlabHTTP, slk, dryRun)
+	}
+	return b, slk, email
+}
+
+// runServe runs the bot, and is what it does without a command
+func runServe(args []string) {
+	flag.NewFlagSet(COMMAND_SERVE, flag.ExitOnError).Parse(args)
+	b, _, email := setup(true)
+	reloadInterval, err := time.ParseDuration(os.Getenv(CONFIG_RELOAD_INTERVAL_ENV_VAR))
+	if err != nil || reloadInterval <= 0 {
+		reloadInterval = DEFAULT_CONFIG_RELOAD_INTERVAL
+	}
+	b.reloader.watch(reloadInterval)
+
+	if b.deployDigest != nil {
+		b.scheduler.Daily("deployment digest", b.deployDigest.hour, b.deployDigest.minute, time.Local, b.postDeployDigest)
+	}
+	if b.freezes != nil && b.freezes.cfg.ICal != "" {
+		b.scheduler.EveryReplica("freeze calendar refresh", FREEZE_ICAL_REFRESH, func() {
+			if err := b.freezes.refresh(); err != nil {
+				logrus.WithError(err).Error("failed to refresh the freeze calendar")
+			}
+		})
+	}
+	if email != nil {
+		at := os.Getenv(EMAIL_DIGEST_TIME_ENV_VAR)
+		if at == "" {
+			at = DEFAULT_EMAIL_DIGEST_TIME
+		}
+		hour, minute, loc, err := parseDigestTime(at, "")
+		if err != nil {
+			log.Fatalf("Failed to configure email digests: %v", err)
+		}
+		b.scheduler.Every("hourly email digests", time.Hour, func() { email.Flush(notify.EMAIL_DIGEST_HOURLY) })
+		b.scheduler.Daily("daily email digests", hour, minute, loc, func() { email.Flush(notify.EMAIL_DIGEST_DAILY) })
+	}
+	if b.quietHours != nil {
+		b.scheduler.Every("quiet hours", QUIET_HOURS_CHECK_INTERVAL, b.quietHours.flush)
+	}
+	dmDigestAt := os.Getenv(DM_DIGEST_TIME_ENV_VAR)
+	if dmDigestAt == "" {
+		dmDigestAt = DEFAULT_DM_DIGEST_TIME
+	}
+	hour, minute, loc, err := parseDigestTime(dmDigestAt, "")
+	if err != nil {
+		log.Fatalf("Failed to configure DM digests: %v", err)
+	}
+	b.scheduler.Daily("DM digests", hour, minute, loc, b.preferences.flush)
+	if b.archive != nil {
+		b.scheduler.EveryReplica("webhook archive retention", WEBHOOK_ARCHIVE_PRUNE_INTERVAL, b.archive.prune)
+	}
+	elector, err := newLeaderElector()
+	if err != nil {
+		log.Fatalf("Failed to start leader election: %v", err)
+	}
+	if elector != nil {
+		b.scheduler.Elect(elector)
+	}
+	b.scheduler.Start()
+	if backfill, _ := strconv.ParseBool(os.Getenv(BACKFILL_ON_STARTUP_ENV_VAR)); backfill {
+		for _, target := range b.instances.all() {
+			go target.triggeredBy(BACKFILL_TRIGGER).backfill("")
+		}
+	}
+
+	addrs, adminAddrs, err := listenAddrsFromEnv()
+	if err != nil {
+		log.Fatalf("Failed to configure listeners: %v", err)
+	}
+
+	limits, err := newWebhookLimits()
+	if err != nil {
+		log.Fatalf("Failed to configure webhook limits: %v", err)
+	}
+
+	r := gin.Default()
+	// otherwise anyone can pick the address they're rate limited and logged as with X-Forwarded-For
+	if err := r.SetTrustedProxies(trustedProxiesFromEnv()); err != nil {
+		log.Fatalf("Failed to configure trusted proxies: %v", err)
+	}
+	// the per-project limit goes by what the webhook says, so it waits for the webhook's secret to be checked
+	r.POST("/gitlab/callback", limits.middleware(b.status), b.instances.handle(bot.verifyWebhook), limits.projectMiddleware(b.status), b.instances.handle(bot.gitlabCallbackRouter))
+	if b.systemHooks != nil {
+		r.POST("/gitlab/system", limits.middleware(b.status), b.instances.handle(bot.verifySystemHook), limits.projectMiddleware(b.status), b.instances.handle(bot.gitlabSystemRouter))
+	}
+	if os.Getenv(GITLAB_OAUTH_REDIRECT_URL_ENV_VAR) != "" {
+		r.GET("/gitlab/oauth/callback", b.gitlabOAuthCallbackRouter)
+	}
+	if b.slackSigningSecret != "" {
+		slackRoutes := r.Group("/slack", slackauth.Verifier{Secret: b.slackSigningSecret}.Middleware())
+		slackRoutes.POST("/interactive", b.instances.serve("", bot.slackInteractiveRouter))
+		slackRoutes.POST("/commands", b.instances.serve("", bot.slackCommandRouter))
+		slackRoutes.POST("/events", b.instances.serve("", bot.slackEventsRouter))
+	} else {
+		logrus.Warn("no slack signing secret set, slack message buttons and slash commands disabled")
+	}
+	r.GET("/healthz", healthRouter)
+	admin := b.adminServer(os.Getenv(ADMIN_USERNAME_ENV_VAR), os.Getenv(ADMIN_PASSWORD_ENV_VAR))
+
+	panic(serve(
+		listener{name: "webhooks", addrs: addrs, handler: r},
+		listener{name: "admin endpoints", addrs: adminAddrs, handler: admin},
+	))
+}
+
+// newBot sets up the bot for one gitlab instance on top of what all instances share, and registers it with the others.
+// it's run from setup, so a misconfigured instance stops the bot from starting
+func newBot(shared bot, cfg *botConfig, inst instanceConfig, state *store.Store, gitlabHTTP httpsettings.Settings, slk *slack.Client, dryRun bool) bot {
+	oauth, err := newGitLabOAuth(inst, gitlabHTTP.Client(), state)
+	if err != nil {
+		log.Fatalf("Failed to configure gitlab OAuth application: %v", err)
+	}
+	var gl *gitlab.Client
+	var token *privateToken
+	if oauth != nil {
+		gl, err = gitlab.NewOAuthClient("", gitlab.WithBaseURL(inst.URL), gitlab.WithHTTPClient(oauth.httpClient(gitlabHTTP.Client())))
+	} else {
+		var client *http.Client
+		token, client = newPrivateToken(secretFromEnv(inst.TokenEnv), gitlabHTTP.Client())
+		gl, err = gitlab.NewClient(token.token, gitlab.WithBaseURL(inst.URL), gitlab.WithHTTPClient(client))
+	}
+	if err != nil {
+		log.Fatalf("Failed to create client: %v", err)
+	}
+	var api GitLabAPI = gitlabClient{Client: gl, oauth: oauth}
+	if dryRun {
+		api = dryRunGitLab{api}
+	}
+
+	slas, err := newReviewSLAs(state)
+	if err != nil {
+		log.Fatalf("Failed to load review SLAs: %v", err)
+	}
+	signoffs, err := newReleaseSignoffs(cfg.ReleaseSignoff, state)
+	if err != nil {
+		log.Fatalf("Failed to configure release sign-offs: %v", err)
+	}
+	if signoffs != nil {
+		signoffs.instance = inst.Name
+	}
+	labelRules, err := compileLabelRules(cfg.Projects)
+	if err != nil {
+		log.Fatalf("Failed to configure label rules: %v", err)
+	}
+	experts, err := compileExpertRules(cfg.Projects)
+	if err != nil {
+		log.Fatalf("Failed to configure expert rules: %v", err)
+	}
+	targetBranches, err := compileTargetBranches(cfg.Projects)
+	if err != nil {
+		log.Fatalf("Failed to configure target branches: %v", err)
+	}
+	routingRules, err := compileRoutingRules(cfg.RoutingRules)
+	if err != nil {
+		log.Fatalf("Failed to configure routing rules: %v", err)
+	}
+	recognition, err := newRecognition(cfg.Recognition, state)
+	if err != nil {
+		log.Fatalf("Failed to load review recognition: %v", err)
+	}
+	handoffs, err := newHandoffs(state)
+	if err != nil {
+		log.Fatalf("Failed to load review handoffs: %v", err)
+	}
+	watches, err := newWatches(state)
+	if err != nil {
+		log.Fatalf("Failed to load file watches: %v", err)
+	}
+	comments, err := newMRComments(cfg.Comments, state)
+	if err != nil {
+		log.Fatalf("Failed to load comment opt-outs: %v", err)
+	}
+	poller, err := newPoller(state)
+	if err != nil {
+		log.Fatalf("Failed to configure merge request polling: %v", err)
+	}
+	cherryPicks, err := newCherryPicks(state)
+	if err != nil {
+		log.Fatalf("Failed to load requested cherry-picks: %v", err)
+	}
+	workingHours, err := newWorkingHours(cfg.Users, state)
+	if err != nil {
+		log.Fatalf("Failed to configure working hours: %v", err)
+	}
+	pagerDuty, err := newPagerDuty(state, dryRun)
+	if err != nil {
+		log.Fatalf("Failed to configure PagerDuty: %v", err)
+	}
+	threads, err := newThreads(state)
+	if err != nil {
+		log.Fatalf("Failed to load slack threads: %v", err)
+	}
+	cycleTimes, err := newCycleTimes(state)
+	if err != nil {
+		log.Fatalf("Failed to load merge request cycle times: %v", err)
+	}
+	dora, err := newDora(state)
+	if err != nil {
+		log.Fatalf("Failed to load DORA metrics: %v", err)
+	}
+	snoozes, err := newSnoozes(state, DEFAULT_SNOOZE_DURATION)
+	if err != nil {
+		log.Fatalf("Failed to load snoozes: %v", err)
+	}
+	reminders, err := newPendingReminders(state)
+	if err != nil {
+		log.Fatalf("Failed to load reminders: %v", err)
+	}
+	blocked, err := newBlockedMRs(state)
+	if err != nil {
+		log.Fatalf("Failed to load merge request blockers: %v", err)
+	}
+	rebases, err := newRebases(state)
+	if err != nil {
+		log.Fatalf("Failed to load rebased merge requests: %v", err)
+	}
+	drafts, err := newDrafts(state)
+	if err != nil {
+		log.Fatalf("Failed to load drafts: %v", err)
+	}
+	issueAssignees, err := newIssueAssignees(state)
+	if err != nil {
+		log.Fatalf("Failed to load issue assignees: %v", err)
+	}
+	trunk, err := newTrunkHealth(state)
+	if err != nil {
+		log.Fatalf("Failed to load default branch health: %v", err)
+	}
+
+	b := shared
+	b.instance = inst.Name
+	b.gl = api
+	b.oauth = oauth
+	b.token = token
+	b.routes = newRoutes(cfg.Projects)
+	b.groupRoutes = newGroupRoutes(cfg.Groups)
+	b.projects = newProjectSettings(cfg.Projects)
+	if err := validatePolicies(cfg.Policies); err != nil {
+		log.Fatalf("Failed to configure policies: %v", err)
+	}
+	if err := validateReviewerCounts(cfg.Projects); err != nil {
+		log.Fatalf("Failed to configure reviewer counts: %v", err)
+	}
+	if err := validateRebaseModes(cfg.Projects); err != nil {
+		log.Fatalf("Failed to configure rebasing: %v", err)
+	}
+	if err := validateEventFilters(cfg.Projects); err != nil {
+		log.Fatalf("Failed to configure event filters: %v", err)
+	}
+	if err := validateDND(cfg.Projects); err != nil {
+		log.Fatalf("Failed to configure do not disturb: %v", err)
+	}
+	b.policies = newPolicies(cfg.Policies, cfg.Projects)
+	b.labelRules = labelRules
+	b.targetBranches = targetBranches
+	b.experts = experts
+	b.routingRules = routingRules
+	b.groupMembers = newGroupMembers()
+	b.routingLookups = newRoutingLookups()
+	b.defaultRoutes = newDefaultRouter(cfg.DefaultRoutes)
+	b.users = newUserMapper(slk, api, cfg.Users)
+	b.snoozes = snoozes
+	b.reminders = reminders
+	b.threads = threads
+	b.blocked = blocked
+	b.rebases = rebases
+	b.drafts = drafts
+	b.stale = staleRemindersFromEnv()
+	b.debounce = debouncerFromEnv()
+	b.slas = slas
+	b.issueAssignees = issueAssignees
+	b.signoffs = signoffs
+	b.trunk = trunk
+	b.recognition = recognition
+	b.handoffs = handoffs
+	b.comments = comments
+	b.poller = poller
+	b.cherryPicks = cherryPicks
+	b.changelog = newChangelog(cfg.Changelog)
+	b.workingHours = workingHours
+	b.userStatuses = userStatusesFromEnv()
+	b.pagerDuty = pagerDuty
+	b.cycleTimes = cycleTimes
+	b.dora = dora
+	b.watches = watches
+	b.artifactLabel = DEFAULT_ARTIFACT_REVIEW_LABEL
+	b.userRetry = retryPolicyFromEnv(USER_LOOKUP_RETRIES_ENV_VAR, USER_LOOKUP_RETRY_INTERVAL_ENV_VAR)
+	b.webhookAuth = webhookAuthFromEnv(inst.WebhookSecretEnv)
+	if b.webhookAuth == nil {
+		logrus.Warnf("no gitlab webhook secret set for %s, anyone who can reach /gitlab/callback can send events", inst.URL)
+	}
+	if b.reviewerPool, err = parseReviewerPool(os.Getenv(REVIEWER_POOL_ENV_VAR)); err != nil {
+		log.Fatalf("Failed to configure reviewer selection: %v", err)
+	}
+	b.reviewersSupported = supportsReviewers(api)
+	if b.assignMode, err = parseAssignMode(os.Getenv(ASSIGN_AS_ENV_VAR), b.reviewersSupported); err != nil {
+		log.Fatalf("Failed to configure merge request assignment: %v", err)
+	}
+	b.resetApprovalsOnPush, _ = strconv.ParseBool(os.Getenv(RESET_APPROVALS_ON_PUSH_ENV_VAR))
+	if label := os.Getenv(ARTIFACT_REVIEW_LABEL_ENV_VAR); label != "" {
+		b.artifactLabel = label
+	}
+	if d, err := time.ParseDuration(os.Getenv(SNOOZE_DURATION_ENV_VAR)); err == nil && d > 0 {
+		b.snoozes.duration = d
+	}
+	if days, err := strconv.Atoi(os.Getenv(APPROVAL_EXPIRY_DAYS_ENV_VAR)); err == nil && days > 0 {
+		logrus.Infof("approvals older than %d days will be treated as stale", days)
+		if b.expiry, err = newApprovalExpiry(days, state); err != nil {
+			log.Fatalf("Failed to load stale approvals: %v", err)
+		}
+	}
+
+	if at := os.Getenv(OPEN_MR_DIGEST_TIME_ENV_VAR); at != "" {
+		hour, minute, loc, err := parseDigestTime(at, os.Getenv(OPEN_MR_DIGEST_TIMEZONE_ENV_VAR))
+		if err != nil {
+			log.Fatalf("Failed to configure open merge request digest: %v", err)
+		}
+		b.scheduler.Daily(b.jobName("open merge request digest"), hour, minute, loc, b.instances.run(inst.Name, "open merge request digest", bot.postOpenMRDigests))
+	}
+	if b.stale != nil {
+		interval, err := time.ParseDuration(os.Getenv(STALE_MR_SCAN_INTERVAL_ENV_VAR))
+		if err != nil || interval <= 0 {
+			interval = DEFAULT_STALE_MR_SCAN_INTERVAL
+		}
+		b.scheduler.Every(b.jobName("stale merge request reminders"), interval, b.instances.run(inst.Name, "stale merge request reminders", bot.remindStale))
+	}
+	if day := os.Getenv(REVIEWER_LOAD_REPORT_DAY_ENV_VAR); day != "" {
+		weekday, err := parseWeekday(day)
+		if err != nil {
+			log.Fatalf("Failed to configure reviewer load report: %v", err)
+		}
+		at := os.Getenv(REVIEWER_LOAD_REPORT_TIME_ENV_VAR)
+		if at == "" {
+			at = DEFAULT_REVIEWER_LOAD_REPORT_TIME
+		}
+		hour, minute, loc, err := parseDigestTime(at, "")
+		if err != nil {
+			log.Fatalf("Failed to configure reviewer load report: %v", err)
+		}
+		b.scheduler.Weekly(b.jobName("reviewer load report"), weekday, hour, minute, loc, b.instances.run(inst.Name, "reviewer load report", bot.postReviewerLoadReports))
+	}
+	if day := os.Getenv(CYCLE_TIME_REPORT_DAY_ENV_VAR); day != "" {
+		weekday, err := parseWeekday(day)
+		if err != nil {
+			log.Fatalf("Failed to configure cycle time report: %v", err)
+		}
+		at := os.Getenv(CYCLE_TIME_REPORT_TIME_ENV_VAR)
+		if at == "" {
+			at = DEFAULT_CYCLE_TIME_REPORT_TIME
+		}
+		hour, minute, loc, err := parseDigestTime(at, "")
+		if err != nil {
+			log.Fatalf("Failed to configure cycle time report: %v", err)
+		}
+		b.scheduler.Weekly(b.jobName("cycle time report"), weekday, hour, minute, loc, b.instances.run(inst.Name, "cycle time report", bot.postCycleTimeReports))
+	}
+	if day := os.Getenv(FLAKY_TEST_REPORT_DAY_ENV_VAR); day != "" {
+		weekday, err := parseWeekday(day)
+		if err != nil {
+			log.Fatalf("Failed to configure flaky test report: %v", err)
+		}
+		at := os.Getenv(FLAKY_TEST_REPORT_TIME_ENV_VAR)
+		if at == "" {
+			at = DEFAULT_FLAKY_TEST_REPORT_TIME
+		}
+		hour, minute, loc, err := parseDigestTime(at, "")
+		if err != nil {
+			log.Fatalf("Failed to configure flaky test report: %v", err)
+		}
+		if b.flaky, err = newFlakyJobs(state); err != nil {
+			log.Fatalf("Failed to load flaky jobs: %v", err)
+		}
+		b.scheduler.Weekly(b.jobName("flaky test report"), weekday, hour, minute, loc, b.instances.run(inst.Name, "flaky test report", bot.postFlakyTestReports))
+	}
+	blockedScan, err := time.ParseDuration(os.Getenv(BLOCKED_SCAN_INTERVAL_ENV_VAR))
+	if err != nil || blockedScan <= 0 {
+		blockedScan = DEFAULT_BLOCKED_SCAN_INTERVAL
+	}
+	b.scheduler.Every(b.jobName("blocked merge request scan"), blockedScan, b.instances.run(inst.Name, "blocked merge request scan", bot.scanBlocked))
+	b.scheduler.Every(b.jobName("review SLAs"), REVIEW_SLA_SCAN_INTERVAL, b.instances.run(inst.Name, "review SLAs", bot.checkReviewSLAs))
+	b.scheduler.Every(b.jobName("snooze reminders"), SNOOZE_CHECK_INTERVAL, b.instances.run(inst.Name, "snooze reminders", bot.remindSnoozed))
+	b.scheduler.Every(b.jobName("comment reminders"), REMINDER_CHECK_INTERVAL, b.instances.run(inst.Name, "comment reminders", bot.remindDue))
+	if b.poller != nil {
+		b.scheduler.Every(b.jobName("merge request polling"), b.poller.interval, b.instances.run(inst.Name, "merge request polling", bot.poll))
+	}
+	if b.workingHours != nil {
+		b.scheduler.Every(b.jobName("working hours assignment queue"), WORKING_HOURS_RETRY_INTERVAL, b.instances.run(inst.Name, "working hours assignment queue", bot.assignQueued))
+	}
+	if oauth != nil {
+		b.scheduler.Every(b.jobName("gitlab OAuth token renewal"), GITLAB_OAUTH_RENEW_INTERVAL, oauth.renew)
+	}
+
+	b.instances.add(inst.Name, inst.URL, b)
+	return b
+}
+
+func (bot bot) gitlabCallbackRouter(c *gin.Context) {
+	defer bot.status.handling()()
+	b, err := ioutil.ReadAll(c.Request.Body)
+	if err != nil {
+		logrus.Errorf("Failed to read request body '%v'", err)
+		http.Error(c.Writer, http.StatusText(http.StatusOK), http.StatusOK)
+		return
+	}
+	if bot.archive != nil {
+		bot.archive.save(bot.instance, c.Request, b, bot.status)
+	}
+	slackChan := c.Request.URL.Query()[GITLAB_SLACK_CHANNEL_QUERY_PARAM]
+	group := c.Query(GITLAB_GROUP_QUERY_PARAM)
+	if len(slackChan) == 0 && group == "" {
+		// keep going: incident escalation doesn't need a channel, and everything else will just be logged
+		bodyBytes, _ := httputil.DumpRequest(c.Request, false)
+		logrus.Errorf("Failed to read %s URL parameter from callback request %s", GITLAB_SLACK_CHANNEL_QUERY_PARAM, string(bodyBytes))
+	}
+
+	webhook, err := gitlab.ParseWebhook(gitlab.WebhookEventType(c.Request), b)
+	if err != nil {
+		logrus.Errorf("Failed to parse gitlab webhook with type '%s', '%v'", c.Request.Header.Get(HEADER_GITLAB_EVENT), err)
+		bot.status.fail("unparseable webhook")
+		bot.status.delivered(webhookDelivery{Instance: bot.instance, Kind: c.Request.Header.Get(HEADER_GITLAB_EVENT), Result: DELIVERY_ERROR, Outcome: "unparseable: " + err.Error()})
+		http.Error(c.Writer, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+	kind := c.Request.Header.Get(HEADER_GITLAB_EVENT)
+	if _, handled := bot.handleWebhook(kind, webhook, slackChan, group); !handled {
+		logrus.Errorf("Not handling event '%s', because we don't care about it", kind)
+		http.Error(c.Writer, http.StatusText(http.StatusNoContent), http.StatusNoContent)
+		return
+	}
+	c.Writer.WriteHeader(http.StatusOK)
+}
+
+// handleWebhook routes the parsed webhook (kind is its X-Gitlab-Event) to its channels and handles it, returning where
+// it went and how it went.  handled is false for events we don't care about
+func (bot bot) handleWebhook(kind string, webhook interface{}, slackChan []string, group string) (delivery webhookDelivery, handled bool) {
+	project, id := webhookProject(webhook)
+	if project != "" {
+		bot.status.event(project, kind)
+		slackChan = bot.route(project, id, slackChan, group)
+	}
+	slackChan = bot.applyRoutingRules(webhook, slackChan)
+	slackChan = bot.scriptedRoute(project, webhook, slackChan)
+	trigger := webhookTrigger(kind, webhook)
+	bot = bot.triggeredBy(trigger).filterEvents(project, webhook).about(project)
+	delivery = webhookDelivery{At: time.Now(), Instance: bot.instance, Project: project, Kind: kind, Event: trigger, Channels: slackChan,
+		Result: DELIVERY_HANDLED, Outcome: "handled"}
+	if len(slackChan) == 0 {
+		delivery.Result, delivery.Outcome = DELIVERY_IGNORED, "no channels to notify"
+	} else if !bot.projects[project].notifies(webhook) {
+		delivery.Result, delivery.Outcome = DELIVERY_IGNORED, "left out by the project's event filters"
+	}
+	defer func() {
+		if !handled {
+			delivery.Result, delivery.Outcome = DELIVERY_IGNORED, "we don't handle "+kind+" events"
+		} else if failed := bot.failedSince(trigger, delivery.At); len(failed) > 0 {
+			delivery.Result, delivery.Outcome = DELIVERY_ERROR, strings.Join(failed, "; ")
+		}
+		bot.status.delivered(delivery)
+	}()
+
+	switch wh := webhook.(type) {
+	case *gitlab.MergeEvent: // actually a Merge Request event...
+		bot.mergeRequest(wh, slackChan)
+	case *gitlab.PipelineEvent:
+		bot.pipeline(wh, slackChan)
+	case *gitlab.DeploymentEvent:
+		bot.deployment(wh, slackChan)
+	case *gitlab.IssueEvent:
+		bot.issue(wh)
+	case *gitlab.TagEvent:
+		bot.tag(wh, slackChan)
+	case *gitlab.MergeCommentEvent:
+		bot.mergeComment(wh)
+	default:
+		return delivery, false
+	}
+	return delivery, true
+}
+
+// mergeRequest receives an MR
+func (bot bot) mergeRequest(mr *gitlab.MergeEvent, slackChans []string) {
+
+	logrus.SetLevel(logrus.DebugLevel)
+
+	logrus.Debugf("processing merge request webhook %+v", mr)
+
+	// TODO: what are the valid states? this docs page is not accurate for MR callbacks: https://docs.gitlab.com/ce/api/events.html#action-types
+
+	bot.recordCycleTime(mr)
+	switch mr.ObjectAttributes.Action {
+	case MR_ACTION_REOPENED:
+		fallthrough
+	case MR_ACTION_OPENED:
+		bot.autoLabel(mr)
+		bot.notifyWatchers(mr)
+		ref := mrRef(mr.Project.ID, mr.ObjectAttributes.IID)
+		bot.drafts.track(ref, mr.ObjectAttributes.WorkInProgress)
+		if mr.ObjectAttributes.WorkInProgress && bot.projects[mr.Project.PathWithNamespace].DeferDrafts {
+			logrus.Debugf("deferring draft merge request !%d until it's marked ready", mr.ObjectAttributes.IID)
+			bot.drafts.deferDraft(ref)
+			return
+		}
+		bot.announceNewMR(mr, slackChans)
+	case MR_ACTION_UPDATED:
+		if mr.ObjectAttributes.OldRev != "" { // new commits may touch new paths
+			bot.autoLabel(mr)
+			bot.notifyWatchers(mr)
+		}
+		if bot.resetApprovalsOnPush {
+			bot.resetApprovals(mr, slackChans)
+		}
+
+		if bot.leftDraft(mr) {
+			bot.markedReady(mr, slackChans)
+		}
+		bot.checkApprovals(mr, slackChans, false)
+		bot.checkBlocked(mr.Project.ID, mr.ObjectAttributes.IID, slackChans)
+	case MR_ACTION_APPROVED:
+		bot.react(mr.Project.ID, mr.ObjectAttributes.IID, REACTION_APPROVED, false)
+		bot.checkApprovals(mr, slackChans, true)
+		if bot.opa != nil { // approvals can satisfy or break policies
+			bot.checkBlocked(mr.Project.ID, mr.ObjectAttributes.IID, slackChans)
+		}
+		bot.recognizeReview(mr, slackChans)
+		bot.publishMR(EVENT_MR_APPROVED, mr, "")
+	case MR_ACTION_MERGED:
+		bot.react(mr.Project.ID, mr.ObjectAttributes.IID, REACTION_MERGED, false)
+		bot.drafts.forget(mrRef(mr.Project.ID, mr.ObjectAttributes.IID))
+		bot.watches.forget(mrRef(mr.Project.ID, mr.ObjectAttributes.IID))
+		bot.blocked.close(mrRef(mr.Project.ID, mr.ObjectAttributes.IID))
+		if bot.expiry != nil {
+			bot.expiry.forget(mrRef(mr.Project.ID, mr.ObjectAttributes.IID))
+		}
+		bot.notifyMerged(mr, slackChans)
+		bot.cherryPickMerged(mr, slackChans)
+		bot.recordChangelog(mr)
+		bot.recordDoraMerge(mr)
+		bot.transitionJira(mr, slackChans)
+		bot.warnFrozenMerge(mr, slackChans)
+		bot.publishMR(EVENT_MR_MERGED, mr, "")
+	case MR_ACTION_UNAPPROVED:
+		// somebody else may still approve of it
+		if approvals, err := bot.gl.GetMergeRequestApprovals(mr.Project.ID, mr.ObjectAttributes.IID); err == nil && len(approvals.ApprovedBy) == 0 {
+			bot.react(mr.Project.ID, mr.ObjectAttributes.IID, REACTION_APPROVED, true)
+		}
+	case MR_ACTION_CLOSED:
+		bot.react(mr.Project.ID, mr.ObjectAttributes.IID, REACTION_CLOSED, false)
+		bot.drafts.forget(mrRef(mr.Project.ID, mr.ObjectAttributes.IID))
+		bot.watches.forget(mrRef(mr.Project.ID, mr.ObjectAttributes.IID))
+		bot.blocked.close(mrRef(mr.Project.ID, mr.ObjectAttributes.IID))
+		if bot.expiry != nil {
+			bot.expiry.forget(mrRef(mr.Project.ID, mr.ObjectAttributes.IID))
+		}
+		bot.publishMR(EVENT_MR_CLOSED, mr, "")
+	}
+	if mr.ObjectAttributes.Action != MR_ACTION_OPENED {
+		bot.refreshLiveStatus(mr.Project.ID, mr.ObjectAttributes.IID)
+	}
+}
+
+// announceNewMR assigns a maintainer to the MR and tells the channels about it
+func (bot bot) announceNewMR(mr *gitlab.MergeEvent, slackChans []string) {
+	if !bot.announcesTarget(mr) {
+		return
+	}
+	// assign
+	policy := bot.policies.forProject(bot.gl, mr.Project.ID)
+	assignee, err := bot.assignReview(mr, policy)
+	if errors.Is(err, errNobodyAvailable) {
+		logrus.Infof("nobody can review merge request !%d in %s right now, it'll be assigned and announced once someone's working", mr.ObjectAttributes.IID, mr.Project.PathWithNamespace)
+		bot.workingHours.enqueue(mr, slackChans)
+		return
+	}
+	if err != nil {
+		logrus.WithError(err).Error("Failed to assign maintainer to merge request")
+		return
+	}
+	if bot.workingHours != nil {
+		bot.workingHours.dequeue(mrRef(mr.Project.ID, mr.ObjectAttributes.IID))
+	}
+	bot.status.assigned(instanceValue(bot.instance, mr.Project.PathWithNamespace), mr.ObjectAttributes.IID, assignee)
+
+	short := 0
+	if candidates, err := bot.candidatesFor(mr, bot.reviewerPoolFor(policy)); err != nil {
+		logrus.WithError(err).Error("Failed to tag additional reviewers on merge request")
+	} else if short, err = ensureTotalMaintainers(bot.gl, bot.comments, mr, bot.reviewersWanted(mr, policy), candidates); err != nil {
+		logrus.WithError(err).Error("Failed to tag additional reviewers on merge request")
+	}
+
+	bot.publishMR(EVENT_MR_OPENED, mr, "")
+	bot.publishMR(EVENT_MR_ASSIGNED, mr, assignee)
+
+	// notify
+	bot.notifyNewMR(mr, assignee, slackChans)
+	if short > 0 {
+		bot.askSlackGroup(mr, policy, short, slackChans)
+	}
+	bot.trackReviewSLA(mr, slackChans)
+}
+
+// ensureTotalMaintainers reviews the current participants for maintainers.
+//If below the given `totalReviewers` then additional maintainers are tagged to reach the desired amount.
+//Returns how many reviewers are still missing, when there weren't enough maintainers to tag
+func ensureTotalMaintainers(gl GitLabAPI, comments *mrComments, mr *gitlab.MergeEvent, totalReviewers int, maintainers reviewCandidates) (int, error) {
+	// who all is participating in this review
+	participants, err := gl.GetMergeRequestParticipants(mr.Project.ID, mr.ObjectAttributes.IID)
+	if err != nil {
+		return 0, err
+	}
+	participating := make(map[int]bool)
+	for _, p := range participants {
+		participating[p.ID] = true
+	}
+	participating[mr.ObjectAttributes.AssigneeID] = true // may have just been assigned, and not be a participant yet
+	if current, err := gl.GetMergeRequest(mr.Project.ID, mr.ObjectAttributes.IID); err == nil {
+		for _, r := range current.Reviewers { // requested reviewers count too
+			participating[r.ID] = true
+		}
+	}
+
+	// maintainers who aren't around right now still count if they're already participating
+	away := 0
+	for _, m := range maintainers.all {
+		if participating[m.ID] && m.ID != mr.ObjectAttributes.AuthorID && memberByID(maintainers.available, m.ID) == nil {
+			away++
+		}
+	}
+
+	// while we're below the desired number of reviewers, roll random available maintainers that aren't already
+	// participating (or the author, who can't review their own MR)
+	add, reviewers := assign.TopUp(memberIDs(maintainers.available), participating, mr.ObjectAttributes.AuthorID, totalReviewers-away)
+	reviewers += away
+	var toTag []string
+	for _, id := range add {
+		toTag = append(toTag, "@"+memberByID(maintainers.available, id).Username)
+	}
+	short := 0
+	if reviewers < totalReviewers {
+		short = totalReviewers - reviewers
+		logrus.Warnf("merge request !%d wants %d reviewers but the project only has %d maintainers to offer", mr.ObjectAttributes.IID, totalReviewers, reviewers)
+	}
+	if len(toTag) == 0 {
+		return short, nil
+	}
+
+	// send the comment string to gitlab, which tags the maintainers and makes them participants
+	return short, comments.post(gl, mr.Project.ID, mr.ObjectAttributes.IID, strings.Join(toTag, " ")+" please review this merge request.")
+}
+
+func (bot bot) notifyNewMR(mr *gitlab.MergeEvent, assignee string, slackChans []string) {
+	author := UNKNOWN_AUTHOR
+	user, err := bot.gl.GetUser(mr.ObjectAttributes.AuthorID)
+	if err != nil {
+		logrus.WithError(err).Error("unable to see who opened the merge request. continuing...")
+	} else {
+		author = user.Name
+	}
+
+	msg := bot.newMRMessage(mr, author, assignee)
+	full, linked := bot.dedupChannels(slackChans)
+	sent := bot.notifyBlocksLocalized(msg, bot.newMRBlocks(mr.Project.ID, mr.ObjectAttributes.IID), full)
+	bot.threads.record(mrRef(mr.Project.ID, mr.ObjectAttributes.IID), sent)
+	// follow-ups are threaded under the announcement, not the links to it
+	bot.linkAnnouncement(mr, msg, sent, linked)
+	if author == UNKNOWN_AUTHOR && len(sent) > 0 {
+		go bot.repairAuthor(mr, assignee, sent)
+	}
+}
+
+// newMRMessage is the new MR notification, to be rendered in each channel's locale.  see newMRBlocks for its buttons
+func (bot bot) newMRMessage(mr *gitlab.MergeEvent, author, assignee string) localized {
+	url := mr.ObjectAttributes.URL
+	repo := mr.ObjectAttributes.Target.Name
+	headline := tr("New merge request in `%s` from %s has been assigned to %s.  See %s for details.", repo, author, assignee, url)
+	if mr.ObjectAttributes.WorkInProgress {
+		headline = tr("New WIP merge request in `%s` from %s has been assigned to %s.  See %s for details.", repo, author, assignee, url)
+	}
+
+	format, args := "%s", []interface{}{headline}
+	if description := mrkdwn.Excerpt(mr.ObjectAttributes.Description, mr.Project.WebURL, MR_DESCRIPTION_EXCERPT_LENGTH); description != "" {
+		format, args = format+"\n\n%s\n", append(args, description)
+	}
+	if size := bot.sizeBadge(mr.Project.ID, mr.ObjectAttributes.IID); size != "" {
+		format, args = format+"\n%s", append(args, tr("Size: %s", size))
+	}
+	if pipeline := bot.headPipelineStatus(mr.Project.ID, mr.ObjectAttributes.IID); pipeline != "" {
+		format, args = format+"\n%s", append(args, tr("Pipeline: %s", pipeline))
+	}
+	if approvals := bot.approvalProgress(mr.Project.ID, mr.ObjectAttributes.IID); approvals != "" {
+		format, args = format+"\n%s", append(args, tr("Approvals: %s", approvals))
+	}
+	if issues := bot.jiraSummary(mr); issues != "" {
+		format, args = format+"\n%s", append(args, issues)
+	}
+	return tr(format, args...)
+}
+
+// newMRBlocks lays out the rendered new MR notification with its buttons.  it's nil when the message has no buttons
+func (bot bot) newMRBlocks(projectID, iid int) func(text string) []slack.Block {
+	if bot.slackSigningSecret == "" {
+		return nil
+	}
+	return func(text string) []slack.Block {
+		return []slack.Block{
+			slack.NewSectionBlock(slack.NewTextBlockObject(slack.MarkdownType, text, false, false), nil, nil),
+			bot.mrActionBlock(projectID, iid),
+		}
+	}
+}
+
+// checkApprovals expires any stale approvals on the MR.  If announceReady is set and the MR has enough
+// fresh approvals, the channels are told it's ready to merge
+func (bot bot) checkApprovals(mr *gitlab.MergeEvent, slackChans []string, announceReady bool) {
+	policy := bot.policies.forProject(bot.gl, mr.Project.ID)
+	if bot.expiry == nil && !(announceReady && policy.AutoMerge) {
+		return
+	}
+	var ready bool
+	var err error
+	if bot.expiry != nil {
+		ready, err = bot.expireStaleApprovals(mr)
+	} else {
+		var approvals *gitlab.MergeRequestApprovals
+		if approvals, err = bot.gl.GetMergeRequestApprovals(mr.Project.ID, mr.ObjectAttributes.IID); err == nil {
+			ready = readyToMerge(approvals, nil)
+		}
+	}
+	if err != nil {
+		logrus.WithError(err).Error("failed to check merge request approvals")
+		return
+	}
+	if ready && announceReady && bot.trunk.isBroken(mr.Project.ID, mr.ObjectAttributes.TargetBranch) {
+		bot.notifyThreadLocalized(mr.Project.ID, mr.ObjectAttributes.IID, tr("<%s|!%d> is approved, but `%s` is broken.  Hold off merging until it's green again.",
+			mr.ObjectAttributes.URL, mr.ObjectAttributes.IID, mr.ObjectAttributes.TargetBranch), slackChans)
+		return
+	}
+	if ready && announceReady {
+		if denials := bot.policyDenials(mr.Project.ID, mr.ObjectAttributes.IID, mr.Project.PathWithNamespace); len(denials) > 0 {
+			bot.notifyThreadLocalized(mr.Project.ID, mr.ObjectAttributes.IID, tr("<%s|!%d> is approved, but its policies don't allow merging it: %s",
+				mr.ObjectAttributes.URL, mr.ObjectAttributes.IID, strings.Join(denials, "; ")), slackChans)
+			return
+		}
+	}
+	if ready && announceReady && bot.expiry != nil {
+		bot.notifyLocalized(tr("Merge request `%s` in `%s` is approved and ready to merge.  See %s for details.",
+			mr.ObjectAttributes.Title, mr.ObjectAttributes.Target.Name, mr.ObjectAttributes.URL), slackChans)
+	}
+	if ready && announceReady && policy.AutoMerge {
+		if w, held := bot.freezes.holdsAutoMerge(mr.Project.PathWithNamespace); held {
+			bot.notifyThreadLocalized(mr.Project.ID, mr.ObjectAttributes.IID, tr(":snowflake: <%s|!%d> is approved, but auto-merge is held for the *%s* freeze.  An admin can `/freeze override %s reason`.",
+				mr.ObjectAttributes.URL, mr.ObjectAttributes.IID, w.Name, mr.Project.PathWithNamespace), slackChans)
+			return
+		}
+		bot.autoMerge(mr, policy, slackChans)
+	}
+}
+
+// notify logs the message and sends it to each of the given slack channels, returning the messages sent
+func (bot bot) notify(msg string, slackChans []string) []slackMessage {
+	logrus.Info(msg)
+	var sent []slackMessage
+	for _, slackChan := range slackChans {
+		ts, err := bot.notifier.Notify(slackChan, msg)
+		if err != nil {
+			logrus.WithError(err).Errorf("failed to send message to slack channel %s", slackChan)
+			bot.status.fail("message")
+			continue
+		}
+		sent = append(sent, slackMessage{slackChan, ts})
+	}
+	return sent
+}
+
+// notifyBlocks is notify for block kit messages.  msg is the fallback text shown in notifications
+func (bot bot) notifyBlocks(msg string, blocks []slack.Block, slackChans []string) []slackMessage {
+	logrus.Info(msg)
+	var sent []slackMessage
+	for _, slackChan := range slackChans {
+		ts, err := bot.notifier.NotifyBlocks(slackChan, msg, blocks)
+		if err != nil {
+			logrus.WithError(err).Errorf("failed to send message to slack channel %s", slackChan)
+			bot.status.fail("message")
+			continue
+		}
+		sent = append(sent, slackMessage{slackChan, ts})
+	}
+	return sent
+}
+
+// maybeAssignMaintainer will ensure the given MR has a maintainer assigned to it
+// if no maintainer is assigned, an available maintainer/owner from the target repository is chosen at random and assigned
+// if someone is assigned and is not a maintainer (i.e. the requester self-assigned),
+// then it is reassigned to a random available maintainer.  If an existing maintainer is already assigned, they remain in place.
+// With the approval rules pool, "maintainers" are the MR's eligible approvers instead.
+// Returns the maintainer's Name, and any errors encountered
+func maybeAssignMaintainer(gl GitLabAPI, mr *gitlab.MergeEvent, maintainers reviewCandidates) (string, error) {
+	if len(maintainers.all) == 0 {
+		return "", fmt.Errorf("no maintainers for repository, cannot assign a maintainer")
+	}
+	if mr.ObjectAttributes.AssigneeID != 0 { // MR is assigned to someone
+		for _, maintainer := range maintainers.all { // if it's currently assigned to a maintainer, great!
+			if maintainer.ID == mr.ObjectAttributes.AssigneeID {
+				// due to some weirdness (or error on my side) the MR callback doesn't list the assignee's name. get it.
+				user, err := gl.GetUser(mr.ObjectAttributes.AssigneeID)
+				if err != nil {
+					return "", err
+				}
+				return user.Name, nil
+			}
+		}
+	}
+	// not assigned to anyone, or it should be reassigned to a maintainer.  give it to a random one who's around, an expert in
+	// its area if possible
+	maintainer, ok := maintainers.pick()
+	if !ok {
+		return "", errNobodyAvailable
+	}
+	return maintainer.Name, assignMergeRequest(gl, mr, maintainer)
+}
+
+// assignMergeRequest sets the MR's assignee to the given maintainer
+func assignMergeRequest(gl GitLabAPI, mr *gitlab.MergeEvent, maintainer *gitlab.ProjectMember) error {
+	logrus.Infof("assigning merge request !%d in project %d to %s (%s)", mr.ObjectAttributes.IID, mr.Project.ID, maintainer.Name, maintainer.Username)
+	_, err := gl.UpdateMergeRequest(mr.Project.ID, mr.ObjectAttributes.IID, &gitlab.UpdateMergeRequestOptions{
+		AssigneeID: &maintainer.ID,
+	})
+	if err == nil {
+		mr.ObjectAttributes.AssigneeID = maintainer.ID
+	}
+	return err
+}
+
+// memberIDs are the members' user IDs, for package assign
+func memberIDs(members []*gitlab.ProjectMember) []int {
+	ids := make([]int, len(members))
+	for i, m := range members {
+		ids[i] = m.ID
+	}
+	return ids
+}
+
+// memberByID finds the member with the user ID among the members
+func memberByID(members []*gitlab.ProjectMember, id int) *gitlab.ProjectMember {
+	for _, m := range members {
+		if m.ID == id {
+			return m
+		}
+	}
+	return nil
+}
+
+// getProjectMaintainers lists the maintainers of the given project.  This does not include inherited permissions.
+func getProjectMaintainers(gl GitLabAPI, id int) (maintainers []*gitlab.ProjectMember, err error) {
+	// not inherited.  if you want inherited, slap on a `/all` at the end
+
+	page := 0
+	members, _, err := gl.ListProjectMembers(id, &gitlab.ListProjectMembersOptions{
+		ListOptions: gitlab.ListOptions{
+			Page:    page,
+			PerPage: 100,
+		},
+		Query: nil,
+	})
+	for ; ; {
+		if err != nil {
+			break
+		}
+		for _, m := range members {
+			if m == nil {
+				break
+			}
+			if m.AccessLevel >= gitlab.MaintainerPermissions {
+				maintainers = append(maintainers, m)
+			}
+		}
+		if len(members) < 100 {
+			break
+		}
+
+		page++
+		members, _, err = gl.ListProjectMembers(id, &gitlab.ListProjectMembersOptions{
+			ListOptions: gitlab.ListOptions{
+				Page:    page,
+				PerPage: 100,
+			},
+			Query: nil,
+		})
+	}
+
+	return maintainers, err
+
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/raidancampbell/gitlab-odds-and-ends/internal/store"
+	"github.com/sirupsen/logrus"
+	"github.com/slack-go/slack"
+	"github.com/xanzy/go-gitlab"
+)
+
+const (
+	ACTION_ASSIGN_TO_ME     = "assign_to_me"
+	ACTION_APPROVE_MR       = "approve_mr"
+	ACTION_SNOOZE_MR        = "snooze_mr"
+	SNOOZE_DURATION_ENV_VAR = "SNOOZE_DURATION"
+	DEFAULT_SNOOZE_DURATION = 24 * time.Hour
+	SNOOZES_STORE_KEY       = "snoozes"
+	// SNOOZE_CHECK_INTERVAL is how often snoozes are checked for being over
+	SNOOZE_CHECK_INTERVAL = time.Minute
+)
+
+// mrActionBlock is the row of buttons attached to new MR notifications
+func (bot bot) mrActionBlock(projectID, iid int) *slack.ActionBlock {
+	ref := bot.actionValue(mrRef(projectID, iid))
+	return slack.NewActionBlock("",
+		slack.NewButtonBlockElement(ACTION_ASSIGN_TO_ME, ref, slack.NewTextBlockObject(slack.PlainTextType, "Assign to me", false, false)),
+		slack.NewButtonBlockElement(ACTION_APPROVE_MR, ref, slack.NewTextBlockObject(slack.PlainTextType, "Approve", false, false)).WithStyle(slack.StylePrimary),
+		slack.NewButtonBlockElement(ACTION_SNOOZE_MR, ref, slack.NewTextBlockObject(slack.PlainTextType, "Snooze", false, false)),
+	)
+}
+
+// snooze is someone asking to hear about an MR later.  Channel, if set, is where they're reminded once it's over
+type snooze struct {
+	Ref     string    `json:"ref"`
+	User    string    `json:"user"` // slack user ID
+	Channel string    `json:"channel,omitempty"`
+	Until   time.Time `json:"until"`
+}
+
+// snoozes remembers who asked to be reminded about which MRs later, keyed by snoozeKey.  they're kept in the store, so
+// a restart doesn't lose them, and whichever replica runs the jobs reminds people when they're over
+type snoozes struct {
+	store    *store.Store
+	duration time.Duration
+	mu       sync.Mutex
+	snoozed  map[string]snooze
+}
+
+func newSnoozes(s *store.Store, duration time.Duration) (*snoozes, error) {
+	sn := &snoozes{store: s, duration: duration, snoozed: make(map[string]snooze)}
+	if _, err := s.Load(SNOOZES_STORE_KEY, &sn.snoozed); err != nil {
+		return nil, err
+	}
+	s.Follow(SNOOZES_STORE_KEY, &sn.snoozed, &sn.mu)
+	return sn, nil
+}
+
+// snoozeKey is the user's snooze of the MR
+func snoozeKey(ref, user string) string {
+	return ref + " " + user
+}
+
+// snooze the MR for the user for the configured duration, returning when the snooze ends.  with a channel, they're
+// reminded there once it's over
+func (s *snoozes) snooze(ref, user, channel string) time.Time {
+	return s.snoozeFor(ref, user, channel, s.duration)
+}
+
+// snoozeFor snoozes the MR for d instead of the configured duration
+func (s *snoozes) snoozeFor(ref, user, channel string, d time.Duration) time.Time {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	until := time.Now().Add(d)
+	s.snoozed[snoozeKey(ref, user)] = snooze{Ref: ref, User: user, Channel: channel, Until: until}
+	s.saveLocked()
+	return until
+}
+
+// isSnoozed reports whether the user has the MR snoozed
+func (s *snoozes) isSnoozed(ref, user string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sn, ok := s.snoozed[snoozeKey(ref, user)]
+	return ok && time.Now().Before(sn.Until)
+}
+
+// snoozers are the users who have the MR snoozed
+func (s *snoozes) snoozers(ref string) map[string]bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	users := make(map[string]bool)
+	now := time.Now()
+	for _, sn := range s.snoozed {
+		if sn.Ref == ref && now.Before(sn.Until) {
+			users[sn.User] = true
+		}
+	}
+	return users
+}
+
+// ended forgets the snoozes that are over, returning the ones whose users want reminding
+func (s *snoozes) ended() []snooze {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var remind []snooze
+	now, changed := time.Now(), false
+	for key, sn := range s.snoozed {
+		if now.Before(sn.Until) {
+			continue
+		}
+		delete(s.snoozed, key)
+		changed = true
+		if sn.Channel != "" {
+			remind = append(remind, sn)
+		}
+	}
+	if changed {
+		s.saveLocked()
+	}
+	return remind
+}
+
+// saveLocked persists the snoozes.  s.mu must be held
+func (s *snoozes) saveLocked() {
+	if err := s.store.Save(SNOOZES_STORE_KEY, s.snoozed); err != nil {
+		logrus.WithError(err).Error("failed to persist snoozes")
+	}
+}
+
+// respond sends an ephemeral reply to whoever clicked the button
+func respond(callback slack.InteractionCallback, text string) {
+	if err := slack.PostWebhook(callback.ResponseURL, &slack.WebhookMessage{Text: text}); err != nil {
+		logrus.WithError(err).Error("failed to respond to slack interaction")
+	}
+}
+
+// interactionTarget resolves the clicking slack user and the referenced MR
+func (bot bot) interactionTarget(ref string, callback slack.InteractionCallback) (*gitlab.User, *gitlab.MergeRequest, error) {
+	projectID, iid, err := parseMRRef(ref)
+	if err != nil {
+		return nil, nil, err
+	}
+	user, err := bot.users.gitlabUser(callback.User.ID)
+	if err != nil {
+		return nil, nil, fmt.Errorf("I don't know who you are on gitlab: %v", err)
+	}
+	mr, err := bot.gl.GetMergeRequest(projectID, iid)
+	if err != nil {
+		return nil, nil, err
+	}
+	return user, mr, nil
+}
+
+// claimMergeRequest handles "Assign to me".  only the project's maintainers may claim a review
+func (bot bot) claimMergeRequest(ref string, callback slack.InteractionCallback) {
+	user, mr, err := bot.interactionTarget(ref, callback)
+	if err != nil {
+		respond(callback, err.Error())
+		return
+	}
+	maintainers, err := getProjectMaintainers(bot.gl, mr.ProjectID)
+	if err != nil {
+		logrus.WithError(err).Error("failed to list maintainers for claim")
+		respond(callback, "I couldn't check whether you're a maintainer, try again later")
+		return
+	}
+	isMaintainer := false
+	for _, m := range maintainers {
+		if m.ID == user.ID {
+			isMaintainer = true
+		}
+	}
+	if !isMaintainer {
+		respond(callback, fmt.Sprintf("only maintainers can claim reviews, and %s isn't a maintainer of this project", user.Username))
+		return
+	}
+
+	if _, err := bot.gl.UpdateMergeRequest(mr.ProjectID, mr.IID, &gitlab.UpdateMergeRequestOptions{AssigneeID: &user.ID}); err != nil {
+		logrus.WithError(err).Errorf("failed to assign merge request !%d to %s", mr.IID, user.Username)
+		respond(callback, "I couldn't assign it to you: "+err.Error())
+		return
+	}
+	bot.notify(fmt.Sprintf("<@%s> claimed the review of <%s|!%d %s>", callback.User.ID, mr.WebURL, mr.IID, mr.Title), []string{callback.Channel.ID})
+}
+
+// approveMergeRequest handles "Approve", approving the MR as the clicking user
+func (bot bot) approveMergeRequest(ref string, callback slack.InteractionCallback) {
+	user, mr, err := bot.interactionTarget(ref, callback)
+	if err != nil {
+		respond(callback, err.Error())
+		return
+	}
+	if err := bot.gl.ApproveMergeRequest(mr.ProjectID, mr.IID, user.Username); err != nil {
+		logrus.WithError(err).Errorf("failed to approve merge request !%d as %s", mr.IID, user.Username)
+		respond(callback, fmt.Sprintf("I couldn't approve it for you (%v), approve it at %s instead", err, mr.WebURL))
+		return
+	}
+	respond(callback, fmt.Sprintf("approved <%s|!%d> as %s", mr.WebURL, mr.IID, user.Username))
+}
+
+// snoozeMergeRequest handles "Snooze": the clicking user is reminded about the MR once the snooze is over, see
+// remindSnoozed
+func (bot bot) snoozeMergeRequest(ref string, callback slack.InteractionCallback) {
+	_, iid, err := parseMRRef(ref)
+	if err != nil {
+		logrus.WithError(err).Errorf("Failed to parse merge request reference '%s'", ref)
+		return
+	}
+	until := bot.snoozes.snooze(ref, callback.User.ID, callback.Channel.ID)
+	respond(callback, fmt.Sprintf("snoozed !%d until %s", iid, until.Format(time.RFC1123)))
+}
+
+// remindSnoozed tells whoever snoozed an MR from its notification that their snooze is over, if it's still open
+func (bot bot) remindSnoozed() {
+	for _, sn := range bot.snoozes.ended() {
+		projectID, iid, err := parseMRRef(sn.Ref)
+		if err != nil {
+			continue
+		}
+		mr, err := bot.gl.GetMergeRequest(projectID, iid)
+		if err != nil {
+			logrus.WithError(err).Error("failed to look up snoozed merge request")
+			continue
+		}
+		if mr.State != "opened" {
+			continue
+		}
+		bot.notifyLocalized(tr("<@%s> your snooze is over, <%s|!%d %s> is still waiting for review", sn.User, mr.WebURL, mr.IID, mr.Title), []string{sn.Channel})
+	}
+}
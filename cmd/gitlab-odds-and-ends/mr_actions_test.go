@@ -0,0 +1,84 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/raidancampbell/gitlab-odds-and-ends/internal/store"
+	"github.com/xanzy/go-gitlab"
+)
+
+func TestSnoozesArePerUser(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.json")
+	s, err := store.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	snoozes, err := newSnoozes(s, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ref := mrRef(1, 2)
+	snoozes.snoozeFor(ref, "U_ALICE", "C_TEAM", -time.Minute) // already over
+	snoozes.snooze(ref, "U_BOB", "C_TEAM")
+
+	if snoozes.isSnoozed(ref, "U_ALICE") || !snoozes.isSnoozed(ref, "U_BOB") {
+		t.Errorf("snoozed for alice %v and bob %v, want only bob", snoozes.isSnoozed(ref, "U_ALICE"), snoozes.isSnoozed(ref, "U_BOB"))
+	}
+
+	// bob's snooze, after alice's, doesn't cost alice her reminder, and both survive a restart
+	s, err = store.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if snoozes, err = newSnoozes(s, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	ended := snoozes.ended()
+	if len(ended) != 1 || ended[0].User != "U_ALICE" || ended[0].Channel != "C_TEAM" {
+		t.Errorf("ended() = %+v, want alice's snooze", ended)
+	}
+	if again := snoozes.ended(); len(again) != 0 {
+		t.Errorf("ended() reminded again: %+v", again)
+	}
+	if !snoozes.isSnoozed(ref, "U_BOB") {
+		t.Error("bob's snooze was lost")
+	}
+}
+
+func TestStaleRemindersFollowReviewersSnoozes(t *testing.T) {
+	tests := []struct {
+		name     string
+		snoozers []string
+		want     bool
+	}{
+		{name: "nobody", want: false},
+		{name: "one of the reviewers", snoozers: []string{"U_ALICE"}, want: false},
+		{name: "someone else", snoozers: []string{"U_CAROL"}, want: false},
+		{name: "every reviewer", snoozers: []string{"U_ALICE", "U_BOB"}, want: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, err := store.Open("")
+			if err != nil {
+				t.Fatal(err)
+			}
+			b := bot{users: newUserMapper(nil, nil, []userConfig{{Slack: "U_ALICE", GitLab: "alice"}, {Slack: "U_BOB", GitLab: "bob"}})}
+			if b.snoozes, err = newSnoozes(s, time.Hour); err != nil {
+				t.Fatal(err)
+			}
+			ref := mrRef(1, 2)
+			for _, u := range tt.snoozers {
+				b.snoozes.snooze(ref, u, "")
+			}
+			mr := &gitlab.MergeRequest{ProjectID: 1, IID: 2,
+				Assignee:  &gitlab.BasicUser{Username: "alice"},
+				Reviewers: []*gitlab.BasicUser{{Username: "bob"}, {Username: "unknown-on-slack"}}}
+
+			if got := b.snoozedByReviewers(ref, mr); got != tt.want {
+				t.Errorf("snoozedByReviewers() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
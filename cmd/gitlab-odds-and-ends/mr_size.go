@@ -0,0 +1,70 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+const MR_SIZE_XL = "XL"
+
+// mrSizes are the sizes up to XL, smallest first.  an MR is the first size it's within both limits of
+var mrSizes = []struct {
+	name         string
+	lines, files int
+}{
+	{"XS", 10, 2},
+	{"S", 50, 5},
+	{"M", 250, 15},
+	{"L", 1000, 40},
+}
+
+// mrSize is how big an MR's change is, by the lines it adds and removes and the files it touches
+type mrSize struct {
+	name                  string
+	added, removed, files int
+}
+
+// classifyMR sizes the MR from its diffs.  gitlab leaves out diffs that are too big, so those MRs can come out smaller
+// than they are
+func (bot bot) classifyMR(projectID, iid int) (mrSize, error) {
+	changes, err := bot.gl.GetMergeRequestChanges(projectID, iid)
+	if err != nil {
+		return mrSize{}, err
+	}
+	size := mrSize{name: MR_SIZE_XL, files: len(changes.Changes)}
+	for _, c := range changes.Changes {
+		for _, line := range strings.Split(c.Diff, "\n") {
+			switch {
+			case strings.HasPrefix(line, "+++"), strings.HasPrefix(line, "---"):
+			case strings.HasPrefix(line, "+"):
+				size.added++
+			case strings.HasPrefix(line, "-"):
+				size.removed++
+			}
+		}
+	}
+	for _, s := range mrSizes {
+		if size.added+size.removed <= s.lines && size.files <= s.files {
+			size.name = s.name
+			break
+		}
+	}
+	return size, nil
+}
+
+// badge is the size as shown in notifications, e.g. "`M` +120 -30 in 6 files"
+func (s mrSize) badge() string {
+	return fmt.Sprintf("`%s` +%d -%d in %s", s.name, s.added, s.removed, plural(s.files, "file"))
+}
+
+// sizeBadge is the MR's size for its notification, or nothing if it can't be worked out
+func (bot bot) sizeBadge(projectID, iid int) string {
+	size, err := bot.classifyMR(projectID, iid)
+	if err != nil {
+		logrus.WithError(err).Errorf("failed to size merge request !%d", iid)
+		return ""
+	}
+	return size.badge()
+}
@@ -0,0 +1,55 @@
+package main
+
+import "github.com/raidancampbell/gitlab-odds-and-ends/internal/notify"
+
+// notifierLayer is a notifier that adds to another, like the audit log, quiet hours or notification preferences
+type notifierLayer interface {
+	notify.Notifier
+	inner() notify.Notifier
+	withInner(inner notify.Notifier) notify.Notifier
+}
+
+// adjustNotifier applies fn to every layer of the notifier, outermost first, e.g. to tell quiet hours a message is
+// critical wherever they are in the stack
+func adjustNotifier(n notify.Notifier, fn func(notify.Notifier) notify.Notifier) notify.Notifier {
+	n = fn(n)
+	if l, ok := n.(notifierLayer); ok {
+		return l.withInner(adjustNotifier(l.inner(), fn))
+	}
+	return n
+}
+
+// isDryRun reports whether the notifier's messages end up with notify.DryRun, under whatever layers it has
+func isDryRun(n notify.Notifier) bool {
+	for {
+		if _, ok := n.(notify.DryRun); ok {
+			return true
+		}
+		l, ok := n.(notifierLayer)
+		if !ok {
+			return false
+		}
+		n = l.inner()
+	}
+}
+
+func (n auditedNotifier) inner() notify.Notifier { return n.Notifier }
+
+func (n auditedNotifier) withInner(inner notify.Notifier) notify.Notifier {
+	n.Notifier = inner
+	return n
+}
+
+func (n quietNotifier) inner() notify.Notifier { return n.Notifier }
+
+func (n quietNotifier) withInner(inner notify.Notifier) notify.Notifier {
+	n.Notifier = inner
+	return n
+}
+
+func (n preferencesNotifier) inner() notify.Notifier { return n.Notifier }
+
+func (n preferencesNotifier) withInner(inner notify.Notifier) notify.Notifier {
+	n.Notifier = inner
+	return n
+}
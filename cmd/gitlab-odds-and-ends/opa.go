@@ -0,0 +1,273 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/open-policy-agent/opa/rego"
+	"github.com/raidancampbell/gitlab-odds-and-ends/internal/config"
+	"github.com/sirupsen/logrus"
+	"github.com/xanzy/go-gitlab"
+)
+
+const (
+	// OPA_QUERY is what the policies' rules are read from, so policies go in `package gitlab.merge_request`
+	OPA_QUERY        = "data.gitlab.merge_request"
+	OPA_EVAL_TIMEOUT = time.Second
+)
+
+// opaConfig has MRs follow policies written in rego, for organizations whose rules go beyond reviewer counts.
+// the policies get the MR as `input` (see opaInput) and can define, in `package gitlab.merge_request`:
+//
+//   - `deny`, a set of reasons the MR mustn't be merged.  they're posted to its thread like any other merge blocker,
+//     and keep it from being announced as ready to merge or merged by its policy's auto-merge
+//   - `exclude`, a set of usernames who mustn't be picked to review it
+//
+// for example, to keep authors from approving their own MRs and have security MRs approved by two seniors:
+//
+//	package gitlab.merge_request
+//
+//	seniors := {"alice", "bob", "carol"}
+//
+//	exclude[input.author]
+//
+//	deny["authors can't approve their own merge requests"] { input.approved_by[_] == input.author }
+//
+//	deny["security merge requests need 2 senior approvals"] {
+//	    input.merge_request.labels[_] == "security"
+//	    count({u | u := input.approved_by[_]; seniors[u]}) < 2
+//	}
+//
+// every decision that changes is recorded in the audit log
+type opaConfig struct {
+	// Files are the rego modules, relative to the config file
+	Files []string `yaml:"files"`
+}
+
+// opaInput is what the policies see as `input`
+type opaInput struct {
+	// Project is the MR's project's path with namespace
+	Project      string               `json:"project"`
+	MergeRequest *gitlab.MergeRequest `json:"merge_request"`
+	// Author, ApprovedBy and Reviewers are gitlab usernames
+	Author     string   `json:"author"`
+	ApprovedBy []string `json:"approved_by"`
+	Reviewers  []string `json:"reviewers"`
+}
+
+// opaDecision is what the policies made of an MR
+type opaDecision struct {
+	Deny    []string
+	Exclude []string
+}
+
+func (d opaDecision) String() string {
+	if len(d.Deny) == 0 && len(d.Exclude) == 0 {
+		return "allowed"
+	}
+	var parts []string
+	if len(d.Deny) > 0 {
+		parts = append(parts, "deny: "+strings.Join(d.Deny, "; "))
+	}
+	if len(d.Exclude) > 0 {
+		parts = append(parts, "exclude: "+strings.Join(d.Exclude, ", "))
+	}
+	return strings.Join(parts, ", ")
+}
+
+// opaPolicies evaluates the rego policies, see opaConfig
+type opaPolicies struct {
+	query rego.PreparedEvalQuery
+
+	mu sync.Mutex
+	// decided is the last decision audited for each MR (keyed by mrRef), so unchanged ones aren't audited again
+	decided map[string]string
+}
+
+// newOPAPolicies compiles the policies, returning nil if there aren't any.  configPath is the config file's, which the
+// policies are relative to
+func newOPAPolicies(cfg opaConfig, configPath string) (*opaPolicies, error) {
+	if len(cfg.Files) == 0 {
+		return nil, nil
+	}
+	options := []func(*rego.Rego){rego.Query(OPA_QUERY)}
+	for _, file := range cfg.Files {
+		path := config.Resolve(configPath, file)
+		src, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("loading rego policy: %v", err)
+		}
+		options = append(options, rego.Module(path, string(src)))
+	}
+	query, err := rego.New(options...).PrepareForEval(context.Background())
+	if err != nil {
+		return nil, fmt.Errorf("compiling rego policies: %v", err)
+	}
+	logrus.Infof("loaded %s", plural(len(cfg.Files), "rego policy file"))
+	return &opaPolicies{query: query, decided: make(map[string]string)}, nil
+}
+
+func (o *opaPolicies) eval(input opaInput) (opaDecision, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), OPA_EVAL_TIMEOUT)
+	defer cancel()
+	results, err := o.query.Eval(ctx, rego.EvalInput(input))
+	if err != nil {
+		return opaDecision{}, err
+	}
+	var decision opaDecision
+	if len(results) == 0 || len(results[0].Expressions) == 0 {
+		return decision, nil // no rules defined for the MR at all
+	}
+	rules, ok := results[0].Expressions[0].Value.(map[string]interface{})
+	if !ok {
+		return decision, fmt.Errorf("%s is a %T, expected rules", OPA_QUERY, results[0].Expressions[0].Value)
+	}
+	if decision.Deny, err = opaStrings(rules, "deny"); err != nil {
+		return decision, err
+	}
+	if decision.Exclude, err = opaStrings(rules, "exclude"); err != nil {
+		return decision, err
+	}
+	return decision, nil
+}
+
+// opaStrings reads a set of strings rule, which comes out of OPA as a list
+func opaStrings(rules map[string]interface{}, rule string) ([]string, error) {
+	v, ok := rules[rule]
+	if !ok {
+		return nil, nil
+	}
+	list, ok := v.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("rule %s is a %T, expected a set of strings", rule, v)
+	}
+	var values []string
+	for _, elem := range list {
+		s, ok := elem.(string)
+		if !ok {
+			return nil, fmt.Errorf("rule %s contains a %T, expected strings", rule, elem)
+		}
+		values = append(values, s)
+	}
+	sort.Strings(values)
+	return values, nil
+}
+
+// changed records the MR's decision, reporting whether it's different from the last one
+func (o *opaPolicies) changed(ref string, decision opaDecision) bool {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	s := decision.String()
+	if last, ok := o.decided[ref]; ok && last == s {
+		return false
+	}
+	o.decided[ref] = s
+	return true
+}
+
+// policyDecision evaluates the policies for the MR, auditing the decision if it changed.  it's nil if there are no
+// policies.  policies that can't be evaluated deny the MR, so a broken policy or a gitlab outage doesn't let it through
+func (bot bot) policyDecision(project string, mr *gitlab.MergeRequest) *opaDecision {
+	if bot.opa == nil {
+		return nil
+	}
+	target := fmt.Sprintf("%s!%d", project, mr.IID)
+	decision, err := bot.evalPolicies(project, mr)
+	if err != nil {
+		logrus.WithError(err).Errorf("failed to evaluate the policies of %s", target)
+		decision = opaDecision{Deny: []string{"the policies couldn't be checked: " + err.Error()}}
+	}
+	if bot.opa.changed(mrRef(mr.ProjectID, mr.IID), decision) && bot.audit != nil {
+		trigger := ""
+		if audited, ok := bot.gl.(auditedGitLab); ok {
+			trigger = audited.trigger
+		}
+		bot.audit.record(auditEntry{Action: "policy_decision", Actor: AUDIT_ACTOR_BOT, Target: target, Trigger: trigger, Outcome: decision.String()})
+	}
+	return &decision
+}
+
+// evalPolicies evaluates the policies with the MR and its approvals as input
+func (bot bot) evalPolicies(project string, mr *gitlab.MergeRequest) (opaDecision, error) {
+	input := opaInput{Project: project, MergeRequest: mr, ApprovedBy: []string{}, Reviewers: []string{}}
+	if mr.Author != nil {
+		input.Author = mr.Author.Username
+	}
+	for _, r := range mr.Reviewers {
+		input.Reviewers = append(input.Reviewers, r.Username)
+	}
+	approvals, err := bot.gl.GetMergeRequestApprovals(mr.ProjectID, mr.IID)
+	if err != nil {
+		return opaDecision{}, fmt.Errorf("looking up its approvals: %v", err)
+	}
+	for _, a := range approvals.ApprovedBy {
+		if a != nil && a.User != nil {
+			input.ApprovedBy = append(input.ApprovedBy, a.User.Username)
+		}
+	}
+	return bot.opa.eval(input)
+}
+
+// policyDenials are why the policies don't let the MR be merged, as it is now.  nothing if they do, or there are none
+func (bot bot) policyDenials(projectID, iid int, project string) []string {
+	if bot.opa == nil {
+		return nil
+	}
+	current, err := bot.gl.GetMergeRequest(projectID, iid)
+	if err != nil {
+		logrus.WithError(err).Errorf("failed to look up merge request !%d for its policies", iid)
+		return []string{"the policies couldn't be checked: looking up the merge request: " + err.Error()}
+	}
+	return bot.policyDecision(project, current).Deny
+}
+
+// policyBlockers are the MR's policy violations, as merge blockers for its author to sort out
+func (bot bot) policyBlockers(project *gitlab.Project, mr *gitlab.MergeRequest) []blocker {
+	decision := bot.policyDecision(project.PathWithNamespace, mr)
+	if decision == nil {
+		return nil
+	}
+	author := ""
+	if mr.Author != nil {
+		author = mr.Author.Username
+	}
+	var blockers []blocker
+	for _, reason := range decision.Deny {
+		blockers = append(blockers, blocker{reason: "policy: " + reason, owner: author})
+	}
+	return blockers
+}
+
+// policyCandidates leaves out the candidates the policies exclude from reviewing the MR
+func (bot bot) policyCandidates(mr *gitlab.MergeEvent, candidates reviewCandidates) reviewCandidates {
+	if bot.opa == nil {
+		return candidates
+	}
+	current, err := bot.gl.GetMergeRequest(mr.Project.ID, mr.ObjectAttributes.IID)
+	if err != nil {
+		logrus.WithError(err).Errorf("failed to look up merge request !%d for its policies", mr.ObjectAttributes.IID)
+		return candidates
+	}
+	decision := bot.policyDecision(mr.Project.PathWithNamespace, current)
+	if decision == nil || len(decision.Exclude) == 0 {
+		return candidates
+	}
+	allowed := func(members []*gitlab.ProjectMember) []*gitlab.ProjectMember {
+		var kept []*gitlab.ProjectMember
+		for _, m := range members {
+			if !contains(decision.Exclude, m.Username) {
+				kept = append(kept, m)
+			}
+		}
+		return kept
+	}
+	candidates.all = allowed(candidates.all)
+	candidates.available = allowed(candidates.available)
+	candidates.experts = allowed(candidates.experts)
+	return candidates
+}
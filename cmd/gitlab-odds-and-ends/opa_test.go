@@ -0,0 +1,92 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/raidancampbell/gitlab-odds-and-ends/internal/notify"
+	"github.com/raidancampbell/gitlab-odds-and-ends/internal/store"
+	"github.com/xanzy/go-gitlab"
+)
+
+// approvalsDownGitLab can't look up approvals
+type approvalsDownGitLab struct {
+	*fakeGitLab
+}
+
+func (gl approvalsDownGitLab) GetMergeRequestApprovals(pid, iid int) (*gitlab.MergeRequestApprovals, error) {
+	return nil, errors.New("502 bad gateway")
+}
+
+func TestAutoMergeFollowsPolicies(t *testing.T) {
+	tests := []struct {
+		name         string
+		policy       string
+		approvalsErr bool
+		wantMerged   bool
+		wantOutcome  string
+	}{
+		{
+			name:        "allowed",
+			policy:      `deny["drafts can't be merged"] { input.merge_request.draft }`,
+			wantMerged:  true,
+			wantOutcome: "allowed",
+		},
+		{
+			name:        "denied",
+			policy:      `deny["security merge requests need a senior"] { input.merge_request.labels[_] == "security" }`,
+			wantOutcome: "deny: security merge requests need a senior",
+		},
+		{
+			name:        "broken policy",
+			policy:      `deny = "not a set" { true }`,
+			wantOutcome: "deny: the policies couldn't be checked",
+		},
+		{
+			name:         "approvals unavailable",
+			policy:       `deny["drafts can't be merged"] { input.merge_request.draft }`,
+			approvalsErr: true,
+			wantOutcome:  "deny: the policies couldn't be checked",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "policy.rego")
+			if err := os.WriteFile(path, []byte("package gitlab.merge_request\n\n"+tt.policy+"\n"), 0o600); err != nil {
+				t.Fatal(err)
+			}
+			opa, err := newOPAPolicies(opaConfig{Files: []string{path}}, "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			s, err := store.Open("")
+			if err != nil {
+				t.Fatal(err)
+			}
+			audit, err := newAuditLog(s)
+			if err != nil {
+				t.Fatal(err)
+			}
+			fake := newFakeGitLab()
+			b := notifyingBot(t, &notify.Recorder{})
+			b.gl, b.opa, b.audit = fake, opa, audit
+			if tt.approvalsErr {
+				b.gl = approvalsDownGitLab{fake}
+			}
+			ev := fake.addMR(&gitlab.MergeRequest{ProjectID: 1, IID: 2, Title: "Fix", Labels: gitlab.Labels{"security"}})
+
+			b.autoMerge(ev, policyConfig{Topic: "security", AutoMerge: true}, nil)
+
+			if merged := len(fake.accepted) > 0; merged != tt.wantMerged {
+				t.Errorf("merged = %v, want %v", merged, tt.wantMerged)
+			}
+			decisions := audit.query(auditQuery{Action: "policy_decision"})
+			if len(decisions) != 1 || !strings.HasPrefix(decisions[0].Outcome, tt.wantOutcome) {
+				t.Errorf("audited %+v, want one decision starting %q", decisions, tt.wantOutcome)
+			}
+		})
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/xanzy/go-gitlab"
+)
+
+const (
+	OPEN_MR_DIGEST_TIME_ENV_VAR     = "OPEN_MR_DIGEST_TIME"
+	OPEN_MR_DIGEST_TIMEZONE_ENV_VAR = "OPEN_MR_DIGEST_TIMEZONE"
+)
+
+// parseDigestTime parses a digest's HH:MM time and IANA timezone.  an empty timezone is the bot's local time
+func parseDigestTime(at, timezone string) (hour, minute int, loc *time.Location, err error) {
+	t, err := time.Parse("15:04", at)
+	if err != nil {
+		return 0, 0, nil, fmt.Errorf("invalid digest time '%s', expected HH:MM: %v", at, err)
+	}
+	loc = time.Local
+	if timezone != "" {
+		if loc, err = time.LoadLocation(timezone); err != nil {
+			return 0, 0, nil, fmt.Errorf("invalid digest timezone '%s': %v", timezone, err)
+		}
+	}
+	return t.Hour(), t.Minute(), loc, nil
+}
+
+// postOpenMRDigests sends every mapped channel its morning review queue.  channels with nothing to review are left alone
+func (bot bot) postOpenMRDigests() {
+	listed := make(map[string][]*gitlab.MergeRequest) // by project, so projects shared by channels are only listed once
+	for _, channel := range bot.routes.allChannels() {
+		var mrs []*gitlab.MergeRequest
+		for _, project := range bot.routes.projectsFor(channel) {
+			projectMRs, ok := listed[project]
+			if !ok {
+				var err error
+				if _, projectMRs, err = bot.openMRs(project); err != nil {
+					logrus.WithError(err).Errorf("failed to list merge requests for %s", project)
+				}
+				listed[project] = projectMRs
+			}
+			mrs = append(mrs, projectMRs...)
+		}
+		if len(mrs) == 0 {
+			continue
+		}
+		bot.notify(bot.openMRDigest(mrs), []string{channel})
+	}
+}
+
+// openMRDigest formats the MRs grouped by assignee, unassigned MRs last
+func (bot bot) openMRDigest(mrs []*gitlab.MergeRequest) string {
+	byAssignee := make(map[string][]*gitlab.MergeRequest)
+	var assignees []string
+	for _, mr := range mrs {
+		name := assigneeName(mr)
+		if _, ok := byAssignee[name]; !ok && mr.Assignee != nil {
+			assignees = append(assignees, name)
+		}
+		byAssignee[name] = append(byAssignee[name], mr)
+	}
+	sort.Strings(assignees)
+	if _, ok := byAssignee[UNASSIGNED]; ok {
+		assignees = append(assignees, UNASSIGNED)
+	}
+
+	lines := []string{fmt.Sprintf(":sunrise: *%s awaiting review*", plural(len(mrs), "merge request"))}
+	for _, assignee := range assignees {
+		lines = append(lines, fmt.Sprintf("*%s*:", assignee))
+		for _, mr := range byAssignee[assignee] {
+			lines = append(lines, fmt.Sprintf("• %s — %s old, %s", mrLink(mr), age(mr.CreatedAt), bot.approvalSummary(mr.ProjectID, mr.IID)))
+		}
+	}
+	return strings.Join(lines, "\n")
+}
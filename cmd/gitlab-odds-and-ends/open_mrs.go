@@ -0,0 +1,120 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/slack-go/slack"
+	"github.com/xanzy/go-gitlab"
+)
+
+const (
+	SLACK_COMMAND_MRS = "/mrs"
+	// don't let one busy project flood the response
+	MAX_LISTED_MRS_PER_PROJECT = 20
+	UNASSIGNED                 = "unassigned"
+)
+
+// mrsCommand handles `/mrs [group/project]`, listing open non-draft merge requests for the project,
+// or for every project routed to the channel.  gitlab can take a while, so the list is sent to the command's response URL
+func (bot bot) mrsCommand(cmd slack.SlashCommand) *slack.Msg {
+	projects := strings.Fields(cmd.Text)
+	if len(projects) == 0 {
+		projects = bot.routes.projectsFor(cmd.ChannelID)
+	}
+	if len(projects) == 0 {
+		return ephemeral("no projects are mapped to this channel, try `/mrs group/project`")
+	}
+
+	go func() {
+		var sections []string
+		for _, project := range projects {
+			sections = append(sections, bot.listOpenMRs(project))
+		}
+		if err := slack.PostWebhook(cmd.ResponseURL, &slack.WebhookMessage{Text: strings.Join(sections, "\n\n")}); err != nil {
+			logrus.WithError(err).Error("failed to respond to /mrs")
+		}
+	}()
+	return ephemeral("looking up open merge requests for `" + strings.Join(projects, "`, `") + "`...")
+}
+
+// openMRs lists the project's open, non-draft merge requests, oldest first
+func (bot bot) openMRs(project string) (int, []*gitlab.MergeRequest, error) {
+	id, err := bot.routes.projectID(bot.gl, project)
+	if err != nil {
+		return 0, nil, err
+	}
+	mrs, _, err := bot.gl.ListProjectMergeRequests(id, &gitlab.ListProjectMergeRequestsOptions{
+		ListOptions: gitlab.ListOptions{PerPage: MAX_LISTED_MRS_PER_PROJECT},
+		State:       gitlab.String("opened"),
+		WIP:         gitlab.String("no"),
+		OrderBy:     gitlab.String("created_at"),
+		Sort:        gitlab.String("asc"),
+	})
+	return id, mrs, err
+}
+
+// listOpenMRs formats the project's open, non-draft merge requests with their assignee, age, and approval status
+func (bot bot) listOpenMRs(project string) string {
+	id, mrs, err := bot.openMRs(project)
+	if err != nil {
+		logrus.WithError(err).Errorf("failed to list merge requests for %s", project)
+		return fmt.Sprintf("*%s*: couldn't list merge requests", project)
+	}
+	if len(mrs) == 0 {
+		return fmt.Sprintf("*%s*: nothing awaiting review :tada:", project)
+	}
+
+	lines := []string{fmt.Sprintf("*%s*:", project)}
+	for _, mr := range mrs {
+		lines = append(lines, fmt.Sprintf("• %s — %s, %s old, %s", mrLink(mr), assigneeName(mr), age(mr.CreatedAt), bot.approvalSummary(id, mr.IID)))
+	}
+	return strings.Join(lines, "\n")
+}
+
+// mrLink is a slack link to the MR, titled e.g. `!12 Fix the thing`
+func mrLink(mr *gitlab.MergeRequest) string {
+	return fmt.Sprintf("<%s|!%d %s>", mr.WebURL, mr.IID, mr.Title)
+}
+
+func assigneeName(mr *gitlab.MergeRequest) string {
+	if mr.Assignee != nil {
+		return mr.Assignee.Name
+	}
+	return UNASSIGNED
+}
+
+// approvalSummary is approvalStatus, looked up
+func (bot bot) approvalSummary(projectID, iid int) string {
+	approvals, err := bot.gl.GetMergeRequestApprovals(projectID, iid)
+	if err != nil {
+		return "approvals unknown"
+	}
+	return approvalStatus(approvals)
+}
+
+// approvalStatus is a short human description of the MR's approvals, e.g. `1/2 approvals`
+func approvalStatus(approvals *gitlab.MergeRequestApprovals) string {
+	if approvals.ApprovalsRequired > 0 {
+		return fmt.Sprintf("%d/%d approvals", len(approvals.ApprovedBy), approvals.ApprovalsRequired)
+	}
+	return plural(len(approvals.ApprovedBy), "approval")
+}
+
+// age is a rough human duration since t, e.g. `3d` or `5h`
+func age(t *time.Time) string {
+	if t == nil {
+		return "?"
+	}
+	d := time.Since(*t)
+	switch {
+	case d >= 24*time.Hour:
+		return fmt.Sprintf("%dd", int(d.Hours()/24))
+	case d >= time.Hour:
+		return fmt.Sprintf("%dh", int(d.Hours()))
+	default:
+		return fmt.Sprintf("%dm", int(d.Minutes()))
+	}
+}
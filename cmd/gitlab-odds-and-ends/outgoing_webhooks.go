@@ -0,0 +1,240 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/xanzy/go-gitlab"
+)
+
+const (
+	EVENT_MR_OPENED       = "merge_request.opened"
+	EVENT_MR_ASSIGNED     = "merge_request.assigned"
+	EVENT_MR_APPROVED     = "merge_request.approved"
+	EVENT_MR_MERGED       = "merge_request.merged"
+	EVENT_MR_CLOSED       = "merge_request.closed"
+	EVENT_PIPELINE_FAILED = "pipeline.failed"
+	EVENT_DEPLOYMENT      = "deployment"
+	// HEADER_BOT_SIGNATURE is `sha256=<hex HMAC-SHA256 of timestamp + "." + body>`, keyed with the webhook's secret
+	HEADER_BOT_SIGNATURE = "X-Bot-Signature"
+	HEADER_BOT_TIMESTAMP = "X-Bot-Timestamp"
+	HEADER_BOT_EVENT     = "X-Bot-Event"
+)
+
+// outgoingWebhookConfig is a URL that gets the bot's events as JSON
+type outgoingWebhookConfig struct {
+	URL string `yaml:"url"`
+	// Secret signs each delivery, see HEADER_BOT_SIGNATURE
+	Secret string `yaml:"secret"`
+	// Events limits which event types are sent, e.g. `merge_request.merged`.  all of them by default
+	Events []string `yaml:"events"`
+}
+
+// outgoingEvent is the normalized event we send, enriched with what the bot knows (like who it assigned)
+type outgoingEvent struct {
+	Type string    `json:"type"`
+	At   time.Time `json:"at"`
+	// Instance is the gitlab instance's name, empty for the one at GITLAB_BASE_URL.  see instanceConfig
+	Instance     string              `json:"instance,omitempty"`
+	Project      outgoingProject     `json:"project"`
+	MergeRequest *outgoingMR         `json:"merge_request,omitempty"`
+	Pipeline     *outgoingPipeline   `json:"pipeline,omitempty"`
+	Deployment   *outgoingDeployment `json:"deployment,omitempty"`
+}
+
+type outgoingProject struct {
+	ID   int    `json:"id"`
+	Path string `json:"path"`
+	URL  string `json:"url"`
+}
+
+type outgoingMR struct {
+	IID          int    `json:"iid"`
+	Title        string `json:"title"`
+	URL          string `json:"url"`
+	SourceBranch string `json:"source_branch"`
+	TargetBranch string `json:"target_branch"`
+	// Actor is whoever caused the event, e.g. the approver
+	Actor    string `json:"actor,omitempty"`
+	Assignee string `json:"assignee,omitempty"`
+}
+
+type outgoingPipeline struct {
+	ID     int    `json:"id"`
+	Ref    string `json:"ref"`
+	SHA    string `json:"sha"`
+	Status string `json:"status"`
+	URL    string `json:"url"`
+	User   string `json:"user"`
+}
+
+type outgoingDeployment struct {
+	Environment string `json:"environment"`
+	Status      string `json:"status"`
+	SHA         string `json:"sha"`
+	URL         string `json:"url"`
+	User        string `json:"user"`
+}
+
+// outgoingWebhooks delivers events to the configured URLs in the background, retrying failed deliveries
+type outgoingWebhooks struct {
+	hooks  []outgoingWebhookConfig
+	client *http.Client
+	retry  retryPolicy
+	dryRun bool
+}
+
+// newOutgoingWebhooks returns nil when there are no webhooks, disabling events
+func newOutgoingWebhooks(hooks []outgoingWebhookConfig, dryRun bool) (*outgoingWebhooks, error) {
+	if len(hooks) == 0 {
+		return nil, nil
+	}
+	for _, h := range hooks {
+		if h.URL == "" {
+			return nil, fmt.Errorf("outgoing webhook has no url")
+		}
+	}
+	return &outgoingWebhooks{hooks: hooks, client: &http.Client{Timeout: 10 * time.Second}, retry: retryPolicy{attempts: 3, interval: 10 * time.Second}, dryRun: dryRun}, nil
+}
+
+func (w *outgoingWebhooks) wants(hook outgoingWebhookConfig, eventType string) bool {
+	if len(hook.Events) == 0 {
+		return true
+	}
+	for _, e := range hook.Events {
+		if e == eventType {
+			return true
+		}
+	}
+	return false
+}
+
+// sign is the HMAC of the timestamp and body, so a captured delivery can't be replayed with a new timestamp
+func sign(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func (w *outgoingWebhooks) deliver(hook outgoingWebhookConfig, ev outgoingEvent, body []byte) error {
+	req, err := http.NewRequest(http.MethodPost, hook.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(HEADER_BOT_EVENT, ev.Type)
+	req.Header.Set(HEADER_BOT_TIMESTAMP, timestamp)
+	if hook.Secret != "" {
+		req.Header.Set(HEADER_BOT_SIGNATURE, sign(hook.Secret, timestamp, body))
+	}
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("%s responded %s", hook.URL, resp.Status)
+	}
+	return nil
+}
+
+// publish sends the event to every webhook that wants it
+func (w *outgoingWebhooks) publish(ev outgoingEvent) {
+	ev.At = time.Now()
+	body, err := json.Marshal(ev)
+	if err != nil {
+		logrus.WithError(err).Errorf("failed to encode %s event", ev.Type)
+		return
+	}
+	for _, hook := range w.hooks {
+		if !w.wants(hook, ev.Type) {
+			continue
+		}
+		if w.dryRun {
+			logrus.Infof("dry run: would send %s event to %s: %s", ev.Type, hook.URL, body)
+			continue
+		}
+		go func(hook outgoingWebhookConfig) {
+			err := w.deliver(hook, ev, body)
+			if err != nil {
+				err = w.retry.retry(func() error { return w.deliver(hook, ev, body) })
+			}
+			if err != nil {
+				logrus.WithError(err).Errorf("failed to send %s event to %s", ev.Type, hook.URL)
+			}
+		}(hook)
+	}
+}
+
+// publishEvent sends the event to the outgoing webhooks, the event database and the event bus, whichever are configured
+func (bot bot) publishEvent(ev outgoingEvent) {
+	ev.At, ev.Instance = time.Now(), bot.instance
+	if bot.outgoing != nil {
+		bot.outgoing.publish(ev)
+	}
+	if bot.eventDB != nil {
+		bot.eventDB.export(bot.instance, ev)
+	}
+	if bot.eventBus != nil {
+		bot.eventBus.publish(ev)
+	}
+}
+
+// publishMR sends an MR event.  assignee is who the bot assigned, if it just did
+func (bot bot) publishMR(eventType string, mr *gitlab.MergeEvent, assignee string) {
+	ev := outgoingEvent{
+		Type:    eventType,
+		Project: outgoingProject{ID: mr.Project.ID, Path: mr.Project.PathWithNamespace, URL: mr.Project.WebURL},
+		MergeRequest: &outgoingMR{
+			IID:          mr.ObjectAttributes.IID,
+			Title:        mr.ObjectAttributes.Title,
+			URL:          mr.ObjectAttributes.URL,
+			SourceBranch: mr.ObjectAttributes.SourceBranch,
+			TargetBranch: mr.ObjectAttributes.TargetBranch,
+			Assignee:     assignee,
+		},
+	}
+	if mr.User != nil {
+		ev.MergeRequest.Actor = mr.User.Username
+	}
+	bot.publishEvent(ev)
+}
+
+func (bot bot) publishPipeline(eventType string, p *gitlab.PipelineEvent) {
+	bot.publishEvent(outgoingEvent{
+		Type:    eventType,
+		Project: outgoingProject{ID: p.Project.ID, Path: p.Project.PathWithNamespace, URL: p.Project.WebURL},
+		Pipeline: &outgoingPipeline{
+			ID:     p.ObjectAttributes.ID,
+			Ref:    p.ObjectAttributes.Ref,
+			SHA:    p.ObjectAttributes.SHA,
+			Status: p.ObjectAttributes.Status,
+			URL:    fmt.Sprintf("%s/-/pipelines/%d", p.Project.WebURL, p.ObjectAttributes.ID),
+			User:   p.User.Username,
+		},
+	})
+}
+
+func (bot bot) publishDeployment(d *gitlab.DeploymentEvent) {
+	bot.publishEvent(outgoingEvent{
+		Type:    EVENT_DEPLOYMENT,
+		Project: outgoingProject{ID: d.Project.ID, Path: d.Project.PathWithNamespace, URL: d.Project.WebURL},
+		Deployment: &outgoingDeployment{
+			Environment: d.Environment,
+			Status:      d.Status,
+			SHA:         d.ShortSHA,
+			URL:         d.DeployableURL,
+			User:        d.User.Username,
+		},
+	})
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/raidancampbell/gitlab-odds-and-ends/internal/store"
+	"github.com/sirupsen/logrus"
+	"github.com/xanzy/go-gitlab"
+)
+
+const (
+	PAGERDUTY_ROUTING_KEY_ENV_VAR = "PAGERDUTY_ROUTING_KEY"
+	PAGERDUTY_BRANCHES_ENV_VAR    = "PAGERDUTY_BRANCHES"
+	PAGERDUTY_REVIEW_SLA_ENV_VAR  = "PAGERDUTY_REVIEW_SLA"
+	PAGERDUTY_EVENTS_URL          = "https://events.pagerduty.com/v2/enqueue"
+	PAGERDUTY_STORE_KEY           = "pagerduty_incidents"
+	PAGERDUTY_ACTION_TRIGGER      = "trigger"
+	PAGERDUTY_ACTION_RESOLVE      = "resolve"
+	PAGERDUTY_SEVERITY_CRITICAL   = "critical"
+	PAGERDUTY_SEVERITY_ERROR      = "error"
+)
+
+// pagerDutyEvent is an Events API v2 event
+type pagerDutyEvent struct {
+	RoutingKey  string            `json:"routing_key"`
+	EventAction string            `json:"event_action"`
+	DedupKey    string            `json:"dedup_key"`
+	Payload     *pagerDutyPayload `json:"payload,omitempty"`
+	Links       []pagerDutyLink   `json:"links,omitempty"`
+}
+
+type pagerDutyPayload struct {
+	Summary  string `json:"summary"`
+	Source   string `json:"source"`
+	Severity string `json:"severity"`
+	Group    string `json:"group,omitempty"`
+}
+
+type pagerDutyLink struct {
+	Href string `json:"href"`
+	Text string `json:"text"`
+}
+
+// pagerDuty pages when pipelines fail on critical branches, and when review SLA breaches climb the whole escalation
+// ladder.  each failing branch and each MR has its own dedup key, so PagerDuty folds repeats into the open incident,
+// and the incident is resolved when the branch is green again or the MR is reviewed.  open incidents are kept in the
+// store so they're still resolved after a restart
+type pagerDuty struct {
+	routingKey string
+	branches   []*regexp.Regexp
+	reviewSLA  bool
+	client     *http.Client
+	dryRun     bool
+	store      *store.Store
+
+	mu sync.Mutex
+	// open are the dedup keys of the incidents the bot triggered and hasn't resolved, and when
+	open map[string]time.Time
+}
+
+// newPagerDuty returns nil unless PAGERDUTY_ROUTING_KEY is set.  PAGERDUTY_BRANCHES are branch globs, e.g.
+// `main,release/*`, and default to each project's default branch
+func newPagerDuty(s *store.Store, dryRun bool) (*pagerDuty, error) {
+	routingKey := secretFromEnv(PAGERDUTY_ROUTING_KEY_ENV_VAR)
+	if routingKey == "" {
+		return nil, nil
+	}
+	p := &pagerDuty{
+		routingKey: routingKey,
+		reviewSLA:  os.Getenv(PAGERDUTY_REVIEW_SLA_ENV_VAR) != "false",
+		client:     &http.Client{Timeout: 10 * time.Second},
+		dryRun:     dryRun,
+		store:      s,
+		open:       make(map[string]time.Time),
+	}
+	for _, glob := range strings.Split(os.Getenv(PAGERDUTY_BRANCHES_ENV_VAR), ",") {
+		if glob = strings.TrimSpace(glob); glob == "" {
+			continue
+		}
+		re, err := compileGlob(glob, false)
+		if err != nil {
+			return nil, fmt.Errorf("invalid branch pattern '%s': %w", glob, err)
+		}
+		p.branches = append(p.branches, re)
+	}
+	if _, err := s.Load(PAGERDUTY_STORE_KEY, &p.open); err != nil {
+		return nil, err
+	}
+	s.Follow(PAGERDUTY_STORE_KEY, &p.open, &p.mu)
+	return p, nil
+}
+
+// critical reports whether failures on the pipeline's branch page
+func (p *pagerDuty) critical(ev *gitlab.PipelineEvent) bool {
+	if ev.ObjectAttributes.Tag {
+		return false
+	}
+	if len(p.branches) == 0 {
+		return isTrunkPipeline(ev)
+	}
+	for _, re := range p.branches {
+		if re.MatchString(ev.ObjectAttributes.Ref) {
+			return true
+		}
+	}
+	return false
+}
+
+// send posts the event to the Events API
+func (p *pagerDuty) send(ev pagerDutyEvent) error {
+	ev.RoutingKey = p.routingKey
+	body, err := json.Marshal(ev)
+	if err != nil {
+		return err
+	}
+	if p.dryRun {
+		logrus.Infof("dry run: would send PagerDuty %s event for %s", ev.EventAction, ev.DedupKey)
+		return nil
+	}
+	resp, err := p.client.Post(PAGERDUTY_EVENTS_URL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("PagerDuty responded %s", resp.Status)
+	}
+	return nil
+}
+
+// trigger pages, unless the dedup key's incident is already open
+func (p *pagerDuty) trigger(dedupKey string, payload pagerDutyPayload, link pagerDutyLink) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if _, ok := p.open[dedupKey]; ok {
+		return nil
+	}
+	ev := pagerDutyEvent{EventAction: PAGERDUTY_ACTION_TRIGGER, DedupKey: dedupKey, Payload: &payload, Links: []pagerDutyLink{link}}
+	if err := p.send(ev); err != nil {
+		return err
+	}
+	p.open[dedupKey] = time.Now()
+	p.saveLocked()
+	return nil
+}
+
+// resolve resolves the dedup key's incident, if the bot triggered one
+func (p *pagerDuty) resolve(dedupKey string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if _, ok := p.open[dedupKey]; !ok {
+		return nil
+	}
+	if err := p.send(pagerDutyEvent{EventAction: PAGERDUTY_ACTION_RESOLVE, DedupKey: dedupKey}); err != nil {
+		return err
+	}
+	delete(p.open, dedupKey)
+	p.saveLocked()
+	return nil
+}
+
+// saveLocked persists the open incidents.  p.mu must be held
+func (p *pagerDuty) saveLocked() {
+	if err := p.store.Save(PAGERDUTY_STORE_KEY, p.open); err != nil {
+		logrus.WithError(err).Error("failed to persist PagerDuty incidents")
+	}
+}
+
+// pipelineDedupKey is the same for every failure on the branch until it's green again
+func (bot bot) pipelineDedupKey(projectID int, ref string) string {
+	return instanceValue(bot.instance, fmt.Sprintf("pipeline/%d/%s", projectID, ref))
+}
+
+// reviewSLADedupKey is the same for every escalation of the MR's review
+func (bot bot) reviewSLADedupKey(ref string) string {
+	return instanceValue(bot.instance, "review-sla/"+ref)
+}
+
+// pagePipeline pages about failed pipelines on critical branches, and resolves the page once the branch passes again
+func (bot bot) pagePipeline(ev *gitlab.PipelineEvent) {
+	if bot.pagerDuty == nil || !bot.pagerDuty.critical(ev) {
+		return
+	}
+	key := bot.pipelineDedupKey(ev.Project.ID, ev.ObjectAttributes.Ref)
+	var err error
+	switch ev.ObjectAttributes.Status {
+	case PIPELINE_STATUS_FAILED:
+		url := fmt.Sprintf("%s/-/pipelines/%d", ev.Project.WebURL, ev.ObjectAttributes.ID)
+		err = bot.pagerDuty.trigger(key, pagerDutyPayload{
+			Summary:  fmt.Sprintf("Pipeline failed on %s in %s", ev.ObjectAttributes.Ref, ev.Project.PathWithNamespace),
+			Source:   ev.Project.PathWithNamespace,
+			Severity: PAGERDUTY_SEVERITY_CRITICAL,
+			Group:    ev.ObjectAttributes.Ref,
+		}, pagerDutyLink{Href: url, Text: fmt.Sprintf("Pipeline #%d", ev.ObjectAttributes.ID)})
+	case PIPELINE_STATUS_SUCCESS:
+		err = bot.pagerDuty.resolve(key)
+	default:
+		return
+	}
+	if err != nil {
+		logrus.WithError(err).Errorf("failed to page for %s's pipeline on %s", ev.Project.PathWithNamespace, ev.ObjectAttributes.Ref)
+		bot.status.fail("pagerduty")
+	}
+}
+
+// pageReviewSLA pages about an MR whose review SLA breach went all the way up the escalation ladder without anyone
+// picking the review up
+func (bot bot) pageReviewSLA(mr *gitlab.MergeRequest, policy policyConfig, waited time.Duration) {
+	if bot.pagerDuty == nil || !bot.pagerDuty.reviewSLA {
+		return
+	}
+	err := bot.pagerDuty.trigger(bot.reviewSLADedupKey(mrRef(mr.ProjectID, mr.IID)), pagerDutyPayload{
+		Summary:  fmt.Sprintf("!%d %s has waited %s for its first review, past its %s SLA", mr.IID, mr.Title, waited.Round(time.Minute), policy.ReviewSLA),
+		Source:   mr.WebURL,
+		Severity: PAGERDUTY_SEVERITY_ERROR,
+		Group:    policy.Topic,
+	}, pagerDutyLink{Href: mr.WebURL, Text: fmt.Sprintf("!%d", mr.IID)})
+	if err != nil {
+		logrus.WithError(err).Errorf("failed to page for merge request !%d's review SLA", mr.IID)
+		bot.status.fail("pagerduty")
+	}
+}
+
+// stopReviewSLA stops the MR's SLA clock, resolving its page if it had one
+func (bot bot) stopReviewSLA(ref string) {
+	bot.slas.stop(ref)
+	if bot.pagerDuty == nil {
+		return
+	}
+	if err := bot.pagerDuty.resolve(bot.reviewSLADedupKey(ref)); err != nil {
+		logrus.WithError(err).Errorf("failed to resolve the review SLA page for %s", ref)
+		bot.status.fail("pagerduty")
+	}
+}
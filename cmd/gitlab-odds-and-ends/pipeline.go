@@ -0,0 +1,69 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/sirupsen/logrus"
+	"github.com/xanzy/go-gitlab"
+)
+
+const (
+	PIPELINE_STATUS_FAILED   = "failed"
+	PIPELINE_STATUS_CANCELED = "canceled"
+)
+
+// pipeline receives a pipeline event.  failures are announced, and escalated if the project is in incident mode.
+// default branch pipelines are followed by the trunk watcher
+func (bot bot) pipeline(p *gitlab.PipelineEvent, slackChans []string) {
+	logrus.Debugf("processing pipeline webhook %+v", p)
+	if bot.flaky != nil {
+		bot.flaky.observe(p)
+	}
+	trunk := isTrunkPipeline(p)
+	if trunk {
+		bot.watchTrunk(p, slackChans)
+	}
+	bot.pagePipeline(p)
+	bot.exportPipeline(p)
+	for _, iid := range bot.pipelineMRs(p) {
+		bot.refreshLiveStatus(p.Project.ID, iid)
+	}
+	if p.ObjectAttributes.Status == PIPELINE_STATUS_SUCCESS {
+		bot.shareArtifacts(p, slackChans)
+		return
+	}
+	if p.ObjectAttributes.Status != PIPELINE_STATUS_FAILED {
+		return
+	}
+
+	url := fmt.Sprintf("%s/-/pipelines/%d", p.Project.WebURL, p.ObjectAttributes.ID)
+	msg := tr("Pipeline failed on `%s` in `%s` (%s).  See %s for details.", p.ObjectAttributes.Ref, p.Project.PathWithNamespace, p.User.Name, url)
+	if !trunk { // the trunk watcher already announced it
+		bot.critical(CRITICAL_PIPELINE_FAILED).notifyLocalized(msg, slackChans)
+	}
+	bot.publishPipeline(EVENT_PIPELINE_FAILED, p)
+	bot.escalate(p.Project.PathWithNamespace, msg)
+	bot.checkBlockedBranch(p, slackChans)
+}
+
+// deployment receives a deployment event.  deployments to production environments are escalated if the project is in incident mode
+func (bot bot) deployment(d *gitlab.DeploymentEvent, slackChans []string) {
+	logrus.Debugf("processing deployment webhook %+v", d)
+
+	msg := tr("Deployment of `%s` to `%s` in `%s` is %s (%s).  See %s for details.",
+		d.ShortSHA, d.Environment, d.Project.PathWithNamespace, d.Status, d.User.Name, d.DeployableURL)
+	if bot.dora.environments[d.Environment] {
+		bot.critical(CRITICAL_PRODUCTION_DEPLOYMENT).notifyLocalized(msg, slackChans)
+	} else {
+		bot.notifyLocalized(msg, slackChans)
+	}
+	bot.warnFrozenDeployment(d, slackChans)
+	bot.publishDeployment(d)
+	if bot.deployDigest != nil {
+		bot.deployDigest.record(d)
+	}
+	bot.recordDoraDeployment(d)
+	if bot.incidents != nil && bot.incidents.environments[d.Environment] {
+		bot.escalate(d.Project.PathWithNamespace, msg)
+	}
+}
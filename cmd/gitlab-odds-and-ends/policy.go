@@ -0,0 +1,247 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/xanzy/go-gitlab"
+)
+
+const (
+	DEFAULT_REVIEWERS = 2
+	// AUTO_MERGE_PIPELINE sets approved MRs to merge when their pipeline succeeds
+	AUTO_MERGE_PIPELINE = "pipeline"
+	// AUTO_MERGE_MERGE merges approved MRs right away when their pipeline is already green
+	AUTO_MERGE_MERGE = "merge"
+	// how long a project's topics are trusted before asking gitlab again
+	PROJECT_TOPICS_TTL = 10 * time.Minute
+)
+
+// policyConfig is a named bundle of review rules, selected by tagging projects with its topic in gitlab
+type policyConfig struct {
+	// Topic is the gitlab project topic that selects this bundle, e.g. `tier-1`
+	Topic string `yaml:"topic"`
+	// Reviewers is how many maintainers should be reviewing each MR
+	Reviewers int `yaml:"reviewers"`
+	// ReviewSLA is how long an MR may wait for its first review, e.g. `8h`.  zero means no SLA
+	ReviewSLA time.Duration `yaml:"review_sla"`
+	// ReviewSLABusinessHours only counts time during business hours towards the SLA
+	ReviewSLABusinessHours bool `yaml:"review_sla_business_hours"`
+	// TeamLead is the slack user ID pinged once the SLA has been breached twice over
+	TeamLead string `yaml:"team_lead"`
+	// EscalationChannel is the slack channel told once the SLA has been breached three times over
+	EscalationChannel string `yaml:"escalation_channel"`
+	// SlackGroup is the ID of the slack user group of the maintainers of the bundle's projects, see projectConfig
+	SlackGroup string `yaml:"slack_group"`
+	// AutoMerge sets approved MRs to merge once their pipeline succeeds
+	AutoMerge bool `yaml:"auto_merge"`
+	// AutoMergeMethod is how AutoMerge merges: `pipeline` (the default) sets the MR to merge when its pipeline succeeds,
+	// `merge` merges it right away if its pipeline already has (or it has none), and sets it to merge when it does otherwise
+	AutoMergeMethod string `yaml:"auto_merge_method"`
+	// AutoMergeApprovals is how many maintainers must have approved before AutoMerge merges, if more than gitlab requires
+	AutoMergeApprovals int `yaml:"auto_merge_approvals"`
+	// AssignAs is how the picked maintainer is put on new MRs, like ASSIGN_AS, which applies when it's empty
+	AssignAs string `yaml:"assign_as"`
+	// ReviewerPool is who reviewers are picked from, like REVIEWER_POOL, which applies when it's empty
+	ReviewerPool string `yaml:"reviewer_pool"`
+	// XLExtraReviewer has XL MRs (over 1000 lines or 40 files changed) reviewed by one more maintainer
+	XLExtraReviewer bool `yaml:"xl_extra_reviewer"`
+}
+
+// validatePolicies checks the bundles' settings up front, so they can be trusted when MRs arrive
+func validatePolicies(bundles []policyConfig) error {
+	for _, bundle := range bundles {
+		if bundle.Topic == "" {
+			return fmt.Errorf("policy without a topic")
+		}
+		if bundle.Reviewers < 0 {
+			return fmt.Errorf("policy '%s' can't have %d reviewers", bundle.Topic, bundle.Reviewers)
+		}
+		if _, err := parseAssignMode(bundle.AssignAs, true); err != nil {
+			return fmt.Errorf("policy '%s': %v", bundle.Topic, err)
+		}
+		if _, err := parseReviewerPool(bundle.ReviewerPool); err != nil {
+			return fmt.Errorf("policy '%s': %v", bundle.Topic, err)
+		}
+		switch bundle.AutoMergeMethod {
+		case "", AUTO_MERGE_PIPELINE, AUTO_MERGE_MERGE:
+		default:
+			return fmt.Errorf("policy '%s' has invalid auto_merge_method '%s', expected %s or %s", bundle.Topic, bundle.AutoMergeMethod, AUTO_MERGE_PIPELINE, AUTO_MERGE_MERGE)
+		}
+		if bundle.AutoMergeApprovals < 0 {
+			return fmt.Errorf("policy '%s' can't need %d approvals to auto-merge", bundle.Topic, bundle.AutoMergeApprovals)
+		}
+	}
+	return nil
+}
+
+// defaultPolicy applies to projects without a matching topic
+var defaultPolicy = policyConfig{Reviewers: DEFAULT_REVIEWERS}
+
+// policies picks each project's policy bundle from its topics.  the first configured bundle with a matching topic wins,
+// unless the project's config names its policy
+type policies struct {
+	bundles []policyConfig
+	// chosen are the policies projects' configs name, by project path with namespace
+	chosen map[string]string
+
+	mu     sync.Mutex
+	topics map[int]projectTopics
+}
+
+type projectTopics struct {
+	path    string
+	topics  []string
+	fetched time.Time
+}
+
+func newPolicies(bundles []policyConfig, projects []projectConfig) *policies {
+	p := &policies{bundles: bundles, chosen: make(map[string]string), topics: make(map[int]projectTopics)}
+	for _, project := range projects {
+		if project.Policy != "" {
+			p.chosen[project.Project] = project.Policy
+		}
+	}
+	return p
+}
+
+// forProject returns the project's policy bundle.  if gitlab can't tell us the project's topics, the default policy applies
+func (p *policies) forProject(gl GitLabAPI, projectID int) policyConfig {
+	if len(p.bundles) == 0 {
+		return defaultPolicy
+	}
+	cached, err := p.projectTopics(gl, projectID)
+	if err != nil {
+		logrus.WithError(err).Errorf("failed to look up topics of project %d, using the default policy", projectID)
+		return defaultPolicy
+	}
+	topics := cached.topics
+	if chosen, ok := p.chosen[cached.path]; ok {
+		topics = []string{chosen}
+	}
+	for _, bundle := range p.bundles {
+		for _, t := range topics {
+			if t == bundle.Topic {
+				if bundle.Reviewers == 0 {
+					bundle.Reviewers = DEFAULT_REVIEWERS
+				}
+				return bundle
+			}
+		}
+	}
+	return defaultPolicy
+}
+
+func (p *policies) projectTopics(gl GitLabAPI, projectID int) (projectTopics, error) {
+	p.mu.Lock()
+	cached, ok := p.topics[projectID]
+	p.mu.Unlock()
+	if ok && time.Since(cached.fetched) < PROJECT_TOPICS_TTL {
+		return cached, nil
+	}
+	project, err := gl.GetProject(projectID)
+	if err != nil {
+		return projectTopics{}, err
+	}
+	cached = projectTopics{path: project.PathWithNamespace, topics: project.TagList, fetched: time.Now()}
+	p.mu.Lock()
+	p.topics[projectID] = cached
+	p.mu.Unlock()
+	return cached, nil
+}
+
+// assignModeFor is how the policy has maintainers put on new MRs
+func (bot bot) assignModeFor(policy policyConfig) assignMode {
+	if policy.AssignAs == "" {
+		return bot.assignMode
+	}
+	mode, err := parseAssignMode(policy.AssignAs, bot.reviewersSupported)
+	if err != nil {
+		// validatePolicies has already rejected it
+		return bot.assignMode
+	}
+	return mode
+}
+
+// reviewerPoolFor is who the policy has reviewers picked from
+func (bot bot) reviewerPoolFor(policy policyConfig) reviewerPool {
+	if policy.ReviewerPool == "" {
+		return bot.reviewerPool
+	}
+	pool, err := parseReviewerPool(policy.ReviewerPool)
+	if err != nil {
+		return bot.reviewerPool
+	}
+	return pool
+}
+
+// autoMerge merges the approved MR the way its policy asks: when its pipeline succeeds, or right away if it already
+// has.  MRs without enough maintainer approvals for the policy, or that the rego policies deny, are left alone
+func (bot bot) autoMerge(mr *gitlab.MergeEvent, policy policyConfig, slackChans []string) {
+	projectID, iid := mr.Project.ID, mr.ObjectAttributes.IID
+	if policy.AutoMergeApprovals > 0 {
+		approved, err := bot.maintainerApprovals(projectID, iid)
+		if err != nil {
+			logrus.WithError(err).Errorf("failed to count maintainer approvals of merge request !%d", iid)
+			return
+		}
+		if approved < policy.AutoMergeApprovals {
+			logrus.Debugf("merge request !%d has %d of the %d maintainer approvals the `%s` policy needs to auto-merge", iid, approved, policy.AutoMergeApprovals, policy.Topic)
+			return
+		}
+	}
+	opt := &gitlab.AcceptMergeRequestOptions{
+		MergeWhenPipelineSucceeds: gitlab.Bool(true),
+		SHA:                       &mr.ObjectAttributes.LastCommit.ID, // don't merge anything pushed since the approval
+	}
+	how := tr("set it to merge when its pipeline succeeds")
+	if policy.AutoMergeMethod == AUTO_MERGE_MERGE {
+		current, err := bot.gl.GetMergeRequest(projectID, iid)
+		if err != nil {
+			logrus.WithError(err).Errorf("failed to look up the pipeline of merge request !%d", iid)
+			return
+		}
+		switch {
+		case current.HeadPipeline == nil || current.HeadPipeline.Status == "success":
+			opt.MergeWhenPipelineSucceeds = nil
+			how = tr("merged it")
+		case current.HeadPipeline.Status == "failed" || current.HeadPipeline.Status == "canceled":
+			bot.notifyThreadLocalized(projectID, iid, tr("<%s|!%d> is approved, but its pipeline %s, so the `%s` policy didn't merge it.",
+				mr.ObjectAttributes.URL, iid, current.HeadPipeline.Status, policy.Topic), slackChans)
+			return
+		}
+	}
+	// checked again right before merging, for anything pushed or approved since it was announced
+	if denials := bot.policyDenials(projectID, iid, mr.Project.PathWithNamespace); len(denials) > 0 {
+		logrus.Infof("not auto-merging merge request !%d, its policies deny it: %s", iid, strings.Join(denials, "; "))
+		return
+	}
+	if _, err := bot.gl.AcceptMergeRequest(projectID, iid, opt); err != nil {
+		logrus.WithError(err).Errorf("failed to merge merge request !%d automatically", iid)
+		return
+	}
+	bot.notifyThreadLocalized(projectID, iid, tr("<%s|!%d> is approved, and the `%s` policy %s.",
+		mr.ObjectAttributes.URL, iid, policy.Topic, how), slackChans)
+}
+
+// maintainerApprovals counts the MR's approvals from the project's maintainers
+func (bot bot) maintainerApprovals(projectID, iid int) (int, error) {
+	approvals, err := bot.gl.GetMergeRequestApprovals(projectID, iid)
+	if err != nil {
+		return 0, err
+	}
+	maintainers, err := getProjectMaintainers(bot.gl, projectID)
+	if err != nil {
+		return 0, err
+	}
+	n := 0
+	for _, a := range approvals.ApprovedBy {
+		if a.User != nil && memberByID(maintainers, a.User.ID) != nil {
+			n++
+		}
+	}
+	return n, nil
+}
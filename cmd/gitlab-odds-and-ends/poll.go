@@ -0,0 +1,203 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/raidancampbell/gitlab-odds-and-ends/internal/store"
+	"github.com/sirupsen/logrus"
+	"github.com/xanzy/go-gitlab"
+)
+
+const (
+	POLL_INTERVAL_ENV_VAR = "POLL_INTERVAL"
+	POLL_STORE_KEY        = "poll"
+	// POLL_OVERLAP is how far back each poll looks past the last one, in case gitlab's clock is behind ours
+	POLL_OVERLAP = time.Minute
+	// POLLED_EVENT is the kind the dashboard shows for polled MR changes
+	POLLED_EVENT = "Merge Request Hook (polled)"
+)
+
+// polledMR is what the last poll saw of an open MR, to tell what changed since
+type polledMR struct {
+	State     string    `json:"state"`
+	SHA       string    `json:"sha"`
+	UpdatedAt time.Time `json:"updated_at"`
+	Approvals int       `json:"approvals"`
+}
+
+// polledProject is a project's MRs as of its last poll
+type polledProject struct {
+	Since time.Time        `json:"since"`
+	MRs   map[int]polledMR `json:"mrs"`
+}
+
+// poller watches the routed projects' MRs through the API, for when gitlab can't reach the bot's webhooks.  changes
+// are turned into the MR webhooks gitlab would have sent and handled the same way.  the first poll of a project only
+// takes note of its open MRs, see backfill for announcing them
+type poller struct {
+	interval time.Duration
+	store    *store.Store
+
+	mu       sync.Mutex
+	projects map[string]polledProject
+}
+
+// newPoller configures polling from the environment, returning nil if POLL_INTERVAL isn't set
+func newPoller(s *store.Store) (*poller, error) {
+	raw := os.Getenv(POLL_INTERVAL_ENV_VAR)
+	if raw == "" {
+		return nil, nil
+	}
+	interval, err := time.ParseDuration(raw)
+	if err != nil || interval <= 0 {
+		return nil, fmt.Errorf("invalid %s '%s'", POLL_INTERVAL_ENV_VAR, raw)
+	}
+	p := &poller{interval: interval, store: s, projects: make(map[string]polledProject)}
+	if _, err := s.Load(POLL_STORE_KEY, &p.projects); err != nil {
+		return nil, err
+	}
+	s.Follow(POLL_STORE_KEY, &p.projects, &p.mu)
+	return p, nil
+}
+
+// poll checks every routed project for MR changes since the last poll
+func (bot bot) poll() {
+	var projects []string
+	for p := range bot.routes.all() {
+		projects = append(projects, p)
+	}
+	sort.Strings(projects)
+	for _, project := range projects {
+		if err := bot.pollProject(project); err != nil {
+			logrus.WithError(err).Errorf("failed to poll %s for merge request changes", project)
+			bot.status.fail("poll")
+		}
+	}
+	bot.poller.mu.Lock()
+	defer bot.poller.mu.Unlock()
+	if err := bot.poller.store.Save(POLL_STORE_KEY, bot.poller.projects); err != nil {
+		logrus.WithError(err).Error("failed to persist polled merge requests")
+	}
+}
+
+// pollProject handles the project's MRs updated since its last poll
+func (bot bot) pollProject(path string) error {
+	id, err := bot.routes.projectID(bot.gl, path)
+	if err != nil {
+		return err
+	}
+	bot.poller.mu.Lock()
+	last, ok := bot.poller.projects[path]
+	bot.poller.mu.Unlock()
+	first := !ok
+	if first {
+		last = polledProject{MRs: make(map[int]polledMR)}
+	}
+	started := time.Now()
+
+	opt := &gitlab.ListProjectMergeRequestsOptions{ListOptions: gitlab.ListOptions{PerPage: 100}}
+	if first {
+		opt.State = gitlab.String("opened")
+	} else {
+		opt.UpdatedAfter = gitlab.Time(last.Since.Add(-POLL_OVERLAP))
+	}
+	var project *gitlab.Project
+	for {
+		mrs, resp, err := bot.gl.ListProjectMergeRequests(id, opt)
+		if err != nil {
+			return err
+		}
+		for _, mr := range mrs {
+			seen, known := last.MRs[mr.IID]
+			if known && mr.UpdatedAt != nil && !mr.UpdatedAt.After(seen.UpdatedAt) {
+				continue
+			}
+			now := polledMR{State: mr.State, SHA: mr.SHA}
+			if mr.UpdatedAt != nil {
+				now.UpdatedAt = *mr.UpdatedAt
+			}
+			if mr.State == "opened" {
+				if approvals, err := bot.gl.GetMergeRequestApprovals(id, mr.IID); err == nil {
+					now.Approvals = len(approvals.ApprovedBy)
+				} else {
+					now.Approvals = seen.Approvals
+				}
+			}
+			if now.State == "opened" {
+				last.MRs[mr.IID] = now
+			} else {
+				delete(last.MRs, mr.IID)
+			}
+			if first {
+				continue
+			}
+			if project == nil {
+				if project, err = bot.gl.GetProject(id); err != nil {
+					return err
+				}
+			}
+			for _, ev := range polledEvents(project, mr, seen, known, now) {
+				bot.handlePolled(path, id, ev)
+			}
+		}
+		if resp.NextPage == 0 {
+			break
+		}
+		opt.Page = resp.NextPage
+	}
+
+	last.Since = started
+	bot.poller.mu.Lock()
+	bot.poller.projects[path] = last
+	bot.poller.mu.Unlock()
+	return nil
+}
+
+// polledEvents are the MR webhooks gitlab would have sent for the change from seen (if known) to now
+func polledEvents(project *gitlab.Project, mr *gitlab.MergeRequest, seen polledMR, known bool, now polledMR) []*gitlab.MergeEvent {
+	var actions []string
+	switch {
+	case now.State == "merged":
+		actions = append(actions, MR_ACTION_MERGED)
+	case now.State == "closed":
+		if known {
+			actions = append(actions, MR_ACTION_CLOSED)
+		}
+	case !known:
+		actions = append(actions, MR_ACTION_OPENED)
+	default:
+		actions = append(actions, MR_ACTION_UPDATED)
+		if now.Approvals > seen.Approvals {
+			actions = append(actions, MR_ACTION_APPROVED)
+		} else if now.Approvals < seen.Approvals {
+			actions = append(actions, MR_ACTION_UNAPPROVED)
+		}
+	}
+	var events []*gitlab.MergeEvent
+	for _, action := range actions {
+		ev := mergeEventFor(project, mr)
+		ev.ObjectAttributes.Action = action
+		if action == MR_ACTION_UPDATED && seen.SHA != now.SHA {
+			ev.ObjectAttributes.OldRev = seen.SHA
+		}
+		events = append(events, ev)
+	}
+	return events
+}
+
+// handlePolled handles a polled MR change like gitlabCallbackRouter handles a webhook
+func (bot bot) handlePolled(path string, id int, ev *gitlab.MergeEvent) {
+	bot.status.event(path, POLLED_EVENT)
+	slackChans := bot.applyRoutingRules(ev, bot.route(path, id, nil, ""))
+	delivery := webhookDelivery{Instance: bot.instance, Project: path, Kind: POLLED_EVENT, Event: webhookTrigger(POLLED_EVENT, ev),
+		Channels: slackChans, Result: DELIVERY_HANDLED, Outcome: "handled"}
+	if len(slackChans) == 0 {
+		delivery.Result, delivery.Outcome = DELIVERY_IGNORED, "no channels to notify"
+	}
+	bot.status.delivered(delivery)
+	bot.triggeredBy(webhookTrigger(POLLED_EVENT, ev)).mergeRequest(ev, slackChans)
+}
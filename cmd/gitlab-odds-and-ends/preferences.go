@@ -0,0 +1,313 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/raidancampbell/gitlab-odds-and-ends/internal/notify"
+	"github.com/raidancampbell/gitlab-odds-and-ends/internal/store"
+	"github.com/sirupsen/logrus"
+	"github.com/slack-go/slack"
+)
+
+const (
+	PREFERENCES_STORE_KEY  = "notification_preferences"
+	DM_DIGEST_TIME_ENV_VAR = "DM_DIGEST_TIME"
+	DEFAULT_DM_DIGEST_TIME = "09:00"
+	// what people can have their DMs do
+	DMS_ON     = "on"
+	DMS_OFF    = "off"
+	DMS_DIGEST = "digest"
+	// DMs to the bot that change preferences
+	DM_PREFERENCES = "preferences"
+	DM_DMS         = "dms"
+	DM_MUTE        = "mute"
+	DM_UNMUTE      = "unmute"
+)
+
+// userPreferences are how someone wants to hear from the bot directly.  they don't change what's posted in channels
+type userPreferences struct {
+	// DMs is `on` (the default), `off` for no DMs at all, or `digest` for one DM a day at DM_DIGEST_TIME with them all
+	DMs string `json:"dms" yaml:"dms"`
+	// Muted are projects (by path with namespace) they don't want DMs about
+	Muted []string `json:"muted" yaml:"muted"`
+}
+
+func (p userPreferences) validate() error {
+	switch p.DMs {
+	case "", DMS_ON, DMS_OFF, DMS_DIGEST:
+		return nil
+	}
+	return fmt.Errorf("invalid dms '%s', expected %s, %s or %s", p.DMs, DMS_ON, DMS_OFF, DMS_DIGEST)
+}
+
+func (p userPreferences) String() string {
+	dms := p.DMs
+	if dms == "" {
+		dms = DMS_ON
+	}
+	s := "DMs: " + dms
+	if len(p.Muted) > 0 {
+		s += ", muted: `" + strings.Join(p.Muted, "`, `") + "`"
+	}
+	return s
+}
+
+type preferencesState struct {
+	Users map[string]userPreferences `json:"users"` // by slack user ID
+	// Digests are the DMs held for each digest user's next digest
+	Digests map[string][]notify.DigestedMessage `json:"digests"`
+}
+
+// preferences keeps everyone's notification preferences, set by DMing the bot or through the admin API, in the store
+type preferences struct {
+	store *store.Store
+	// send is what digests are sent with, the notifier under the preferences
+	send notify.Notifier
+
+	mu    sync.Mutex
+	state preferencesState
+}
+
+func newPreferences(s *store.Store) (*preferences, error) {
+	p := &preferences{store: s, state: preferencesState{Users: make(map[string]userPreferences), Digests: make(map[string][]notify.DigestedMessage)}}
+	if _, err := s.Load(PREFERENCES_STORE_KEY, &p.state); err != nil {
+		return nil, err
+	}
+	if p.state.Users == nil {
+		p.state.Users = make(map[string]userPreferences)
+	}
+	if p.state.Digests == nil {
+		p.state.Digests = make(map[string][]notify.DigestedMessage)
+	}
+	s.Follow(PREFERENCES_STORE_KEY, &p.state, &p.mu)
+	return p, nil
+}
+
+func (p *preferences) get(user string) userPreferences {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.state.Users[user]
+}
+
+func (p *preferences) all() map[string]userPreferences {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	all := make(map[string]userPreferences)
+	for user, prefs := range p.state.Users {
+		all[user] = prefs
+	}
+	return all
+}
+
+// set changes the user's preferences, nil forgets them
+func (p *preferences) set(user string, change func(*userPreferences)) userPreferences {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	prefs := p.state.Users[user]
+	if change == nil {
+		delete(p.state.Users, user)
+	} else {
+		change(&prefs)
+		p.state.Users[user] = prefs
+	}
+	p.saveLocked()
+	return prefs
+}
+
+// saveLocked persists the preferences.  p.mu must be held
+func (p *preferences) saveLocked() {
+	if err := p.store.Save(PREFERENCES_STORE_KEY, p.state); err != nil {
+		logrus.WithError(err).Error("failed to persist notification preferences")
+	}
+}
+
+// holds decides what happens to a DM to the user about the project (empty if it's not about one): sent, dropped, or
+// held for their digest
+func (p *preferences) holds(user, project string) (drop, digest bool) {
+	prefs := p.get(user)
+	if project != "" && contains(prefs.Muted, project) {
+		return true, false
+	}
+	return prefs.DMs == DMS_OFF, prefs.DMs == DMS_DIGEST
+}
+
+func (p *preferences) hold(user, msg string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.state.Digests[user] = append(p.state.Digests[user], notify.DigestedMessage{At: time.Now(), Text: msg})
+	p.saveLocked()
+}
+
+// flush sends everyone their digest of held DMs.  those it fails for keep theirs for next time
+func (p *preferences) flush() {
+	p.mu.Lock()
+	pending := p.state.Digests
+	if len(pending) > 0 {
+		p.state.Digests = make(map[string][]notify.DigestedMessage)
+		p.saveLocked()
+	}
+	p.mu.Unlock()
+
+	var users []string
+	for user := range pending {
+		users = append(users, user)
+	}
+	sort.Strings(users)
+	failed := make(map[string][]notify.DigestedMessage)
+	for _, user := range users {
+		msgs := pending[user]
+		lines := []string{fmt.Sprintf(":newspaper: your digest, %s:", plural(len(msgs), "message"))}
+		for _, m := range msgs {
+			lines = append(lines, fmt.Sprintf("*%s* %s", m.At.Format("Mon 15:04"), m.Text))
+		}
+		if _, err := p.send.Notify(user, strings.Join(lines, "\n")); err != nil {
+			logrus.WithError(err).Errorf("failed to send %s their DM digest", user)
+			failed[user] = msgs
+		}
+	}
+	if len(failed) == 0 {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for user, msgs := range failed {
+		p.state.Digests[user] = append(msgs, p.state.Digests[user]...)
+	}
+	p.saveLocked()
+}
+
+// isSlackUser reports whether the channel is a slack user's ID, i.e. a DM
+func isSlackUser(channel string) bool {
+	return !strings.Contains(channel, ":") && (strings.HasPrefix(channel, "U") || strings.HasPrefix(channel, "W"))
+}
+
+// preferencesNotifier checks the recipient's preferences before DMing them.  messages to channels go through
+type preferencesNotifier struct {
+	notify.Notifier
+	prefs *preferences
+	// project is what the messages are about, if anything, see bot.about
+	project string
+}
+
+// allow reports whether the DM should be sent now, holding it for the user's digest if that's what they want
+func (n preferencesNotifier) allow(channel, msg string) bool {
+	if !isSlackUser(channel) {
+		return true
+	}
+	drop, digest := n.prefs.holds(channel, n.project)
+	switch {
+	case drop:
+		logrus.Debugf("not DMing %s, their preferences say not to", channel)
+		return false
+	case digest:
+		logrus.Debugf("holding DM to %s for their digest", channel)
+		n.prefs.hold(channel, msg)
+		return false
+	}
+	return true
+}
+
+func (n preferencesNotifier) Notify(channel, msg string) (string, error) {
+	if !n.allow(channel, msg) {
+		return "", nil
+	}
+	return n.Notifier.Notify(channel, msg)
+}
+
+func (n preferencesNotifier) NotifyBlocks(channel, msg string, blocks []slack.Block) (string, error) {
+	if !n.allow(channel, msg) {
+		return "", nil
+	}
+	return n.Notifier.NotifyBlocks(channel, msg, blocks)
+}
+
+func (n preferencesNotifier) Reply(channel, threadTS, msg string) (string, error) {
+	if !n.allow(channel, msg) {
+		return "", nil
+	}
+	return n.Notifier.Reply(channel, threadTS, msg)
+}
+
+// about is the bot as it sends messages about the project, which people who muted it aren't DMed
+func (bot bot) about(project string) bot {
+	bot.notifier = adjustNotifier(bot.notifier, func(n notify.Notifier) notify.Notifier {
+		if prefs, ok := n.(preferencesNotifier); ok {
+			prefs.project = project
+			return prefs
+		}
+		return n
+	})
+	return bot
+}
+
+// dmPreferences handles `preferences`, `dms on|off|digest`, `mute <group/project>` and `unmute <group/project>`
+func (bot bot) dmPreferences(user string, args []string) string {
+	usage := "usage: `preferences`, `dms on|off|digest`, `mute <group/project>` or `unmute <group/project>`"
+	if len(args) == 0 {
+		return usage
+	}
+	args[0] = strings.ToLower(args[0])
+	switch {
+	case args[0] == DM_PREFERENCES && len(args) == 1:
+		return bot.preferences.get(user).String()
+	case args[0] == DM_DMS && len(args) == 2:
+		prefs := userPreferences{DMs: strings.ToLower(args[1])}
+		if err := prefs.validate(); err != nil {
+			return err.Error()
+		}
+		return bot.preferences.set(user, func(p *userPreferences) { p.DMs = prefs.DMs }).String()
+	case args[0] == DM_MUTE && len(args) == 2:
+		return bot.preferences.set(user, func(p *userPreferences) {
+			if !contains(p.Muted, args[1]) {
+				p.Muted = append(p.Muted, args[1])
+			}
+		}).String()
+	case args[0] == DM_UNMUTE && len(args) == 2:
+		return bot.preferences.set(user, func(p *userPreferences) {
+			var muted []string
+			for _, project := range p.Muted {
+				if project != args[1] {
+					muted = append(muted, project)
+				}
+			}
+			p.Muted = muted
+		}).String()
+	}
+	return usage
+}
+
+// adminPreferencesRouter lists everyone's notification preferences, by slack user ID
+func (bot bot) adminPreferencesRouter(c *gin.Context) {
+	c.YAML(http.StatusOK, bot.preferences.all())
+}
+
+func (bot bot) adminUserPreferencesRouter(c *gin.Context) {
+	c.YAML(http.StatusOK, bot.preferences.get(c.Param("user")))
+}
+
+// adminPutPreferencesRouter replaces someone's preferences, e.g. `{"dms": "digest", "muted": ["group/project"]}`
+func (bot bot) adminPutPreferencesRouter(c *gin.Context) {
+	user := c.Param("user")
+	var prefs userPreferences
+	if !bindAdminBody(c, &prefs) {
+		return
+	}
+	err := prefs.validate()
+	if err == nil {
+		bot.preferences.set(user, func(p *userPreferences) { *p = prefs })
+	}
+	bot.adminChanged(c, "admin_preferences_put", user, err)
+}
+
+// adminDeletePreferencesRouter puts someone back on the default preferences
+func (bot bot) adminDeletePreferencesRouter(c *gin.Context) {
+	user := c.Param("user")
+	bot.preferences.set(user, nil)
+	bot.adminChanged(c, "admin_preferences_delete", user, nil)
+}
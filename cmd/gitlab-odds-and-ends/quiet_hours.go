@@ -0,0 +1,242 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/raidancampbell/gitlab-odds-and-ends/internal/notify"
+	"github.com/raidancampbell/gitlab-odds-and-ends/internal/store"
+	"github.com/sirupsen/logrus"
+	"github.com/slack-go/slack"
+)
+
+const (
+	QUIET_HOURS_STORE_KEY = "quiet_hours_queue"
+	// QUIET_HOURS_CHECK_INTERVAL is how often channels are checked for the end of their quiet hours
+	QUIET_HOURS_CHECK_INTERVAL = time.Minute
+	// critical events a channel's quiet hours can let through
+	CRITICAL_PIPELINE_FAILED       = "pipeline_failed"
+	CRITICAL_TRUNK_BROKEN          = "trunk_broken"
+	CRITICAL_PRODUCTION_DEPLOYMENT = "production_deployment"
+	CRITICAL_INCIDENT              = "incident"
+)
+
+var criticalEvents = map[string]bool{
+	CRITICAL_PIPELINE_FAILED: true, CRITICAL_TRUNK_BROKEN: true, CRITICAL_PRODUCTION_DEPLOYMENT: true, CRITICAL_INCIDENT: true,
+}
+
+// quietHoursConfig keeps channels quiet overnight or on weekends.  their messages are held back and posted together
+// when the quiet hours end, except for the critical events, e.g.
+//
+//	quiet_hours:
+//	  - channels: [C0123456789]
+//	    hours: "19:00-08:00"
+//	    weekends: true
+//	    timezone: Europe/Berlin
+//	    critical: [trunk_broken, production_deployment]
+type quietHoursConfig struct {
+	// Channels are the channels that are kept quiet
+	Channels []string `yaml:"channels"`
+	// Hours are the quiet hours every day, e.g. `19:00-08:00`
+	Hours string `yaml:"hours"`
+	// Weekends keeps the channels quiet all saturday and sunday
+	Weekends bool `yaml:"weekends"`
+	// Timezone is the IANA timezone of Hours and Weekends, the bot's local time by default
+	Timezone string `yaml:"timezone"`
+	// Critical are the events that are posted anyway: pipeline_failed, trunk_broken (a default branch pipeline
+	// failed, and whether it is fixed), production_deployment (to one of DORA_ENVIRONMENTS), and incident (an
+	// escalation to INCIDENT_SLACK_CHANNEL)
+	Critical []string `yaml:"critical"`
+}
+
+// quietWindow is when a channel is quiet
+type quietWindow struct {
+	hours    *shift
+	weekends bool
+	loc      *time.Location
+	critical map[string]bool
+}
+
+// quiet reports whether t is in the channel's quiet hours
+func (w quietWindow) quiet(t time.Time) bool {
+	t = t.In(w.loc)
+	if w.weekends && (t.Weekday() == time.Saturday || t.Weekday() == time.Sunday) {
+		return true
+	}
+	return w.hours != nil && w.hours.covers(t)
+}
+
+// heldMessage is a message waiting for the end of its channel's quiet hours
+type heldMessage struct {
+	At   time.Time `json:"at"`
+	Text string    `json:"text"`
+}
+
+// quietHours holds back messages to channels in their quiet hours.  held messages are persisted, so a restart doesn't
+// lose them
+type quietHours struct {
+	windows map[string]quietWindow // by channel
+	store   *store.Store
+	// send is what the held messages are posted with, the notifier under the quiet hours
+	send notify.Notifier
+
+	mu   sync.Mutex
+	held map[string][]heldMessage // by channel
+}
+
+// newQuietHours configures the channels' quiet hours, returning nil if none have any
+func newQuietHours(cfgs []quietHoursConfig, s *store.Store) (*quietHours, error) {
+	if len(cfgs) == 0 {
+		return nil, nil
+	}
+	q := &quietHours{windows: make(map[string]quietWindow), store: s, held: make(map[string][]heldMessage)}
+	for _, cfg := range cfgs {
+		w := quietWindow{weekends: cfg.Weekends, loc: time.Local, critical: make(map[string]bool)}
+		if cfg.Hours != "" {
+			hours, err := parseShift(cfg.Hours, []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"})
+			if err != nil {
+				return nil, fmt.Errorf("quiet hours for %s: %v", strings.Join(cfg.Channels, ", "), err)
+			}
+			w.hours = &hours
+		}
+		if cfg.Timezone != "" {
+			loc, err := time.LoadLocation(cfg.Timezone)
+			if err != nil {
+				return nil, fmt.Errorf("invalid quiet hours timezone '%s': %v", cfg.Timezone, err)
+			}
+			w.loc = loc
+		}
+		for _, event := range cfg.Critical {
+			if !criticalEvents[event] {
+				return nil, fmt.Errorf("unknown critical event '%s' in quiet hours for %s", event, strings.Join(cfg.Channels, ", "))
+			}
+			w.critical[event] = true
+		}
+		for _, channel := range cfg.Channels {
+			q.windows[channel] = w
+		}
+	}
+	if _, err := s.Load(QUIET_HOURS_STORE_KEY, &q.held); err != nil {
+		return nil, err
+	}
+	s.Follow(QUIET_HOURS_STORE_KEY, &q.held, &q.mu)
+	return q, nil
+}
+
+// holds reports whether a message about the event (empty if it isn't a critical one) to the channel should be held back
+func (q *quietHours) holds(channel, event string) bool {
+	w, ok := q.windows[channel]
+	return ok && !w.critical[event] && w.quiet(time.Now())
+}
+
+func (q *quietHours) hold(channel, msg string) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.held[channel] = append(q.held[channel], heldMessage{At: time.Now(), Text: msg})
+	q.saveLocked()
+}
+
+// saveLocked persists the held messages.  q.mu must be held
+func (q *quietHours) saveLocked() {
+	if err := q.store.Save(QUIET_HOURS_STORE_KEY, q.held); err != nil {
+		logrus.WithError(err).Error("failed to persist messages held for quiet hours")
+	}
+}
+
+// flush posts each channel whose quiet hours are over what it missed, in one message.  channels it fails for keep
+// theirs for next time
+func (q *quietHours) flush() {
+	now := time.Now()
+	q.mu.Lock()
+	due := make(map[string][]heldMessage)
+	for channel, msgs := range q.held {
+		if !q.windows[channel].quiet(now) {
+			due[channel] = msgs
+			delete(q.held, channel)
+		}
+	}
+	if len(due) > 0 {
+		q.saveLocked()
+	}
+	q.mu.Unlock()
+
+	var channels []string
+	for channel := range due {
+		channels = append(channels, channel)
+	}
+	sort.Strings(channels)
+	failed := make(map[string][]heldMessage)
+	for _, channel := range channels {
+		msgs := due[channel]
+		lines := []string{fmt.Sprintf(":sunrise: %s while the channel was quiet:", plural(len(msgs), "update"))}
+		for _, m := range msgs {
+			lines = append(lines, fmt.Sprintf("*%s* %s", m.At.In(q.windows[channel].loc).Format("Mon 15:04"), m.Text))
+		}
+		if _, err := q.send.Notify(channel, strings.Join(lines, "\n")); err != nil {
+			logrus.WithError(err).Errorf("failed to post the messages held for quiet hours to %s", channel)
+			failed[channel] = msgs
+		}
+	}
+	if len(failed) == 0 {
+		return
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for channel, msgs := range failed {
+		q.held[channel] = append(msgs, q.held[channel]...)
+	}
+	q.saveLocked()
+}
+
+// quietNotifier holds back messages to channels in their quiet hours, unless they're about a critical event the
+// channel lets through.  replies are held too and lose their thread; edits and reactions go through, they don't
+// notify anyone
+type quietNotifier struct {
+	notify.Notifier
+	hours *quietHours
+	// event is the critical event the messages are about, if any, see bot.critical
+	event string
+}
+
+func (n quietNotifier) Notify(channel, msg string) (string, error) {
+	if n.hours.holds(channel, n.event) {
+		logrus.Debugf("holding message to %s for the end of its quiet hours", channel)
+		n.hours.hold(channel, msg)
+		return "", nil
+	}
+	return n.Notifier.Notify(channel, msg)
+}
+
+func (n quietNotifier) NotifyBlocks(channel, msg string, blocks []slack.Block) (string, error) {
+	if n.hours.holds(channel, n.event) {
+		logrus.Debugf("holding message to %s for the end of its quiet hours", channel)
+		n.hours.hold(channel, msg)
+		return "", nil
+	}
+	return n.Notifier.NotifyBlocks(channel, msg, blocks)
+}
+
+func (n quietNotifier) Reply(channel, threadTS, msg string) (string, error) {
+	if n.hours.holds(channel, n.event) {
+		logrus.Debugf("holding reply to %s for the end of its quiet hours", channel)
+		n.hours.hold(channel, msg)
+		return "", nil
+	}
+	return n.Notifier.Reply(channel, threadTS, msg)
+}
+
+// critical is the bot as it sends messages about the critical event, which get through the quiet hours of channels
+// that let it
+func (bot bot) critical(event string) bot {
+	bot.notifier = adjustNotifier(bot.notifier, func(n notify.Notifier) notify.Notifier {
+		if quiet, ok := n.(quietNotifier); ok {
+			quiet.event = event
+			return quiet
+		}
+		return n
+	})
+	return bot
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/time/rate"
+)
+
+const (
+	WEBHOOK_MAX_BODY_BYTES_ENV_VAR     = "WEBHOOK_MAX_BODY_BYTES"
+	WEBHOOK_PROJECT_RATE_LIMIT_ENV_VAR = "WEBHOOK_PROJECT_RATE_LIMIT"
+	WEBHOOK_IP_RATE_LIMIT_ENV_VAR      = "WEBHOOK_IP_RATE_LIMIT"
+	TRUSTED_PROXIES_ENV_VAR            = "TRUSTED_PROXIES"
+	DEFAULT_WEBHOOK_MAX_BODY_BYTES     = 10 << 20
+	// DEFAULT_WEBHOOK_PROJECT_RATE_LIMIT and DEFAULT_WEBHOOK_IP_RATE_LIMIT are webhooks per minute.  every project's
+	// webhooks come from gitlab's few addresses, so the per-address limit has to allow for all of them together
+	DEFAULT_WEBHOOK_PROJECT_RATE_LIMIT = 300
+	DEFAULT_WEBHOOK_IP_RATE_LIMIT      = 3000
+	// WEBHOOK_RATE_LIMIT_IDLE is how long a project or address goes without webhooks before its limiter is dropped
+	WEBHOOK_RATE_LIMIT_IDLE = 10 * time.Minute
+)
+
+// rateLimiters are token buckets by key, refilled at perMinute and holding up to a fifth of a minute's worth, so
+// short bursts like a merge train's pipelines get through
+type rateLimiters struct {
+	perMinute int
+
+	mu       sync.Mutex
+	limiters map[string]*rateLimiter
+	swept    time.Time
+}
+
+type rateLimiter struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
+
+func newRateLimiters(perMinute int) *rateLimiters {
+	return &rateLimiters{perMinute: perMinute, limiters: make(map[string]*rateLimiter), swept: time.Now()}
+}
+
+// allow takes a token from the key's bucket, or says how long until there's one
+func (r *rateLimiters) allow(key string) (bool, time.Duration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	now := time.Now()
+	if now.Sub(r.swept) > WEBHOOK_RATE_LIMIT_IDLE {
+		for k, l := range r.limiters {
+			if now.Sub(l.lastSeen) > WEBHOOK_RATE_LIMIT_IDLE {
+				delete(r.limiters, k)
+			}
+		}
+		r.swept = now
+	}
+	l, ok := r.limiters[key]
+	if !ok {
+		burst := r.perMinute / 5
+		if burst < 1 {
+			burst = 1
+		}
+		l = &rateLimiter{limiter: rate.NewLimiter(rate.Limit(float64(r.perMinute)/60), burst)}
+		r.limiters[key] = l
+	}
+	l.lastSeen = now
+	if l.limiter.AllowN(now, 1) {
+		return true, 0
+	}
+	return false, time.Duration(float64(time.Minute) / float64(r.perMinute))
+}
+
+// webhookLimits protects webhook handling from a misbehaving CI job or a hook storm: request bodies are capped, and
+// each source address and each project has its own rate limit, so one of them can't starve the others or run the bot
+// out of memory
+type webhookLimits struct {
+	maxBody  int64
+	ips      *rateLimiters
+	projects *rateLimiters
+}
+
+// newWebhookLimits caps bodies at WEBHOOK_MAX_BODY_BYTES and rate limits to WEBHOOK_IP_RATE_LIMIT and
+// WEBHOOK_PROJECT_RATE_LIMIT webhooks per minute.  a limit of 0 turns it off
+func newWebhookLimits() (*webhookLimits, error) {
+	limit := func(envVar string, def int64) (int64, error) {
+		raw := os.Getenv(envVar)
+		if raw == "" {
+			return def, nil
+		}
+		n, err := strconv.ParseInt(raw, 10, 64)
+		if err != nil || n < 0 {
+			return 0, fmt.Errorf("invalid %s '%s', expected a number", envVar, raw)
+		}
+		return n, nil
+	}
+	maxBody, err := limit(WEBHOOK_MAX_BODY_BYTES_ENV_VAR, DEFAULT_WEBHOOK_MAX_BODY_BYTES)
+	if err != nil {
+		return nil, err
+	}
+	ipLimit, err := limit(WEBHOOK_IP_RATE_LIMIT_ENV_VAR, DEFAULT_WEBHOOK_IP_RATE_LIMIT)
+	if err != nil {
+		return nil, err
+	}
+	projectLimit, err := limit(WEBHOOK_PROJECT_RATE_LIMIT_ENV_VAR, DEFAULT_WEBHOOK_PROJECT_RATE_LIMIT)
+	if err != nil {
+		return nil, err
+	}
+	l := &webhookLimits{maxBody: maxBody}
+	if ipLimit > 0 {
+		l.ips = newRateLimiters(int(ipLimit))
+	}
+	if projectLimit > 0 {
+		l.projects = newRateLimiters(int(projectLimit))
+	}
+	return l, nil
+}
+
+// webhookSource is just enough of a webhook to tell which project sent it
+type webhookSource struct {
+	Project struct {
+		PathWithNamespace string `json:"path_with_namespace"`
+	} `json:"project"`
+}
+
+// middleware enforces the size and source address limits before the webhook is handled, counting rejections in the
+// bot's status.  the body is read here, and handed on to the handler
+func (l *webhookLimits) middleware(status *botStatus) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ip := c.ClientIP()
+		if l.ips != nil {
+			if ok, wait := l.ips.allow(ip); !ok {
+				l.reject(c, status, wait, "from "+ip)
+				return
+			}
+		}
+		if l.maxBody > 0 && c.Request.ContentLength > l.maxBody {
+			l.tooLarge(c, status, ip)
+			return
+		}
+		body := io.Reader(c.Request.Body)
+		if l.maxBody > 0 {
+			body = io.LimitReader(body, l.maxBody+1)
+		}
+		b, err := ioutil.ReadAll(body)
+		if err != nil {
+			logrus.WithError(err).Errorf("failed to read webhook from %s", ip)
+			http.Error(c.Writer, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+			c.Abort()
+			return
+		}
+		if l.maxBody > 0 && int64(len(b)) > l.maxBody {
+			l.tooLarge(c, status, ip)
+			return
+		}
+		c.Request.Body = ioutil.NopCloser(bytes.NewReader(b))
+		c.Next()
+	}
+}
+
+// projectMiddleware enforces the per-project limit.  it believes the project the webhook names, so it goes after the
+// webhook's secret is checked, and after middleware read the body
+func (l *webhookLimits) projectMiddleware(status *botStatus) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if l.projects == nil {
+			return
+		}
+		b, err := ioutil.ReadAll(c.Request.Body)
+		if err != nil {
+			return // left for the handler to fail on
+		}
+		c.Request.Body = ioutil.NopCloser(bytes.NewReader(b))
+		var source webhookSource
+		// a body that isn't JSON is left for the handler to reject
+		if json.Unmarshal(b, &source) == nil && source.Project.PathWithNamespace != "" {
+			if ok, wait := l.projects.allow(source.Project.PathWithNamespace); !ok {
+				l.reject(c, status, wait, "for "+source.Project.PathWithNamespace)
+			}
+		}
+	}
+}
+
+// trustedProxiesFromEnv is the TRUSTED_PROXIES whose X-Forwarded-For is believed, none by default
+func trustedProxiesFromEnv() []string {
+	var proxies []string
+	for _, p := range strings.Split(os.Getenv(TRUSTED_PROXIES_ENV_VAR), ",") {
+		if p = strings.TrimSpace(p); p != "" {
+			proxies = append(proxies, p)
+		}
+	}
+	return proxies
+}
+
+// reject turns away a webhook over its rate limit, telling the sender when to try again
+func (l *webhookLimits) reject(c *gin.Context, status *botStatus, wait time.Duration, source string) {
+	logrus.Warnf("rate limiting %s webhook %s", c.Request.Header.Get(HEADER_GITLAB_EVENT), source)
+	status.fail("rate limited webhook")
+	status.delivered(webhookDelivery{Kind: c.Request.Header.Get(HEADER_GITLAB_EVENT), Result: DELIVERY_ERROR, Outcome: "rate limited " + source})
+	c.Header("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+	http.Error(c.Writer, http.StatusText(http.StatusTooManyRequests), http.StatusTooManyRequests)
+	c.Abort()
+}
+
+// tooLarge turns away a webhook over WEBHOOK_MAX_BODY_BYTES
+func (l *webhookLimits) tooLarge(c *gin.Context, status *botStatus, ip string) {
+	logrus.Warnf("rejecting %s webhook from %s, it's over %d bytes", c.Request.Header.Get(HEADER_GITLAB_EVENT), ip, l.maxBody)
+	status.fail("oversized webhook")
+	status.delivered(webhookDelivery{Kind: c.Request.Header.Get(HEADER_GITLAB_EVENT), Result: DELIVERY_ERROR, Outcome: "rejected: too large"})
+	http.Error(c.Writer, http.StatusText(http.StatusRequestEntityTooLarge), http.StatusRequestEntityTooLarge)
+	c.Abort()
+}
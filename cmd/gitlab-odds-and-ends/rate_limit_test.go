@@ -0,0 +1,53 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/raidancampbell/gitlab-odds-and-ends/internal/webhook"
+)
+
+func TestWebhookLimits(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	b := bot{webhookAuth: &webhook.Auth{Secret: "s3cret"}, status: newBotStatus()}
+	limits := &webhookLimits{ips: newRateLimiters(15), projects: newRateLimiters(5)} // bursts of 3 and 1
+	r := gin.New()
+	if err := r.SetTrustedProxies(nil); err != nil {
+		t.Fatal(err)
+	}
+	r.POST("/gitlab/callback", limits.middleware(b.status), b.verifyWebhook, limits.projectMiddleware(b.status), func(c *gin.Context) {
+		c.Status(http.StatusOK)
+	})
+	send := func(token, project, forwardedFor string) int {
+		req := httptest.NewRequest(http.MethodPost, "/gitlab/callback", strings.NewReader(`{"object_kind": "push", "project": {"path_with_namespace": "`+project+`"}}`))
+		req.RemoteAddr = "192.0.2.1:1234"
+		req.Header.Set(webhook.HEADER_GITLAB_TOKEN, token)
+		if forwardedFor != "" {
+			req.Header.Set("X-Forwarded-For", forwardedFor)
+		}
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	// a forged webhook naming the project doesn't use up its budget
+	if got := send("guess", "team/app", ""); got != http.StatusUnauthorized {
+		t.Errorf("forged webhook = %d, want %d", got, http.StatusUnauthorized)
+	}
+	if got := send("s3cret", "team/app", ""); got != http.StatusOK {
+		t.Errorf("first webhook = %d, want %d", got, http.StatusOK)
+	}
+	if got := send("s3cret", "team/app", ""); got != http.StatusTooManyRequests {
+		t.Errorf("webhook over the project's limit = %d, want %d", got, http.StatusTooManyRequests)
+	}
+	// the address's burst is used up, whatever X-Forwarded-For says
+	if got := send("s3cret", "team/other", "198.51.100.8"); got != http.StatusTooManyRequests {
+		t.Errorf("webhook over the address's limit = %d, want %d", got, http.StatusTooManyRequests)
+	}
+	if _, ok := limits.ips.limiters["198.51.100.8"]; ok {
+		t.Error("rate limited by the forwarded address of an untrusted proxy")
+	}
+}
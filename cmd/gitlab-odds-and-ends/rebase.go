@@ -0,0 +1,103 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/raidancampbell/gitlab-odds-and-ends/internal/store"
+	"github.com/sirupsen/logrus"
+	"github.com/xanzy/go-gitlab"
+)
+
+const (
+	// REBASE_API rebases MRs that fall behind with gitlab's rebase API, or asks their author to on projects that only
+	// fast-forward merge
+	REBASE_API = "api"
+	// REBASE_COMMENT asks the author to rebase MRs that fall behind
+	REBASE_COMMENT = "comment"
+	// REBASES_STORE_KEY keeps the MRs that are behind in the store, so a restart or another replica doesn't rebase
+	// them again
+	REBASES_STORE_KEY = "rebases"
+)
+
+// validateRebaseModes checks the projects' rebase settings up front, like validatePolicies
+func validateRebaseModes(projects []projectConfig) error {
+	for _, p := range projects {
+		switch p.Rebase {
+		case "", REBASE_API, REBASE_COMMENT:
+		default:
+			return fmt.Errorf("project %s has invalid rebase '%s', expected %s or %s", p.Project, p.Rebase, REBASE_API, REBASE_COMMENT)
+		}
+	}
+	return nil
+}
+
+// rebases remembers which MRs (by mrRef) the bot already rebased or asked to be rebased since they fell behind, so
+// it happens once each time their target branch moves on without them
+type rebases struct {
+	store  *store.Store
+	mu     sync.Mutex
+	behind map[string]bool
+}
+
+func newRebases(s *store.Store) (*rebases, error) {
+	r := &rebases{store: s, behind: make(map[string]bool)}
+	if _, err := s.Load(REBASES_STORE_KEY, &r.behind); err != nil {
+		return nil, err
+	}
+	s.Follow(REBASES_STORE_KEY, &r.behind, &r.mu)
+	return r, nil
+}
+
+// save persists the MRs that are behind.  callers hold mu
+func (r *rebases) save() {
+	if err := r.store.Save(REBASES_STORE_KEY, r.behind); err != nil {
+		logrus.WithError(err).Error("failed to persist rebased merge requests")
+	}
+}
+
+// fellBehind records whether the MR is behind its target, reporting whether it's newly so
+func (r *rebases) fellBehind(ref string, behind bool) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !behind {
+		if r.behind[ref] {
+			delete(r.behind, ref)
+			r.save()
+		}
+		return false
+	}
+	if r.behind[ref] {
+		return false
+	}
+	r.behind[ref] = true
+	r.save()
+	return true
+}
+
+// maybeRebase deals with the MR falling behind its target branch as its project's rebase setting says.  conflicting
+// MRs are left to checkBlocked, since gitlab can't rebase them
+func (bot bot) maybeRebase(project *gitlab.Project, mr *gitlab.MergeRequest, slackChans []string) {
+	mode := bot.projects[project.PathWithNamespace].Rebase
+	if mode == "" || mr.HasConflicts {
+		return
+	}
+	if !bot.rebases.fellBehind(mrRef(mr.ProjectID, mr.IID), mr.DivergedCommitsCount > 0) {
+		return
+	}
+	behind := fmt.Sprintf("%s behind `%s`", plural(mr.DivergedCommitsCount, "commit"), mr.TargetBranch)
+	if mode == REBASE_API && project.MergeMethod != gitlab.FastForwardMerge {
+		err := bot.gl.RebaseMergeRequest(mr.ProjectID, mr.IID)
+		if err == nil {
+			logrus.Infof("rebasing merge request !%d in %s, it's %s", mr.IID, project.PathWithNamespace, behind)
+			bot.notifyThreadLocalized(mr.ProjectID, mr.IID, tr("<%s|!%d> was %s, so I've started rebasing it.", mr.WebURL, mr.IID, behind), slackChans)
+			return
+		}
+		logrus.WithError(err).Warnf("failed to rebase merge request !%d, asking its author to", mr.IID)
+	}
+	mention := ""
+	if mr.Author != nil {
+		mention = "@" + mr.Author.Username + " "
+	}
+	bot.commentOn(mr.ProjectID, mr.IID, fmt.Sprintf("%sthis merge request is %s.  Please rebase it onto `%s`.", mention, behind, mr.TargetBranch))
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/raidancampbell/gitlab-odds-and-ends/internal/store"
+	"github.com/sirupsen/logrus"
+	"github.com/xanzy/go-gitlab"
+)
+
+const (
+	REVIEW_RECOGNITION_KEY = "review_recognition"
+	// every STREAK_MILESTONE business days in a row with a review earns a shout-out
+	STREAK_MILESTONE = 5
+)
+
+// DEFAULT_REVIEW_MILESTONES are the review counts in a quarter that earn a shout-out
+var DEFAULT_REVIEW_MILESTONES = []int{10, 25, 50, 100, 200}
+
+// recognitionConfig turns on light-hearted shout-outs for reviewers who hit a milestone.  it's off unless enabled
+type recognitionConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// Milestones are the review counts in a quarter worth a shout-out, DEFAULT_REVIEW_MILESTONES by default
+	Milestones []int `yaml:"milestones"`
+	// QuietChannels never get shout-outs, for teams that would rather not be gamified
+	QuietChannels []string `yaml:"quiet_channels"`
+}
+
+// reviewerTally is one reviewer's reviews this quarter and their current streak
+type reviewerTally struct {
+	Quarter string `json:"quarter"`
+	// Reviewed are the MRs (by mrRef) they approved this quarter, so approving twice only counts once
+	Reviewed map[string]bool `json:"reviewed"`
+	// LastDay is the last day they reviewed on, and Streak how many business days in a row that's been
+	LastDay string `json:"last_day"`
+	Streak  int    `json:"streak"`
+}
+
+// recognition counts approvals per reviewer and per quarter, persisted so a restart doesn't reset anyone's count
+type recognition struct {
+	milestones map[int]bool
+	quiet      map[string]bool
+	store      *store.Store
+	mu         sync.Mutex
+	tallies    map[string]*reviewerTally // by gitlab username
+}
+
+// newRecognition returns nil unless recognition is enabled
+func newRecognition(cfg recognitionConfig, s *store.Store) (*recognition, error) {
+	if !cfg.Enabled {
+		return nil, nil
+	}
+	r := &recognition{milestones: make(map[int]bool), quiet: make(map[string]bool), store: s, tallies: make(map[string]*reviewerTally)}
+	milestones := cfg.Milestones
+	if len(milestones) == 0 {
+		milestones = DEFAULT_REVIEW_MILESTONES
+	}
+	for _, m := range milestones {
+		r.milestones[m] = true
+	}
+	for _, c := range cfg.QuietChannels {
+		r.quiet[c] = true
+	}
+	if _, err := s.Load(REVIEW_RECOGNITION_KEY, &r.tallies); err != nil {
+		return nil, err
+	}
+	s.Follow(REVIEW_RECOGNITION_KEY, &r.tallies, &r.mu)
+	return r, nil
+}
+
+// quarter names the quarter the time is in, e.g. `2021-Q2`
+func quarter(t time.Time) string {
+	return fmt.Sprintf("%d-Q%d", t.Year(), (int(t.Month())-1)/3+1)
+}
+
+// previousBusinessDay is the weekday before the day
+func previousBusinessDay(day time.Time) time.Time {
+	day = day.AddDate(0, 0, -1)
+	for day.Weekday() == time.Saturday || day.Weekday() == time.Sunday {
+		day = day.AddDate(0, 0, -1)
+	}
+	return day
+}
+
+// count records the review, returning the reviewer's reviews this quarter and their streak if either just hit a
+// milestone, or zeroes if not
+func (r *recognition) count(username, ref string, now time.Time) (reviews, streak int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	t, ok := r.tallies[username]
+	if !ok || t.Quarter != quarter(now) {
+		fresh := &reviewerTally{Quarter: quarter(now), Reviewed: make(map[string]bool)}
+		if ok { // streaks carry over into the new quarter
+			fresh.LastDay, fresh.Streak = t.LastDay, t.Streak
+		}
+		t = fresh
+		r.tallies[username] = t
+	}
+	if t.Reviewed[ref] {
+		return 0, 0
+	}
+	t.Reviewed[ref] = true
+
+	today := now.Format("2006-01-02")
+	newDay := t.LastDay != today
+	if newDay {
+		if t.LastDay == previousBusinessDay(now).Format("2006-01-02") {
+			t.Streak++
+		} else {
+			t.Streak = 1
+		}
+		t.LastDay = today
+	}
+	if err := r.store.Save(REVIEW_RECOGNITION_KEY, r.tallies); err != nil {
+		logrus.WithError(err).Error("failed to persist review recognition")
+	}
+
+	if r.milestones[len(t.Reviewed)] {
+		reviews = len(t.Reviewed)
+	}
+	if newDay && t.Streak > 1 && t.Streak%STREAK_MILESTONE == 0 {
+		streak = t.Streak
+	}
+	return reviews, streak
+}
+
+// ordinal is 1st, 2nd, 3rd, 4th...
+func ordinal(n int) string {
+	suffix := "th"
+	if n%100 < 11 || n%100 > 13 {
+		switch n % 10 {
+		case 1:
+			suffix = "st"
+		case 2:
+			suffix = "nd"
+		case 3:
+			suffix = "rd"
+		}
+	}
+	return fmt.Sprintf("%d%s", n, suffix)
+}
+
+// recognizeReview counts the approval towards the approver's tally, and gives them a shout-out in the MR's channels
+// if it hit a milestone.  approving your own MR doesn't count
+func (bot bot) recognizeReview(mr *gitlab.MergeEvent, slackChans []string) {
+	if bot.recognition == nil || mr.User == nil || mr.User.Username == "" {
+		return
+	}
+	if author, err := bot.gl.GetUser(mr.ObjectAttributes.AuthorID); err == nil && author.Username == mr.User.Username {
+		return
+	}
+	reviews, streak := bot.recognition.count(mr.User.Username, mrRef(mr.Project.ID, mr.ObjectAttributes.IID), time.Now())
+	if reviews == 0 && streak == 0 {
+		return
+	}
+	who := mr.User.Name
+	if slackID, err := bot.users.slackUser(mr.User.Username); err == nil {
+		who = fmt.Sprintf("<@%s>", slackID)
+	}
+	var msg string
+	switch {
+	case reviews > 0 && streak > 0:
+		msg = fmt.Sprintf(":tada: %s completed their %s review this quarter, and has reviewed something %d business days in a row!", who, ordinal(reviews), streak)
+	case reviews > 0:
+		msg = fmt.Sprintf(":tada: %s completed their %s review this quarter!", who, ordinal(reviews))
+	default:
+		msg = fmt.Sprintf(":fire: %s has reviewed something %d business days in a row!", who, streak)
+	}
+	var chans []string
+	for _, c := range slackChans {
+		if !bot.recognition.quiet[c] {
+			chans = append(chans, c)
+		}
+	}
+	bot.notify(msg, chans)
+}
@@ -0,0 +1,310 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/raidancampbell/gitlab-odds-and-ends/internal/store"
+	"github.com/sirupsen/logrus"
+	"github.com/slack-go/slack"
+	"github.com/xanzy/go-gitlab"
+)
+
+const (
+	ACTION_SIGN_OFF_RC    = "sign_off_rc"
+	RC_SIGNOFF_STORE_KEY  = "rc_signoffs"
+	TAG_REF_PREFIX        = "refs/tags/"
+	GIT_ZERO_SHA          = "0000000000000000000000000000000000000000"
+	DEFAULT_RC_TAG_FORMAT = `^(v?\d+\.\d+\.\d+)-rc\.?\d+$`
+)
+
+// releaseSignoffConfig turns release candidate tags into a sign-off checklist.  once every team has signed off, the
+// final release is created from the candidate's commit
+type releaseSignoffConfig struct {
+	// Pattern matches release candidate tags.  its first capture group is the final release's tag, e.g. `v1.2.3` for
+	// `v1.2.3-rc1`.  defaults to DEFAULT_RC_TAG_FORMAT
+	Pattern string `yaml:"pattern"`
+	// Teams must each sign off on a release candidate
+	Teams []signoffTeam `yaml:"teams"`
+}
+
+type signoffTeam struct {
+	Name string `yaml:"name"`
+	// Members are the slack user IDs allowed to sign off for the team.  empty means anyone
+	Members []string `yaml:"members"`
+}
+
+// rcSignoff is a release candidate waiting on sign-off, persisted in the store
+type rcSignoff struct {
+	ProjectID int    `json:"project_id"`
+	Project   string `json:"project"`
+	WebURL    string `json:"web_url"`
+	Tag       string `json:"tag"`
+	Release   string `json:"release"`
+	SHA       string `json:"sha"`
+	// SignedOff maps team names to the slack user that signed off for the team
+	SignedOff map[string]string `json:"signed_off"`
+	// Signers are the slack usernames of the users that signed off, by ID, for the release's description
+	Signers  map[string]string `json:"signers"`
+	Messages []slackMessage    `json:"messages"`
+	Released bool              `json:"released"`
+}
+
+// releaseSignoffs tracks every release candidate's sign-off state
+type releaseSignoffs struct {
+	pattern *regexp.Regexp
+	teams   []signoffTeam
+	store   *store.Store
+	// instance qualifies the sign-off buttons, see instanceValue
+	instance string
+
+	mu         sync.Mutex
+	candidates map[string]*rcSignoff // keyed by rcKey
+}
+
+// newReleaseSignoffs returns nil when no teams are configured, disabling sign-offs
+func newReleaseSignoffs(cfg releaseSignoffConfig, s *store.Store) (*releaseSignoffs, error) {
+	if len(cfg.Teams) == 0 {
+		return nil, nil
+	}
+	if cfg.Pattern == "" {
+		cfg.Pattern = DEFAULT_RC_TAG_FORMAT
+	}
+	pattern, err := regexp.Compile(cfg.Pattern)
+	if err != nil {
+		return nil, fmt.Errorf("invalid release candidate pattern: %v", err)
+	}
+	if pattern.NumSubexp() < 1 {
+		return nil, fmt.Errorf("release candidate pattern '%s' needs a capture group for the release's tag", cfg.Pattern)
+	}
+	for _, t := range cfg.Teams {
+		if t.Name == "" || strings.Contains(t.Name, "|") {
+			return nil, fmt.Errorf("invalid sign-off team name '%s'", t.Name)
+		}
+	}
+	r := &releaseSignoffs{pattern: pattern, teams: cfg.Teams, store: s, candidates: make(map[string]*rcSignoff)}
+	if _, err := s.Load(RC_SIGNOFF_STORE_KEY, &r.candidates); err != nil {
+		return nil, err
+	}
+	s.Follow(RC_SIGNOFF_STORE_KEY, &r.candidates, &r.mu)
+	return r, nil
+}
+
+// rcKey identifies a release candidate in button values and the store
+func rcKey(projectID int, tag string) string {
+	return fmt.Sprintf("%d|%s", projectID, tag)
+}
+
+// saveLocked persists the candidates.  r.mu must be held
+func (r *releaseSignoffs) saveLocked() {
+	if err := r.store.Save(RC_SIGNOFF_STORE_KEY, r.candidates); err != nil {
+		logrus.WithError(err).Error("failed to persist release sign-offs")
+	}
+}
+
+// canSignOff reports whether the slack user may sign off for the team
+func (r *releaseSignoffs) canSignOff(team, slackID string) bool {
+	for _, t := range r.teams {
+		if t.Name != team {
+			continue
+		}
+		if len(t.Members) == 0 {
+			return true
+		}
+		for _, m := range t.Members {
+			if m == slackID {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// complete reports whether every team has signed off
+func (r *releaseSignoffs) complete(rc *rcSignoff) bool {
+	for _, t := range r.teams {
+		if rc.SignedOff[t.Name] == "" {
+			return false
+		}
+	}
+	return true
+}
+
+// signoffMessage renders the checklist, with a sign-off button for each team still to sign off
+func (r *releaseSignoffs) signoffMessage(rc *rcSignoff) (string, []slack.Block) {
+	msg := fmt.Sprintf("Release candidate `%s` of `%s` needs sign-off before `%s` is released.", rc.Tag, rc.Project, rc.Release)
+	if rc.Released {
+		msg = fmt.Sprintf("Release candidate `%s` of `%s` was signed off and released as `%s`.", rc.Tag, rc.Project, rc.Release)
+	}
+	var lines []string
+	var buttons []slack.BlockElement
+	for _, t := range r.teams {
+		if by := rc.SignedOff[t.Name]; by != "" {
+			lines = append(lines, fmt.Sprintf(":white_check_mark: *%s* signed off by <@%s>", t.Name, by))
+			continue
+		}
+		lines = append(lines, fmt.Sprintf(":hourglass: *%s*", t.Name))
+		buttons = append(buttons, slack.NewButtonBlockElement(ACTION_SIGN_OFF_RC, instanceValue(r.instance, rcKey(rc.ProjectID, rc.Tag)+"|"+t.Name),
+			slack.NewTextBlockObject(slack.PlainTextType, "Sign off for "+t.Name, false, false)))
+	}
+	blocks := []slack.Block{
+		slack.NewSectionBlock(slack.NewTextBlockObject(slack.MarkdownType, fmt.Sprintf("%s  <%s/-/tags/%s|View tag>", msg, rc.WebURL, rc.Tag), false, false), nil, nil),
+		slack.NewSectionBlock(slack.NewTextBlockObject(slack.MarkdownType, strings.Join(lines, "\n"), false, false), nil, nil),
+	}
+	if len(buttons) > 0 {
+		blocks = append(blocks, slack.NewActionBlock("", buttons...))
+	}
+	return msg, blocks
+}
+
+// tag receives a tag push event, posting a sign-off checklist for new release candidate tags
+func (bot bot) tag(ev *gitlab.TagEvent, slackChans []string) {
+	logrus.Debugf("processing tag webhook %+v", ev)
+	if bot.signoffs == nil || ev.After == GIT_ZERO_SHA { // deleted
+		return
+	}
+	tag := strings.TrimPrefix(ev.Ref, TAG_REF_PREFIX)
+	match := bot.signoffs.pattern.FindStringSubmatch(tag)
+	if match == nil {
+		return
+	}
+	if bot.slackSigningSecret == "" {
+		logrus.Warnf("not posting sign-off for release candidate %s, sign-off buttons need SLACK_SIGNING_SECRET", tag)
+		return
+	}
+
+	key := rcKey(ev.ProjectID, tag)
+	bot.signoffs.mu.Lock()
+	existing, ok := bot.signoffs.candidates[key]
+	same := ok && existing.SHA == ev.CheckoutSHA
+	bot.signoffs.mu.Unlock()
+	if same { // pushed again, e.g. from another clone: the sign-offs so far still stand
+		logrus.Infof("release candidate %s of %s was pushed again at the same commit, keeping its sign-offs", tag, ev.Project.PathWithNamespace)
+		return
+	}
+
+	rc := &rcSignoff{
+		ProjectID: ev.ProjectID,
+		Project:   ev.Project.PathWithNamespace,
+		WebURL:    ev.Project.WebURL,
+		Tag:       tag,
+		Release:   match[1],
+		SHA:       ev.CheckoutSHA,
+		SignedOff: make(map[string]string),
+		Signers:   make(map[string]string),
+	}
+	msg, blocks := bot.signoffs.signoffMessage(rc)
+	rc.Messages = bot.notifyBlocks(msg, blocks, slackChans)
+
+	bot.signoffs.mu.Lock()
+	bot.signoffs.candidates[key] = rc
+	bot.signoffs.saveLocked()
+	bot.signoffs.mu.Unlock()
+}
+
+// signOffRelease handles a team's "Sign off" button.  the last sign-off creates the release
+func (bot bot) signOffRelease(value string, callback slack.InteractionCallback) {
+	parts := strings.SplitN(value, "|", 3)
+	if len(parts) != 3 {
+		logrus.Errorf("Failed to parse sign-off '%s'", value)
+		return
+	}
+	projectID, err := strconv.Atoi(parts[0])
+	if err != nil {
+		logrus.WithError(err).Errorf("Failed to parse sign-off '%s'", value)
+		return
+	}
+	key, team := rcKey(projectID, parts[1]), parts[2]
+	if !bot.signoffs.canSignOff(team, callback.User.ID) {
+		respond(callback, fmt.Sprintf("you can't sign off for %s", team))
+		return
+	}
+
+	bot.signoffs.mu.Lock()
+	rc, ok := bot.signoffs.candidates[key]
+	if !ok || rc.Released {
+		bot.signoffs.mu.Unlock()
+		respond(callback, "that release candidate isn't waiting on sign-off any more")
+		return
+	}
+	rc.SignedOff[team] = callback.User.ID
+	if rc.Signers == nil { // signed off on before signers were remembered
+		rc.Signers = make(map[string]string)
+	}
+	rc.Signers[callback.User.ID] = callback.User.Name
+	complete := bot.signoffs.complete(rc)
+	bot.signoffs.saveLocked()
+	snapshot := *rc
+	bot.signoffs.mu.Unlock()
+
+	if complete {
+		bot.release(key, &snapshot)
+		return
+	}
+	bot.updateSignoff(&snapshot)
+}
+
+// release creates the final release from the signed off candidate's commit
+func (bot bot) release(key string, rc *rcSignoff) {
+	description := fmt.Sprintf("Released from release candidate %s.\n\nSigned off by:\n", rc.Tag)
+	for _, t := range bot.signoffs.teams {
+		description += fmt.Sprintf("- %s: %s\n", t.Name, bot.signer(rc, rc.SignedOff[t.Name]))
+	}
+	if _, err := bot.gl.CreateRelease(rc.ProjectID, &gitlab.CreateReleaseOptions{
+		Name:        &rc.Release,
+		TagName:     &rc.Release,
+		Ref:         &rc.SHA,
+		Description: &description,
+	}); err != nil {
+		logrus.WithError(err).Errorf("failed to release %s of %s", rc.Release, rc.Project)
+		msg := fmt.Sprintf("Everyone signed off, but I couldn't create the `%s` release: %v", rc.Release, err)
+		for _, m := range rc.Messages {
+			if _, err := bot.notifier.Reply(m.Channel, m.Timestamp, msg); err != nil {
+				logrus.WithError(err).Errorf("failed to reply to slack thread %s in channel %s", m.Timestamp, m.Channel)
+			}
+		}
+		return
+	}
+
+	bot.signoffs.mu.Lock()
+	if stored, ok := bot.signoffs.candidates[key]; ok {
+		stored.Released = true
+	}
+	bot.signoffs.saveLocked()
+	bot.signoffs.mu.Unlock()
+
+	rc.Released = true
+	bot.updateSignoff(rc)
+	var channels []string
+	for _, m := range rc.Messages {
+		channels = append(channels, m.Channel)
+	}
+	bot.notify(fmt.Sprintf(":rocket: `%s` of `%s` is released!  See %s/-/releases/%s", rc.Release, rc.Project, rc.WebURL, rc.Release), dedupe(channels))
+}
+
+// signer is who the slack user that signed off is in gitlab, e.g. `@alice`, or their slack username if they can't be
+// matched to a gitlab user
+func (bot bot) signer(rc *rcSignoff, slackID string) string {
+	if bot.users != nil {
+		if user, err := bot.users.gitlabUser(slackID); err == nil {
+			return "@" + user.Username
+		}
+	}
+	if name := rc.Signers[slackID]; name != "" {
+		return name + " (slack)"
+	}
+	return slackID + " (slack)"
+}
+
+// updateSignoff re-renders the candidate's checklist messages
+func (bot bot) updateSignoff(rc *rcSignoff) {
+	msg, blocks := bot.signoffs.signoffMessage(rc)
+	for _, m := range rc.Messages {
+		if err := bot.notifier.Update(m.Channel, m.Timestamp, msg, blocks); err != nil {
+			logrus.WithError(err).Errorf("failed to update sign-off message %s in channel %s", m.Timestamp, m.Channel)
+		}
+	}
+}
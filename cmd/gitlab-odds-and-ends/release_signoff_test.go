@@ -0,0 +1,95 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/raidancampbell/gitlab-odds-and-ends/internal/notify"
+	"github.com/raidancampbell/gitlab-odds-and-ends/internal/store"
+	"github.com/slack-go/slack"
+	"github.com/xanzy/go-gitlab"
+)
+
+// signoffBot is a bot whose release candidates need sign-off from the qa and ops teams
+func signoffBot(t *testing.T, rec *notify.Recorder, gl *fakeGitLab) bot {
+	t.Helper()
+	b := notifyingBot(t, rec)
+	s, err := store.Open("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.signoffs, err = newReleaseSignoffs(releaseSignoffConfig{Teams: []signoffTeam{{Name: "qa"}, {Name: "ops"}}}, s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.gl = gl
+	b.users = newUserMapper(nil, gl, []userConfig{{Slack: "UALICE", GitLab: "alice"}})
+	b.slackSigningSecret = "secret"
+	return b
+}
+
+func rcTag(tag, sha string) *gitlab.TagEvent {
+	ev := &gitlab.TagEvent{ObjectKind: "tag_push", Ref: TAG_REF_PREFIX + tag, After: sha, CheckoutSHA: sha, ProjectID: testProject}
+	ev.Project.PathWithNamespace = "group/project"
+	ev.Project.WebURL = "https://gitlab.example/group/project"
+	return ev
+}
+
+func signOff(b bot, tag, team, slackID, name string) {
+	var callback slack.InteractionCallback
+	callback.User.ID, callback.User.Name = slackID, name
+	b.signOffRelease(rcKey(testProject, tag)+"|"+team, callback)
+}
+
+func TestReleaseCandidatePushedAgain(t *testing.T) {
+	tests := []struct {
+		name          string
+		sha           string
+		wantSignedOff bool
+	}{
+		{"at the same commit keeps its sign-offs", "aaaa", true},
+		{"at a new commit needs signing off again", "bbbb", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := &notify.Recorder{}
+			b := signoffBot(t, rec, newFakeGitLab())
+			b.tag(rcTag("v1.2.3-rc1", "aaaa"), []string{"#releases"})
+			signOff(b, "v1.2.3-rc1", "qa", "UALICE", "alice")
+
+			b.tag(rcTag("v1.2.3-rc1", tt.sha), []string{"#releases"})
+
+			rc := b.signoffs.candidates[rcKey(testProject, "v1.2.3-rc1")]
+			if signedOff := rc.SignedOff["qa"] != ""; signedOff != tt.wantSignedOff {
+				t.Errorf("qa signed off = %v, want %v", signedOff, tt.wantSignedOff)
+			}
+			wantChecklists := 1
+			if !tt.wantSignedOff {
+				wantChecklists = 2
+			}
+			if got := rec.Of(notify.KIND_BLOCKS); len(got) != wantChecklists {
+				t.Errorf("posted %d checklists, want %d", len(got), wantChecklists)
+			}
+		})
+	}
+}
+
+func TestReleaseListsSigners(t *testing.T) {
+	gl := newFakeGitLab()
+	gl.addUser(10, "alice", gitlab.MaintainerPermissions)
+	b := signoffBot(t, &notify.Recorder{}, gl)
+	b.tag(rcTag("v1.2.3-rc1", "aaaa"), []string{"#releases"})
+
+	signOff(b, "v1.2.3-rc1", "qa", "UALICE", "alice")
+	signOff(b, "v1.2.3-rc1", "ops", "UBOB", "bob")
+
+	if len(gl.releases) != 1 {
+		t.Fatalf("created %d releases, want 1", len(gl.releases))
+	}
+	description := *gl.releases[0].Description
+	for _, want := range []string{"- qa: @alice\n", "- ops: bob (slack)\n"} {
+		if !strings.Contains(description, want) {
+			t.Errorf("release description %q doesn't list %q", description, want)
+		}
+	}
+}
@@ -0,0 +1,331 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/raidancampbell/gitlab-odds-and-ends/internal/store"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	CONFIG_RELOAD_INTERVAL_ENV_VAR = "CONFIG_RELOAD_INTERVAL"
+	DEFAULT_CONFIG_RELOAD_INTERVAL = 30 * time.Second
+	// SECRET_FILE_SUFFIX names the variable holding a file to read a secret from instead, e.g. GITLAB_TOKEN_FILE.
+	// the file is read again on reload, so the secret can be rotated without a restart
+	SECRET_FILE_SUFFIX = "_FILE"
+)
+
+// secretFromEnv reads the secret in envVar, or in the file named by envVar+SECRET_FILE_SUFFIX
+func secretFromEnv(envVar string) string {
+	if envVar == "" {
+		return ""
+	}
+	path := os.Getenv(envVar + SECRET_FILE_SUFFIX)
+	if path == "" {
+		return os.Getenv(envVar)
+	}
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		logrus.WithError(err).Errorf("Failed to read %s", envVar+SECRET_FILE_SUFFIX)
+		return ""
+	}
+	return strings.TrimSpace(string(b))
+}
+
+// privateToken is a gitlab access token that can be rotated while the client is in use
+type privateToken struct {
+	mu    sync.RWMutex
+	token string
+	base  http.RoundTripper
+}
+
+// newPrivateToken returns the token, and a client sending it with base's requests
+func newPrivateToken(token string, base *http.Client) (*privateToken, *http.Client) {
+	t := &privateToken{token: token, base: base.Transport}
+	if t.base == nil {
+		t.base = http.DefaultTransport
+	}
+	return t, &http.Client{Transport: t, Timeout: base.Timeout}
+}
+
+func (t *privateToken) RoundTrip(req *http.Request) (*http.Response, error) {
+	t.mu.RLock()
+	token := t.token
+	t.mu.RUnlock()
+	req = req.Clone(req.Context())
+	req.Header.Set("PRIVATE-TOKEN", token)
+	return t.base.RoundTrip(req)
+}
+
+// set rotates the token.  an empty token, e.g. from a half written file, is ignored
+func (t *privateToken) set(token string) {
+	if token == "" {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.token = token
+}
+
+// reloader applies changes to the config file, the admin API, and rotated secrets without a restart.  channel mappings,
+// routing and label rules, policies (rego ones too), locales, and project scripts are reloaded; everything else (e.g.
+// the instances themselves, slack settings, listeners) still needs a restart.  state like threads and SLA clocks is kept.
+// with redis, the admin API's changes made on other replicas are applied too
+type reloader struct {
+	path      string
+	instances *instances
+	store     *store.Store
+	// secrets are the instances' token and webhook secret variables, by instance
+	secrets map[string]instanceConfig
+
+	mu sync.Mutex
+	// file is the config file as last loaded, and cfg is the config in effect: the file with the overrides on top
+	file      *botConfig
+	cfg       *botConfig
+	overrides adminOverrides
+	// modified are the watched files' modification times when they were last loaded
+	modified map[string]time.Time
+}
+
+// newReloader starts from the config file loaded at startup, with the admin API's overrides from the store on top
+func newReloader(path string, file *botConfig, s *store.Store, in *instances, insts []instanceConfig) (*reloader, error) {
+	r := &reloader{path: path, instances: in, store: s, file: file, secrets: make(map[string]instanceConfig)}
+	if _, err := s.Load(ADMIN_OVERRIDES_STORE_KEY, &r.overrides); err != nil {
+		return nil, err
+	}
+	r.overrides = r.overrides.copy()
+	r.cfg = r.overrides.merge(file)
+	for _, inst := range insts {
+		r.secrets[inst.Name] = inst
+	}
+	r.modified = r.stat()
+	s.Watch(ADMIN_OVERRIDES_STORE_KEY, r.reloadOverrides)
+	return r, nil
+}
+
+// reloadOverrides applies the admin API's changes made on another replica.  changes that don't apply here, e.g. a
+// policy whose rego file this replica doesn't have, are reported and the old config is kept
+func (r *reloader) reloadOverrides() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var overrides adminOverrides
+	_, err := r.store.Load(ADMIN_OVERRIDES_STORE_KEY, &overrides)
+	if err == nil {
+		err = r.apply(r.file, overrides.copy())
+	}
+	def, _ := r.instances.get("")
+	entry := auditEntry{Action: "config_reload", Actor: "another replica's admin API change", Target: ADMIN_OVERRIDES_STORE_KEY}
+	if err != nil {
+		logrus.WithError(err).Error("Failed to apply another replica's admin API changes, keeping the old config")
+		entry.Outcome = "kept the old config: " + err.Error()
+	} else {
+		logrus.Info("applied another replica's admin API changes")
+		entry.Outcome = "reloaded"
+	}
+	def.audit.record(entry)
+}
+
+// current is the config in effect, and the overrides making it differ from the file
+func (r *reloader) current() (*botConfig, adminOverrides) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.cfg, r.overrides.copy()
+}
+
+// watched are the config file and any secret files
+func (r *reloader) watched() []string {
+	var paths []string
+	if r.path != "" {
+		paths = append(paths, r.path)
+	}
+	for _, inst := range r.secrets {
+		for _, envVar := range []string{inst.TokenEnv, inst.WebhookSecretEnv} {
+			if envVar == "" {
+				continue
+			}
+			if path := os.Getenv(envVar + SECRET_FILE_SUFFIX); path != "" {
+				paths = append(paths, path)
+			}
+		}
+	}
+	return paths
+}
+
+func (r *reloader) stat() map[string]time.Time {
+	modified := make(map[string]time.Time)
+	for _, path := range r.watched() {
+		if info, err := os.Stat(path); err == nil {
+			modified[path] = info.ModTime()
+		}
+	}
+	return modified
+}
+
+// watch reloads on SIGHUP, and whenever a watched file changes.  files are polled every interval
+func (r *reloader) watch(interval time.Duration) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	ticker := time.NewTicker(interval)
+	go func() {
+		for {
+			select {
+			case <-hup:
+				r.reload("SIGHUP")
+			case <-ticker.C:
+				if modified := r.stat(); r.changed(modified) {
+					r.reload("file change")
+				}
+			}
+		}
+	}()
+}
+
+func (r *reloader) changed(modified map[string]time.Time) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(modified) != len(r.modified) {
+		return true
+	}
+	for path, t := range modified {
+		if !r.modified[path].Equal(t) {
+			return true
+		}
+	}
+	return false
+}
+
+// reload applies the config file and secrets.  a config that doesn't load is reported and the old one is kept
+func (r *reloader) reload(why string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.modified = r.stat()
+
+	def, _ := r.instances.get("")
+	entry := auditEntry{Action: "config_reload", Actor: why, Target: r.path}
+	file, err := loadConfig(r.path)
+	if err == nil {
+		err = validateReload(r.file, file)
+	}
+	if err == nil {
+		err = r.apply(file, r.overrides)
+	}
+	if err != nil {
+		logrus.WithError(err).Error("Failed to reload config, keeping the old one")
+		entry.Outcome = "kept the old config: " + err.Error()
+		def.audit.record(entry)
+		return
+	}
+	logrus.Infof("reloaded the config after %s", why)
+	entry.Outcome = "reloaded"
+	def.audit.record(entry)
+}
+
+// change applies a change through the admin API, and keeps it in the store.  a change that doesn't apply isn't kept
+func (r *reloader) change(fn func(*adminOverrides) error) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	overrides := r.overrides.copy()
+	if err := fn(&overrides); err != nil {
+		return err
+	}
+	if err := r.apply(r.file, overrides); err != nil {
+		return err
+	}
+	if err := r.store.Save(ADMIN_OVERRIDES_STORE_KEY, overrides); err != nil {
+		logrus.WithError(err).Error("Failed to save admin API changes, they'll be lost on restart")
+	}
+	return nil
+}
+
+// apply puts the config file with the overrides on top into effect.  the caller holds the lock
+func (r *reloader) apply(file *botConfig, overrides adminOverrides) error {
+	cfg := overrides.merge(file)
+	if err := validatePolicies(cfg.Policies); err != nil {
+		return err
+	}
+	if err := validateReviewerCounts(cfg.Projects); err != nil {
+		return err
+	}
+	if err := validateRebaseModes(cfg.Projects); err != nil {
+		return err
+	}
+	if err := validateEventFilters(cfg.Projects); err != nil {
+		return err
+	}
+	if err := validateDND(cfg.Projects); err != nil {
+		return err
+	}
+	labelRules, err := compileLabelRules(cfg.Projects)
+	if err != nil {
+		return err
+	}
+	experts, err := compileExpertRules(cfg.Projects)
+	if err != nil {
+		return err
+	}
+	targetBranches, err := compileTargetBranches(cfg.Projects)
+	if err != nil {
+		return err
+	}
+	routingRules, err := compileRoutingRules(cfg.RoutingRules)
+	if err != nil {
+		return err
+	}
+	loc, err := newLocales(cfg.Locales, r.path, cfg.Projects)
+	if err != nil {
+		return err
+	}
+	scripts, err := loadScripts(r.path, cfg.Projects)
+	if err != nil {
+		return err
+	}
+	opa, err := newOPAPolicies(cfg.OPA, r.path)
+	if err != nil {
+		return err
+	}
+
+	// nothing has changed until everything has loaded
+	old := r.cfg
+	r.instances.update(func(b bot) bot {
+		b.routes.reconfigure(old.Projects, cfg.Projects)
+		b.groupRoutes = newGroupRoutes(cfg.Groups)
+		b.projects = newProjectSettings(cfg.Projects)
+		b.defaultRoutes = newDefaultRouter(cfg.DefaultRoutes)
+		b.policies = newPolicies(cfg.Policies, cfg.Projects)
+		b.labelRules = labelRules
+		b.targetBranches = targetBranches
+		b.experts = experts
+		b.routingRules = routingRules
+		b.locales = loc
+		b.scripts = scripts
+		b.opa = opa
+		inst := r.secrets[b.instance]
+		if b.token != nil {
+			b.token.set(secretFromEnv(inst.TokenEnv))
+		}
+		b.webhookAuth = reloadWebhookAuth(b.webhookAuth, inst.WebhookSecretEnv)
+		return b
+	})
+	r.file, r.cfg, r.overrides = file, cfg, overrides
+	return nil
+}
+
+// validateReload rejects changes that can't be applied without a restart, rather than half applying them
+func validateReload(old, cfg *botConfig) error {
+	changed := len(old.Instances) != len(cfg.Instances)
+	for i := 0; !changed && i < len(cfg.Instances); i++ {
+		changed = old.Instances[i] != cfg.Instances[i]
+	}
+	if changed {
+		return errors.New("changing instances needs a restart")
+	}
+	return nil
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/slack-go/slack"
+	"github.com/xanzy/go-gitlab"
+)
+
+const (
+	UNKNOWN_AUTHOR                     = "unknown(see logs for error)"
+	USER_LOOKUP_RETRIES_ENV_VAR        = "USER_LOOKUP_RETRIES"
+	USER_LOOKUP_RETRY_INTERVAL_ENV_VAR = "USER_LOOKUP_RETRY_INTERVAL"
+	DEFAULT_USER_LOOKUP_RETRIES        = 5
+	DEFAULT_USER_LOOKUP_RETRY_INTERVAL = time.Minute
+)
+
+// retryPolicy is how many times to retry something, and how long to wait before the first retry.  the wait doubles each time
+type retryPolicy struct {
+	attempts int
+	interval time.Duration
+}
+
+// retryPolicyFromEnv reads a retry policy from the given env vars, falling back to the user lookup defaults
+func retryPolicyFromEnv(attemptsVar, intervalVar string) retryPolicy {
+	p := retryPolicy{attempts: DEFAULT_USER_LOOKUP_RETRIES, interval: DEFAULT_USER_LOOKUP_RETRY_INTERVAL}
+	if n, err := strconv.Atoi(os.Getenv(attemptsVar)); err == nil && n >= 0 {
+		p.attempts = n
+	}
+	if d, err := time.ParseDuration(os.Getenv(intervalVar)); err == nil && d > 0 {
+		p.interval = d
+	}
+	return p
+}
+
+// retry calls f until it succeeds or the policy runs out of attempts, returning f's last error
+func (p retryPolicy) retry(f func() error) error {
+	var err error
+	wait := p.interval
+	for i := 0; i < p.attempts; i++ {
+		time.Sleep(wait)
+		if err = f(); err == nil {
+			return nil
+		}
+		wait *= 2
+	}
+	return err
+}
+
+// repairAuthor keeps trying to look up the MR's author, and once it can, edits the sent notifications so they
+// stop saying "unknown"
+func (bot bot) repairAuthor(mr *gitlab.MergeEvent, assignee string, sent []slackMessage) {
+	var user *gitlab.User
+	err := bot.userRetry.retry(func() error {
+		var err error
+		user, err = bot.gl.GetUser(mr.ObjectAttributes.AuthorID)
+		return err
+	})
+	if err != nil {
+		logrus.WithError(err).Errorf("giving up on looking up the author of merge request !%d", mr.ObjectAttributes.IID)
+		return
+	}
+
+	msg := bot.newMRMessage(mr, user.Name, assignee)
+	layout := bot.newMRBlocks(mr.Project.ID, mr.ObjectAttributes.IID)
+	for _, m := range sent {
+		text := bot.locales.render(m.Channel, msg)
+		var blocks []slack.Block
+		if layout != nil {
+			blocks = layout(text)
+		}
+		if err := bot.notifier.Update(m.Channel, m.Timestamp, text, blocks); err != nil {
+			logrus.WithError(err).Errorf("failed to repair message %s in channel %s", m.Timestamp, m.Channel)
+		}
+	}
+	logrus.Infof("repaired author of merge request !%d notification: %s", mr.ObjectAttributes.IID, user.Name)
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/raidancampbell/gitlab-odds-and-ends/internal/assign"
+	"github.com/sirupsen/logrus"
+	"github.com/slack-go/slack"
+	"github.com/xanzy/go-gitlab"
+)
+
+// notifyMerged announces a merged MR.  When slack interactivity is configured the message carries a
+// "Revert" button so a bad change can be backed out straight from the channel
+func (bot bot) notifyMerged(mr *gitlab.MergeEvent, slackChans []string) {
+	msg := tr("Merge request `%s` in `%s` has been merged.  See %s for details.",
+		mr.ObjectAttributes.Title, mr.ObjectAttributes.Target.Name, mr.ObjectAttributes.URL)
+	if bot.slackSigningSecret == "" {
+		bot.notifyLocalized(msg, slackChans)
+		return
+	}
+
+	bot.notifyBlocksLocalized(msg, func(text string) []slack.Block {
+		return []slack.Block{
+			slack.NewSectionBlock(slack.NewTextBlockObject(slack.MarkdownType, text, false, false), nil, nil),
+			slack.NewActionBlock("",
+				slack.NewButtonBlockElement(ACTION_REVERT_MR, bot.actionValue(mrRef(mr.Project.ID, mr.ObjectAttributes.IID)),
+					slack.NewTextBlockObject(slack.PlainTextType, "Revert", false, false)).WithStyle(slack.StyleDanger),
+			),
+		}
+	}, slackChans)
+}
+
+// revertMergeRequest opens a merge request reverting the given (merged) MR, assigned to the original author and a maintainer.
+// ref is the button value created by mrRef; the result is announced in slackChan on behalf of slackUser
+func (bot bot) revertMergeRequest(ref, slackChan, slackUser string) {
+	projectID, iid, err := parseMRRef(ref)
+	if err != nil {
+		logrus.WithError(err).Errorf("Failed to parse merge request reference '%s'", ref)
+		return
+	}
+
+	revert, err := bot.createRevertMR(projectID, iid)
+	if err != nil {
+		logrus.WithError(err).Errorf("Failed to revert merge request !%d in project %d", iid, projectID)
+		bot.notifyLocalized(tr("<@%s> I couldn't revert !%d: %s", slackUser, iid, err), []string{slackChan})
+		return
+	}
+	bot.notifyLocalized(tr("<@%s> requested a revert of !%d.  Revert merge request: %s", slackUser, iid, revert.WebURL), []string{slackChan})
+}
+
+// createRevertMR branches off the MR's target, reverts the MR's merge (or squash) commit onto that branch, and opens an MR for it.
+// a revert that's already open is returned rather than opened again
+func (bot bot) createRevertMR(projectID, iid int) (*gitlab.MergeRequest, error) {
+	original, err := bot.gl.GetMergeRequest(projectID, iid)
+	if err != nil {
+		return nil, err
+	}
+	if original.State != "merged" {
+		return nil, fmt.Errorf("merge request is %s, not merged", original.State)
+	}
+	shas, err := bot.revertedCommits(original)
+	if err != nil {
+		return nil, err
+	}
+	prefix := fmt.Sprintf("revert-%s", shas[0][:8])
+	if open, err := bot.openRevert(original, prefix); err != nil || open != nil {
+		return open, err
+	}
+
+	assignees := []int{original.Author.ID}
+	maintainers, err := getProjectMaintainers(bot.gl, projectID)
+	if err != nil {
+		return nil, err
+	}
+	if id, ok := assign.Pick(memberIDs(maintainers), original.Author.ID); ok {
+		assignees = append(assignees, id)
+	}
+
+	// a revert that was closed may have left its branch behind, so each revert gets a branch of its own
+	branch := fmt.Sprintf("%s-%d", prefix, time.Now().Unix())
+	title := fmt.Sprintf("Revert \"%s\"", original.Title)
+	description := fmt.Sprintf("This reverts merge request !%d (commit %s).", iid, strings.Join(shas, ", "))
+	if _, err := bot.gl.CreateBranch(projectID, branch, original.TargetBranch); err != nil {
+		return nil, err
+	}
+	for _, sha := range shas {
+		if _, err = bot.gl.RevertCommit(projectID, sha, branch); err != nil {
+			break
+		}
+	}
+	var revert *gitlab.MergeRequest
+	if err == nil {
+		revert, err = bot.gl.CreateMergeRequest(projectID, &gitlab.CreateMergeRequestOptions{
+			Title:              &title,
+			Description:        &description,
+			SourceBranch:       &branch,
+			TargetBranch:       &original.TargetBranch,
+			AssigneeIDs:        &assignees,
+			RemoveSourceBranch: gitlab.Bool(true),
+		})
+	}
+	if err != nil {
+		if err := bot.gl.DeleteBranch(projectID, branch); err != nil {
+			logrus.WithError(err).Errorf("failed to delete branch %s of a failed revert in project %d", branch, projectID)
+		}
+		return nil, err
+	}
+	return revert, nil
+}
+
+// revertedCommits are the commits reverting the merged MR takes, newest first: its merge commit, or its squash commit.
+// fast-forward merges without squashing have neither, and put the MR's own commits on the target
+func (bot bot) revertedCommits(mr *gitlab.MergeRequest) ([]string, error) {
+	if mr.MergeCommitSHA != "" {
+		return []string{mr.MergeCommitSHA}, nil
+	}
+	if mr.SquashCommitSHA != "" {
+		return []string{mr.SquashCommitSHA}, nil
+	}
+	commits, err := bot.gl.ListMergeRequestCommits(mr.ProjectID, mr.IID)
+	if err != nil {
+		return nil, err
+	}
+	if len(commits) == 0 {
+		return nil, fmt.Errorf("merge request has no commits to revert")
+	}
+	shas := make([]string, len(commits))
+	for i, c := range commits {
+		shas[i] = c.ID
+	}
+	return shas, nil
+}
+
+// openRevert finds an open revert of the MR, made by createRevertMR on a branch starting with prefix
+func (bot bot) openRevert(mr *gitlab.MergeRequest, prefix string) (*gitlab.MergeRequest, error) {
+	open, _, err := bot.gl.ListProjectMergeRequests(mr.ProjectID, &gitlab.ListProjectMergeRequestsOptions{
+		State:        gitlab.String("opened"),
+		TargetBranch: &mr.TargetBranch,
+		ListOptions:  gitlab.ListOptions{PerPage: 100},
+	})
+	if err != nil {
+		return nil, err
+	}
+	for _, candidate := range open {
+		if strings.HasPrefix(candidate.SourceBranch, prefix+"-") {
+			return candidate, nil
+		}
+	}
+	return nil, nil
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/xanzy/go-gitlab"
+)
+
+// branchingGitLab keeps branches, and reverts onto them, failing to revert failSHA
+type branchingGitLab struct {
+	*fakeGitLab
+	failSHA  string
+	commits  []*gitlab.Commit
+	branches map[string][]string // reverted SHAs, by branch
+	opened   []*gitlab.MergeRequest
+}
+
+func (gl *branchingGitLab) ListProjectMembers(pid int, opt *gitlab.ListProjectMembersOptions) ([]*gitlab.ProjectMember, *gitlab.Response, error) {
+	return []*gitlab.ProjectMember{{ID: 2, Username: "maintainer", AccessLevel: gitlab.MaintainerPermissions}}, &gitlab.Response{}, nil
+}
+
+func (gl *branchingGitLab) ListMergeRequestCommits(pid, iid int) ([]*gitlab.Commit, error) {
+	return gl.commits, nil
+}
+
+func (gl *branchingGitLab) ListProjectMergeRequests(pid int, opt *gitlab.ListProjectMergeRequestsOptions) ([]*gitlab.MergeRequest, *gitlab.Response, error) {
+	return gl.opened, &gitlab.Response{}, nil
+}
+
+func (gl *branchingGitLab) CreateBranch(pid int, branch, ref string) (*gitlab.Branch, error) {
+	if _, ok := gl.branches[branch]; ok {
+		return nil, errors.New("branch already exists")
+	}
+	gl.branches[branch] = nil
+	return &gitlab.Branch{Name: branch}, nil
+}
+
+func (gl *branchingGitLab) DeleteBranch(pid int, branch string) error {
+	delete(gl.branches, branch)
+	return nil
+}
+
+func (gl *branchingGitLab) RevertCommit(pid int, sha, branch string) (*gitlab.Commit, error) {
+	if sha == gl.failSHA {
+		return nil, errors.New("sorry, we cannot revert this commit automatically")
+	}
+	gl.branches[branch] = append(gl.branches[branch], sha)
+	return &gitlab.Commit{}, nil
+}
+
+func (gl *branchingGitLab) CreateMergeRequest(pid int, opt *gitlab.CreateMergeRequestOptions) (*gitlab.MergeRequest, error) {
+	mr := &gitlab.MergeRequest{ProjectID: pid, IID: 100 + len(gl.opened), SourceBranch: *opt.SourceBranch, TargetBranch: *opt.TargetBranch}
+	gl.opened = append(gl.opened, mr)
+	return mr, nil
+}
+
+func TestCreateRevertMR(t *testing.T) {
+	tests := []struct {
+		name       string
+		merge      string
+		squash     string
+		failSHA    string
+		wantErr    bool
+		wantBranch string
+		wantRevert []string
+	}{
+		{name: "merge commit", merge: "aaaaaaaa11", wantBranch: "revert-aaaaaaaa-", wantRevert: []string{"aaaaaaaa11"}},
+		{name: "squash commit", squash: "bbbbbbbb22", wantBranch: "revert-bbbbbbbb-", wantRevert: []string{"bbbbbbbb22"}},
+		{name: "fast-forward", wantBranch: "revert-dddddddd-", wantRevert: []string{"dddddddd44", "cccccccc33"}},
+		{name: "conflicting revert", merge: "aaaaaaaa11", failSHA: "aaaaaaaa11", wantErr: true},
+		{name: "conflicting fast-forward", failSHA: "cccccccc33", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gl := &branchingGitLab{
+				fakeGitLab: newFakeGitLab(),
+				failSHA:    tt.failSHA,
+				commits:    []*gitlab.Commit{{ID: "dddddddd44"}, {ID: "cccccccc33"}},
+				branches:   make(map[string][]string),
+			}
+			gl.addMR(&gitlab.MergeRequest{ProjectID: 1, IID: 7, Title: "Fix", State: "merged", TargetBranch: "main",
+				MergeCommitSHA: tt.merge, SquashCommitSHA: tt.squash, Author: &gitlab.BasicUser{ID: 1}})
+			b := bot{gl: gl}
+
+			revert, err := b.createRevertMR(1, 7)
+
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("createRevertMR() error = %v, want error %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				if len(gl.branches) != 0 {
+					t.Errorf("a failed revert left branches %v behind", gl.branches)
+				}
+				return
+			}
+			if !strings.HasPrefix(revert.SourceBranch, tt.wantBranch) {
+				t.Errorf("revert branch = %s, want it to start %s", revert.SourceBranch, tt.wantBranch)
+			}
+			if got := gl.branches[revert.SourceBranch]; !reflect.DeepEqual(got, tt.wantRevert) {
+				t.Errorf("reverted %v, want %v", got, tt.wantRevert)
+			}
+
+			// asking again finds the open revert
+			again, err := b.createRevertMR(1, 7)
+			if err != nil || again.IID != revert.IID || len(gl.opened) != 1 {
+				t.Errorf("second revert = %+v, %v, want the open revert !%d", again, err, revert.IID)
+			}
+		})
+	}
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/sirupsen/logrus"
+	"github.com/xanzy/go-gitlab"
+)
+
+// validateReviewerCounts checks the projects' reviewer counts up front, like validatePolicies
+func validateReviewerCounts(projects []projectConfig) error {
+	for _, p := range projects {
+		if p.Reviewers < 0 {
+			return fmt.Errorf("project %s can't have %d reviewers", p.Project, p.Reviewers)
+		}
+		for label, n := range p.LabelReviewers {
+			if n < 0 {
+				return fmt.Errorf("project %s can't have %d reviewers for label %s", p.Project, n, label)
+			}
+		}
+	}
+	return nil
+}
+
+// reviewersWanted is how many maintainers should be reviewing the MR: its project's count if the config file or admin
+// API set one, otherwise its policy's.  labels with their own count raise it, e.g. `security: 3`, but never lower it,
+// and policies with xl_extra_reviewer want one more for XL MRs
+func (bot bot) reviewersWanted(mr *gitlab.MergeEvent, policy policyConfig) int {
+	project := bot.projects[mr.Project.PathWithNamespace]
+	wanted := policy.Reviewers
+	if project.Reviewers > 0 {
+		wanted = project.Reviewers
+	}
+	if policy.XLExtraReviewer {
+		if size, err := bot.classifyMR(mr.Project.ID, mr.ObjectAttributes.IID); err != nil {
+			logrus.WithError(err).Errorf("failed to size merge request !%d, not asking for an extra reviewer", mr.ObjectAttributes.IID)
+		} else if size.name == MR_SIZE_XL {
+			wanted++
+		}
+	}
+	if len(project.LabelReviewers) == 0 {
+		return wanted
+	}
+	// the webhook's labels don't include any autoLabel just added
+	current, err := bot.gl.GetMergeRequest(mr.Project.ID, mr.ObjectAttributes.IID)
+	if err != nil {
+		logrus.WithError(err).Errorf("failed to look up the labels of merge request !%d, ignoring label reviewer counts", mr.ObjectAttributes.IID)
+		return wanted
+	}
+	for _, label := range current.Labels {
+		if n := project.LabelReviewers[label]; n > wanted {
+			wanted = n
+		}
+	}
+	return wanted
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+	"github.com/xanzy/go-gitlab"
+)
+
+const (
+	REVIEWER_LOAD_REPORT_DAY_ENV_VAR  = "REVIEWER_LOAD_REPORT_DAY"
+	REVIEWER_LOAD_REPORT_TIME_ENV_VAR = "REVIEWER_LOAD_REPORT_TIME"
+	DEFAULT_REVIEWER_LOAD_REPORT_TIME = "09:00"
+	REVIEWER_LOAD_PERIOD              = 7 * 24 * time.Hour
+)
+
+// reviewerLoad is how much review work one maintainer got over the report period
+type reviewerLoad struct {
+	Username string `json:"username"`
+	Name     string `json:"name"`
+	// Assigned is how many MRs opened in the period were assigned to them
+	Assigned int `json:"assigned"`
+	// Reviewed is how many MRs they commented on or approved in the period, other than their own
+	Reviewed int `json:"reviewed"`
+	// HandedOff is how many of their assigned MRs they handed off to someone else with `/handoff`.  these still count
+	// as assigned to them, as well as to whoever took them
+	HandedOff int `json:"handed_off"`
+}
+
+// reviewerLoadReport is the reviewer load of every maintainer of a project
+type reviewerLoadReport struct {
+	Project   string         `json:"project"`
+	Since     time.Time      `json:"since"`
+	Reviewers []reviewerLoad `json:"reviewers"`
+}
+
+// reviewerLoadReport works out the project's reviewer load since the given time.  maintainers who got no work are
+// included, since they matter most when checking the assignment is fair
+func (bot bot) reviewerLoadReport(project string, since time.Time) (*reviewerLoadReport, error) {
+	id, err := bot.routes.projectID(bot.gl, project)
+	if err != nil {
+		return nil, err
+	}
+	maintainers, err := getProjectMaintainers(bot.gl, id)
+	if err != nil {
+		return nil, err
+	}
+	loads := make(map[int]*reviewerLoad)
+	for _, m := range maintainers {
+		loads[m.ID] = &reviewerLoad{Username: m.Username, Name: m.Name}
+	}
+
+	opts := &gitlab.ListProjectMergeRequestsOptions{
+		ListOptions:  gitlab.ListOptions{PerPage: 100},
+		UpdatedAfter: &since,
+	}
+	for {
+		mrs, resp, err := bot.gl.ListProjectMergeRequests(id, opts)
+		if err != nil {
+			return nil, err
+		}
+		for _, mr := range mrs {
+			if mr.Assignee != nil && mr.CreatedAt != nil && mr.CreatedAt.After(since) {
+				if load, ok := loads[mr.Assignee.ID]; ok {
+					load.Assigned++
+				}
+			}
+			reviewers, err := reviewersSince(bot.gl, mr, since)
+			if err != nil {
+				logrus.WithError(err).Errorf("failed to find reviewers of merge request !%d", mr.IID)
+				continue
+			}
+			for reviewer := range reviewers {
+				if load, ok := loads[reviewer]; ok {
+					load.Reviewed++
+				}
+			}
+		}
+		if resp.NextPage == 0 {
+			break
+		}
+		opts.Page = resp.NextPage
+	}
+	if bot.handoffs != nil {
+		for _, h := range bot.handoffs.since(project, since) {
+			for _, load := range loads {
+				if load.Username == h.From {
+					load.Assigned++
+					load.HandedOff++
+				}
+			}
+		}
+	}
+
+	report := &reviewerLoadReport{Project: project, Since: since}
+	for _, load := range loads {
+		report.Reviewers = append(report.Reviewers, *load)
+	}
+	sort.Slice(report.Reviewers, func(i, j int) bool {
+		a, b := report.Reviewers[i], report.Reviewers[j]
+		if a.Assigned != b.Assigned {
+			return a.Assigned > b.Assigned
+		}
+		return a.Username < b.Username
+	})
+	return report, nil
+}
+
+// reviewersSince returns the IDs of everyone who reviewed the MR since the given time
+func reviewersSince(gl GitLabAPI, mr *gitlab.MergeRequest, since time.Time) (map[int]bool, error) {
+	reviewers := make(map[int]bool)
+	opts := &gitlab.ListMergeRequestNotesOptions{ListOptions: gitlab.ListOptions{PerPage: 100}}
+	for {
+		notes, resp, err := gl.ListMergeRequestNotes(mr.ProjectID, mr.IID, opts)
+		if err != nil {
+			return nil, err
+		}
+		for _, note := range notes {
+			if isReviewNote(mr, note) && note.CreatedAt.After(since) {
+				reviewers[note.Author.ID] = true
+			}
+		}
+		if resp.NextPage == 0 {
+			return reviewers, nil
+		}
+		opts.Page = resp.NextPage
+	}
+}
+
+// format renders the report for slack
+func (r *reviewerLoadReport) format() string {
+	lines := []string{fmt.Sprintf(":bar_chart: *Reviewer load for `%s` since %s*", r.Project, r.Since.Format("Jan 2"))}
+	for _, load := range r.Reviewers {
+		line := fmt.Sprintf("• %s: %s assigned, %s reviewed", load.Name, plural(load.Assigned, "MR"), plural(load.Reviewed, "MR"))
+		if load.HandedOff > 0 {
+			line += fmt.Sprintf(", %d handed off", load.HandedOff)
+		}
+		lines = append(lines, line)
+	}
+	if len(r.Reviewers) == 0 {
+		lines = append(lines, "no maintainers")
+	}
+	return strings.Join(lines, "\n")
+}
+
+// postReviewerLoadReports sends every routed project's weekly report to its channels
+func (bot bot) postReviewerLoadReports() {
+	since := time.Now().Add(-REVIEWER_LOAD_PERIOD)
+	reports := make(map[string]string) // by project, so projects shared by channels are only counted once
+	for _, channel := range bot.routes.allChannels() {
+		for _, project := range bot.routes.projectsFor(channel) {
+			msg, ok := reports[project]
+			if !ok {
+				report, err := bot.reviewerLoadReport(project, since)
+				if err != nil {
+					logrus.WithError(err).Errorf("failed to build reviewer load report for %s", project)
+				} else {
+					msg = report.format()
+				}
+				reports[project] = msg
+			}
+			if msg != "" {
+				bot.notify(msg, []string{channel})
+			}
+		}
+	}
+}
+
+// reviewerLoadRouter serves `GET /reports/reviewer-load?project=group/project[&days=7]` as JSON
+func (bot bot) reviewerLoadRouter(c *gin.Context) {
+	project := c.Query("project")
+	if project == "" {
+		http.Error(c.Writer, "missing project query parameter", http.StatusBadRequest)
+		return
+	}
+	period := REVIEWER_LOAD_PERIOD
+	if days := c.Query("days"); days != "" {
+		var n int
+		if _, err := fmt.Sscanf(days, "%d", &n); err != nil || n <= 0 {
+			http.Error(c.Writer, "days must be a positive number", http.StatusBadRequest)
+			return
+		}
+		period = time.Duration(n) * 24 * time.Hour
+	}
+	report, err := bot.reviewerLoadReport(project, time.Now().Add(-period))
+	if err != nil {
+		logrus.WithError(err).Errorf("failed to build reviewer load report for %s", project)
+		http.Error(c.Writer, http.StatusText(http.StatusBadGateway), http.StatusBadGateway)
+		return
+	}
+	c.JSON(http.StatusOK, report)
+}
+
+// parseWeekday parses a day name like `monday` or `Mon`
+func parseWeekday(day string) (time.Weekday, error) {
+	for d := time.Sunday; d <= time.Saturday; d++ {
+		if strings.EqualFold(day, d.String()) || strings.EqualFold(day, d.String()[:3]) {
+			return d, nil
+		}
+	}
+	return 0, fmt.Errorf("invalid weekday '%s'", day)
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/raidancampbell/gitlab-odds-and-ends/internal/assign"
+	"github.com/sirupsen/logrus"
+	"github.com/xanzy/go-gitlab"
+)
+
+const (
+	REVIEWER_POOL_ENV_VAR        = "REVIEWER_POOL"
+	REVIEWER_POOL_MAINTAINERS    = "maintainers"
+	REVIEWER_POOL_APPROVAL_RULES = "approval_rules"
+)
+
+// reviewerPool is who new MRs' reviewers are picked from
+type reviewerPool string
+
+func parseReviewerPool(setting string) (reviewerPool, error) {
+	switch pool := reviewerPool(strings.ToLower(setting)); pool {
+	case "":
+		return REVIEWER_POOL_MAINTAINERS, nil
+	case REVIEWER_POOL_MAINTAINERS, REVIEWER_POOL_APPROVAL_RULES:
+		return pool, nil
+	}
+	return "", fmt.Errorf("invalid %s '%s', expected %s or %s", REVIEWER_POOL_ENV_VAR, setting, REVIEWER_POOL_MAINTAINERS, REVIEWER_POOL_APPROVAL_RULES)
+}
+
+// reviewCandidates are who may review an MR, and who of them new reviews can go to
+type reviewCandidates struct {
+	all []*gitlab.ProjectMember
+	// available are the candidates who can be given a review right now, e.g. because they're in their working hours
+	available []*gitlab.ProjectMember
+	// experts are the available candidates who know the MR's area best, see expertRule
+	experts []*gitlab.ProjectMember
+}
+
+// pick picks a random available candidate other than the excluded ones, an expert if one's around
+func (c reviewCandidates) pick(exclude ...int) (*gitlab.ProjectMember, bool) {
+	for _, pool := range [][]*gitlab.ProjectMember{c.experts, c.available} {
+		if id, ok := assign.Pick(memberIDs(pool), exclude...); ok {
+			return memberByID(pool, id), true
+		}
+	}
+	return nil, false
+}
+
+// candidatesFor lists who from the pool may review the MR, and who of them is available right now
+func (bot bot) candidatesFor(mr *gitlab.MergeEvent, pool reviewerPool) (reviewCandidates, error) {
+	all, err := candidateReviewers(bot.gl, mr, pool)
+	if err != nil {
+		return reviewCandidates{}, err
+	}
+	candidates := reviewCandidates{all: all, available: all}
+	if bot.workingHours != nil {
+		candidates.available = bot.workingHours.available(bot.gl, all)
+	}
+	if bot.userStatuses != nil {
+		candidates.available = bot.userStatuses.filter(bot.gl, candidates.available)
+	}
+	candidates.experts = bot.expertsFor(mr, candidates.available)
+	candidates = bot.scriptedAssignee(mr, candidates)
+	candidates = bot.policyCandidates(mr, candidates)
+	return candidates, nil
+}
+
+// candidateReviewers lists who may review the MR.  with the approval rules pool that's the eligible approvers of the
+// MR's rules that still need approving (or of all its rules, once they're all approved).  projects without approval
+// rules, e.g. on gitlab's free tier, fall back to their maintainers
+func candidateReviewers(gl GitLabAPI, mr *gitlab.MergeEvent, pool reviewerPool) ([]*gitlab.ProjectMember, error) {
+	if pool != REVIEWER_POOL_APPROVAL_RULES {
+		return getProjectMaintainers(gl, mr.Project.ID)
+	}
+	rules, err := gl.GetMergeRequestApprovalRules(mr.Project.ID, mr.ObjectAttributes.IID)
+	if err != nil {
+		return nil, err
+	}
+	candidates := eligibleApprovers(rules, true)
+	if len(candidates) == 0 {
+		candidates = eligibleApprovers(rules, false)
+	}
+	if len(candidates) == 0 {
+		logrus.Infof("merge request !%d in project %d has no eligible approvers, picking from maintainers", mr.ObjectAttributes.IID, mr.Project.ID)
+		return getProjectMaintainers(gl, mr.Project.ID)
+	}
+	return candidates, nil
+}
+
+// eligibleApprovers collects the approvers of rules that need approvals, optionally only the unapproved ones
+func eligibleApprovers(rules []*gitlab.MergeRequestApprovalRule, unapprovedOnly bool) []*gitlab.ProjectMember {
+	seen := make(map[int]bool)
+	var approvers []*gitlab.ProjectMember
+	for _, rule := range rules {
+		if rule.ApprovalsRequired == 0 || (unapprovedOnly && rule.Approved) {
+			continue
+		}
+		for _, u := range rule.EligibleApprovers {
+			if !seen[u.ID] {
+				seen[u.ID] = true
+				approvers = append(approvers, &gitlab.ProjectMember{ID: u.ID, Username: u.Username, Name: u.Name})
+			}
+		}
+	}
+	return approvers
+}
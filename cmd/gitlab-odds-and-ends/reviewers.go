@@ -0,0 +1,131 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+	"github.com/xanzy/go-gitlab"
+)
+
+const (
+	ASSIGN_AS_ENV_VAR  = "ASSIGN_AS"
+	ASSIGN_AS_ASSIGNEE = "assignee"
+	ASSIGN_AS_REVIEWER = "reviewer"
+	ASSIGN_AS_BOTH     = "both"
+	// merge request reviewers arrived in gitlab 13.7
+	REVIEWERS_MIN_MAJOR = 13
+	REVIEWERS_MIN_MINOR = 7
+)
+
+// assignMode is how the randomly picked maintainer is put on a new MR: as its assignee, its reviewer, or both
+type assignMode struct {
+	assignee bool
+	reviewer bool
+}
+
+// parseAssignMode parses an ASSIGN_AS setting, falling back to assigning if the gitlab instance is too old for reviewers
+func parseAssignMode(setting string, reviewersSupported bool) (assignMode, error) {
+	var mode assignMode
+	switch strings.ToLower(setting) {
+	case "", ASSIGN_AS_ASSIGNEE:
+		return assignMode{assignee: true}, nil
+	case ASSIGN_AS_REVIEWER:
+		mode = assignMode{reviewer: true}
+	case ASSIGN_AS_BOTH:
+		mode = assignMode{assignee: true, reviewer: true}
+	default:
+		return mode, fmt.Errorf("invalid %s '%s', expected %s, %s, or %s", ASSIGN_AS_ENV_VAR, setting, ASSIGN_AS_ASSIGNEE, ASSIGN_AS_REVIEWER, ASSIGN_AS_BOTH)
+	}
+	if !reviewersSupported {
+		return assignMode{assignee: true}, nil
+	}
+	return mode, nil
+}
+
+// supportsReviewers reports whether the gitlab instance is new enough for MR reviewers.
+// if the version can't be looked up, reviewers are assumed to work
+func supportsReviewers(gl GitLabAPI) bool {
+	v, err := gl.Version()
+	if err != nil {
+		logrus.WithError(err).Warn("failed to look up the gitlab version, assuming it supports merge request reviewers")
+		return true
+	}
+	var major, minor int
+	if _, err := fmt.Sscanf(v.Version, "%d.%d", &major, &minor); err != nil {
+		logrus.WithError(err).Warnf("failed to parse gitlab version '%s', assuming it supports merge request reviewers", v.Version)
+		return true
+	}
+	if major < REVIEWERS_MIN_MAJOR || (major == REVIEWERS_MIN_MAJOR && minor < REVIEWERS_MIN_MINOR) {
+		logrus.Warnf("gitlab %s doesn't support merge request reviewers, maintainers will be assigned instead", v.Version)
+		return false
+	}
+	return true
+}
+
+// assignReview puts a maintainer on the MR the way its policy says, returning their name
+func (bot bot) assignReview(mr *gitlab.MergeEvent, policy policyConfig) (string, error) {
+	mode := bot.assignModeFor(policy)
+	candidates, err := bot.candidatesFor(mr, bot.reviewerPoolFor(policy))
+	if err != nil {
+		return "", err
+	}
+	if !mode.reviewer {
+		return maybeAssignMaintainer(bot.gl, mr, candidates)
+	}
+	if !mode.assignee {
+		return maybeRequestReview(bot.gl, mr, candidates)
+	}
+	// both: the assignee reviews it
+	assignee, err := maybeAssignMaintainer(bot.gl, mr, candidates)
+	if err != nil {
+		return "", err
+	}
+	current, err := bot.gl.GetMergeRequest(mr.Project.ID, mr.ObjectAttributes.IID)
+	if err != nil {
+		return "", err
+	}
+	return assignee, addReviewer(bot.gl, current, mr.ObjectAttributes.AssigneeID)
+}
+
+// maybeRequestReview is maybeAssignMaintainer for reviewers: if none of the MR's reviewers is a maintainer, a random
+// available maintainer other than the author, preferably an expert, is added to them.  Returns the reviewing maintainer's Name
+func maybeRequestReview(gl GitLabAPI, mr *gitlab.MergeEvent, maintainers reviewCandidates) (string, error) {
+	current, err := gl.GetMergeRequest(mr.Project.ID, mr.ObjectAttributes.IID)
+	if err != nil {
+		return "", err
+	}
+	others := 0
+	for _, m := range maintainers.all {
+		for _, r := range current.Reviewers {
+			if r.ID == m.ID && m.ID != mr.ObjectAttributes.AuthorID {
+				return m.Name, nil
+			}
+		}
+		if m.ID != mr.ObjectAttributes.AuthorID {
+			others++
+		}
+	}
+	if others == 0 {
+		return "", fmt.Errorf("no maintainers other than the author for repository, cannot request a review")
+	}
+	maintainer, ok := maintainers.pick(mr.ObjectAttributes.AuthorID)
+	if !ok {
+		return "", errNobodyAvailable
+	}
+	logrus.Infof("requesting review of merge request !%d in project %d from %s (%s)", mr.ObjectAttributes.IID, mr.Project.ID, maintainer.Name, maintainer.Username)
+	return maintainer.Name, addReviewer(gl, current, maintainer.ID)
+}
+
+// addReviewer adds the user to the MR's reviewers, keeping the ones it has
+func addReviewer(gl GitLabAPI, mr *gitlab.MergeRequest, userID int) error {
+	ids := []int{userID}
+	for _, r := range mr.Reviewers {
+		if r.ID == userID {
+			return nil
+		}
+		ids = append(ids, r.ID)
+	}
+	_, err := gl.UpdateMergeRequest(mr.ProjectID, mr.IID, &gitlab.UpdateMergeRequestOptions{ReviewerIDs: &ids})
+	return err
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"sort"
+	"sync"
+
+	"github.com/xanzy/go-gitlab"
+)
+
+// routes maps projects to slack channels and back.  Routes come from the config file, and are also learned from the
+// `slack-channel` query parameter of incoming webhooks, so a channel knows about every project that has notified it.
+// projects are keyed by their path with namespace
+type routes struct {
+	mu       sync.RWMutex
+	channels map[string]map[string]bool
+	ids      map[string]int
+}
+
+func newRoutes(projects []projectConfig) *routes {
+	r := &routes{
+		channels: make(map[string]map[string]bool),
+		ids:      make(map[string]int),
+	}
+	for _, p := range projects {
+		r.add(p.Project, 0, p.Channels)
+	}
+	return r
+}
+
+// copy is a deep copy of the routes, for learning routes that mustn't reach these, see bot.simulated
+func (r *routes) copy() *routes {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	c := &routes{channels: make(map[string]map[string]bool), ids: make(map[string]int)}
+	for p, channels := range r.channels {
+		c.channels[p] = make(map[string]bool)
+		for ch := range channels {
+			c.channels[p][ch] = true
+		}
+	}
+	for p, id := range r.ids {
+		c.ids[p] = id
+	}
+	return c
+}
+
+// add routes the project to the channels.  id is the project's numeric ID, or 0 if it isn't known
+func (r *routes) add(project string, id int, channels []string) {
+	if project == "" {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if id != 0 {
+		r.ids[project] = id
+	}
+	if r.channels[project] == nil {
+		r.channels[project] = make(map[string]bool)
+	}
+	for _, c := range channels {
+		r.channels[project][c] = true
+	}
+}
+
+// reconfigure swaps the routes from the old config for the new config's, keeping the ones learned from webhooks.
+// a channel both configured and learned is forgotten with the config until the project's next webhook
+func (r *routes) reconfigure(old, projects []projectConfig) {
+	r.mu.Lock()
+	for _, p := range old {
+		for _, c := range p.Channels {
+			delete(r.channels[p.Project], c)
+		}
+	}
+	r.mu.Unlock()
+	for _, p := range projects {
+		r.add(p.Project, 0, p.Channels)
+	}
+}
+
+// resolve learns the given channels for the project, and returns every channel the project routes to
+func (r *routes) resolve(project string, id int, channels []string) []string {
+	r.add(project, id, channels)
+	return r.channelsFor(project)
+}
+
+// channelsFor returns the channels the project routes to
+func (r *routes) channelsFor(project string) []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	var channels []string
+	for c := range r.channels[project] {
+		channels = append(channels, c)
+	}
+	sort.Strings(channels)
+	return channels
+}
+
+// projectsFor returns the projects routed to the channel
+func (r *routes) projectsFor(channel string) []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	var projects []string
+	for p, channels := range r.channels {
+		if channels[channel] {
+			projects = append(projects, p)
+		}
+	}
+	sort.Strings(projects)
+	return projects
+}
+
+// all returns every project's channels
+func (r *routes) all() map[string][]string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	all := make(map[string][]string)
+	for p, projectChannels := range r.channels {
+		for c := range projectChannels {
+			all[p] = append(all[p], c)
+		}
+		sort.Strings(all[p])
+	}
+	return all
+}
+
+// allChannels returns every channel some project routes to
+func (r *routes) allChannels() []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	seen := make(map[string]bool)
+	var channels []string
+	for _, projectChannels := range r.channels {
+		for c := range projectChannels {
+			if !seen[c] {
+				seen[c] = true
+				channels = append(channels, c)
+			}
+		}
+	}
+	sort.Strings(channels)
+	return channels
+}
+
+// projectID returns the project's numeric ID, looking it up if it was only configured by path
+func (r *routes) projectID(gl GitLabAPI, project string) (int, error) {
+	r.mu.RLock()
+	id, ok := r.ids[project]
+	r.mu.RUnlock()
+	if ok {
+		return id, nil
+	}
+	p, err := gl.GetProjectByPath(project)
+	if err != nil {
+		return 0, err
+	}
+	r.mu.Lock()
+	r.ids[project] = p.ID
+	r.mu.Unlock()
+	return p.ID, nil
+}
+
+// webhookProject pulls the project out of the webhook events we handle
+func webhookProject(webhook interface{}) (path string, id int) {
+	switch wh := webhook.(type) {
+	case *gitlab.MergeEvent:
+		return wh.Project.PathWithNamespace, wh.Project.ID
+	case *gitlab.PipelineEvent:
+		return wh.Project.PathWithNamespace, wh.Project.ID
+	case *gitlab.DeploymentEvent:
+		return wh.Project.PathWithNamespace, wh.Project.ID
+	case *gitlab.IssueEvent:
+		return wh.Project.PathWithNamespace, wh.Project.ID
+	case *gitlab.TagEvent:
+		return wh.Project.PathWithNamespace, wh.ProjectID
+	case *gitlab.MergeCommentEvent:
+		return wh.Project.PathWithNamespace, wh.ProjectID
+	}
+	return "", 0
+}
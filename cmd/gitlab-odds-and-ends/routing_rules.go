@@ -0,0 +1,361 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/xanzy/go-gitlab"
+)
+
+const (
+	// how long a group's members are trusted before asking gitlab again
+	GROUP_MEMBERS_TTL = 10 * time.Minute
+	// how long an author's username and an MR's changes are trusted before asking gitlab again.  an MR's changes are
+	// asked for again as soon as it gets a new commit
+	ROUTING_LOOKUP_TTL = 5 * time.Minute
+)
+
+// routingRule sends events that match all of its conditions to more channels, on top of the project's own.  a condition
+// that's left out matches everything, and a condition matches if any of its values do.  for example, to also send
+// security MRs to #appsec:
+//
+//	routing_rules:
+//	  - labels: [security]
+//	    channels: [C0APPSEC00]
+type routingRule struct {
+	// Projects limits the rule to these projects, by path with namespace
+	Projects []string `yaml:"projects"`
+	// Labels matches MRs and issues with any of the labels
+	Labels []string `yaml:"labels"`
+	// Paths matches MRs changing a file matching any of the globs, see labelRule for the syntax
+	Paths []string `yaml:"paths"`
+	// AuthorGroups matches MRs and issues opened by, and pipelines run by, a member of any of the gitlab groups
+	AuthorGroups []string `yaml:"author_groups"`
+	// TargetBranches matches MRs (and their pipelines) targeting, and pipelines running on, a branch matching any of the globs
+	TargetBranches []string `yaml:"target_branches"`
+	Channels       []string `yaml:"channels"`
+}
+
+// compiledRoutingRule is a routingRule with its globs turned into regular expressions
+type compiledRoutingRule struct {
+	routingRule
+	projects map[string]bool
+	paths    []*regexp.Regexp
+	branches []*regexp.Regexp
+}
+
+// compileRoutingRules checks the routing rules up front, so a bad glob fails at startup instead of on an event
+func compileRoutingRules(rules []routingRule) ([]compiledRoutingRule, error) {
+	var compiled []compiledRoutingRule
+	for i, rule := range rules {
+		if len(rule.Channels) == 0 {
+			return nil, fmt.Errorf("routing rule %d has no channels", i+1)
+		}
+		c := compiledRoutingRule{routingRule: rule, projects: make(map[string]bool)}
+		for _, p := range rule.Projects {
+			c.projects[p] = true
+		}
+		for _, glob := range rule.Paths {
+			re, err := globRegexp(glob)
+			if err != nil {
+				return nil, fmt.Errorf("invalid path glob '%s' in routing rule %d: %v", glob, i+1, err)
+			}
+			c.paths = append(c.paths, re)
+		}
+		for _, glob := range rule.TargetBranches {
+			re, err := compileGlob(glob, false) // branch globs match the whole name, `main` isn't `feature/main`
+			if err != nil {
+				return nil, fmt.Errorf("invalid branch glob '%s' in routing rule %d: %v", glob, i+1, err)
+			}
+			c.branches = append(c.branches, re)
+		}
+		compiled = append(compiled, c)
+	}
+	return compiled, nil
+}
+
+// routedEvent is what routing rules can match on.  the MR's labels, files and author are looked up only if a rule needs them
+type routedEvent struct {
+	bot       bot
+	project   string
+	projectID int
+	// mrIID is the MR the event is about, or 0, and sha its latest commit if the event says
+	mrIID        int
+	sha          string
+	labels       []string
+	branch       string
+	author       string
+	authorID     int
+	changes      *gitlab.MergeRequest
+	changesTried bool
+}
+
+// newRoutedEvent pulls what the rules match on out of the webhook events we handle
+func (bot bot) newRoutedEvent(webhook interface{}) *routedEvent {
+	ev := &routedEvent{bot: bot}
+	ev.project, ev.projectID = webhookProject(webhook)
+	switch wh := webhook.(type) {
+	case *gitlab.MergeEvent:
+		ev.mrIID = wh.ObjectAttributes.IID
+		ev.sha = wh.ObjectAttributes.LastCommit.ID
+		ev.branch = wh.ObjectAttributes.TargetBranch
+		ev.authorID = wh.ObjectAttributes.AuthorID
+		for _, l := range wh.Labels {
+			ev.labels = append(ev.labels, l.Title)
+		}
+	case *gitlab.PipelineEvent:
+		ev.mrIID = wh.MergeRequest.IID
+		ev.branch = wh.ObjectAttributes.Ref
+		if wh.MergeRequest.IID != 0 {
+			ev.sha = wh.ObjectAttributes.SHA
+			ev.branch = wh.MergeRequest.TargetBranch
+		}
+		ev.author = wh.User.Username
+	case *gitlab.DeploymentEvent:
+		ev.author = wh.User.Username
+	case *gitlab.IssueEvent:
+		ev.authorID = wh.ObjectAttributes.AuthorID
+		for _, l := range wh.Labels {
+			ev.labels = append(ev.labels, l.Title)
+		}
+	}
+	return ev
+}
+
+// mergeRequest returns the event's MR with its changes, or nil if there isn't one or it can't be looked up
+func (ev *routedEvent) mergeRequest() *gitlab.MergeRequest {
+	if ev.mrIID == 0 || ev.changesTried {
+		return ev.changes
+	}
+	ev.changesTried = true
+	mr, err := ev.bot.routingLookups.changes(ev.bot.gl, ev.projectID, ev.mrIID, ev.sha)
+	if err != nil {
+		logrus.WithError(err).Errorf("failed to list changes of merge request !%d for routing", ev.mrIID)
+		return nil
+	}
+	ev.changes = mr
+	return mr
+}
+
+func (ev *routedEvent) eventLabels() []string {
+	if ev.labels == nil {
+		if mr := ev.mergeRequest(); mr != nil {
+			ev.labels = mr.Labels
+		}
+	}
+	return ev.labels
+}
+
+func (ev *routedEvent) authorUsername() string {
+	if ev.author == "" && ev.authorID != 0 {
+		username, err := ev.bot.routingLookups.username(ev.bot.gl, ev.authorID)
+		if err != nil {
+			logrus.WithError(err).Errorf("failed to look up author %d for routing", ev.authorID)
+			ev.authorID = 0 // don't ask again for the other rules
+			return ""
+		}
+		ev.author = username
+	}
+	return ev.author
+}
+
+// matches reports whether the event meets every condition of the rule
+func (rule compiledRoutingRule) matches(ev *routedEvent) bool {
+	if len(rule.projects) > 0 && !rule.projects[ev.project] {
+		return false
+	}
+	if len(rule.TargetBranches) > 0 && !matchesAny(rule.branches, []string{ev.branch}) {
+		return false
+	}
+	if len(rule.Labels) > 0 {
+		has := make(map[string]bool)
+		for _, l := range ev.eventLabels() {
+			has[l] = true
+		}
+		matched := false
+		for _, l := range rule.Labels {
+			matched = matched || has[l]
+		}
+		if !matched {
+			return false
+		}
+	}
+	if len(rule.Paths) > 0 {
+		mr := ev.mergeRequest()
+		if mr == nil {
+			return false
+		}
+		var paths []string
+		for _, c := range mr.Changes {
+			paths = append(paths, c.OldPath, c.NewPath)
+		}
+		if !matchesAny(rule.paths, paths) {
+			return false
+		}
+	}
+	if len(rule.AuthorGroups) > 0 {
+		author := ev.authorUsername()
+		if author == "" {
+			return false
+		}
+		matched := false
+		for _, group := range rule.AuthorGroups {
+			if matched = ev.bot.groupMembers.isMember(ev.bot.gl, group, author); matched {
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+	return true
+}
+
+// matchesAny reports whether any of the values matches any of the regular expressions
+func matchesAny(res []*regexp.Regexp, values []string) bool {
+	for _, re := range res {
+		for _, v := range values {
+			if v != "" && re.MatchString(v) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// applyRoutingRules adds the channels of every rule the event matches to the project's channels.  the extra channels
+// only get this event, they aren't learned as routes for the project
+func (bot bot) applyRoutingRules(webhook interface{}, slackChans []string) []string {
+	if len(bot.routingRules) == 0 {
+		return slackChans
+	}
+	ev := bot.newRoutedEvent(webhook)
+	seen := make(map[string]bool)
+	for _, c := range slackChans {
+		seen[c] = true
+	}
+	for _, rule := range bot.routingRules {
+		if !rule.matches(ev) {
+			continue
+		}
+		logrus.Debugf("routing rule for %s matched, also notifying %s", ev.project, strings.Join(rule.Channels, ", "))
+		for _, c := range rule.Channels {
+			if !seen[c] {
+				seen[c] = true
+				slackChans = append(slackChans, c)
+			}
+		}
+	}
+	return slackChans
+}
+
+// groupMembers caches the usernames of each gitlab group's members, inherited ones included
+type groupMembers struct {
+	mu     sync.Mutex
+	groups map[string]cachedGroupMembers
+}
+
+type cachedGroupMembers struct {
+	usernames map[string]bool
+	fetched   time.Time
+}
+
+func newGroupMembers() *groupMembers {
+	return &groupMembers{groups: make(map[string]cachedGroupMembers)}
+}
+
+// isMember reports whether the user is in the group.  if gitlab can't tell us, they aren't
+func (g *groupMembers) isMember(gl GitLabAPI, group, username string) bool {
+	g.mu.Lock()
+	cached, ok := g.groups[group]
+	g.mu.Unlock()
+	if !ok || time.Since(cached.fetched) >= GROUP_MEMBERS_TTL {
+		members, err := gl.ListAllGroupMembers(group)
+		if err != nil {
+			logrus.WithError(err).Errorf("failed to list members of group %s", group)
+			return false
+		}
+		cached = cachedGroupMembers{usernames: make(map[string]bool), fetched: time.Now()}
+		for _, m := range members {
+			cached.usernames[m.Username] = true
+		}
+		g.mu.Lock()
+		g.groups[group] = cached
+		g.mu.Unlock()
+	}
+	return cached.usernames[username]
+}
+
+// routingLookups caches the authors and MR changes routing rules look up, so webhooks about a busy MR aren't each held
+// up asking gitlab before they're answered
+type routingLookups struct {
+	mu        sync.Mutex
+	usernames map[int]cachedUsername
+	mrs       map[string]cachedChanges // by mrRef
+}
+
+type cachedUsername struct {
+	username string
+	fetched  time.Time
+}
+
+type cachedChanges struct {
+	mr      *gitlab.MergeRequest
+	sha     string
+	fetched time.Time
+}
+
+func newRoutingLookups() *routingLookups {
+	return &routingLookups{usernames: make(map[int]cachedUsername), mrs: make(map[string]cachedChanges)}
+}
+
+// username looks up the user's username
+func (r *routingLookups) username(gl GitLabAPI, id int) (string, error) {
+	r.mu.Lock()
+	cached, ok := r.usernames[id]
+	r.mu.Unlock()
+	if ok && time.Since(cached.fetched) < ROUTING_LOOKUP_TTL {
+		return cached.username, nil
+	}
+	user, err := gl.GetUser(id)
+	if err != nil {
+		return "", err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for id, c := range r.usernames {
+		if time.Since(c.fetched) >= ROUTING_LOOKUP_TTL {
+			delete(r.usernames, id)
+		}
+	}
+	r.usernames[id] = cachedUsername{username: user.Username, fetched: time.Now()}
+	return user.Username, nil
+}
+
+// changes looks up the MR with its changes.  sha is its latest commit if the event says, so a push isn't missed
+func (r *routingLookups) changes(gl GitLabAPI, projectID, iid int, sha string) (*gitlab.MergeRequest, error) {
+	ref := mrRef(projectID, iid)
+	r.mu.Lock()
+	cached, ok := r.mrs[ref]
+	r.mu.Unlock()
+	if ok && (sha == "" || sha == cached.sha) && time.Since(cached.fetched) < ROUTING_LOOKUP_TTL {
+		return cached.mr, nil
+	}
+	mr, err := gl.GetMergeRequestChanges(projectID, iid)
+	if err != nil {
+		return nil, err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for ref, c := range r.mrs {
+		if time.Since(c.fetched) >= ROUTING_LOOKUP_TTL {
+			delete(r.mrs, ref)
+		}
+	}
+	r.mrs[ref] = cachedChanges{mr: mr, sha: mr.SHA, fetched: time.Now()}
+	return mr, nil
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/xanzy/go-gitlab"
+)
+
+// countingGitLab counts the lookups routing makes
+type countingGitLab struct {
+	*fakeGitLab
+	userLookups, changesLookups int
+}
+
+func (gl *countingGitLab) GetUser(id int) (*gitlab.User, error) {
+	gl.userLookups++
+	return gl.fakeGitLab.GetUser(id)
+}
+
+func (gl *countingGitLab) GetMergeRequestChanges(pid, iid int) (*gitlab.MergeRequest, error) {
+	gl.changesLookups++
+	return gl.fakeGitLab.GetMergeRequestChanges(pid, iid)
+}
+
+func TestRoutingLookupsAreCached(t *testing.T) {
+	gl := &countingGitLab{fakeGitLab: newFakeGitLab()}
+	testMembers(gl.fakeGitLab)
+	ev := testMR(gl.fakeGitLab, 0)
+	gl.fakeGitLab.mrs[mrRef(testProject, testIID)].SHA = "aaa"
+	gl.fakeGitLab.changes[mrRef(testProject, testIID)] = []*gitlab.MergeRequestDiff{{OldPath: "docs/README.md", NewPath: "docs/README.md"}}
+	rules, err := compileRoutingRules([]routingRule{{Paths: []string{"docs/**"}, Channels: []string{"#docs"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := bot{gl: gl, routingRules: rules, routingLookups: newRoutingLookups()}
+
+	ev.ObjectAttributes.LastCommit.ID = "aaa"
+	for i := 0; i < 3; i++ {
+		if got := b.applyRoutingRules(ev, nil); len(got) != 1 || got[0] != "#docs" {
+			t.Fatalf("applyRoutingRules() = %v, want #docs", got)
+		}
+	}
+	if gl.changesLookups != 1 {
+		t.Errorf("looked up the MR's changes %d times, want once", gl.changesLookups)
+	}
+
+	gl.fakeGitLab.mrs[mrRef(testProject, testIID)].SHA = "bbb"
+	ev.ObjectAttributes.LastCommit.ID = "bbb"
+	b.applyRoutingRules(ev, nil)
+	if gl.changesLookups != 2 {
+		t.Errorf("looked up the MR's changes %d times, want again after a push", gl.changesLookups)
+	}
+
+	for i := 0; i < 3; i++ {
+		if _, err := b.routingLookups.username(gl, testAuthor); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if gl.userLookups != 1 {
+		t.Errorf("looked up the author %d times, want once", gl.userLookups)
+	}
+}
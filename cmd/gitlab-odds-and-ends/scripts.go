@@ -0,0 +1,134 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"time"
+
+	"github.com/raidancampbell/gitlab-odds-and-ends/internal/config"
+	"github.com/raidancampbell/gitlab-odds-and-ends/internal/script"
+	"github.com/sirupsen/logrus"
+	"github.com/xanzy/go-gitlab"
+)
+
+const (
+	// the budget of each call to a project's script, see script.Limits
+	SCRIPT_TIMEOUT   = 250 * time.Millisecond
+	SCRIPT_MAX_STEPS = 1000000
+	SCRIPT_MAX_ALLOC = 4 << 20
+	// the functions a script can define
+	SCRIPT_ROUTE  = "route"
+	SCRIPT_ASSIGN = "assign"
+)
+
+// loadScripts compiles each project's script, see projectConfig.Script.  configPath is the config file's, which
+// scripts are relative to
+func loadScripts(configPath string, projects []projectConfig) (map[string]*script.Script, error) {
+	scripts := make(map[string]*script.Script)
+	for _, p := range projects {
+		if p.Script == "" {
+			continue
+		}
+		path := config.Resolve(configPath, p.Script)
+		src, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("loading the script of project %s: %v", p.Project, err)
+		}
+		s, err := script.Compile(path, src, script.Limits{Timeout: SCRIPT_TIMEOUT, MaxSteps: SCRIPT_MAX_STEPS, MaxAlloc: SCRIPT_MAX_ALLOC})
+		if err != nil {
+			return nil, fmt.Errorf("compiling the script of project %s: %v", p.Project, err)
+		}
+		if !s.Has(SCRIPT_ROUTE) && !s.Has(SCRIPT_ASSIGN) {
+			return nil, fmt.Errorf("the script of project %s defines neither %s nor %s", p.Project, SCRIPT_ROUTE, SCRIPT_ASSIGN)
+		}
+		scripts[p.Project] = s
+	}
+	return scripts, nil
+}
+
+// scriptEvent is the webhook as the script sees it: the event's JSON, e.g. `event["object_attributes"]["title"]`
+func scriptEvent(webhook interface{}) (map[string]interface{}, error) {
+	b, err := json.Marshal(webhook)
+	if err != nil {
+		return nil, err
+	}
+	var ev map[string]interface{}
+	return ev, json.Unmarshal(b, &ev)
+}
+
+// scriptedRoute lets the project's script pick the event's channels.  its `route(event, channels)` gets the channels
+// routing picked and returns the ones to notify instead, or None to leave them be.  a script that fails leaves them be
+// too
+func (bot bot) scriptedRoute(project string, webhook interface{}, slackChans []string) []string {
+	s := bot.scripts[project]
+	if s == nil || !s.Has(SCRIPT_ROUTE) {
+		return slackChans
+	}
+	ev, err := scriptEvent(webhook)
+	if err != nil {
+		logrus.WithError(err).Errorf("failed to pass the event to the script of %s", project)
+		return slackChans
+	}
+	result, err := s.Call(SCRIPT_ROUTE, ev, slackChans)
+	if err != nil {
+		logrus.WithError(err).Errorf("the script of %s failed to route the event", project)
+		return slackChans
+	}
+	if result == nil {
+		return slackChans
+	}
+	list, ok := result.([]interface{})
+	if !ok {
+		logrus.Errorf("the script of %s routed the event to a %T, expected a list of channels", project, result)
+		return slackChans
+	}
+	channels := make([]string, 0, len(list))
+	for _, c := range list {
+		channel, ok := c.(string)
+		if !ok || channel == "" {
+			logrus.Errorf("the script of %s routed the event to '%v', which isn't a channel", project, c)
+			return slackChans
+		}
+		channels = append(channels, channel)
+	}
+	logrus.Debugf("the script of %s routed the event to %v", project, channels)
+	return channels
+}
+
+// scriptedAssignee lets the project's script pick who reviews the MR.  its `assign(event, candidates)` gets the MR's
+// event and the usernames of the available candidates, and returns one of them, or None to pick as usual.  the pick
+// takes the place of the experts, so it's still skipped if it's the MR's author
+func (bot bot) scriptedAssignee(mr *gitlab.MergeEvent, candidates reviewCandidates) reviewCandidates {
+	project := mr.Project.PathWithNamespace
+	s := bot.scripts[project]
+	if s == nil || !s.Has(SCRIPT_ASSIGN) {
+		return candidates
+	}
+	ev, err := scriptEvent(mr)
+	if err != nil {
+		logrus.WithError(err).Errorf("failed to pass merge request !%d to the script of %s", mr.ObjectAttributes.IID, project)
+		return candidates
+	}
+	usernames := make([]string, len(candidates.available))
+	for i, m := range candidates.available {
+		usernames[i] = m.Username
+	}
+	result, err := s.Call(SCRIPT_ASSIGN, ev, usernames)
+	if err != nil {
+		logrus.WithError(err).Errorf("the script of %s failed to assign merge request !%d", project, mr.ObjectAttributes.IID)
+		return candidates
+	}
+	if result == nil {
+		return candidates
+	}
+	for _, m := range candidates.available {
+		if m.Username == result {
+			logrus.Infof("the script of %s picked %s for merge request !%d", project, m.Username, mr.ObjectAttributes.IID)
+			candidates.experts = []*gitlab.ProjectMember{m}
+			return candidates
+		}
+	}
+	logrus.Errorf("the script of %s picked '%v' for merge request !%d, who isn't an available candidate", project, result, mr.ObjectAttributes.IID)
+	return candidates
+}
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"github.com/raidancampbell/gitlab-odds-and-ends/internal/notify"
+	"github.com/raidancampbell/gitlab-odds-and-ends/internal/store"
+	"github.com/xanzy/go-gitlab"
+)
+
+const (
+	DEBUG_SIMULATE_ENV_VAR = "DEBUG_SIMULATE"
+	// SIMULATED_USER is who triggered simulated events that have no MR author to pin them on
+	SIMULATED_USER = "simulation"
+)
+
+// simulateEnabled reports whether DEBUG_SIMULATE turns on `/debug/simulate`
+func simulateEnabled() bool {
+	enabled, _ := strconv.ParseBool(os.Getenv(DEBUG_SIMULATE_ENV_VAR))
+	return enabled
+}
+
+// simulation is what `/debug/simulate` answers with: the event it made up, where routing sent it, and everything the
+// bot would have done about it
+type simulation struct {
+	Kind      string       `json:"kind"`
+	Event     interface{}  `json:"event"`
+	Channels  []string     `json:"channels"`
+	Result    string       `json:"result"`
+	Outcome   string       `json:"outcome"`
+	Decisions []auditEntry `json:"decisions"`
+}
+
+// simulateRouter serves `POST /debug/simulate?event=merge_request&project=group/project`, which makes up a webhook for
+// the project from its real data, runs it through the bot like one from gitlab, and answers with what the bot would
+// have done, without doing any of it.  for merge_request events `mr` picks the MR (the most recently updated open one by
+// default) and `action` what happened to it (`open` by default, see mrActions).  pipeline events run on `mr`'s source
+// branch, or the default branch, and `status` is how they went (`failed` by default).  `slack-channel` and `instance`
+// work as they do for gitlab's webhooks.  only what the bot does before answering is included; follow-ups it schedules
+// for later aren't
+func (bot bot) simulateRouter(c *gin.Context) {
+	target, ok := bot.instances.get(c.Query(GITLAB_INSTANCE_QUERY_PARAM))
+	if !ok {
+		http.Error(c.Writer, fmt.Sprintf("no gitlab instance named %q", c.Query(GITLAB_INSTANCE_QUERY_PARAM)), http.StatusNotFound)
+		return
+	}
+	mem, err := store.Open("")
+	if err != nil {
+		http.Error(c.Writer, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	trace, err := newAuditLog(mem)
+	if err != nil {
+		http.Error(c.Writer, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	sim, err := target.simulated(mem, trace)
+	if err != nil {
+		http.Error(c.Writer, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	kind, webhook, err := sim.synthesize(c.Query("event"), c.Query("project"), c.Request.URL.Query())
+	if err != nil {
+		http.Error(c.Writer, err.Error(), http.StatusBadRequest)
+		return
+	}
+	delivery, _ := sim.handleWebhook(kind, webhook, c.QueryArray(GITLAB_SLACK_CHANNEL_QUERY_PARAM), "")
+	bot.audit.record(auditEntry{Action: "simulate", Actor: "admin:" + c.GetString(gin.AuthUserKey), Target: delivery.Project,
+		Detail: webhookTrigger(kind, webhook), Outcome: delivery.Outcome})
+	c.JSON(http.StatusOK, simulation{
+		Kind:      kind,
+		Event:     webhook,
+		Channels:  delivery.Channels,
+		Result:    delivery.Result,
+		Outcome:   delivery.Outcome,
+		Decisions: trace.query(auditQuery{}),
+	})
+}
+
+// simulated is the bot as it handles a simulated event.  it reads from gitlab as usual, but its changes and messages
+// are only recorded, in trace.  it starts from the empty state in mem, so the real MRs' threads, review clocks and
+// metrics are left alone, and it leaves out the integrations that would tell other systems about the event
+func (bot bot) simulated(mem *store.Store, trace *auditLog) (bot, error) {
+	if _, ok := bot.gl.(dryRunGitLab); !ok {
+		bot.gl = dryRunGitLab{bot.gl}
+	}
+	bot.notifier = notify.DryRun{}
+	bot.audit = trace
+	bot.status = newBotStatus()
+
+	var err error
+	if bot.threads, err = newThreads(mem); err != nil {
+		return bot, err
+	}
+	if bot.slas, err = newReviewSLAs(mem); err != nil {
+		return bot, err
+	}
+	if bot.cycleTimes, err = newCycleTimes(mem); err != nil {
+		return bot, err
+	}
+	if bot.dora, err = newDora(mem); err != nil {
+		return bot, err
+	}
+	if bot.cherryPicks, err = newCherryPicks(mem); err != nil {
+		return bot, err
+	}
+	if bot.handoffs, err = newHandoffs(mem); err != nil {
+		return bot, err
+	}
+	// routing learns from the events it routes, which mustn't change where the real ones go
+	if bot.routes != nil {
+		bot.routes = bot.routes.copy()
+	}
+	if bot.defaultRoutes != nil {
+		bot.defaultRoutes = bot.defaultRoutes.copy()
+	}
+	if bot.blocked, err = newBlockedMRs(mem); err != nil {
+		return bot, err
+	}
+	if bot.rebases, err = newRebases(mem); err != nil {
+		return bot, err
+	}
+	if bot.drafts, err = newDrafts(mem); err != nil {
+		return bot, err
+	}
+	if bot.issueAssignees, err = newIssueAssignees(mem); err != nil {
+		return bot, err
+	}
+	if bot.trunk, err = newTrunkHealth(mem); err != nil {
+		return bot, err
+	}
+	if bot.reminders, err = newPendingReminders(mem); err != nil {
+		return bot, err
+	}
+	if bot.expiry != nil {
+		if bot.expiry, err = newApprovalExpiry(int(bot.expiry.maxAge.Hours()/24), mem); err != nil {
+			return bot, err
+		}
+	}
+	if bot.opa != nil {
+		// its own record of decisions, so the simulation's are in trace whatever the real MR's were
+		bot.opa = &opaPolicies{query: bot.opa.query, decided: make(map[string]string)}
+	}
+	if bot.jira != nil {
+		j := *bot.jira
+		j.dryRun = true
+		bot.jira = &j
+	}
+	// replies go out right away, so they're in trace
+	bot.debounce = nil
+	bot.recognition = nil
+	bot.signoffs = nil
+	bot.pagerDuty = nil
+	bot.deployDigest = nil
+	bot.flaky = nil
+	bot.eventDB = nil
+	bot.eventBus = nil
+	bot.outgoing = nil
+	bot.archive = nil
+	return bot, nil
+}
+
+// synthesize makes up a webhook of the kind (see simulateRouter) for the project, returning it with its X-Gitlab-Event
+func (bot bot) synthesize(event, path string, q url.Values) (string, interface{}, error) {
+	if path == "" {
+		return "", nil, fmt.Errorf("which project? e.g. `project=group/project`")
+	}
+	project, err := bot.gl.GetProjectByPath(path)
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to look up %s: %v", path, err)
+	}
+	switch event {
+	case EVENT_KIND_MERGE_REQUEST:
+		mr, err := bot.simulatedMR(project, q.Get("mr"), true)
+		if err != nil {
+			return "", nil, err
+		}
+		action := q.Get("action")
+		if action == "" {
+			action = MR_ACTION_OPENED
+		}
+		if !mrActions[action] {
+			return "", nil, fmt.Errorf("unknown merge request action '%s'", action)
+		}
+		ev := mergeEventFor(project, mr)
+		ev.ObjectAttributes.Action = action
+		switch action {
+		case MR_ACTION_MERGED:
+			ev.ObjectAttributes.State = "merged"
+		case MR_ACTION_CLOSED:
+			ev.ObjectAttributes.State = "closed"
+		default:
+			ev.ObjectAttributes.State = "opened"
+		}
+		return string(gitlab.EventTypeMergeRequest), ev, nil
+	case EVENT_KIND_PIPELINE:
+		mr, err := bot.simulatedMR(project, q.Get("mr"), false)
+		if err != nil {
+			return "", nil, err
+		}
+		status := q.Get("status")
+		if status == "" {
+			status = PIPELINE_STATUS_FAILED
+		}
+		ev := &gitlab.PipelineEvent{ObjectKind: EVENT_KIND_PIPELINE}
+		ev.Project.ID = project.ID
+		ev.Project.Name = project.Name
+		ev.Project.PathWithNamespace = project.PathWithNamespace
+		ev.Project.WebURL = project.WebURL
+		ev.Project.DefaultBranch = project.DefaultBranch
+		ev.ObjectAttributes.Ref = project.DefaultBranch
+		ev.ObjectAttributes.Status = status
+		ev.ObjectAttributes.Source = "push"
+		ev.User = &gitlab.EventUser{Name: SIMULATED_USER, Username: SIMULATED_USER}
+		ev.Commit.Message = "simulated pipeline"
+		if mr != nil {
+			ev.ObjectAttributes.Ref = mr.SourceBranch
+			ev.ObjectAttributes.SHA = mr.SHA
+			ev.Commit.ID = mr.SHA
+			if mr.HeadPipeline != nil {
+				ev.ObjectAttributes.ID = mr.HeadPipeline.ID
+			}
+			ev.MergeRequest.IID = mr.IID
+			ev.MergeRequest.Title = mr.Title
+			ev.MergeRequest.SourceBranch = mr.SourceBranch
+			ev.MergeRequest.TargetBranch = mr.TargetBranch
+			ev.MergeRequest.State = mr.State
+			ev.MergeRequest.URL = mr.WebURL
+			if mr.Author != nil {
+				ev.User = &gitlab.EventUser{ID: mr.Author.ID, Name: mr.Author.Name, Username: mr.Author.Username}
+			}
+		}
+		return string(gitlab.EventTypePipeline), ev, nil
+	}
+	return "", nil, fmt.Errorf("can't simulate '%s' events, only %s and %s", event, EVENT_KIND_MERGE_REQUEST, EVENT_KIND_PIPELINE)
+}
+
+// simulatedMR is the MR with the IID, or the project's most recently updated open one if required (nil otherwise)
+func (bot bot) simulatedMR(project *gitlab.Project, iid string, required bool) (*gitlab.MergeRequest, error) {
+	if iid != "" {
+		n, err := strconv.Atoi(iid)
+		if err != nil {
+			return nil, fmt.Errorf("invalid mr '%s'", iid)
+		}
+		return bot.gl.GetMergeRequest(project.ID, n)
+	}
+	if !required {
+		return nil, nil
+	}
+	mrs, _, err := bot.gl.ListProjectMergeRequests(project.ID, &gitlab.ListProjectMergeRequestsOptions{
+		State:       gitlab.String("opened"),
+		OrderBy:     gitlab.String("updated_at"),
+		ListOptions: gitlab.ListOptions{PerPage: 1},
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(mrs) == 0 {
+		return nil, fmt.Errorf("%s has no open merge requests, pick one with `mr=<iid>`", project.PathWithNamespace)
+	}
+	// the list leaves out some of what the MR's own page has, like its head pipeline
+	return bot.gl.GetMergeRequest(project.ID, mrs[0].IID)
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/raidancampbell/gitlab-odds-and-ends/internal/store"
+)
+
+func TestSimulationDoesntChangeRouting(t *testing.T) {
+	b := bot{
+		routes:        newRoutes([]projectConfig{{Project: "group/project", Channels: []string{"#team"}}}),
+		defaultRoutes: newDefaultRouter(defaultRoutesConfig{}),
+	}
+	mem, err := store.Open("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	trace, err := newAuditLog(mem)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sim, err := b.simulated(mem, trace)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got := sim.routes.resolve("group/project", 1, []string{"#simulated"}); len(got) != 2 {
+		t.Errorf("simulated routes = %v, want the configured and the simulated channel", got)
+	}
+	sim.defaultRoutes.reportUnrouted("group/unrouted")
+
+	if got := b.routes.channelsFor("group/project"); len(got) != 1 || got[0] != "#team" {
+		t.Errorf("routes after a simulation = %v, want only #team", got)
+	}
+	if !b.defaultRoutes.reportUnrouted("group/unrouted") {
+		t.Error("the simulation kept an unrouted project from being reported")
+	}
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/raidancampbell/gitlab-odds-and-ends/internal/store"
+	"github.com/sirupsen/logrus"
+	"github.com/xanzy/go-gitlab"
+)
+
+const (
+	REVIEW_SLA_STORE_KEY = "review_sla"
+	// business hours are 9 to 5, monday to friday, in the bot's local timezone
+	BUSINESS_DAY_START       = 9
+	BUSINESS_DAY_END         = 17
+	REVIEW_SLA_SCAN_INTERVAL = 5 * time.Minute
+)
+
+// slaEntry tracks an MR waiting on its first review
+type slaEntry struct {
+	ProjectID int       `json:"project_id"`
+	IID       int       `json:"iid"`
+	Opened    time.Time `json:"opened"`
+	// Level is how far up the escalation ladder the MR has gone
+	Level    int      `json:"level"`
+	Channels []string `json:"channels"`
+}
+
+// reviewSLAs tracks open-to-first-review time for MRs in projects whose policy has a review SLA, and is persisted so a
+// restart doesn't reset anyone's clock
+type reviewSLAs struct {
+	store   *store.Store
+	mu      sync.Mutex
+	entries map[string]*slaEntry // keyed by mrRef
+}
+
+func newReviewSLAs(s *store.Store) (*reviewSLAs, error) {
+	r := &reviewSLAs{store: s, entries: make(map[string]*slaEntry)}
+	if _, err := s.Load(REVIEW_SLA_STORE_KEY, &r.entries); err != nil {
+		return nil, err
+	}
+	s.Follow(REVIEW_SLA_STORE_KEY, &r.entries, &r.mu)
+	return r, nil
+}
+
+// saveLocked persists the entries.  r.mu must be held
+func (r *reviewSLAs) saveLocked() {
+	if err := r.store.Save(REVIEW_SLA_STORE_KEY, r.entries); err != nil {
+		logrus.WithError(err).Error("failed to persist review SLAs")
+	}
+}
+
+// track starts the MR's clock, unless it's already running (e.g. it was reopened)
+func (r *reviewSLAs) track(projectID, iid int, opened time.Time, channels []string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	ref := mrRef(projectID, iid)
+	if _, ok := r.entries[ref]; ok {
+		return
+	}
+	r.entries[ref] = &slaEntry{ProjectID: projectID, IID: iid, Opened: opened, Channels: channels}
+	r.saveLocked()
+}
+
+func (r *reviewSLAs) stop(ref string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.entries, ref)
+	r.saveLocked()
+}
+
+// snapshot copies the entries, so they can be checked without holding the lock over gitlab calls
+func (r *reviewSLAs) snapshot() map[string]slaEntry {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	entries := make(map[string]slaEntry, len(r.entries))
+	for ref, e := range r.entries {
+		entries[ref] = *e
+	}
+	return entries
+}
+
+// escalated records that the MR reached the given escalation level
+func (r *reviewSLAs) escalated(ref string, level int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if e, ok := r.entries[ref]; ok {
+		e.Level = level
+		r.saveLocked()
+	}
+}
+
+// businessTime is how much of the time between from and to fell within business hours
+func businessTime(from, to time.Time) time.Duration {
+	var d time.Duration
+	from, to = from.Local(), to.Local()
+	for day := time.Date(from.Year(), from.Month(), from.Day(), 0, 0, 0, 0, time.Local); day.Before(to); day = day.AddDate(0, 0, 1) {
+		if day.Weekday() == time.Saturday || day.Weekday() == time.Sunday {
+			continue
+		}
+		start := time.Date(day.Year(), day.Month(), day.Day(), BUSINESS_DAY_START, 0, 0, 0, time.Local)
+		end := time.Date(day.Year(), day.Month(), day.Day(), BUSINESS_DAY_END, 0, 0, 0, time.Local)
+		if start.Before(from) {
+			start = from
+		}
+		if end.After(to) {
+			end = to
+		}
+		if end.After(start) {
+			d += end.Sub(start)
+		}
+	}
+	return d
+}
+
+// trackReviewSLA starts the SLA clock on a newly announced MR, if its project's policy has one
+func (bot bot) trackReviewSLA(mr *gitlab.MergeEvent, slackChans []string) {
+	if bot.policies.forProject(bot.gl, mr.Project.ID).ReviewSLA == 0 {
+		return
+	}
+	bot.slas.track(mr.Project.ID, mr.ObjectAttributes.IID, time.Now(), slackChans)
+}
+
+// checkReviewSLAs looks for first reviews on the tracked MRs, and escalates the ones that breached their SLA.  each
+// further SLA period without a review climbs a rung: remind the assignee, ping the team lead, then the escalation channel
+func (bot bot) checkReviewSLAs() {
+	for ref, entry := range bot.slas.snapshot() {
+		mr, err := bot.gl.GetMergeRequest(entry.ProjectID, entry.IID)
+		if err != nil {
+			logrus.WithError(err).Errorf("failed to look up merge request !%d for its review SLA", entry.IID)
+			continue
+		}
+		if mr.State != "opened" {
+			bot.stopReviewSLA(ref)
+			continue
+		}
+		policy := bot.policies.forProject(bot.gl, entry.ProjectID)
+		if policy.ReviewSLA == 0 {
+			bot.stopReviewSLA(ref)
+			continue
+		}
+
+		reviewed, err := firstReview(bot.gl, mr, entry.Opened)
+		if err != nil {
+			logrus.WithError(err).Errorf("failed to look for reviews of merge request !%d", entry.IID)
+			continue
+		}
+		waited := time.Since(entry.Opened)
+		if !reviewed.IsZero() {
+			waited = reviewed.Sub(entry.Opened)
+		}
+		if policy.ReviewSLABusinessHours {
+			waited = businessTime(entry.Opened, entry.Opened.Add(waited))
+		}
+		if !reviewed.IsZero() {
+			logrus.Infof("merge request !%d in project %d got its first review after %s (SLA %s)", entry.IID, entry.ProjectID, waited.Round(time.Minute), policy.ReviewSLA)
+			bot.stopReviewSLA(ref)
+			continue
+		}
+
+		for level := entry.Level + 1; level <= 3 && waited >= time.Duration(level)*policy.ReviewSLA; level++ {
+			bot.escalateReview(mr, policy, entry, level, waited)
+			bot.slas.escalated(ref, level)
+		}
+	}
+}
+
+// firstReview is when someone other than the author first commented on or approved the MR since it was opened, or zero
+func firstReview(gl GitLabAPI, mr *gitlab.MergeRequest, since time.Time) (time.Time, error) {
+	opts := &gitlab.ListMergeRequestNotesOptions{
+		ListOptions: gitlab.ListOptions{PerPage: 100},
+		OrderBy:     gitlab.String("created_at"),
+		Sort:        gitlab.String("asc"),
+	}
+	for {
+		notes, resp, err := gl.ListMergeRequestNotes(mr.ProjectID, mr.IID, opts)
+		if err != nil {
+			return time.Time{}, err
+		}
+		for _, note := range notes {
+			if isReviewNote(mr, note) && note.CreatedAt.After(since) {
+				return *note.CreatedAt, nil
+			}
+		}
+		if resp.NextPage == 0 {
+			return time.Time{}, nil
+		}
+		opts.Page = resp.NextPage
+	}
+}
+
+// escalateReview takes the MR one rung up the escalation ladder
+func (bot bot) escalateReview(mr *gitlab.MergeRequest, policy policyConfig, entry slaEntry, level int, waited time.Duration) {
+	msg := tr(":alarm_clock: <%s|!%d %s> has waited %s for its first review, past the `%s` policy's %s SLA.",
+		mr.WebURL, mr.IID, mr.Title, waited.Round(time.Minute), policy.Topic, policy.ReviewSLA)
+	group := bot.escalationGroup(mr, policy)
+	switch level {
+	case 1:
+		if mr.Assignee == nil {
+			if group != "" {
+				bot.notifyThreadLocalized(mr.ProjectID, mr.IID, tr("%s  It has no assignee, %s can one of you take it?", msg, slackGroupMention(group)), entry.Channels)
+				return
+			}
+			bot.notifyThreadLocalized(mr.ProjectID, mr.IID, tr("%s  It has no assignee.", msg), entry.Channels)
+			return
+		}
+		mention := "@" + mr.Assignee.Username
+		if slackID, err := bot.users.slackUser(mr.Assignee.Username); err == nil {
+			mention = fmt.Sprintf("<@%s>", slackID)
+		}
+		bot.notifyThreadLocalized(mr.ProjectID, mr.IID, tr("%s  %s please take a look.", msg, mention), entry.Channels)
+	case 2:
+		if policy.TeamLead == "" && group != "" {
+			bot.notifyThreadLocalized(mr.ProjectID, mr.IID, tr("%s  %s can one of you review it?", msg, slackGroupMention(group)), entry.Channels)
+			return
+		}
+		if policy.TeamLead == "" {
+			logrus.Debugf("no team lead in the `%s` policy to escalate merge request !%d to", policy.Topic, mr.IID)
+			return
+		}
+		bot.notifyThreadLocalized(mr.ProjectID, mr.IID, tr("%s  <@%s> can you find it a reviewer?", msg, policy.TeamLead), entry.Channels)
+	case 3:
+		bot.pageReviewSLA(mr, policy, waited)
+		if policy.EscalationChannel == "" {
+			logrus.Debugf("no escalation channel in the `%s` policy for merge request !%d", policy.Topic, mr.IID)
+			return
+		}
+		if group != "" {
+			msg = tr("%s  %s", msg, slackGroupMention(group))
+		}
+		bot.notifyLocalized(msg, []string{policy.EscalationChannel})
+	}
+}
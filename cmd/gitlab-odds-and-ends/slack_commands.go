@@ -0,0 +1,55 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+	"github.com/slack-go/slack"
+)
+
+const (
+	SLACK_COMMAND_INCIDENT = "/incident"
+)
+
+// slackCommandRouter receives slash commands.  point each of the slack app's slash commands at `/slack/commands`
+func (bot bot) slackCommandRouter(c *gin.Context) {
+	cmd, err := slack.SlashCommandParse(c.Request)
+	if err != nil {
+		logrus.WithError(err).Error("Failed to parse slash command")
+		http.Error(c.Writer, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+	logrus.Debugf("processing slash command %s '%s' from %s", cmd.Command, cmd.Text, cmd.UserName)
+	bot = bot.triggeredBy(fmt.Sprintf("slack:%s %s %s", cmd.UserID, cmd.Command, cmd.Text))
+
+	var resp *slack.Msg
+	switch cmd.Command {
+	case SLACK_COMMAND_INCIDENT:
+		resp = bot.incidentCommand(cmd)
+	case SLACK_COMMAND_MRS:
+		resp = bot.mrsCommand(cmd)
+	case SLACK_COMMAND_FREEZE:
+		resp = bot.freezeCommand(cmd)
+	case SLACK_COMMAND_BOT_STATUS:
+		resp = bot.botStatusCommand(cmd)
+	case SLACK_COMMAND_HANDOFF:
+		resp = bot.handoffCommand(cmd)
+	case SLACK_COMMAND_WATCH:
+		resp = bot.watchCommand(cmd)
+	default:
+		resp = ephemeral("I don't know how to handle " + cmd.Command)
+	}
+	c.JSON(http.StatusOK, resp)
+}
+
+// ephemeral is a slash command response only the caller can see
+func ephemeral(text string) *slack.Msg {
+	return &slack.Msg{ResponseType: slack.ResponseTypeEphemeral, Text: text}
+}
+
+// inChannel is a slash command response the whole channel can see
+func inChannel(text string) *slack.Msg {
+	return &slack.Msg{ResponseType: slack.ResponseTypeInChannel, Text: text}
+}
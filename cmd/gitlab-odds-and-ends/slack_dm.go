@@ -0,0 +1,138 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/slack-go/slack/slackevents"
+	"github.com/xanzy/go-gitlab"
+)
+
+const (
+	DM_MY_REVIEWS = "my reviews"
+	DM_MY_MRS     = "my mrs"
+	DM_SNOOZE     = "snooze"
+)
+
+// dmHelp is the answer to DMs the bot doesn't understand
+const dmHelp = "I understand `my reviews` (open merge requests you're assigned or reviewing), `my mrs` (your own open merge " +
+	"requests and their approvals), `snooze <merge request link> [2d]` (no stale reminders about it for a while), and " +
+	"`preferences`, `dms on|off|digest` and `mute|unmute <group/project>` (how I DM you)"
+
+// directMessage answers a DM to the bot.  the slack app needs to subscribe to `message.im` events at `/slack/events`.
+// the sender's gitlab user comes from the users section of the config file, or their email address
+func (bot bot) directMessage(ev *slackevents.MessageEvent) {
+	if ev.ChannelType != "im" || ev.BotID != "" || ev.SubType != "" {
+		return
+	}
+	text := strings.TrimSpace(strings.ToLower(ev.Text))
+	var reply string
+	switch {
+	case text == DM_MY_REVIEWS:
+		reply = bot.dmMRs(ev.User, isReviewing, "you're not reviewing any open merge requests :tada:")
+	case text == DM_MY_MRS:
+		reply = bot.dmMRs(ev.User, isAuthor, "you don't have any open merge requests")
+	case text == DM_SNOOZE || strings.HasPrefix(text, DM_SNOOZE+" "):
+		reply = bot.dmSnooze(ev.User, strings.Fields(ev.Text)[1:])
+	case text == DM_PREFERENCES, strings.HasPrefix(text, DM_DMS+" "), strings.HasPrefix(text, DM_MUTE+" "), strings.HasPrefix(text, DM_UNMUTE+" "):
+		reply = bot.dmPreferences(ev.User, strings.Fields(ev.Text))
+	default:
+		reply = dmHelp
+	}
+	if _, err := bot.notifier.Notify(ev.Channel, reply); err != nil {
+		logrus.WithError(err).Errorf("failed to answer DM from %s", ev.User)
+	}
+}
+
+// isReviewing reports whether the user is the MR's assignee or one of its reviewers
+func isReviewing(mr *gitlab.MergeRequest, user *gitlab.User) bool {
+	if mr.Assignee != nil && mr.Assignee.ID == user.ID {
+		return true
+	}
+	for _, r := range mr.Reviewers {
+		if r.ID == user.ID {
+			return true
+		}
+	}
+	return false
+}
+
+func isAuthor(mr *gitlab.MergeRequest, user *gitlab.User) bool {
+	return mr.Author != nil && mr.Author.ID == user.ID
+}
+
+// dmMRs lists the routed projects' open MRs that match the slack user, with their approvals
+func (bot bot) dmMRs(slackID string, match func(*gitlab.MergeRequest, *gitlab.User) bool, none string) string {
+	user, err := bot.users.gitlabUser(slackID)
+	if err != nil {
+		return fmt.Sprintf("I don't know who you are on gitlab: %v", err)
+	}
+	var projects []string
+	for p := range bot.routes.all() {
+		projects = append(projects, p)
+	}
+	sort.Strings(projects)
+
+	var lines []string
+	for _, project := range projects {
+		id, err := bot.routes.projectID(bot.gl, project)
+		if err != nil {
+			logrus.WithError(err).Errorf("failed to look up %s", project)
+			continue
+		}
+		opt := &gitlab.ListProjectMergeRequestsOptions{ListOptions: gitlab.ListOptions{PerPage: 100}, State: gitlab.String("opened")}
+		for {
+			mrs, resp, err := bot.gl.ListProjectMergeRequests(id, opt)
+			if err != nil {
+				logrus.WithError(err).Errorf("failed to list merge requests for %s", project)
+				lines = append(lines, fmt.Sprintf("• *%s*: couldn't list merge requests", project))
+				break
+			}
+			for _, mr := range mrs {
+				if match(mr, user) {
+					lines = append(lines, fmt.Sprintf("• *%s* %s — %s, %s old, %s", project, mrLink(mr), assigneeName(mr), age(mr.CreatedAt), bot.approvalSummary(id, mr.IID)))
+				}
+			}
+			if resp.NextPage == 0 {
+				break
+			}
+			opt.Page = resp.NextPage
+		}
+	}
+	if len(lines) == 0 {
+		return none
+	}
+	return strings.Join(lines, "\n")
+}
+
+// dmSnooze handles `snooze <merge request link> [delay]`, holding off the MR's stale reminders for the user for the
+// delay, or SNOOZE_DURATION without one
+func (bot bot) dmSnooze(slackID string, args []string) string {
+	if len(args) == 0 || len(args) > 2 {
+		return "usage: `snooze <merge request link> [2d]`"
+	}
+	// slack sends links as `<url>` or `<url|text>`
+	link, ok := parseGitlabLink(strings.SplitN(strings.Trim(args[0], "<>"), "|", 2)[0])
+	if !ok || link.kind != "merge_requests" {
+		return fmt.Sprintf("%s isn't a merge request link", args[0])
+	}
+	projectID, err := bot.routes.projectID(bot.gl, link.project)
+	if err != nil {
+		return fmt.Sprintf("I couldn't find %s on gitlab", link.project)
+	}
+	ref := mrRef(projectID, link.iid)
+	var until time.Time
+	if len(args) == 2 {
+		d, err := parseReminderDelay(args[1])
+		if err != nil {
+			return err.Error()
+		}
+		until = bot.snoozes.snoozeFor(ref, slackID, "", d)
+	} else {
+		until = bot.snoozes.snooze(ref, slackID, "")
+	}
+	return fmt.Sprintf("snoozed %s!%d until %s", link.project, link.iid, until.Format(time.RFC1123))
+}
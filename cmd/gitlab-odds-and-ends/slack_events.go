@@ -0,0 +1,50 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+	"github.com/slack-go/slack/slackevents"
+)
+
+// slackEventsRouter receives slack's events API callbacks.  point the slack app's event subscription request URL at `/slack/events`
+func (bot bot) slackEventsRouter(c *gin.Context) {
+	b, err := ioutil.ReadAll(c.Request.Body)
+	if err != nil {
+		logrus.WithError(err).Error("Failed to read slack event body")
+		http.Error(c.Writer, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+
+	event, err := slackevents.ParseEvent(json.RawMessage(b), slackevents.OptionNoVerifyToken())
+	if err != nil {
+		logrus.WithError(err).Error("Failed to parse slack event")
+		http.Error(c.Writer, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+
+	switch event.Type {
+	case slackevents.URLVerification:
+		var challenge slackevents.ChallengeResponse
+		if err := json.Unmarshal(b, &challenge); err != nil {
+			http.Error(c.Writer, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+			return
+		}
+		c.String(http.StatusOK, challenge.Challenge)
+	case slackevents.CallbackEvent:
+		c.Writer.WriteHeader(http.StatusOK)
+		switch ev := event.InnerEvent.Data.(type) {
+		case *slackevents.LinkSharedEvent:
+			go bot.unfurl(ev)
+		case *slackevents.MessageEvent:
+			go bot.triggeredBy("slack:" + ev.User + " DM").directMessage(ev)
+		default:
+			logrus.Debugf("Not handling slack event '%s'", event.InnerEvent.Type)
+		}
+	default:
+		c.Writer.WriteHeader(http.StatusOK)
+	}
+}
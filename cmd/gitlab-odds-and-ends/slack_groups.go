@@ -0,0 +1,42 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/sirupsen/logrus"
+	"github.com/xanzy/go-gitlab"
+)
+
+// slackGroupFor is the slack user group standing in for the project's maintainers: the project's own slack_group, or
+// its policy's.  empty if neither has one
+func (bot bot) slackGroupFor(project string, policy policyConfig) string {
+	if group := bot.projects[project].SlackGroup; group != "" {
+		return group
+	}
+	return policy.SlackGroup
+}
+
+// slackGroupMention mentions the user group, which notifies everyone in it
+func slackGroupMention(group string) string {
+	return fmt.Sprintf("<!subteam^%s>", group)
+}
+
+// askSlackGroup asks the project's maintainer group for the reviewers ensureTotalMaintainers couldn't find
+func (bot bot) askSlackGroup(mr *gitlab.MergeEvent, policy policyConfig, short int, slackChans []string) {
+	group := bot.slackGroupFor(mr.Project.PathWithNamespace, policy)
+	if group == "" {
+		return
+	}
+	bot.notifyThreadLocalized(mr.Project.ID, mr.ObjectAttributes.IID, tr("%s <%s|!%d> still needs %s and nobody else is available to tag, can one of you take a look?",
+		slackGroupMention(group), mr.ObjectAttributes.URL, mr.ObjectAttributes.IID, plural(short, "reviewer")), slackChans)
+}
+
+// escalationGroup is the maintainer group to mention in a review SLA escalation, if the MR's project has one
+func (bot bot) escalationGroup(mr *gitlab.MergeRequest, policy policyConfig) string {
+	project, err := bot.gl.GetProject(mr.ProjectID)
+	if err != nil {
+		logrus.WithError(err).Errorf("failed to look up project %d to find its maintainer group", mr.ProjectID)
+		return policy.SlackGroup
+	}
+	return bot.slackGroupFor(project.PathWithNamespace, policy)
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+	"github.com/slack-go/slack"
+)
+
+const (
+	SLACK_SIGNING_SECRET_ENV_VAR = "SLACK_SIGNING_SECRET"
+	ACTION_REVERT_MR             = "revert_mr"
+)
+
+// mrRef packs a project/MR pair into a button value, see parseMRRef
+func mrRef(projectID, iid int) string {
+	return fmt.Sprintf("%d:%d", projectID, iid)
+}
+
+// parseMRRef unpacks a button value created with mrRef
+func parseMRRef(ref string) (projectID, iid int, err error) {
+	_, err = fmt.Sscanf(ref, "%d:%d", &projectID, &iid)
+	return projectID, iid, err
+}
+
+// slackInteractiveRouter receives button clicks, shortcuts and modal submissions from slack.
+// enable interactivity on the slack app and point its request URL at `/slack/interactive`.  the "Create GitLab issue"
+// message shortcut needs the callback ID `create_gitlab_issue`
+func (bot bot) slackInteractiveRouter(c *gin.Context) {
+	b, err := ioutil.ReadAll(c.Request.Body)
+	if err != nil {
+		logrus.WithError(err).Error("Failed to read slack interaction body")
+		http.Error(c.Writer, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+
+	form, err := url.ParseQuery(string(b))
+	if err != nil {
+		logrus.WithError(err).Error("Failed to parse slack interaction form")
+		http.Error(c.Writer, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+	var callback slack.InteractionCallback
+	if err := json.Unmarshal([]byte(form.Get("payload")), &callback); err != nil {
+		logrus.WithError(err).Error("Failed to parse slack interaction payload")
+		http.Error(c.Writer, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+
+	// slack wants an answer within 3 seconds, so acknowledge now and do the work in the background
+	c.Writer.WriteHeader(http.StatusOK)
+	switch callback.Type {
+	case slack.InteractionTypeBlockActions:
+	case slack.InteractionTypeMessageAction:
+		if callback.CallbackID == CALLBACK_CREATE_ISSUE {
+			go bot.openIssueModal(callback)
+		}
+		return
+	case slack.InteractionTypeViewSubmission:
+		if callback.View.CallbackID == CALLBACK_CREATE_ISSUE {
+			go bot.createIssue(callback)
+		}
+		return
+	default:
+		logrus.Debugf("Not handling slack interaction of type '%s'", callback.Type)
+		return
+	}
+
+	for _, action := range callback.ActionCallback.BlockActions {
+		// buttons about MRs on another gitlab instance are handled by that instance's bot
+		target, value := bot.instances.forValue(action.Value)
+		target = target.triggeredBy(fmt.Sprintf("slack:%s %s", callback.User.ID, action.ActionID))
+		switch action.ActionID {
+		case ACTION_REVERT_MR:
+			go target.revertMergeRequest(value, callback.Channel.ID, callback.User.ID)
+		case ACTION_ASSIGN_TO_ME:
+			go target.claimMergeRequest(value, callback)
+		case ACTION_APPROVE_MR:
+			go target.approveMergeRequest(value, callback)
+		case ACTION_SNOOZE_MR:
+			go target.snoozeMergeRequest(value, callback)
+		case ACTION_SIGN_OFF_RC:
+			go target.signOffRelease(value, callback)
+		default:
+			logrus.Warnf("Not handling unknown slack action '%s'", action.ActionID)
+		}
+	}
+}
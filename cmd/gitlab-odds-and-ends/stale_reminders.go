@@ -0,0 +1,206 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/xanzy/go-gitlab"
+)
+
+const (
+	STALE_MR_REMINDER_AFTER_ENV_VAR = "STALE_MR_REMINDER_AFTER"
+	STALE_MR_SCAN_INTERVAL_ENV_VAR  = "STALE_MR_SCAN_INTERVAL"
+	STALE_MR_DM_ASSIGNEE_ENV_VAR    = "STALE_MR_DM_ASSIGNEE"
+	DEFAULT_STALE_MR_SCAN_INTERVAL  = time.Hour
+)
+
+// staleReminders nags about announced MRs that nobody has reviewed in a while.  each reminder waits twice as long as the
+// last and is louder: first the thread, then the thread and the assignee's DMs, then the whole channel
+type staleReminders struct {
+	after    time.Duration
+	dm       bool
+	mu       sync.Mutex
+	reminded map[string]staleState // keyed by mrRef
+}
+
+type staleState struct {
+	activity time.Time // review activity the reminders were counted from
+	level    int       // reminders sent since
+	finished bool      // merged or closed, stop looking at it
+}
+
+func newStaleReminders(after time.Duration, dm bool) *staleReminders {
+	return &staleReminders{after: after, dm: dm, reminded: make(map[string]staleState)}
+}
+
+// staleRemindersFromEnv configures the reminders, returning nil when they're disabled
+func staleRemindersFromEnv() *staleReminders {
+	after, err := time.ParseDuration(os.Getenv(STALE_MR_REMINDER_AFTER_ENV_VAR))
+	if err != nil || after <= 0 {
+		return nil
+	}
+	dm, _ := strconv.ParseBool(os.Getenv(STALE_MR_DM_ASSIGNEE_ENV_VAR))
+	return newStaleReminders(after, dm)
+}
+
+// due returns which reminder (1, 2, 3...) the MR has earned if one is due, or 0.  the MR's reminders start over when it
+// sees new review activity
+func (s *staleReminders) due(ref string, activity time.Time) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	state := s.reminded[ref]
+	if state.finished {
+		return 0
+	}
+	if !state.activity.Equal(activity) {
+		state = staleState{activity: activity}
+	}
+	// the nth reminder is due after (2^n - 1) * after of silence: 1x, 3x, 7x, ...
+	next := state.level + 1
+	if time.Since(activity) < time.Duration(1<<uint(next)-1)*s.after {
+		s.reminded[ref] = state
+		return 0
+	}
+	state.level = next
+	s.reminded[ref] = state
+	return next
+}
+
+func (s *staleReminders) finish(ref string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.reminded[ref] = staleState{finished: true}
+}
+
+func (s *staleReminders) isFinished(ref string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.reminded[ref].finished
+}
+
+// isReviewNote reports whether the note is someone other than the author commenting on or approving the MR
+func isReviewNote(mr *gitlab.MergeRequest, note *gitlab.Note) bool {
+	if note.CreatedAt == nil || (mr.Author != nil && note.Author.ID == mr.Author.ID) {
+		return false
+	}
+	// pushes, label changes and the like aren't reviews
+	return !note.System || note.Body == NOTE_APPROVED
+}
+
+// lastReviewActivity is when someone other than the author last commented on or approved the MR, or when it was opened
+func lastReviewActivity(gl GitLabAPI, mr *gitlab.MergeRequest) (time.Time, error) {
+	notes, _, err := gl.ListMergeRequestNotes(mr.ProjectID, mr.IID, &gitlab.ListMergeRequestNotesOptions{
+		ListOptions: gitlab.ListOptions{PerPage: 100},
+		OrderBy:     gitlab.String("created_at"),
+		Sort:        gitlab.String("desc"),
+	})
+	if err != nil {
+		return time.Time{}, err
+	}
+	for _, note := range notes {
+		if isReviewNote(mr, note) {
+			return *note.CreatedAt, nil
+		}
+	}
+	if mr.CreatedAt == nil {
+		return time.Time{}, fmt.Errorf("merge request !%d has no creation time", mr.IID)
+	}
+	return *mr.CreatedAt, nil
+}
+
+// remindStale scans the MRs we've announced for ones waiting on review
+func (bot bot) remindStale() {
+	for _, ref := range bot.threads.refs() {
+		if bot.stale.isFinished(ref) {
+			continue
+		}
+		projectID, iid, err := parseMRRef(ref)
+		if err != nil {
+			continue
+		}
+		mr, err := bot.gl.GetMergeRequest(projectID, iid)
+		if err != nil {
+			logrus.WithError(err).Errorf("failed to look up merge request !%d for stale reminders", iid)
+			continue
+		}
+		if mr.State != "opened" {
+			bot.stale.finish(ref)
+			continue
+		}
+		if mr.WorkInProgress || bot.snoozedByReviewers(ref, mr) {
+			continue
+		}
+		activity, err := lastReviewActivity(bot.gl, mr)
+		if err != nil {
+			logrus.WithError(err).Errorf("failed to find review activity on merge request !%d", iid)
+			continue
+		}
+		if level := bot.stale.due(ref, activity); level > 0 {
+			bot.remind(mr, activity, level)
+		}
+	}
+}
+
+// snoozedByReviewers reports whether everyone the MR's reminders are for has it snoozed: its assignees and reviewers
+// who are known on slack, or, when none are, anyone
+func (bot bot) snoozedByReviewers(ref string, mr *gitlab.MergeRequest) bool {
+	snoozers := bot.snoozes.snoozers(ref)
+	if len(snoozers) == 0 {
+		return false
+	}
+	for _, u := range append(append([]*gitlab.BasicUser{mr.Assignee}, mr.Assignees...), mr.Reviewers...) {
+		if u == nil {
+			continue
+		}
+		slackID, err := bot.users.slackUser(u.Username)
+		if err != nil {
+			continue
+		}
+		if !snoozers[slackID] {
+			return false
+		}
+	}
+	return true
+}
+
+// remind sends the MR's level-th stale reminder
+func (bot bot) remind(mr *gitlab.MergeRequest, activity time.Time, level int) {
+	waiting := time.Since(activity).Round(time.Hour)
+	msg := tr(":hourglass: <%s|!%d %s> hasn't been reviewed in %s.", mr.WebURL, mr.IID, mr.Title, waiting)
+	bot.notifyThreadLocalized(mr.ProjectID, mr.IID, msg, nil)
+
+	if level >= 2 && bot.stale.dm && mr.Assignee != nil && !bot.snoozedBy(mr, mr.Assignee.Username) {
+		link, _ := parseGitlabLink(mr.WebURL)
+		bot.dmReviewer(link.project, mr, mr.Assignee.Username, bot.locales.render("", tr("%s  You're the assignee, please take a look.", msg)))
+	}
+	if level >= 3 {
+		var channels []string
+		for _, m := range bot.threads.get(mrRef(mr.ProjectID, mr.IID)) {
+			channels = append(channels, m.Channel)
+		}
+		bot.notifyLocalized(tr("%s  Can someone pick it up?", msg), dedupe(channels))
+	}
+}
+
+// snoozedBy reports whether the gitlab user has the MR snoozed
+func (bot bot) snoozedBy(mr *gitlab.MergeRequest, username string) bool {
+	slackID, err := bot.users.slackUser(username)
+	return err == nil && bot.snoozes.isSnoozed(mrRef(mr.ProjectID, mr.IID), slackID)
+}
+
+// dedupe returns the strings in order, without repeats
+func dedupe(in []string) []string {
+	seen := make(map[string]bool)
+	var out []string
+	for _, s := range in {
+		if !seen[s] {
+			seen[s] = true
+			out = append(out, s)
+		}
+	}
+	return out
+}
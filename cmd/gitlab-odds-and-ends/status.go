@@ -0,0 +1,232 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/slack-go/slack"
+)
+
+const (
+	SLACK_COMMAND_BOT_STATUS = "/bot-status"
+	// TOKEN_EXPIRY_WARNING is how soon a token's expiry gets called out
+	TOKEN_EXPIRY_WARNING = 14 * 24 * time.Hour
+	// RECENT_WEBHOOKS is how many webhooks the dashboard and `/debug/events` remember, DEFAULT_RECENT_WEBHOOKS by default
+	RECENT_WEBHOOKS_ENV_VAR = "RECENT_WEBHOOKS"
+	DEFAULT_RECENT_WEBHOOKS = 100
+	// RECENT_ASSIGNMENTS is how many assignments the dashboard remembers per project
+	RECENT_ASSIGNMENTS = 10
+)
+
+// projectEvent is the last webhook a project sent
+type projectEvent struct {
+	kind string
+	at   time.Time
+}
+
+// what became of a webhook, see webhookDelivery
+const (
+	DELIVERY_HANDLED = "handled"
+	DELIVERY_IGNORED = "ignored"
+	DELIVERY_ERROR   = "error"
+)
+
+// webhookDelivery is a webhook as the dashboard shows it: where it was routed, or why it wasn't handled
+type webhookDelivery struct {
+	At       time.Time `json:"at"`
+	Instance string    `json:"instance,omitempty"`
+	Project  string    `json:"project,omitempty"`
+	Kind     string    `json:"kind"`
+	// Event is what happened, e.g. to which MR, see webhookTrigger
+	Event    string   `json:"event,omitempty"`
+	Channels []string `json:"channels,omitempty"`
+	// Result is DELIVERY_HANDLED, DELIVERY_IGNORED or DELIVERY_ERROR, and Outcome says why
+	Result  string `json:"result"`
+	Outcome string `json:"outcome"`
+}
+
+// assignment is a maintainer picked for an MR
+type assignment struct {
+	At       time.Time
+	IID      int
+	Reviewer string
+}
+
+// botStatus keeps the numbers `/bot-status` reports, so people can tell whether the bot is alive without server access,
+// and what the dashboard shows
+type botStatus struct {
+	started time.Time
+	// inFlight is how many webhooks are being handled right now
+	inFlight int64
+	mu       sync.Mutex
+	events   map[string]projectEvent
+	failures map[string]int
+	// recent are the latest webhooks, oldest first, at most keep of them
+	recent []webhookDelivery
+	keep   int
+	// assignments are each project's latest assignments, oldest first
+	assignments map[string][]assignment
+}
+
+func newBotStatus() *botStatus {
+	keep, err := strconv.Atoi(os.Getenv(RECENT_WEBHOOKS_ENV_VAR))
+	if err != nil || keep <= 0 {
+		keep = DEFAULT_RECENT_WEBHOOKS
+	}
+	return &botStatus{
+		started:     time.Now(),
+		events:      make(map[string]projectEvent),
+		failures:    make(map[string]int),
+		keep:        keep,
+		assignments: make(map[string][]assignment),
+	}
+}
+
+// handling counts a webhook as in flight until the returned func is called
+func (s *botStatus) handling() func() {
+	atomic.AddInt64(&s.inFlight, 1)
+	return func() { atomic.AddInt64(&s.inFlight, -1) }
+}
+
+// event records the project's latest webhook
+func (s *botStatus) event(project, kind string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.events[project] = projectEvent{kind: kind, at: time.Now()}
+}
+
+// delivered remembers a webhook for the dashboard and `/debug/events`
+func (s *botStatus) delivered(d webhookDelivery) {
+	if d.At.IsZero() {
+		d.At = time.Now()
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.recent = append(s.recent, d)
+	if len(s.recent) > s.keep {
+		s.recent = s.recent[len(s.recent)-s.keep:]
+	}
+}
+
+// deliveries are the latest webhooks, newest first
+func (s *botStatus) deliveries() []webhookDelivery {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	recent := make([]webhookDelivery, 0, len(s.recent))
+	for i := len(s.recent) - 1; i >= 0; i-- {
+		recent = append(recent, s.recent[i])
+	}
+	return recent
+}
+
+// debugEventsRouter serves `GET /debug/events` on the admin listener: the latest webhooks, newest first, with what
+// became of them, for working out why one did nothing.  `project`, `result` (handled, ignored or error) and `limit`
+// narrow them down
+func (bot bot) debugEventsRouter(c *gin.Context) {
+	limit := 0
+	if raw := c.Query("limit"); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil || n <= 0 {
+			http.Error(c.Writer, fmt.Sprintf("invalid limit '%s'", raw), http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+	project, result := c.Query("project"), c.Query("result")
+	found := []webhookDelivery{}
+	for _, d := range bot.status.deliveries() {
+		if (project == "" || d.Project == project) && (result == "" || d.Result == result) {
+			found = append(found, d)
+		}
+		if limit > 0 && len(found) == limit {
+			break
+		}
+	}
+	c.JSON(http.StatusOK, found)
+}
+
+// assigned remembers who the project's MR was given to, so the dashboard can show how reviews are being spread
+func (s *botStatus) assigned(project string, iid int, reviewer string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	recent := append(s.assignments[project], assignment{At: time.Now(), IID: iid, Reviewer: reviewer})
+	if len(recent) > RECENT_ASSIGNMENTS {
+		recent = recent[len(recent)-RECENT_ASSIGNMENTS:]
+	}
+	s.assignments[project] = recent
+}
+
+// fail counts a failure of the kind, e.g. `slack message`
+func (s *botStatus) fail(kind string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.failures[kind]++
+}
+
+// botStatusCommand handles `/bot-status`, answering only the caller
+func (bot bot) botStatusCommand(cmd slack.SlashCommand) *slack.Msg {
+	s := bot.status
+	lines := []string{
+		fmt.Sprintf("*Up* %s, since %s", time.Since(s.started).Round(time.Second), s.started.Format(time.RFC1123)),
+		fmt.Sprintf("*Webhooks in flight*: %d", atomic.LoadInt64(&s.inFlight)),
+	}
+
+	s.mu.Lock()
+	var projects []string
+	for p := range s.events {
+		projects = append(projects, p)
+	}
+	sort.Strings(projects)
+	lines = append(lines, "*Last event per project*:")
+	for _, p := range projects {
+		ev := s.events[p]
+		lines = append(lines, fmt.Sprintf("• `%s`: %s, %s ago", p, ev.kind, time.Since(ev.at).Round(time.Second)))
+	}
+	if len(projects) == 0 {
+		lines = append(lines, "• nothing since startup")
+	}
+	var kinds []string
+	for k := range s.failures {
+		kinds = append(kinds, k)
+	}
+	sort.Strings(kinds)
+	var failures []string
+	for _, k := range kinds {
+		failures = append(failures, fmt.Sprintf("%s: %d", k, s.failures[k]))
+	}
+	s.mu.Unlock()
+	if len(failures) == 0 {
+		failures = []string{"none"}
+	}
+	lines = append(lines, "*Failures since startup*: "+strings.Join(failures, ", "))
+
+	lines = append(lines, "*GitLab token*: "+bot.gitlabTokenStatus())
+	return ephemeral(strings.Join(lines, "\n"))
+}
+
+// gitlabTokenStatus estimates when the gitlab token expires.  only personal, project and group access tokens can tell us
+func (bot bot) gitlabTokenStatus() string {
+	expires, err := bot.gl.TokenExpiry()
+	if err != nil {
+		return fmt.Sprintf("couldn't check (%v)", err)
+	}
+	if expires == nil {
+		return "doesn't expire"
+	}
+	left := time.Until(*expires)
+	switch {
+	case left <= 0:
+		return fmt.Sprintf(":rotating_light: expired on %s", expires.Format("Jan 2, 2006"))
+	case left < TOKEN_EXPIRY_WARNING:
+		return fmt.Sprintf(":warning: expires in %d days, on %s", int(left.Hours()/24), expires.Format("Jan 2, 2006"))
+	}
+	return fmt.Sprintf("expires in %d days, on %s", int(left.Hours()/24), expires.Format("Jan 2, 2006"))
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/raidancampbell/gitlab-odds-and-ends/internal/webhook"
+	"github.com/sirupsen/logrus"
+	"github.com/xanzy/go-gitlab"
+)
+
+const (
+	SYSTEM_HOOK_SECRET_ENV_VAR = "GITLAB_SYSTEM_HOOK_SECRET"
+	HEADER_GITLAB_SYSTEM_EVENT = "System Hook"
+)
+
+// the system hook events announced when the config doesn't list any
+var defaultSystemEvents = []string{"project_create", "project_destroy", "project_rename", "project_transfer", "user_add_to_team", "user_remove_from_team"}
+
+// systemHooksConfig handles gitlab's instance-wide system hooks, at `/gitlab/system`.  adding a system hook needs an
+// admin, under Admin Area > System Hooks
+type systemHooksConfig struct {
+	// Channels get instance-level notifications
+	Channels []string `yaml:"channels"`
+	// Events are the system hook events (by gitlab's event_name, e.g. `project_create`) to tell Channels about.  see
+	// defaultSystemEvents for the default.  `repository_update` is every push to every project, so be careful
+	Events []string `yaml:"events"`
+	// Enroll adds the bot's webhook to newly created projects
+	Enroll enrollConfig `yaml:"enroll"`
+}
+
+type enrollConfig struct {
+	// URL is the bot's `/gitlab/callback` as gitlab reaches it, e.g. `https://bot.example.com/gitlab/callback`.  include
+	// a `slack-channel` query parameter to route the new projects there, otherwise default_routes decide
+	URL string `yaml:"url"`
+	// Namespaces limits enrollment to projects under these groups, e.g. `team-a` or `team-a/backend`.  empty is every
+	// new project
+	Namespaces []string `yaml:"namespaces"`
+}
+
+// systemHooks is what the bot does with system hook events
+type systemHooks struct {
+	cfg    systemHooksConfig
+	events map[string]bool
+	auth   *webhook.Auth
+}
+
+// newSystemHooks returns nil when there's nothing to do with system hooks
+func newSystemHooks(cfg systemHooksConfig, secret string) *systemHooks {
+	if len(cfg.Channels) == 0 && cfg.Enroll.URL == "" {
+		return nil
+	}
+	h := &systemHooks{cfg: cfg, events: make(map[string]bool)}
+	events := cfg.Events
+	if len(events) == 0 {
+		events = defaultSystemEvents
+	}
+	for _, e := range events {
+		h.events[e] = true
+	}
+	if secret != "" {
+		h.auth = &webhook.Auth{Secret: secret, Window: webhook.DEFAULT_REPLAY_WINDOW, Skew: webhook.DEFAULT_CLOCK_SKEW}
+	} else {
+		logrus.Warn("no gitlab system hook secret set, anyone who can reach /gitlab/system can send events")
+	}
+	return h
+}
+
+// enrolls reports whether a new project at the path gets the bot's webhook
+func (h *systemHooks) enrolls(path string) bool {
+	if h.cfg.Enroll.URL == "" {
+		return false
+	}
+	if len(h.cfg.Enroll.Namespaces) == 0 {
+		return true
+	}
+	for _, ns := range h.cfg.Enroll.Namespaces {
+		if strings.HasPrefix(path, strings.TrimSuffix(ns, "/")+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// repositoryUpdate is the parts of a repository_update event go-gitlab doesn't decode
+type repositoryUpdate struct {
+	UserName string `json:"user_name"`
+	Project  struct {
+		PathWithNamespace string `json:"path_with_namespace"`
+	} `json:"project"`
+	Changes []struct {
+		Ref string `json:"ref"`
+	} `json:"changes"`
+}
+
+// gitlabSystemRouter receives gitlab's system hooks.  the system hook's secret token goes in GITLAB_SYSTEM_HOOK_SECRET
+func (bot bot) gitlabSystemRouter(c *gin.Context) {
+	defer bot.status.handling()()
+	b, err := ioutil.ReadAll(c.Request.Body)
+	if err != nil {
+		logrus.Errorf("Failed to read request body '%v'", err)
+		http.Error(c.Writer, http.StatusText(http.StatusOK), http.StatusOK)
+		return
+	}
+	if bot.archive != nil {
+		bot.archive.save(bot.instance, c.Request, b, bot.status)
+	}
+
+	event, err := gitlab.ParseSystemhook(b)
+	if err != nil {
+		logrus.WithError(err).Error("Failed to parse gitlab system hook")
+		bot.status.fail("unparseable webhook")
+		http.Error(c.Writer, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+	c.Writer.WriteHeader(http.StatusOK)
+	switch ev := event.(type) {
+	case *gitlab.ProjectSystemEvent:
+		bot.status.event(ev.PathWithNamespace, HEADER_GITLAB_SYSTEM_EVENT)
+		bot.projectSystemEvent(ev)
+	case *gitlab.UserTeamSystemEvent:
+		bot.status.event(ev.ProjectPathWithNamespace, HEADER_GITLAB_SYSTEM_EVENT)
+		bot.systemNotify(ev.EventName, tr("%s (@%s) was %s `%s` as %s", ev.Name, ev.Username, membership(ev.EventName), ev.ProjectPathWithNamespace, ev.AccessLevel))
+	case *gitlab.RepositoryUpdateSystemEvent:
+		var update repositoryUpdate
+		if err := json.Unmarshal(b, &update); err != nil || !bot.systemHooks.events[ev.EventName] {
+			return
+		}
+		var refs []string
+		for _, change := range update.Changes {
+			refs = append(refs, "`"+strings.TrimPrefix(change.Ref, "refs/heads/")+"`")
+		}
+		bot.status.event(update.Project.PathWithNamespace, HEADER_GITLAB_SYSTEM_EVENT)
+		bot.systemNotify(ev.EventName, tr("%s pushed to %s in `%s`", update.UserName, strings.Join(refs, ", "), update.Project.PathWithNamespace))
+	case *gitlab.GroupSystemEvent:
+		bot.systemNotify(ev.EventName, tr("gitlab `%s`: group `%s`", ev.EventName, ev.PathWithNamespace))
+	case *gitlab.UserSystemEvent:
+		bot.systemNotify(ev.EventName, tr("gitlab `%s`: user %s (@%s)", ev.EventName, ev.Name, ev.Username))
+	default:
+		logrus.Debugf("Not handling system hook %T", event)
+	}
+}
+
+// membership describes a user_*_team event
+func membership(event string) string {
+	switch event {
+	case "user_add_to_team":
+		return "added to"
+	case "user_remove_from_team":
+		return "removed from"
+	}
+	return "changed in"
+}
+
+// systemNotify tells the system hook channels about the event, if they want to hear about it
+func (bot bot) systemNotify(event string, msg localized) {
+	if bot.systemHooks.events[event] {
+		bot.notifyLocalized(msg, bot.systemHooks.cfg.Channels)
+	}
+}
+
+// projectSystemEvent announces project changes, and enrolls new projects
+func (bot bot) projectSystemEvent(ev *gitlab.ProjectSystemEvent) {
+	switch ev.EventName {
+	case "project_create":
+		enrolled := ""
+		if bot.systemHooks.enrolls(ev.PathWithNamespace) {
+			if err := bot.enroll(ev.ProjectID, ev.PathWithNamespace, bot.systemHooks.cfg.Enroll.URL, "gitlab:system_hook"); err != nil {
+				logrus.WithError(err).Errorf("failed to enroll %s", ev.PathWithNamespace)
+				enrolled = "  I couldn't add my webhook to it: " + err.Error()
+			} else {
+				enrolled = "  I added my webhook to it."
+			}
+		}
+		bot.systemNotify(ev.EventName, tr(":new: %s created `%s`.%s", ev.OwnerName, ev.PathWithNamespace, enrolled))
+	case "project_destroy":
+		bot.systemNotify(ev.EventName, tr(":wastebasket: `%s` was deleted.", ev.PathWithNamespace))
+	case "project_rename", "project_transfer":
+		bot.systemNotify(ev.EventName, tr("`%s` moved to `%s`.", ev.OldPathWithNamespace, ev.PathWithNamespace))
+	default:
+		bot.systemNotify(ev.EventName, tr("gitlab `%s`: project `%s`", ev.EventName, ev.PathWithNamespace))
+	}
+}
+
+// enroll adds the bot's webhook at url to the project, with every event the bot handles
+func (bot bot) enroll(projectID int, path, url, actor string) error {
+	yes := true
+	opts := &gitlab.AddProjectHookOptions{
+		URL:                 &url,
+		MergeRequestsEvents: &yes,
+		PipelineEvents:      &yes,
+		DeploymentEvents:    &yes,
+		IssuesEvents:        &yes,
+		TagPushEvents:       &yes,
+		NoteEvents:          &yes,
+	}
+	if bot.webhookAuth != nil {
+		opts.Token = &bot.webhookAuth.Secret
+	}
+	if _, err := bot.gl.AddProjectHook(projectID, opts); err != nil {
+		return err
+	}
+	bot.audit.record(auditEntry{
+		Action:  "enroll_project",
+		Actor:   actor,
+		Target:  path,
+		Outcome: fmt.Sprintf("webhook added for %s", url),
+	})
+	return nil
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+
+	"github.com/sirupsen/logrus"
+	"github.com/xanzy/go-gitlab"
+)
+
+// compileTargetBranches checks every project's target branch globs up front, like compileLabelRules
+func compileTargetBranches(projects []projectConfig) (map[string][]*regexp.Regexp, error) {
+	branches := make(map[string][]*regexp.Regexp)
+	for _, p := range projects {
+		for _, glob := range p.TargetBranches {
+			re, err := compileGlob(glob, false) // branch globs match the whole name, `main` isn't `feature/main`
+			if err != nil {
+				return nil, fmt.Errorf("invalid target branch glob '%s' in %s: %v", glob, p.Project, err)
+			}
+			branches[p.Project] = append(branches[p.Project], re)
+		}
+	}
+	return branches, nil
+}
+
+// announcesTarget reports whether the MR's target branch is one its project assigns and announces MRs for.  projects
+// without target branches announce them all
+func (bot bot) announcesTarget(mr *gitlab.MergeEvent) bool {
+	branches := bot.targetBranches[mr.Project.PathWithNamespace]
+	if len(branches) == 0 {
+		return true
+	}
+	for _, re := range branches {
+		if re.MatchString(mr.ObjectAttributes.TargetBranch) {
+			return true
+		}
+	}
+	logrus.Debugf("not assigning or announcing merge request !%d in %s, %s isn't one of its target branches", mr.ObjectAttributes.IID, mr.Project.PathWithNamespace, mr.ObjectAttributes.TargetBranch)
+	return false
+}
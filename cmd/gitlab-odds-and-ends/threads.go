@@ -0,0 +1,131 @@
+package main
+
+import (
+	"sync"
+
+	"github.com/raidancampbell/gitlab-odds-and-ends/internal/store"
+	"github.com/sirupsen/logrus"
+)
+
+const THREADS_STORE_KEY = "threads"
+
+// slackMessage identifies a message the bot sent
+type slackMessage struct {
+	Channel   string
+	Timestamp string
+}
+
+// threads remembers the notification sent for each MR (keyed by mrRef), so follow-ups can be threaded under it.
+// issues linked to slack threads are tracked here too, keyed by issueRef.  they're kept in the store, so replicas
+// sharing it thread under each other's messages
+type threads struct {
+	store *store.Store
+
+	mu       sync.RWMutex
+	messages map[string][]slackMessage
+}
+
+func newThreads(s *store.Store) (*threads, error) {
+	t := &threads{store: s, messages: make(map[string][]slackMessage)}
+	if _, err := s.Load(THREADS_STORE_KEY, &t.messages); err != nil {
+		return nil, err
+	}
+	s.Follow(THREADS_STORE_KEY, &t.messages, &t.mu)
+	return t, nil
+}
+
+// record the MR's notification messages.  messages without a timestamp (i.e. never actually sent) are skipped
+func (t *threads) record(ref string, msgs []slackMessage) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	recorded := false
+	for _, m := range msgs {
+		if m.Timestamp != "" {
+			t.messages[ref] = append(t.messages[ref], m)
+			recorded = true
+		}
+	}
+	if !recorded {
+		return
+	}
+	if err := t.store.Save(THREADS_STORE_KEY, t.messages); err != nil {
+		logrus.WithError(err).Error("failed to persist slack threads")
+	}
+}
+
+// get the MR's notification messages, if any
+func (t *threads) get(ref string) []slackMessage {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return append([]slackMessage(nil), t.messages[ref]...)
+}
+
+// forget the MRs' notifications, e.g. a while after they were merged or closed
+func (t *threads) forget(refs ...string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, ref := range refs {
+		delete(t.messages, ref)
+	}
+	if err := t.store.Save(THREADS_STORE_KEY, t.messages); err != nil {
+		logrus.WithError(err).Error("failed to persist slack threads")
+	}
+}
+
+// refs lists every MR with a recorded notification
+func (t *threads) refs() []string {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	var refs []string
+	for ref := range t.messages {
+		refs = append(refs, ref)
+	}
+	return refs
+}
+
+const (
+	REACTION_APPROVED = "white_check_mark"
+	REACTION_MERGED   = "tada"
+	REACTION_CLOSED   = "no_entry_sign"
+)
+
+// react adds (or with remove, takes away) an emoji reaction on the MR's notification messages, so the channel can see
+// the MR's state at a glance
+func (bot bot) react(projectID, iid int, emoji string, remove bool) {
+	for _, m := range bot.threads.get(mrRef(projectID, iid)) {
+		var err error
+		if remove {
+			err = bot.notifier.Unreact(m.Channel, m.Timestamp, emoji)
+		} else {
+			err = bot.notifier.React(m.Channel, m.Timestamp, emoji)
+		}
+		if err != nil {
+			logrus.WithError(err).Errorf("failed to update :%s: reaction on message %s in channel %s", emoji, m.Timestamp, m.Channel)
+		}
+	}
+}
+
+// notifyThread replies to the MR's notification threads.  If the MR was never announced (or we've forgotten about it)
+// the message is sent to the fallback channels instead
+func (bot bot) notifyThread(projectID, iid int, msg string, fallbackChans []string) {
+	if bot.debounce != nil && len(bot.threads.get(mrRef(projectID, iid))) > 0 {
+		bot.debounce.add(bot, mrRef(projectID, iid), tr("%s", msg))
+		return
+	}
+	bot.replyThreads(mrRef(projectID, iid), msg, fallbackChans)
+}
+
+// replyThreads is notifyThread for any tracked thread, e.g. an issue's
+func (bot bot) replyThreads(ref string, msg string, fallbackChans []string) {
+	msgs := bot.threads.get(ref)
+	if len(msgs) == 0 {
+		bot.notify(msg, fallbackChans)
+		return
+	}
+	logrus.Info(msg)
+	for _, m := range msgs {
+		if _, err := bot.notifier.Reply(m.Channel, m.Timestamp, msg); err != nil {
+			logrus.WithError(err).Errorf("failed to reply to slack thread %s in channel %s", m.Timestamp, m.Channel)
+		}
+	}
+}
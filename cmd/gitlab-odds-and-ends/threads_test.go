@@ -0,0 +1,142 @@
+package main
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/raidancampbell/gitlab-odds-and-ends/internal/notify"
+	"github.com/raidancampbell/gitlab-odds-and-ends/internal/store"
+	"github.com/slack-go/slack"
+	"github.com/xanzy/go-gitlab"
+)
+
+// notifyingBot is a bot that sends its messages to the recorder, with in-memory state
+func notifyingBot(t *testing.T, rec *notify.Recorder) bot {
+	t.Helper()
+	s, err := store.Open("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	th, err := newThreads(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := newLocales(localesConfig{}, "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return bot{notifier: rec, threads: th, status: newBotStatus(), locales: l}
+}
+
+func TestNotifySkipsFailedChannels(t *testing.T) {
+	rec := &notify.Recorder{Fail: map[string]error{"#gone": errors.New("channel_not_found")}}
+	b := notifyingBot(t, rec)
+
+	sent := b.notify("hello", []string{"#one", "#gone", "#two"})
+
+	if len(sent) != 2 || sent[0].Channel != "#one" || sent[1].Channel != "#two" {
+		t.Errorf("notify() sent %+v, want #one and #two", sent)
+	}
+	if got := rec.Of(notify.KIND_NOTIFY); len(got) != 2 {
+		t.Errorf("recorded %+v, want 2 messages", got)
+	}
+}
+
+func TestReplyThreads(t *testing.T) {
+	tests := []struct {
+		name      string
+		announced []string // channels the MR was announced in
+		fallback  []string
+		want      []notify.Recorded
+	}{
+		{
+			name:      "announced MRs are replied to in their threads",
+			announced: []string{"#team"},
+			fallback:  []string{"#fallback"},
+			want:      []notify.Recorded{{Kind: notify.KIND_REPLY, Channel: "#team", TS: "1", Text: "pipeline failed"}},
+		},
+		{
+			name:      "every announcement gets the reply",
+			announced: []string{"#team", "#other"},
+			want: []notify.Recorded{
+				{Kind: notify.KIND_REPLY, Channel: "#team", TS: "1", Text: "pipeline failed"},
+				{Kind: notify.KIND_REPLY, Channel: "#other", TS: "2", Text: "pipeline failed"},
+			},
+		},
+		{
+			name:     "unannounced MRs go to the fallback channels",
+			fallback: []string{"#fallback"},
+			want:     []notify.Recorded{{Kind: notify.KIND_NOTIFY, Channel: "#fallback", TS: "1", Text: "pipeline failed"}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := &notify.Recorder{}
+			b := notifyingBot(t, rec)
+			ref := mrRef(1, 2)
+			b.threads.record(ref, b.notify("announcement", tt.announced))
+			rec.Reset()
+
+			b.replyThreads(ref, "pipeline failed", tt.fallback)
+
+			assertRecorded(t, rec, tt.want)
+		})
+	}
+}
+
+func TestReact(t *testing.T) {
+	rec := &notify.Recorder{}
+	b := notifyingBot(t, rec)
+	b.threads.record(mrRef(1, 2), b.notify("announcement", []string{"#team"}))
+	rec.Reset()
+
+	b.react(1, 2, REACTION_APPROVED, false)
+	b.react(1, 2, REACTION_APPROVED, true)
+	b.react(1, 3, REACTION_MERGED, false) // never announced
+
+	assertRecorded(t, rec, []notify.Recorded{
+		{Kind: notify.KIND_REACT, Channel: "#team", TS: "1", Text: REACTION_APPROVED},
+		{Kind: notify.KIND_UNREACT, Channel: "#team", TS: "1", Text: REACTION_APPROVED},
+	})
+}
+
+func TestNotifyMergedIsLocalized(t *testing.T) {
+	rec := &notify.Recorder{}
+	b := notifyingBot(t, rec)
+	b.slackSigningSecret = "secret" // for the revert button
+	b.locales.channels = map[string]string{"#team-de": "de"}
+	b.locales.catalogs = map[string]map[string]string{"de": {
+		"Merge request `%s` in `%s` has been merged.  See %s for details.": "Merge request `%s` in `%s` wurde gemerged.  Details: %s",
+	}}
+	mr := &gitlab.MergeEvent{}
+	mr.ObjectAttributes.Title = "Fix"
+	mr.ObjectAttributes.URL = "https://gitlab.example.com/team/app/-/merge_requests/2"
+	mr.ObjectAttributes.Target = &gitlab.Repository{Name: "app"}
+
+	b.notifyMerged(mr, []string{"#team", "#team-de"})
+
+	assertRecorded(t, rec, []notify.Recorded{
+		{Kind: notify.KIND_BLOCKS, Channel: "#team", TS: "1", Text: "Merge request `Fix` in `app` has been merged.  See https://gitlab.example.com/team/app/-/merge_requests/2 for details."},
+		{Kind: notify.KIND_BLOCKS, Channel: "#team-de", TS: "2", Text: "Merge request `Fix` in `app` wurde gemerged.  Details: https://gitlab.example.com/team/app/-/merge_requests/2"},
+	})
+	for _, r := range rec.Recorded() {
+		if section, ok := r.Blocks[0].(*slack.SectionBlock); !ok || section.Text.Text != r.Text {
+			t.Errorf("blocks in %s don't carry its message %q", r.Channel, r.Text)
+		}
+	}
+}
+
+// assertRecorded checks the recorder was asked to do exactly what's wanted, ignoring blocks
+func assertRecorded(t *testing.T, rec *notify.Recorder, want []notify.Recorded) {
+	t.Helper()
+	got := rec.Recorded()
+	if len(got) != len(want) {
+		t.Fatalf("recorded %+v, want %+v", got, want)
+	}
+	for i := range want {
+		g, w := got[i], want[i]
+		if g.Kind != w.Kind || g.Channel != w.Channel || g.TS != w.TS || g.Text != w.Text {
+			t.Errorf("recorded[%d] = %+v, want %+v", i, g, w)
+		}
+	}
+}
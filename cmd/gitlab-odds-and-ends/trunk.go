@@ -0,0 +1,135 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/raidancampbell/gitlab-odds-and-ends/internal/store"
+	"github.com/sirupsen/logrus"
+	"github.com/xanzy/go-gitlab"
+)
+
+const (
+	BROKEN_TRUNKS_STORE_KEY   = "broken_trunks"
+	TRUNK_PIPELINES_STORE_KEY = "trunk_pipelines"
+)
+
+// brokenTrunk is a default branch whose latest pipeline failed
+type brokenTrunk struct {
+	Branch   string         `json:"branch"`
+	Since    time.Time      `json:"since"`
+	SHA      string         `json:"sha"`      // the first commit that failed
+	Messages []slackMessage `json:"messages"` // the announcement, updates are threaded under it
+}
+
+// trunkHealth watches the pipelines of each project's default branch, keyed by project ID.  it's kept in the store,
+// so whichever replica hears the branch is green again replies to the announcement
+type trunkHealth struct {
+	store    *store.Store
+	mu       sync.Mutex
+	broken   map[int]*brokenTrunk
+	pipeline map[int]int // latest pipeline seen, so a slow old pipeline can't flip the state back
+}
+
+func newTrunkHealth(s *store.Store) (*trunkHealth, error) {
+	t := &trunkHealth{store: s, broken: make(map[int]*brokenTrunk), pipeline: make(map[int]int)}
+	if _, err := s.Load(BROKEN_TRUNKS_STORE_KEY, &t.broken); err != nil {
+		return nil, err
+	}
+	if _, err := s.Load(TRUNK_PIPELINES_STORE_KEY, &t.pipeline); err != nil {
+		return nil, err
+	}
+	s.Follow(BROKEN_TRUNKS_STORE_KEY, &t.broken, &t.mu)
+	s.Follow(TRUNK_PIPELINES_STORE_KEY, &t.pipeline, &t.mu)
+	return t, nil
+}
+
+// save persists the broken branches and latest pipelines.  callers hold mu
+func (t *trunkHealth) save() {
+	if err := t.store.Save(BROKEN_TRUNKS_STORE_KEY, t.broken); err != nil {
+		logrus.WithError(err).Error("failed to persist broken default branches")
+	}
+	if err := t.store.Save(TRUNK_PIPELINES_STORE_KEY, t.pipeline); err != nil {
+		logrus.WithError(err).Error("failed to persist default branch pipelines")
+	}
+}
+
+// isBroken reports whether the branch is the project's default branch and it's red
+func (t *trunkHealth) isBroken(projectID int, branch string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	b, ok := t.broken[projectID]
+	return ok && b.Branch == branch
+}
+
+// isTrunkPipeline reports whether the pipeline ran on the project's default branch
+func isTrunkPipeline(p *gitlab.PipelineEvent) bool {
+	return !p.ObjectAttributes.Tag && p.ObjectAttributes.Ref == p.Project.DefaultBranch
+}
+
+// watchTrunk follows a default branch pipeline: the first failure is announced with the breaking commit's author,
+// further failures are posted in its thread, and the thread hears when the branch is green again
+func (bot bot) watchTrunk(p *gitlab.PipelineEvent, slackChans []string) {
+	status := p.ObjectAttributes.Status
+	if status != PIPELINE_STATUS_FAILED && status != PIPELINE_STATUS_SUCCESS {
+		return
+	}
+	projectID := p.Project.ID
+	url := fmt.Sprintf("%s/-/pipelines/%d", p.Project.WebURL, p.ObjectAttributes.ID)
+	sha := p.ObjectAttributes.SHA
+	if len(sha) > 8 {
+		sha = sha[:8]
+	}
+
+	bot.trunk.mu.Lock()
+	if p.ObjectAttributes.ID < bot.trunk.pipeline[projectID] {
+		bot.trunk.mu.Unlock()
+		logrus.Debugf("ignoring pipeline %d, a newer one already ran on %s", p.ObjectAttributes.ID, p.ObjectAttributes.Ref)
+		return
+	}
+	bot.trunk.pipeline[projectID] = p.ObjectAttributes.ID
+	broken, wasBroken := bot.trunk.broken[projectID]
+	if status == PIPELINE_STATUS_SUCCESS {
+		delete(bot.trunk.broken, projectID)
+	}
+	bot.trunk.save()
+	bot.trunk.mu.Unlock()
+
+	bot = bot.critical(CRITICAL_TRUNK_BROKEN)
+	switch {
+	case status == PIPELINE_STATUS_SUCCESS && wasBroken:
+		bot.replyTrunk(broken, fmt.Sprintf(":large_green_circle: `%s` in `%s` is green again as of `%s` (<%s|pipeline>), after %s.  MRs targeting it can be merged.",
+			broken.Branch, p.Project.PathWithNamespace, sha, url, time.Since(broken.Since).Round(time.Minute)))
+	case status == PIPELINE_STATUS_FAILED && wasBroken:
+		bot.replyTrunk(broken, fmt.Sprintf(":red_circle: still red: `%s` (%s) failed too, <%s|pipeline>.", sha, firstLine(p.Commit.Message), url))
+	case status == PIPELINE_STATUS_FAILED:
+		author := p.Commit.Author.Name
+		if slackID, err := bot.users.slackUserByEmail(p.Commit.Author.Email); err == nil {
+			author = fmt.Sprintf("<@%s>", slackID)
+		}
+		msg := fmt.Sprintf(":red_circle: `%s` in `%s` is broken!  The <%s|pipeline> for `%s` (%s) by %s failed.  MRs targeting `%s` won't be marked ready to merge until it's fixed.",
+			p.ObjectAttributes.Ref, p.Project.PathWithNamespace, url, sha, firstLine(p.Commit.Message), author, p.ObjectAttributes.Ref)
+		sent := bot.notify(msg, slackChans)
+		bot.trunk.mu.Lock()
+		bot.trunk.broken[projectID] = &brokenTrunk{Branch: p.ObjectAttributes.Ref, Since: time.Now(), SHA: p.ObjectAttributes.SHA, Messages: sent}
+		bot.trunk.save()
+		bot.trunk.mu.Unlock()
+	}
+}
+
+// replyTrunk posts an update in the broken trunk announcement's threads
+func (bot bot) replyTrunk(broken *brokenTrunk, msg string) {
+	logrus.Info(msg)
+	for _, m := range broken.Messages {
+		if _, err := bot.notifier.Reply(m.Channel, m.Timestamp, msg); err != nil {
+			logrus.WithError(err).Errorf("failed to reply to slack thread %s in channel %s", m.Timestamp, m.Channel)
+		}
+	}
+}
+
+// firstLine is a commit message's subject
+func firstLine(msg string) string {
+	return strings.TrimSpace(strings.SplitN(msg, "\n", 2)[0])
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+	"github.com/slack-go/slack"
+	"github.com/slack-go/slack/slackevents"
+)
+
+// gitlabLink is a link to an MR or issue
+type gitlabLink struct {
+	project string
+	kind    string // merge_requests or issues
+	iid     int
+}
+
+// parseGitlabLink picks apart links like `https://gitlab/group/project/-/merge_requests/12`
+func parseGitlabLink(link string) (gitlabLink, bool) {
+	u, err := url.Parse(link)
+	if err != nil {
+		return gitlabLink{}, false
+	}
+	parts := strings.SplitN(strings.Trim(u.Path, "/"), "/-/", 2)
+	if len(parts) != 2 {
+		return gitlabLink{}, false
+	}
+	rest := strings.Split(parts[1], "/")
+	if len(rest) < 2 || (rest[0] != "merge_requests" && rest[0] != "issues") {
+		return gitlabLink{}, false
+	}
+	iid, err := strconv.Atoi(rest[1])
+	if err != nil {
+		return gitlabLink{}, false
+	}
+	return gitlabLink{project: parts[0], kind: rest[0], iid: iid}, true
+}
+
+// unfurl answers slack's link_shared event with previews of the gitlab MRs and issues in the message.
+// links are only unfurled in channels that at least one project is routed to.  register the gitlab domain under the
+// slack app's "App unfurl domains", and subscribe to the `link_shared` event
+func (bot bot) unfurl(ev *slackevents.LinkSharedEvent) {
+	if len(bot.routes.projectsFor(ev.Channel)) == 0 {
+		logrus.Debugf("not unfurling links in unenrolled channel %s", ev.Channel)
+		return
+	}
+
+	unfurls := make(map[string]slack.Attachment)
+	for _, link := range ev.Links {
+		parsed, ok := parseGitlabLink(link.URL)
+		if !ok {
+			continue
+		}
+		id, err := bot.routes.projectID(bot.gl, parsed.project)
+		if err != nil {
+			logrus.WithError(err).Errorf("failed to look up project %s to unfurl", parsed.project)
+			continue
+		}
+		var attachment slack.Attachment
+		if parsed.kind == "merge_requests" {
+			attachment, err = bot.unfurlMR(id, parsed.iid)
+		} else {
+			attachment, err = bot.unfurlIssue(id, parsed.iid)
+			if err == nil {
+				bot.linkIssue(id, parsed.iid, slackMessage{ev.Channel, threadRoot(ev)})
+			}
+		}
+		if err != nil {
+			logrus.WithError(err).Errorf("failed to unfurl %s", link.URL)
+			continue
+		}
+		attachment.TitleLink = link.URL
+		unfurls[link.URL] = attachment
+	}
+	if len(unfurls) == 0 {
+		return
+	}
+	if err := bot.notifier.Unfurl(ev.Channel, ev.MessageTimeStamp, unfurls); err != nil {
+		logrus.WithError(err).Error("failed to unfurl links")
+	}
+}
+
+func (bot bot) unfurlMR(projectID, iid int) (slack.Attachment, error) {
+	mr, err := bot.gl.GetMergeRequest(projectID, iid)
+	if err != nil {
+		return slack.Attachment{}, err
+	}
+	assignee := "unassigned"
+	if mr.Assignee != nil {
+		assignee = mr.Assignee.Name
+	}
+	approval := "unknown"
+	if approvals, err := bot.gl.GetMergeRequestApprovals(projectID, iid); err == nil {
+		approval = approvalStatus(approvals)
+	}
+	pipeline := "none"
+	if mr.HeadPipeline != nil {
+		pipeline = mr.HeadPipeline.Status
+	}
+	return slack.Attachment{
+		Title: fmt.Sprintf("!%d %s", mr.IID, mr.Title),
+		Fields: []slack.AttachmentField{
+			{Title: "State", Value: mr.State, Short: true},
+			{Title: "Assignee", Value: assignee, Short: true},
+			{Title: "Approvals", Value: approval, Short: true},
+			{Title: "Pipeline", Value: pipeline, Short: true},
+		},
+	}, nil
+}
+
+func (bot bot) unfurlIssue(projectID, iid int) (slack.Attachment, error) {
+	issue, err := bot.gl.GetIssue(projectID, iid)
+	if err != nil {
+		return slack.Attachment{}, err
+	}
+	assignee := "unassigned"
+	if issue.Assignee != nil {
+		assignee = issue.Assignee.Name
+	}
+	return slack.Attachment{
+		Title: fmt.Sprintf("#%d %s", issue.IID, issue.Title),
+		Fields: []slack.AttachmentField{
+			{Title: "State", Value: issue.State, Short: true},
+			{Title: "Assignee", Value: assignee, Short: true},
+		},
+	}, nil
+}
+
+// threadRoot is the timestamp of the thread the shared link is in, or the link's own message when it isn't in a thread
+func threadRoot(ev *slackevents.LinkSharedEvent) string {
+	if ev.ThreadTimeStamp != "" {
+		return ev.ThreadTimeStamp
+	}
+	return ev.MessageTimeStamp
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/xanzy/go-gitlab"
+)
+
+const (
+	RESPECT_USER_STATUS_ENV_VAR = "RESPECT_USER_STATUS"
+	OOO_STATUS_PATTERNS_ENV_VAR = "OOO_STATUS_PATTERNS"
+	DEFAULT_OOO_STATUS_PATTERNS = ":palm_tree:,vacation,holiday,out of office,ooo"
+	// USER_AVAILABILITY_BUSY is the availability of gitlab users who ticked "Busy" on their status
+	USER_AVAILABILITY_BUSY = "busy"
+	// USER_STATUS_TTL is how long a looked up status is trusted
+	USER_STATUS_TTL = 5 * time.Minute
+)
+
+// cachedStatus is why a user is away, if they are, as of when it was looked up
+type cachedStatus struct {
+	away    string
+	checked time.Time
+}
+
+// userStatuses skips maintainers whose gitlab status says they're busy or out of office when new reviews are
+// handed out.  out of office is a status emoji or message matching one of the patterns, like `:palm_tree:` or
+// `vacation`
+type userStatuses struct {
+	patterns []*regexp.Regexp
+
+	mu    sync.Mutex
+	cache map[int]cachedStatus // by gitlab user ID
+}
+
+// userStatusesFromEnv configures the status check from the environment, returning nil if RESPECT_USER_STATUS=false.
+// OOO_STATUS_PATTERNS is a comma separated list of words or `:emoji:`, matched case insensitively
+func userStatusesFromEnv() *userStatuses {
+	if respect, err := strconv.ParseBool(os.Getenv(RESPECT_USER_STATUS_ENV_VAR)); err == nil && !respect {
+		return nil
+	}
+	patterns := os.Getenv(OOO_STATUS_PATTERNS_ENV_VAR)
+	if patterns == "" {
+		patterns = DEFAULT_OOO_STATUS_PATTERNS
+	}
+	s := &userStatuses{cache: make(map[int]cachedStatus)}
+	for _, p := range strings.Split(patterns, ",") {
+		if p = strings.TrimSpace(p); p != "" {
+			s.patterns = append(s.patterns, regexp.MustCompile(`(?i)(^|\W)`+regexp.QuoteMeta(p)+`(\W|$)`))
+		}
+	}
+	return s
+}
+
+// awayReason says why the gitlab status means the user shouldn't get new reviews, or "" if it doesn't
+func (s *userStatuses) awayReason(status *gitlab.UserStatus) string {
+	if status == nil {
+		return ""
+	}
+	if string(status.Availability) == USER_AVAILABILITY_BUSY {
+		return "busy"
+	}
+	text := status.Message
+	if status.Emoji != "" {
+		text = fmt.Sprintf(":%s: %s", status.Emoji, text)
+	}
+	for _, p := range s.patterns {
+		if p.MatchString(text) {
+			return "out of office: " + strings.TrimSpace(text)
+		}
+	}
+	return ""
+}
+
+// away reports why the user shouldn't get new reviews, or "" if they can.  users whose status can't be looked up can
+func (s *userStatuses) away(gl GitLabAPI, userID int) string {
+	s.mu.Lock()
+	cached, ok := s.cache[userID]
+	s.mu.Unlock()
+	if ok && time.Since(cached.checked) < USER_STATUS_TTL {
+		return cached.away
+	}
+	status, err := gl.GetUserStatus(userID)
+	if err != nil {
+		logrus.WithError(err).Debugf("failed to look up the gitlab status of user %d, assuming they're around", userID)
+		return ""
+	}
+	cached = cachedStatus{away: s.awayReason(status), checked: time.Now()}
+	s.mu.Lock()
+	s.cache[userID] = cached
+	s.mu.Unlock()
+	return cached.away
+}
+
+// filter drops the members who are busy or out of office.  if that's all of them, it keeps them all: someone has to
+// review it, and an out of office status can last weeks
+func (s *userStatuses) filter(gl GitLabAPI, members []*gitlab.ProjectMember) []*gitlab.ProjectMember {
+	var around []*gitlab.ProjectMember
+	for _, m := range members {
+		if reason := s.away(gl, m.ID); reason != "" {
+			logrus.Debugf("not giving %s new reviews, they're %s", m.Username, reason)
+			continue
+		}
+		around = append(around, m)
+	}
+	if len(around) == 0 && len(members) > 0 {
+		logrus.Warnf("all %d candidate reviewers are busy or out of office, picking from them anyway", len(members))
+		return members
+	}
+	return around
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+	"github.com/slack-go/slack"
+	"github.com/xanzy/go-gitlab"
+)
+
+// userMapper resolves slack users to gitlab users.  Explicit mappings from the config file win, otherwise users are
+// matched by the email address on their slack profile.  Searching gitlab users by private email needs an admin token.
+type userMapper struct {
+	slack *slack.Client // nil when slack is disabled
+	gl    GitLabAPI
+
+	mu            sync.Mutex
+	slackToGitlab map[string]*gitlab.User
+	configured    map[string]string // slack user ID -> gitlab username
+	gitlabToSlack map[string]string // gitlab username -> slack user ID
+}
+
+func newUserMapper(slk *slack.Client, gl GitLabAPI, users []userConfig) *userMapper {
+	m := &userMapper{
+		slack:         slk,
+		gl:            gl,
+		slackToGitlab: make(map[string]*gitlab.User),
+		configured:    make(map[string]string),
+		gitlabToSlack: make(map[string]string),
+	}
+	for _, u := range users {
+		m.configured[u.Slack] = u.GitLab
+		m.gitlabToSlack[u.GitLab] = u.Slack
+	}
+	return m
+}
+
+// gitlabUser returns the gitlab user for the slack user ID
+func (m *userMapper) gitlabUser(slackID string) (*gitlab.User, error) {
+	m.mu.Lock()
+	user, ok := m.slackToGitlab[slackID]
+	username, configured := m.configured[slackID]
+	m.mu.Unlock()
+	if ok {
+		return user, nil
+	}
+
+	opt := &gitlab.ListUsersOptions{}
+	if configured {
+		opt.Username = &username
+	} else {
+		if m.slack == nil {
+			return nil, fmt.Errorf("slack is disabled, can't look up slack user %s", slackID)
+		}
+		profile, err := m.slack.GetUserInfo(slackID)
+		if err != nil {
+			return nil, err
+		}
+		if profile.Profile.Email == "" {
+			return nil, fmt.Errorf("slack user %s has no email address", slackID)
+		}
+		opt.Search = &profile.Profile.Email
+	}
+	users, err := m.gl.ListUsers(opt)
+	if err != nil {
+		return nil, err
+	}
+	if len(users) != 1 {
+		return nil, fmt.Errorf("found %d gitlab users for slack user %s, add them to the `users` section of the config file", len(users), slackID)
+	}
+
+	m.mu.Lock()
+	m.slackToGitlab[slackID] = users[0]
+	m.mu.Unlock()
+	return users[0], nil
+}
+
+// slackUser returns the slack user ID for the gitlab username.  Unconfigured users are matched by the public email on
+// their gitlab profile
+func (m *userMapper) slackUser(username string) (string, error) {
+	m.mu.Lock()
+	slackID, ok := m.gitlabToSlack[username]
+	m.mu.Unlock()
+	if ok {
+		return slackID, nil
+	}
+	if m.slack == nil {
+		return "", fmt.Errorf("slack is disabled, can't look up gitlab user %s", username)
+	}
+
+	users, err := m.gl.ListUsers(&gitlab.ListUsersOptions{Username: &username})
+	if err != nil {
+		return "", err
+	}
+	if len(users) != 1 || users[0].PublicEmail == "" {
+		return "", fmt.Errorf("gitlab user %s has no public email, add them to the `users` section of the config file", username)
+	}
+	profile, err := m.slack.GetUserByEmail(users[0].PublicEmail)
+	if err != nil {
+		return "", err
+	}
+
+	m.mu.Lock()
+	m.gitlabToSlack[username] = profile.ID
+	m.mu.Unlock()
+	return profile.ID, nil
+}
+
+// slackUserByEmail returns the slack user ID with the email address, e.g. a commit author's
+func (m *userMapper) slackUserByEmail(email string) (string, error) {
+	if m.slack == nil {
+		return "", fmt.Errorf("slack is disabled, can't look up %s", email)
+	}
+	if email == "" {
+		return "", fmt.Errorf("no email address to look up")
+	}
+	profile, err := m.slack.GetUserByEmail(email)
+	if err != nil {
+		return "", err
+	}
+	return profile.ID, nil
+}
+
+// dm sends the message to the gitlab user's slack DMs, if we can work out who they are on slack
+func (bot bot) dm(username, msg string) {
+	slackID, err := bot.users.slackUser(username)
+	if err != nil {
+		logrus.WithError(err).Warnf("can't DM %s", username)
+		return
+	}
+	if _, err := bot.notifier.Notify(slackID, msg); err != nil {
+		logrus.WithError(err).Errorf("failed to DM %s", username)
+	}
+}
@@ -0,0 +1,254 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/raidancampbell/gitlab-odds-and-ends/internal/store"
+	"github.com/sirupsen/logrus"
+	"github.com/slack-go/slack"
+	"github.com/xanzy/go-gitlab"
+)
+
+const (
+	SLACK_COMMAND_WATCH = "/watch"
+	WATCHES_STORE_KEY   = "file_watches"
+	// at most this many matching files are listed in a watch DM
+	MAX_WATCH_FILES = 5
+)
+
+// fileWatch is a glob someone wants to hear about MRs touching, e.g. `**/auth/**`.  globs work like label rules' paths
+type fileWatch struct {
+	Pattern string `json:"pattern"`
+	// Project limits the watch to one project.  empty is every project
+	Project string `json:"project,omitempty"`
+}
+
+// watches are everyone's personal file watches, and which MRs they were already told about
+type watches struct {
+	store *store.Store
+
+	mu    sync.Mutex
+	state watchState
+}
+
+type watchState struct {
+	ByUser   map[string][]fileWatch `json:"by_user"`  // slack user ID -> their watches
+	Notified map[string][]string    `json:"notified"` // mrRef -> slack user IDs DMed about it
+}
+
+func newWatches(s *store.Store) (*watches, error) {
+	w := &watches{store: s, state: watchState{ByUser: make(map[string][]fileWatch), Notified: make(map[string][]string)}}
+	if _, err := s.Load(WATCHES_STORE_KEY, &w.state); err != nil {
+		return nil, err
+	}
+	s.Follow(WATCHES_STORE_KEY, &w.state, &w.mu)
+	return w, nil
+}
+
+// persist saves the watches.  callers hold the lock
+func (w *watches) persist() {
+	if err := w.store.Save(WATCHES_STORE_KEY, w.state); err != nil {
+		logrus.WithError(err).Error("failed to persist file watches")
+	}
+}
+
+// add the watch for the user, reporting whether they didn't have it already
+func (w *watches) add(user string, watch fileWatch) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for _, existing := range w.state.ByUser[user] {
+		if existing == watch {
+			return false
+		}
+	}
+	w.state.ByUser[user] = append(w.state.ByUser[user], watch)
+	w.persist()
+	return true
+}
+
+// remove the user's watches with the pattern, returning how many there were
+func (w *watches) remove(user, pattern string) int {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	var kept []fileWatch
+	for _, watch := range w.state.ByUser[user] {
+		if watch.Pattern != pattern {
+			kept = append(kept, watch)
+		}
+	}
+	removed := len(w.state.ByUser[user]) - len(kept)
+	if len(kept) == 0 {
+		delete(w.state.ByUser, user)
+	} else {
+		w.state.ByUser[user] = kept
+	}
+	if removed > 0 {
+		w.persist()
+	}
+	return removed
+}
+
+// any reports whether anyone is watching anything
+func (w *watches) any() bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return len(w.state.ByUser) > 0
+}
+
+func (w *watches) list(user string) []fileWatch {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return append([]fileWatch(nil), w.state.ByUser[user]...)
+}
+
+// matches returns, for each user who hasn't been told about the MR yet, the watched files it changes and the first
+// of their patterns that matched
+func (w *watches) matches(ref, project string, paths []string) map[string]watchMatch {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	told := make(map[string]bool)
+	for _, user := range w.state.Notified[ref] {
+		told[user] = true
+	}
+	found := make(map[string]watchMatch)
+	for user, userWatches := range w.state.ByUser {
+		if told[user] {
+			continue
+		}
+		var match watchMatch
+		seen := make(map[string]bool)
+		for _, watch := range userWatches {
+			if watch.Project != "" && watch.Project != project {
+				continue
+			}
+			re, err := globRegexp(watch.Pattern)
+			if err != nil {
+				continue // checked when the watch was added
+			}
+			for _, p := range paths {
+				if p != "" && !seen[p] && re.MatchString(p) {
+					seen[p] = true
+					match.files = append(match.files, p)
+					if match.pattern == "" {
+						match.pattern = watch.Pattern
+					}
+				}
+			}
+		}
+		if len(match.files) > 0 {
+			sort.Strings(match.files)
+			found[user] = match
+		}
+	}
+	return found
+}
+
+type watchMatch struct {
+	pattern string
+	files   []string
+}
+
+// notified records that the users were told about the MR
+func (w *watches) notified(ref string, users []string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.state.Notified[ref] = append(w.state.Notified[ref], users...)
+	w.persist()
+}
+
+// forget the MR, e.g. once it's been merged or closed
+func (w *watches) forget(ref string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if _, ok := w.state.Notified[ref]; ok {
+		delete(w.state.Notified, ref)
+		w.persist()
+	}
+}
+
+// notifyWatchers DMs everyone watching files the MR changes, once per MR.  the author doesn't hear about their own MR
+func (bot bot) notifyWatchers(mr *gitlab.MergeEvent) {
+	if !bot.watches.any() {
+		return
+	}
+	ref := mrRef(mr.Project.ID, mr.ObjectAttributes.IID)
+	changes, err := bot.gl.GetMergeRequestChanges(mr.Project.ID, mr.ObjectAttributes.IID)
+	if err != nil {
+		logrus.WithError(err).Errorf("failed to list changes of merge request !%d for file watches", mr.ObjectAttributes.IID)
+		return
+	}
+	var paths []string
+	for _, c := range changes.Changes {
+		paths = append(paths, c.OldPath, c.NewPath)
+	}
+
+	var told []string
+	for user, match := range bot.watches.matches(ref, mr.Project.PathWithNamespace, paths) {
+		if gl, err := bot.users.gitlabUser(user); err == nil && gl.ID == mr.ObjectAttributes.AuthorID {
+			continue
+		}
+		files := match.files
+		more := ""
+		if len(files) > MAX_WATCH_FILES {
+			more = fmt.Sprintf(" and %d more", len(files)-MAX_WATCH_FILES)
+			files = files[:MAX_WATCH_FILES]
+		}
+		msg := tr(":eyes: <%s|!%d %s> in `%s` changes files you're watching with `%s`: `%s`%s",
+			mr.ObjectAttributes.URL, mr.ObjectAttributes.IID, mr.ObjectAttributes.Title, mr.Project.PathWithNamespace,
+			match.pattern, strings.Join(files, "`, `"), more)
+		if _, err := bot.notifier.Notify(user, bot.locales.render(user, msg)); err != nil {
+			logrus.WithError(err).Errorf("failed to DM %s about watched files", user)
+			continue
+		}
+		told = append(told, user)
+	}
+	if len(told) > 0 {
+		bot.watches.notified(ref, told)
+	}
+}
+
+// watchCommand handles `/watch add <glob> [group/project]`, `/watch remove <glob>` and `/watch list`
+func (bot bot) watchCommand(cmd slack.SlashCommand) *slack.Msg {
+	usage := "usage: `/watch add <glob> [group/project]`, `/watch remove <glob>` or `/watch list`, e.g. `/watch add **/auth/**`"
+	args := strings.Fields(cmd.Text)
+	if len(args) == 0 {
+		return ephemeral(usage)
+	}
+	switch {
+	case args[0] == "list":
+		watches := bot.watches.list(cmd.UserID)
+		if len(watches) == 0 {
+			return ephemeral("you aren't watching any files")
+		}
+		lines := []string{"you're watching:"}
+		for _, w := range watches {
+			where := "every project"
+			if w.Project != "" {
+				where = "`" + w.Project + "`"
+			}
+			lines = append(lines, fmt.Sprintf("• `%s` in %s", w.Pattern, where))
+		}
+		return ephemeral(strings.Join(lines, "\n"))
+	case args[0] == "add" && (len(args) == 2 || len(args) == 3):
+		watch := fileWatch{Pattern: args[1]}
+		if len(args) == 3 {
+			watch.Project = args[2]
+		}
+		if _, err := globRegexp(watch.Pattern); err != nil {
+			return ephemeral(fmt.Sprintf("`%s` isn't a valid glob: %v", watch.Pattern, err))
+		}
+		if !bot.watches.add(cmd.UserID, watch) {
+			return ephemeral(fmt.Sprintf("you're already watching `%s`", watch.Pattern))
+		}
+		return ephemeral(fmt.Sprintf("I'll DM you about merge requests that change files matching `%s`", watch.Pattern))
+	case args[0] == "remove" && len(args) == 2:
+		if bot.watches.remove(cmd.UserID, args[1]) == 0 {
+			return ephemeral(fmt.Sprintf("you weren't watching `%s`", args[1]))
+		}
+		return ephemeral(fmt.Sprintf("you're no longer watching `%s`", args[1]))
+	}
+	return ephemeral(usage)
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/raidancampbell/gitlab-odds-and-ends/internal/webhook"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	GITLAB_WEBHOOK_SECRET_ENV_VAR = "GITLAB_WEBHOOK_SECRET"
+	WEBHOOK_REPLAY_WINDOW_ENV_VAR = "WEBHOOK_REPLAY_WINDOW"
+	WEBHOOK_CLOCK_SKEW_ENV_VAR    = "WEBHOOK_CLOCK_SKEW"
+)
+
+// webhookAuthFromEnv returns nil when the webhook secret in secretEnvVar (or its file, see secretFromEnv) isn't set
+func webhookAuthFromEnv(secretEnvVar string) *webhook.Auth {
+	secret := secretFromEnv(secretEnvVar)
+	if secret == "" {
+		return nil
+	}
+	auth := &webhook.Auth{Secret: secret, Window: webhook.DEFAULT_REPLAY_WINDOW, Skew: webhook.DEFAULT_CLOCK_SKEW}
+	if d, err := time.ParseDuration(os.Getenv(WEBHOOK_REPLAY_WINDOW_ENV_VAR)); err == nil && d > 0 {
+		auth.Window = d
+	}
+	if d, err := time.ParseDuration(os.Getenv(WEBHOOK_CLOCK_SKEW_ENV_VAR)); err == nil && d >= 0 {
+		auth.Skew = d
+	}
+	return auth
+}
+
+// reloadWebhookAuth re-reads the webhook secret, e.g. after it was rotated.  an empty or unreadable secret keeps the
+// previous one instead of turning webhook authentication off; that takes a restart
+func reloadWebhookAuth(prev *webhook.Auth, secretEnvVar string) *webhook.Auth {
+	auth := webhookAuthFromEnv(secretEnvVar)
+	if auth == nil && prev != nil {
+		logrus.Errorf("The webhook secret in %s is empty or unreadable, keeping the previous one", secretEnvVar)
+		return prev
+	}
+	return auth
+}
+
+// verifyWebhook turns away gitlab webhooks without the webhook secret, or replayed, before anything else (e.g. the
+// per-project rate limit) believes what they say
+func (bot bot) verifyWebhook(c *gin.Context) {
+	if err := bot.verify(c, bot.webhookAuth, "gitlab webhook"); err != nil {
+		bot.status.delivered(webhookDelivery{Instance: bot.instance, Kind: c.Request.Header.Get(HEADER_GITLAB_EVENT), Result: DELIVERY_ERROR, Outcome: "rejected: " + err.Error()})
+	}
+}
+
+// verifySystemHook is verifyWebhook for system hooks, with the system hook's secret
+func (bot bot) verifySystemHook(c *gin.Context) {
+	bot.verify(c, bot.systemHooks.auth, "gitlab system hook")
+}
+
+// verify aborts the request if auth, when there is one, rejects it, returning why.  the body is left for the
+// handlers after it
+func (bot bot) verify(c *gin.Context, auth *webhook.Auth, what string) error {
+	if auth == nil {
+		return nil
+	}
+	b, err := ioutil.ReadAll(c.Request.Body)
+	if err != nil {
+		logrus.Errorf("Failed to read request body '%v'", err)
+		http.Error(c.Writer, http.StatusText(http.StatusOK), http.StatusOK)
+		c.Abort()
+		return err
+	}
+	c.Request.Body = ioutil.NopCloser(bytes.NewReader(b))
+	status, err := auth.Verify(c.Request.Header, b, time.Now())
+	if err != nil {
+		logrus.WithError(err).Warnf("Rejecting %s from %s", what, c.ClientIP())
+		bot.status.fail("rejected webhook")
+		http.Error(c.Writer, http.StatusText(status), status)
+		c.Abort()
+	}
+	return err
+}
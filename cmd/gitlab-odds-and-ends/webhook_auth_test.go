@@ -0,0 +1,53 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/raidancampbell/gitlab-odds-and-ends/internal/webhook"
+)
+
+func TestReloadWebhookAuth(t *testing.T) {
+	rotated := filepath.Join(t.TempDir(), "secret")
+	if err := os.WriteFile(rotated, []byte("rotated\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	empty := filepath.Join(t.TempDir(), "empty")
+	if err := os.WriteFile(empty, nil, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	prev := &webhook.Auth{Secret: "previous"}
+	tests := []struct {
+		name       string
+		prev       *webhook.Auth
+		secret     string
+		secretFile string
+		want       string // the secret in effect, or empty for none
+	}{
+		{name: "rotated secret", prev: prev, secretFile: rotated, want: "rotated"},
+		{name: "empty secret file keeps the previous one", prev: prev, secretFile: empty, want: "previous"},
+		{name: "unreadable secret file keeps the previous one", prev: prev, secretFile: filepath.Join(t.TempDir(), "missing"), want: "previous"},
+		{name: "unset secret keeps the previous one", prev: prev, want: "previous"},
+		{name: "secret set after starting without one", secret: "new", want: "new"},
+		{name: "still no secret"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("TEST_WEBHOOK_SECRET", tt.secret)
+			t.Setenv("TEST_WEBHOOK_SECRET"+SECRET_FILE_SUFFIX, tt.secretFile)
+
+			got := reloadWebhookAuth(tt.prev, "TEST_WEBHOOK_SECRET")
+
+			if tt.want == "" {
+				if got != nil {
+					t.Errorf("reloadWebhookAuth() = %+v, want no authentication", got)
+				}
+				return
+			}
+			if got == nil || got.Secret != tt.want {
+				t.Errorf("reloadWebhookAuth() = %+v, want secret %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,285 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/raidancampbell/gitlab-odds-and-ends/internal/store"
+	"github.com/sirupsen/logrus"
+	"github.com/xanzy/go-gitlab"
+)
+
+const (
+	WORKING_HOURS_ENV_VAR   = "WORKING_HOURS"
+	WORKING_HOURS_STORE_KEY = "working_hours_queue"
+	// WORKING_HOURS_RETRY_INTERVAL is how often queued MRs look for someone who's come online
+	WORKING_HOURS_RETRY_INTERVAL = 15 * time.Minute
+	// WORKING_HOURS_ZONE_TTL is how long a timezone worked out from a gitlab profile is trusted, since daylight saving
+	// moves it
+	WORKING_HOURS_ZONE_TTL = 12 * time.Hour
+	// GITLAB_LOCAL_TIME_LAYOUT is how gitlab profiles show the user's local time
+	GITLAB_LOCAL_TIME_LAYOUT = "3:04 PM"
+)
+
+// errNobodyAvailable is returned when the MR has reviewers to pick from, but none of them are working right now
+var errNobodyAvailable = errors.New("nobody who can review it is in their working hours")
+
+// defaultWorkingDays are monday to friday
+var defaultWorkingDays = []string{"mon", "tue", "wed", "thu", "fri"}
+
+// shift is when someone works: minutes past midnight on their working days.  shifts ending before they start run
+// overnight into the next day
+type shift struct {
+	start, end int
+	days       map[time.Weekday]bool
+}
+
+// parseShift parses working hours like `09:00-17:00` and the days they're worked.  no days is monday to friday
+func parseShift(hours string, days []string) (shift, error) {
+	s := shift{days: make(map[time.Weekday]bool)}
+	parts := strings.SplitN(hours, "-", 2)
+	if len(parts) != 2 {
+		return s, fmt.Errorf("invalid working hours '%s', expected HH:MM-HH:MM", hours)
+	}
+	for i, at := range []*int{&s.start, &s.end} {
+		t, err := time.Parse("15:04", strings.TrimSpace(parts[i]))
+		if err != nil {
+			return s, fmt.Errorf("invalid working hours '%s', expected HH:MM-HH:MM: %v", hours, err)
+		}
+		*at = t.Hour()*60 + t.Minute()
+	}
+	if s.start == s.end {
+		return s, fmt.Errorf("invalid working hours '%s', they start when they end", hours)
+	}
+	if len(days) == 0 {
+		days = defaultWorkingDays
+	}
+	for _, day := range days {
+		weekday, err := parseWeekday(day)
+		if err != nil {
+			return s, err
+		}
+		s.days[weekday] = true
+	}
+	return s, nil
+}
+
+// covers reports whether t, on the worker's clock, is in the shift
+func (s shift) covers(t time.Time) bool {
+	minute := t.Hour()*60 + t.Minute()
+	if s.start < s.end {
+		return s.days[t.Weekday()] && minute >= s.start && minute < s.end
+	}
+	// overnight: the evening of a working day, or the morning after one
+	yesterday := (t.Weekday() + 6) % 7
+	return (s.days[t.Weekday()] && minute >= s.start) || (s.days[yesterday] && minute < s.end)
+}
+
+// userHours is a configured user's timezone and shift.  a nil loc is worked out from their gitlab profile
+type userHours struct {
+	loc   *time.Location
+	shift shift
+}
+
+// profileZone is a timezone worked out from a gitlab profile
+type profileZone struct {
+	loc     *time.Location
+	checked time.Time
+}
+
+// queuedAssignment is a new MR waiting for one of its reviewers to start working
+type queuedAssignment struct {
+	ProjectID int       `json:"project_id"`
+	Project   string    `json:"project"`
+	IID       int       `json:"iid"`
+	Channels  []string  `json:"channels"`
+	Queued    time.Time `json:"queued"`
+}
+
+// workingHours keeps new reviews to maintainers who are working right now.  everyone works WORKING_HOURS on
+// weekdays unless the users section of the config file says otherwise, in their own timezone.  MRs that come in when
+// nobody's working are queued, unassigned and unannounced, for whoever comes online first
+type workingHours struct {
+	defaults shift
+	users    map[string]userHours // by gitlab username
+	store    *store.Store
+
+	mu    sync.Mutex
+	zones map[int]profileZone // by gitlab user ID
+	queue map[string]queuedAssignment
+}
+
+// newWorkingHours configures working hours from the environment and the users section of the config file, returning
+// nil if WORKING_HOURS isn't set
+func newWorkingHours(users []userConfig, s *store.Store) (*workingHours, error) {
+	hours := os.Getenv(WORKING_HOURS_ENV_VAR)
+	if hours == "" {
+		return nil, nil
+	}
+	defaults, err := parseShift(hours, nil)
+	if err != nil {
+		return nil, err
+	}
+	w := &workingHours{defaults: defaults, users: make(map[string]userHours), store: s, zones: make(map[int]profileZone), queue: make(map[string]queuedAssignment)}
+	for _, u := range users {
+		if u.GitLab == "" || (u.Timezone == "" && u.WorkingHours == "" && len(u.WorkingDays) == 0) {
+			continue
+		}
+		h := userHours{shift: defaults}
+		if u.Timezone != "" {
+			if h.loc, err = time.LoadLocation(u.Timezone); err != nil {
+				return nil, fmt.Errorf("invalid timezone '%s' for %s: %v", u.Timezone, u.GitLab, err)
+			}
+		}
+		if u.WorkingHours != "" || len(u.WorkingDays) > 0 {
+			if u.WorkingHours == "" {
+				u.WorkingHours = hours
+			}
+			if h.shift, err = parseShift(u.WorkingHours, u.WorkingDays); err != nil {
+				return nil, fmt.Errorf("%s: %v", u.GitLab, err)
+			}
+		}
+		w.users[u.GitLab] = h
+	}
+	if _, err := s.Load(WORKING_HOURS_STORE_KEY, &w.queue); err != nil {
+		return nil, err
+	}
+	s.Follow(WORKING_HOURS_STORE_KEY, &w.queue, &w.mu)
+	return w, nil
+}
+
+// available narrows the members to those in their working hours.  members whose timezone can't be worked out are
+// assumed to be working
+func (w *workingHours) available(gl GitLabAPI, members []*gitlab.ProjectMember) []*gitlab.ProjectMember {
+	now := time.Now()
+	var working []*gitlab.ProjectMember
+	for _, m := range members {
+		h, ok := w.users[m.Username]
+		if !ok {
+			h.shift = w.defaults
+		}
+		loc := h.loc
+		if loc == nil {
+			var err error
+			if loc, err = w.profileZone(gl, m.ID); err != nil {
+				logrus.WithError(err).Debugf("couldn't work out %s's timezone, assuming they're working", m.Username)
+				working = append(working, m)
+				continue
+			}
+		}
+		if h.shift.covers(now.In(loc)) {
+			working = append(working, m)
+		}
+	}
+	return working
+}
+
+// profileZone works out the user's timezone from the local time gitlab shows on their profile
+func (w *workingHours) profileZone(gl GitLabAPI, userID int) (*time.Location, error) {
+	w.mu.Lock()
+	z, ok := w.zones[userID]
+	w.mu.Unlock()
+	if ok && time.Since(z.checked) < WORKING_HOURS_ZONE_TTL {
+		return z.loc, nil
+	}
+	localTime, err := gl.GetUserLocalTime(userID)
+	if err != nil {
+		return nil, err
+	}
+	loc, err := zoneFromLocalTime(localTime, time.Now().UTC())
+	if err != nil {
+		return nil, err
+	}
+	w.mu.Lock()
+	w.zones[userID] = profileZone{loc: loc, checked: time.Now()}
+	w.mu.Unlock()
+	return loc, nil
+}
+
+// zoneFromLocalTime turns a gitlab profile's local time into the user's UTC offset, by comparing it to the time in
+// UTC.  gitlab only shows the minute, so the offset is rounded to the nearest quarter hour
+func zoneFromLocalTime(localTime string, utc time.Time) (*time.Location, error) {
+	if localTime == "" {
+		return nil, fmt.Errorf("no local time on their gitlab profile")
+	}
+	t, err := time.Parse(GITLAB_LOCAL_TIME_LAYOUT, strings.TrimSpace(localTime))
+	if err != nil {
+		return nil, fmt.Errorf("invalid local time '%s' on their gitlab profile: %v", localTime, err)
+	}
+	offset := (t.Hour()*60 + t.Minute()) - (utc.Hour()*60 + utc.Minute())
+	// offsets run from -12:00 to +14:00
+	if offset < -12*60 {
+		offset += 24 * 60
+	} else if offset > 14*60 {
+		offset -= 24 * 60
+	}
+	offset = (offset+7+12*60)/15*15 - 12*60
+	return time.FixedZone("gitlab profile", offset*60), nil
+}
+
+// enqueue holds off the MR until someone who can review it is working.  MRs already queued keep their place
+func (w *workingHours) enqueue(mr *gitlab.MergeEvent, slackChans []string) {
+	ref := mrRef(mr.Project.ID, mr.ObjectAttributes.IID)
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if _, ok := w.queue[ref]; ok {
+		return
+	}
+	w.queue[ref] = queuedAssignment{ProjectID: mr.Project.ID, Project: mr.Project.PathWithNamespace, IID: mr.ObjectAttributes.IID, Channels: slackChans, Queued: time.Now()}
+	w.save()
+}
+
+// dequeue takes the MR off the queue
+func (w *workingHours) dequeue(ref string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if _, ok := w.queue[ref]; ok {
+		delete(w.queue, ref)
+		w.save()
+	}
+}
+
+// queued lists the MRs waiting for someone to come online
+func (w *workingHours) queued() map[string]queuedAssignment {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	queued := make(map[string]queuedAssignment, len(w.queue))
+	for ref, q := range w.queue {
+		queued[ref] = q
+	}
+	return queued
+}
+
+// save persists the queue.  callers hold mu
+func (w *workingHours) save() {
+	if err := w.store.Save(WORKING_HOURS_STORE_KEY, w.queue); err != nil {
+		logrus.WithError(err).Error("failed to persist merge requests waiting for working hours")
+	}
+}
+
+// assignQueued retries the new MR flow for the MRs that were waiting for someone to come online.  MRs that were
+// merged, closed, or picked up by someone in the meantime are dropped
+func (bot bot) assignQueued() {
+	for ref, q := range bot.workingHours.queued() {
+		mr, err := bot.gl.GetMergeRequest(q.ProjectID, q.IID)
+		if err != nil {
+			logrus.WithError(err).Errorf("failed to look up queued merge request !%d in %s", q.IID, q.Project)
+			continue
+		}
+		if mr.State != "opened" || mr.Assignee != nil || len(mr.Reviewers) > 0 {
+			bot.workingHours.dequeue(ref)
+			continue
+		}
+		project, err := bot.gl.GetProject(q.ProjectID)
+		if err != nil {
+			logrus.WithError(err).Errorf("failed to look up %s for queued merge request !%d", q.Project, q.IID)
+			continue
+		}
+		// announceNewMR takes it off the queue once someone's assigned
+		bot.announceNewMR(mergeEventFor(project, mr), q.Channels)
+	}
+}
@@ -0,0 +1,53 @@
+// Package assign picks reviewers for merge requests.  it works on gitlab user IDs, so it doesn't care whether the
+// candidates are a project's maintainers or an MR's eligible approvers
+package assign
+
+import (
+	"math/rand"
+)
+
+// Pick returns a random one of the candidates, other than the excluded ones, or false if that leaves nobody
+func Pick(candidates []int, exclude ...int) (int, bool) {
+	var eligible []int
+	for _, c := range candidates {
+		if !contains(exclude, c) {
+			eligible = append(eligible, c)
+		}
+	}
+	if len(eligible) == 0 {
+		return 0, false
+	}
+	return eligible[rand.Intn(len(eligible))], true
+}
+
+// TopUp returns random candidates to add to those reviewing, until want of the candidates are.  the author never counts
+// and is never added.  got is how many candidates are reviewing once they're added, less than want if there weren't
+// enough
+func TopUp(candidates []int, reviewing map[int]bool, author, want int) (add []int, got int) {
+	for _, c := range candidates {
+		if reviewing[c] && c != author {
+			got++
+		}
+	}
+	for _, i := range rand.Perm(len(candidates)) {
+		if got >= want {
+			break
+		}
+		c := candidates[i]
+		if reviewing[c] || c == author {
+			continue
+		}
+		add = append(add, c)
+		got++
+	}
+	return add, got
+}
+
+func contains(ids []int, id int) bool {
+	for _, i := range ids {
+		if i == id {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,67 @@
+package assign
+
+import (
+	"testing"
+)
+
+func TestPick(t *testing.T) {
+	tests := []struct {
+		name       string
+		candidates []int
+		exclude    []int
+		wantOK     bool
+	}{
+		{"picks a candidate", []int{1, 2, 3}, nil, true},
+		{"skips the excluded", []int{1, 2, 3}, []int{1, 3}, true},
+		{"nobody left", []int{1}, []int{1}, false},
+		{"no candidates", nil, nil, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for i := 0; i < 20; i++ {
+				got, ok := Pick(tt.candidates, tt.exclude...)
+				if ok != tt.wantOK {
+					t.Fatalf("Pick() = %d, %v, want ok %v", got, ok, tt.wantOK)
+				}
+				if ok && (!contains(tt.candidates, got) || contains(tt.exclude, got)) {
+					t.Fatalf("Pick() = %d, which isn't an eligible candidate", got)
+				}
+			}
+		})
+	}
+}
+
+func TestTopUp(t *testing.T) {
+	tests := []struct {
+		name       string
+		candidates []int
+		reviewing  []int
+		author     int
+		want       int
+		wantAdd    int
+		wantGot    int
+	}{
+		{"adds up to want", []int{1, 2, 3}, nil, 9, 2, 2, 2},
+		{"counts who's reviewing", []int{1, 2, 3}, []int{1}, 9, 2, 1, 2},
+		{"already enough", []int{1, 2, 3}, []int{1, 2}, 9, 2, 0, 2},
+		{"the author doesn't count", []int{1, 2, 3}, []int{1}, 1, 2, 2, 2},
+		{"not enough candidates", []int{1, 2}, nil, 2, 3, 1, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reviewing := make(map[int]bool)
+			for _, id := range tt.reviewing {
+				reviewing[id] = true
+			}
+			add, got := TopUp(tt.candidates, reviewing, tt.author, tt.want)
+			if len(add) != tt.wantAdd || got != tt.wantGot {
+				t.Fatalf("TopUp() = %v, %d, want %d added and %d reviewing", add, got, tt.wantAdd, tt.wantGot)
+			}
+			for _, id := range add {
+				if reviewing[id] || id == tt.author || !contains(tt.candidates, id) {
+					t.Errorf("TopUp() added %d, who isn't an eligible candidate", id)
+				}
+			}
+		})
+	}
+}
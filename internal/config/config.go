@@ -0,0 +1,31 @@
+// Package config reads the bot's YAML configuration file.  what's in it is up to the bot, so this only knows how to read
+// it strictly and where it is.
+package config
+
+import (
+	"io/ioutil"
+	"path/filepath"
+
+	"gopkg.in/yaml.v2"
+)
+
+// Load decodes the YAML file at path into v.  Unknown fields are errors, so typos don't go unnoticed.  An empty path
+// leaves v alone
+func Load(path string, v interface{}) error {
+	if path == "" {
+		return nil
+	}
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	return yaml.UnmarshalStrict(b, v)
+}
+
+// Resolve makes a path from the config file relative to the config file's directory.  absolute paths are left alone
+func Resolve(configPath, path string) string {
+	if filepath.IsAbs(path) {
+		return path
+	}
+	return filepath.Join(filepath.Dir(configPath), path)
+}
@@ -0,0 +1,66 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+type testConfig struct {
+	Name  string   `yaml:"name"`
+	Teams []string `yaml:"teams"`
+}
+
+func TestLoad(t *testing.T) {
+	tests := []struct {
+		name    string
+		yaml    string
+		want    testConfig
+		wantErr bool
+	}{
+		{"fields", "name: bot\nteams: [a, b]\n", testConfig{Name: "bot", Teams: []string{"a", "b"}}, false},
+		{"unknown fields are errors", "name: bot\nteam: [a]\n", testConfig{}, true},
+		{"malformed", "name: [bot\n", testConfig{}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "config.yaml")
+			if err := os.WriteFile(path, []byte(tt.yaml), 0o600); err != nil {
+				t.Fatal(err)
+			}
+			var got testConfig
+			err := Load(path, &got)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Load() error = %v, want error %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && (got.Name != tt.want.Name || len(got.Teams) != len(tt.want.Teams)) {
+				t.Errorf("Load() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoadWithoutPath(t *testing.T) {
+	got := testConfig{Name: "default"}
+	if err := Load("", &got); err != nil || got.Name != "default" {
+		t.Errorf("Load(\"\") = %+v, %v, want it left alone", got, err)
+	}
+	if err := Load(filepath.Join(t.TempDir(), "missing.yaml"), &got); err == nil {
+		t.Error("Load() of a missing file succeeded")
+	}
+}
+
+func TestResolve(t *testing.T) {
+	tests := []struct {
+		config, path, want string
+	}{
+		{"/etc/bot/config.yaml", "policies/merge.rego", "/etc/bot/policies/merge.rego"},
+		{"/etc/bot/config.yaml", "/srv/merge.rego", "/srv/merge.rego"},
+		{"config.yaml", "scripts/route.star", "scripts/route.star"},
+	}
+	for _, tt := range tests {
+		if got := Resolve(tt.config, tt.path); got != tt.want {
+			t.Errorf("Resolve(%q, %q) = %q, want %q", tt.config, tt.path, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,79 @@
+// Package httpsettings configures how the bot reaches gitlab and slack: through which proxy, and trusting which CAs.
+package httpsettings
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+
+	"github.com/gorilla/websocket"
+)
+
+// Settings is how to reach one of the services we talk to.  the zero value is net/http's defaults, including
+// the HTTPS_PROXY/HTTP_PROXY/NO_PROXY environment variables
+type Settings struct {
+	// proxy, if set, is used for every request instead of the proxy environment variables
+	proxy *url.URL
+	// roots are the trusted CAs: the system's, plus the CA bundle if one was given
+	roots *x509.CertPool
+	// InsecureSkipVerify turns off TLS certificate verification
+	InsecureSkipVerify bool
+}
+
+// FromEnv reads the proxy, CA bundle (a PEM file) and insecure-skip-verify environment variables
+func FromEnv(proxyVar, caBundleVar, insecureVar string) (Settings, error) {
+	var s Settings
+	if proxy := os.Getenv(proxyVar); proxy != "" {
+		u, err := url.Parse(proxy)
+		if err != nil {
+			return s, fmt.Errorf("invalid %s: %v", proxyVar, err)
+		}
+		s.proxy = u
+	}
+	if path := os.Getenv(caBundleVar); path != "" {
+		pem, err := ioutil.ReadFile(path)
+		if err != nil {
+			return s, fmt.Errorf("failed to read %s: %v", caBundleVar, err)
+		}
+		if s.roots, err = x509.SystemCertPool(); err != nil {
+			s.roots = x509.NewCertPool()
+		}
+		if !s.roots.AppendCertsFromPEM(pem) {
+			return s, fmt.Errorf("%s has no PEM certificates", path)
+		}
+	}
+	s.InsecureSkipVerify, _ = strconv.ParseBool(os.Getenv(insecureVar))
+	return s, nil
+}
+
+func (s Settings) proxyFunc() func(*http.Request) (*url.URL, error) {
+	if s.proxy != nil {
+		return http.ProxyURL(s.proxy)
+	}
+	return http.ProxyFromEnvironment
+}
+
+func (s Settings) tlsConfig() *tls.Config {
+	return &tls.Config{RootCAs: s.roots, InsecureSkipVerify: s.InsecureSkipVerify}
+}
+
+// Client builds an HTTP client with the settings
+func (s Settings) Client() *http.Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = s.proxyFunc()
+	transport.TLSClientConfig = s.tlsConfig()
+	return &http.Client{Transport: transport}
+}
+
+// Dialer builds a websocket dialer with the settings, for slack's RTM connection
+func (s Settings) Dialer() *websocket.Dialer {
+	d := *websocket.DefaultDialer
+	d.Proxy = s.proxyFunc()
+	d.TLSClientConfig = s.tlsConfig()
+	return &d
+}
@@ -0,0 +1,65 @@
+package httpsettings
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFromEnv(t *testing.T) {
+	notPEM := filepath.Join(t.TempDir(), "bundle.pem")
+	if err := os.WriteFile(notPEM, []byte("not a certificate"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name         string
+		proxy        string
+		caBundle     string
+		insecure     string
+		wantErr      bool
+		wantProxy    string
+		wantInsecure bool
+	}{
+		{name: "defaults"},
+		{name: "proxy", proxy: "http://proxy.example:3128", wantProxy: "http://proxy.example:3128"},
+		{name: "insecure", insecure: "true", wantInsecure: true},
+		{name: "missing CA bundle", caBundle: filepath.Join(t.TempDir(), "missing.pem"), wantErr: true},
+		{name: "CA bundle without certificates", caBundle: notPEM, wantErr: true},
+		{name: "invalid proxy", proxy: "http://[::1", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("TEST_PROXY", tt.proxy)
+			t.Setenv("TEST_CA_BUNDLE", tt.caBundle)
+			t.Setenv("TEST_INSECURE", tt.insecure)
+
+			s, err := FromEnv("TEST_PROXY", "TEST_CA_BUNDLE", "TEST_INSECURE")
+
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("FromEnv() error = %v, want error %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if s.InsecureSkipVerify != tt.wantInsecure {
+				t.Errorf("InsecureSkipVerify = %v, want %v", s.InsecureSkipVerify, tt.wantInsecure)
+			}
+			transport := s.Client().Transport.(*http.Transport)
+			if transport.TLSClientConfig.InsecureSkipVerify != tt.wantInsecure {
+				t.Errorf("the client's InsecureSkipVerify = %v, want %v", transport.TLSClientConfig.InsecureSkipVerify, tt.wantInsecure)
+			}
+			req, _ := http.NewRequest(http.MethodGet, "https://gitlab.example", nil)
+			proxy, err := transport.Proxy(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.wantProxy != "" && (proxy == nil || proxy.String() != tt.wantProxy) {
+				t.Errorf("the client's proxy = %v, want %s", proxy, tt.wantProxy)
+			}
+			if d := s.Dialer(); d.TLSClientConfig.InsecureSkipVerify != tt.wantInsecure {
+				t.Errorf("the dialer's InsecureSkipVerify = %v, want %v", d.TLSClientConfig.InsecureSkipVerify, tt.wantInsecure)
+			}
+		})
+	}
+}
@@ -0,0 +1,163 @@
+// Package leader picks one of the bot's replicas to run its scheduled jobs, with a redis lock or a kubernetes lease.
+package leader
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/sirupsen/logrus"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/leaderelection"
+	"k8s.io/client-go/tools/leaderelection/resourcelock"
+)
+
+const (
+	// TTL is how long a leader keeps the lock or lease without renewing it, so how long the jobs can go without a
+	// leader after the leader dies
+	TTL = 15 * time.Second
+	// RETRY is how often the leader renews, and followers try to take over
+	RETRY = TTL / 3
+)
+
+// renewScript extends the lock only if this replica still holds it
+var renewScript = redis.NewScript(`
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("PEXPIRE", KEYS[1], ARGV[2])
+end
+return 0`)
+
+// Redis elects the replica holding a redis key, set with NX and a TTL and renewed while the replica lives
+type Redis struct {
+	client   *redis.Client
+	key      string
+	identity string
+
+	mu sync.Mutex
+	// until is when this replica's hold on the lock runs out, zero when it doesn't have it
+	until time.Time
+}
+
+// NewRedis campaigns for the key in the redis at url, e.g. `redis://:password@host:6379/0`, as identity
+func NewRedis(url, key, identity string) (*Redis, error) {
+	opts, err := redis.ParseURL(url)
+	if err != nil {
+		return nil, err
+	}
+	client := redis.NewClient(opts)
+	if err := client.Ping(context.Background()).Err(); err != nil {
+		return nil, err
+	}
+	r := &Redis{client: client, key: key, identity: identity}
+	go r.campaign()
+	return r, nil
+}
+
+// Leader reports whether this replica holds the lock
+func (r *Redis) Leader() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return time.Now().Before(r.until)
+}
+
+// campaign takes or renews the lock every RETRY, forever
+func (r *Redis) campaign() {
+	for {
+		r.try()
+		time.Sleep(RETRY)
+	}
+}
+
+func (r *Redis) try() {
+	ctx, cancel := context.WithTimeout(context.Background(), RETRY)
+	defer cancel()
+	// the hold is counted from before asking, so it can't outlast the key
+	start := time.Now()
+	leading := r.Leader()
+	var held bool
+	var err error
+	if leading {
+		var renewed int64
+		renewed, err = renewScript.Run(ctx, r.client, []string{r.key}, r.identity, TTL.Milliseconds()).Int64()
+		held = renewed == 1
+	} else {
+		held, err = r.client.SetNX(ctx, r.key, r.identity, TTL).Result()
+	}
+	if err != nil {
+		// keep what we had until it runs out, the next try may get through
+		logrus.WithError(err).Warn("failed to reach redis for leader election")
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	switch {
+	case held:
+		r.until = start.Add(TTL)
+		if !leading {
+			logrus.Infof("%s is now the leader, running scheduled jobs", r.identity)
+		}
+	case leading:
+		r.until = time.Time{}
+		logrus.Warnf("%s lost the leader lock, no longer running scheduled jobs", r.identity)
+	}
+}
+
+// Kubernetes elects the replica holding a coordination.k8s.io lease, through the API server the pod runs against
+type Kubernetes struct {
+	elector *leaderelection.LeaderElector
+}
+
+// NewKubernetes campaigns for the lease called name in the namespace as identity, normally the pod's name.  it needs
+// the in-cluster service account, with permission to get, create and update leases
+func NewKubernetes(namespace, name, identity string) (*Kubernetes, error) {
+	cfg, err := rest.InClusterConfig()
+	if err != nil {
+		return nil, err
+	}
+	client, err := kubernetes.NewForConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return newKubernetes(client, namespace, name, identity)
+}
+
+// newKubernetes is NewKubernetes through the client
+func newKubernetes(client kubernetes.Interface, namespace, name, identity string) (*Kubernetes, error) {
+	elector, err := leaderelection.NewLeaderElector(leaderelection.LeaderElectionConfig{
+		Lock: &resourcelock.LeaseLock{
+			LeaseMeta:  metav1.ObjectMeta{Name: name, Namespace: namespace},
+			Client:     client.CoordinationV1(),
+			LockConfig: resourcelock.ResourceLockConfig{Identity: identity},
+		},
+		LeaseDuration:   TTL,
+		RenewDeadline:   TTL * 2 / 3,
+		RetryPeriod:     RETRY / 2,
+		ReleaseOnCancel: true,
+		Callbacks: leaderelection.LeaderCallbacks{
+			OnStartedLeading: func(context.Context) {
+				logrus.Infof("%s is now the leader, running scheduled jobs", identity)
+			},
+			OnStoppedLeading: func() {
+				logrus.Warnf("%s lost the leader lease, no longer running scheduled jobs", identity)
+			},
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	// Run returns when the lease is lost, go back to campaigning for it
+	go func() {
+		for {
+			elector.Run(context.Background())
+		}
+	}()
+	return &Kubernetes{elector: elector}, nil
+}
+
+// Leader reports whether this replica holds the lease
+func (k *Kubernetes) Leader() bool {
+	return k.elector.IsLeader()
+}
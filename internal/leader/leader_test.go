@@ -0,0 +1,211 @@
+package leader
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+// fakeRedis serves just the commands Redis uses: GET, SET with NX and an expiry, and the renew script
+type fakeRedis struct {
+	listener net.Listener
+
+	mu      sync.Mutex
+	values  map[string]string
+	expires map[string]time.Time
+}
+
+func newFakeRedis(t *testing.T) *fakeRedis {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := &fakeRedis{listener: l, values: make(map[string]string), expires: make(map[string]time.Time)}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go r.serve(conn)
+		}
+	}()
+	return r
+}
+
+func (r *fakeRedis) client() *redis.Client {
+	return redis.NewClient(&redis.Options{Addr: r.listener.Addr().String(), MaxRetries: -1})
+}
+
+// get is the key's value, unless it's expired
+func (r *fakeRedis) get(key string) (string, bool) {
+	if at, ok := r.expires[key]; ok && !time.Now().Before(at) {
+		delete(r.values, key)
+		delete(r.expires, key)
+	}
+	v, ok := r.values[key]
+	return v, ok
+}
+
+// expire drops the key, as if its holder stopped renewing it
+func (r *fakeRedis) expire(key string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.values, key)
+	delete(r.expires, key)
+}
+
+func (r *fakeRedis) serve(conn net.Conn) {
+	defer conn.Close()
+	in := bufio.NewReader(conn)
+	for {
+		args, err := readCommand(in)
+		if err != nil {
+			return
+		}
+		r.mu.Lock()
+		reply := r.do(args)
+		r.mu.Unlock()
+		if _, err := io.WriteString(conn, reply); err != nil {
+			return
+		}
+	}
+}
+
+func (r *fakeRedis) do(args []string) string {
+	switch strings.ToLower(args[0]) {
+	case "ping":
+		return "+PONG\r\n"
+	case "get":
+		if v, ok := r.get(args[1]); ok {
+			return fmt.Sprintf("$%d\r\n%s\r\n", len(v), v)
+		}
+		return "$-1\r\n"
+	case "set": // set key value ex|px ttl nx
+		if _, ok := r.get(args[1]); ok {
+			return "$-1\r\n"
+		}
+		ttl, _ := strconv.Atoi(args[4])
+		unit := time.Second
+		if strings.EqualFold(args[3], "px") {
+			unit = time.Millisecond
+		}
+		r.values[args[1]] = args[2]
+		r.expires[args[1]] = time.Now().Add(time.Duration(ttl) * unit)
+		return "+OK\r\n"
+	case "evalsha":
+		return "-NOSCRIPT No matching script\r\n"
+	case "eval": // the renew script: eval script 1 key identity ttl
+		if v, ok := r.get(args[3]); !ok || v != args[4] {
+			return ":0\r\n"
+		}
+		ttl, _ := strconv.Atoi(args[5])
+		r.expires[args[3]] = time.Now().Add(time.Duration(ttl) * time.Millisecond)
+		return ":1\r\n"
+	}
+	return fmt.Sprintf("-ERR unknown command '%s'\r\n", args[0])
+}
+
+// readCommand reads a command sent as an array of bulk strings
+func readCommand(in *bufio.Reader) ([]string, error) {
+	line, err := in.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(strings.TrimPrefix(line, "*")))
+	if err != nil {
+		return nil, err
+	}
+	args := make([]string, n)
+	for i := range args {
+		if line, err = in.ReadString('\n'); err != nil {
+			return nil, err
+		}
+		size, err := strconv.Atoi(strings.TrimSpace(strings.TrimPrefix(line, "$")))
+		if err != nil {
+			return nil, err
+		}
+		b := make([]byte, size+2)
+		if _, err := io.ReadFull(in, b); err != nil {
+			return nil, err
+		}
+		args[i] = string(b[:size])
+	}
+	return args, nil
+}
+
+func TestRedis(t *testing.T) {
+	server := newFakeRedis(t)
+	a := &Redis{client: server.client(), key: "bot-leader", identity: "a"}
+	b := &Redis{client: server.client(), key: "bot-leader", identity: "b"}
+
+	a.try()
+	b.try()
+	if !a.Leader() || b.Leader() {
+		t.Fatalf("leaders a = %v, b = %v, want only a", a.Leader(), b.Leader())
+	}
+
+	// a renews its hold, and b keeps waiting
+	a.try()
+	b.try()
+	if !a.Leader() || b.Leader() {
+		t.Fatalf("after renewing, leaders a = %v, b = %v, want only a", a.Leader(), b.Leader())
+	}
+
+	// a's lock runs out, e.g. it was paused: b takes over, and a finds out when it next tries to renew
+	server.expire("bot-leader")
+	b.try()
+	a.try()
+	if a.Leader() || !b.Leader() {
+		t.Fatalf("after a's lock ran out, leaders a = %v, b = %v, want only b", a.Leader(), b.Leader())
+	}
+
+	// without redis, b keeps leading until its hold runs out
+	server.listener.Close()
+	b.client.Close()
+	b.client = server.client()
+	b.try()
+	if !b.Leader() {
+		t.Error("b stopped leading as soon as redis was unreachable")
+	}
+	b.mu.Lock()
+	b.until = time.Now()
+	b.mu.Unlock()
+	if b.Leader() {
+		t.Error("b is still leading after its hold ran out")
+	}
+}
+
+func TestKubernetes(t *testing.T) {
+	client := fake.NewSimpleClientset()
+	a, err := newKubernetes(client, "bots", "bot-leader", "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(10 * time.Second)
+	for !a.Leader() {
+		if time.Now().After(deadline) {
+			t.Fatal("a never took the lease")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	b, err := newKubernetes(client, "bots", "bot-leader", "b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(500 * time.Millisecond)
+	if b.Leader() || !a.Leader() {
+		t.Errorf("leaders a = %v, b = %v, want only a", a.Leader(), b.Leader())
+	}
+}
@@ -0,0 +1,203 @@
+// Package mrkdwn renders the GitLab flavored markdown people write in MR and issue descriptions as slack's mrkdwn, so
+// quoting them in slack shows links, code and lists rather than the raw markup.
+package mrkdwn
+
+import (
+	"regexp"
+	"strings"
+	"unicode/utf8"
+)
+
+const (
+	CHECKBOX_EMPTY   = "☐"
+	CHECKBOX_CHECKED = "☑"
+	BULLET           = "•"
+	ELLIPSIS         = "…"
+)
+
+var (
+	htmlComment = regexp.MustCompile(`(?s)<!--.*?-->`)
+	fence       = regexp.MustCompile("^\\s*(```|~~~)")
+	heading     = regexp.MustCompile(`^#{1,6}\s+(.*?)\s*#*$`)
+	quote       = regexp.MustCompile(`^>\s?`)
+	task        = regexp.MustCompile(`^(\s*)[-*+]\s+\[([ xX])\]\s+`)
+	bullet      = regexp.MustCompile(`^(\s*)[-*+]\s+`)
+	rule        = regexp.MustCompile(`^\s*([-*_])(\s*[-*_]){2,}\s*$`)
+	image       = regexp.MustCompile(`!\[([^\]]*)\]\(([^)\s]+)[^)]*\)`)
+	link        = regexp.MustCompile(`\[([^\]]+)\]\(([^)\s]+)[^)]*\)`)
+	bold        = regexp.MustCompile(`\*\*(\S(?:.*?\S)?)\*\*|__(\S(?:.*?\S)?)__`)
+	italic      = regexp.MustCompile(`\*(\S(?:[^*]*?\S)?)\*`)
+	strike      = regexp.MustCompile(`~~(\S(?:.*?\S)?)~~`)
+	escaper     = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;")
+)
+
+// Convert renders the markdown as mrkdwn.  relative links, like gitlab's `/uploads/...`, are made absolute with base,
+// the project's web URL
+func Convert(md, base string) string {
+	md = htmlComment.ReplaceAllString(strings.ReplaceAll(md, "\r\n", "\n"), "")
+	var out []string
+	inFence, blank := false, false
+	for _, line := range strings.Split(md, "\n") {
+		if fence.MatchString(line) {
+			inFence = !inFence
+			out = append(out, "```")
+			blank = false
+			continue
+		}
+		if inFence {
+			out = append(out, escaper.Replace(line))
+			continue
+		}
+		if strings.TrimSpace(line) == "" {
+			// runs of blank lines are one
+			if !blank && len(out) > 0 {
+				out = append(out, "")
+			}
+			blank = true
+			continue
+		}
+		blank = false
+		out = append(out, convertLine(line, base))
+	}
+	if inFence {
+		out = append(out, "```")
+	}
+	return strings.TrimSpace(strings.Join(out, "\n"))
+}
+
+// convertLine renders a line outside a code block
+func convertLine(line, base string) string {
+	switch {
+	case rule.MatchString(line):
+		return "———"
+	case heading.MatchString(line):
+		return "*" + inline(heading.FindStringSubmatch(line)[1], base) + "*"
+	case quote.MatchString(line):
+		return "> " + inline(quote.ReplaceAllString(line, ""), base)
+	case task.MatchString(line):
+		m := task.FindStringSubmatch(line)
+		box := CHECKBOX_EMPTY
+		if m[2] != " " {
+			box = CHECKBOX_CHECKED
+		}
+		return indent(m[1]) + box + " " + inline(line[len(m[0]):], base)
+	case bullet.MatchString(line):
+		m := bullet.FindStringSubmatch(line)
+		return indent(m[1]) + BULLET + " " + inline(line[len(m[0]):], base)
+	}
+	return inline(strings.TrimSpace(line), base)
+}
+
+// indent keeps a nested list item's depth.  slack collapses leading spaces, so it's kept with em spaces
+func indent(spaces string) string {
+	return strings.Repeat("\u2003", len(strings.ReplaceAll(spaces, "\t", "  "))/2)
+}
+
+// inline renders the line's links and emphasis, leaving its code spans as they are
+func inline(text, base string) string {
+	parts := strings.Split(text, "`")
+	for i := range parts {
+		parts[i] = escaper.Replace(parts[i])
+		// odd parts are inside a code span, unless the last backtick is unmatched
+		if i%2 == 1 && i < len(parts)-1 {
+			continue
+		}
+		parts[i] = image.ReplaceAllStringFunc(parts[i], func(m string) string {
+			sub := image.FindStringSubmatch(m)
+			alt := sub[1]
+			if alt == "" {
+				alt = "image"
+			}
+			return "<" + absolute(sub[2], base) + "|" + strings.ReplaceAll(alt, "|", "/") + ">"
+		})
+		parts[i] = link.ReplaceAllStringFunc(parts[i], func(m string) string {
+			sub := link.FindStringSubmatch(m)
+			return "<" + absolute(sub[2], base) + "|" + strings.ReplaceAll(sub[1], "|", "/") + ">"
+		})
+		// bold is marked with a placeholder so italics don't take its asterisks
+		parts[i] = bold.ReplaceAllString(parts[i], "\x00$1$2\x00")
+		parts[i] = italic.ReplaceAllString(parts[i], "_${1}_")
+		parts[i] = strings.ReplaceAll(parts[i], "\x00", "*")
+		parts[i] = strike.ReplaceAllString(parts[i], "~$1~")
+	}
+	return strings.Join(parts, "`")
+}
+
+// absolute resolves a link relative to the project
+func absolute(url, base string) string {
+	if strings.HasPrefix(url, "/") && base != "" {
+		return strings.TrimSuffix(base, "/") + url
+	}
+	return url
+}
+
+// Excerpt is Convert for the start of the markdown: at most max characters of mrkdwn, cut at the end of a line (or a
+// word, if that leaves too little) and never in the middle of a link, an entity like `&amp;`, a code span or a code
+// block
+func Excerpt(md, base string, max int) string {
+	text := Convert(md, base)
+	runes := []rune(text)
+	if len(runes) <= max {
+		return text
+	}
+	limit := len(string(runes[:max]))
+	ok := boundaries(text)
+	last := func(at func(i int) bool) int {
+		for i := limit; i > 0; i-- {
+			if ok[i] && at(i) {
+				return i
+			}
+		}
+		return 0
+	}
+	cut := last(func(i int) bool { return text[i] == '\n' })
+	if cut <= limit/2 {
+		if cut = last(func(i int) bool { return text[i] == ' ' }); cut == 0 {
+			cut = last(func(int) bool { return true })
+		}
+	}
+	excerpt := strings.TrimRight(text[:cut], " \n")
+	if strings.Count(excerpt, "```")%2 == 1 {
+		return excerpt + "\n" + ELLIPSIS + "\n```"
+	}
+	return excerpt + " " + ELLIPSIS
+}
+
+// boundaries marks the offsets text can be cut at: not inside a rune, a link, an entity or a code span
+func boundaries(text string) []bool {
+	ok := make([]bool, len(text)+1)
+	ok[len(text)] = true
+	inFence, start := false, 0
+	for _, line := range strings.SplitAfter(text, "\n") {
+		content := strings.TrimSuffix(line, "\n")
+		if content == "```" {
+			inFence = !inFence
+		}
+		// like inline, a line's last backtick is literal if it's unmatched
+		spans := strings.Count(content, "`") / 2 * 2
+		if inFence || content == "```" {
+			spans = 0
+		}
+		inCode, inLink, inEntity := false, false, false
+		for i := 0; i < len(line); i++ {
+			ok[start+i] = utf8.RuneStart(line[i]) && !inCode && !inLink && !inEntity
+			switch line[i] {
+			case '`':
+				if spans > 0 {
+					inCode = !inCode
+					spans--
+				}
+			case '<':
+				inLink = !inCode
+			case '>':
+				inLink = false
+			case '&':
+				inEntity = true
+			case ';':
+				inEntity = false
+			}
+		}
+		start += len(line)
+	}
+	return ok
+}
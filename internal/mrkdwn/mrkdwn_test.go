@@ -0,0 +1,67 @@
+package mrkdwn
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestConvert(t *testing.T) {
+	tests := []struct {
+		name string
+		md   string
+		want string
+	}{
+		{name: "link", md: "see [the docs](https://example.com/docs)", want: "see <https://example.com/docs|the docs>"},
+		{name: "relative link", md: "![screenshot](/uploads/abc/shot.png)", want: "<https://gitlab.example/team/app/uploads/abc/shot.png|screenshot>"},
+		{name: "link text with a pipe", md: "[a|b](https://example.com)", want: "<https://example.com|a/b>"},
+		{name: "bold", md: "this is **important**", want: "this is *important*"},
+		{name: "underscore bold", md: "this is __important__", want: "this is *important*"},
+		{name: "italic", md: "this is *subtle*", want: "this is _subtle_"},
+		{name: "bold and italic", md: "**loud** and *quiet*", want: "*loud* and _quiet_"},
+		{name: "strikethrough", md: "~~gone~~", want: "~gone~"},
+		{name: "code span", md: "run `make **all**` first", want: "run `make **all**` first"},
+		{name: "unmatched backtick", md: "a ` and **b**", want: "a ` and *b*"},
+		{name: "entities", md: "a < b && c > d", want: "a &lt; b &amp;&amp; c &gt; d"},
+		{name: "entities in code", md: "`a<b`", want: "`a&lt;b`"},
+		{name: "heading", md: "## Summary ##", want: "*Summary*"},
+		{name: "list", md: "- [ ] todo\n- [x] done\n  * nested", want: "☐ todo\n☑ done\n • nested"},
+		{name: "code block", md: "```go\nif a < b {}\n```", want: "```\nif a &lt; b {}\n```"},
+		{name: "comments and blank lines", md: "a<!-- hidden -->\n\n\n\nb", want: "a\n\nb"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Convert(tt.md, "https://gitlab.example/team/app"); got != tt.want {
+				t.Errorf("Convert(%q) = %q, want %q", tt.md, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestExcerpt(t *testing.T) {
+	tests := []struct {
+		name string
+		md   string
+		max  int
+		want string
+	}{
+		{name: "short", md: "fixes the build", max: 40, want: "fixes the build"},
+		{name: "at a line", md: "first line is long enough\nsecond line", max: 30, want: "first line is long enough …"},
+		{name: "at a word", md: "one two three four", max: 10, want: "one two …"},
+		{name: "not in a link", md: "see [the docs](https://example.com/docs) now", max: 20, want: "see …"},
+		{name: "not in an entity", md: "a&&&&&&&&", max: 10, want: "a&amp; …"},
+		{name: "not in a code span", md: "run `make all` first", max: 10, want: "run …"},
+		{name: "not in a code span without spaces", md: "x`make-all`", max: 6, want: "x …"},
+		{name: "in a code block", md: "```\nline one\nline two\n```", max: 16, want: "```\nline one\n…\n```"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := Excerpt(tt.md, "", tt.max)
+			if got != tt.want {
+				t.Errorf("Excerpt(%q, %d) = %q, want %q", tt.md, tt.max, got, tt.want)
+			}
+			if n := len([]rune(strings.TrimSuffix(strings.TrimSuffix(got, "\n```"), " "+ELLIPSIS))); n > tt.max {
+				t.Errorf("Excerpt(%q, %d) kept %d characters", tt.md, tt.max, n)
+			}
+		})
+	}
+}
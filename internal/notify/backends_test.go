@@ -0,0 +1,111 @@
+package notify
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/raidancampbell/gitlab-odds-and-ends/internal/store"
+	"github.com/slack-go/slack"
+)
+
+func TestMarkdown(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{"<https://gitlab.example/mr/1|!1 fix>", "[!1 fix](https://gitlab.example/mr/1)"},
+		{"see <https://gitlab.example>", "see https://gitlab.example"},
+		{"<@U0123> and <!here>", "@U0123 and @here"},
+		{"1 &lt; 2 &amp;&amp; 3 &gt; 2", "1 < 2 && 3 > 2"},
+	}
+	for _, tt := range tests {
+		if got := markdown(tt.in); got != tt.want {
+			t.Errorf("markdown(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestTeams(t *testing.T) {
+	var got map[string]string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := json.NewDecoder(r.Body).Decode(&got); err != nil {
+			t.Error(err)
+		}
+	}))
+	defer server.Close()
+	n := NewTeams(map[string]string{"backend": server.URL}, server.Client())
+
+	if _, err := n.Reply(TEAMS_CHANNEL_PREFIX+"backend", "1", "<https://gitlab.example/mr/1|!1> approved"); err != nil {
+		t.Fatal(err)
+	}
+	if got["text"] != "[!1](https://gitlab.example/mr/1) approved" {
+		t.Errorf("posted %+v, want the message in markdown", got)
+	}
+	if _, err := n.Notify(TEAMS_CHANNEL_PREFIX+"frontend", "hello"); err == nil {
+		t.Error("Notify() to an unconfigured channel succeeded")
+	}
+}
+
+func TestMattermostMentions(t *testing.T) {
+	n := &Mattermost{usernames: map[string]string{"U1": "alice"}}
+	if got, want := n.translate("<@U1> <@U2> <!here>"), "@alice @U2 @here"; got != want {
+		t.Errorf("translate() = %q, want %q", got, want)
+	}
+}
+
+func TestDiscordCard(t *testing.T) {
+	blocks := []slack.Block{
+		slack.NewSectionBlock(slack.NewTextBlockObject(slack.MarkdownType, "*<https://gitlab.example/mr/1|!1 fix>*", false, false),
+			[]*slack.TextBlockObject{slack.NewTextBlockObject(slack.MarkdownType, "*Author*\nalice", false, false)}, nil),
+	}
+	card := discordCard("fallback", blocks)
+	if card.Description != "*[!1 fix](https://gitlab.example/mr/1)*" {
+		t.Errorf("description = %q", card.Description)
+	}
+	if len(card.Fields) != 1 || card.Fields[0].Name != "Author" || card.Fields[0].Value != "alice" {
+		t.Errorf("fields = %+v, want the author", card.Fields)
+	}
+	if card := discordCard("<@U1> fallback", nil); card.Description != "@U1 fallback" {
+		t.Errorf("description without blocks = %q, want the fallback", card.Description)
+	}
+}
+
+func TestEmailDigests(t *testing.T) {
+	s, err := store.Open("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, err := NewEmail("localhost:0", "bot@example.com", nil, s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := n.Notify(EMAIL_CHANNEL_PREFIX+EMAIL_DIGEST_DAILY+":dev@example.com", "<https://gitlab.example/mr/1|!1> opened"); err != nil {
+		t.Fatal(err)
+	}
+
+	reloaded, err := NewEmail("localhost:0", "bot@example.com", nil, s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pending := reloaded.digests[EMAIL_DIGEST_DAILY]["dev@example.com"]
+	if len(pending) != 1 || pending[0].Text != "[!1](https://gitlab.example/mr/1) opened" {
+		t.Errorf("pending digest = %+v, want the message kept for the daily digest", pending)
+	}
+}
+
+func TestParseEmailChannel(t *testing.T) {
+	tests := []struct {
+		channel, digest, address string
+	}{
+		{"email:dev@example.com", "", "dev@example.com"},
+		{"email:hourly:dev@example.com", EMAIL_DIGEST_HOURLY, "dev@example.com"},
+		{"email:daily:dev@example.com", EMAIL_DIGEST_DAILY, "dev@example.com"},
+	}
+	for _, tt := range tests {
+		digest, address := parseEmailChannel(tt.channel)
+		if digest != tt.digest || address != tt.address {
+			t.Errorf("parseEmailChannel(%q) = %q, %q, want %q, %q", tt.channel, digest, address, tt.digest, tt.address)
+		}
+	}
+}
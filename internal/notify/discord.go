@@ -0,0 +1,191 @@
+package notify
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/slack-go/slack"
+)
+
+const (
+	// DISCORD_CHANNEL_PREFIX marks a channel as a Discord channel ID, e.g. `discord:123456789012345678`
+	DISCORD_CHANNEL_PREFIX = "discord:"
+	DISCORD_API            = "https://discord.com/api/v10"
+	// DISCORD_EMBED_COLOR is gitlab orange
+	DISCORD_EMBED_COLOR = 0xFC6D26
+)
+
+// discordEmoji are the unicode emoji for the slack reactions we use, since discord reacts with the emoji itself
+var discordEmoji = map[string]string{
+	"white_check_mark": "✅",
+	"tada":             "🎉",
+	"no_entry_sign":    "🚫",
+}
+
+type discordEmbed struct {
+	Description string              `json:"description,omitempty"`
+	Color       int                 `json:"color,omitempty"`
+	Fields      []discordEmbedField `json:"fields,omitempty"`
+}
+
+type discordEmbedField struct {
+	Name   string `json:"name"`
+	Value  string `json:"value"`
+	Inline bool   `json:"inline"`
+}
+
+type discordMessage struct {
+	Content   string            `json:"content,omitempty"`
+	Embeds    []discordEmbed    `json:"embeds,omitempty"`
+	Reference *discordReference `json:"message_reference,omitempty"`
+}
+
+type discordReference struct {
+	MessageID string `json:"message_id"`
+}
+
+// Discord posts to Discord channels as a bot.  the bot needs the Send Messages, Embed Links and Add Reactions
+// permissions in the channels.  message IDs stand in for slack timestamps, and replies reply to the message
+type Discord struct {
+	Token  string
+	Client *http.Client
+}
+
+// do sends a request to discord's API, decoding the response into v if it's set
+func (n Discord) do(method, path string, body, v interface{}) error {
+	var b []byte
+	if body != nil {
+		var err error
+		if b, err = json.Marshal(body); err != nil {
+			return err
+		}
+	}
+	req, err := http.NewRequest(method, DISCORD_API+path, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bot "+n.Token)
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := n.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("discord responded %s to %s %s", resp.Status, method, path)
+	}
+	if v != nil {
+		return json.NewDecoder(resp.Body).Decode(v)
+	}
+	return nil
+}
+
+func discordChannel(channel string) string {
+	return strings.TrimPrefix(channel, DISCORD_CHANNEL_PREFIX)
+}
+
+func (n Discord) send(channel string, msg discordMessage) (string, error) {
+	var sent struct {
+		ID string `json:"id"`
+	}
+	if err := n.do(http.MethodPost, "/channels/"+discordChannel(channel)+"/messages", msg, &sent); err != nil {
+		return "", err
+	}
+	return sent.ID, nil
+}
+
+// Notify sends the message as an embed card, which is how announcements like new MRs stand out from chatter
+func (n Discord) Notify(channel, msg string) (string, error) {
+	return n.send(channel, discordMessage{Embeds: []discordEmbed{discordCard(msg, nil)}})
+}
+
+// NotifyBlocks sends the message as an embed card.  sections become its description, and section fields
+// become inline embed fields.  buttons are dropped, since discord has no way to click them back to us
+func (n Discord) NotifyBlocks(channel, msg string, blocks []slack.Block) (string, error) {
+	return n.send(channel, discordMessage{Embeds: []discordEmbed{discordCard(msg, blocks)}})
+}
+
+func discordCard(msg string, blocks []slack.Block) discordEmbed {
+	embed := discordEmbed{Color: DISCORD_EMBED_COLOR}
+	var description []string
+	for _, block := range blocks {
+		switch b := block.(type) {
+		case *slack.SectionBlock:
+			if b.Text != nil {
+				description = append(description, markdown(b.Text.Text))
+			}
+			for _, f := range b.Fields {
+				name, value := "\u200b", markdown(f.Text) // discord needs a name, and slack fields don't have one
+				if parts := strings.SplitN(value, "\n", 2); len(parts) == 2 {
+					name, value = strings.Trim(parts[0], "*"), parts[1]
+				}
+				embed.Fields = append(embed.Fields, discordEmbedField{Name: name, Value: value, Inline: true})
+			}
+		case *slack.ContextBlock:
+			for _, e := range b.ContextElements.Elements {
+				if t, ok := e.(*slack.TextBlockObject); ok {
+					description = append(description, markdown(t.Text))
+				}
+			}
+		}
+	}
+	embed.Description = strings.Join(description, "\n")
+	if embed.Description == "" {
+		embed.Description = markdown(msg)
+	}
+	return embed
+}
+
+func (n Discord) Reply(channel, threadTS, msg string) (string, error) {
+	m := discordMessage{Content: markdown(msg)}
+	if threadTS != "" {
+		m.Reference = &discordReference{MessageID: threadTS}
+	}
+	return n.send(channel, m)
+}
+
+func (n Discord) Update(channel, ts, msg string, blocks []slack.Block) error {
+	m := discordMessage{Embeds: []discordEmbed{discordCard(msg, blocks)}}
+	return n.do(http.MethodPatch, "/channels/"+discordChannel(channel)+"/messages/"+ts, m, nil)
+}
+
+func (n Discord) reactionPath(channel, ts, emoji string) (string, bool) {
+	unicode, ok := discordEmoji[emoji]
+	if !ok || ts == "" {
+		return "", false
+	}
+	return "/channels/" + discordChannel(channel) + "/messages/" + ts + "/reactions/" + url.PathEscape(unicode) + "/@me", true
+}
+
+func (n Discord) React(channel, ts, emoji string) error {
+	path, ok := n.reactionPath(channel, ts, emoji)
+	if !ok {
+		return nil
+	}
+	return n.do(http.MethodPut, path, nil, nil)
+}
+
+func (n Discord) Unreact(channel, ts, emoji string) error {
+	path, ok := n.reactionPath(channel, ts, emoji)
+	if !ok {
+		return nil
+	}
+	return n.do(http.MethodDelete, path, nil, nil)
+}
+
+func (Discord) Unfurl(channel, ts string, unfurls map[string]slack.Attachment) error {
+	return nil
+}
+
+func (Discord) OpenModal(triggerID string, view slack.ModalViewRequest) error {
+	return nil
+}
+
+// Permalink is empty: discord links need the server's ID, which channel IDs don't tell us
+func (Discord) Permalink(channel, ts string) (string, error) {
+	return "", nil
+}
@@ -0,0 +1,187 @@
+package notify
+
+import (
+	"fmt"
+	"net/smtp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/raidancampbell/gitlab-odds-and-ends/internal/store"
+	"github.com/sirupsen/logrus"
+	"github.com/slack-go/slack"
+)
+
+const (
+	// EMAIL_CHANNEL_PREFIX marks a channel as an email address.  `email:hourly:<address>` and `email:daily:<address>`
+	// roll the address's messages up into a digest instead of sending each one
+	EMAIL_CHANNEL_PREFIX = "email:"
+	EMAIL_DIGEST_HOURLY  = "hourly"
+	EMAIL_DIGEST_DAILY   = "daily"
+	EMAIL_DIGESTS_KEY    = "email_digests"
+	// EMAIL_SUBJECT_LENGTH is how much of a message makes it into its email's subject
+	EMAIL_SUBJECT_LENGTH = 80
+)
+
+// DigestedMessage is a message waiting for its recipient's next digest, by email or DM
+type DigestedMessage struct {
+	At   time.Time `json:"at"`
+	Text string    `json:"text"`
+}
+
+// Email sends messages to email addresses over SMTP, either one email per message or in hourly or daily
+// digests.  pending digests are persisted, so a restart doesn't lose them.  emails can't be threaded, updated or
+// reacted to, so replies are sent as emails of their own and the rest is dropped
+type Email struct {
+	addr string
+	auth smtp.Auth
+	from string
+
+	store *store.Store
+	mu    sync.Mutex
+	// digests are the pending messages by digest (hourly or daily), then recipient
+	digests map[string]map[string][]DigestedMessage
+}
+
+// NewEmail sends from the address through the SMTP server at addr (host:port), authenticating if auth is set.  its
+// pending digests are kept in the store
+func NewEmail(addr, from string, auth smtp.Auth, s *store.Store) (*Email, error) {
+	n := &Email{addr: addr, auth: auth, from: from, store: s, digests: make(map[string]map[string][]DigestedMessage)}
+	if _, err := s.Load(EMAIL_DIGESTS_KEY, &n.digests); err != nil {
+		return nil, err
+	}
+	s.Follow(EMAIL_DIGESTS_KEY, &n.digests, &n.mu)
+	return n, nil
+}
+
+// parseEmailChannel splits a channel into its digest (empty to send right away) and address
+func parseEmailChannel(channel string) (digest, address string) {
+	address = strings.TrimPrefix(channel, EMAIL_CHANNEL_PREFIX)
+	for _, d := range []string{EMAIL_DIGEST_HOURLY, EMAIL_DIGEST_DAILY} {
+		if strings.HasPrefix(address, d+":") {
+			return d, strings.TrimPrefix(address, d+":")
+		}
+	}
+	return "", address
+}
+
+// mail sends one email
+func (n *Email) mail(to, subject, body string) error {
+	msg := strings.Join([]string{
+		"From: " + n.from,
+		"To: " + to,
+		"Subject: " + subject,
+		"Date: " + time.Now().Format(time.RFC1123Z),
+		"MIME-Version: 1.0",
+		"Content-Type: text/plain; charset=utf-8",
+		"",
+		strings.ReplaceAll(body, "\n", "\r\n"),
+	}, "\r\n")
+	return smtp.SendMail(n.addr, n.auth, n.from, []string{to}, []byte(msg))
+}
+
+// subject is the message's first line, shortened
+func subject(text string) string {
+	s := strings.TrimSpace(strings.SplitN(text, "\n", 2)[0])
+	if len(s) > EMAIL_SUBJECT_LENGTH {
+		s = s[:EMAIL_SUBJECT_LENGTH-3] + "..."
+	}
+	return s
+}
+
+func (n *Email) Notify(channel, msg string) (string, error) {
+	digest, address := parseEmailChannel(channel)
+	text := markdown(msg)
+	if digest == "" {
+		return "", n.mail(address, subject(text), text)
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.digests[digest] == nil {
+		n.digests[digest] = make(map[string][]DigestedMessage)
+	}
+	n.digests[digest][address] = append(n.digests[digest][address], DigestedMessage{At: time.Now(), Text: text})
+	n.saveLocked()
+	return "", nil
+}
+
+// saveLocked persists the pending digests.  n.mu must be held
+func (n *Email) saveLocked() {
+	if err := n.store.Save(EMAIL_DIGESTS_KEY, n.digests); err != nil {
+		logrus.WithError(err).Error("failed to persist email digests")
+	}
+}
+
+// Flush sends every recipient of the digest their pending messages.  recipients whose email fails keep theirs for next time
+func (n *Email) Flush(digest string) {
+	n.mu.Lock()
+	pending := n.digests[digest]
+	delete(n.digests, digest)
+	n.mu.Unlock()
+
+	var addresses []string
+	for address := range pending {
+		addresses = append(addresses, address)
+	}
+	sort.Strings(addresses)
+	failed := make(map[string][]DigestedMessage)
+	for _, address := range addresses {
+		messages := pending[address]
+		var body []string
+		for _, m := range messages {
+			body = append(body, m.At.Format("Mon Jan 2 15:04")+"  "+m.Text)
+		}
+		updates := "updates"
+		if len(messages) == 1 {
+			updates = "update"
+		}
+		subject := fmt.Sprintf("Your %s GitLab digest: %d %s", digest, len(messages), updates)
+		if err := n.mail(address, subject, strings.Join(body, "\n\n")); err != nil {
+			logrus.WithError(err).Errorf("failed to send %s digest to %s", digest, address)
+			failed[address] = messages
+		}
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	for address, messages := range failed {
+		if n.digests[digest] == nil {
+			n.digests[digest] = make(map[string][]DigestedMessage)
+		}
+		n.digests[digest][address] = append(messages, n.digests[digest][address]...)
+	}
+	n.saveLocked()
+}
+
+func (n *Email) NotifyBlocks(channel, msg string, blocks []slack.Block) (string, error) {
+	return n.Notify(channel, msg)
+}
+
+func (n *Email) Reply(channel, threadTS, msg string) (string, error) {
+	return n.Notify(channel, msg)
+}
+
+func (n *Email) Update(channel, ts, msg string, blocks []slack.Block) error {
+	return nil
+}
+
+func (n *Email) React(channel, ts, emoji string) error {
+	return nil
+}
+
+func (n *Email) Unreact(channel, ts, emoji string) error {
+	return nil
+}
+
+func (n *Email) Unfurl(channel, ts string, unfurls map[string]slack.Attachment) error {
+	return nil
+}
+
+func (n *Email) OpenModal(triggerID string, view slack.ModalViewRequest) error {
+	return nil
+}
+
+func (n *Email) Permalink(channel, ts string) (string, error) {
+	return "", nil
+}
@@ -0,0 +1,21 @@
+package notify
+
+import (
+	"regexp"
+	"strings"
+)
+
+var (
+	slackLink    = regexp.MustCompile(`<([^@!#|>][^|>]*)\|([^>]*)>`)
+	slackURL     = regexp.MustCompile(`<([^@!#|>][^|>]*)>`)
+	slackMention = regexp.MustCompile(`<[@!]([^|>]*)(\|[^>]*)?>`)
+)
+
+// markdown translates the slack markup in our messages into the markdown Teams and Discord render.  slack mentions
+// mean nothing there, so they're left as plain text
+func markdown(msg string) string {
+	msg = slackLink.ReplaceAllString(msg, "[$2]($1)")
+	msg = slackURL.ReplaceAllString(msg, "$1")
+	msg = slackMention.ReplaceAllString(msg, "@$1")
+	return strings.NewReplacer("&lt;", "<", "&gt;", ">", "&amp;", "&").Replace(msg)
+}
@@ -0,0 +1,143 @@
+package notify
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/slack-go/slack"
+)
+
+const (
+	// MATTERMOST_CHANNEL_PREFIX marks a channel as a Mattermost channel ID, e.g. `mattermost:4xp9fdt77pncbef59f4k1qe83o`
+	MATTERMOST_CHANNEL_PREFIX = "mattermost:"
+)
+
+// Mattermost posts to Mattermost channels as a bot account.  post IDs stand in for slack timestamps, so
+// threads, updates and reactions work like they do in slack.  slack mentions are turned into mattermost ones
+// for the users it knows
+type Mattermost struct {
+	baseURL string
+	token   string
+	client  *http.Client
+	// userID is the bot's own user ID, which reactions are made as
+	userID string
+	// usernames maps slack user IDs to mattermost usernames
+	usernames map[string]string
+}
+
+// NewMattermost logs in with the token to find out who the bot is.  usernames maps slack user IDs to mattermost
+// usernames, for mentions
+func NewMattermost(baseURL, token string, usernames map[string]string, client *http.Client) (*Mattermost, error) {
+	n := &Mattermost{baseURL: strings.TrimSuffix(baseURL, "/"), token: token, client: client, usernames: usernames}
+	var me struct {
+		ID string `json:"id"`
+	}
+	if err := n.do(http.MethodGet, "/users/me", nil, &me); err != nil {
+		return nil, fmt.Errorf("failed to log in to mattermost: %v", err)
+	}
+	n.userID = me.ID
+	return n, nil
+}
+
+// do sends a request to mattermost's API, decoding the response into v if it's set
+func (n *Mattermost) do(method, path string, body, v interface{}) error {
+	var b []byte
+	if body != nil {
+		var err error
+		if b, err = json.Marshal(body); err != nil {
+			return err
+		}
+	}
+	req, err := http.NewRequest(method, n.baseURL+"/api/v4"+path, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+n.token)
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("mattermost responded %s to %s %s", resp.Status, method, path)
+	}
+	if v != nil {
+		return json.NewDecoder(resp.Body).Decode(v)
+	}
+	return nil
+}
+
+// translate turns the slack markup in a message into mattermost markdown, mapping mentions of known users
+func (n *Mattermost) translate(msg string) string {
+	msg = slackMention.ReplaceAllStringFunc(msg, func(mention string) string {
+		id := slackMention.FindStringSubmatch(mention)[1]
+		switch id {
+		case "here", "channel":
+			return "@" + id
+		}
+		if username, ok := n.usernames[id]; ok {
+			return "@" + username
+		}
+		return mention
+	})
+	return markdown(msg)
+}
+
+func (n *Mattermost) post(channel, rootID, msg string) (string, error) {
+	body := map[string]string{
+		"channel_id": strings.TrimPrefix(channel, MATTERMOST_CHANNEL_PREFIX),
+		"message":    n.translate(msg),
+		"root_id":    rootID,
+	}
+	var sent struct {
+		ID string `json:"id"`
+	}
+	if err := n.do(http.MethodPost, "/posts", body, &sent); err != nil {
+		return "", err
+	}
+	return sent.ID, nil
+}
+
+func (n *Mattermost) Notify(channel, msg string) (string, error) {
+	return n.post(channel, "", msg)
+}
+
+// NotifyBlocks sends the fallback text: mattermost can't click buttons back to us
+func (n *Mattermost) NotifyBlocks(channel, msg string, blocks []slack.Block) (string, error) {
+	return n.post(channel, "", msg)
+}
+
+func (n *Mattermost) Reply(channel, threadTS, msg string) (string, error) {
+	return n.post(channel, threadTS, msg)
+}
+
+func (n *Mattermost) Update(channel, ts, msg string, blocks []slack.Block) error {
+	return n.do(http.MethodPut, "/posts/"+ts+"/patch", map[string]string{"message": n.translate(msg)}, nil)
+}
+
+// React uses the slack emoji name, which mattermost shares for the ones we use
+func (n *Mattermost) React(channel, ts, emoji string) error {
+	return n.do(http.MethodPost, "/reactions", map[string]string{"user_id": n.userID, "post_id": ts, "emoji_name": emoji}, nil)
+}
+
+func (n *Mattermost) Unreact(channel, ts, emoji string) error {
+	return n.do(http.MethodDelete, "/users/"+n.userID+"/posts/"+ts+"/reactions/"+url.PathEscape(emoji), nil, nil)
+}
+
+func (n *Mattermost) Unfurl(channel, ts string, unfurls map[string]slack.Attachment) error {
+	return nil
+}
+
+func (n *Mattermost) OpenModal(triggerID string, view slack.ModalViewRequest) error {
+	return nil
+}
+
+// Permalink uses mattermost's redirect, since post links otherwise need the team's name
+func (n *Mattermost) Permalink(channel, ts string) (string, error) {
+	return n.baseURL + "/_redirect/pl/" + ts, nil
+}
@@ -0,0 +1,245 @@
+// Package notify is where the bot sends its messages: slack, and other chat backends by channel prefix.
+package notify
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+	"github.com/slack-go/slack"
+)
+
+// Notifier is where the bot sends its messages.
+// Sending returns the message's timestamp, which slack uses to identify messages within a channel.
+type Notifier interface {
+	// Notify sends a plain text message to the channel
+	Notify(channel, msg string) (string, error)
+	// NotifyBlocks sends a block kit message to the channel.  msg is the fallback text shown in notifications
+	NotifyBlocks(channel, msg string, blocks []slack.Block) (string, error)
+	// Reply sends a plain text message to the thread started by the message with timestamp threadTS
+	Reply(channel, threadTS, msg string) (string, error)
+	// Update replaces the text (and blocks, if any) of a message we sent
+	Update(channel, ts, msg string, blocks []slack.Block) error
+	// React adds an emoji reaction (by name, without colons) to the message
+	React(channel, ts, emoji string) error
+	// Unreact removes an emoji reaction previously added with React
+	Unreact(channel, ts, emoji string) error
+	// Unfurl attaches previews to the links (keyed by URL) in someone else's message
+	Unfurl(channel, ts string, unfurls map[string]slack.Attachment) error
+	// OpenModal shows a modal to the user whose interaction gave us the trigger ID
+	OpenModal(triggerID string, view slack.ModalViewRequest) error
+	// Permalink returns a link to the message
+	Permalink(channel, ts string) (string, error)
+}
+
+// slack's errors for channels the bot can't post to
+const (
+	SLACK_ERROR_NOT_IN_CHANNEL    = "not_in_channel"
+	SLACK_ERROR_CHANNEL_NOT_FOUND = "channel_not_found"
+)
+
+// Slack sends messages through slack's web API
+type Slack struct {
+	RTM *slack.RTM
+}
+
+func (n Slack) Notify(channel, msg string) (string, error) {
+	return n.post(channel, slack.MsgOptionText(msg, false))
+}
+
+func (n Slack) NotifyBlocks(channel, msg string, blocks []slack.Block) (string, error) {
+	return n.post(channel, slack.MsgOptionText(msg, false), slack.MsgOptionBlocks(blocks...))
+}
+
+func (n Slack) Reply(channel, threadTS, msg string) (string, error) {
+	return n.post(channel, slack.MsgOptionText(msg, false), slack.MsgOptionTS(threadTS))
+}
+
+// post sends the message.  if the bot isn't in the channel it joins it and tries again, which works for public
+// channels with the channels:join scope.  private channels (which slack reports as not found to anyone outside them)
+// can't be joined, the bot has to be invited, and then posting to them works like any other
+func (n Slack) post(channel string, options ...slack.MsgOption) (string, error) {
+	_, ts, err := n.RTM.PostMessage(channel, options...)
+	if err == nil || (err.Error() != SLACK_ERROR_NOT_IN_CHANNEL && err.Error() != SLACK_ERROR_CHANNEL_NOT_FOUND) {
+		return ts, err
+	}
+	if _, _, _, joinErr := n.RTM.JoinConversation(channel); joinErr != nil {
+		return "", fmt.Errorf("the bot isn't in slack channel %s and can't join it (%v).  if the channel is private, invite the bot to it with `/invite`", channel, joinErr)
+	}
+	logrus.Infof("joined slack channel %s to post to it", channel)
+	_, ts, err = n.RTM.PostMessage(channel, options...)
+	return ts, err
+}
+
+func (n Slack) Update(channel, ts, msg string, blocks []slack.Block) error {
+	options := []slack.MsgOption{slack.MsgOptionText(msg, false)}
+	if blocks != nil {
+		options = append(options, slack.MsgOptionBlocks(blocks...))
+	}
+	_, _, _, err := n.RTM.UpdateMessage(channel, ts, options...)
+	return err
+}
+
+func (n Slack) React(channel, ts, emoji string) error {
+	return n.RTM.AddReaction(emoji, slack.NewRefToMessage(channel, ts))
+}
+
+func (n Slack) Unreact(channel, ts, emoji string) error {
+	return n.RTM.RemoveReaction(emoji, slack.NewRefToMessage(channel, ts))
+}
+
+func (n Slack) Unfurl(channel, ts string, unfurls map[string]slack.Attachment) error {
+	_, _, _, err := n.RTM.UnfurlMessage(channel, ts, unfurls)
+	return err
+}
+
+func (n Slack) OpenModal(triggerID string, view slack.ModalViewRequest) error {
+	_, err := n.RTM.OpenView(triggerID, view)
+	return err
+}
+
+func (n Slack) Permalink(channel, ts string) (string, error) {
+	return n.RTM.GetPermalink(&slack.PermalinkParameters{Channel: channel, Ts: ts})
+}
+
+// Noop drops every message.  used when no slack token is configured
+type Noop struct{}
+
+func (Noop) Notify(channel, msg string) (string, error) {
+	logrus.Debugf("slack disabled, dropping message for channel %s", channel)
+	return "", nil
+}
+
+func (Noop) NotifyBlocks(channel, msg string, blocks []slack.Block) (string, error) {
+	logrus.Debugf("slack disabled, dropping message for channel %s", channel)
+	return "", nil
+}
+
+func (Noop) Reply(channel, threadTS, msg string) (string, error) {
+	logrus.Debugf("slack disabled, dropping reply for thread %s in channel %s", threadTS, channel)
+	return "", nil
+}
+
+func (Noop) Update(channel, ts, msg string, blocks []slack.Block) error {
+	return nil
+}
+
+func (Noop) React(channel, ts, emoji string) error {
+	return nil
+}
+
+func (Noop) Unreact(channel, ts, emoji string) error {
+	return nil
+}
+
+func (Noop) Unfurl(channel, ts string, unfurls map[string]slack.Attachment) error {
+	return nil
+}
+
+func (Noop) OpenModal(triggerID string, view slack.ModalViewRequest) error {
+	return nil
+}
+
+func (Noop) Permalink(channel, ts string) (string, error) {
+	return "", nil
+}
+
+// DryRun logs what would have been sent instead of sending it
+type DryRun struct{}
+
+func (DryRun) Notify(channel, msg string) (string, error) {
+	logrus.Infof("dry run: would send message to slack channel %s: %s", channel, msg)
+	return "", nil
+}
+
+func (DryRun) NotifyBlocks(channel, msg string, blocks []slack.Block) (string, error) {
+	logrus.Infof("dry run: would send message with %d blocks to slack channel %s: %s", len(blocks), channel, msg)
+	return "", nil
+}
+
+func (DryRun) Reply(channel, threadTS, msg string) (string, error) {
+	logrus.Infof("dry run: would reply to thread %s in slack channel %s: %s", threadTS, channel, msg)
+	return "", nil
+}
+
+func (DryRun) Update(channel, ts, msg string, blocks []slack.Block) error {
+	logrus.Infof("dry run: would update message %s in slack channel %s to: %s", ts, channel, msg)
+	return nil
+}
+
+func (DryRun) React(channel, ts, emoji string) error {
+	logrus.Infof("dry run: would react with :%s: to message %s in slack channel %s", emoji, ts, channel)
+	return nil
+}
+
+func (DryRun) Unreact(channel, ts, emoji string) error {
+	logrus.Infof("dry run: would remove :%s: reaction from message %s in slack channel %s", emoji, ts, channel)
+	return nil
+}
+
+func (DryRun) Unfurl(channel, ts string, unfurls map[string]slack.Attachment) error {
+	logrus.Infof("dry run: would unfurl %d links in message %s in slack channel %s", len(unfurls), ts, channel)
+	return nil
+}
+
+func (DryRun) OpenModal(triggerID string, view slack.ModalViewRequest) error {
+	logrus.Infof("dry run: would open modal %s", view.CallbackID)
+	return nil
+}
+
+func (DryRun) Permalink(channel, ts string) (string, error) {
+	return "", nil
+}
+
+// Channels sends each channel's messages through the backend its prefix names, e.g. `teams:backend`.
+// unprefixed channels are slack's
+type Channels struct {
+	Slack    Notifier
+	Backends map[string]Notifier // by prefix, including the colon
+}
+
+func (n Channels) pick(channel string) Notifier {
+	for prefix, backend := range n.Backends {
+		if strings.HasPrefix(channel, prefix) {
+			return backend
+		}
+	}
+	return n.Slack
+}
+
+func (n Channels) Notify(channel, msg string) (string, error) {
+	return n.pick(channel).Notify(channel, msg)
+}
+
+func (n Channels) NotifyBlocks(channel, msg string, blocks []slack.Block) (string, error) {
+	return n.pick(channel).NotifyBlocks(channel, msg, blocks)
+}
+
+func (n Channels) Reply(channel, threadTS, msg string) (string, error) {
+	return n.pick(channel).Reply(channel, threadTS, msg)
+}
+
+func (n Channels) Update(channel, ts, msg string, blocks []slack.Block) error {
+	return n.pick(channel).Update(channel, ts, msg, blocks)
+}
+
+func (n Channels) React(channel, ts, emoji string) error {
+	return n.pick(channel).React(channel, ts, emoji)
+}
+
+func (n Channels) Unreact(channel, ts, emoji string) error {
+	return n.pick(channel).Unreact(channel, ts, emoji)
+}
+
+func (n Channels) Unfurl(channel, ts string, unfurls map[string]slack.Attachment) error {
+	return n.pick(channel).Unfurl(channel, ts, unfurls)
+}
+
+// OpenModal only happens for slack interactions
+func (n Channels) OpenModal(triggerID string, view slack.ModalViewRequest) error {
+	return n.Slack.OpenModal(triggerID, view)
+}
+
+func (n Channels) Permalink(channel, ts string) (string, error) {
+	return n.pick(channel).Permalink(channel, ts)
+}
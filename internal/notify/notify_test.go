@@ -0,0 +1,99 @@
+package notify
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/slack-go/slack"
+)
+
+func TestChannelsPicksBackendByPrefix(t *testing.T) {
+	tests := []struct {
+		channel string
+		want    string // which recorder gets it
+	}{
+		{"#general", "slack"},
+		{"C0123", "slack"},
+		{"teams:backend", "teams"},
+		{"email:dev@example.com", "email"},
+		{"teamsish", "slack"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.channel, func(t *testing.T) {
+			recorders := map[string]*Recorder{"slack": {}, "teams": {}, "email": {}}
+			n := Channels{
+				Slack:    recorders["slack"],
+				Backends: map[string]Notifier{"teams:": recorders["teams"], "email:": recorders["email"]},
+			}
+			if _, err := n.Notify(tt.channel, "hello"); err != nil {
+				t.Fatal(err)
+			}
+			for name, r := range recorders {
+				got := len(r.Of(KIND_NOTIFY))
+				want := 0
+				if name == tt.want {
+					want = 1
+				}
+				if got != want {
+					t.Errorf("%s got %d messages, want %d", name, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestChannelsOpensModalsOnSlack(t *testing.T) {
+	slackRec, teams := &Recorder{}, &Recorder{}
+	n := Channels{Slack: slackRec, Backends: map[string]Notifier{"teams:": teams}}
+	if err := n.OpenModal("trigger", modalView("issue")); err != nil {
+		t.Fatal(err)
+	}
+	if got := slackRec.Of(KIND_MODAL); len(got) != 1 || got[0].Text != "issue" {
+		t.Errorf("slack got modals %+v, want the issue modal", got)
+	}
+	if got := teams.Recorded(); len(got) != 0 {
+		t.Errorf("teams got %+v, want nothing", got)
+	}
+}
+
+func TestRecorder(t *testing.T) {
+	r := &Recorder{Fail: map[string]error{"#broken": errors.New("channel_not_found")}}
+
+	ts, err := r.Notify("#general", "new merge request")
+	if err != nil || ts != "1" {
+		t.Fatalf("Notify() = %q, %v, want the first timestamp", ts, err)
+	}
+	if _, err := r.Reply("#general", ts, "approved"); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.React("#general", ts, "tada"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.Notify("#broken", "lost"); err == nil {
+		t.Error("Notify() to a failing channel succeeded")
+	}
+
+	want := []Recorded{
+		{Kind: KIND_NOTIFY, Channel: "#general", TS: "1", Text: "new merge request"},
+		{Kind: KIND_REPLY, Channel: "#general", TS: "1", Text: "approved"},
+		{Kind: KIND_REACT, Channel: "#general", TS: "1", Text: "tada"},
+	}
+	got := r.Recorded()
+	if len(got) != len(want) {
+		t.Fatalf("recorded %+v, want %+v", got, want)
+	}
+	for i := range want {
+		if got[i].Kind != want[i].Kind || got[i].Channel != want[i].Channel || got[i].TS != want[i].TS || got[i].Text != want[i].Text {
+			t.Errorf("recorded[%d] = %+v, want %+v", i, got[i], want[i])
+		}
+	}
+
+	r.Reset()
+	if got := r.Recorded(); len(got) != 0 {
+		t.Errorf("recorded %+v after Reset, want nothing", got)
+	}
+}
+
+func modalView(callbackID string) slack.ModalViewRequest {
+	return slack.ModalViewRequest{Type: slack.VTModal, CallbackID: callbackID}
+}
@@ -0,0 +1,130 @@
+package notify
+
+import (
+	"strconv"
+	"sync"
+
+	"github.com/slack-go/slack"
+)
+
+// what a Recorder was asked to do, see Recorded.Kind
+const (
+	KIND_NOTIFY  = "notify"
+	KIND_BLOCKS  = "blocks"
+	KIND_REPLY   = "reply"
+	KIND_UPDATE  = "update"
+	KIND_REACT   = "react"
+	KIND_UNREACT = "unreact"
+	KIND_UNFURL  = "unfurl"
+	KIND_MODAL   = "modal"
+)
+
+// Recorded is one thing a Recorder was asked to do
+type Recorded struct {
+	Kind    string
+	Channel string
+	// TS is the timestamp of the message it's about: the one sent, or the one replied to, updated, reacted to, etc.
+	TS string
+	// Text is the message, or the emoji for reactions
+	Text   string
+	Blocks []slack.Block
+}
+
+// Recorder remembers what it's asked to send instead of sending it, so tests can check what the bot said.  messages
+// get timestamps "1", "2", and so on, in the order they're sent.  the zero Recorder is ready to use
+type Recorder struct {
+	// Fail makes sending to the channels fail with their errors
+	Fail map[string]error
+
+	mu       sync.Mutex
+	recorded []Recorded
+	sent     int
+}
+
+// Recorded returns everything the Recorder was asked to do so far, in order
+func (r *Recorder) Recorded() []Recorded {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]Recorded(nil), r.recorded...)
+}
+
+// Of returns what the Recorder was asked to do of the kind, e.g. KIND_REPLY
+func (r *Recorder) Of(kind string) []Recorded {
+	var of []Recorded
+	for _, rec := range r.Recorded() {
+		if rec.Kind == kind {
+			of = append(of, rec)
+		}
+	}
+	return of
+}
+
+// Reset forgets everything recorded so far
+func (r *Recorder) Reset() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.recorded = nil
+}
+
+// send records a new message, returning its timestamp
+func (r *Recorder) send(rec Recorded) (string, error) {
+	if err := r.Fail[rec.Channel]; err != nil {
+		return "", err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.sent++
+	ts := strconv.Itoa(r.sent)
+	if rec.Kind == KIND_NOTIFY || rec.Kind == KIND_BLOCKS {
+		rec.TS = ts
+	}
+	r.recorded = append(r.recorded, rec)
+	return ts, nil
+}
+
+// record records something done to an existing message
+func (r *Recorder) record(rec Recorded) error {
+	if err := r.Fail[rec.Channel]; err != nil {
+		return err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.recorded = append(r.recorded, rec)
+	return nil
+}
+
+func (r *Recorder) Notify(channel, msg string) (string, error) {
+	return r.send(Recorded{Kind: KIND_NOTIFY, Channel: channel, Text: msg})
+}
+
+func (r *Recorder) NotifyBlocks(channel, msg string, blocks []slack.Block) (string, error) {
+	return r.send(Recorded{Kind: KIND_BLOCKS, Channel: channel, Text: msg, Blocks: blocks})
+}
+
+func (r *Recorder) Reply(channel, threadTS, msg string) (string, error) {
+	return r.send(Recorded{Kind: KIND_REPLY, Channel: channel, TS: threadTS, Text: msg})
+}
+
+func (r *Recorder) Update(channel, ts, msg string, blocks []slack.Block) error {
+	return r.record(Recorded{Kind: KIND_UPDATE, Channel: channel, TS: ts, Text: msg, Blocks: blocks})
+}
+
+func (r *Recorder) React(channel, ts, emoji string) error {
+	return r.record(Recorded{Kind: KIND_REACT, Channel: channel, TS: ts, Text: emoji})
+}
+
+func (r *Recorder) Unreact(channel, ts, emoji string) error {
+	return r.record(Recorded{Kind: KIND_UNREACT, Channel: channel, TS: ts, Text: emoji})
+}
+
+func (r *Recorder) Unfurl(channel, ts string, unfurls map[string]slack.Attachment) error {
+	return r.record(Recorded{Kind: KIND_UNFURL, Channel: channel, TS: ts})
+}
+
+func (r *Recorder) OpenModal(triggerID string, view slack.ModalViewRequest) error {
+	return r.record(Recorded{Kind: KIND_MODAL, Text: view.CallbackID})
+}
+
+func (r *Recorder) Permalink(channel, ts string) (string, error) {
+	return "https://slack.example/" + channel + "/p" + ts, nil
+}
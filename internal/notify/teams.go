@@ -0,0 +1,80 @@
+package notify
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/slack-go/slack"
+)
+
+const (
+	// TEAMS_CHANNEL_PREFIX marks a channel as a Microsoft Teams channel, e.g. `teams:backend`
+	TEAMS_CHANNEL_PREFIX = "teams:"
+)
+
+// Teams posts to Microsoft Teams channels through their incoming webhooks.  webhooks can only post, so
+// replies become new messages, and updates, reactions and everything interactive are dropped
+type Teams struct {
+	webhooks map[string]string // by channel name, without the prefix
+	client   *http.Client
+}
+
+// NewTeams posts to the channels' incoming webhooks, by channel name
+func NewTeams(webhooks map[string]string, client *http.Client) Teams {
+	return Teams{webhooks: webhooks, client: client}
+}
+
+func (n Teams) Notify(channel, msg string) (string, error) {
+	webhook, ok := n.webhooks[strings.TrimPrefix(channel, TEAMS_CHANNEL_PREFIX)]
+	if !ok {
+		return "", fmt.Errorf("no teams channel named '%s' is configured", channel)
+	}
+	body, err := json.Marshal(map[string]string{"text": markdown(msg)})
+	if err != nil {
+		return "", err
+	}
+	resp, err := n.client.Post(webhook, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("teams webhook responded %s", resp.Status)
+	}
+	return "", nil
+}
+
+func (n Teams) NotifyBlocks(channel, msg string, blocks []slack.Block) (string, error) {
+	return n.Notify(channel, msg)
+}
+
+func (n Teams) Reply(channel, threadTS, msg string) (string, error) {
+	return n.Notify(channel, msg)
+}
+
+func (Teams) Update(channel, ts, msg string, blocks []slack.Block) error {
+	return nil
+}
+
+func (Teams) React(channel, ts, emoji string) error {
+	return nil
+}
+
+func (Teams) Unreact(channel, ts, emoji string) error {
+	return nil
+}
+
+func (Teams) Unfurl(channel, ts string, unfurls map[string]slack.Attachment) error {
+	return nil
+}
+
+func (Teams) OpenModal(triggerID string, view slack.ModalViewRequest) error {
+	return nil
+}
+
+func (Teams) Permalink(channel, ts string) (string, error) {
+	return "", nil
+}
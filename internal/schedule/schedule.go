@@ -0,0 +1,114 @@
+// Package schedule runs the bot's periodic jobs.
+package schedule
+
+import (
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Scheduler runs jobs, each on its own interval.  jobs are registered before Start is called
+type Scheduler struct {
+	jobs []scheduledJob
+	// elector, if set, picks the one replica that runs the jobs, see Elect
+	elector Elector
+}
+
+// Elector tells whether this replica is the leader, the one that should run the jobs
+type Elector interface {
+	Leader() bool
+}
+
+type scheduledJob struct {
+	name  string
+	every time.Duration
+	// next, if set, is when the job runs next after the given time, instead of every
+	next func(time.Time) time.Time
+	run  func()
+	// everyReplica jobs run on followers too, see EveryReplica
+	everyReplica bool
+}
+
+// New returns a scheduler without jobs
+func New() *Scheduler {
+	return &Scheduler{}
+}
+
+// Every registers fn to run once per interval, starting one interval after the scheduler starts
+func (s *Scheduler) Every(name string, interval time.Duration, fn func()) {
+	s.jobs = append(s.jobs, scheduledJob{name: name, every: interval, run: fn})
+}
+
+// EveryReplica is Every for jobs that keep something up to date on each replica, e.g. an in-memory cache, so they run
+// whether or not this replica is the leader
+func (s *Scheduler) EveryReplica(name string, interval time.Duration, fn func()) {
+	s.jobs = append(s.jobs, scheduledJob{name: name, every: interval, run: fn, everyReplica: true})
+}
+
+// Elect only runs jobs while the elector says this replica is the leader, so several replicas don't each send the same
+// digests and reminders.  it's called before Start
+func (s *Scheduler) Elect(e Elector) {
+	s.elector = e
+}
+
+// Daily registers fn to run every day at hour:minute in the timezone
+func (s *Scheduler) Daily(name string, hour, minute int, loc *time.Location, fn func()) {
+	s.jobs = append(s.jobs, scheduledJob{name: name, run: fn, next: func(now time.Time) time.Time {
+		now = now.In(loc)
+		due := time.Date(now.Year(), now.Month(), now.Day(), hour, minute, 0, 0, loc)
+		if !due.After(now) {
+			due = due.AddDate(0, 0, 1)
+		}
+		return due
+	}})
+}
+
+// Weekly registers fn to run every week on the weekday at hour:minute in the timezone
+func (s *Scheduler) Weekly(name string, weekday time.Weekday, hour, minute int, loc *time.Location, fn func()) {
+	s.jobs = append(s.jobs, scheduledJob{name: name, run: fn, next: func(now time.Time) time.Time {
+		now = now.In(loc)
+		due := time.Date(now.Year(), now.Month(), now.Day(), hour, minute, 0, 0, loc)
+		due = due.AddDate(0, 0, (int(weekday)-int(due.Weekday())+7)%7)
+		if !due.After(now) {
+			due = due.AddDate(0, 0, 7)
+		}
+		return due
+	}})
+}
+
+// Start runs each job in its own goroutine.  a job that panics is logged and tried again next interval
+func (s *Scheduler) Start() {
+	for _, job := range s.jobs {
+		if job.next != nil {
+			logrus.Infof("scheduling %s, first run at %s", job.name, job.next(time.Now()))
+			go func(job scheduledJob) {
+				for {
+					time.Sleep(time.Until(job.next(time.Now())))
+					s.runOnce(job)
+				}
+			}(job)
+			continue
+		}
+		logrus.Infof("scheduling %s every %s", job.name, job.every)
+		go func(job scheduledJob) {
+			for range time.Tick(job.every) {
+				s.runOnce(job)
+			}
+		}(job)
+	}
+}
+
+// runOnce runs the job, unless another replica is the leader
+func (s *Scheduler) runOnce(job scheduledJob) {
+	if s.elector != nil && !job.everyReplica && !s.elector.Leader() {
+		logrus.Debugf("skipping scheduled job %s, this replica isn't the leader", job.name)
+		return
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			logrus.Errorf("scheduled job %s panicked: %v", job.name, r)
+		}
+	}()
+	logrus.Debugf("running scheduled job %s", job.name)
+	job.run()
+}
@@ -0,0 +1,87 @@
+package schedule
+
+import (
+	"testing"
+	"time"
+)
+
+type elector bool
+
+func (e elector) Leader() bool { return bool(e) }
+
+func TestDailyNext(t *testing.T) {
+	loc := time.FixedZone("UTC-5", -5*60*60)
+	s := New()
+	s.Daily("digest", 9, 30, loc, func() {})
+	next := s.jobs[0].next
+	tests := []struct {
+		name string
+		now  time.Time
+		want time.Time
+	}{
+		{"later today", time.Date(2024, 5, 1, 8, 0, 0, 0, loc), time.Date(2024, 5, 1, 9, 30, 0, 0, loc)},
+		{"already ran today", time.Date(2024, 5, 1, 9, 30, 0, 0, loc), time.Date(2024, 5, 2, 9, 30, 0, 0, loc)},
+		{"in the job's timezone", time.Date(2024, 5, 1, 15, 0, 0, 0, time.UTC), time.Date(2024, 5, 2, 9, 30, 0, 0, loc)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := next(tt.now); !got.Equal(tt.want) {
+				t.Errorf("next(%s) = %s, want %s", tt.now, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWeeklyNext(t *testing.T) {
+	s := New()
+	s.Weekly("report", time.Monday, 10, 0, time.UTC, func() {})
+	next := s.jobs[0].next
+	tests := []struct {
+		name string
+		now  time.Time
+		want time.Time
+	}{
+		{"later this week", time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC), time.Date(2024, 5, 6, 10, 0, 0, 0, time.UTC)}, // a wednesday
+		{"later today", time.Date(2024, 5, 6, 9, 0, 0, 0, time.UTC), time.Date(2024, 5, 6, 10, 0, 0, 0, time.UTC)},
+		{"already ran today", time.Date(2024, 5, 6, 10, 0, 0, 0, time.UTC), time.Date(2024, 5, 13, 10, 0, 0, 0, time.UTC)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := next(tt.now); !got.Equal(tt.want) {
+				t.Errorf("next(%s) = %s, want %s", tt.now, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRunOnceOnlyOnTheLeader(t *testing.T) {
+	tests := []struct {
+		name         string
+		elector      Elector
+		everyReplica bool
+		want         bool
+	}{
+		{"without an elector", nil, false, true},
+		{"on the leader", elector(true), false, true},
+		{"on a follower", elector(false), false, false},
+		{"every replica job on a follower", elector(false), true, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := New()
+			if tt.elector != nil {
+				s.Elect(tt.elector)
+			}
+			ran := false
+			s.runOnce(scheduledJob{name: "job", run: func() { ran = true }, everyReplica: tt.everyReplica})
+			if ran != tt.want {
+				t.Errorf("ran = %v, want %v", ran, tt.want)
+			}
+		})
+	}
+}
+
+func TestRunOnceRecovers(t *testing.T) {
+	s := New()
+	s.runOnce(scheduledJob{name: "job", run: func() { panic("boom") }})
+}
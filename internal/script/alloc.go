@@ -0,0 +1,417 @@
+package script
+
+import (
+	"fmt"
+	"math"
+	"strings"
+
+	"go.starlark.net/starlark"
+	"go.starlark.net/syntax"
+)
+
+// starlark has no memory accounting of its own, and one step can build a value as big as starlark lets any value get,
+// e.g. `"x" * 1000000000` or `",".join(l)`.  so Compile rewrites the script for the operations that build values to
+// go through these builtins, which check what they'd build fits in what's left of the call's Limits.MaxAlloc before
+// building it, and charge the call for what they built
+const (
+	// callBuiltin calls a function, see checkedCall
+	callBuiltin = "_call"
+	// binaryBuiltin does a binary operation, see checkedBinary
+	binaryBuiltin = "_binary"
+	// operandBuiltin checks an augmented assignment, e.g. `x += y`, see checkedOperand
+	operandBuiltin = "_operand"
+	// countedBuiltin charges for a value that was built anyway, e.g. a slice, see counted
+	countedBuiltin = "_counted"
+
+	allocLocal = "alloc"
+)
+
+// growing are the binary operations that build a new value, bar comparisons and arithmetic on small numbers
+var growing = map[syntax.Token]bool{
+	syntax.PLUS:       true,
+	syntax.MINUS:      true,
+	syntax.STAR:       true,
+	syntax.PERCENT:    true,
+	syntax.PIPE:       true,
+	syntax.AMP:        true,
+	syntax.CIRCUMFLEX: true,
+	syntax.LTLT:       true,
+}
+
+// augmented are the assignments of the growing operations, e.g. `x += y`
+var augmented = map[syntax.Token]syntax.Token{
+	syntax.PLUS_EQ:       syntax.PLUS,
+	syntax.MINUS_EQ:      syntax.MINUS,
+	syntax.STAR_EQ:       syntax.STAR,
+	syntax.PERCENT_EQ:    syntax.PERCENT,
+	syntax.PIPE_EQ:       syntax.PIPE,
+	syntax.AMP_EQ:        syntax.AMP,
+	syntax.CIRCUMFLEX_EQ: syntax.CIRCUMFLEX,
+	syntax.LTLT_EQ:       syntax.LTLT,
+}
+
+// referencing are the builtins that return a value that already exists, so aren't charged for it
+var referencing = map[string]bool{
+	"get": true, "pop": true, "setdefault": true, "min": true, "max": true, "getattr": true,
+	// range's values are made as they're iterated
+	"range": true,
+}
+
+// allocBudget is what a call may still build, kept in its thread
+type allocBudget struct {
+	left int
+}
+
+func budgetOf(thread *starlark.Thread) *allocBudget {
+	b, _ := thread.Local(allocLocal).(*allocBudget)
+	return b
+}
+
+// check fails if something of size won't fit in the budget
+func (b *allocBudget) check(size int) error {
+	if b != nil && size > b.left {
+		return fmt.Errorf("script would build a value of size %d, over what's left of its allocation limit (%d)", size, b.left)
+	}
+	return nil
+}
+
+// charge takes size from the budget, failing once it's spent
+func (b *allocBudget) charge(size int) error {
+	if err := b.check(size); err != nil {
+		return err
+	}
+	if b != nil {
+		b.left -= size
+	}
+	return nil
+}
+
+// allocBuiltins are the builtins bound's rewrites call
+var allocBuiltins = starlark.StringDict{
+	callBuiltin:    starlark.NewBuiltin(callBuiltin, checkedCall),
+	binaryBuiltin:  starlark.NewBuiltin(binaryBuiltin, checkedBinary),
+	operandBuiltin: starlark.NewBuiltin(operandBuiltin, checkedOperand),
+	countedBuiltin: starlark.NewBuiltin(countedBuiltin, counted),
+}
+
+// bound rewrites the script so the operations that build values go through allocBuiltins: `f(x)` becomes
+// `_call(f, x)`, `x * y` becomes `_binary("*", x, y)`, `x += y` becomes `x += _operand("+", x, y)` and `x[a:b]` becomes
+// `_counted(x[a:b])`.  the target of an augmented assignment is evaluated twice
+func bound(f *syntax.File) {
+	rewritten := make(map[syntax.Expr]bool)
+	call := func(fn string, pos, end syntax.Position, args ...syntax.Expr) syntax.Expr {
+		c := &syntax.CallExpr{Fn: &syntax.Ident{NamePos: pos, Name: fn}, Lparen: pos, Args: args, Rparen: end}
+		rewritten[c] = true
+		return c
+	}
+	op := func(pos syntax.Position, tok syntax.Token) syntax.Expr {
+		return &syntax.Literal{Token: syntax.STRING, TokenPos: pos, Raw: fmt.Sprintf("%q", tok.String()), Value: tok.String()}
+	}
+	wrap := func(e *syntax.Expr) {
+		if *e == nil || rewritten[*e] {
+			return
+		}
+		switch x := (*e).(type) {
+		case *syntax.CallExpr:
+			*e = call(callBuiltin, x.Lparen, x.Rparen, append([]syntax.Expr{x.Fn}, x.Args...)...)
+		case *syntax.BinaryExpr:
+			if growing[x.Op] {
+				_, end := x.Span()
+				*e = call(binaryBuiltin, x.OpPos, end, op(x.OpPos, x.Op), x.X, x.Y)
+			}
+		case *syntax.SliceExpr:
+			rewritten[x] = true
+			*e = call(countedBuiltin, x.Lbrack, x.Rbrack, x)
+		}
+	}
+	syntax.Walk(f, func(n syntax.Node) bool {
+		switch n := n.(type) {
+		case *syntax.ExprStmt:
+			wrap(&n.X)
+		case *syntax.IfStmt:
+			wrap(&n.Cond)
+		case *syntax.AssignStmt:
+			if tok, ok := augmented[n.Op]; ok {
+				_, end := n.Span()
+				n.RHS = call(operandBuiltin, n.OpPos, end, op(n.OpPos, tok), n.LHS, n.RHS)
+			} else {
+				wrap(&n.RHS)
+			}
+		case *syntax.ForStmt:
+			wrap(&n.X)
+		case *syntax.WhileStmt:
+			wrap(&n.Cond)
+		case *syntax.ReturnStmt:
+			wrap(&n.Result)
+		case *syntax.ListExpr:
+			for i := range n.List {
+				wrap(&n.List[i])
+			}
+		case *syntax.TupleExpr:
+			for i := range n.List {
+				wrap(&n.List[i])
+			}
+		case *syntax.ParenExpr:
+			wrap(&n.X)
+		case *syntax.CondExpr:
+			wrap(&n.Cond)
+			wrap(&n.True)
+			wrap(&n.False)
+		case *syntax.IndexExpr:
+			wrap(&n.X)
+			wrap(&n.Y)
+		case *syntax.DictEntry:
+			wrap(&n.Key)
+			wrap(&n.Value)
+		case *syntax.SliceExpr:
+			wrap(&n.X)
+			wrap(&n.Lo)
+			wrap(&n.Hi)
+			wrap(&n.Step)
+		case *syntax.Comprehension:
+			wrap(&n.Body)
+		case *syntax.IfClause:
+			wrap(&n.Cond)
+		case *syntax.ForClause:
+			wrap(&n.X)
+		case *syntax.UnaryExpr:
+			wrap(&n.X)
+		case *syntax.BinaryExpr:
+			wrap(&n.X)
+			wrap(&n.Y)
+		case *syntax.DotExpr:
+			wrap(&n.X)
+		case *syntax.CallExpr:
+			for i := range n.Args {
+				wrap(&n.Args[i])
+			}
+		case *syntax.LambdaExpr:
+			wrap(&n.Body)
+		}
+		return true
+	})
+}
+
+// checkedCall is `fn(args...)`.  builtins are checked against estimateCall before they're called, and charged for what
+// they build, including what they add to their receiver, e.g. `l.extend(m)`.  the script's own functions are charged
+// for as they run
+func checkedCall(thread *starlark.Thread, _ *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	if len(args) == 0 {
+		return nil, fmt.Errorf("%s: missing function", callBuiltin)
+	}
+	fn, args := args[0], args[1:]
+	b, ok := fn.(*starlark.Builtin)
+	if !ok {
+		return starlark.Call(thread, fn, args, kwargs)
+	}
+	budget := budgetOf(thread)
+	if err := budget.check(estimateCall(b, args, kwargs)); err != nil {
+		return nil, err
+	}
+	recv := b.Receiver()
+	before := starlark.Len(recv)
+	result, err := starlark.Call(thread, fn, args, kwargs)
+	if err != nil {
+		return nil, err
+	}
+	built := 0
+	if !referencing[b.Name()] {
+		built = size(result)
+	}
+	if after := starlark.Len(recv); before >= 0 && after > before {
+		built += after - before
+	}
+	return result, budget.charge(built)
+}
+
+// estimateCall is the most a builtin call may build
+func estimateCall(b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) int {
+	if s, ok := b.Receiver().(starlark.String); ok {
+		switch b.Name() {
+		case "join":
+			if len(args) == 1 {
+				if seq, ok := args[0].(starlark.Sequence); ok {
+					n := mul(len(s), seq.Len())
+					iter := seq.Iterate()
+					defer iter.Done()
+					var elem starlark.Value
+					for iter.Next(&elem) {
+						n = add(n, size(elem))
+					}
+					return n
+				}
+			}
+		case "replace":
+			if len(args) >= 2 {
+				old, _ := starlark.AsString(args[0])
+				with, _ := starlark.AsString(args[1])
+				return add(len(s), mul(strings.Count(string(s), old), len(with)))
+			}
+		case "format":
+			return add(len(s), mul(strings.Count(string(s), "{"), largest(args, kwargs)))
+		}
+	}
+	// otherwise a builtin builds at most about as much as it's given, which already exists and was paid for, bar ranges:
+	// their values are made as they're iterated, so e.g. `list(range(n))` builds n values in one step
+	n := 0
+	for _, arg := range args {
+		if arg.Type() == "range" {
+			n = add(n, starlark.Len(arg))
+		}
+	}
+	return n
+}
+
+// checkedBinary is `x op y`
+func checkedBinary(thread *starlark.Thread, _ *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var op string
+	var x, y starlark.Value
+	if err := starlark.UnpackPositionalArgs(binaryBuiltin, args, kwargs, 3, &op, &x, &y); err != nil {
+		return nil, err
+	}
+	tok, err := operator(op)
+	if err != nil {
+		return nil, err
+	}
+	budget := budgetOf(thread)
+	if err := budget.check(estimateBinary(tok, x, y)); err != nil {
+		return nil, err
+	}
+	result, err := starlark.Binary(tok, x, y)
+	if err != nil {
+		return nil, err
+	}
+	return result, budget.charge(size(result))
+}
+
+// checkedOperand checks `x op= y`, returning y for the assignment to do the operation with
+func checkedOperand(thread *starlark.Thread, _ *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var op string
+	var x, y starlark.Value
+	if err := starlark.UnpackPositionalArgs(operandBuiltin, args, kwargs, 3, &op, &x, &y); err != nil {
+		return nil, err
+	}
+	tok, err := operator(op)
+	if err != nil {
+		return nil, err
+	}
+	// lists are extended in place, so that's all they build
+	if _, ok := x.(*starlark.List); ok && (tok == syntax.PLUS || tok == syntax.PIPE) {
+		return y, budgetOf(thread).charge(size(y))
+	}
+	return y, budgetOf(thread).charge(estimateBinary(tok, x, y))
+}
+
+// counted charges for a value that's already been built
+func counted(thread *starlark.Thread, _ *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var v starlark.Value
+	if err := starlark.UnpackPositionalArgs(countedBuiltin, args, kwargs, 1, &v); err != nil {
+		return nil, err
+	}
+	return v, budgetOf(thread).charge(size(v))
+}
+
+func operator(op string) (syntax.Token, error) {
+	for tok := range growing {
+		if tok.String() == op {
+			return tok, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown operator %q", op)
+}
+
+// estimateBinary is the most `x op y` may build
+func estimateBinary(op syntax.Token, x, y starlark.Value) int {
+	switch op {
+	case syntax.STAR:
+		// repetition
+		if n, ok := y.(starlark.Int); ok && starlark.Len(x) >= 0 {
+			return mul(size(x), repeats(n))
+		}
+		if n, ok := x.(starlark.Int); ok && starlark.Len(y) >= 0 {
+			return mul(size(y), repeats(n))
+		}
+	case syntax.PERCENT:
+		// formatting
+		if s, ok := x.(starlark.String); ok {
+			var args starlark.Tuple
+			if t, ok := y.(starlark.Tuple); ok {
+				args = t
+			} else {
+				args = starlark.Tuple{y}
+			}
+			var kwargs []starlark.Tuple
+			if d, ok := y.(*starlark.Dict); ok {
+				kwargs = d.Items()
+			}
+			return add(len(s), mul(strings.Count(string(s), "%"), largest(args, kwargs)))
+		}
+	case syntax.LTLT:
+		if n, ok := y.(starlark.Int); ok {
+			return add(size(x), repeats(n)/3)
+		}
+	}
+	return add(size(x), size(y))
+}
+
+// size is how big a value is: the bytes of strings, the elements of lists, tuples, dicts and sets, and roughly the
+// digits of ints
+func size(v starlark.Value) int {
+	switch v := v.(type) {
+	case starlark.String:
+		return len(v)
+	case starlark.Bytes:
+		return len(v)
+	case starlark.Int:
+		if _, ok := v.Int64(); ok {
+			return 0
+		}
+		return v.BigInt().BitLen() / 3
+	}
+	if n := starlark.Len(v); n >= 0 {
+		return n
+	}
+	return 0
+}
+
+// largest is the size of the biggest argument
+func largest(args starlark.Tuple, kwargs []starlark.Tuple) int {
+	n := 0
+	for _, arg := range args {
+		if s := size(arg); s > n {
+			n = s
+		}
+	}
+	for _, kv := range kwargs {
+		if s := size(kv[1]); s > n {
+			n = s
+		}
+	}
+	return n
+}
+
+// repeats is how many times `x * n` repeats x
+func repeats(n starlark.Int) int {
+	i, ok := n.Int64()
+	if !ok || i > math.MaxInt32 {
+		return math.MaxInt32
+	}
+	if i < 0 {
+		return 0
+	}
+	return int(i)
+}
+
+func add(a, b int) int {
+	if a > math.MaxInt-b {
+		return math.MaxInt
+	}
+	return a + b
+}
+
+func mul(a, b int) int {
+	if a != 0 && b > math.MaxInt/a {
+		return math.MaxInt
+	}
+	return a * b
+}
@@ -0,0 +1,229 @@
+// Package script runs the small Starlark scripts projects can configure for the routing and assignment decisions the
+// config file can't express.  scripts are sandboxed: they can't load other files or reach the file system or network,
+// and every call has a time, step and allocation budget.
+package script
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"go.starlark.net/starlark"
+	"go.starlark.net/syntax"
+)
+
+// Limits bound what a script may do per call
+type Limits struct {
+	// Timeout is how long a call may run before it's cancelled
+	Timeout time.Duration
+	// MaxSteps is how many starlark computation steps a call may take
+	MaxSteps uint64
+	// MaxAlloc is how much a call may build altogether, counting the bytes of strings, the elements of lists, tuples,
+	// dicts and sets, and roughly the digits of ints.  values are checked before they're built, so a single step like
+	// `"x" * 1000000000` fails instead of taking the memory
+	MaxAlloc int
+}
+
+// Script is a compiled script's top level.  its globals are frozen, so it's safe to call from many goroutines
+type Script struct {
+	name    string
+	globals starlark.StringDict
+	limits  Limits
+}
+
+// Compile runs the script's top level, e.g. the `def`s of the functions it provides, within the limits
+func Compile(name string, src []byte, limits Limits) (*Script, error) {
+	thread := newThread(name, limits)
+	stop := cancelAfter(thread, limits.Timeout)
+	defer stop()
+	f, err := syntax.LegacyFileOptions().Parse(name, src, 0)
+	if err != nil {
+		return nil, err
+	}
+	var predeclared starlark.StringDict
+	if limits.MaxAlloc > 0 {
+		bound(f)
+		predeclared = allocBuiltins
+	}
+	program, err := starlark.FileProgram(f, predeclared.Has)
+	if err != nil {
+		return nil, err
+	}
+	globals, err := program.Init(thread, predeclared)
+	globals.Freeze()
+	if err != nil {
+		return nil, describe(err)
+	}
+	return &Script{name: name, globals: globals, limits: limits}, nil
+}
+
+// Has reports whether the script defines the function
+func (s *Script) Has(fn string) bool {
+	_, ok := s.globals[fn].(starlark.Callable)
+	return ok
+}
+
+// Call calls the script's function with the arguments, which are JSON-like values: nil, bools, numbers, strings, and
+// slices and string-keyed maps of them.  the result comes back the same way
+func (s *Script) Call(fn string, args ...interface{}) (interface{}, error) {
+	callable, ok := s.globals[fn].(starlark.Callable)
+	if !ok {
+		return nil, fmt.Errorf("%s has no function %s", s.name, fn)
+	}
+	tuple := make(starlark.Tuple, len(args))
+	for i, arg := range args {
+		v, err := toStarlark(arg)
+		if err != nil {
+			return nil, err
+		}
+		v.Freeze()
+		tuple[i] = v
+	}
+	thread := newThread(s.name, s.limits)
+	stop := cancelAfter(thread, s.limits.Timeout)
+	defer stop()
+	result, err := starlark.Call(thread, callable, tuple, nil)
+	if err != nil {
+		return nil, describe(err)
+	}
+	return fromStarlark(result)
+}
+
+// newThread is a thread for one call: no loading other files, and print goes to the debug log
+func newThread(name string, limits Limits) *starlark.Thread {
+	thread := &starlark.Thread{
+		Name:  name,
+		Print: func(_ *starlark.Thread, msg string) { logrus.Debugf("%s: %s", name, msg) },
+		Load: func(_ *starlark.Thread, module string) (starlark.StringDict, error) {
+			return nil, fmt.Errorf("scripts can't load %s", module)
+		},
+	}
+	if limits.MaxSteps > 0 {
+		thread.SetMaxExecutionSteps(limits.MaxSteps)
+	}
+	if limits.MaxAlloc > 0 {
+		thread.SetLocal(allocLocal, &allocBudget{left: limits.MaxAlloc})
+	}
+	return thread
+}
+
+// cancelAfter cancels the thread once the timeout is up.  stop it once the call's done
+func cancelAfter(thread *starlark.Thread, timeout time.Duration) (stop func()) {
+	if timeout <= 0 {
+		return func() {}
+	}
+	timer := time.AfterFunc(timeout, func() { thread.Cancel(fmt.Sprintf("took longer than %s", timeout)) })
+	return func() { timer.Stop() }
+}
+
+// describe includes the script's backtrace in its errors
+func describe(err error) error {
+	if evalErr, ok := err.(*starlark.EvalError); ok {
+		return fmt.Errorf("%s", evalErr.Backtrace())
+	}
+	return err
+}
+
+func toStarlark(v interface{}) (starlark.Value, error) {
+	switch v := v.(type) {
+	case nil:
+		return starlark.None, nil
+	case bool:
+		return starlark.Bool(v), nil
+	case int:
+		return starlark.MakeInt(v), nil
+	case int64:
+		return starlark.MakeInt64(v), nil
+	case float64:
+		// JSON numbers are all floats; whole ones, like IDs, are ints to the script
+		if v == math.Trunc(v) && math.Abs(v) < 1<<53 {
+			return starlark.MakeInt64(int64(v)), nil
+		}
+		return starlark.Float(v), nil
+	case string:
+		return starlark.String(v), nil
+	case []string:
+		list := make([]starlark.Value, len(v))
+		for i, s := range v {
+			list[i] = starlark.String(s)
+		}
+		return starlark.NewList(list), nil
+	case []interface{}:
+		list := make([]starlark.Value, len(v))
+		for i, elem := range v {
+			sv, err := toStarlark(elem)
+			if err != nil {
+				return nil, err
+			}
+			list[i] = sv
+		}
+		return starlark.NewList(list), nil
+	case map[string]interface{}:
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		dict := starlark.NewDict(len(v))
+		for _, k := range keys {
+			sv, err := toStarlark(v[k])
+			if err != nil {
+				return nil, err
+			}
+			if err := dict.SetKey(starlark.String(k), sv); err != nil {
+				return nil, err
+			}
+		}
+		return dict, nil
+	}
+	return nil, fmt.Errorf("can't pass a %T to a script", v)
+}
+
+func fromStarlark(v starlark.Value) (interface{}, error) {
+	switch v := v.(type) {
+	case starlark.NoneType:
+		return nil, nil
+	case starlark.Bool:
+		return bool(v), nil
+	case starlark.Int:
+		i, ok := v.Int64()
+		if !ok {
+			return nil, fmt.Errorf("script returned an int too big for us, %s", v)
+		}
+		return i, nil
+	case starlark.Float:
+		return float64(v), nil
+	case starlark.String:
+		return string(v), nil
+	case *starlark.List, starlark.Tuple:
+		iter := starlark.Iterate(v)
+		defer iter.Done()
+		list := []interface{}{}
+		var elem starlark.Value
+		for iter.Next(&elem) {
+			gv, err := fromStarlark(elem)
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, gv)
+		}
+		return list, nil
+	case *starlark.Dict:
+		dict := make(map[string]interface{}, v.Len())
+		for _, item := range v.Items() {
+			k, ok := starlark.AsString(item[0])
+			if !ok {
+				return nil, fmt.Errorf("script returned a dict with a %s key, only strings are supported", item[0].Type())
+			}
+			gv, err := fromStarlark(item[1])
+			if err != nil {
+				return nil, err
+			}
+			dict[k] = gv
+		}
+		return dict, nil
+	}
+	return nil, fmt.Errorf("script returned a %s, which isn't supported", v.Type())
+}
@@ -0,0 +1,142 @@
+package script
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+var testLimits = Limits{Timeout: time.Second, MaxSteps: 100000, MaxAlloc: 100000}
+
+func TestCall(t *testing.T) {
+	s, err := Compile("route.star", []byte(`
+def route(event):
+    if "security" in event["labels"]:
+        return ["#appsec"] + event["channels"]
+    return event["channels"]
+`), testLimits)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !s.Has("route") || s.Has("assign") {
+		t.Errorf("Has() doesn't match the script's functions")
+	}
+
+	got, err := s.Call("route", map[string]interface{}{"labels": []string{"security"}, "channels": []interface{}{"#team"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []interface{}{"#appsec", "#team"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Call() = %#v, want %#v", got, want)
+	}
+	if _, err := s.Call("assign"); err == nil {
+		t.Error("Call() of a missing function succeeded")
+	}
+}
+
+func TestConversions(t *testing.T) {
+	s, err := Compile("echo.star", []byte("def echo(v):\n    return v\n"), testLimits)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name string
+		in   interface{}
+		want interface{}
+	}{
+		{"nil", nil, nil},
+		{"bool", true, true},
+		{"int", 7, int64(7)},
+		{"whole float is an int", float64(42), int64(42)},
+		{"float", 1.5, 1.5},
+		{"string", "hi", "hi"},
+		{"nested", map[string]interface{}{"ids": []interface{}{float64(1), "two"}}, map[string]interface{}{"ids": []interface{}{int64(1), "two"}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := s.Call("echo", tt.in)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Call() = %#v, want %#v", got, tt.want)
+			}
+		})
+	}
+	if _, err := s.Call("echo", struct{}{}); err == nil {
+		t.Error("Call() with an unsupported argument succeeded")
+	}
+}
+
+func TestAllocationBoundKeepsBehaviour(t *testing.T) {
+	s, err := Compile("everything.star", []byte(`
+def label(name, prefix="team"):
+    return "%s/%s" % (prefix, name)
+
+def route(event):
+    channels = []
+    same = channels
+    same += ["#" + event["team"]]
+    for l in sorted(event["labels"])[:2]:
+        channels.append(label(l, prefix=event["team"]))
+    counts = {l: len(l) for l in event["labels"] if l}
+    pick = lambda c: c.upper()
+    channels.extend([pick(c) for c in channels[:1]])
+    return same + ["{}:{}".format(k, counts[k]) for k in sorted(counts)] + [",".join(event["labels"]).replace(",", ";")]
+`), testLimits)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := s.Call("route", map[string]interface{}{"team": "core", "labels": []string{"ui", "api", "db"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []interface{}{"#core", "core/api", "core/db", "#CORE", "api:3", "db:2", "ui:2", "ui;api;db"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Call() = %#v, want %#v", got, want)
+	}
+}
+
+func TestArgumentsAreFrozen(t *testing.T) {
+	s, err := Compile("mutate.star", []byte("def mutate(l):\n    l.append(1)\n"), testLimits)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Call("mutate", []interface{}{}); err == nil || !strings.Contains(err.Error(), "frozen") {
+		t.Errorf("Call() error = %v, want the argument frozen", err)
+	}
+}
+
+func TestSandbox(t *testing.T) {
+	tests := []struct {
+		name    string
+		src     string
+		limits  Limits
+		wantErr string
+	}{
+		{"no loading", `load("other.star", "x")`, testLimits, "can't load"},
+		{"step budget", "def f():\n    for i in range(1000000):\n        pass\nf()\n", Limits{MaxSteps: 1000}, "too many steps"},
+		{"timeout", "def f():\n    for i in range(100000000):\n        pass\nf()\n", Limits{Timeout: 10 * time.Millisecond}, "took longer than"},
+		{"syntax error", "def f(:\n", testLimits, "want ')'"},
+		{"string repetition", `x = "x" * 1000000000`, testLimits, "allocation limit"},
+		{"list repetition", `x = 1000000000 * [0]`, testLimits, "allocation limit"},
+		{"augmented repetition", "def f():\n    x = [0]\n    x *= 1000000000\nf()\n", testLimits, "allocation limit"},
+		{"doubling", "def f():\n    s = 'x'\n    for i in range(40):\n        s += s\nf()\n", testLimits, "allocation limit"},
+		{"many small values", "def f():\n    l = []\n    for i in range(100):\n        l.append('y' * 10000)\nf()\n", testLimits, "allocation limit"},
+		{"range built whole", "x = list(range(1000000000))", testLimits, "allocation limit"},
+		{"join", "x = ('x' * 1000).join(['a'] * 1000)", testLimits, "allocation limit"},
+		{"replace", "x = ('x' * 1000).replace('', 'y' * 1000)", testLimits, "allocation limit"},
+		{"formatting", "x = ('%s' * 1000) % tuple(['y' * 1000] * 1000)", testLimits, "allocation limit"},
+		{"copies of slices", "def f():\n    s = 'x' * 50000\n    l = [s[1:] for i in range(10)]\nf()\n", testLimits, "allocation limit"},
+		{"big ints", "def f():\n    n = 3\n    for i in range(30):\n        n = n * n\nf()\n", testLimits, "allocation limit"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := Compile(tt.name+".star", []byte(tt.src), tt.limits)
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("Compile() error = %v, want it to mention %q", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,102 @@
+// Package slackauth checks that requests to the bot's slack endpoints come from slack.
+package slackauth
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	HEADER_SLACK_SIGNATURE = "X-Slack-Signature"
+	HEADER_SLACK_TIMESTAMP = "X-Slack-Request-Timestamp"
+	// SIGNATURE_VERSION is the only version of slack's signatures
+	SIGNATURE_VERSION = "v0"
+	// DEFAULT_MAX_AGE is how old slack says a request can be before it's treated as a replay
+	DEFAULT_MAX_AGE = 5 * time.Minute
+	// DEFAULT_MAX_BODY is the most of a request's body that's read, slack's own requests are far smaller
+	DEFAULT_MAX_BODY = 1 << 20
+)
+
+// Verifier checks slack's signature on requests, made with the app's signing secret, and that they aren't a captured
+// request being replayed
+type Verifier struct {
+	Secret string
+	// MaxAge is how old a request may be, either way, DEFAULT_MAX_AGE if it's zero
+	MaxAge time.Duration
+	// MaxBody is how many bytes a request's body may be, DEFAULT_MAX_BODY if it's zero
+	MaxBody int64
+}
+
+// Verify checks the request's timestamp and signature, returning the status to reject it with and why
+func (v Verifier) Verify(header http.Header, body []byte, now time.Time) (int, error) {
+	raw := header.Get(HEADER_SLACK_TIMESTAMP)
+	ts, err := strconv.ParseInt(raw, 10, 64)
+	if err != nil {
+		return http.StatusUnauthorized, fmt.Errorf("bad or missing %s header", HEADER_SLACK_TIMESTAMP)
+	}
+	maxAge := v.MaxAge
+	if maxAge == 0 {
+		maxAge = DEFAULT_MAX_AGE
+	}
+	at := time.Unix(ts, 0)
+	if age := now.Sub(at); age > maxAge || age < -maxAge {
+		return http.StatusUnauthorized, fmt.Errorf("request from %s is outside the %s window", at.Format(time.RFC3339), maxAge)
+	}
+
+	signature := header.Get(HEADER_SLACK_SIGNATURE)
+	if !strings.HasPrefix(signature, SIGNATURE_VERSION+"=") {
+		return http.StatusUnauthorized, fmt.Errorf("bad or missing %s header", HEADER_SLACK_SIGNATURE)
+	}
+	got, err := hex.DecodeString(strings.TrimPrefix(signature, SIGNATURE_VERSION+"="))
+	if err != nil {
+		return http.StatusUnauthorized, fmt.Errorf("bad %s header", HEADER_SLACK_SIGNATURE)
+	}
+	mac := hmac.New(sha256.New, []byte(v.Secret))
+	fmt.Fprintf(mac, "%s:%s:", SIGNATURE_VERSION, raw)
+	mac.Write(body)
+	if !hmac.Equal(got, mac.Sum(nil)) {
+		return http.StatusUnauthorized, fmt.Errorf("%s doesn't match", HEADER_SLACK_SIGNATURE)
+	}
+	return http.StatusOK, nil
+}
+
+// Middleware rejects requests Verify doesn't accept before they reach the handler, which gets the body as it came
+func (v Verifier) Middleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		maxBody := v.MaxBody
+		if maxBody == 0 {
+			maxBody = DEFAULT_MAX_BODY
+		}
+		body, err := ioutil.ReadAll(http.MaxBytesReader(c.Writer, c.Request.Body, maxBody))
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			logrus.Warnf("rejecting slack request to %s from %s, it's over %d bytes", c.Request.URL.Path, c.ClientIP(), maxBody)
+			c.AbortWithStatus(http.StatusRequestEntityTooLarge)
+			return
+		}
+		if err != nil {
+			logrus.WithError(err).Errorf("failed to read slack request to %s", c.Request.URL.Path)
+			c.AbortWithStatus(http.StatusBadRequest)
+			return
+		}
+		if status, err := v.Verify(c.Request.Header, body, time.Now()); err != nil {
+			logrus.WithError(err).Warnf("rejecting slack request to %s from %s", c.Request.URL.Path, c.ClientIP())
+			c.AbortWithStatus(status)
+			return
+		}
+		c.Request.Body = ioutil.NopCloser(bytes.NewReader(body))
+		c.Next()
+	}
+}
@@ -0,0 +1,108 @@
+package slackauth
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const secret = "8f742231b10e8888abcd99yyyzzz85a5"
+
+// sign is slack's signature of the body at the time, made with the secret
+func sign(secret, timestamp, body string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(SIGNATURE_VERSION + ":" + timestamp + ":" + body))
+	return SIGNATURE_VERSION + "=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func TestMiddleware(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	now := strconv.FormatInt(time.Now().Unix(), 10)
+	stale := strconv.FormatInt(time.Now().Add(-10*time.Minute).Unix(), 10)
+	body := "token=xyz&team_id=T1&command=%2Fmrs&text=mine"
+	large := strings.Repeat("x", 2048)
+	tests := []struct {
+		name      string
+		timestamp string
+		signature string
+		body      string
+		want      int
+	}{
+		{name: "valid", timestamp: now, signature: sign(secret, now, body), body: body, want: http.StatusOK},
+		{name: "signed with another secret", timestamp: now, signature: sign("guess", now, body), body: body, want: http.StatusUnauthorized},
+		{name: "tampered body", timestamp: now, signature: sign(secret, now, body), body: body + "&admin=1", want: http.StatusUnauthorized},
+		{name: "signature for another time", timestamp: now, signature: sign(secret, stale, body), body: body, want: http.StatusUnauthorized},
+		{name: "not hex", timestamp: now, signature: SIGNATURE_VERSION + "=zz", body: body, want: http.StatusUnauthorized},
+		{name: "another version", timestamp: now, signature: "v1=" + strings.TrimPrefix(sign(secret, now, body), "v0="), body: body, want: http.StatusUnauthorized},
+		{name: "stale", timestamp: stale, signature: sign(secret, stale, body), body: body, want: http.StatusUnauthorized},
+		{name: "missing signature", timestamp: now, body: body, want: http.StatusUnauthorized},
+		{name: "missing timestamp", signature: sign(secret, "", body), body: body, want: http.StatusUnauthorized},
+		{name: "oversized", timestamp: now, signature: sign(secret, now, large), body: large, want: http.StatusRequestEntityTooLarge},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got string
+			r := gin.New()
+			r.POST("/slack/commands", Verifier{Secret: secret, MaxBody: 1024}.Middleware(), func(c *gin.Context) {
+				b, _ := ioutil.ReadAll(c.Request.Body)
+				got = string(b)
+				c.Status(http.StatusOK)
+			})
+			req := httptest.NewRequest(http.MethodPost, "/slack/commands", strings.NewReader(tt.body))
+			if tt.timestamp != "" {
+				req.Header.Set(HEADER_SLACK_TIMESTAMP, tt.timestamp)
+			}
+			if tt.signature != "" {
+				req.Header.Set(HEADER_SLACK_SIGNATURE, tt.signature)
+			}
+			w := httptest.NewRecorder()
+
+			r.ServeHTTP(w, req)
+
+			if w.Code != tt.want {
+				t.Errorf("status = %d, want %d", w.Code, tt.want)
+			}
+			if tt.want == http.StatusOK && got != tt.body {
+				t.Errorf("handler got body %q, want %q", got, tt.body)
+			}
+			if tt.want != http.StatusOK && got != "" {
+				t.Error("handler ran for a rejected request")
+			}
+		})
+	}
+}
+
+func TestVerifyWindow(t *testing.T) {
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	v := Verifier{Secret: secret, MaxAge: time.Minute}
+	tests := []struct {
+		name string
+		at   time.Time
+		want int
+	}{
+		{name: "now", at: now, want: http.StatusOK},
+		{name: "within the window", at: now.Add(-59 * time.Second), want: http.StatusOK},
+		{name: "too old", at: now.Add(-61 * time.Second), want: http.StatusUnauthorized},
+		{name: "too far ahead", at: now.Add(61 * time.Second), want: http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ts := strconv.FormatInt(tt.at.Unix(), 10)
+			header := http.Header{}
+			header.Set(HEADER_SLACK_TIMESTAMP, ts)
+			header.Set(HEADER_SLACK_SIGNATURE, sign(secret, ts, "payload"))
+			if got, err := v.Verify(header, []byte("payload"), now); got != tt.want {
+				t.Errorf("Verify() = %d (%v), want %d", got, err, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,247 @@
+package store
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"reflect"
+	"strings"
+	"sync"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/sirupsen/logrus"
+)
+
+// savedChannel is where replicas announce the keys they save, as `<replica> <key>`
+const savedChannel = "saved"
+
+// redisState keeps the state in redis, one redis key per store key, so replicas share it.  replicas tell each other
+// about their saves, for keys they Follow.
+//
+// JSON objects are kept as redis hashes, one field per entry, and saves only write the entries that changed since this
+// replica last saw the key.  replicas saving different entries of the same key at about the same time then keep both,
+// instead of the last save undoing the other's
+type redisState struct {
+	client *redis.Client
+	prefix string
+	// replica tells this replica's saves apart from the others'
+	replica string
+
+	mu        sync.Mutex
+	followers map[string][]follower
+	// seen is each object key's entries as this replica last loaded or saved them, to tell what a save changed
+	seen map[string]map[string]json.RawMessage
+}
+
+// follower is a value kept up to date with a key, see Store.Follow, or a func to call when it changes, see Store.Watch
+type follower struct {
+	v       interface{}
+	mu      sync.Locker
+	changed func()
+}
+
+// OpenRedis keeps the state in the redis at url, e.g. `redis://:password@host:6379/0`, with every key prefixed by
+// prefix so one redis can hold several bots' state
+func OpenRedis(url, prefix string) (*Store, error) {
+	opts, err := redis.ParseURL(url)
+	if err != nil {
+		return nil, err
+	}
+	client := redis.NewClient(opts)
+	if err := client.Ping(context.Background()).Err(); err != nil {
+		return nil, err
+	}
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+	r := &redisState{client: client, prefix: prefix, replica: hex.EncodeToString(id), followers: make(map[string][]follower), seen: make(map[string]map[string]json.RawMessage)}
+	go r.listen()
+	return &Store{file: &file{redis: r, data: make(map[string]json.RawMessage)}}, nil
+}
+
+// OpenRedisReadOnly is OpenRedis without ever writing to redis, like OpenReadOnly
+func OpenRedisReadOnly(url, prefix string) (*Store, error) {
+	s, err := OpenRedis(url, prefix)
+	if err != nil {
+		return nil, err
+	}
+	s.file.readOnly = true
+	return s, nil
+}
+
+// load reads the key, a hash of the object's entries or, for anything else, the whole value
+func (r *redisState) load(key string) (json.RawMessage, bool, error) {
+	ctx := context.Background()
+	fields, err := r.client.HGetAll(ctx, r.prefix+key).Result()
+	if err != nil && strings.HasPrefix(err.Error(), "WRONGTYPE") {
+		return r.loadWhole(ctx, key)
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	if len(fields) == 0 {
+		return nil, false, nil
+	}
+	entries := make(map[string]json.RawMessage, len(fields))
+	for k, v := range fields {
+		entries[k] = json.RawMessage(v)
+	}
+	raw, err := json.Marshal(entries)
+	if err != nil {
+		return nil, false, err
+	}
+	r.mu.Lock()
+	r.seen[key] = entries
+	r.mu.Unlock()
+	return raw, true, nil
+}
+
+func (r *redisState) loadWhole(ctx context.Context, key string) (json.RawMessage, bool, error) {
+	raw, err := r.client.Get(ctx, r.prefix+key).Bytes()
+	if err == redis.Nil {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	r.mu.Lock()
+	delete(r.seen, key)
+	r.mu.Unlock()
+	return raw, true, nil
+}
+
+// save writes what changed in the key and tells the other replicas
+func (r *redisState) save(key string, raw json.RawMessage) error {
+	ctx := context.Background()
+	var entries map[string]json.RawMessage
+	if json.Unmarshal(raw, &entries) != nil || entries == nil {
+		if err := r.client.Set(ctx, r.prefix+key, []byte(raw), 0).Err(); err != nil {
+			return err
+		}
+		r.mu.Lock()
+		delete(r.seen, key)
+		r.mu.Unlock()
+		return r.publish(ctx, key)
+	}
+
+	r.mu.Lock()
+	seen, ok := r.seen[key]
+	r.mu.Unlock()
+	whole := false
+	if !ok {
+		// a value saved whole, e.g. before objects were kept as hashes, can't take fields
+		typ, err := r.client.Type(ctx, r.prefix+key).Result()
+		if err != nil {
+			return err
+		}
+		whole = typ == "string"
+	}
+	set, del := changedEntries(seen, entries)
+	if len(set) > 0 || len(del) > 0 || whole {
+		_, err := r.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			if whole {
+				pipe.Del(ctx, r.prefix+key)
+			}
+			if len(set) > 0 {
+				pipe.HSet(ctx, r.prefix+key, set...)
+			}
+			if len(del) > 0 {
+				pipe.HDel(ctx, r.prefix+key, del...)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	r.mu.Lock()
+	r.seen[key] = entries
+	r.mu.Unlock()
+	return r.publish(ctx, key)
+}
+
+// changedEntries is the HSET arguments for the entries that were added or changed since seen, and the entries that
+// were deleted.  entries nobody touched aren't written, so another replica's change to them isn't undone
+func changedEntries(seen, entries map[string]json.RawMessage) (set []interface{}, del []string) {
+	for k, v := range entries {
+		if old, ok := seen[k]; !ok || !bytes.Equal(old, v) {
+			set = append(set, k, []byte(v))
+		}
+	}
+	for k := range seen {
+		if _, ok := entries[k]; !ok {
+			del = append(del, k)
+		}
+	}
+	return set, del
+}
+
+func (r *redisState) publish(ctx context.Context, key string) error {
+	return r.client.Publish(ctx, r.prefix+savedChannel, r.replica+" "+key).Err()
+}
+
+func (r *redisState) follow(key string, v interface{}, mu sync.Locker) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.followers[key] = append(r.followers[key], follower{v: v, mu: mu})
+}
+
+func (r *redisState) watch(key string, fn func()) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.followers[key] = append(r.followers[key], follower{changed: fn})
+}
+
+// listen reloads the followers of keys the other replicas save, forever
+func (r *redisState) listen() {
+	sub := r.client.Subscribe(context.Background(), r.prefix+savedChannel)
+	for msg := range sub.Channel() {
+		parts := strings.SplitN(msg.Payload, " ", 2)
+		if len(parts) != 2 || parts[0] == r.replica {
+			continue
+		}
+		key := parts[1]
+		r.mu.Lock()
+		followers := r.followers[key]
+		r.mu.Unlock()
+		if len(followers) == 0 {
+			continue
+		}
+		raw, found, err := r.load(key)
+		if err != nil {
+			logrus.WithError(err).Errorf("failed to reload %s after another replica saved it", key)
+			continue
+		}
+		if !found {
+			// objects are hashes, and redis drops a hash with its last entry
+			raw = json.RawMessage("{}")
+		}
+		for _, f := range followers {
+			if f.changed != nil {
+				f.changed()
+				continue
+			}
+			f.mu.Lock()
+			err := replace(f.v, raw)
+			f.mu.Unlock()
+			if err != nil {
+				logrus.WithError(err).Errorf("failed to reload %s after another replica saved it, keeping what was there", key)
+			}
+		}
+	}
+}
+
+// replace sets what v points to to raw's value.  it decodes into a new value, so entries the other replica deleted
+// don't stay in maps, and v keeps its old value if raw doesn't decode
+func replace(v interface{}, raw json.RawMessage) error {
+	target := reflect.ValueOf(v).Elem()
+	fresh := reflect.New(target.Type())
+	if err := json.Unmarshal(raw, fresh.Interface()); err != nil {
+		return err
+	}
+	target.Set(fresh.Elem())
+	return nil
+}
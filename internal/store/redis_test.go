@@ -0,0 +1,55 @@
+package store
+
+import (
+	"encoding/json"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestChangedEntries(t *testing.T) {
+	seen := map[string]json.RawMessage{"kept": json.RawMessage(`1`), "changed": json.RawMessage(`2`), "deleted": json.RawMessage(`3`)}
+	entries := map[string]json.RawMessage{"kept": json.RawMessage(`1`), "changed": json.RawMessage(`20`), "added": json.RawMessage(`4`)}
+
+	set, del := changedEntries(seen, entries)
+
+	got := map[string]string{}
+	for i := 0; i < len(set); i += 2 {
+		got[set[i].(string)] = string(set[i+1].([]byte))
+	}
+	if want := map[string]string{"changed": "20", "added": "4"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("changedEntries() sets %v, want %v", got, want)
+	}
+	sort.Strings(del)
+	if want := []string{"deleted"}; !reflect.DeepEqual(del, want) {
+		t.Errorf("changedEntries() deletes %v, want %v", del, want)
+	}
+
+	// nothing seen yet, e.g. a key this replica never loaded: write everything, delete nothing
+	if set, del := changedEntries(nil, entries); len(set) != 2*len(entries) || len(del) != 0 {
+		t.Errorf("changedEntries(nil) = %v, %v, want every entry set", set, del)
+	}
+}
+
+func TestReplace(t *testing.T) {
+	v := state{Counts: map[string]int{"a": 1, "gone": 2}}
+	if err := replace(&v, json.RawMessage(`{"counts": {"a": 3}}`)); err != nil {
+		t.Fatal(err)
+	}
+	if want := map[string]int{"a": 3}; !reflect.DeepEqual(v.Counts, want) {
+		t.Errorf("replace() = %v, want %v", v.Counts, want)
+	}
+
+	if err := replace(&v, json.RawMessage(`{"counts": [`)); err == nil {
+		t.Error("replace() with broken JSON succeeded")
+	}
+	if want := map[string]int{"a": 3}; !reflect.DeepEqual(v.Counts, want) {
+		t.Errorf("a failed replace() left %v, want %v", v.Counts, want)
+	}
+	v.Counts["b"] = 4 // still writable
+
+	m := map[string]int{"gone": 1}
+	if err := replace(&m, json.RawMessage(`{}`)); err != nil || m == nil || len(m) != 0 {
+		t.Errorf("replace() with an emptied key = %v, %v, want an empty map", m, err)
+	}
+}
@@ -0,0 +1,147 @@
+// Package store persists the bot's state across restarts as one JSON document, one key per subsystem, or in redis
+// for replicas to share.
+package store
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// Store is the bot's state.  Without a path everything stays in memory and is forgotten on restart.
+type Store struct {
+	file   *file
+	prefix string
+}
+
+// file is the state file that a store and its namespaces share
+type file struct {
+	path string
+	// readOnly keeps saves in memory instead of writing the file
+	readOnly bool
+	// redis, if set, keeps the state in redis instead of the file, see OpenRedis
+	redis *redisState
+	mu    sync.Mutex
+	data  map[string]json.RawMessage
+}
+
+// Open loads the state file at path.  A missing file is an empty store
+func Open(path string) (*Store, error) {
+	f := &file{path: path, data: make(map[string]json.RawMessage)}
+	s := &Store{file: f}
+	if path == "" {
+		return s, nil
+	}
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(b, &f.data); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// OpenReadOnly loads the state file at path without ever writing it, for looking at the state of a bot that's running
+func OpenReadOnly(path string) (*Store, error) {
+	s, err := Open(path)
+	if err != nil {
+		return nil, err
+	}
+	s.file.readOnly = true
+	return s, nil
+}
+
+// ReadOnly reports whether saves are kept in memory only, see OpenReadOnly
+func (s *Store) ReadOnly() bool {
+	return s.file.readOnly
+}
+
+// Namespace returns a store whose keys are kept apart from this one's, in the same file
+func (s *Store) Namespace(prefix string) *Store {
+	return &Store{file: s.file, prefix: s.prefix + prefix + "/"}
+}
+
+// Shared reports whether other replicas see the state too, see OpenRedis
+func (s *Store) Shared() bool {
+	return s.file.redis != nil
+}
+
+// Load decodes the key's value into v, reporting whether there was one
+func (s *Store) Load(key string, v interface{}) (bool, error) {
+	f := s.file
+	f.mu.Lock()
+	raw, ok := f.data[s.prefix+key]
+	f.mu.Unlock()
+	// read-only stores keep their own saves, see OpenReadOnly
+	if f.redis != nil && !(ok && f.readOnly) {
+		var err error
+		if raw, ok, err = f.redis.load(s.prefix + key); err != nil {
+			return false, err
+		}
+	}
+	if !ok {
+		return false, nil
+	}
+	return true, json.Unmarshal(raw, v)
+}
+
+// Follow keeps v up to date with the key's value as other replicas save it, locking mu while it's replaced.  v is
+// what Load decoded the key into.  it does nothing unless the store is shared
+func (s *Store) Follow(key string, v interface{}, mu sync.Locker) {
+	if s.file.redis != nil {
+		s.file.redis.follow(s.prefix+key, v, mu)
+	}
+}
+
+// Watch calls fn whenever another replica saves the key, for values that need more than decoding, see Follow.  it does
+// nothing unless the store is shared
+func (s *Store) Watch(key string, fn func()) {
+	if s.file.redis != nil {
+		s.file.redis.watch(s.prefix+key, fn)
+	}
+}
+
+// Save sets the key to v and writes the state file, or redis.  the file is replaced atomically so a crash can't leave
+// half of it behind
+func (s *Store) Save(key string, v interface{}) error {
+	raw, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	f := s.file
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.data[s.prefix+key] = raw
+	if f.readOnly {
+		return nil
+	}
+	if f.redis != nil {
+		return f.redis.save(s.prefix+key, raw)
+	}
+	if f.path == "" {
+		return nil
+	}
+	b, err := json.Marshal(f.data)
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(f.path), filepath.Base(f.path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), f.path)
+}
@@ -0,0 +1,124 @@
+package store
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+type state struct {
+	Counts map[string]int `json:"counts"`
+}
+
+func TestSaveAndReopen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.json")
+	s, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := s.Load("counts", &state{}); ok || err != nil {
+		t.Fatalf("Load() from a missing file = %v, %v, want nothing", ok, err)
+	}
+	if err := s.Save("counts", state{Counts: map[string]int{"a": 1}}); err != nil {
+		t.Fatal(err)
+	}
+
+	reopened, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got state
+	if ok, err := reopened.Load("counts", &got); !ok || err != nil {
+		t.Fatalf("Load() = %v, %v, want the saved state", ok, err)
+	}
+	if got.Counts["a"] != 1 {
+		t.Errorf("Load() = %+v, want a: 1", got)
+	}
+	leftovers, _ := filepath.Glob(path + ".*")
+	if len(leftovers) != 0 {
+		t.Errorf("left temporary files behind: %v", leftovers)
+	}
+}
+
+func TestInMemory(t *testing.T) {
+	s, err := Open("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Save("k", 42); err != nil {
+		t.Fatal(err)
+	}
+	var got int
+	if ok, err := s.Load("k", &got); !ok || err != nil || got != 42 {
+		t.Errorf("Load() = %d, %v, %v, want 42", got, ok, err)
+	}
+	if s.Shared() || s.ReadOnly() {
+		t.Errorf("an in-memory store is shared or read-only")
+	}
+	s.Follow("k", &got, &sync.Mutex{}) // nothing to follow
+}
+
+func TestNamespace(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.json")
+	s, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, b := s.Namespace("a"), s.Namespace("b")
+	if err := a.Save("k", "from a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Save("k", "from b"); err != nil {
+		t.Fatal(err)
+	}
+
+	reopened, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for ns, want := range map[string]string{"a": "from a", "b": "from b"} {
+		var got string
+		if _, err := reopened.Namespace(ns).Load("k", &got); err != nil || got != want {
+			t.Errorf("namespace %s has %q, %v, want %q", ns, got, err, want)
+		}
+	}
+	if ok, _ := reopened.Load("k", new(string)); ok {
+		t.Errorf("the namespaces' keys leaked into the top level")
+	}
+}
+
+func TestReadOnly(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.json")
+	if err := os.WriteFile(path, []byte(`{"k": "on disk"}`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	s, err := OpenReadOnly(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Save("k", "in memory"); err != nil {
+		t.Fatal(err)
+	}
+	var got string
+	if _, err := s.Load("k", &got); err != nil || got != "in memory" {
+		t.Errorf("Load() = %q, %v, want its own save", got, err)
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != `{"k": "on disk"}` {
+		t.Errorf("a read-only store wrote %s", b)
+	}
+}
+
+func TestOpenCorrupt(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.json")
+	if err := os.WriteFile(path, []byte(`{"k":`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Open(path); err == nil {
+		t.Error("Open() of a corrupt file succeeded")
+	}
+}
@@ -0,0 +1,86 @@
+// Package webhook checks that gitlab webhook deliveries are genuine.
+package webhook
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+const (
+	HEADER_GITLAB_TOKEN   = "X-Gitlab-Token"
+	DEFAULT_REPLAY_WINDOW = time.Hour
+	DEFAULT_CLOCK_SKEW    = time.Minute
+)
+
+// gitlab isn't consistent about how it formats timestamps in webhooks
+var timeLayouts = []string{time.RFC3339, "2006-01-02 15:04:05 MST", "2006-01-02 15:04:05 -0700"}
+
+// Auth checks that webhooks come from gitlab, by the secret token configured on the project's webhook, and
+// that they aren't a captured delivery being replayed
+type Auth struct {
+	Secret string
+	// Window is how old an event may be.  Skew is how far our clock and gitlab's may disagree, either way
+	Window time.Duration
+	Skew   time.Duration
+}
+
+// Verify checks the request's token and event time, returning the status to reject it with and why
+func (a Auth) Verify(header http.Header, body []byte, now time.Time) (int, error) {
+	token := header.Get(HEADER_GITLAB_TOKEN)
+	if subtle.ConstantTimeCompare([]byte(token), []byte(a.Secret)) != 1 {
+		return http.StatusUnauthorized, fmt.Errorf("bad or missing %s header", HEADER_GITLAB_TOKEN)
+	}
+	at, ok := EventTime(body)
+	if !ok {
+		return http.StatusOK, nil // e.g. tag pushes, which carry no time of their own
+	}
+	if age := now.Sub(at); age > a.Window+a.Skew {
+		return http.StatusForbidden, fmt.Errorf("event from %s is older than the %s replay window", at.Format(time.RFC3339), a.Window)
+	} else if age < -a.Skew {
+		return http.StatusForbidden, fmt.Errorf("event from %s is in the future", at.Format(time.RFC3339))
+	}
+	return http.StatusOK, nil
+}
+
+// EventTime is the latest time the event carries.  MRs and issues have their update time, and finished pipelines and
+// jobs their finish time.  pipelines and jobs still in progress only carry when they were created or started, which a
+// long pipeline's later updates are well past, so they have no time of their own
+func EventTime(body []byte) (time.Time, bool) {
+	var ev struct {
+		ObjectKind       string `json:"object_kind"`
+		ObjectAttributes struct {
+			CreatedAt  string `json:"created_at"`
+			UpdatedAt  string `json:"updated_at"`
+			FinishedAt string `json:"finished_at"`
+		} `json:"object_attributes"`
+		// deployments
+		StatusChangedAt string `json:"status_changed_at"`
+		// jobs
+		BuildFinishedAt string `json:"build_finished_at"`
+	}
+	if err := json.Unmarshal(body, &ev); err != nil {
+		return time.Time{}, false
+	}
+	times := []string{ev.ObjectAttributes.CreatedAt, ev.ObjectAttributes.UpdatedAt, ev.ObjectAttributes.FinishedAt, ev.StatusChangedAt}
+	switch ev.ObjectKind {
+	case "pipeline":
+		times = []string{ev.ObjectAttributes.FinishedAt}
+	case "build":
+		times = []string{ev.BuildFinishedAt}
+	}
+	var latest time.Time
+	for _, s := range times {
+		for _, layout := range timeLayouts {
+			if t, err := time.Parse(layout, s); err == nil {
+				if t.After(latest) {
+					latest = t
+				}
+				break
+			}
+		}
+	}
+	return latest, !latest.IsZero()
+}
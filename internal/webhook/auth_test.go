@@ -0,0 +1,156 @@
+package webhook
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+var now = time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+
+func TestVerify(t *testing.T) {
+	auth := Auth{Secret: "s3cret", Window: DEFAULT_REPLAY_WINDOW, Skew: DEFAULT_CLOCK_SKEW}
+	tests := []struct {
+		name  string
+		token string
+		body  string
+		want  int
+	}{
+		{
+			name:  "fresh MR update",
+			token: "s3cret",
+			body:  `{"object_kind": "merge_request", "object_attributes": {"created_at": "2024-04-01 09:00:00 UTC", "updated_at": "2024-05-01 11:59:00 UTC"}}`,
+			want:  http.StatusOK,
+		},
+		{
+			name:  "wrong token",
+			token: "guess",
+			body:  `{"object_kind": "merge_request", "object_attributes": {"updated_at": "2024-05-01 11:59:00 UTC"}}`,
+			want:  http.StatusUnauthorized,
+		},
+		{
+			name: "missing token",
+			body: `{"object_kind": "merge_request", "object_attributes": {"updated_at": "2024-05-01 11:59:00 UTC"}}`,
+			want: http.StatusUnauthorized,
+		},
+		{
+			name:  "replayed MR update",
+			token: "s3cret",
+			body:  `{"object_kind": "merge_request", "object_attributes": {"updated_at": "2024-05-01 09:00:00 UTC"}}`,
+			want:  http.StatusForbidden,
+		},
+		{
+			name:  "from the future",
+			token: "s3cret",
+			body:  `{"object_kind": "merge_request", "object_attributes": {"updated_at": "2024-05-01 13:00:00 UTC"}}`,
+			want:  http.StatusForbidden,
+		},
+		{
+			name:  "within the clock skew",
+			token: "s3cret",
+			body:  `{"object_kind": "merge_request", "object_attributes": {"updated_at": "2024-05-01T12:00:30Z"}}`,
+			want:  http.StatusOK,
+		},
+		{
+			name:  "long pipeline still running",
+			token: "s3cret",
+			body:  `{"object_kind": "pipeline", "object_attributes": {"status": "running", "created_at": "2024-05-01 08:00:00 UTC", "finished_at": null}}`,
+			want:  http.StatusOK,
+		},
+		{
+			name:  "long pipeline just finished",
+			token: "s3cret",
+			body:  `{"object_kind": "pipeline", "object_attributes": {"status": "success", "created_at": "2024-05-01 08:00:00 UTC", "finished_at": "2024-05-01 11:58:00 UTC"}}`,
+			want:  http.StatusOK,
+		},
+		{
+			name:  "replayed finished pipeline",
+			token: "s3cret",
+			body:  `{"object_kind": "pipeline", "object_attributes": {"status": "failed", "created_at": "2024-04-30 08:00:00 UTC", "finished_at": "2024-04-30 09:00:00 UTC"}}`,
+			want:  http.StatusForbidden,
+		},
+		{
+			name:  "long job still running",
+			token: "s3cret",
+			body:  `{"object_kind": "build", "build_status": "running", "build_created_at": "2024-05-01 08:00:00 UTC", "build_started_at": "2024-05-01 08:01:00 UTC"}`,
+			want:  http.StatusOK,
+		},
+		{
+			name:  "replayed finished job",
+			token: "s3cret",
+			body:  `{"object_kind": "build", "build_status": "success", "build_started_at": "2024-04-30 08:00:00 UTC", "build_finished_at": "2024-04-30 08:30:00 UTC"}`,
+			want:  http.StatusForbidden,
+		},
+		{
+			name:  "tag push without a time",
+			token: "s3cret",
+			body:  `{"object_kind": "tag_push", "ref": "refs/tags/v1.0.0"}`,
+			want:  http.StatusOK,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			header := http.Header{}
+			if tt.token != "" {
+				header.Set(HEADER_GITLAB_TOKEN, tt.token)
+			}
+			got, err := auth.Verify(header, []byte(tt.body), now)
+			if got != tt.want {
+				t.Errorf("Verify() = %d (%v), want %d", got, err, tt.want)
+			}
+			if (err != nil) != (tt.want != http.StatusOK) {
+				t.Errorf("Verify() error = %v with status %d", err, got)
+			}
+		})
+	}
+}
+
+func TestEventTime(t *testing.T) {
+	tests := []struct {
+		name   string
+		body   string
+		want   time.Time
+		wantOK bool
+	}{
+		{
+			name:   "latest of an MR's times",
+			body:   `{"object_kind": "merge_request", "object_attributes": {"created_at": "2024-04-01 09:00:00 UTC", "updated_at": "2024-05-01 11:00:00 +0200"}}`,
+			want:   time.Date(2024, 5, 1, 9, 0, 0, 0, time.UTC),
+			wantOK: true,
+		},
+		{
+			name:   "deployment status change",
+			body:   `{"object_kind": "deployment", "status_changed_at": "2024-05-01T11:30:00Z"}`,
+			want:   time.Date(2024, 5, 1, 11, 30, 0, 0, time.UTC),
+			wantOK: true,
+		},
+		{
+			name:   "finished pipeline ignores its creation",
+			body:   `{"object_kind": "pipeline", "object_attributes": {"created_at": "2024-05-01 08:00:00 UTC", "finished_at": "2024-05-01 11:00:00 UTC"}}`,
+			want:   time.Date(2024, 5, 1, 11, 0, 0, 0, time.UTC),
+			wantOK: true,
+		},
+		{
+			name: "running pipeline",
+			body: `{"object_kind": "pipeline", "object_attributes": {"created_at": "2024-05-01 08:00:00 UTC"}}`,
+		},
+		{
+			name:   "finished job",
+			body:   `{"object_kind": "build", "build_started_at": "2024-05-01 08:00:00 UTC", "build_finished_at": "2024-05-01 10:00:00 UTC"}`,
+			want:   time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC),
+			wantOK: true,
+		},
+		{
+			name: "not json",
+			body: `<html>`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := EventTime([]byte(tt.body))
+			if ok != tt.wantOK || !got.Equal(tt.want) {
+				t.Errorf("EventTime() = %v, %v, want %v, %v", got, ok, tt.want, tt.wantOK)
+			}
+		})
+	}
+}